@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/drgomesp/etherspy/pkg/stats"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/rs/zerolog/log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Each accounting window spans at least accountingBuckets buckets of the
+// ledgers, so the shortest one slides smoothly.
+const accountingBuckets = 6
+
+// accounting attributes discovery traffic to the IPs and node IDs sending
+// it over sliding windows, ranks them and flags those over their quota.
+// Enabled with -accounting.
+type accounting struct {
+	windows []time.Duration // ascending
+	top     int
+	quota   uint64 // bytes per shortest window, 0 for none
+
+	ips, nodes *stats.Ledger
+}
+
+// accountingRow is a line of the accounting export.
+type accountingRow struct {
+	Window    string `json:"window"`
+	By        string `json:"by"` // ip or node
+	Rank      int    `json:"rank"`
+	Key       string `json:"key"`
+	Bytes     uint64 `json:"bytes"`
+	Packets   uint64 `json:"packets"`
+	OverQuota bool   `json:"over_quota,omitempty"`
+}
+
+// newAccounting parses a comma separated list of windows such as "1m,1h".
+func newAccounting(spec string, top int, quota uint64) (*accounting, error) {
+	var windows []time.Duration
+	for _, s := range strings.Split(spec, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid accounting window %q", s)
+		}
+		windows = append(windows, d)
+	}
+	if len(windows) == 0 {
+		return nil, fmt.Errorf("no accounting windows given")
+	}
+	sort.Slice(windows, func(i, j int) bool { return windows[i] < windows[j] })
+
+	resolution := windows[0] / accountingBuckets
+	if resolution < time.Second {
+		resolution = time.Second
+	}
+	n := int(windows[len(windows)-1]/resolution) + 1
+	return &accounting{
+		windows: windows,
+		top:     top,
+		quota:   quota,
+		ips:     stats.NewLedger(resolution, n),
+		nodes:   stats.NewLedger(resolution, n),
+	}, nil
+}
+
+// observeIP accounts a datagram of size bytes to the host of its source
+// address.
+func (a *accounting) observeIP(t time.Time, src string, size int) {
+	if host, _, err := net.SplitHostPort(src); err == nil {
+		src = host
+	}
+	a.ips.Add(t, src, size)
+}
+
+// observeNode accounts a decoded packet to its sender. Senders are keyed by
+// their discv5 node ID whatever the protocol.
+func (a *accounting) observeNode(t time.Time, id enode.ID, size int) {
+	a.nodes.Add(t, id.String(), size)
+}
+
+// observeV4 accounts a discv4 packet to its sender.
+func (a *accounting) observeV4(t time.Time, id discv4.NodeID, size int) {
+	a.observeNode(t, v4ID(id), size)
+}
+
+// rows ranks the senders of every window as of now.
+func (a *accounting) rows(now time.Time) []accountingRow {
+	var rows []accountingRow
+	for _, w := range a.windows {
+		for _, l := range []struct {
+			by     string
+			ledger *stats.Ledger
+		}{{"ip", a.ips}, {"node", a.nodes}} {
+			for i, acc := range l.ledger.Top(now, w, a.top) {
+				rows = append(rows, accountingRow{
+					Window:    w.String(),
+					By:        l.by,
+					Rank:      i + 1,
+					Key:       acc.Key,
+					Bytes:     acc.Bytes,
+					Packets:   acc.Packets,
+					OverQuota: a.quota > 0 && w == a.windows[0] && acc.Bytes > a.quota,
+				})
+			}
+		}
+	}
+	return rows
+}
+
+// report logs the heaviest sender of each window and those over quota.
+func (a *accounting) report(rows []accountingRow) {
+	for _, r := range rows {
+		if r.Rank == 1 {
+			log.Info().
+				Str("window", r.Window).
+				Str("by", r.By).
+				Str("key", r.Key).
+				Uint64("bytes", r.Bytes).
+				Uint64("packets", r.Packets).
+				Msg("heaviest sender")
+		}
+		if r.OverQuota {
+			log.Warn().
+				Str("window", r.Window).
+				Str("by", r.By).
+				Str("key", r.Key).
+				Uint64("bytes", r.Bytes).
+				Uint64("quota", a.quota).
+				Msg("sender over quota")
+		}
+	}
+}
+
+// save writes the rows to path, as CSV if it ends in .csv and JSON
+// otherwise, replacing the previous export.
+func (a *accounting) save(path string, rows []accountingRow) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if strings.HasSuffix(path, ".csv") {
+		w := csv.NewWriter(tmp)
+		w.Write([]string{"window", "by", "rank", "key", "bytes", "packets", "over_quota"})
+		for _, r := range rows {
+			w.Write([]string{r.Window, r.By, strconv.Itoa(r.Rank), r.Key, strconv.FormatUint(r.Bytes, 10), strconv.FormatUint(r.Packets, 10), strconv.FormatBool(r.OverQuota)})
+		}
+		w.Flush()
+		err = w.Error()
+	} else {
+		enc := json.NewEncoder(tmp)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(rows)
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/errcode"
+	"github.com/drgomesp/etherspy/pkg/match"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// controller applies runtime changes requested through the admin API.
+// Requests are run by the capture loop between packets, so they never race
+// with packet processing.
+type controller struct {
+	requests chan func()
+
+	paused  bool
+	capture *capture
+	bpf     string
+	dump    *dumper
+}
+
+func newController(handle *capture, bpf string) *controller {
+	return &controller{requests: make(chan func()), capture: handle, bpf: bpf}
+}
+
+// do runs fn on the capture loop and waits for its result.
+func (c *controller) do(fn func() (interface{}, error)) (interface{}, error) {
+	var (
+		v    interface{}
+		err  error
+		done = make(chan struct{})
+	)
+	c.requests <- func() {
+		v, err = fn()
+		close(done)
+	}
+	<-done
+	return v, err
+}
+
+type controlStatus struct {
+	Paused     bool            `json:"paused"`
+	BPF        string          `json:"bpf"`
+	Grep       string          `json:"grep"`
+	Match      string          `json:"match"`
+	Decoders   map[string]bool `json:"decoders"`
+	Enrichment []enrichStatus  `json:"enrichment,omitempty"`
+}
+
+func (c *controller) status() (interface{}, error) {
+	s := controlStatus{Paused: c.paused, BPF: c.bpf, Decoders: decoderStates()}
+	if grepPattern != nil {
+		s.Grep = grepPattern.String()
+	}
+	if matchExpr != nil {
+		s.Match = matchExpr.String()
+	}
+	if enrichment != nil {
+		s.Enrichment = enrichment.status()
+	}
+	return s, nil
+}
+
+// dumpState writes the internal state to a file, answering its path.
+func (c *controller) dumpState() (interface{}, error) {
+	path, err := c.dump.dump()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"path": path}, nil
+}
+
+func (c *controller) setPaused(paused bool) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		if c.paused != paused {
+			c.paused = paused
+			log.Info().Msgf("capture paused: %t", paused)
+		}
+		return c.status()
+	}
+}
+
+func (c *controller) setBPF(expr string) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		if err := c.capture.SetBPFFilter(expr); err != nil {
+			return nil, err
+		}
+		if following != nil {
+			// Narrow the new filter again to the hosts of the followed node.
+			following.baseFilter = expr
+			following.updateFilter()
+		}
+		if narrowing != nil {
+			narrowing.setBase(expr)
+		}
+		c.bpf = expr
+		log.Info().Msgf("capture filter set to %q", expr)
+		return c.status()
+	}
+}
+
+func (c *controller) setGrep(expr string) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		if expr == "" {
+			grepPattern = nil
+		} else {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, err
+			}
+			grepPattern = re
+		}
+		log.Info().Msgf("output pattern set to %q", expr)
+		return c.status()
+	}
+}
+
+func (c *controller) setMatch(expr string) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		if expr == "" {
+			matchExpr = nil
+		} else {
+			e, err := match.Compile(expr)
+			if err != nil {
+				return nil, err
+			}
+			matchExpr = e
+		}
+		log.Info().Msgf("output expression set to %q", expr)
+		return c.status()
+	}
+}
+
+// setTranscript selects the peer pair of the transcript, given as a,b,
+// dropping the entries recorded of the previous pair.
+func (c *controller) setTranscript(peers string) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		t, err := newTranscript(peers, *transcriptMax)
+		if err != nil {
+			return nil, err
+		}
+		conversation = t
+		log.Info().Msgf("recording the transcript of %s <-> %s", t.a, t.b)
+		return c.status()
+	}
+}
+
+// setDecoder toggles the decoder named protocol, or label/protocol when
+// several networks are monitored.
+func (c *controller) setDecoder(name string, enabled bool) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		for _, n := range networks {
+			for _, protocol := range []string{"discv4", "discv5"} {
+				if n.qualify(protocol) == name {
+					n.decoders.setEnabled(protocol, enabled)
+					log.Info().Msgf("%s decoder enabled: %t", name, enabled)
+					return c.status()
+				}
+			}
+		}
+		return nil, fmt.Errorf("unknown decoder %q", name)
+	}
+}
+
+// setEnrichStage toggles the enrichment stage named name.
+func (c *controller) setEnrichStage(name string, enabled bool) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		if enrichment == nil {
+			return nil, fmt.Errorf("no enrichment stage is running")
+		}
+		if err := enrichment.setEnabled(name, enabled); err != nil {
+			return nil, err
+		}
+		log.Info().Msgf("%s enrichment enabled: %t", name, enabled)
+		return c.status()
+	}
+}
+
+// serve runs the admin API on addr:
+//
+//	GET  /status                         current state
+//	POST /pause, /resume                 stop and restart reading packets
+//	POST /decoders/{name}/enable|disable toggle a decoder (label/protocol with -network)
+//	POST /enrich/{stage}/enable|disable  toggle an enrichment stage
+//	PUT  /bpf                            replace the capture filter (request body)
+//	PUT  /grep                           replace the output pattern, empty clears it
+//	PUT  /match                          replace the output expression, empty clears it
+//	GET  /nodes?limit=N                  nodes seen most recently, with -track-nodes
+//	GET  /nodes/{id}                     a single node, with -track-nodes
+//	GET  /error-codes                    decode error code taxonomy
+//	POST /dump                           write the internal state to -dump-dir
+func (c *controller) serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nodes", serveNodes)
+	mux.HandleFunc("/nodes/", serveNodes)
+	mux.HandleFunc("/error-codes", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(errcode.Taxonomy())
+	})
+	mux.HandleFunc("/status", c.handle(http.MethodGet, func(string) func() (interface{}, error) { return c.status }))
+	mux.HandleFunc("/pause", c.handle(http.MethodPost, func(string) func() (interface{}, error) { return c.setPaused(true) }))
+	mux.HandleFunc("/resume", c.handle(http.MethodPost, func(string) func() (interface{}, error) { return c.setPaused(false) }))
+	mux.HandleFunc("/dump", c.handle(http.MethodPost, func(string) func() (interface{}, error) { return c.dumpState }))
+	mux.HandleFunc("/bpf", c.handle(http.MethodPut, c.setBPF))
+	mux.HandleFunc("/grep", c.handle(http.MethodPut, c.setGrep))
+	mux.HandleFunc("/match", c.handle(http.MethodPut, c.setMatch))
+	mux.HandleFunc("/decoders/", c.toggle("/decoders/", c.setDecoder))
+	mux.HandleFunc("/enrich/", c.toggle("/enrich/", c.setEnrichStage))
+	log.Info().Msgf("admin API listening on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// toggle handles POST {prefix}{name}/enable|disable with set.
+func (c *controller) toggle(prefix string, set func(name string, enabled bool) func() (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, prefix)
+		i := strings.LastIndexByte(path, '/')
+		if i <= 0 || (path[i+1:] != "enable" && path[i+1:] != "disable") {
+			http.NotFound(w, r)
+			return
+		}
+		c.handle(http.MethodPost, func(string) func() (interface{}, error) {
+			return set(path[:i], path[i+1:] == "enable")
+		})(w, r)
+	}
+}
+
+// handle adapts a request taking the request body as argument to an HTTP
+// handler answering with the resulting state as JSON.
+func (c *controller) handle(method string, request func(body string) func() (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		v, err := c.do(request(strings.TrimSpace(string(body))))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+// serveNodes answers queries of the node table. The table is safe for
+// concurrent use, so queries don't go through the capture loop.
+func serveNodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if nodes == nil {
+		http.Error(w, "node tracking is disabled, set -track-nodes", http.StatusNotFound)
+		return
+	}
+
+	var v interface{}
+	if id := strings.TrimPrefix(r.URL.Path, "/nodes/"); id != r.URL.Path && id != "" {
+		nid, err := enode.ParseID(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n, ok := nodes.Get(nid)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		v = enrichNode(n)
+	} else {
+		limit := 100
+		if s := r.URL.Query().Get("limit"); s != "" {
+			l, err := strconv.Atoi(s)
+			if err != nil || l < 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = l
+		}
+		list := nodes.Nodes(limit)
+		for i := range list {
+			list[i] = enrichNode(list[i])
+		}
+		v = list
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/drgomesp/etherspy/pkg/stats"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// clientUnknown groups the peers of which no record with a client entry was
+// captured.
+const clientUnknown = "unknown"
+
+// peerAffinity counts the bonds and sessions of a peer.
+type peerAffinity struct {
+	addr     string
+	bonds    uint64 // discv4 pings starting a bond
+	sessions uint64 // discv5 handshakes
+	rebond   time.Duration
+	n        uint64 // intervals summed in rebond
+}
+
+// clientAffinity holds the distributions of a client implementation.
+type clientAffinity struct {
+	rebonds  stats.Histogram // between two bonds of a peer with an endpoint
+	sessions stats.Histogram // between two handshakes of a pair of endpoints
+}
+
+// affinity measures how often peers re-bond with the endpoints they talk
+// to, pinging them again in discv4, and re-handshake, replacing their
+// discv5 sessions, per client implementation as learned from records.
+// Clients whose median interval is below the threshold expire their bonds
+// or sessions too eagerly, costing both ends round trips and handshakes.
+// Enabled with -session-affinity.
+type affinity struct {
+	threshold time.Duration
+
+	bonds    map[[2]string]time.Time // last ping by pinger, pinged address
+	sessions map[[2]string]time.Time // last handshake by address pair, sorted
+	clients  map[enode.ID]string
+	peers    map[enode.ID]*peerAffinity
+	byClient map[string]*clientAffinity
+
+	lastExpire time.Time
+}
+
+func newAffinity(threshold time.Duration) *affinity {
+	return &affinity{
+		threshold: threshold,
+		bonds:     make(map[[2]string]time.Time),
+		sessions:  make(map[[2]string]time.Time),
+		clients:   make(map[enode.ID]string),
+		peers:     make(map[enode.ID]*peerAffinity),
+		byClient:  make(map[string]*clientAffinity),
+	}
+}
+
+func (a *affinity) peer(id enode.ID, addr string) *peerAffinity {
+	p := a.peers[id]
+	if p == nil {
+		p = &peerAffinity{addr: addr}
+		a.peers[id] = p
+	}
+	return p
+}
+
+// client returns the distributions of the client of the node id.
+func (a *affinity) client(id enode.ID) *clientAffinity {
+	name, ok := a.clients[id]
+	if !ok {
+		name = clientUnknown
+	}
+	c := a.byClient[name]
+	if c == nil {
+		c = new(clientAffinity)
+		a.byClient[name] = c
+	}
+	return c
+}
+
+// observeV4 accounts for a discv4 packet sent by the node id. A ping
+// repeated within the pong timeout is a retransmission, not a new bond.
+func (a *affinity) observeV4(rec *record, id enode.ID, pkt *discv4.Packet) {
+	a.expire(rec.Time)
+	switch pkt.Kind {
+	case discv4.PacketPing:
+	case discv4.PacketENRResponse:
+		if body, err := pkt.Body(); err == nil {
+			if r, ok := body.(*discv4.ENRResponse); ok {
+				a.observeRecord(&r.Record)
+			}
+		}
+		return
+	default:
+		return
+	}
+	key := [2]string{rec.Src, rec.Dst}
+	last, ok := a.bonds[key]
+	if ok && rec.Time.Sub(last) < pongTimeout {
+		return
+	}
+	a.bonds[key] = rec.Time
+	p := a.peer(id, rec.Src)
+	p.bonds++
+	if ok {
+		interval := rec.Time.Sub(last)
+		a.client(id).rebonds.Observe(interval)
+		p.rebond += interval
+		p.n++
+	}
+}
+
+// observeV5 accounts for a discv5 packet. A handshake replaces the session
+// of the pair of endpoints, whichever side initiates it; it is attributed
+// to the sender.
+func (a *affinity) observeV5(rec *record, p discv5.Packet) {
+	a.expire(rec.Time)
+	a.observeBody(p)
+	h, ok := p.(*discv5.Handshake)
+	if !ok {
+		return
+	}
+	key := [2]string{rec.Src, rec.Dst}
+	if key[1] < key[0] {
+		key[0], key[1] = key[1], key[0]
+	}
+	last, ok := a.sessions[key]
+	a.sessions[key] = rec.Time
+	peer := a.peer(h.SrcID, rec.Src)
+	peer.sessions++
+	if ok {
+		a.client(h.SrcID).sessions.Observe(rec.Time.Sub(last))
+	}
+}
+
+// expire forgets the bonds and sessions older than a day, at most once a
+// minute, so intervals are measured up to the bond expiration.
+func (a *affinity) expire(now time.Time) {
+	if now.Sub(a.lastExpire) < time.Minute {
+		return
+	}
+	a.lastExpire = now
+	for key, t := range a.bonds {
+		if now.Sub(t) > bondExpiration {
+			delete(a.bonds, key)
+		}
+	}
+	for key, t := range a.sessions {
+		if now.Sub(t) > bondExpiration {
+			delete(a.sessions, key)
+		}
+	}
+}
+
+// observeBody learns the clients of the nodes whose records a discv5
+// packet carries.
+func (a *affinity) observeBody(body interface{}) {
+	switch p := body.(type) {
+	case *discv5.Handshake:
+		a.observeRecord(p.Record)
+		a.observeBody(p.Body)
+	case *discv5.Message:
+		a.observeBody(p.Body)
+	case *discv5.Nodes:
+		for _, r := range p.Nodes {
+			a.observeRecord(r)
+		}
+	}
+}
+
+func (a *affinity) observeRecord(r *enr.Record) {
+	if r == nil {
+		return
+	}
+	client := recordClient(r)
+	if client == "" {
+		return
+	}
+	n, err := enode.New(enode.ValidSchemes, r)
+	if err != nil {
+		return
+	}
+	if i := strings.IndexByte(client, '/'); i >= 0 {
+		client = client[:i]
+	}
+	a.clients[n.ID()] = client
+}
+
+// report logs the re-bonding and session lifetime distributions of every
+// client, warns of the clients expiring them below the threshold, then
+// logs the peers bonding and handshaking again most often.
+func (a *affinity) report() {
+	if len(a.peers) == 0 {
+		return
+	}
+	names := make([]string, 0, len(a.byClient))
+	for name := range a.byClient {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := a.byClient[name]
+		log.Info().
+			Str("client", name).
+			Uint64("rebonds", c.rebonds.Count()).
+			Dur("rebond_p10", c.rebonds.Quantile(0.1)).
+			Dur("rebond_p50", c.rebonds.Quantile(0.5)).
+			Dur("rebond_p90", c.rebonds.Quantile(0.9)).
+			Uint64("sessions", c.sessions.Count()).
+			Dur("session_p10", c.sessions.Quantile(0.1)).
+			Dur("session_p50", c.sessions.Quantile(0.5)).
+			Dur("session_p90", c.sessions.Quantile(0.9)).
+			Msg("session affinity")
+		if c.rebonds.Count() > 0 && c.rebonds.Quantile(0.5) < a.threshold {
+			log.Warn().Str("client", name).Dur("rebond_p50", c.rebonds.Quantile(0.5)).
+				Msgf("%s nodes re-bond every %s, more often than every %s", name, c.rebonds.Quantile(0.5), a.threshold)
+		}
+		if c.sessions.Count() > 0 && c.sessions.Quantile(0.5) < a.threshold {
+			log.Warn().Str("client", name).Dur("session_p50", c.sessions.Quantile(0.5)).
+				Msgf("%s nodes re-handshake every %s, more often than every %s", name, c.sessions.Quantile(0.5), a.threshold)
+		}
+	}
+
+	churn := func(p *peerAffinity) uint64 { return p.bonds + p.sessions }
+	ids := make([]enode.ID, 0, len(a.peers))
+	for id, p := range a.peers {
+		if churn(p) > 1 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if x, y := churn(a.peers[ids[i]]), churn(a.peers[ids[j]]); x != y {
+			return x > y
+		}
+		return ids[i].String() < ids[j].String()
+	})
+	if len(ids) > 10 {
+		ids = ids[:10]
+	}
+	for _, id := range ids {
+		p := a.peers[id]
+		client, ok := a.clients[id]
+		if !ok {
+			client = clientUnknown
+		}
+		ev := enrichEvent(log.Info().Str("node", id.TerminalString()).Str("endpoint", p.addr), p.addr).
+			Str("client", client).
+			Uint64("bonds", p.bonds).
+			Uint64("handshakes", p.sessions)
+		if p.n > 0 {
+			ev = ev.Dur("rebond_mean", p.rebond/time.Duration(p.n))
+		}
+		ev.Msg("peer session churn")
+	}
+}
@@ -0,0 +1,120 @@
+//go:build linux && cgo
+
+package main
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// afpacketSource captures through a TPACKETv3 ring shared with the kernel,
+// without libpcap. Filters are compiled like those of the other backends
+// and attached to the socket. Interfaces aren't switched to promiscuous
+// mode, which a node's own traffic doesn't need.
+type afpacketSource struct {
+	*afpacket.TPacket
+	snaplen  int
+	loopback bool
+
+	// The ring is unmapped on close, reads hold mu so it never happens
+	// under them, as pcap handles do.
+	mu     sync.Mutex
+	closed bool
+}
+
+// afpacketPoll bounds how long a read waits for packets, and so how long
+// closing the capture waits for the read in progress.
+const afpacketPoll = 100 * time.Millisecond
+
+// skipOutgoing rejects packets sent by the host, which loopback interfaces
+// would otherwise deliver twice, as libpcap does.
+var skipOutgoing = []bpf.Instruction{
+	bpf.LoadExtension{Num: bpf.ExtType},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: unix.PACKET_OUTGOING, SkipFalse: 1},
+	bpf.RetConstant{Val: 0},
+}
+
+// openAFPacket opens an AF_PACKET capture on device, with a ring about the
+// size of the preset's capture buffer and delivering packets within a
+// millisecond with a low latency preset.
+func openAFPacket(p perfPreset, device string, snaplen int) (source, error) {
+	page := os.Getpagesize()
+	// Frames hold a packet and its TPACKETv3 header.
+	frame := (snaplen + 128 + page - 1) / page * page
+	block := frame * 128
+	blocks := afpacket.DefaultNumBlocks
+	if p.captureBuffer != 0 {
+		blocks = p.captureBuffer / block
+		if blocks < 1 {
+			blocks = 1
+		}
+	}
+	timeout := afpacket.DefaultBlockTimeout
+	if p.immediate {
+		timeout = time.Millisecond
+	}
+
+	tp, err := afpacket.NewTPacket(
+		afpacket.OptInterface(device),
+		afpacket.OptFrameSize(frame),
+		afpacket.OptBlockSize(block),
+		afpacket.OptNumBlocks(blocks),
+		afpacket.OptBlockTimeout(timeout),
+		afpacket.OptPollTimeout(afpacketPoll),
+		afpacket.TPacketVersion3,
+	)
+	if err != nil {
+		return nil, err
+	}
+	src := &afpacketSource{TPacket: tp, snaplen: snaplen}
+	if ifi, err := net.InterfaceByName(device); err == nil {
+		src.loopback = ifi.Flags&net.FlagLoopback != 0
+	}
+	return src, nil
+}
+
+func (s *afpacketSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	return s.TPacket.ReadPacketData()
+}
+
+func (s *afpacketSource) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.TPacket.Close()
+	}
+}
+
+func (s *afpacketSource) LinkType() layers.LinkType { return layers.LinkTypeEthernet }
+
+func (s *afpacketSource) SnapLen() int { return s.snaplen }
+
+func (s *afpacketSource) SetBPFFilter(expr string) error {
+	prog, err := compileBPF(layers.LinkTypeEthernet, s.snaplen, expr)
+	if err != nil {
+		return err
+	}
+	if s.loopback {
+		skip, err := bpf.Assemble(skipOutgoing)
+		if err != nil {
+			return err
+		}
+		// Jumps are relative, the filter runs on unchanged.
+		prog = append(skip, prog...)
+	}
+	return s.SetBPF(prog)
+}
@@ -0,0 +1,9 @@
+//go:build !linux || !cgo
+
+package main
+
+import "errors"
+
+func openAFPacket(perfPreset, string, int) (source, error) {
+	return nil, errors.New("AF_PACKET capture needs linux and cgo")
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/sink"
+	"github.com/rs/zerolog/log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scopes of alert rules: packets of all sources, of every source IP or of
+// every node ID exceeding a rate, or a sudden rise of the overall rate.
+const (
+	alertTotal = "total"
+	alertIP    = "ip"
+	alertNode  = "node"
+	alertSpike = "spike"
+)
+
+// A spike is measured against the mean rate of the windows before it,
+// once spikeWarmup windows were seen. Windows of a spike are left out of
+// the mean so a long spike keeps firing.
+const (
+	spikeWarmup = 5
+	spikeWeight = 0.2
+)
+
+// alertTimeout bounds the delivery of an alert to a webhook, alertQueue the
+// alerts waiting to be delivered before new ones are dropped.
+const (
+	alertTimeout = 5 * time.Second
+	alertQueue   = 64
+)
+
+// alertList collects the values of the repeatable -alert flag.
+type alertList []string
+
+func (l *alertList) String() string { return strings.Join(*l, " ") }
+
+func (l *alertList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// alertRule is a threshold on the packets matching kind, counted over
+// windows of a fixed length per key of its scope.
+type alertRule struct {
+	name      string
+	scope     string
+	kind      string // protocol/kind or protocol, empty for all packets
+	threshold float64
+
+	counts map[string]uint64 // by source IP or node ID in the current window
+	firing map[string]bool
+
+	baseline float64 // of spikes, in packets per second
+	windows  int
+}
+
+// parseAlertRule parses a rule given as [name=]scope[:kind]>threshold.
+func parseAlertRule(spec string) (*alertRule, error) {
+	r := &alertRule{name: spec, counts: make(map[string]uint64), firing: make(map[string]bool)}
+	rest := spec
+	if i := strings.IndexByte(spec, '='); i >= 0 {
+		r.name, rest = spec[:i], spec[i+1:]
+	}
+	i := strings.IndexByte(rest, '>')
+	if i < 0 {
+		return nil, fmt.Errorf("invalid alert %q, want [name=]scope[:kind]>threshold", spec)
+	}
+	threshold, err := strconv.ParseFloat(rest[i+1:], 64)
+	if err != nil || threshold <= 0 {
+		return nil, fmt.Errorf("invalid alert %q: threshold must be a positive number", spec)
+	}
+	r.threshold = threshold
+	r.scope = rest[:i]
+	if j := strings.IndexByte(r.scope, ':'); j >= 0 {
+		r.scope, r.kind = r.scope[:j], r.scope[j+1:]
+	}
+	switch r.scope {
+	case alertTotal, alertIP, alertNode, alertSpike:
+	default:
+		return nil, fmt.Errorf("invalid alert %q: unknown scope %q, want %s, %s, %s or %s", spec, r.scope, alertTotal, alertIP, alertNode, alertSpike)
+	}
+	return r, nil
+}
+
+// matches reports whether a packet of protocol and kind is counted.
+func (r *alertRule) matches(protocol, kind string) bool {
+	return r.kind == "" || r.kind == protocol || r.kind == protocol+"/"+kind
+}
+
+// alert is a rule starting or ceasing to fire, as delivered to webhooks.
+type alert struct {
+	Time      time.Time `json:"time"`
+	Rule      string    `json:"rule"`
+	State     string    `json:"state"` // firing or resolved
+	Key       string    `json:"key,omitempty"`
+	Rate      float64   `json:"rate"`
+	Threshold float64   `json:"threshold"`
+}
+
+func (a alert) String() string {
+	s := fmt.Sprintf("etherspy alert %s %s", a.Rule, a.State)
+	if a.Key != "" {
+		s += " for " + a.Key
+	}
+	return s + fmt.Sprintf(": %.2f packets/s, threshold %g", a.Rate, a.Threshold)
+}
+
+// alerting evaluates rules on the rates of decoded packets at the end of
+// every window, firing an alert when a rule is exceeded and resolving it
+// once the rate is back under its threshold. Alerts are logged, and posted
+// to a webhook as JSON, to Slack as messages and as CloudEvents with
+// -cloudevents, off the capture loop.
+// Enabled with -alert.
+type alerting struct {
+	rules  []*alertRule
+	window time.Duration
+	start  time.Time
+	fired  uint64
+
+	webhook, slack string
+	queue          chan alert
+	done           sync.WaitGroup
+}
+
+func newAlerting(specs []string, window time.Duration, webhook, slack string) (*alerting, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("-alert-window must be positive")
+	}
+	a := &alerting{window: window, webhook: webhook, slack: slack}
+	for _, spec := range specs {
+		r, err := parseAlertRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		a.rules = append(a.rules, r)
+	}
+	if webhook != "" || slack != "" {
+		a.queue = make(chan alert, alertQueue)
+		a.done.Add(1)
+		go a.deliver()
+	}
+	return a, nil
+}
+
+// observe counts a decoded packet against the rules matching it.
+func (a *alerting) observe(rec *record) {
+	if a.start.IsZero() {
+		a.start = rec.Time
+	}
+	if rec.Time.Sub(a.start) >= a.window {
+		a.evaluate(a.window)
+		a.start = a.start.Add(a.window)
+		if rec.Time.Sub(a.start) >= a.window {
+			// Nothing matched in between, the next window starts now.
+			a.evaluate(a.window)
+			a.start = rec.Time
+		}
+	}
+	for _, r := range a.rules {
+		if !r.matches(rec.Protocol, rec.Kind) {
+			continue
+		}
+		var key string
+		switch r.scope {
+		case alertIP:
+			if host, _, err := net.SplitHostPort(rec.Src); err == nil {
+				key = host
+			}
+		case alertNode:
+			if rec.NodeID != nil {
+				key, _ = rec.NodeID()
+			}
+		}
+		if key == "" && (r.scope == alertIP || r.scope == alertNode) {
+			continue
+		}
+		r.counts[key]++
+	}
+}
+
+// evaluate closes the current window, of length d, firing and resolving
+// alerts.
+func (a *alerting) evaluate(d time.Duration) {
+	end := a.start.Add(d)
+	for _, r := range a.rules {
+		exceeded := make(map[string]float64)
+		for key, n := range r.counts {
+			rate := float64(n) / d.Seconds()
+			if r.scope == alertSpike {
+				spiking := r.windows >= spikeWarmup && r.baseline > 0 && rate > r.threshold*r.baseline
+				if spiking {
+					exceeded[key] = rate
+				} else {
+					r.baseline += (rate - r.baseline) * spikeWeight
+				}
+				r.windows++
+			} else if rate > r.threshold {
+				exceeded[key] = rate
+			}
+		}
+		if r.scope == alertSpike && len(r.counts) == 0 {
+			r.baseline -= r.baseline * spikeWeight
+			r.windows++
+		}
+
+		keys := make([]string, 0, len(exceeded))
+		for key := range exceeded {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if !r.firing[key] {
+				r.firing[key] = true
+				a.notify(alert{Time: end, Rule: r.name, State: "firing", Key: key, Rate: exceeded[key], Threshold: r.threshold})
+			}
+		}
+		for key := range r.firing {
+			if _, ok := exceeded[key]; !ok {
+				delete(r.firing, key)
+				a.notify(alert{Time: end, Rule: r.name, State: "resolved", Key: key, Rate: float64(r.counts[key]) / d.Seconds(), Threshold: r.threshold})
+			}
+		}
+		r.counts = make(map[string]uint64)
+	}
+}
+
+// notify logs an alert and queues it for delivery.
+func (a *alerting) notify(al alert) {
+	ev := log.Info()
+	if al.State == "firing" {
+		a.fired++
+		ev = log.Warn()
+	}
+	if al.Key != "" {
+		ev = ev.Str("key", al.Key)
+		if net.ParseIP(al.Key) != nil {
+			ev = enrichEvent(ev, al.Key)
+		}
+	}
+	ev.Time("at", al.Time).
+		Float64("rate", al.Rate).
+		Float64("threshold", al.Threshold).
+		Msgf("alert %s %s", al.Rule, al.State)
+	if cloudEvents != nil {
+		if err := cloudEvents.Emit(sink.EventAlert, al.Key, al.Time, al, map[string]string{"rule": al.Rule, "state": al.State}); err != nil {
+			log.Warn().Err(err).Msg("cloudevents sink")
+		}
+	}
+	if a.queue == nil {
+		return
+	}
+	select {
+	case a.queue <- al:
+	default:
+		log.Warn().Msgf("alert %s not delivered, %d alerts already waiting", al.Rule, alertQueue)
+	}
+}
+
+// deliver posts the queued alerts until the queue is closed.
+func (a *alerting) deliver() {
+	defer a.done.Done()
+	client := http.Client{Timeout: alertTimeout}
+	for al := range a.queue {
+		if a.webhook != "" {
+			body, _ := json.Marshal(al)
+			if err := post(&client, a.webhook, body); err != nil {
+				log.Warn().Err(err).Msg("could not deliver alert to webhook")
+			}
+		}
+		if a.slack != "" {
+			body, _ := json.Marshal(struct {
+				Text string `json:"text"`
+			}{al.String()})
+			if err := post(&client, a.slack, body); err != nil {
+				log.Warn().Err(err).Msg("could not deliver alert to Slack")
+			}
+		}
+	}
+}
+
+func post(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// close evaluates the window left open at the end of the capture, over the
+// time it lasted, and waits for the alerts to be delivered.
+func (a *alerting) close(lastSeen time.Time) {
+	if !a.start.IsZero() {
+		d := lastSeen.Sub(a.start)
+		if d < time.Second {
+			d = time.Second
+		}
+		a.evaluate(d)
+	}
+	if a.queue != nil {
+		close(a.queue)
+		a.done.Wait()
+	}
+}
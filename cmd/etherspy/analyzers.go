@@ -0,0 +1,595 @@
+package main
+
+import (
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/errcode"
+	"github.com/drgomesp/etherspy/pkg/stats"
+	"github.com/drgomesp/etherspy/pkg/tracker"
+	"github.com/google/gopacket"
+	"github.com/rs/zerolog/log"
+	"os"
+	"time"
+)
+
+// Sizing of the seen node ID filter, about 12MB on disk.
+const (
+	seenCapacity = 10_000_000
+	seenFPRate   = 0.01
+)
+
+// Keys of the time series analyzers keep. Per protocol ones are followed
+// by the protocol, and those of kinds by protocol/kind.
+const (
+	seriesPackets  = "packets"
+	seriesNewNodes = "nodes/new"
+	seriesDecoded  = "decoded/"
+	seriesFailed   = "failed/"
+	seriesKinds    = "kinds/"
+)
+
+// seriesSpan is the time the series cover, an hour or the span of
+// -sparkline if longer.
+func seriesSpan() time.Duration {
+	if span := *sparklineSpan + *sparklineSpan/sparkColumns; span > time.Hour {
+		return span
+	}
+	return time.Hour
+}
+
+// analyzers holds the aggregate statistics kept over a capture. Optional
+// analyzers are nil when disabled.
+type analyzers struct {
+	timer *stats.StageTimer
+
+	series     *stats.Series
+	packetRate *stats.EWMA
+	total      uint64
+	kinds      map[string]uint64
+	errors     map[string]uint64
+
+	seen *stats.Bloom
+
+	uniqueNodes, uniqueIPs *stats.Cardinality
+
+	talkerIPs, talkerNodes *stats.TopK
+	lastDecay              time.Time
+
+	tails      *tails
+	versions   *versionTimeline
+	metrics    *metrics
+	holePunch  *holePunches
+	proofs     *endpointProofs
+	affinity   *affinity
+	prints     *fingerprints
+	alerts     *alerting
+	lookups    *lookups
+	suggest    *suggestions
+	rpc        *rpcTimeline
+	libp2p     *libp2pTraffic
+	paths      *ipPaths
+	handshakes *handshakes
+	chains     *chains
+	accounting *accounting
+	ghosts     *ghosts
+	topology   *topologyGraph
+	batch      *batchReport
+	dashboard  *dashboard
+	spark      *sparklines
+
+	// Timestamp of the most recent packet, windows are relative to it so
+	// offline captures report meaningful values.
+	lastSeen time.Time
+}
+
+func newAnalyzers() (*analyzers, error) {
+	a := &analyzers{
+		series:     stats.NewSeries(time.Second, seriesSpan()),
+		packetRate: stats.NewEWMA(time.Minute),
+		kinds:      make(map[string]uint64),
+		errors:     make(map[string]uint64),
+	}
+
+	if *profileStages {
+		a.timer = stats.NewStageTimer()
+	}
+
+	if *cardinality {
+		a.uniqueNodes, a.uniqueIPs = stats.NewCardinality(), stats.NewCardinality()
+	}
+
+	if *topTalkers > 0 {
+		capacity := 10 * *topTalkers
+		if capacity < 100 {
+			capacity = 100
+		}
+		a.talkerIPs, a.talkerNodes = stats.NewTopK(capacity), stats.NewTopK(capacity)
+	}
+
+	if *tailStats {
+		a.tails = newTails()
+	}
+
+	if *holePunching {
+		a.holePunch = newHolePunches()
+	}
+
+	if *endpointProofTracking {
+		a.proofs = newEndpointProofs()
+	}
+
+	if len(alertRules) > 0 {
+		alerts, err := newAlerting(alertRules, *alertWindow, *alertWebhook, *alertSlack)
+		if err != nil {
+			return nil, err
+		}
+		a.alerts = alerts
+	}
+
+	if *sessionAffinity > 0 {
+		a.affinity = newAffinity(*sessionAffinity)
+	}
+
+	if *fingerprint {
+		a.prints = newFingerprints()
+	}
+
+	if *findNodeAnalysis {
+		a.lookups = newLookups()
+	}
+
+	if *suggestOut != "" || *suggestGeth != "" {
+		if *suggestCount < 1 {
+			return nil, fmt.Errorf("-suggest-count must be positive")
+		}
+		a.suggest = newSuggestions(*suggestCount, *suggestOut, *suggestGeth)
+		if a.proofs == nil {
+			a.proofs = newEndpointProofs()
+		}
+	}
+
+	if *rpcPorts != "" {
+		rpc, err := newRPCTimeline(*rpcPorts)
+		if err != nil {
+			return nil, err
+		}
+		a.rpc = rpc
+	}
+
+	if *libp2pPorts != "" {
+		libp2p, err := newLibp2pTraffic(*libp2pPorts)
+		if err != nil {
+			return nil, err
+		}
+		a.libp2p = libp2p
+	}
+
+	if *ipHeaders {
+		a.paths = newIPPaths()
+	}
+
+	if *handshakeEvents {
+		a.handshakes = newHandshakes()
+	}
+
+	if *classifyNetworks {
+		a.chains = newChains()
+	}
+
+	if *tuiMode {
+		a.dashboard = newDashboard(a.series, newLogRing(tuiLogLines))
+	}
+
+	if *sparklineSpan > 0 {
+		a.spark = newSparklines(a.series, *sparklineSpan, os.Stderr)
+	}
+
+	if *ghostEntries {
+		a.ghosts = newGhosts(*ghostWindow)
+	}
+
+	if batchMode {
+		a.batch = newBatchReport(batchOut, *fname)
+	}
+
+	if *topologyOut != "" {
+		if *topologyMaxEdges < 1 {
+			return nil, fmt.Errorf("-topology-max-edges must be positive")
+		}
+		a.topology = newTopologyGraph(*topologyOut, *topologyMaxEdges)
+	}
+
+	if *accountingWindows != "" {
+		acc, err := newAccounting(*accountingWindows, *accountingTop, uint64(*accountingQuota))
+		if err != nil {
+			return nil, err
+		}
+		a.accounting = acc
+	}
+
+	if *versionsOut != "" {
+		v, err := newVersionTimeline(*versionsBucket, *versionsAdoption)
+		if err != nil {
+			return nil, err
+		}
+		a.versions = v
+	}
+
+	if *metricsAddr != "" {
+		a.metrics = newMetrics()
+	}
+
+	if *seenDB != "" {
+		seen, err := stats.LoadBloom(*seenDB, seenCapacity, seenFPRate)
+		if err != nil {
+			return nil, err
+		}
+		log.Info().Msgf("loaded %d previously seen node IDs from %q", seen.Count(), *seenDB)
+		a.seen = seen
+	}
+
+	return a, nil
+}
+
+// observePacket accounts for a captured packet.
+func (a *analyzers) observePacket(packet gopacket.Packet) {
+	a.lastSeen = packetTime(packet)
+	a.total++
+	a.series.Add(seriesPackets, a.lastSeen, 1)
+	a.packetRate.Add(a.lastSeen, 1)
+	if a.metrics != nil {
+		a.metrics.captured.Inc()
+	}
+
+	// Top talker counts are halved every minute of capture time, so
+	// rankings reflect recent traffic.
+	if a.talkerIPs != nil || a.dashboard != nil {
+		if a.lastDecay.IsZero() {
+			a.lastDecay = a.lastSeen
+		}
+		for ; a.lastSeen.Sub(a.lastDecay) >= time.Minute; a.lastDecay = a.lastDecay.Add(time.Minute) {
+			if a.talkerIPs != nil {
+				a.talkerIPs.Decay(0.5)
+				a.talkerNodes.Decay(0.5)
+			}
+			if a.dashboard != nil {
+				a.dashboard.decay()
+			}
+		}
+	}
+
+	if network := packet.NetworkLayer(); network != nil {
+		src := network.NetworkFlow().Src()
+		if a.uniqueIPs != nil {
+			a.uniqueIPs.Add(a.lastSeen, src.Raw())
+		}
+		if a.talkerIPs != nil {
+			a.talkerIPs.Add(src.String(), 1)
+		}
+	}
+}
+
+// clock returns the time live views are drawn at: the current time when
+// capturing live, that of the latest packet when reading a file.
+func (a *analyzers) clock() time.Time {
+	if *fname == "" {
+		return time.Now()
+	}
+	return a.lastSeen
+}
+
+// observePayload accounts for a payload of size bytes handed to the
+// decoders.
+func (a *analyzers) observePayload(size int) {
+	if a.metrics != nil {
+		a.metrics.bytes.Add(float64(size))
+	}
+}
+
+// observeKind accounts for a successfully decoded packet of size bytes.
+func (a *analyzers) observeKind(protocol, kind string, size int) {
+	a.kinds[protocol+"/"+kind]++
+	a.series.Add(seriesDecoded+protocol, a.lastSeen, 1)
+	a.series.Add(seriesKinds+protocol+"/"+kind, a.lastSeen, 1)
+	if a.metrics != nil {
+		a.metrics.observeDecoded(protocol, kind, size)
+	}
+	if a.rpc != nil {
+		a.rpc.observeDiscovery(a.lastSeen, false)
+	}
+	if a.batch != nil {
+		a.batch.observeKind(protocol, a.lastSeen)
+	}
+}
+
+// observeError accounts for a packet that failed to decode.
+func (a *analyzers) observeError(protocol string, err error) {
+	a.errors[protocol]++
+	// The protocol is listed with its rates even if nothing decoded yet.
+	a.series.Touch(seriesDecoded + protocol)
+	a.series.Add(seriesFailed+protocol, a.lastSeen, 1)
+	if a.metrics != nil {
+		a.metrics.observeError(protocol, err)
+	}
+	if a.dashboard != nil {
+		a.dashboard.observeError(err)
+	}
+	if a.batch != nil {
+		a.batch.observeError(protocol, err, a.lastSeen)
+	}
+	if influx != nil {
+		if err := influx.Failure(a.lastSeen, protocol, errcode.ID(err)); err != nil {
+			log.Warn().Err(err).Msg("influx sink")
+		}
+	}
+	if a.rpc != nil {
+		a.rpc.observeDiscovery(a.lastSeen, true)
+	}
+}
+
+// wantsNodeIDs reports whether any analyzer needs the sender's node ID,
+// which may be expensive to recover.
+func (a *analyzers) wantsNodeIDs() bool {
+	return a.seen != nil || a.uniqueNodes != nil || a.talkerNodes != nil || a.metrics != nil || a.accounting != nil || a.dashboard != nil || nodes != nil
+}
+
+// observeNode accounts for a packet sent by the node with the given ID.
+func (a *analyzers) observeNode(id fmt.Stringer, raw []byte) {
+	if a.seen != nil && a.seen.Add(raw) {
+		a.series.Add(seriesNewNodes, a.lastSeen, 1)
+	}
+	if a.uniqueNodes != nil {
+		a.uniqueNodes.Add(a.lastSeen, raw)
+	}
+	if a.talkerNodes != nil {
+		a.talkerNodes.Add(id.String(), 1)
+	}
+	if a.metrics != nil {
+		a.metrics.observeNode(raw)
+	}
+	if a.dashboard != nil {
+		a.dashboard.observeNode(id.String())
+	}
+}
+
+// report logs every enabled analyzer.
+func (a *analyzers) report() {
+	if reports != nil {
+		reports.begin()
+		defer reports.end(a.lastSeen)
+	}
+	a.reportTraffic()
+	a.reportStages()
+	a.reportNewNodes()
+	a.reportCardinality()
+	a.reportTopTalkers()
+	if a.tails != nil {
+		a.tails.report()
+	}
+	if a.holePunch != nil {
+		a.holePunch.report()
+	}
+	if a.proofs != nil {
+		a.proofs.report()
+	}
+	if a.affinity != nil {
+		a.affinity.report()
+	}
+	if a.prints != nil {
+		a.prints.report()
+	}
+	if a.lookups != nil {
+		a.lookups.report()
+	}
+	if a.rpc != nil {
+		a.rpc.report()
+	}
+	if a.libp2p != nil {
+		a.libp2p.report()
+	}
+	if a.paths != nil {
+		a.paths.report()
+	}
+	if enrichment != nil {
+		enrichment.report()
+	}
+	if decoding != nil {
+		decoding.report()
+	}
+	if decapsulator != nil {
+		decapsulator.report()
+	}
+	if reassembler != nil {
+		reassembler.report()
+	}
+	if a.handshakes != nil {
+		a.handshakes.report()
+	}
+	if a.chains != nil {
+		a.chains.report()
+	}
+	if a.ghosts != nil && !a.lastSeen.IsZero() {
+		a.ghosts.report(a.lastSeen)
+	}
+	if a.topology != nil {
+		a.topology.report()
+	}
+	if a.accounting != nil && !a.lastSeen.IsZero() {
+		rows := a.accounting.rows(a.lastSeen)
+		a.accounting.report(rows)
+		if *accountingOut != "" {
+			if err := a.accounting.save(*accountingOut, rows); err != nil {
+				log.Warn().Err(err).Msg("could not write traffic accounting")
+			}
+		}
+	}
+	if nodes != nil && !a.lastSeen.IsZero() {
+		reportNodes(a.lastSeen)
+	}
+	if a.suggest != nil && !a.lastSeen.IsZero() {
+		a.suggest.update(a.lastSeen, a.proofs, a.lookups)
+	}
+	if db != nil {
+		saveNodes()
+	}
+	if a.versions != nil {
+		a.versions.report()
+		if err := a.versions.save(*versionsOut); err != nil {
+			log.Warn().Err(err).Msg("could not write client version timeline")
+		}
+	}
+}
+
+// reportTraffic logs packet totals and rates over recent windows.
+func (a *analyzers) reportTraffic() {
+	now := a.lastSeen
+	if now.IsZero() {
+		return
+	}
+	log.Info().
+		Float64("packets_1m", a.series.Sum(seriesPackets, now, time.Minute)).
+		Float64("packets_1h", a.series.Sum(seriesPackets, now, time.Hour)).
+		Float64("rate_1m", a.series.Rate(seriesPackets, now, time.Minute)).
+		Float64("rate_ewma", a.packetRate.Rate(now)).
+		Msg("traffic")
+}
+
+// reportStages logs the latency percentiles of every processing stage
+// since the previous report.
+func (a *analyzers) reportStages() {
+	for _, r := range a.timer.Report(true) {
+		log.Info().
+			Str("stage", r.Name).
+			Uint64("count", r.Count).
+			Dur("mean", r.Mean).
+			Dur("p50", r.P50).
+			Dur("p90", r.P90).
+			Dur("p99", r.P99).
+			Dur("max", r.Max).
+			Msg("stage latency")
+	}
+}
+
+// reportNewNodes logs how many never before seen node IDs showed up in the
+// last minute and hour and persists the filter.
+func (a *analyzers) reportNewNodes() {
+	if a.seen == nil {
+		return
+	}
+	log.Info().
+		Float64("new_1m", a.series.Sum(seriesNewNodes, a.lastSeen, time.Minute)).
+		Float64("new_1h", a.series.Sum(seriesNewNodes, a.lastSeen, time.Hour)).
+		Uint64("total", a.seen.Count()).
+		Float64("fp_rate", a.seen.FalsePositiveRate()).
+		Msg("new node IDs")
+
+	if err := a.seen.Save(*seenDB); err != nil {
+		log.Warn().Err(err).Msg("could not persist seen node IDs")
+	}
+}
+
+// reportCardinality logs the approximate number of unique node IDs and IPs
+// over each window.
+func (a *analyzers) reportCardinality() {
+	if a.uniqueNodes == nil || a.lastSeen.IsZero() {
+		return
+	}
+	for _, w := range stats.CardinalityWindows {
+		log.Info().
+			Str("window", w.String()).
+			Uint64("nodes", a.uniqueNodes.Estimate(a.lastSeen, w)).
+			Uint64("ips", a.uniqueIPs.Estimate(a.lastSeen, w)).
+			Msg("unique peers")
+	}
+}
+
+// reportTopTalkers logs the busiest source IPs and node IDs, with older
+// traffic weighing exponentially less.
+func (a *analyzers) reportTopTalkers() {
+	if a.talkerIPs == nil {
+		return
+	}
+	for _, t := range []struct {
+		kind string
+		topk *stats.TopK
+	}{{"ip", a.talkerIPs}, {"node", a.talkerNodes}} {
+		for i, h := range t.topk.Top(*topTalkers) {
+			ev := log.Info().
+				Int("rank", i+1).
+				Str(t.kind, h.Key)
+			if t.kind == "ip" {
+				ev = enrichEvent(ev, h.Key)
+			}
+			ev.Uint64("packets", h.Count).
+				Uint64("error", h.Error).
+				Msg("top talker")
+		}
+	}
+}
+
+// analyzerState is the deterministic part of the analyzer state, the same
+// capture always yields the same state. Wall clock dependent values such as
+// stage latencies are left out, and so is state carried over from previous
+// runs, such as the node IDs of -seen-db.
+type analyzerState struct {
+	Packets     uint64                         `json:"packets"`
+	Kinds       map[string]uint64              `json:"kinds"`
+	Errors      map[string]uint64              `json:"errors"`
+	UniqueNodes map[string]uint64              `json:"unique_nodes,omitempty"`
+	UniqueIPs   map[string]uint64              `json:"unique_ips,omitempty"`
+	TopTalkers  map[string][]stats.HeavyHitter `json:"top_talkers,omitempty"`
+	Tails       map[string]*tailKind           `json:"tails,omitempty"`
+}
+
+func (a *analyzers) state() analyzerState {
+	s := analyzerState{
+		Packets: a.total,
+		Kinds:   a.kinds,
+		Errors:  a.errors,
+	}
+	if a.uniqueNodes != nil && !a.lastSeen.IsZero() {
+		s.UniqueNodes, s.UniqueIPs = make(map[string]uint64), make(map[string]uint64)
+		for _, w := range stats.CardinalityWindows {
+			s.UniqueNodes[w.String()] = a.uniqueNodes.Estimate(a.lastSeen, w)
+			s.UniqueIPs[w.String()] = a.uniqueIPs.Estimate(a.lastSeen, w)
+		}
+	}
+	if a.talkerIPs != nil {
+		s.TopTalkers = map[string][]stats.HeavyHitter{
+			"ip":   a.talkerIPs.Top(*topTalkers),
+			"node": a.talkerNodes.Top(*topTalkers),
+		}
+	}
+	if a.tails != nil {
+		s.Tails = a.tails.kinds
+	}
+	return s
+}
+
+// seenNodes returns the number of node IDs ever seen with -seen-db, nil if
+// unset.
+func (a *analyzers) seenNodes() *uint64 {
+	if a.seen == nil {
+		return nil
+	}
+	count := a.seen.Count()
+	return &count
+}
+
+// snapshotState is the state written by -snapshot and compared by
+// -snapshot-expect: that of the analyzers and the node table of
+// -track-nodes, keyed by node ID.
+type snapshotState struct {
+	analyzerState
+	Nodes map[string]tracker.Node `json:"nodes,omitempty"`
+}
+
+func (a *analyzers) snapshot() snapshotState {
+	s := snapshotState{analyzerState: a.state()}
+	if nodes != nil {
+		s.Nodes = make(map[string]tracker.Node)
+		for _, n := range nodes.Nodes(0) {
+			s.Nodes[n.ID.String()] = n
+		}
+	}
+	return s
+}
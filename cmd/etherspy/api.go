@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/sink"
+	"github.com/drgomesp/etherspy/pkg/stats"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// apiRecent is the number of packets kept for /packets/recent, and
+// apiEvents the node events buffered per client of /nodes/events.
+const (
+	apiRecent = 1000
+	apiEvents = 1000
+)
+
+// apiStats is the answer of /stats.
+type apiStats struct {
+	Time     time.Time `json:"time"`
+	Paused   bool      `json:"paused"`
+	Rate1m   float64   `json:"rate_1m"`
+	RateEWMA float64   `json:"rate_ewma"`
+	Nodes    int       `json:"tracked_nodes,omitempty"`
+	Seen     *uint64   `json:"seen_nodes,omitempty"`
+	analyzerState
+}
+
+// serveAPI serves the read-only HTTP API of -http, for dashboards and
+// scripts querying a running capture. Unlike the admin API it can't change
+// anything.
+//
+//	GET /nodes?limit=N               nodes seen most recently, with -track-nodes
+//	GET /nodes/{id}                  a single node, with -track-nodes
+//	GET /nodes/events                node table changes as JSON lines, with -track-nodes
+//	GET /packets/recent?limit=N      latest packets output, most recent first
+//	GET /series                      keys of the time series kept by the analyzers
+//	GET /series?key=K&span=D&step=S  sums of K per step over span, oldest first
+//	GET /stats                       packet totals, rates and analyzer state
+func serveAPI(addr string, c *controller, a *analyzers, recent *sink.Recent) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nodes", serveNodes)
+	mux.HandleFunc("/nodes/", serveNodes)
+	mux.HandleFunc("/nodes/events", serveNodeEvents)
+	mux.HandleFunc("/packets/recent", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		limit := 100
+		if s := r.URL.Query().Get("limit"); s != "" {
+			l, err := strconv.Atoi(s)
+			if err != nil || l < 0 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = l
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(recent.Records(limit))
+	})
+	// The analyzer state belongs to the capture loop, so it is encoded
+	// there.
+	mux.HandleFunc("/stats", c.handle(http.MethodGet, func(string) func() (interface{}, error) {
+		return func() (interface{}, error) {
+			s := apiStats{Time: a.lastSeen, Paused: c.paused, Seen: a.seenNodes(), analyzerState: a.state()}
+			if !a.lastSeen.IsZero() {
+				s.Rate1m = a.series.Rate(seriesPackets, a.lastSeen, time.Minute)
+				s.RateEWMA = a.packetRate.Rate(a.lastSeen)
+			}
+			if nodes != nil {
+				s.Nodes = nodes.Len()
+			}
+			data, err := json.Marshal(s)
+			return json.RawMessage(data), err
+		}
+	}))
+	mux.HandleFunc("/series", func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseSeriesQuery(r, a.series)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.handle(http.MethodGet, func(string) func() (interface{}, error) {
+			return func() (interface{}, error) {
+				if q.key == "" {
+					return a.series.Keys(""), nil
+				}
+				return q.points(a.series, a.lastSeen), nil
+			}
+		})(w, r)
+	})
+	log.Info().Msgf("HTTP API listening on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// serveNodeEvents streams the changes to the node table as JSON lines until
+// the client goes away. Events a slow client can't keep up with are
+// dropped.
+func serveNodeEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if nodes == nil {
+		http.Error(w, "node tracking is disabled, set -track-nodes", http.StatusNotFound)
+		return
+	}
+	sub := nodes.Subscribe(apiEvents)
+	defer sub.Unsubscribe()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-sub.Events():
+			e.Node = enrichNode(e.Node)
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// seriesQuery is a query of /series.
+type seriesQuery struct {
+	key        string
+	span, step time.Duration
+}
+
+// seriesPoint is the sum of a series over the step starting at Time.
+type seriesPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// parseSeriesQuery parses the key, span and step of a /series query. The
+// span defaults to 5m and the step to the resolution of the series.
+func parseSeriesQuery(r *http.Request, series *stats.Series) (seriesQuery, error) {
+	q := seriesQuery{key: r.URL.Query().Get("key"), span: 5 * time.Minute, step: series.Resolution()}
+	for _, p := range []struct {
+		name string
+		d    *time.Duration
+	}{{"span", &q.span}, {"step", &q.step}} {
+		s := r.URL.Query().Get(p.name)
+		if s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return q, fmt.Errorf("invalid %s %q", p.name, s)
+		}
+		*p.d = d
+	}
+	q.step = q.step.Truncate(series.Resolution())
+	if q.step < series.Resolution() {
+		q.step = series.Resolution()
+	}
+	if q.span > series.Span() {
+		q.span = series.Span()
+	}
+	if q.span < q.step {
+		q.span = q.step
+	}
+	return q, nil
+}
+
+// points returns the sums of the queried series as of now.
+func (q seriesQuery) points(series *stats.Series, now time.Time) []seriesPoint {
+	n := int(q.span / q.step)
+	points := make([]seriesPoint, n)
+	if now.IsZero() {
+		return points[:0]
+	}
+	last := now.Truncate(series.Resolution()).Add(-q.step + series.Resolution())
+	for i, v := range series.Buckets(q.key, now, q.step, n) {
+		points[i] = seriesPoint{Time: last.Add(-time.Duration(n-1-i) * q.step), Value: v}
+	}
+	return points
+}
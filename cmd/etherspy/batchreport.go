@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/errcode"
+	"github.com/drgomesp/etherspy/pkg/report"
+	"github.com/drgomesp/etherspy/pkg/stats"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The timeline of a batch report keeps at most batchBuckets buckets, their
+// width doubling from a second whenever the capture outgrows them.
+const batchBuckets = 512
+
+// batchReport gathers what the report command renders once a whole
+// capture is decoded: the timeline of packets and errors per protocol and
+// the errors by code. The protocol mix, top peers and endpoint proofs come
+// from the analyzers the command enables.
+type batchReport struct {
+	path   string // empty for Markdown on stdout
+	source string
+
+	start, last time.Time
+	step        time.Duration
+	timeline    map[string][]float64 // packets per bucket, by protocol and seriesErrors
+	errors      map[[3]string]uint64 // by protocol, code and reason
+}
+
+// seriesErrors is the timeline series of decode errors.
+const seriesErrors = "errors"
+
+func newBatchReport(path, source string) *batchReport {
+	return &batchReport{
+		path:     path,
+		source:   source,
+		step:     time.Second,
+		timeline: make(map[string][]float64),
+		errors:   make(map[[3]string]uint64),
+	}
+}
+
+// add counts a packet of series at t.
+func (b *batchReport) add(series string, t time.Time) {
+	if b.start.IsZero() {
+		b.start = t.Truncate(time.Second)
+	}
+	if t.After(b.last) {
+		b.last = t
+	}
+	i := int(t.Sub(b.start) / b.step)
+	if i < 0 {
+		i = 0 // reordered by the capture
+	}
+	for i >= batchBuckets {
+		b.step *= 2
+		for name, values := range b.timeline {
+			for j := range values {
+				if j%2 == 1 {
+					values[j/2] += values[j]
+				} else {
+					values[j/2] = values[j]
+				}
+			}
+			b.timeline[name] = values[:(len(values)+1)/2]
+		}
+		i = int(t.Sub(b.start) / b.step)
+	}
+	values := b.timeline[series]
+	for len(values) <= i {
+		values = append(values, 0)
+	}
+	values[i]++
+	b.timeline[series] = values
+}
+
+func (b *batchReport) observeKind(protocol string, t time.Time) {
+	b.add(protocol, t)
+}
+
+func (b *batchReport) observeError(protocol string, err error, t time.Time) {
+	b.add(seriesErrors, t)
+	b.errors[[3]string{protocol, errcode.ID(err), errorReason(err)}]++
+}
+
+// write renders the report of the capture a analyzed.
+func (b *batchReport) write(a *analyzers) error {
+	r := &report.Report{
+		Title:     "etherspy capture report",
+		Generated: time.Now(),
+		Meta: []report.Field{
+			{Name: "source", Value: b.source},
+			{Name: "packets", Value: strconv.FormatUint(a.total, 10)},
+		},
+	}
+	if !b.start.IsZero() {
+		r.Meta = append(r.Meta,
+			report.Field{Name: "first packet", Value: times.Format(b.start)},
+			report.Field{Name: "last packet", Value: times.Format(b.last)},
+			report.Field{Name: "duration", Value: b.last.Sub(b.start).Round(time.Millisecond).String()},
+		)
+	}
+	r.Sections = append(r.Sections, b.mix(a), b.peers(a), b.handshakes(a), b.errorBreakdown(a), b.chart())
+	if b.path == "" {
+		return report.Render(os.Stdout, report.Markdown, r)
+	}
+	return report.WriteFile(b.path, r)
+}
+
+// mix is the section of the packets decoded by protocol and kind.
+func (b *batchReport) mix(a *analyzers) report.Section {
+	s := report.Section{Title: "protocol mix"}
+	var decoded uint64
+	keys := make([]string, 0, len(a.kinds))
+	for k, n := range a.kinds {
+		keys = append(keys, k)
+		decoded += n
+	}
+	if decoded == 0 {
+		s.Notes = []string{"No packet was decoded."}
+		return s
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if a.kinds[keys[i]] != a.kinds[keys[j]] {
+			return a.kinds[keys[i]] > a.kinds[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	s.Table = &report.Table{Columns: []string{"protocol", "kind", "packets", "share"}}
+	for _, k := range keys {
+		protocol, kind, _ := strings.Cut(k, "/")
+		n := a.kinds[k]
+		s.Table.Rows = append(s.Table.Rows, []string{protocol, kind, strconv.FormatUint(n, 10), percent(n, decoded)})
+	}
+	return s
+}
+
+// peers is the section of the busiest source IPs and node IDs.
+func (b *batchReport) peers(a *analyzers) report.Section {
+	s := report.Section{Title: "top peers"}
+	if a.talkerIPs == nil {
+		s.Notes = []string{"Top peers are ranked with -top-talkers."}
+		return s
+	}
+	s.Table = &report.Table{Columns: []string{"rank", "kind", "peer", "packets"}}
+	for _, t := range []struct {
+		kind string
+		topk *stats.TopK
+	}{{"ip", a.talkerIPs}, {"node", a.talkerNodes}} {
+		for i, h := range t.topk.Top(*topTalkers) {
+			s.Table.Rows = append(s.Table.Rows, []string{strconv.Itoa(i + 1), t.kind, h.Key, strconv.FormatUint(h.Count, 10)})
+		}
+	}
+	return s
+}
+
+// handshakes is the section of the discv5 handshakes completed per
+// WHOAREYOU challenge, and of the discv4 endpoint proofs.
+func (b *batchReport) handshakes(a *analyzers) report.Section {
+	s := report.Section{Title: "handshakes"}
+	var challenges, completed uint64
+	for k, n := range a.kinds {
+		switch {
+		case k == "discv5/WHOAREYOU":
+			challenges += n
+		case strings.HasPrefix(k, "discv5/HANDSHAKE"):
+			completed += n
+		}
+	}
+	s.Fields = append(s.Fields,
+		report.Field{Name: "discv5 challenges", Value: strconv.FormatUint(challenges, 10)},
+		report.Field{Name: "discv5 handshakes", Value: strconv.FormatUint(completed, 10)},
+	)
+	if challenges > 0 {
+		s.Fields = append(s.Fields, report.Field{Name: "discv5 success rate", Value: percent(completed, challenges)})
+	}
+	if p := a.proofs; p != nil {
+		resolved := p.outcomes[proofCompleted] + p.outcomes[proofUnanswered] + p.outcomes[proofLate]
+		s.Fields = append(s.Fields,
+			report.Field{Name: "discv4 pings resolved", Value: strconv.FormatUint(resolved, 10)},
+			report.Field{Name: "discv4 endpoint proofs", Value: strconv.FormatUint(p.outcomes[proofCompleted], 10)},
+		)
+		if resolved > 0 {
+			s.Fields = append(s.Fields,
+				report.Field{Name: "discv4 success rate", Value: percent(p.outcomes[proofCompleted], resolved)},
+				report.Field{Name: "discv4 rtt p50", Value: p.rtt.Quantile(0.5).String()},
+			)
+		}
+	}
+	return s
+}
+
+// errorBreakdown is the section of the decode errors by protocol and code.
+func (b *batchReport) errorBreakdown(a *analyzers) report.Section {
+	s := report.Section{Title: "decode errors"}
+	if len(b.errors) == 0 {
+		s.Notes = []string{"Every packet decoded."}
+		return s
+	}
+	keys := make([][3]string, 0, len(b.errors))
+	for k := range b.errors {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if b.errors[keys[i]] != b.errors[keys[j]] {
+			return b.errors[keys[i]] > b.errors[keys[j]]
+		}
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+	s.Table = &report.Table{Columns: []string{"protocol", "code", "reason", "packets", "share of protocol"}}
+	for _, k := range keys {
+		var attempts uint64
+		for kind, n := range a.kinds {
+			if strings.HasPrefix(kind, k[0]+"/") {
+				attempts += n
+			}
+		}
+		attempts += a.errors[k[0]]
+		n := b.errors[k]
+		s.Table.Rows = append(s.Table.Rows, []string{k[0], k[1], k[2], strconv.FormatUint(n, 10), percent(n, attempts)})
+	}
+	return s
+}
+
+// chart is the section of the timeline of packets per protocol and of
+// errors, in packets per second.
+func (b *batchReport) chart() report.Section {
+	s := report.Section{Title: "timeline"}
+	if len(b.timeline) == 0 {
+		s.Notes = []string{"No packet to chart."}
+		return s
+	}
+	names := make([]string, 0, len(b.timeline))
+	for name := range b.timeline {
+		if name != seriesErrors {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := b.timeline[seriesErrors]; ok {
+		names = append(names, seriesErrors)
+	}
+	c := &report.Chart{Start: b.start, Step: b.step, Unit: "packets/s"}
+	for _, name := range names {
+		values := make([]float64, len(b.timeline[name]))
+		for i, v := range b.timeline[name] {
+			values[i] = v / b.step.Seconds()
+		}
+		c.Series = append(c.Series, report.Series{Name: name, Values: values})
+	}
+	s.Chart = c
+	return s
+}
+
+func percent(n, total uint64) string {
+	if total == 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(100*float64(n)/float64(total), 'f', 1, 64) + "%"
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/drgomesp/etherspy/pkg/snapshot"
+	"github.com/drgomesp/etherspy/pkg/stats"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var bootnodeNetworks = map[string][]string{
+	"mainnet": params.MainnetBootnodes,
+	"sepolia": params.SepoliaBootnodes,
+	"goerli":  params.GoerliBootnodes,
+	"ropsten": params.RopstenBootnodes,
+	"rinkeby": params.RinkebyBootnodes,
+}
+
+func bootnodeNetworkNames() string {
+	names := make([]string, 0, len(bootnodeNetworks))
+	for name := range bootnodeNetworks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, "|")
+}
+
+// bootnodeHealth is the probing history of a bootnode.
+type bootnodeHealth struct {
+	node *enode.Node
+
+	probes      uint64
+	pongs       uint64
+	neighbors   uint64 // FINDNODE queries answered
+	nodes       uint64 // nodes received in answers
+	failures    int    // consecutive unanswered probes
+	dark        bool
+	lastSeen    time.Time
+	latency     stats.Histogram
+	lastLatency time.Duration
+	lastErr     error  // of the last probe that could not be sent
+	seenAs      net.IP // the prober's address as echoed by the last PONG
+}
+
+// bootnodeReport is the uptime report of a bootnode.
+type bootnodeReport struct {
+	Node          string        `json:"node"`
+	Addr          string        `json:"addr"`
+	Probes        uint64        `json:"probes"`
+	Uptime        float64       `json:"uptime"`
+	Dark          bool          `json:"dark"`
+	LastSeen      *time.Time    `json:"last_seen,omitempty"`
+	LatencyP50    time.Duration `json:"latency_p50_ns"`
+	LatencyP99    time.Duration `json:"latency_p99_ns"`
+	FindNodeRate  float64       `json:"findnode_answer_rate"`
+	NodesPerReply float64       `json:"nodes_per_answer"`
+}
+
+func (h *bootnodeHealth) report() bootnodeReport {
+	r := bootnodeReport{
+		Node:       h.node.ID().String(),
+		Addr:       fmt.Sprintf("%s:%d", h.node.IP(), h.node.UDP()),
+		Probes:     h.probes,
+		Dark:       h.dark,
+		LatencyP50: h.latency.Quantile(0.5),
+		LatencyP99: h.latency.Quantile(0.99),
+	}
+	if h.probes > 0 {
+		r.Uptime = float64(h.pongs) / float64(h.probes)
+	}
+	if h.pongs > 0 {
+		r.FindNodeRate = float64(h.neighbors) / float64(h.pongs)
+	}
+	if h.neighbors > 0 {
+		r.NodesPerReply = float64(h.nodes) / float64(h.neighbors)
+	}
+	if !h.lastSeen.IsZero() {
+		t := h.lastSeen.UTC()
+		r.LastSeen = &t
+	}
+	return r
+}
+
+// prober speaks just enough discv4 to check on bootnodes: it pings them,
+// answers their pings so they accept its queries, and asks for neighbors.
+type prober struct {
+	conn *net.UDPConn
+	key  *ecdsa.PrivateKey
+
+	mu      sync.Mutex
+	waiters map[string]chan *discv4.Packet // by remote address
+}
+
+func newProber(listen string, key *ecdsa.PrivateKey) (*prober, error) {
+	addr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	p := &prober{conn: conn, key: key, waiters: make(map[string]chan *discv4.Packet)}
+	go p.read()
+	return p, nil
+}
+
+func (p *prober) read() {
+	buf := make([]byte, discv4.MaxPacketSize)
+	for {
+		n, from, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		pkt, err := discv4.Decode(append([]byte(nil), buf[:n]...), discv4.DecodeOptions{})
+		if err != nil {
+			continue
+		}
+		if pkt.Kind == discv4.PacketPing {
+			p.send(from, &discv4.Pong{
+				To:         discv4.Endpoint{IP: from.IP, UDP: uint16(from.Port)},
+				ReplyTok:   pkt.Hash,
+				Expiration: expiration(),
+			})
+			continue
+		}
+		p.mu.Lock()
+		ch := p.waiters[from.String()]
+		p.mu.Unlock()
+		if ch != nil {
+			select {
+			case ch <- pkt:
+			default:
+			}
+		}
+	}
+}
+
+func (p *prober) send(to *net.UDPAddr, body discv4.Body) ([]byte, error) {
+	packet, hash, err := discv4.Encode(p.key, body)
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.conn.WriteToUDP(packet, to)
+	return hash, err
+}
+
+// wait returns the body of the next packet of the given kind on ch that
+// satisfies ok, nil on timeout.
+func wait(ch chan *discv4.Packet, kind discv4.PacketKind, timeout time.Duration, ok func(discv4.Body) bool) discv4.Body {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case pkt := <-ch:
+			if pkt.Kind != kind {
+				continue
+			}
+			if body, err := pkt.Body(); err == nil && ok(body) {
+				return body
+			}
+		case <-deadline:
+			return nil
+		}
+	}
+}
+
+// subscribe returns the channel receiving the packets sent from to, other
+// than pings, and the function to call once done with it.
+func (p *prober) subscribe(to *net.UDPAddr) (chan *discv4.Packet, func()) {
+	ch := make(chan *discv4.Packet, 16)
+	p.mu.Lock()
+	p.waiters[to.String()] = ch
+	p.mu.Unlock()
+	return ch, func() {
+		p.mu.Lock()
+		delete(p.waiters, to.String())
+		p.mu.Unlock()
+	}
+}
+
+// probe pings h's node and, if it answers, asks it for neighbors.
+func (p *prober) probe(h *bootnodeHealth, timeout time.Duration) {
+	to := &net.UDPAddr{IP: h.node.IP(), Port: h.node.UDP()}
+	ch, done := p.subscribe(to)
+	defer done()
+
+	h.probes++
+	pong, rtt, err := p.ping(to, ch, timeout)
+	if h.lastErr = err; err != nil {
+		log.Warn().Err(err).Msgf("could not ping bootnode %s", to)
+		return
+	}
+	if pong == nil {
+		return
+	}
+	h.pongs++
+	h.lastSeen = time.Now()
+	h.lastLatency = rtt
+	h.latency.Observe(rtt)
+	h.seenAs = pong.To.IP
+
+	var target discv4.NodeID
+	rand.Read(target[:])
+	if nodes, ok := p.findNode(to, ch, target, timeout); ok {
+		h.neighbors++
+		h.nodes += uint64(len(nodes))
+	}
+}
+
+// ping pings to, whose packets arrive on ch, and returns its pong and the
+// round trip time, a nil pong on timeout. Once it answered, to pings back
+// to prove our endpoint before it answers queries, ping leaves it time to
+// do so.
+func (p *prober) ping(to *net.UDPAddr, ch chan *discv4.Packet, timeout time.Duration) (*discv4.Pong, time.Duration, error) {
+	local := p.conn.LocalAddr().(*net.UDPAddr)
+	sent := time.Now()
+	hash, err := p.send(to, &discv4.Ping{
+		Version:    4,
+		From:       discv4.Endpoint{IP: local.IP, UDP: uint16(local.Port)},
+		To:         discv4.Endpoint{IP: to.IP, UDP: uint16(to.Port)},
+		Expiration: expiration(),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	pong := wait(ch, discv4.PacketPong, timeout, func(b discv4.Body) bool {
+		return string(b.(*discv4.Pong).ReplyTok) == string(hash)
+	})
+	if pong == nil {
+		return nil, 0, nil
+	}
+	rtt := time.Since(sent)
+	time.Sleep(200 * time.Millisecond)
+	return pong.(*discv4.Pong), rtt, nil
+}
+
+// findNode asks to, whose packets arrive on ch, for the neighbors of
+// target, reporting whether it answered.
+func (p *prober) findNode(to *net.UDPAddr, ch chan *discv4.Packet, target discv4.NodeID, timeout time.Duration) ([]discv4.Node, bool) {
+	if _, err := p.send(to, &discv4.FindNode{Target: target, Expiration: expiration()}); err != nil {
+		return nil, false
+	}
+	// A full bucket of 16 nodes spans two packets of at most 12, a packet
+	// of fewer ends the answer. Lost packets are waited for neighborsGap
+	// past the previous one rather than the whole timeout.
+	var nodes []discv4.Node
+	answered, patience := false, timeout
+	for len(nodes) < bucketSize {
+		b := wait(ch, discv4.PacketNeighbors, patience, func(discv4.Body) bool { return true })
+		if b == nil {
+			break
+		}
+		answered = true
+		n := b.(*discv4.Neighbors).Nodes
+		nodes = append(nodes, n...)
+		if len(n) < neighborsPerPacket {
+			break
+		}
+		patience = neighborsGap
+	}
+	return nodes, answered
+}
+
+// Answers to FINDNODE hold up to bucketSize nodes, sent neighborsPerPacket
+// at a time, in packets following each other within neighborsGap.
+const (
+	bucketSize         = 16
+	neighborsPerPacket = 12
+	neighborsGap       = 500 * time.Millisecond
+)
+
+func expiration() uint64 {
+	return uint64(time.Now().Add(20 * time.Second).Unix())
+}
+
+// monitorBootnodes runs the monitor-bootnodes command: it probes the
+// bootnodes of a network at regular intervals, logs an alert when one goes
+// dark and keeps an uptime report up to date. After -rounds, bootnodes
+// still dark set exitCode to exitAlert.
+func monitorBootnodes(args []string) error {
+	fs := flag.NewFlagSet("monitor-bootnodes", flag.ExitOnError)
+	network := fs.String("network", "mainnet", "Network whose bootnodes are monitored ("+bootnodeNetworkNames()+")")
+	interval := fs.Duration("interval", time.Minute, "Time between two probes of every bootnode")
+	timeout := fs.Duration("timeout", 5*time.Second, "Time to wait for an answer")
+	darkAfter := fs.Int("dark-after", 3, "Consecutive unanswered probes after which a bootnode is reported dark")
+	listen := fs.String("listen", "0.0.0.0:0", "UDP address probes are sent from")
+	reportOut := fs.String("report", "", "File the JSON uptime report is written to after every round")
+	keyFile := fs.String("nodekey-file", "", "Key probes are signed with (default a new key)")
+	rounds := fs.Int("rounds", 0, "Stop after this many rounds of probes, exiting with code 4 if a bootnode is dark, 0 runs forever")
+	quietMode := fs.Bool("quiet", false, "Print nothing but errors and a final line of the result, with -rounds")
+	fs.Parse(args)
+	if *quietMode {
+		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+	}
+
+	urls, ok := bootnodeNetworks[*network]
+	if !ok {
+		return fmt.Errorf("unknown network %q, want one of %s", *network, bootnodeNetworkNames())
+	}
+	var nodes []*bootnodeHealth
+	for _, u := range urls {
+		n, err := enode.Parse(enode.ValidSchemes, u)
+		if err != nil {
+			return fmt.Errorf("invalid bootnode %q: %v", u, err)
+		}
+		if n.IP().To4() == nil {
+			continue
+		}
+		nodes = append(nodes, &bootnodeHealth{node: n})
+	}
+
+	var (
+		key *ecdsa.PrivateKey
+		err error
+	)
+	if *keyFile != "" {
+		key, err = readNodeKey(*keyFile)
+	} else {
+		key, err = crypto.GenerateKey()
+	}
+	if err != nil {
+		return err
+	}
+	p, err := newProber(*listen, key)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("monitoring %d %s bootnodes from %s", len(nodes), *network, p.conn.LocalAddr())
+
+	for round := 1; ; round++ {
+		var wg sync.WaitGroup
+		for _, h := range nodes {
+			wg.Add(1)
+			go func(h *bootnodeHealth) {
+				defer wg.Done()
+				pongs := h.pongs
+				p.probe(h, *timeout)
+				if h.pongs > pongs {
+					h.failures = 0
+				} else {
+					h.failures++
+				}
+			}(h)
+		}
+		wg.Wait()
+
+		reports := make([]bootnodeReport, len(nodes))
+		for i, h := range nodes {
+			switch {
+			case !h.dark && h.failures >= *darkAfter:
+				h.dark = true
+				log.Error().Str("node", h.node.URLv4()).Msgf("bootnode %s went dark, %d probes unanswered", h.node.ID().TerminalString(), h.failures)
+			case h.dark && h.failures == 0:
+				h.dark = false
+				log.Info().Str("node", h.node.URLv4()).Msgf("bootnode %s is back", h.node.ID().TerminalString())
+			}
+			reports[i] = h.report()
+			log.Info().Msgf("bootnode %s uptime %.1f%% latency %s dark %t", h.node.ID().TerminalString(), reports[i].Uptime*100, h.lastLatency, h.dark)
+		}
+		if *reportOut != "" {
+			if err := snapshot.Write(*reportOut, reports); err != nil {
+				log.Warn().Err(err).Msg("could not write bootnode report")
+			}
+		}
+		if round == *rounds {
+			dark := 0
+			for _, h := range nodes {
+				if h.dark {
+					dark++
+				}
+			}
+			if dark > 0 {
+				exitCode = exitAlert
+				if *quietMode {
+					fmt.Printf("ALERT: %d of %d %s bootnodes dark\n", dark, len(nodes), *network)
+				}
+			} else if *quietMode {
+				fmt.Printf("OK: %d %s bootnodes up\n", len(nodes), *network)
+			}
+			return nil
+		}
+		time.Sleep(*interval)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"github.com/drgomesp/etherspy/pkg/errcode"
+	"github.com/rs/zerolog/log"
+	"sort"
+)
+
+// breaker watches the failure rate of a decoder over its last packets.
+// Once the rate exceeds the threshold it trips: a single diagnosis replaces
+// the per packet warnings and, optionally, the decoder is disabled.
+type breaker struct {
+	protocol string
+	name     string // protocol qualified with the network label
+
+	outcomes []bool // ring of the last packets, true for failures
+	next     int
+	filled   int
+	failures int
+	errs     map[string]int    // failures by error since the last trip
+	codes    map[string]string // code IDs of the errors in errs
+
+	tripped  bool
+	disabled bool
+}
+
+type breakers struct {
+	network   string
+	window    int
+	threshold float64
+	disable   bool
+	byName    map[string]*breaker
+}
+
+func newBreakers(window int, threshold float64, disable bool) *breakers {
+	return &breakers{window: window, threshold: threshold, disable: disable, byName: make(map[string]*breaker)}
+}
+
+func (bs *breakers) get(protocol string) *breaker {
+	b := bs.byName[protocol]
+	if b == nil {
+		name := protocol
+		if bs.network != "" {
+			name = bs.network + "/" + protocol
+		}
+		b = &breaker{protocol: protocol, name: name, outcomes: make([]bool, bs.window), errs: make(map[string]int), codes: make(map[string]string)}
+		bs.byName[protocol] = b
+	}
+	return b
+}
+
+// enabled reports whether the decoder of protocol should still be used.
+func (bs *breakers) enabled(protocol string) bool {
+	return !bs.get(protocol).disabled
+}
+
+// setEnabled turns the decoder of protocol on or off. Enabling a decoder
+// also clears its failure history so a tripped breaker starts over.
+func (bs *breakers) setEnabled(protocol string, enabled bool) {
+	b := bs.get(protocol)
+	if enabled && b.disabled {
+		bs.byName[protocol] = nil
+		b = bs.get(protocol)
+	}
+	b.disabled = !enabled
+}
+
+// states returns whether each decoder seen so far is enabled.
+func (bs *breakers) states() map[string]bool {
+	states := make(map[string]bool, len(bs.byName))
+	for name, b := range bs.byName {
+		states[name] = !b.disabled
+	}
+	return states
+}
+
+// success records a packet decoded by the decoder of protocol.
+func (bs *breakers) success(protocol string) {
+	bs.record(bs.get(protocol), nil)
+}
+
+// failure records a packet the decoder of protocol failed on, logging it
+// unless the breaker is tripped.
+func (bs *breakers) failure(protocol string, err error) {
+	b := bs.get(protocol)
+	bs.record(b, err)
+	if !b.tripped {
+		log.Warn().Str("code", errcode.ID(err)).Msgf("[%s] %s", b.name, err.Error())
+	}
+}
+
+func (bs *breakers) record(b *breaker, err error) {
+	failed := err != nil
+	if b.filled == len(b.outcomes) && b.outcomes[b.next] {
+		b.failures--
+	}
+	if b.filled < len(b.outcomes) {
+		b.filled++
+	}
+	b.outcomes[b.next] = failed
+	b.next = (b.next + 1) % len(b.outcomes)
+	if failed {
+		b.failures++
+		if len(b.errs) < 16 || b.errs[err.Error()] > 0 {
+			b.errs[err.Error()]++
+			b.codes[err.Error()] = errcode.ID(err)
+		}
+	}
+
+	if b.filled < len(b.outcomes) {
+		return
+	}
+	rate := float64(b.failures) / float64(b.filled)
+	switch {
+	case !b.tripped && rate >= bs.threshold:
+		b.tripped = true
+		b.disabled = bs.disable
+		b.diagnose(rate)
+	case b.tripped && rate < bs.threshold/2:
+		b.tripped = false
+		b.errs, b.codes = make(map[string]int), make(map[string]string)
+		log.Info().Msgf("[%s] decoder failure rate back to %.0f%%, resuming per packet warnings", b.name, rate*100)
+	}
+}
+
+// diagnose logs the most frequent error of a tripped breaker along with
+// suggested fixes.
+func (b *breaker) diagnose(rate float64) {
+	msgs := make([]string, 0, len(b.errs))
+	for msg := range b.errs {
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		if b.errs[msgs[i]] != b.errs[msgs[j]] {
+			return b.errs[msgs[i]] > b.errs[msgs[j]]
+		}
+		return msgs[i] < msgs[j]
+	})
+	var top string
+	if len(msgs) > 0 {
+		top = msgs[0]
+	}
+
+	e := log.Error().
+		Str("protocol", b.protocol).
+		Float64("failure_rate", rate).
+		Int("window", len(b.outcomes)).
+		Str("error", top).
+		Str("code", b.codes[top]).
+		Str("suggestion", suggestion(b.protocol, b.codes[top]))
+	if b.disabled {
+		e.Msgf("[%s] decoder fails on %.0f%% of packets, disabling it", b.name, rate*100)
+	} else {
+		e.Msgf("[%s] decoder fails on %.0f%% of packets, further failures are not logged until it recovers", b.name, rate*100)
+	}
+}
+
+// suggestion returns an actionable fix for the code of a dominant decoding
+// error.
+func suggestion(protocol, code string) string {
+	switch code {
+	case "ES-001":
+		return "headers are masked with the recipient's node ID: pass -nodekey, -nodekey-file or -geth-datadir of the capturing host's node, or capture its outgoing discv4 traffic so it is detected"
+	case "ES-002":
+		return "the traffic is neither discovery protocol, narrow the capture filter with -f to the discovery port"
+	case "D5-002":
+		return "unmasking with the local node ID fails: check that -nodekey-file belongs to the node receiving this traffic and that -local-ip lists its addresses, or that the traffic is discv5 at all"
+	case "D4-001":
+		return "packets may be truncated, raise the snap length with -s, or the traffic is not discv4; use -no-verify only on trusted captures"
+	case "D4-002", "D4-003", "D5-001":
+		return "the traffic does not look like " + protocol + ", narrow the capture filter with -f"
+	default:
+		return "check that the capture filter -f only matches " + protocol + " traffic"
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/etherspy"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"strings"
+)
+
+// filterList collects the values of the repeatable -f flag, replacing the
+// default filter once given.
+type filterList struct {
+	exprs []string
+	set   bool
+}
+
+func (l *filterList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(l.exprs, " ")
+}
+
+func (l *filterList) Set(v string) error {
+	if !l.set {
+		l.exprs, l.set = nil, true
+	}
+	l.exprs = append(l.exprs, v)
+	return nil
+}
+
+// expr returns the filter matching any of the expressions given, as when
+// a node listens on several ports.
+func (l *filterList) expr() string {
+	if len(l.exprs) == 1 {
+		return l.exprs[0]
+	}
+	terms := make([]string, len(l.exprs))
+	for i, e := range l.exprs {
+		terms[i] = "(" + e + ")"
+	}
+	return strings.Join(terms, " or ")
+}
+
+// source is a capture backend reading the packets of an interface or a
+// file. pcap handles are sources.
+type source interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+	SnapLen() int
+	SetBPFFilter(expr string) error
+	Close()
+}
+
+// matcher tells whether a packet matches a compiled filter, as a pcap.BPF
+// does.
+type matcher interface {
+	Matches(ci gopacket.CaptureInfo, data []byte) bool
+}
+
+// Capture backends, selected with -capture.
+const (
+	backendPcap     = "pcap"
+	backendAFPacket = "afpacket"
+)
+
+// capture is where packets are read from: a capture file, or one or more
+// interfaces read concurrently, as nodes often listen on several. Filters
+// apply to every interface alike, so they must share a link type.
+type capture struct {
+	devices []string // empty when reading a file
+	sources []source
+
+	// Settings of live captures, to reopen them.
+	backend string
+	preset  perfPreset
+	snaplen int
+	filter  string
+	sniffer *etherspy.Sniffer // reading the sources, once Packets is called
+}
+
+// openDevices opens a live capture on each of the comma separated devices
+// with the given backend, tuned according to the preset.
+func openDevices(backend string, p perfPreset, devices string, snaplen int) (*capture, error) {
+	var open func(perfPreset, string, int) (source, error)
+	switch backend {
+	case backendPcap:
+		open = openPcap
+	case backendAFPacket:
+		open = openAFPacket
+	default:
+		return nil, fmt.Errorf("unknown capture backend %q, want %s or %s", backend, backendPcap, backendAFPacket)
+	}
+
+	c := &capture{backend: backend, preset: p, snaplen: snaplen}
+	for _, device := range strings.Split(devices, ",") {
+		device = strings.TrimSpace(device)
+		if device == "" {
+			continue
+		}
+		src, err := open(p, device, snaplen)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("interface %q: %v", device, err)
+		}
+		if len(c.sources) > 0 && src.LinkType() != c.LinkType() {
+			src.Close()
+			c.Close()
+			return nil, fmt.Errorf("interface %q has link type %s, %q has %s", device, src.LinkType(), c.devices[0], c.LinkType())
+		}
+		c.devices = append(c.devices, device)
+		c.sources = append(c.sources, src)
+	}
+	if len(c.sources) == 0 {
+		return nil, fmt.Errorf("no interface given")
+	}
+	return c, nil
+}
+
+func (c *capture) LinkType() layers.LinkType { return c.sources[0].LinkType() }
+
+func (c *capture) SnapLen() int { return c.sources[0].SnapLen() }
+
+// NewBPF compiles expr for matching packets of the capture.
+func (c *capture) NewBPF(expr string) (matcher, error) {
+	return newMatcher(c.LinkType(), c.SnapLen(), expr)
+}
+
+// SetBPFFilter sets the filter of every interface. It is checked against
+// all of them first, so an invalid filter leaves them untouched.
+func (c *capture) SetBPFFilter(expr string) error {
+	for _, src := range c.sources {
+		if _, err := compileBPF(src.LinkType(), src.SnapLen(), expr); err != nil {
+			return err
+		}
+	}
+	for i, src := range c.sources {
+		if err := src.SetBPFFilter(expr); err != nil {
+			if len(c.devices) > 0 {
+				return fmt.Errorf("interface %q: %v", c.devices[i], err)
+			}
+			return err
+		}
+	}
+	c.filter = expr
+	return nil
+}
+
+// Packets returns the packets of every interface, read by a Sniffer in the
+// order they are read. The channel is closed once all are exhausted, which
+// only happens with capture files or interfaces gone down.
+func (c *capture) Packets() <-chan gopacket.Packet {
+	sources := make([]etherspy.Source, len(c.sources))
+	for i, s := range c.sources {
+		sources[i] = s
+	}
+	// Packet data is not retained past a loop iteration, payloads that need
+	// to outlive it or be modified are copied into pooled buffers.
+	c.sniffer = etherspy.New(etherspy.Config{Sources: sources, Raw: true})
+	// Reading opened sources, the Sniffer can't fail to start.
+	c.sniffer.Start()
+	return c.sniffer.Frames()
+}
+
+// Close closes the interfaces, then waits for the Sniffer reading them.
+func (c *capture) Close() {
+	for _, s := range c.sources {
+		s.Close()
+	}
+	if c.sniffer != nil {
+		c.sniffer.Stop()
+		c.sniffer = nil
+	}
+}
+
+// reopen closes the interfaces of a live capture and opens them again with
+// the same settings and filter, as needed once an interface went down.
+// Packets must be called again for the packets of the new handles.
+func (c *capture) reopen() error {
+	fresh, err := openDevices(c.backend, c.preset, strings.Join(c.devices, ","), c.snaplen)
+	if err != nil {
+		return err
+	}
+	if c.filter != "" {
+		if err := fresh.SetBPFFilter(c.filter); err != nil {
+			fresh.Close()
+			return err
+		}
+	}
+	c.Close()
+	c.sources = fresh.sources
+	return nil
+}
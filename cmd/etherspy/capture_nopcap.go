@@ -0,0 +1,119 @@
+//go:build nopcap
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/drgomesp/etherspy/pkg/capfilter"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/net/bpf"
+)
+
+// Builds tagged nopcap don't link libpcap, so they can be static. Filters
+// are compiled by capfilter, which only knows Ethernet framing and a subset
+// of the filter language, and captures go through AF_PACKET.
+
+func openPcap(perfPreset, string, int) (source, error) {
+	return nil, errors.New("built without libpcap, capture with -capture " + backendAFPacket)
+}
+
+// fileSource reads a pcap or pcapng file, filtering packets in user space.
+type fileSource struct {
+	f *os.File
+	r interface {
+		gopacket.PacketDataSource
+		LinkType() layers.LinkType
+	}
+	snaplen int
+	filter  *capfilter.Filter
+}
+
+// openFile opens a capture file.
+func openFile(path string) (*capture, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileSource{f: f, snaplen: 65535}
+	br := bufio.NewReader(f)
+	// pcapng files start with a section header block.
+	if magic, _ := br.Peek(4); string(magic) == "\x0a\x0d\x0d\x0a" {
+		s.r, err = pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+	} else {
+		var r *pcapgo.Reader
+		if r, err = pcapgo.NewReader(br); err == nil {
+			s.r, s.snaplen = r, int(r.Snaplen())
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &capture{sources: []source{s}}, nil
+}
+
+func (s *fileSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := s.r.ReadPacketData()
+		if err != nil || s.filter == nil || s.filter.Matches(data) {
+			return data, ci, err
+		}
+	}
+}
+
+func (s *fileSource) LinkType() layers.LinkType { return s.r.LinkType() }
+
+func (s *fileSource) SnapLen() int { return s.snaplen }
+
+func (s *fileSource) SetBPFFilter(expr string) error {
+	if s.LinkType() != layers.LinkTypeEthernet {
+		return errUnfilterable
+	}
+	filter, err := capfilter.New(expr, s.snaplen)
+	if err != nil {
+		return err
+	}
+	s.filter = filter
+	return nil
+}
+
+func (s *fileSource) Close() { s.f.Close() }
+
+var errUnfilterable = errors.New("only Ethernet captures can be filtered without libpcap")
+
+func compileBPF(linkType layers.LinkType, snaplen int, expr string) ([]bpf.RawInstruction, error) {
+	if linkType != layers.LinkTypeEthernet {
+		return nil, errUnfilterable
+	}
+	prog, err := capfilter.Compile(expr, snaplen)
+	if err != nil {
+		return nil, err
+	}
+	return bpf.Assemble(prog)
+}
+
+// userFilter matches packets in user space.
+type userFilter struct {
+	*capfilter.Filter
+}
+
+func (f userFilter) Matches(_ gopacket.CaptureInfo, data []byte) bool {
+	return f.Filter.Matches(data)
+}
+
+func newMatcher(linkType layers.LinkType, snaplen int, expr string) (matcher, error) {
+	if linkType != layers.LinkTypeEthernet {
+		return nil, errUnfilterable
+	}
+	f, err := capfilter.New(expr, snaplen)
+	if err != nil {
+		return nil, err
+	}
+	return userFilter{f}, nil
+}
@@ -0,0 +1,68 @@
+//go:build !nopcap
+
+package main
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// openPcap opens a live capture on device with libpcap, tuned according to
+// the preset.
+func openPcap(p perfPreset, device string, snaplen int) (source, error) {
+	inactive, err := pcap.NewInactiveHandle(device)
+	if err != nil {
+		return nil, err
+	}
+	defer inactive.CleanUp()
+
+	if err := inactive.SetSnapLen(snaplen); err != nil {
+		return nil, err
+	}
+	if err := inactive.SetPromisc(true); err != nil {
+		return nil, err
+	}
+	if err := inactive.SetTimeout(pcap.BlockForever); err != nil {
+		return nil, err
+	}
+	if p.captureBuffer != 0 {
+		if err := inactive.SetBufferSize(p.captureBuffer); err != nil {
+			return nil, err
+		}
+	}
+	if p.immediate {
+		if err := inactive.SetImmediateMode(true); err != nil {
+			return nil, err
+		}
+	}
+
+	return inactive.Activate()
+}
+
+// openFile opens a capture file.
+func openFile(path string) (*capture, error) {
+	handle, err := pcap.OpenOffline(path)
+	if err != nil {
+		return nil, err
+	}
+	return &capture{sources: []source{handle}}, nil
+}
+
+// compileBPF compiles a filter with libpcap, which understands the whole
+// filter language.
+func compileBPF(linkType layers.LinkType, snaplen int, expr string) ([]bpf.RawInstruction, error) {
+	insts, err := pcap.CompileBPFFilter(linkType, snaplen, expr)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]bpf.RawInstruction, len(insts))
+	for i, in := range insts {
+		raw[i] = bpf.RawInstruction{Op: in.Code, Jt: in.Jt, Jf: in.Jf, K: in.K}
+	}
+	return raw, nil
+}
+
+func newMatcher(linkType layers.LinkType, snaplen int, expr string) (matcher, error) {
+	return pcap.NewBPF(linkType, snaplen, expr)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"github.com/drgomesp/etherspy/pkg/ethereum/enr"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/eth"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"time"
+)
+
+// chainsMaxNodes bounds the nodes classified. Once reached, those seen least
+// recently are forgotten.
+const chainsMaxNodes = 1 << 18
+
+// chains classifies nodes by the Ethereum network they are on, from the
+// fork IDs of the eth entries of their records, and tags their packets with
+// it. The Status messages nodes exchange over RLPx would tell as much, but
+// captures aren't decrypted past discovery. Enabled with -classify-networks.
+type chains struct {
+	nodes map[enode.ID]*chainNode
+}
+
+// chainNode is the network of a node and when it was last seen.
+type chainNode struct {
+	name string
+	seen time.Time
+}
+
+func newChains() *chains {
+	return &chains{nodes: make(map[enode.ID]*chainNode)}
+}
+
+// observeBody classifies the nodes whose records a decoded packet carries.
+// Records without an eth entry, such as those of consensus clients, leave
+// their node unclassified.
+func (c *chains) observeBody(now time.Time, body interface{}) {
+	for _, r := range enr.FromPacket(body) {
+		if !r.Verified {
+			continue
+		}
+		if id, ok := r.ForkID(); ok {
+			name := eth.NetworkCustom
+			if n := eth.ClassifyForkID(id); n != nil {
+				name = n.Name
+			}
+			c.classify(now, r.NodeID, name)
+		}
+	}
+}
+
+func (c *chains) classify(now time.Time, node enode.ID, name string) {
+	n := c.nodes[node]
+	if n == nil {
+		if len(c.nodes) >= chainsMaxNodes {
+			c.evict()
+		}
+		n = new(chainNode)
+		c.nodes[node] = n
+	}
+	n.name = name
+	if now.After(n.seen) {
+		n.seen = now
+	}
+}
+
+// evict forgets the tenth of the nodes seen least recently, as the node
+// table does.
+func (c *chains) evict() {
+	ids := make([]enode.ID, 0, len(c.nodes))
+	for id := range c.nodes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return c.nodes[ids[i]].seen.Before(c.nodes[ids[j]].seen) })
+	for _, id := range ids[:len(ids)/10+1] {
+		delete(c.nodes, id)
+	}
+}
+
+// of returns the network node was classified to, empty if unknown, and
+// marks it seen at now.
+func (c *chains) of(now time.Time, node enode.ID) string {
+	n := c.nodes[node]
+	if n == nil {
+		return ""
+	}
+	if now.After(n.seen) {
+		n.seen = now
+	}
+	return n.name
+}
+
+// ofV4 returns the network of the node with a discv4 node ID.
+func (c *chains) ofV4(now time.Time, id discv4.NodeID) string {
+	return c.of(now, v4ID(id))
+}
+
+// report logs the number of nodes classified to each network.
+func (c *chains) report() {
+	if len(c.nodes) == 0 {
+		return
+	}
+	counts := make(map[string]int)
+	for _, n := range c.nodes {
+		counts[n.name]++
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	e := log.Info().Int("classified", len(c.nodes))
+	for _, name := range names {
+		e = e.Int(name, counts[name])
+	}
+	e.Msg("node networks")
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/report"
+	"path/filepath"
+	"strings"
+)
+
+// command is a subcommand of etherspy, named by the first argument.
+type command struct {
+	name    string
+	args    string // synopsis of the arguments following the flags
+	summary string
+	run     func(args []string) error
+}
+
+// commands are the subcommands, in the order of the usage. Those decoding
+// traffic share the flags of the command line, the active ones have flag
+// sets of their own.
+var commands []command
+
+// Commands decoding traffic.
+const (
+	commandCapture = "capture"
+	commandRead    = "read"
+	commandServe   = "serve"
+	commandExport  = "export"
+	commandReport  = "report"
+	commandExtcap  = "extcap"
+)
+
+// batchMode is set by the report command, which renders its report to
+// batchOut, Markdown on stdout if empty, once the capture is decoded.
+var (
+	batchMode bool
+	batchOut  string
+)
+
+func init() {
+	decoding := func(name string) func([]string) error {
+		return func(args []string) error {
+			runCapture(name, args)
+			return nil
+		}
+	}
+	commands = []command{
+		{commandCapture, "", "Capture discovery traffic live from the interfaces of -i", decoding(commandCapture)},
+		{commandRead, "FILE", "Decode a pcap file or simulator trace", decoding(commandRead)},
+		{commandServe, "", "Capture live, or read -r, serving the HTTP API (default on localhost:8080) rather than printing packets", decoding(commandServe)},
+		{commandExport, "FILE OUT", "Decode a pcap file into OUT, JSON lines, CSV or SQLite by its extension", decoding(commandExport)},
+		{commandReport, "FILE", "Decode a pcap file and render a report of its protocol mix, top peers, handshakes, errors and timeline to -report-out (default Markdown on stdout)", decoding(commandReport)},
+		{commandExtcap, "--capture ...", "Run as a Wireshark extcap, a capture interface whose packets carry their decoding as comments", extcapCommand},
+		{"crawl", "", "Crawl the discv4 network from the bootnodes of a network", crawlCommand},
+		{"ping", "enode://...|enr:...", "Ping a node and fetch its record", pingCommand},
+		{"monitor-bootnodes", "", "Probe the bootnodes of a network and report their uptime", monitorBootnodes},
+		{"diagnose-peering", "", "Diagnose why the local node finds no peers", diagnoseCommand},
+		{"schema", "dump|validate ...", "Print the JSON Schemas of the outputs or validate output against them", schemaCommand},
+	}
+	flag.Usage = usage
+}
+
+// lookupCommand returns the subcommand named name, nil if there is none.
+func lookupCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "Usage: etherspy [command] [flags] [arguments]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-28s %s\n", strings.TrimSpace(c.name+" "+c.args), c.summary)
+	}
+	fmt.Fprintf(w, "\nWithout a command, etherspy reads the file of -r or else captures live.\n")
+	fmt.Fprintf(w, "Run etherspy COMMAND -h for the flags of the active commands.\n")
+	fmt.Fprintf(w, "\nFlags of %s, %s, %s, %s and %s:\n", commandCapture, commandRead, commandServe, commandExport, commandReport)
+	flag.PrintDefaults()
+}
+
+// flagGiven reports whether any of the named flags was set, on the command
+// line or by the configuration file.
+func flagGiven(names ...string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		for _, name := range names {
+			given = given || f.Name == name
+		}
+	})
+	return given
+}
+
+// setupCommand checks the arguments left after the flags against the
+// decoding command name, empty if none was given, and applies its
+// defaults.
+func setupCommand(name string) error {
+	args := flag.Args()
+	switch name {
+	case "":
+		return nil
+	case commandCapture:
+		if *fname != "" {
+			return fmt.Errorf("capture reads from interfaces, decode files with etherspy read")
+		}
+	case commandRead:
+		if len(args) == 1 && *fname == "" {
+			*fname, args = args[0], nil
+		}
+		if *fname == "" {
+			return fmt.Errorf("usage: etherspy read [flags] FILE")
+		}
+	case commandServe:
+		if *httpAddr == "" && *adminAddr == "" && *metricsAddr == "" {
+			*httpAddr = "localhost:8080"
+		}
+		if !flagGiven("output", "o") {
+			*outputFormat = outputNone
+		}
+	case commandReport:
+		if len(args) == 1 && *fname == "" {
+			*fname, args = args[0], nil
+		}
+		if *fname == "" {
+			return fmt.Errorf("usage: etherspy report [flags] FILE")
+		}
+		if *reportOut != "" {
+			if _, ok := report.FormatOf(*reportOut); !ok {
+				return fmt.Errorf("-report-out %s: unknown extension, want one of .txt, .md, .html or .pdf", *reportOut)
+			}
+		}
+		// The report is rendered once at the end rather than every minute.
+		batchMode, batchOut, *reportOut = true, *reportOut, ""
+		if *topTalkers == 0 {
+			*topTalkers = 10
+		}
+		*endpointProofTracking = true
+		if !flagGiven("output", "o") {
+			*outputFormat = outputNone
+		}
+	case commandExtcap:
+		if *pcapOutPath != "" {
+			return fmt.Errorf("-w conflicts with the capture written to Wireshark")
+		}
+	case commandExport:
+		if len(args) == 2 && *fname == "" {
+			*fname, args = args[0], args[1:]
+		}
+		if *fname == "" || len(args) != 1 {
+			return fmt.Errorf("usage: etherspy export [flags] FILE OUT, OUT ending in .jsonl, .json, .csv, .sqlite or .db")
+		}
+		if err := setupExport(args[0]); err != nil {
+			return err
+		}
+		args = nil
+		if !flagGiven("output", "o") {
+			*outputFormat = outputNone
+		}
+	}
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected arguments %q", strings.Join(args, " "))
+	}
+	return nil
+}
+
+// setupExport directs the output of the export command to out, by its
+// extension.
+func setupExport(out string) error {
+	var spec string
+	switch strings.ToLower(filepath.Ext(out)) {
+	case ".jsonl", ".json":
+		spec = outputJSON + ":" + out
+	case ".csv":
+		spec = outputCSV + ":" + out
+	case ".sqlite", ".db":
+		if *dbPath != "" {
+			return fmt.Errorf("export to %s conflicts with -db", out)
+		}
+		*dbPath = out
+		return nil
+	default:
+		return fmt.Errorf("export to %s: unknown extension, want .jsonl, .json, .csv, .sqlite or .db", out)
+	}
+	if *sinks != "" {
+		spec = *sinks + "," + spec
+	}
+	*sinks = spec
+	return nil
+}
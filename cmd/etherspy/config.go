@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/naoina/toml"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// configAliases are the names config files may give the flags whose own
+// names are too terse to read well there, and the shorthands of flags.
+var configAliases = map[string]string{
+	"o":          "output",
+	"interfaces": "i",
+	"read":       "r",
+	"filters":    "f",
+	"snaplen":    "s",
+	"verbose":    "v",
+	"sinks":      "sink",
+}
+
+// loadConfig sets the flags not given on the command line from a config
+// file, YAML or, with a .toml extension, TOML. Its settings are keyed by
+// flag name, lists setting repeatable flags such as -f once per item, and
+// named profiles override them:
+//
+//	interfaces: eth0,eth1
+//	filters: [udp port 30303, udp port 9000]
+//	output: json
+//	sinks: json:packets.jsonl
+//	profile: bootnode-monitor   # unless -config-profile is given
+//	profiles:
+//	  bootnode-monitor:
+//	    classify-networks: true
+//	    track-nodes: 10000
+//	  local-dev:
+//	    interfaces: lo
+//	    v: true
+//
+// The command line wins over profiles, which win over the top level.
+func loadConfig(path, profile string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = toml.Unmarshal(data, &doc)
+	} else {
+		err = yaml.Unmarshal(data, &doc)
+	}
+	if err != nil {
+		return fmt.Errorf("config %s: %v", path, err)
+	}
+
+	var profiles map[string]interface{}
+	if v, ok := doc["profiles"]; ok {
+		if profiles, ok = v.(map[string]interface{}); !ok {
+			return fmt.Errorf("config %s: profiles must map names to settings", path)
+		}
+		delete(doc, "profiles")
+	}
+	if v, ok := doc["profile"]; ok {
+		if profile == "" {
+			profile = fmt.Sprint(v)
+		}
+		delete(doc, "profile")
+	}
+
+	settings := make(map[string]interface{})
+	if err := mergeConfig(settings, doc); err != nil {
+		return fmt.Errorf("config %s: %v", path, err)
+	}
+	if profile != "" {
+		v, ok := profiles[profile]
+		if !ok {
+			names := make([]string, 0, len(profiles))
+			for name := range profiles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return fmt.Errorf("config %s has no profile %q, it has %s", path, profile, strings.Join(names, ", "))
+		}
+		p, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("config %s: profile %q must map flags to values", path, profile)
+		}
+		if err := mergeConfig(settings, p); err != nil {
+			return fmt.Errorf("config %s: profile %s: %v", path, profile, err)
+		}
+	}
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+		if name, ok := configAliases[f.Name]; ok {
+			given[name] = true
+		}
+	})
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if given[name] {
+			continue
+		}
+		values, err := configValues(settings[name])
+		if err != nil {
+			return fmt.Errorf("config %s: %s: %v", path, name, err)
+		}
+		for _, v := range values {
+			if err := flag.Set(name, v); err != nil {
+				return fmt.Errorf("config %s: %s: %v", path, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// mergeConfig adds settings to the flag values of dst, by flag name.
+func mergeConfig(dst, settings map[string]interface{}) error {
+	for key, v := range settings {
+		name := key
+		if alias, ok := configAliases[key]; ok {
+			name = alias
+		}
+		if name == "config" || name == "config-profile" {
+			return fmt.Errorf("%s can only be given on the command line", key)
+		}
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %q", key)
+		}
+		dst[name] = v
+	}
+	return nil
+}
+
+// configValues returns the values a setting sets its flag to, in order.
+func configValues(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, fmt.Errorf("no value")
+	case map[string]interface{}:
+		return nil, fmt.Errorf("want a value or a list of values")
+	case []interface{}:
+		values := make([]string, len(v))
+		for i, item := range v {
+			switch item.(type) {
+			case nil, map[string]interface{}, []interface{}:
+				return nil, fmt.Errorf("item %d is not a value", i+1)
+			}
+			values[i] = fmt.Sprint(item)
+		}
+		return values, nil
+	default:
+		return []string{fmt.Sprint(v)}, nil
+	}
+}
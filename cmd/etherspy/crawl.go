@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/drgomesp/etherspy/pkg/snapshot"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/rs/zerolog/log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// crawledNode is a node found by the crawl, as printed.
+type crawledNode struct {
+	ID        string `json:"id"`
+	URL       string `json:"enode"`
+	IP        string `json:"ip"`
+	UDP       int    `json:"udp"`
+	TCP       int    `json:"tcp"`
+	Answered  bool   `json:"answered"`
+	RTT       string `json:"rtt,omitempty"`
+	Neighbors int    `json:"neighbors"` // distinct nodes it returned
+}
+
+func newCrawledNode(n discv4.Node) *crawledNode {
+	url := "enode://" + n.ID.String() + "@" + net.JoinHostPort(n.IP.String(), strconv.Itoa(int(n.TCP)))
+	if n.UDP != n.TCP {
+		url += "?discport=" + strconv.Itoa(int(n.UDP))
+	}
+	return &crawledNode{
+		ID:  v4ID(n.ID).String(),
+		URL: url,
+		IP:  n.IP.String(),
+		UDP: int(n.UDP),
+		TCP: int(n.TCP),
+	}
+}
+
+// crawlCommand runs the crawl command: starting from the bootnodes of a
+// network, it pings every discv4 node it learns of and asks it for the
+// neighbors of random targets, until no new node turns up or -max-nodes
+// are known. Every node visited is printed as a JSON line, and the file of
+// -out gets them all once done.
+func crawlCommand(args []string) error {
+	fs := flag.NewFlagSet("crawl", flag.ExitOnError)
+	network := fs.String("network", "mainnet", "Network whose bootnodes the crawl starts from ("+bootnodeNetworkNames()+")")
+	bootnodes := fs.String("bootnodes", "", "Enode URLs the crawl starts from, comma separated, instead of those of -network")
+	listen := fs.String("listen", "0.0.0.0:0", "UDP address queries are sent from")
+	keyFile := fs.String("nodekey-file", "", "Key queries are signed with (default a new key)")
+	timeout := fs.Duration("timeout", 2*time.Second, "Time to wait for an answer")
+	lookups := fs.Int("lookups", 3, "FINDNODE queries of random targets sent to every node")
+	workers := fs.Int("workers", 32, "Nodes queried at once")
+	maxNodes := fs.Int("max-nodes", 10000, "Stop learning of new nodes once this many are known")
+	out := fs.String("out", "", "File the JSON array of the nodes visited is written to once done")
+	fs.Parse(args)
+	if *workers < 1 || *lookups < 1 || *maxNodes < 1 {
+		return fmt.Errorf("-workers, -lookups and -max-nodes must be positive")
+	}
+
+	urls := bootnodeNetworks[*network]
+	if *bootnodes != "" {
+		urls = strings.Split(*bootnodes, ",")
+	} else if urls == nil {
+		return fmt.Errorf("unknown network %q, want one of %s", *network, bootnodeNetworkNames())
+	}
+	var start []discv4.Node
+	for _, u := range urls {
+		n, err := enode.Parse(enode.ValidSchemes, strings.TrimSpace(u))
+		if err != nil {
+			return fmt.Errorf("invalid bootnode %q: %v", u, err)
+		}
+		var id discv4.NodeID
+		copy(id[:], crypto.FromECDSAPub(n.Pubkey())[1:])
+		start = append(start, discv4.Node{IP: n.IP(), UDP: uint16(n.UDP()), TCP: uint16(n.TCP()), ID: id})
+	}
+
+	var (
+		key *ecdsa.PrivateKey
+		err error
+	)
+	if *keyFile != "" {
+		key, err = readNodeKey(*keyFile)
+	} else {
+		key, err = crypto.GenerateKey()
+	}
+	if err != nil {
+		return err
+	}
+	p, err := newProber(*listen, key)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("crawling from %d bootnodes on %s", len(start), p.conn.LocalAddr())
+
+	c := &crawl{
+		prober:   p,
+		timeout:  *timeout,
+		lookups:  *lookups,
+		maxNodes: *maxNodes,
+		known:    make(map[discv4.NodeID]bool),
+		queue:    make(chan discv4.Node, *maxNodes),
+		enc:      json.NewEncoder(os.Stdout),
+	}
+	for _, n := range start {
+		c.learn(n)
+	}
+	if c.pending == 0 {
+		return fmt.Errorf("no bootnode to start from")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.work()
+		}()
+	}
+	wg.Wait()
+
+	answered := 0
+	for _, n := range c.visited {
+		if n.Answered {
+			answered++
+		}
+	}
+	log.Info().Int("known", len(c.known)).Int("visited", len(c.visited)).Int("answered", answered).Msg("crawl done")
+	if *out != "" {
+		return snapshot.Write(*out, c.visited)
+	}
+	return nil
+}
+
+// crawl is the state of a crawl: the nodes known, those left to visit and
+// those visited.
+type crawl struct {
+	prober   *prober
+	timeout  time.Duration
+	lookups  int
+	maxNodes int
+
+	mu      sync.Mutex
+	known   map[discv4.NodeID]bool
+	pending int // nodes queued or being visited
+	queue   chan discv4.Node
+	visited []*crawledNode
+	enc     *json.Encoder
+}
+
+// learn queues n unless it is known already or the crawl is full. The
+// queue is closed once nothing is pending anymore.
+func (c *crawl) learn(n discv4.Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.known[n.ID] || len(c.known) >= c.maxNodes || n.IP.IsUnspecified() || n.UDP == 0 {
+		return
+	}
+	c.known[n.ID] = true
+	c.pending++
+	c.queue <- n
+}
+
+func (c *crawl) work() {
+	for n := range c.queue {
+		visited := c.visit(n)
+		c.mu.Lock()
+		c.visited = append(c.visited, visited)
+		if err := c.enc.Encode(visited); err != nil {
+			log.Warn().Err(err).Msg("could not print crawled node")
+		}
+		if c.pending--; c.pending == 0 {
+			close(c.queue)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// visit pings n and asks it for the neighbors of random targets, learning
+// the nodes it returns.
+func (c *crawl) visit(n discv4.Node) *crawledNode {
+	node := newCrawledNode(n)
+	to := &net.UDPAddr{IP: n.IP, Port: int(n.UDP)}
+	ch, done := c.prober.subscribe(to)
+	defer done()
+
+	pong, rtt, err := c.prober.ping(to, ch, c.timeout)
+	if err != nil || pong == nil {
+		return node
+	}
+	node.Answered, node.RTT = true, rtt.String()
+	seen := make(map[discv4.NodeID]bool)
+	for i := 0; i < c.lookups; i++ {
+		var target discv4.NodeID
+		rand.Read(target[:])
+		nodes, ok := c.prober.findNode(to, ch, target, c.timeout)
+		if !ok {
+			break
+		}
+		for _, found := range nodes {
+			seen[found.ID] = true
+			c.learn(found)
+		}
+	}
+	node.Neighbors = len(seen)
+	return node
+}
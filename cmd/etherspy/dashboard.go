@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/errcode"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/drgomesp/etherspy/pkg/stats"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rates of the dashboard are computed over dashboardSpan of capture time,
+// and it lists up to dashboardRows talkers, handshakes and error codes, and
+// the last dashboardTranscript packets of the transcript.
+const (
+	dashboardSpan       = 10 * time.Second
+	dashboardRows       = 10
+	dashboardTranscript = 200
+)
+
+// dashboard collects what the -tui panels show, its rates read from the
+// series of the analyzers. It is fed by the capture loop and read through
+// snapshots taken on it.
+type dashboard struct {
+	series  *stats.Series
+	codes   map[string]uint64 // decode errors by code
+	talkers *stats.TopK       // node IDs
+	shakes  []handshakeRow    // most recent first
+	logs    *logRing
+}
+
+// handshakeRow is a discv5 handshake as listed by the dashboard.
+type handshakeRow struct {
+	Time   time.Time
+	Src    string
+	Node   string
+	Record bool
+	Keys   bool // the message decrypted with the derived keys
+}
+
+// dashboardView is a consistent copy of the dashboard state.
+type dashboardView struct {
+	Time       time.Time
+	Paused     bool
+	Rates      map[string]float64 // decoded packets per second by protocol
+	ErrorRates map[string]float64 // share of failed packets by protocol
+	Codes      []codeCount
+	Talkers    []stats.HeavyHitter
+	Handshakes []handshakeRow
+	Logs       []string
+
+	// Transcript names the peer pair of -transcript and Exchange lists its
+	// latest packets, both empty without a transcript.
+	Transcript string
+	Exchange   []string
+
+	// Decoders lists the decoders in the order of their key bindings, BPF,
+	// Grep and Match are the filters in effect.
+	Decoders         []decoderToggle
+	BPF, Grep, Match string
+}
+
+type decoderToggle struct {
+	Name    string
+	Enabled bool
+}
+
+type codeCount struct {
+	Code  string
+	Count uint64
+}
+
+func newDashboard(series *stats.Series, logs *logRing) *dashboard {
+	return &dashboard{
+		series:  series,
+		codes:   make(map[string]uint64),
+		talkers: stats.NewTopK(10 * dashboardRows),
+		logs:    logs,
+	}
+}
+
+func (d *dashboard) observeError(err error) {
+	d.codes[errcode.ID(err)]++
+}
+
+func (d *dashboard) observeNode(id string) {
+	d.talkers.Add(id, 1)
+}
+
+// observeV5 lists handshakes and counts the traffic of discv5 senders.
+func (d *dashboard) observeV5(rec *record, p discv5.Packet) {
+	if id, ok := discv5.SrcID(p); ok {
+		d.talkers.Add(id.String(), 1)
+	}
+	h, ok := p.(*discv5.Handshake)
+	if !ok {
+		return
+	}
+	row := handshakeRow{Time: rec.Time, Src: rec.Src, Node: h.SrcID.String(), Record: h.Record != nil, Keys: h.Body != nil}
+	d.shakes = append([]handshakeRow{row}, d.shakes...)
+	if len(d.shakes) > dashboardRows {
+		d.shakes = d.shakes[:dashboardRows]
+	}
+}
+
+// decay halves the talker counts, so they weigh recent traffic more as with
+// -top-talkers. Called every minute of capture time.
+func (d *dashboard) decay() {
+	d.talkers.Decay(0.5)
+}
+
+// view copies the state as of now, with the controls of status.
+func (d *dashboard) view(now time.Time, status controlStatus) dashboardView {
+	v := dashboardView{
+		Time:       now,
+		Paused:     status.Paused,
+		BPF:        status.BPF,
+		Grep:       status.Grep,
+		Match:      status.Match,
+		Rates:      make(map[string]float64),
+		ErrorRates: make(map[string]float64),
+		Talkers:    d.talkers.Top(dashboardRows),
+		Handshakes: append([]handshakeRow(nil), d.shakes...),
+		Logs:       d.logs.lines(),
+	}
+	for _, key := range d.series.Keys(seriesDecoded) {
+		protocol := strings.TrimPrefix(key, seriesDecoded)
+		ok := d.series.Sum(key, now, dashboardSpan)
+		failed := d.series.Sum(seriesFailed+protocol, now, dashboardSpan)
+		v.Rates[protocol] = ok / dashboardSpan.Seconds()
+		if ok+failed > 0 {
+			v.ErrorRates[protocol] = failed / (ok + failed)
+		}
+	}
+	for code, n := range d.codes {
+		v.Codes = append(v.Codes, codeCount{code, n})
+	}
+	sort.Slice(v.Codes, func(i, j int) bool {
+		if v.Codes[i].Count != v.Codes[j].Count {
+			return v.Codes[i].Count > v.Codes[j].Count
+		}
+		return v.Codes[i].Code < v.Codes[j].Code
+	})
+	if len(v.Codes) > dashboardRows {
+		v.Codes = v.Codes[:dashboardRows]
+	}
+	for _, name := range decoderNames() {
+		// Decoders are enabled until toggled.
+		enabled, seen := status.Decoders[name]
+		v.Decoders = append(v.Decoders, decoderToggle{name, enabled || !seen})
+	}
+	if conversation != nil {
+		v.Transcript = fmt.Sprintf("%s <-> %s, %s", conversation.a, conversation.b, conversation.summary())
+		for _, e := range conversation.tail(dashboardTranscript) {
+			v.Exchange = append(v.Exchange, e.line())
+		}
+	}
+	return v
+}
+
+// logRing keeps the last lines logged while the terminal is taken over by
+// the dashboard.
+type logRing struct {
+	mu   sync.Mutex
+	size int
+	buf  []string
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{size: size}
+}
+
+func (r *logRing) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		r.buf = append(r.buf, line)
+	}
+	if len(r.buf) > r.size {
+		r.buf = append(r.buf[:0], r.buf[len(r.buf)-r.size:]...)
+	}
+	return len(p), nil
+}
+
+// lines returns the kept lines, oldest first.
+func (r *logRing) lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.buf...)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/drgomesp/etherspy/pkg/store"
+	"github.com/drgomesp/etherspy/pkg/tracker"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// dbNodes is the size of the node table kept for -db and peer suggestions
+// when -track-nodes is unset.
+const dbNodes = 100_000
+
+// db is the SQLite database of -db, nil if unset. It is one of the output
+// sinks and also stores the node table.
+var db *store.DB
+
+// dbSaved is the time of the last node seen when the node table was last
+// saved, only nodes seen since are saved again.
+var dbSaved time.Time
+
+func openDB(path string) error {
+	d, err := store.Open(path)
+	if err != nil {
+		return err
+	}
+	db = d
+	output = append(output, d)
+	log.Info().Msgf("storing packets and nodes in %q", path)
+	return nil
+}
+
+// saveNodes stores the nodes seen since the last save.
+func saveNodes() {
+	var changed []tracker.Node
+	for _, n := range nodes.Nodes(0) {
+		if !n.LastSeen.After(dbSaved) {
+			// Nodes are sorted by last seen, the rest is unchanged.
+			break
+		}
+		changed = append(changed, n)
+	}
+	if len(changed) == 0 {
+		return
+	}
+	if err := db.SaveNodes(changed); err != nil {
+		log.Warn().Err(err).Msg("could not store nodes")
+		return
+	}
+	dbSaved = changed[0].LastSeen
+}
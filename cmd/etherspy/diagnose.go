@@ -0,0 +1,388 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"flag"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/ethereum/enr"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/rs/zerolog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcomes of a diagnose-peering check.
+const (
+	checkPass = "PASS"
+	checkWarn = "WARN"
+	checkFail = "FAIL"
+	checkSkip = "SKIP"
+)
+
+// checkResult is the outcome of a step of diagnose-peering.
+type checkResult struct {
+	name, outcome, detail string
+}
+
+// cause is a likely reason for a node's peering problems, the higher its
+// likelihood the earlier it is listed.
+type cause struct {
+	likelihood int
+	text       string
+}
+
+// diagnosis collects the checks run on a node and the causes they point to.
+type diagnosis struct {
+	checks []checkResult
+	causes []cause
+}
+
+func (d *diagnosis) check(name, outcome, format string, args ...interface{}) {
+	d.checks = append(d.checks, checkResult{name, outcome, fmt.Sprintf(format, args...)})
+}
+
+func (d *diagnosis) suspect(likelihood int, format string, args ...interface{}) {
+	d.causes = append(d.causes, cause{likelihood, fmt.Sprintf(format, args...)})
+}
+
+func (d *diagnosis) failed() bool {
+	for _, c := range d.checks {
+		if c.outcome == checkFail {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *diagnosis) print() {
+	for _, c := range d.checks {
+		fmt.Printf("%-4s  %-22s %s\n", c.outcome, c.name, c.detail)
+	}
+	if len(d.causes) == 0 {
+		fmt.Println("no likely cause of peering problems found")
+		return
+	}
+	sort.SliceStable(d.causes, func(i, j int) bool { return d.causes[i].likelihood > d.causes[j].likelihood })
+	fmt.Println("likely causes, most likely first:")
+	for i, c := range d.causes {
+		fmt.Printf("%3d. %s\n", i+1, c.text)
+	}
+}
+
+// diagnoseCommand runs the diagnose-peering command on the node of a data
+// directory. It checks, in turn, that the node's discovery port answers on
+// the host, that pings to the bootnodes of its network leave the host and
+// their PONGs come back, that the bootnodes then answer FINDNODE, which
+// takes them proving our endpoint, that the node's record advertises the
+// public address the bootnodes see, and that the node's ports are open at
+// that address. It prints the outcome of every check and a ranked list of
+// the likely causes of failures, exiting with exitAlert if a check failed.
+func diagnoseCommand(args []string) error {
+	fs := flag.NewFlagSet("diagnose-peering", flag.ExitOnError)
+	datadir := fs.String("datadir", "", "Data directory of the node, holding its nodekey and possibly enr.dat")
+	keyFile := fs.String("nodekey-file", "", "Key of the node (default the nodekey in -datadir)")
+	recordFile := fs.String("enr-file", "", "File holding the node's textual ENR (default enr.dat next to the node key, else asked from the node)")
+	host := fs.String("host", "127.0.0.1", "Address the node listens on from this host")
+	port := fs.Int("port", 30303, "UDP discovery port of the node")
+	tcpPort := fs.Int("tcp-port", 0, "TCP port of the node (default from its record, else -port)")
+	network := fs.String("network", "mainnet", "Network whose bootnodes are pinged ("+bootnodeNetworkNames()+")")
+	timeout := fs.Duration("timeout", 5*time.Second, "Time to wait for an answer")
+	listen := fs.String("listen", "0.0.0.0:0", "UDP address probes are sent from")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: etherspy diagnose-peering -datadir DIR [flags]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *datadir == "" && *keyFile == "" {
+		fs.Usage()
+		return fmt.Errorf("want the node's -datadir or -nodekey-file")
+	}
+	// The diagnosis is printed, the log only tells of probes that failed.
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+
+	if *keyFile == "" {
+		*keyFile = gethNodeKey(*datadir)
+	}
+	nodeKey, err := readNodeKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	self := enode.PubkeyToIDV4(&nodeKey.PublicKey)
+	if *recordFile == "" {
+		if p := filepath.Join(filepath.Dir(*keyFile), "enr.dat"); fileExists(p) {
+			*recordFile = p
+		}
+	}
+	urls, ok := bootnodeNetworks[*network]
+	if !ok {
+		return fmt.Errorf("unknown network %q, want one of %s", *network, bootnodeNetworkNames())
+	}
+	// Probes are signed with a key of their own, bootnodes must not mistake
+	// them for the node's.
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("diagnosing peering of node %s (key %s)\n", self.TerminalString(), *keyFile)
+
+	d := new(diagnosis)
+	record := diagnoseLocal(d, self, key, *listen, *recordFile, &net.UDPAddr{IP: net.ParseIP(*host), Port: *port}, *timeout)
+	public, err := diagnoseBootnodes(d, urls, key, *listen, *timeout)
+	if err != nil {
+		return err
+	}
+	udpPort, tcp := *port, *tcpPort
+	if record != nil {
+		if p, ok := record.UDP(); ok {
+			udpPort = int(p)
+		}
+		if p, ok := record.TCP(); ok && tcp == 0 {
+			tcp = int(p)
+		}
+	}
+	if tcp == 0 {
+		tcp = *port
+	}
+	diagnoseRecord(d, record, public, *port)
+	diagnosePorts(d, key, *listen, *host, public, udpPort, tcp, *timeout)
+
+	d.print()
+	if d.failed() {
+		exitCode = exitAlert
+	}
+	return nil
+}
+
+// diagnoseLocal checks that the node's discovery answers a PING on the host
+// and returns its record, read from recordFile or asked from the node.
+func diagnoseLocal(d *diagnosis, self enode.ID, key *ecdsa.PrivateKey, listen, recordFile string, addr *net.UDPAddr, timeout time.Duration) *enr.Record {
+	const name = "discovery listening"
+	p, err := newV4Pinger(listen, key, addr)
+	if err != nil {
+		d.check(name, checkFail, "%v", err)
+		return nil
+	}
+	defer p.close()
+	rtt, err := p.ping(timeout)
+	switch {
+	case err != nil:
+		d.check(name, checkFail, "could not ping %s: %v", addr, err)
+		d.suspect(60, "a local firewall blocks UDP, even on the host: pinging %s failed with %v", addr, err)
+	case rtt == 0:
+		d.check(name, checkFail, "no PONG from %s within %s", addr, timeout)
+		d.suspect(95, "the node is not running, runs with discovery disabled or listens on another port than %d", addr.Port)
+	default:
+		d.check(name, checkPass, "%s answered in %s", addr, rtt.Round(time.Microsecond))
+	}
+
+	var record *enr.Record
+	source := recordFile
+	if recordFile != "" {
+		data, err := os.ReadFile(recordFile)
+		if err == nil {
+			record, err = enr.Parse(strings.TrimSpace(string(data)))
+		}
+		if err != nil {
+			d.check("local record", checkWarn, "%v", err)
+		}
+	} else if rtt > 0 {
+		source = "the node"
+		if record, err = p.record(timeout); err != nil || record == nil {
+			d.check("local record", checkWarn, "the node did not send its record")
+			record = nil
+		}
+	}
+	switch {
+	case record == nil:
+		if rtt > 0 || recordFile != "" {
+			d.suspect(30, "the node's record is unknown, so what it advertises could not be checked")
+		} else {
+			d.check("local record", checkSkip, "no enr.dat and the node did not answer")
+		}
+	case !record.Verified || record.NodeID != self:
+		d.check("local record", checkFail, "record from %s belongs to %s, not the node of the key", source, record.NodeID.TerminalString())
+		d.suspect(90, "another node than the one of the key answers on the port, or -datadir points at another node")
+		return nil
+	default:
+		d.check("local record", checkPass, "seq %d from %s", record.Seq, source)
+	}
+	return record
+}
+
+// diagnoseBootnodes pings the bootnodes and, once they answered, asks them
+// for neighbors. It returns the public address the bootnodes saw the most,
+// nil if none answered.
+func diagnoseBootnodes(d *diagnosis, urls []string, key *ecdsa.PrivateKey, listen string, timeout time.Duration) (net.IP, error) {
+	var nodes []*bootnodeHealth
+	for _, u := range urls {
+		n, err := enode.Parse(enode.ValidSchemes, u)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bootnode %q: %v", u, err)
+		}
+		if n.IP().To4() != nil {
+			nodes = append(nodes, &bootnodeHealth{node: n})
+		}
+	}
+	p, err := newProber(listen, key)
+	if err != nil {
+		return nil, err
+	}
+	defer p.conn.Close()
+	var wg sync.WaitGroup
+	for _, h := range nodes {
+		wg.Add(1)
+		go func(h *bootnodeHealth) {
+			defer wg.Done()
+			p.probe(h, timeout)
+		}(h)
+	}
+	wg.Wait()
+
+	var sent, pongs, answered int
+	var lastErr error
+	seen := make(map[string]int)
+	for _, h := range nodes {
+		if h.lastErr != nil {
+			lastErr = h.lastErr
+			continue
+		}
+		sent++
+		if h.pongs > 0 {
+			pongs++
+			if h.seenAs != nil {
+				seen[h.seenAs.String()]++
+			}
+		}
+		if h.neighbors > 0 {
+			answered++
+		}
+	}
+
+	switch {
+	case sent == 0:
+		d.check("outbound pings", checkFail, "none of %d pings could be sent: %v", len(nodes), lastErr)
+		d.suspect(90, "outbound UDP is blocked on the host or there is no route to the internet: %v", lastErr)
+	default:
+		d.check("outbound pings", checkPass, "%d of %d pings to bootnodes sent", sent, len(nodes))
+	}
+	switch {
+	case sent == 0:
+		d.check("inbound responses", checkSkip, "no ping sent")
+	case pongs == 0:
+		d.check("inbound responses", checkFail, "no PONG from %d bootnodes", sent)
+		d.suspect(80, "a firewall drops inbound UDP, or outbound UDP is dropped past the host")
+	case pongs < sent/2:
+		d.check("inbound responses", checkWarn, "PONGs from %d of %d bootnodes", pongs, sent)
+		d.suspect(20, "UDP is lossy or rate limited on the path, %d of %d bootnodes answered", pongs, sent)
+	default:
+		d.check("inbound responses", checkPass, "PONGs from %d of %d bootnodes", pongs, sent)
+	}
+	switch {
+	case pongs == 0:
+		d.check("endpoint proofs", checkSkip, "no bootnode answered")
+	case answered == 0:
+		d.check("endpoint proofs", checkFail, "none of %d bootnodes answered FINDNODE", pongs)
+		d.suspect(70, "the bootnodes' own pings don't reach the host, so they never prove its endpoint and ignore its queries")
+	default:
+		d.check("endpoint proofs", checkPass, "%d of %d bootnodes answered FINDNODE", answered, pongs)
+	}
+
+	var public string
+	for ip, n := range seen {
+		if public == "" || n > seen[public] || n == seen[public] && ip < public {
+			public = ip
+		}
+	}
+	if len(seen) > 1 {
+		d.suspect(40, "bootnodes see the host at %d addresses, the NAT maps it inconsistently", len(seen))
+	}
+	return net.ParseIP(public), nil
+}
+
+// diagnoseRecord checks that the node's record advertises the public
+// address and the port the node listens on.
+func diagnoseRecord(d *diagnosis, record *enr.Record, public net.IP, port int) {
+	const name = "record address"
+	if record == nil || public == nil {
+		d.check(name, checkSkip, "needs the node's record and the address bootnodes see")
+		return
+	}
+	ip, ok := record.IP()
+	switch {
+	case !ok:
+		d.check(name, checkFail, "the record has no IP, bootnodes see %s", public)
+		d.suspect(65, "the node doesn't advertise an IP, set it with --nat extip:%s", public)
+	case !ip.Equal(public):
+		d.check(name, checkFail, "the record advertises %s, bootnodes see %s", ip, public)
+		if ip.IsPrivate() || ip.IsLoopback() {
+			d.suspect(85, "the record advertises the private address %s, set the public one with --nat extip:%s", ip, public)
+		} else {
+			d.suspect(85, "the record advertises %s but the host is seen at %s, the public IP changed or --nat is wrong", ip, public)
+		}
+	default:
+		d.check(name, checkPass, "the record advertises %s, as bootnodes see it", ip)
+	}
+	if udp, ok := record.UDP(); ok && int(udp) != port {
+		d.check("record port", checkWarn, "the record advertises UDP port %d, the node was pinged on %d", udp, port)
+		d.suspect(50, "the record advertises UDP port %d, check the port mapping or the node's --discovery.port", udp)
+	}
+}
+
+// diagnosePorts checks that the node's UDP and TCP ports answer at its
+// public address. Routers that don't hairpin make these checks fail from
+// inside the NAT, so failures are only suspected causes when the node
+// answers on the host.
+func diagnosePorts(d *diagnosis, key *ecdsa.PrivateKey, listen, host string, public net.IP, udpPort, tcpPort int, timeout time.Duration) {
+	const name = "ports reachable"
+	if public == nil {
+		d.check(name, checkSkip, "the public address is unknown")
+		return
+	}
+	udp := &net.UDPAddr{IP: public, Port: udpPort}
+	var udpOK bool
+	if p, err := newV4Pinger(listen, key, udp); err == nil {
+		rtt, err := p.ping(timeout)
+		udpOK = err == nil && rtt > 0
+		p.close()
+	}
+	tcp := net.JoinHostPort(public.String(), strconv.Itoa(tcpPort))
+	tcpOK := dialable(tcp, timeout)
+	localTCP := dialable(net.JoinHostPort(host, strconv.Itoa(tcpPort)), timeout)
+
+	switch {
+	case udpOK && tcpOK:
+		d.check(name, checkPass, "UDP %s and TCP %s answer", udp, tcp)
+		return
+	case udpOK:
+		d.check(name, checkFail, "UDP %s answers, TCP %s doesn't", udp, tcp)
+	case tcpOK:
+		d.check(name, checkFail, "TCP %s answers, UDP %s doesn't", tcp, udp)
+	default:
+		d.check(name, checkFail, "neither UDP %s nor TCP %s answer", udp, tcp)
+	}
+	if !localTCP {
+		d.suspect(60, "nothing listens on TCP port %d on the host, peers can't connect even once discovered", tcpPort)
+	}
+	if !udpOK {
+		d.suspect(75, "UDP port %d is not forwarded to the host, or the router doesn't hairpin and this check must be run from outside", udpPort)
+	}
+	if !tcpOK && localTCP {
+		d.suspect(75, "TCP port %d is not forwarded to the host, or the router doesn't hairpin and this check must be run from outside", tcpPort)
+	}
+}
+
+func dialable(addr string, timeout time.Duration) bool {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/drgomesp/etherspy/pkg/tracker"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// queued is an entry of a correlation queue: a request, challenge or
+// attempt awaiting the packet that completes it.
+type queued struct {
+	Since  time.Time `json:"since"`
+	From   string    `json:"from,omitempty"`
+	To     string    `json:"to,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// stateDump is the internal state written on demand, to debug odd behavior
+// without stopping capture. Keys are left out of the session table.
+type stateDump struct {
+	Time     time.Time             `json:"time"`
+	LastSeen time.Time             `json:"last_seen"`
+	Control  controlStatus         `json:"control"`
+	Sketches analyzerState         `json:"sketches"`
+	Seen     *uint64               `json:"seen_nodes,omitempty"`
+	Nodes    []tracker.Node        `json:"nodes,omitempty"`
+	Sessions discv5.SessionSummary `json:"sessions"`
+	Queues   map[string][]queued   `json:"queues"`
+	Pending  map[string]int        `json:"pending"` // of queues only counted
+}
+
+// dumper writes the state dumps requested with SIGUSR1 or the admin API to
+// timestamped files of a directory. It runs on the capture loop.
+type dumper struct {
+	dir      string
+	control  *controller
+	analysis *analyzers
+	sessions *discv5.SessionStore
+}
+
+// dump writes the current state, returning the path of the file.
+func (d *dumper) dump() (string, error) {
+	now := time.Now()
+	s := stateDump{
+		Time:     now,
+		LastSeen: d.analysis.lastSeen,
+		Sketches: d.analysis.state(),
+		Seen:     d.analysis.seenNodes(),
+		Sessions: d.sessions.Summary(),
+		Queues:   make(map[string][]queued),
+		Pending:  make(map[string]int),
+	}
+	st, _ := d.control.status()
+	s.Control = st.(controlStatus)
+	if nodes != nil {
+		s.Nodes = nodes.Nodes(0)
+		for i := range s.Nodes {
+			s.Nodes[i] = enrichNode(s.Nodes[i])
+		}
+	}
+
+	s.Queues["enr_requests"] = queuedENRRequests()
+	if h := d.analysis.handshakes; h != nil {
+		s.Queues["challenges"], s.Queues["challenge_triggers"] = h.queued()
+	}
+	if h := d.analysis.holePunch; h != nil {
+		s.Queues["hole_punches"] = h.queued()
+	}
+	if p := d.analysis.proofs; p != nil {
+		s.Queues["pings"] = p.queued()
+	}
+	if l := d.analysis.lookups; l != nil {
+		s.Queues["lookups"] = l.queued()
+	}
+	for _, q := range s.Queues {
+		sort.Slice(q, func(i, j int) bool { return q[i].Since.Before(q[j].Since) })
+	}
+	if decoding != nil {
+		s.Pending["decode_workers"] = decoding.pending
+	}
+	if enrichment != nil {
+		for stage, n := range enrichment.pending() {
+			s.Pending[stage] = n
+		}
+	}
+	if g := d.analysis.ghosts; g != nil {
+		s.Pending["ghost_mentions"] = len(g.mentions)
+	}
+
+	path := filepath.Join(d.dir, "etherspy-state-"+now.UTC().Format("20060102-150405.000")+".json")
+	if err := writeJSON(path, s); err != nil {
+		return "", fmt.Errorf("state dump: %v", err)
+	}
+	log.Info().Str("path", path).Msg("state dumped")
+	return path, nil
+}
+
+// writeJSON writes v indented to path, through a temporary file so readers
+// never see it half written.
+func writeJSON(path string, v interface{}) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	enc := json.NewEncoder(tmp)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func queuedENRRequests() []queued {
+	q := make([]queued, 0, len(enrRequests))
+	for hash, r := range enrRequests {
+		q = append(q, queued{Since: r.time, From: r.from, To: r.to, Detail: fmt.Sprintf("hash %x", hash)})
+	}
+	return q
+}
+
+// queued returns the WHOAREYOU challenges awaiting their handshake, and the
+// messages that may yet be challenged.
+func (h *handshakes) queued() (challenges, triggers []queued) {
+	challenges = make([]queued, 0, len(h.pending))
+	for key, c := range h.pending {
+		challenges = append(challenges, queued{Since: c.time, From: key[1], To: key[0], Detail: c.network + " " + c.direction})
+	}
+	triggers = make([]queued, 0, len(h.triggers))
+	for nonce, t := range h.triggers {
+		triggers = append(triggers, queued{Since: t.time, From: t.src, To: t.dst, Detail: fmt.Sprintf("nonce %x", nonce[:])})
+	}
+	return challenges, triggers
+}
+
+func (h *holePunches) queued() []queued {
+	q := make([]queued, 0, len(h.pending))
+	for _, a := range h.pending {
+		q = append(q, queued{
+			Since:  a.started,
+			From:   a.initiator,
+			To:     a.target,
+			Detail: fmt.Sprintf("relayed %t punched %t succeeded %t", a.relayed, a.punched, a.succeeded),
+		})
+	}
+	return q
+}
+
+func (p *endpointProofs) queued() []queued {
+	q := make([]queued, 0, len(p.pings))
+	for hash, ping := range p.pings {
+		q = append(q, queued{Since: ping.time, From: ping.from, To: ping.to, Detail: fmt.Sprintf("hash %x", hash)})
+	}
+	return q
+}
+
+func (l *lookups) queued() []queued {
+	q := make([]queued, 0, len(l.pending))
+	for key, f := range l.pending {
+		q = append(q, queued{Since: f.time, From: key[0], To: key[1], Detail: "target " + f.target.String()})
+	}
+	return q
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// dumpSignals request a state dump.
+var dumpSignals = []os.Signal{syscall.SIGUSR1}
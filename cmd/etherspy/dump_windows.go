@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// dumpSignals is empty, Windows has no SIGUSR1: state dumps are requested
+// through the admin API only.
+var dumpSignals []os.Signal
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/tracker"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// enricher is a stage of the enrichment pipeline, adding what it knows of
+// the peers at an endpoint to node profiles and reports. Enrichers are
+// called from the capture loop and the API handlers alike, so they must be
+// safe for concurrent use and never block: lookups taking time are made in
+// the background, as reverse DNS does.
+type enricher interface {
+	// observe notes an endpoint seen in a decoded packet.
+	observe(endpoint string)
+	// endpoint fills in what the stage knows of e.
+	endpoint(e *tracker.Endpoint)
+	// event adds what the stage knows of endpoint to a report event.
+	event(ev *zerolog.Event, endpoint string) *zerolog.Event
+	report()
+}
+
+// enrichStageSpec describes a known stage, enabled by flags of its own.
+type enrichStageSpec struct {
+	name       string
+	configured func() bool
+	flag       string        // enabling the stage, for errors
+	timeout    time.Duration // default
+	open       func(timeout time.Duration) (enricher, error)
+}
+
+// enrichStages are the known stages, in the order they run unless -enrich
+// says otherwise. Cheap local lookups come first.
+var enrichStages = []enrichStageSpec{
+	{
+		name:       "labels",
+		configured: func() bool { return *labelsFile != "" },
+		flag:       "-labels",
+		timeout:    time.Millisecond,
+		open:       func(time.Duration) (enricher, error) { return loadLabels(*labelsFile) },
+	},
+	{
+		name:       "geoip",
+		configured: func() bool { return *geoIPFiles != "" },
+		flag:       "-geoip",
+		timeout:    time.Millisecond,
+		open:       func(time.Duration) (enricher, error) { return openGeoIP(*geoIPFiles) },
+	},
+	{
+		name:       "rdns",
+		configured: func() bool { return *rdnsRate > 0 },
+		flag:       "-rdns",
+		timeout:    2 * time.Second,
+		open: func(timeout time.Duration) (enricher, error) {
+			return newRDNS(*rdnsRate, *rdnsCache, timeout), nil
+		},
+	},
+}
+
+// enrichment is the pipeline of enabled stages, nil if there is none.
+var enrichment *pipeline
+
+// enrichStage is a stage of the pipeline along with its metrics. Calls
+// taking longer than the timeout of the stage are counted as slow; stages
+// doing lookups give each of them the timeout.
+type enrichStage struct {
+	name    string
+	timeout time.Duration
+	e       enricher
+
+	disabled int32 // through the admin API
+	calls    uint64
+	slow     uint64
+	nanos    uint64 // spent in calls
+}
+
+// enrichStatus is the state of a stage as the admin API reports it.
+type enrichStatus struct {
+	Name    string        `json:"name"`
+	Enabled bool          `json:"enabled"`
+	Timeout time.Duration `json:"timeout_ns"`
+	Calls   uint64        `json:"calls"`
+	Slow    uint64        `json:"slow"`
+	Average time.Duration `json:"average_ns"`
+}
+
+func (s *enrichStage) enabled() bool {
+	return atomic.LoadInt32(&s.disabled) == 0
+}
+
+// track accounts for a call that started at start.
+func (s *enrichStage) track(start time.Time) {
+	d := time.Since(start)
+	atomic.AddUint64(&s.calls, 1)
+	atomic.AddUint64(&s.nanos, uint64(d))
+	if d > s.timeout {
+		atomic.AddUint64(&s.slow, 1)
+	}
+}
+
+func (s *enrichStage) status() enrichStatus {
+	st := enrichStatus{
+		Name:    s.name,
+		Enabled: s.enabled(),
+		Timeout: s.timeout,
+		Calls:   atomic.LoadUint64(&s.calls),
+		Slow:    atomic.LoadUint64(&s.slow),
+	}
+	if st.Calls > 0 {
+		st.Average = time.Duration(atomic.LoadUint64(&s.nanos) / st.Calls)
+	}
+	return st
+}
+
+// pipeline runs the enabled stages in order, later stages overriding what
+// earlier ones filled in.
+type pipeline struct {
+	stages []*enrichStage
+}
+
+// newPipeline opens the stages listed in spec, comma separated as
+// name[:timeout] in the order they are to run. An empty spec runs every
+// stage whose flags are set, in the default order. Stages whose flags are
+// set but missing from spec stay off, so heavy ones can be left out.
+func newPipeline(spec string) (*pipeline, error) {
+	type choice struct {
+		spec    enrichStageSpec
+		timeout time.Duration
+	}
+	var chosen []choice
+	if strings.TrimSpace(spec) == "" {
+		for _, s := range enrichStages {
+			if s.configured() {
+				chosen = append(chosen, choice{s, s.timeout})
+			}
+		}
+	} else {
+		seen := make(map[string]bool)
+		for _, item := range strings.Split(spec, ",") {
+			item = strings.TrimSpace(item)
+			name, timeout := item, ""
+			if i := strings.IndexByte(item, ':'); i >= 0 {
+				name, timeout = item[:i], item[i+1:]
+			}
+			s, ok := enrichStageByName(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown enrichment stage %q, want one of %s", name, enrichStageNames())
+			}
+			if seen[name] {
+				return nil, fmt.Errorf("enrichment stage %q listed twice", name)
+			}
+			seen[name] = true
+			if !s.configured() {
+				return nil, fmt.Errorf("enrichment stage %q needs %s", name, s.flag)
+			}
+			c := choice{s, s.timeout}
+			if timeout != "" {
+				d, err := time.ParseDuration(timeout)
+				if err != nil || d <= 0 {
+					return nil, fmt.Errorf("invalid timeout %q of enrichment stage %q", timeout, name)
+				}
+				c.timeout = d
+			}
+			chosen = append(chosen, c)
+		}
+		for _, s := range enrichStages {
+			if s.configured() && !seen[s.name] {
+				log.Info().Msgf("enrichment stage %s is set up by %s but not listed by -enrich, leaving it off", s.name, s.flag)
+			}
+		}
+	}
+	if len(chosen) == 0 {
+		return nil, nil
+	}
+
+	p := new(pipeline)
+	names := make([]string, len(chosen))
+	for i, c := range chosen {
+		e, err := c.spec.open(c.timeout)
+		if err != nil {
+			return nil, fmt.Errorf("enrichment stage %s: %v", c.spec.name, err)
+		}
+		p.stages = append(p.stages, &enrichStage{name: c.spec.name, timeout: c.timeout, e: e})
+		names[i] = c.spec.name
+	}
+	log.Info().Msgf("enrichment stages: %s", strings.Join(names, ", "))
+	return p, nil
+}
+
+func enrichStageByName(name string) (enrichStageSpec, bool) {
+	for _, s := range enrichStages {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return enrichStageSpec{}, false
+}
+
+func enrichStageNames() string {
+	names := make([]string, len(enrichStages))
+	for i, s := range enrichStages {
+		names[i] = s.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// observe hands a peer endpoint seen in a decoded packet to every stage.
+func (p *pipeline) observe(endpoint string) {
+	for _, s := range p.stages {
+		if s.enabled() {
+			start := time.Now()
+			s.e.observe(endpoint)
+			s.track(start)
+		}
+	}
+}
+
+// setEnabled toggles the stage named name.
+func (p *pipeline) setEnabled(name string, enabled bool) error {
+	for _, s := range p.stages {
+		if s.name == name {
+			var v int32
+			if !enabled {
+				v = 1
+			}
+			atomic.StoreInt32(&s.disabled, v)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown or unused enrichment stage %q", name)
+}
+
+func (p *pipeline) status() []enrichStatus {
+	st := make([]enrichStatus, len(p.stages))
+	for i, s := range p.stages {
+		st[i] = s.status()
+	}
+	return st
+}
+
+// pending returns the lookups waiting in the background, by stage.
+func (p *pipeline) pending() map[string]int {
+	m := make(map[string]int)
+	for _, s := range p.stages {
+		if q, ok := s.e.(interface{ pending() int }); ok {
+			m["enrich_"+s.name] = q.pending()
+		}
+	}
+	return m
+}
+
+// collectors exposes the metrics of the stages to Prometheus.
+func (p *pipeline) collectors() []prometheus.Collector {
+	var cs []prometheus.Collector
+	for _, s := range p.stages {
+		s := s
+		labels := prometheus.Labels{"stage": s.name}
+		cs = append(cs,
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace:   "etherspy",
+				Name:        "enrich_calls_total",
+				Help:        "Calls of an enrichment stage.",
+				ConstLabels: labels,
+			}, func() float64 { return float64(atomic.LoadUint64(&s.calls)) }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace:   "etherspy",
+				Name:        "enrich_slow_calls_total",
+				Help:        "Calls of an enrichment stage exceeding its timeout.",
+				ConstLabels: labels,
+			}, func() float64 { return float64(atomic.LoadUint64(&s.slow)) }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Namespace:   "etherspy",
+				Name:        "enrich_seconds_total",
+				Help:        "Time spent in calls of an enrichment stage.",
+				ConstLabels: labels,
+			}, func() float64 { return time.Duration(atomic.LoadUint64(&s.nanos)).Seconds() }),
+		)
+	}
+	return cs
+}
+
+// report logs the metrics of every stage, then lets each report on its
+// own.
+func (p *pipeline) report() {
+	for _, s := range p.stages {
+		st := s.status()
+		log.Info().
+			Str("stage", st.Name).
+			Bool("enabled", st.Enabled).
+			Uint64("calls", st.Calls).
+			Uint64("slow", st.Slow).
+			Dur("average", st.Average).
+			Msg("enrichment")
+		s.e.report()
+	}
+}
+
+// enrichEvent adds what the enabled stages know of endpoint to a report
+// event.
+func enrichEvent(ev *zerolog.Event, endpoint string) *zerolog.Event {
+	if enrichment == nil {
+		return ev
+	}
+	for _, s := range enrichment.stages {
+		if s.enabled() {
+			start := time.Now()
+			ev = s.e.event(ev, endpoint)
+			s.track(start)
+		}
+	}
+	return ev
+}
+
+// enrichNode returns a copy of n with what the enabled stages know of its
+// endpoints filled in.
+func enrichNode(n tracker.Node) tracker.Node {
+	if enrichment == nil {
+		return n
+	}
+	for _, s := range enrichment.stages {
+		if !s.enabled() {
+			continue
+		}
+		start := time.Now()
+		for i := range n.Endpoints {
+			s.e.endpoint(&n.Endpoints[i])
+		}
+		s.track(start)
+	}
+	return n
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"github.com/drgomesp/etherspy/pkg/tracker"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// enrWatcher merges the node records found in a file, or in the files of a
+// directory, into the resolution table and the node table, polling for
+// changes so records exported by other tooling keep flowing in. Files hold
+// one ENR or enode URL per line; blank lines, lines starting with # and
+// anything following the record on its line are ignored. Enabled with
+// -enr-watch.
+type enrWatcher struct {
+	path  string
+	table *resolver
+	read  map[string]fileStamp // files already merged, by path
+}
+
+// fileStamp tells whether a file changed since it was last read.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+func newENRWatcher(path string, table *resolver) *enrWatcher {
+	return &enrWatcher{path: path, table: table, read: make(map[string]fileStamp)}
+}
+
+// watch merges the files changed since the previous poll, every interval.
+func (w *enrWatcher) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := w.poll(); err != nil {
+			log.Warn().Err(err).Msgf("could not watch records in %q", w.path)
+		}
+	}
+}
+
+// poll merges the files changed since the previous poll.
+func (w *enrWatcher) poll() error {
+	info, err := os.Stat(w.path)
+	if err != nil {
+		return err
+	}
+	files := []string{w.path}
+	if info.IsDir() {
+		entries, err := os.ReadDir(w.path)
+		if err != nil {
+			return err
+		}
+		files = files[:0]
+		for _, e := range entries {
+			if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+				files = append(files, filepath.Join(w.path, e.Name()))
+			}
+		}
+	}
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		stamp := fileStamp{size: info.Size(), modTime: info.ModTime()}
+		if w.read[path] == stamp {
+			continue
+		}
+		if err := w.merge(path, stamp.modTime); err != nil {
+			log.Warn().Err(err).Msgf("could not read records from %q", path)
+			continue
+		}
+		w.read[path] = stamp
+	}
+	return nil
+}
+
+// merge reads the records of a file modified at the given time.
+func (w *enrWatcher) merge(path string, modified time.Time) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var records, resolved, invalid int
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 4096), 1<<20)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		n, err := enode.Parse(enode.ValidSchemes, fields[0])
+		if err != nil {
+			invalid++
+			continue
+		}
+		records++
+		if w.table.add(n) {
+			resolved++
+		}
+		if nodes != nil {
+			nodes.ObserveRecord(n, recordClient(n.Record()), tracker.Provenance{Time: modified, Source: "file", From: path})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	log.Info().
+		Str("file", path).
+		Int("records", records).
+		Int("new_endpoints", resolved).
+		Int("invalid", invalid).
+		Int("endpoints", w.table.len()).
+		Msg("merged node records")
+	return nil
+}
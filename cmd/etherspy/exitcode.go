@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"os"
+)
+
+// Exit codes, stable so scripts and cron jobs can tell failures apart.
+const (
+	exitOK           = 0
+	exitError        = 1 // invalid flags and any other failure
+	exitDecodeErrors = 2 // more decode failures than -max-error-rate
+	exitCapture      = 3 // the capture could not be opened
+	exitAlert        = 4 // an alert fired
+)
+
+// exitCode is the code main exits with once done, set by finish.
+var exitCode = exitOK
+
+// exitWith logs err and exits with code.
+func exitWith(code int, err error) {
+	log.WithLevel(zerolog.FatalLevel).Err(err).Send()
+	os.Exit(code)
+}
+
+// captureResult is the outcome of a capture: how many decode attempts of
+// the monitored protocols failed.
+type captureResult struct {
+	packets uint64
+	decoded uint64
+	failed  uint64
+	alerts  uint64 // fired
+}
+
+func (a *analyzers) result() captureResult {
+	r := captureResult{packets: a.total}
+	for _, n := range a.kinds {
+		r.decoded += n
+	}
+	for _, n := range a.errors {
+		r.failed += n
+	}
+	if a.alerts != nil {
+		r.alerts = a.alerts.fired
+	}
+	return r
+}
+
+// errorRate returns the fraction of decode attempts that failed.
+func (r captureResult) errorRate() float64 {
+	if r.decoded+r.failed == 0 {
+		return 0
+	}
+	return float64(r.failed) / float64(r.decoded+r.failed)
+}
+
+// code returns the exit code of the result given the highest error rate
+// tolerated. Decode errors take precedence over alerts.
+func (r captureResult) code(maxErrorRate float64) int {
+	switch {
+	case r.errorRate() > maxErrorRate:
+		return exitDecodeErrors
+	case r.alerts > 0:
+		return exitAlert
+	}
+	return exitOK
+}
+
+// String formats the result as the single line printed by -quiet, led by
+// its status.
+func (r captureResult) String() string {
+	status := "OK"
+	switch r.code(*maxErrorRate) {
+	case exitDecodeErrors:
+		status = "DECODE ERRORS"
+	case exitAlert:
+		status = "ALERT"
+	}
+	s := fmt.Sprintf("%s: %d packets, %d decoded, %d failed to decode (%.2f%%)",
+		status, r.packets, r.decoded, r.failed, r.errorRate()*100)
+	if r.alerts > 0 {
+		s += fmt.Sprintf(", %d alerts fired", r.alerts)
+	}
+	return s
+}
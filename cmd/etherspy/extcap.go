@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/rs/zerolog"
+	"strings"
+)
+
+// extcapInterface is the interface etherspy offers Wireshark.
+const extcapInterface = "etherspy"
+
+// extcapPipe is the pipe Wireshark reads the capture of the extcap command
+// from, empty for other commands. extcapRecords adds the JSON record of
+// every packet to its comments.
+var (
+	extcapPipe    string
+	extcapRecords bool
+)
+
+// extcapArg is an option of the capture offered in Wireshark's dialog,
+// passed back as --call VALUE.
+type extcapArg struct {
+	call, display, typ, tooltip, value string
+}
+
+var extcapArgs = []extcapArg{
+	{"iface", "Interfaces", "string", "Interfaces to capture on, comma separated", "any"},
+	{"file", "Read file", "fileselect", "Decode a pcap file or simulator trace rather than capturing live", ""},
+	{"nodekey", "Node key", "password", "Private key of the local node, hex encoded, to unmask its discv5 traffic", ""},
+	{"keylog", "Key log", "fileselect", "Key log of discv5 session keys, to decrypt their sessions", ""},
+	{"records", "JSON records", "boolflag", "Attach the JSON record of every packet as a second comment", ""},
+	{"flags", "Other flags", "string", "Further etherspy flags, space separated, e.g. -network sepolia=sepolia", ""},
+}
+
+// isExtcap reports whether etherspy was run by Wireshark as an extcap,
+// with its arguments rather than a command.
+func isExtcap(args []string) bool {
+	for _, a := range args {
+		if strings.HasPrefix(a, "--extcap-") || a == "--capture" {
+			return true
+		}
+	}
+	return false
+}
+
+// extcapCommand implements the extcap interface of Wireshark: installed in
+// its extcap directory, etherspy shows up as a capture interface whose
+// packets carry comments with their decoding, written as pcapng to the
+// pipe Wireshark reads.
+func extcapCommand(args []string) error {
+	fs := flag.NewFlagSet("extcap", flag.ContinueOnError)
+	var (
+		interfaces = fs.Bool("extcap-interfaces", false, "List the interfaces")
+		dlts       = fs.Bool("extcap-dlts", false, "List the link types of --extcap-interface")
+		config     = fs.Bool("extcap-config", false, "List the options of --extcap-interface")
+		doCapture  = fs.Bool("capture", false, "Capture on --extcap-interface into --fifo")
+		selected   = fs.String("extcap-interface", "", "Interface to act on")
+		fifo       = fs.String("fifo", "", "Pipe to write the capture to")
+		filter     = fs.String("extcap-capture-filter", "", "Capture filter")
+		ifaces     = fs.String("iface", "any", "Interfaces")
+		file       = fs.String("file", "", "File to read")
+		nodekey    = fs.String("nodekey", "", "Node key")
+		keylog     = fs.String("keylog", "", "Key log")
+		records    = fs.Bool("records", false, "Attach JSON records")
+		extra      = fs.String("flags", "", "Further etherspy flags")
+	)
+	fs.String("extcap-version", "", "Version of Wireshark")
+	fs.String("extcap-control-in", "", "Unused, etherspy has no toolbar")
+	fs.String("extcap-control-out", "", "Unused, etherspy has no toolbar")
+	fs.Bool("debug", false, "Unused")
+	fs.String("debug-file", "", "Unused")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	switch {
+	case *interfaces:
+		fmt.Printf("extcap {version=1.0}{help=https://github.com/drgomesp/etherspy}\n")
+		fmt.Printf("interface {value=%s}{display=Ethereum discovery (etherspy)}\n", extcapInterface)
+		return nil
+	case *selected != extcapInterface:
+		return fmt.Errorf("unknown extcap interface %q", *selected)
+	case *dlts:
+		// The capture carries the link type of the interfaces captured on,
+		// which Wireshark takes from it.
+		fmt.Printf("dlt {number=1}{name=EN10MB}{display=Ethernet}\n")
+		return nil
+	case *config:
+		for i, a := range extcapArgs {
+			fmt.Printf("arg {number=%d}{call=--%s}{display=%s}{type=%s}{tooltip=%s}", i, a.call, a.display, a.typ, a.tooltip)
+			if a.value != "" {
+				fmt.Printf("{default=%s}", a.value)
+			}
+			fmt.Println()
+		}
+		return nil
+	case !*doCapture:
+		// Wireshark validates capture filters this way, libpcap checks them
+		// once capturing.
+		return nil
+	case *fifo == "":
+		return fmt.Errorf("--capture needs --fifo")
+	}
+
+	// Wireshark shows the output of extcaps that fail, only errors are
+	// logged.
+	zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+	extcapPipe, extcapRecords = *fifo, *records
+	flags := []string{"-o", outputNone}
+	if *file != "" {
+		flags = append(flags, "-r", *file)
+	} else {
+		flags = append(flags, "-i", *ifaces)
+	}
+	if *filter != "" {
+		flags = append(flags, "-f", *filter)
+	}
+	if *nodekey != "" {
+		flags = append(flags, "-nodekey", *nodekey)
+	}
+	if *keylog != "" {
+		flags = append(flags, "-keylog", *keylog)
+	}
+	runCapture(commandExtcap, append(flags, strings.Fields(*extra)...))
+	return nil
+}
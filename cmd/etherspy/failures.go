@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/errcode"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// failures saves the payloads that failed to decode, set up with
+// -save-failures and nil if unset.
+var failures *failureLog
+
+// failure describes a payload that failed to decode, with what it takes to
+// decode it again.
+type failure struct {
+	Time      time.Time `json:"time"`
+	Protocol  string    `json:"protocol"`
+	Network   string    `json:"network,omitempty"`
+	Src       string    `json:"src"`
+	Dst       string    `json:"dst"`
+	Direction string    `json:"direction"`
+	Dest      string    `json:"dest,omitempty"` // node ID discv5 headers were unmasked with
+	Size      int       `json:"size"`
+	Code      string    `json:"code"`
+	Error     string    `json:"error"`
+	Payload   string    `json:"payload,omitempty"` // hex, in a JSONL file
+	File      string    `json:"file,omitempty"`    // of the payload, in a directory
+}
+
+// failureLog saves the UDP payloads that failed to decode with their
+// capture metadata and error, so decoder bugs can be reproduced with real
+// payloads: to a JSON lines file of hex encoded payloads if the path ends
+// with .jsonl, otherwise to a directory, each payload in a .bin file next
+// to a .json file of its metadata. Saving stops after max payloads.
+type failureLog struct {
+	dir string
+	f   *os.File
+	enc *json.Encoder
+
+	max, saved, skipped uint64
+}
+
+func newFailureLog(path string, max uint64) (*failureLog, error) {
+	l := &failureLog{max: max}
+	if strings.EqualFold(filepath.Ext(path), ".jsonl") {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		l.f, l.enc = f, json.NewEncoder(f)
+	} else {
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			return nil, err
+		}
+		l.dir = path
+	}
+	log.Info().Msgf("saving the payloads failing to decode to %q", path)
+	return l, nil
+}
+
+// save records the payload of rec, which failed to decode with err. dest is
+// the node ID its headers were unmasked with, nil if none.
+func (l *failureLog) save(rec *record, dest *enode.ID, payload []byte, err error) {
+	if l.saved >= l.max {
+		l.skipped++
+		return
+	}
+	l.saved++
+	protocol := rec.Protocol
+	if protocol == "" {
+		protocol = "unknown"
+	}
+	f := failure{
+		Time:      rec.Time,
+		Protocol:  protocol,
+		Network:   rec.Network,
+		Src:       rec.Src,
+		Dst:       rec.Dst,
+		Direction: rec.Direction,
+		Size:      len(payload),
+		Code:      errcode.ID(err),
+		Error:     err.Error(),
+	}
+	if dest != nil {
+		f.Dest = dest.String()
+	}
+	if err := l.write(f, payload); err != nil {
+		log.Warn().Err(err).Msg("could not save payload failing to decode")
+	}
+}
+
+func (l *failureLog) write(f failure, payload []byte) error {
+	if l.enc != nil {
+		f.Payload = hex.EncodeToString(payload)
+		return l.enc.Encode(f)
+	}
+	base := fmt.Sprintf("%s-%06d-%s-%s", f.Time.UTC().Format("20060102T150405"), l.saved, f.Protocol, f.Code)
+	f.File = base + ".bin"
+	if err := os.WriteFile(filepath.Join(l.dir, f.File), payload, 0o644); err != nil {
+		return err
+	}
+	meta, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(l.dir, base+".json"), append(meta, '\n'), 0o644)
+}
+
+func (l *failureLog) close() error {
+	if l.skipped > 0 {
+		log.Warn().Msgf("%d more payloads failed to decode past -save-failures-max %d", l.skipped, l.max)
+	}
+	if l.f != nil {
+		return l.f.Close()
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"github.com/drgomesp/etherspy/pkg/ethereum/enr"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/drgomesp/etherspy/pkg/tracker"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/rs/zerolog/log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fingerprintMaxNodes bounds the nodes profiled, later ones are left out.
+const fingerprintMaxNodes = 1 << 18
+
+// Sources of fingerprints: the client entry of the node's own record, or
+// the traits of its traffic and records compared to those of nodes that
+// advertise their client.
+const (
+	sourceRecord  = "record"
+	sourceTraffic = "traffic"
+)
+
+// nodeTraits are the traits of a node telling implementations apart.
+type nodeTraits struct {
+	client    string // advertised in its record, empty if not
+	entries   string // keys of its record, comma separated
+	neighbors int    // most nodes sent in a discv4 NEIGHBORS packet
+	nodes     int    // most records sent in a discv5 NODES packet
+	pingTail  int    // elements following a discv4 PING, -1 before any
+	pingSum   time.Duration
+	pings     int // intervals summed in pingSum
+}
+
+// features lists the traits known of t as name=value strings.
+func (t *nodeTraits) features() []string {
+	var f []string
+	if t.entries != "" {
+		f = append(f, "entries="+t.entries)
+	}
+	if t.neighbors > 0 {
+		f = append(f, "neighbors="+strconv.Itoa(t.neighbors))
+	}
+	if t.nodes > 0 {
+		f = append(f, "nodes="+strconv.Itoa(t.nodes))
+	}
+	if t.pingTail >= 0 {
+		f = append(f, "ping-tail="+strconv.Itoa(t.pingTail))
+	}
+	if t.pings > 0 {
+		// Intervals are compared by their order of magnitude, they vary with
+		// table sizes and randomized timers.
+		mean := (t.pingSum / time.Duration(t.pings)).Seconds()
+		f = append(f, "ping-interval=2^"+strconv.Itoa(int(math.Round(math.Log2(mean+1))))+"s")
+	}
+	return f
+}
+
+// fingerprints guesses the client implementation of nodes not advertising
+// it, such as geth, nethermind, besu, erigon or reth. The nodes whose
+// records carry a client entry teach it the traits of each client: the
+// entries of their records, the most nodes they send in a NEIGHBORS or
+// NODES packet, what they append to PINGs and how often they ping a peer.
+// The others get the client whose traits match theirs best, by naive Bayes,
+// with its posterior probability as confidence. Tracked nodes are tagged
+// with the guess. Only discovery traffic is looked at: the Hello and Status
+// messages of RLPx connections, which name the client and its network, are
+// encrypted. Enabled with -fingerprint.
+type fingerprints struct {
+	nodes map[enode.ID]*nodeTraits
+	pings map[pingKey]time.Time // last ping of a node to an address
+
+	lastExpire time.Time
+}
+
+type pingKey struct {
+	id  enode.ID
+	dst string
+}
+
+func newFingerprints() *fingerprints {
+	return &fingerprints{
+		nodes: make(map[enode.ID]*nodeTraits),
+		pings: make(map[pingKey]time.Time),
+	}
+}
+
+func (f *fingerprints) node(id enode.ID) *nodeTraits {
+	t := f.nodes[id]
+	if t == nil && len(f.nodes) < fingerprintMaxNodes {
+		t = &nodeTraits{pingTail: -1}
+		f.nodes[id] = t
+	}
+	return t
+}
+
+// observeV4 accounts for a discv4 packet sent by the node id.
+func (f *fingerprints) observeV4(rec *record, id enode.ID, pkt *discv4.Packet) {
+	f.expire(rec.Time)
+	body, err := pkt.Body()
+	if err != nil {
+		return
+	}
+	f.observeRecords(body)
+	t := f.node(id)
+	if t == nil {
+		return
+	}
+	switch b := body.(type) {
+	case *discv4.Ping:
+		if rest, err := pkt.Tail(); err == nil {
+			t.pingTail = len(rest)
+		}
+		key := pingKey{id, rec.Dst}
+		last, ok := f.pings[key]
+		if ok && rec.Time.Sub(last) < pongTimeout {
+			return // a retransmission
+		}
+		f.pings[key] = rec.Time
+		if ok {
+			t.pingSum += rec.Time.Sub(last)
+			t.pings++
+		}
+	case *discv4.Neighbors:
+		if len(b.Nodes) > t.neighbors {
+			t.neighbors = len(b.Nodes)
+		}
+	}
+}
+
+// observeV5 accounts for a discv5 packet.
+func (f *fingerprints) observeV5(p discv5.Packet) {
+	f.observeRecords(p)
+	id, ok := discv5.SrcID(p)
+	if !ok {
+		return
+	}
+	var body interface{}
+	switch p := p.(type) {
+	case *discv5.Message:
+		body = p.Body
+	case *discv5.Handshake:
+		body = p.Body
+	}
+	if n, ok := body.(*discv5.Nodes); ok {
+		if t := f.node(id); t != nil && len(n.Nodes) > t.nodes {
+			t.nodes = len(n.Nodes)
+		}
+	}
+}
+
+// observeRecords learns the clients and entries of the nodes whose records
+// a decoded packet carries.
+func (f *fingerprints) observeRecords(body interface{}) {
+	for _, r := range enr.FromPacket(body) {
+		if !r.Verified {
+			continue
+		}
+		t := f.node(r.NodeID)
+		if t == nil {
+			continue
+		}
+		keys := make([]string, len(r.Pairs))
+		for i, p := range r.Pairs {
+			keys[i] = p.Key
+		}
+		t.entries = strings.Join(keys, ",")
+		if client := recordClient(r.Record()); client != "" {
+			if i := strings.IndexByte(client, '/'); i >= 0 {
+				client = client[:i]
+			}
+			t.client = client
+		}
+	}
+}
+
+// expire forgets the pings older than the bond expiration, at most once a
+// minute.
+func (f *fingerprints) expire(now time.Time) {
+	if now.Sub(f.lastExpire) < time.Minute {
+		return
+	}
+	f.lastExpire = now
+	for key, t := range f.pings {
+		if now.Sub(t) > bondExpiration {
+			delete(f.pings, key)
+		}
+	}
+}
+
+// guesses returns the fingerprint of every node advertising its client or
+// with traits to compare, learning the traits of clients anew.
+func (f *fingerprints) guesses() map[enode.ID]tracker.Fingerprint {
+	labeled := make(map[string]int)
+	counts := make(map[string]map[string]int) // by client and feature
+	for _, t := range f.nodes {
+		if t.client == "" {
+			continue
+		}
+		labeled[t.client]++
+		if counts[t.client] == nil {
+			counts[t.client] = make(map[string]int)
+		}
+		for _, feature := range t.features() {
+			counts[t.client][feature]++
+		}
+	}
+	var total int
+	for _, n := range labeled {
+		total += n
+	}
+
+	out := make(map[enode.ID]tracker.Fingerprint)
+	for id, t := range f.nodes {
+		if t.client != "" {
+			out[id] = tracker.Fingerprint{Client: t.client, Confidence: 1, Source: sourceRecord}
+			continue
+		}
+		features := t.features()
+		if total == 0 || len(features) == 0 {
+			continue
+		}
+		// Log-likelihoods of every client, smoothed so a trait not seen
+		// with a client makes it unlikely rather than impossible.
+		scores := make(map[string]float64, len(labeled))
+		best, top := "", math.Inf(-1)
+		for client, n := range labeled {
+			score := math.Log(float64(n) / float64(total))
+			for _, feature := range features {
+				score += math.Log(float64(counts[client][feature]+1) / float64(n+2))
+			}
+			scores[client] = score
+			if score > top || score == top && client < best {
+				best, top = client, score
+			}
+		}
+		var sum float64
+		for _, score := range scores {
+			sum += math.Exp(score - top)
+		}
+		out[id] = tracker.Fingerprint{Client: best, Confidence: 1 / sum, Source: sourceTraffic}
+	}
+	return out
+}
+
+// report tags the tracked nodes with their fingerprints and logs how many
+// nodes were advertised or guessed to run each client.
+func (f *fingerprints) report() {
+	guesses := f.guesses()
+	if len(guesses) == 0 {
+		return
+	}
+	type clientCount struct {
+		advertised, guessed int
+		confidence          float64
+	}
+	counts := make(map[string]*clientCount)
+	for id, g := range guesses {
+		if nodes != nil {
+			nodes.SetFingerprint(id, g)
+		}
+		c := counts[g.Client]
+		if c == nil {
+			c = new(clientCount)
+			counts[g.Client] = c
+		}
+		if g.Source == sourceRecord {
+			c.advertised++
+		} else {
+			c.guessed++
+			c.confidence += g.Confidence
+		}
+	}
+	clients := make([]string, 0, len(counts))
+	for client := range counts {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	for _, client := range clients {
+		c := counts[client]
+		ev := log.Info().Str("client", client).Int("advertised", c.advertised).Int("guessed", c.guessed)
+		if c.guessed > 0 {
+			ev = ev.Float64("mean_confidence", c.confidence/float64(c.guessed))
+		}
+		ev.Msg("client fingerprints")
+	}
+	log.Info().
+		Int("nodes", len(f.nodes)).
+		Int("fingerprinted", len(guesses)).
+		Int("unknown", len(f.nodes)-len(guesses)).
+		Msg("fingerprinting")
+}
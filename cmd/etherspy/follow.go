@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/rs/zerolog/log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// follower restricts output to the traffic of a single node, recognized by
+// its discv4 or discv5 node ID and the endpoints it was seen using.
+type follower struct {
+	v4    string // hex discv4 node ID, empty if unknown
+	v5    string // hex discv5 node ID
+	label string
+
+	endpoints map[string]bool // ip:port pairs
+	hosts     map[string]bool
+
+	handle     *capture
+	baseFilter string
+}
+
+// newFollower parses a node given as enode URL, ENR, 64 byte hex discv4 node
+// ID (public key) or 32 byte hex discv5 node ID.
+func newFollower(spec string) (*follower, error) {
+	f := &follower{label: spec, endpoints: make(map[string]bool), hosts: make(map[string]bool)}
+
+	switch {
+	case strings.HasPrefix(spec, "enode://"), strings.HasPrefix(spec, "enr:"):
+		n, err := enode.Parse(enode.ValidSchemes, spec)
+		if err != nil {
+			return nil, err
+		}
+		f.v5 = n.ID().String()
+		if pub := n.Pubkey(); pub != nil {
+			f.v4 = hex.EncodeToString(crypto.FromECDSAPub(pub)[1:])
+		}
+		if n.IP() != nil && n.UDP() != 0 {
+			f.learn(net.JoinHostPort(n.IP().String(), strconv.Itoa(n.UDP())))
+		}
+	default:
+		raw, err := hex.DecodeString(strings.TrimPrefix(spec, "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid node %q: %v", spec, err)
+		}
+		switch len(raw) {
+		case len(discv4.NodeID{}):
+			f.v4 = hex.EncodeToString(raw)
+			f.v5 = crypto.Keccak256Hash(raw).Hex()[2:]
+		case len(enode.ID{}):
+			f.v5 = hex.EncodeToString(raw)
+		default:
+			return nil, errors.New("node ID must be 32 (discv5) or 64 (discv4) bytes")
+		}
+	}
+
+	if len(f.label) > 16 {
+		f.label = f.label[:16] + "…"
+	}
+	return f, nil
+}
+
+// attach narrows the capture filter of handle to the endpoints of the
+// followed node as they are learned.
+func (f *follower) attach(handle *capture, baseFilter string) {
+	f.handle, f.baseFilter = handle, baseFilter
+	f.updateFilter()
+}
+
+// match reports whether r was sent by or to the followed node. Endpoints of
+// packets carrying the node's ID are learned along the way.
+func (f *follower) match(r *record) bool {
+	if r.NodeID != nil {
+		if id, err := r.NodeID(); err == nil && id != "" && (id == f.v4 || id == f.v5) {
+			if !f.endpoints[r.Src] && r.Src != "-" {
+				f.learn(r.Src)
+				f.updateFilter()
+			}
+			return true
+		}
+	}
+	return f.endpoints[r.Src] || f.endpoints[r.Dst]
+}
+
+func (f *follower) learn(endpoint string) {
+	f.endpoints[endpoint] = true
+	if host, _, err := net.SplitHostPort(endpoint); err == nil {
+		f.hosts[host] = true
+	}
+	log.Info().Msgf("following %s at %s", f.label, endpoint)
+}
+
+// updateFilter restricts the capture to the hosts the node was seen at.
+// Nothing is narrowed until at least one host is known.
+func (f *follower) updateFilter() {
+	if f.handle == nil || len(f.hosts) == 0 {
+		return
+	}
+	hosts := make([]string, 0, len(f.hosts))
+	for h := range f.hosts {
+		hosts = append(hosts, "host "+h)
+	}
+	sort.Strings(hosts)
+
+	expr := "(" + strings.Join(hosts, " or ") + ")"
+	if f.baseFilter != "" {
+		expr = "(" + f.baseFilter + ") and " + expr
+	}
+	if err := f.handle.SetBPFFilter(expr); err != nil {
+		log.Warn().Err(err).Msgf("could not narrow capture filter to %q", expr)
+		return
+	}
+	log.Debug().Msgf("capture filter narrowed to %q", expr)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/drgomesp/etherspy/pkg/defrag"
+	"github.com/google/gopacket"
+	"github.com/rs/zerolog/log"
+)
+
+// fragmentFilter lets through the IPv4 fragments but the first, which
+// carries the UDP header and matches port filters, and every IPv6
+// fragment, whose UDP header comes after the fragment header.
+const fragmentFilter = "(ip and not ip[6:2] & 0x1fff = 0) or ip6[6] = 44"
+
+// reassembler is the reassembly of fragmented datagrams, nil if disabled
+// with -reassemble=false.
+var reassembler *reassembly
+
+// reassembly puts fragmented datagrams back together before they are
+// decoded. The capture lets every fragment through, so datagrams are
+// checked against the capture filter once whole.
+type reassembly struct {
+	defrag *defrag.Defragmenter
+	filter matcher
+
+	datagrams, failures uint64
+}
+
+func newReassembly(c *capture, filter string) (*reassembly, error) {
+	m, err := c.NewBPF(filter)
+	if err != nil {
+		return nil, err
+	}
+	return &reassembly{defrag: defrag.New(), filter: m}, nil
+}
+
+// packet returns the packet to process in place of p: p itself if it
+// isn't a fragment, the whole datagram with its last fragment, or nil. The
+// second result reports whether the datagram was reassembled.
+func (r *reassembly) packet(p gopacket.Packet) (gopacket.Packet, bool) {
+	whole, reassembled, err := r.defrag.Packet(p)
+	if err != nil {
+		r.failures++
+		log.Debug().Err(err).Msg("could not reassemble fragments")
+		return nil, false
+	}
+	if !reassembled {
+		return whole, false
+	}
+	r.datagrams++
+	if !r.filter.Matches(whole.Metadata().CaptureInfo, whole.Data()) {
+		return nil, false
+	}
+	return whole, true
+}
+
+// report logs how many datagrams were reassembled.
+func (r *reassembly) report() {
+	if r.datagrams == 0 && r.failures == 0 {
+		return
+	}
+	log.Info().Uint64("datagrams", r.datagrams).Uint64("failures", r.failures).Msg("fragment reassembly")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"github.com/drgomesp/etherspy/pkg/geo"
+	"github.com/drgomesp/etherspy/pkg/tracker"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// geoIPMaxAddrs bounds the addresses counted in the report of the geoip
+// stage, later ones are still located but not counted.
+const geoIPMaxAddrs = 1 << 20
+
+// geoIP locates the peers at an endpoint, their country, city and
+// autonomous system, in the MaxMind databases given with -geoip. Packet
+// records carry the locations of their source and destination, and the
+// stage reports how many addresses were seen per country and network.
+type geoIP struct {
+	db *geo.DB
+
+	mu        sync.Mutex
+	seen      map[string]bool
+	countries map[string]int
+	networks  map[string]int // by AS number and organization
+}
+
+func openGeoIP(spec string) (*geoIP, error) {
+	var paths []string
+	for _, p := range strings.Split(spec, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	db, err := geo.Open(paths...)
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Msgf("loaded GeoIP databases %s", strings.Join(db.Types(), ", "))
+	return &geoIP{
+		db:        db,
+		seen:      make(map[string]bool),
+		countries: make(map[string]int),
+		networks:  make(map[string]int),
+	}, nil
+}
+
+// lookup returns the location of the IP of endpoint, nil if unknown.
+func (g *geoIP) lookup(endpoint string) *geo.Location {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		host = endpoint
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	loc, ok := g.db.Lookup(ip)
+	if !ok {
+		return nil
+	}
+	return &loc
+}
+
+// observe counts the address of endpoint once.
+func (g *geoIP) observe(endpoint string) {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.seen[host] || len(g.seen) >= geoIPMaxAddrs {
+		return
+	}
+	g.seen[host] = true
+	loc := g.lookup(host)
+	if loc == nil {
+		g.countries["unknown"]++
+		return
+	}
+	if loc.Country != "" {
+		g.countries[loc.Country]++
+	}
+	if loc.ASN != 0 {
+		g.networks["AS"+strconv.FormatUint(uint64(loc.ASN), 10)+" "+loc.Org]++
+	}
+}
+
+func (g *geoIP) endpoint(e *tracker.Endpoint) {
+	if loc := g.lookup(e.Addr); loc != nil {
+		e.Geo = loc
+	}
+}
+
+func (g *geoIP) event(ev *zerolog.Event, endpoint string) *zerolog.Event {
+	loc := g.lookup(endpoint)
+	if loc == nil {
+		return ev
+	}
+	if loc.Country != "" {
+		ev = ev.Str("country", loc.Country)
+	}
+	if loc.City != "" {
+		ev = ev.Str("city", loc.City)
+	}
+	if loc.ASN != 0 {
+		ev = ev.Uint("asn", loc.ASN).Str("as_org", loc.Org)
+	}
+	return ev
+}
+
+// report logs the countries and networks with the most addresses.
+func (g *geoIP) report() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, t := range []struct {
+		kind   string
+		counts map[string]int
+	}{{"country", g.countries}, {"network", g.networks}} {
+		keys := make([]string, 0, len(t.counts))
+		for k := range t.counts {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if a, b := t.counts[keys[i]], t.counts[keys[j]]; a != b {
+				return a > b
+			}
+			return keys[i] < keys[j]
+		})
+		if len(keys) > 10 {
+			keys = keys[:10]
+		}
+		for i, k := range keys {
+			log.Info().Int("rank", i+1).Str(t.kind, k).Int("addresses", t.counts[k]).Msg("peers by " + t.kind)
+		}
+	}
+}
+
+// locate returns the location of endpoint for packet records, nil if the
+// geoip stage is off or doesn't know it.
+func locate(endpoint string) *geo.Location {
+	if enrichment == nil {
+		return nil
+	}
+	for _, s := range enrichment.stages {
+		if g, ok := s.e.(*geoIP); ok && s.enabled() {
+			start := time.Now()
+			loc := g.lookup(endpoint)
+			s.track(start)
+			return loc
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"time"
+)
+
+// mention is a node as listed in the Neighbors and NODES responses of other
+// peers.
+type mention struct {
+	last  time.Time
+	count uint64
+}
+
+// ghosts finds the nodes other peers list in their Neighbors and NODES
+// responses that never send traffic themselves within the window: ghost
+// entries, never seen, and dead peers, last seen before the window. Both are
+// stale routing table entries. Only the traffic of the capture point is
+// seen, so a busy node talking to others may still be counted. Enabled with
+// -ghosts.
+type ghosts struct {
+	window   time.Duration
+	mentions map[enode.ID]*mention
+	senders  map[enode.ID]time.Time // last traffic
+
+	// Nodes listed by each responding peer, by address, to rank peers by
+	// the stale entries they hand out.
+	reporters map[string]map[enode.ID]bool
+}
+
+func newGhosts(window time.Duration) *ghosts {
+	return &ghosts{
+		window:    window,
+		mentions:  make(map[enode.ID]*mention),
+		senders:   make(map[enode.ID]time.Time),
+		reporters: make(map[string]map[enode.ID]bool),
+	}
+}
+
+// observeSender accounts for traffic sent by id.
+func (g *ghosts) observeSender(now time.Time, id enode.ID) {
+	g.senders[id] = now
+}
+
+// observeV4 accounts for a discv4 packet from sender.
+func (g *ghosts) observeV4(rec *record, sender discv4.NodeID, pkt *discv4.Packet) {
+	g.observeSender(rec.Time, v4ID(sender))
+	if pkt.Kind != discv4.PacketNeighbors {
+		return
+	}
+	body, err := pkt.Body()
+	if err != nil {
+		return
+	}
+	for _, n := range body.(*discv4.Neighbors).Nodes {
+		g.mention(rec, v4ID(n.ID))
+	}
+}
+
+// observeV5 accounts for a discv5 packet.
+func (g *ghosts) observeV5(rec *record, p discv5.Packet) {
+	if id, ok := discv5.SrcID(p); ok {
+		g.observeSender(rec.Time, id)
+	}
+	var body discv5.Packet
+	switch p := p.(type) {
+	case *discv5.Handshake:
+		body = p.Body
+	case *discv5.Message:
+		body = p.Body
+	}
+	if n, ok := body.(*discv5.Nodes); ok {
+		for _, r := range n.Nodes {
+			if node, err := enode.New(enode.ValidSchemes, r); err == nil {
+				g.mention(rec, node.ID())
+			}
+		}
+	}
+}
+
+func (g *ghosts) mention(rec *record, id enode.ID) {
+	m := g.mentions[id]
+	if m == nil {
+		m = new(mention)
+		g.mentions[id] = m
+	}
+	m.last = rec.Time
+	m.count++
+
+	reported := g.reporters[rec.Src]
+	if reported == nil {
+		reported = make(map[enode.ID]bool)
+		g.reporters[rec.Src] = reported
+	}
+	reported[id] = true
+}
+
+// v4ID returns the discv5 node ID of a discv4 node.
+func v4ID(id discv4.NodeID) enode.ID {
+	return enode.ID(crypto.Keccak256Hash(id[:]))
+}
+
+// report logs how many listed nodes are ghosts or dead, the share of
+// listings pointing at them and the peers listing most of them. Nodes not
+// mentioned within the window are forgotten.
+func (g *ghosts) report(now time.Time) {
+	start := now.Add(-g.window)
+	var listed, ghost, dead int
+	var listings, stale uint64
+	for id, m := range g.mentions {
+		if m.last.Before(start) {
+			delete(g.mentions, id)
+			continue
+		}
+		listed++
+		listings += m.count
+		switch seen, ok := g.senders[id]; {
+		case !ok:
+			ghost++
+			stale += m.count
+		case seen.Before(start):
+			dead++
+			stale += m.count
+		}
+	}
+	for id, seen := range g.senders {
+		if seen.Before(start) && g.mentions[id] == nil {
+			delete(g.senders, id)
+		}
+	}
+	if listed == 0 {
+		return
+	}
+	log.Info().
+		Int("listed", listed).
+		Int("ghosts", ghost).
+		Int("dead", dead).
+		Float64("stale_share", float64(ghost+dead)/float64(listed)).
+		Float64("stale_listing_share", float64(stale)/float64(listings)).
+		Msg("ghost entries")
+
+	type reporter struct {
+		addr          string
+		listed, stale int
+	}
+	var reporters []reporter
+	for addr, ids := range g.reporters {
+		r := reporter{addr: addr}
+		for id := range ids {
+			if g.mentions[id] == nil {
+				delete(ids, id)
+				continue
+			}
+			r.listed++
+			if seen, ok := g.senders[id]; !ok || seen.Before(start) {
+				r.stale++
+			}
+		}
+		if len(ids) == 0 {
+			delete(g.reporters, addr)
+		}
+		if r.stale > 0 {
+			reporters = append(reporters, r)
+		}
+	}
+	sort.Slice(reporters, func(i, j int) bool {
+		if reporters[i].stale != reporters[j].stale {
+			return reporters[i].stale > reporters[j].stale
+		}
+		return reporters[i].addr < reporters[j].addr
+	})
+	if len(reporters) > 10 {
+		reporters = reporters[:10]
+	}
+	for _, r := range reporters {
+		enrichEvent(log.Info().Str("peer", r.addr), r.addr).
+			Int("listed", r.listed).
+			Int("stale", r.stale).
+			Float64("stale_share", float64(r.stale)/float64(r.listed)).
+			Msg("stale routing table")
+	}
+}
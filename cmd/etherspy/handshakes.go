@@ -0,0 +1,213 @@
+package main
+
+import (
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// kindHandshakeEvent is the kind of the records summarizing a challenge.
+const kindHandshakeEvent = "HANDSHAKE_EVENT"
+
+// Challenges not answered within handshakeTimeout are reported as failed.
+// Messages are remembered as the possible trigger of a challenge for as long.
+const handshakeTimeout = 5 * time.Second
+
+// HandshakeEvent is the record written for a WHOAREYOU challenge once it is
+// answered or given up on, and for handshakes answering a challenge that
+// wasn't captured.
+type HandshakeEvent struct {
+	Challenger     string // node ID, empty if unknown
+	ChallengerAddr string
+	Responder      string
+	ResponderAddr  string
+	Nonce          discv5.Nonce // of the message that triggered the challenge
+
+	Challenged bool // the WHOAREYOU was captured
+	Triggered  bool // the message it challenges was captured
+	Completed  bool // the responder sent a handshake
+	Decrypted  bool // the handshake message was decrypted with the derived keys
+	Record     bool // the responder sent its ENR along
+	LatencyMs  float64
+}
+
+// challenge is a WHOAREYOU awaiting its handshake.
+type challenge struct {
+	time      time.Time
+	network   string
+	direction string // of the expected handshake
+	event     HandshakeEvent
+}
+
+// trigger is a message that may be challenged.
+type trigger struct {
+	time     time.Time
+	src, dst string
+	srcID    enode.ID
+	dstID    enode.ID
+}
+
+// handshakes correlates discv5 WHOAREYOU challenges with the messages that
+// triggered them, by nonce and source, and the handshakes answering them,
+// by address. Enabled with -handshake-events.
+type handshakes struct {
+	pending  map[[2]string]*challenge // by responder, challenger address
+	triggers map[discv5.Nonce]*trigger
+
+	challenges, completed, unchallenged uint64
+	lastExpiry                          time.Time
+}
+
+func newHandshakes() *handshakes {
+	return &handshakes{
+		pending:  make(map[[2]string]*challenge),
+		triggers: make(map[discv5.Nonce]*trigger),
+	}
+}
+
+// observe accounts for a discv5 packet addressed to dest and returns the
+// handshake events it concludes, to be written after it.
+func (h *handshakes) observe(rec *record, p discv5.Packet, dest enode.ID) []*record {
+	events := h.expire(rec.Time)
+	switch p := p.(type) {
+	case *discv5.Message:
+		h.triggers[p.Nonce] = &trigger{time: rec.Time, src: rec.Src, dst: rec.Dst, srcID: p.SrcID, dstID: dest}
+
+	case *discv5.Whoareyou:
+		h.challenges++
+		c := &challenge{
+			time:      rec.Time,
+			network:   rec.Network,
+			direction: reverseDirection(rec.Direction),
+			event: HandshakeEvent{
+				ChallengerAddr: rec.Src,
+				Responder:      dest.String(),
+				ResponderAddr:  rec.Dst,
+				Nonce:          p.Nonce,
+				Challenged:     true,
+			},
+		}
+		// The challenged message went the other way, with the same nonce.
+		if t := h.triggers[p.Nonce]; t != nil && t.src == rec.Dst && t.dst == rec.Src {
+			c.event.Triggered = true
+			c.event.Challenger = t.dstID.String()
+			delete(h.triggers, p.Nonce)
+		}
+		key := [2]string{rec.Dst, rec.Src}
+		if old := h.pending[key]; old != nil {
+			// Challenged again before answering, the first one failed.
+			events = append(events, h.event(old, rec.Time))
+		}
+		h.pending[key] = c
+
+	case *discv5.Handshake:
+		// The message a handshake carries may itself be challenged.
+		h.triggers[p.Nonce] = &trigger{time: rec.Time, src: rec.Src, dst: rec.Dst, srcID: p.SrcID, dstID: dest}
+
+		key := [2]string{rec.Src, rec.Dst}
+		c := h.pending[key]
+		if c == nil {
+			h.unchallenged++
+			c = &challenge{
+				time:    rec.Time,
+				network: rec.Network,
+				event:   HandshakeEvent{ChallengerAddr: rec.Dst, ResponderAddr: rec.Src},
+			}
+		}
+		delete(h.pending, key)
+		h.completed++
+		c.direction = rec.Direction
+		c.event.Challenger = dest.String()
+		c.event.Responder = p.SrcID.String()
+		c.event.Completed = true
+		c.event.Decrypted = p.Body != nil
+		c.event.Record = p.Record != nil
+		if c.event.Challenged {
+			c.event.LatencyMs = float64(rec.Time.Sub(c.time)) / float64(time.Millisecond)
+		}
+		events = append(events, h.event(c, rec.Time))
+	}
+	return events
+}
+
+// expire gives up on the challenges past the timeout, at most once per
+// second of capture time, and returns their events.
+func (h *handshakes) expire(now time.Time) []*record {
+	if now.Sub(h.lastExpiry) < time.Second {
+		return nil
+	}
+	h.lastExpiry = now
+	var events []*record
+	for key, c := range h.pending {
+		if now.Sub(c.time) > handshakeTimeout {
+			delete(h.pending, key)
+			events = append(events, h.event(c, c.time.Add(handshakeTimeout)))
+		}
+	}
+	for nonce, t := range h.triggers {
+		if now.Sub(t.time) > handshakeTimeout {
+			delete(h.triggers, nonce)
+		}
+	}
+	return events
+}
+
+// flush returns the events of every challenge still pending, once the
+// capture ends.
+func (h *handshakes) flush() []*record {
+	events := make([]*record, 0, len(h.pending))
+	for key, c := range h.pending {
+		delete(h.pending, key)
+		events = append(events, h.event(c, c.time))
+	}
+	return events
+}
+
+// event turns a challenge into its record, from the responder to the
+// challenger like the handshake.
+func (h *handshakes) event(c *challenge, t time.Time) *record {
+	ev := c.event
+	return &record{
+		Time:      t,
+		Network:   c.network,
+		Protocol:  "discv5",
+		Kind:      kindHandshakeEvent,
+		Src:       ev.ResponderAddr,
+		Dst:       ev.ChallengerAddr,
+		Direction: c.direction,
+		NodeID:    func() (string, error) { return ev.Responder, nil },
+		Body:      func() (interface{}, error) { return &ev, nil },
+	}
+}
+
+// report logs how many challenges were answered.
+func (h *handshakes) report() {
+	if h.challenges == 0 && h.completed == 0 {
+		return
+	}
+	rate := 0.0
+	if h.challenges > 0 {
+		rate = float64(h.completed-h.unchallenged) / float64(h.challenges)
+	}
+	log.Info().
+		Uint64("challenges", h.challenges).
+		Uint64("completed", h.completed).
+		Uint64("unchallenged", h.unchallenged).
+		Float64("completion_rate", rate).
+		Int("pending", len(h.pending)).
+		Msg("discv5 handshakes")
+}
+
+// reverseDirection returns the direction of a reply to a packet going in
+// direction d.
+func reverseDirection(d string) string {
+	switch d {
+	case directionIn:
+		return directionOut
+	case directionOut:
+		return directionIn
+	default:
+		return d
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"time"
+)
+
+// Hole punches taking longer than holePunchTimeout are given up on. Pings
+// exchanged both ways within syncPingWindow are taken for a synchronized
+// attempt to open a path through NATs.
+const (
+	holePunchTimeout = 10 * time.Second
+	syncPingWindow   = 500 * time.Millisecond
+)
+
+// holePunch is a NAT traversal attempt of the discv5 relay flow: the
+// initiator sends RELAYINIT to a relay, which forwards a RELAYMSG to the
+// target, which answers the initiator's message nonce with a WHOAREYOU
+// that punches a hole in its NAT. The initiator completing the handshake
+// proves the hole open.
+type holePunch struct {
+	started   time.Time
+	initiator string // node ID, empty if unknown
+	target    string
+	relayed   bool
+	punched   bool   // WHOAREYOU seen
+	punchSrc  string // address of the WHOAREYOU, the target's
+	punchDst  string // the initiator's
+	succeeded bool
+}
+
+// holePunchPair accounts for the attempts from an initiator to a target.
+type holePunchPair struct {
+	Attempts, Relayed, Punched, Succeeded uint64
+}
+
+// holePunches detects NAT traversal attempts, enabled with -holepunch.
+type holePunches struct {
+	pending map[discv5.Nonce]*holePunch
+	pairs   map[[2]string]*holePunchPair
+	total   holePunchPair
+
+	pings     map[[2]string]time.Time // last ping by src, dst
+	syncPings uint64
+	lastPurge time.Time
+}
+
+func newHolePunches() *holePunches {
+	return &holePunches{
+		pending: make(map[discv5.Nonce]*holePunch),
+		pairs:   make(map[[2]string]*holePunchPair),
+		pings:   make(map[[2]string]time.Time),
+	}
+}
+
+// observeV5 accounts for a decoded discv5 packet.
+func (h *holePunches) observeV5(rec *record, p discv5.Packet) {
+	h.purge(rec.Time)
+	var body discv5.Packet
+	switch p := p.(type) {
+	case *discv5.Whoareyou:
+		if a := h.pending[p.Nonce]; a != nil && !a.punched {
+			a.punched, a.punchSrc, a.punchDst = true, rec.Src, rec.Dst
+			h.pair(a).Punched++
+			h.total.Punched++
+		}
+		return
+	case *discv5.Handshake:
+		// The initiator answering the target's challenge went through.
+		for _, a := range h.pending {
+			if a.punched && !a.succeeded && a.punchDst == rec.Src && a.punchSrc == rec.Dst {
+				a.succeeded = true
+				h.pair(a).Succeeded++
+				h.total.Succeeded++
+			}
+		}
+		body = p.Body
+	case *discv5.Message:
+		body = p.Body
+	}
+
+	switch b := body.(type) {
+	case *discv5.RelayInit:
+		a := &holePunch{started: rec.Time, initiator: recordID(b.Initiator), target: b.Target.String()}
+		h.pending[b.Nonce] = a
+		h.pair(a).Attempts++
+		h.total.Attempts++
+	case *discv5.RelayMsg:
+		a := h.pending[b.Nonce]
+		if a == nil {
+			// Only the relay's leg of the attempt was captured.
+			a = &holePunch{started: rec.Time, initiator: recordID(b.Initiator)}
+			h.pending[b.Nonce] = a
+			h.pair(a).Attempts++
+			h.total.Attempts++
+		}
+		if !a.relayed {
+			a.relayed = true
+			h.pair(a).Relayed++
+			h.total.Relayed++
+		}
+	case *discv5.Ping:
+		h.observePing(rec)
+	}
+}
+
+// observeV4 accounts for a discv4 packet, only its pings matter.
+func (h *holePunches) observeV4(rec *record, kind discv4.PacketKind) {
+	if kind == discv4.PacketPing {
+		h.purge(rec.Time)
+		h.observePing(rec)
+	}
+}
+
+// observePing counts the pings answered by a ping of the other side within
+// the synchronization window, rather than by a pong.
+func (h *holePunches) observePing(rec *record) {
+	if t, ok := h.pings[[2]string{rec.Dst, rec.Src}]; ok && rec.Time.Sub(t) <= syncPingWindow {
+		h.syncPings++
+		delete(h.pings, [2]string{rec.Dst, rec.Src})
+		return
+	}
+	h.pings[[2]string{rec.Src, rec.Dst}] = rec.Time
+}
+
+func (h *holePunches) pair(a *holePunch) *holePunchPair {
+	key := [2]string{a.initiator, a.target}
+	p := h.pairs[key]
+	if p == nil {
+		p = new(holePunchPair)
+		h.pairs[key] = p
+	}
+	return p
+}
+
+// purge forgets attempts and pings too old to progress, at most once per
+// timeout.
+func (h *holePunches) purge(now time.Time) {
+	if now.Sub(h.lastPurge) < holePunchTimeout {
+		return
+	}
+	h.lastPurge = now
+	for nonce, a := range h.pending {
+		if now.Sub(a.started) > holePunchTimeout {
+			delete(h.pending, nonce)
+		}
+	}
+	for key, t := range h.pings {
+		if now.Sub(t) > syncPingWindow {
+			delete(h.pings, key)
+		}
+	}
+}
+
+// report logs the overall success rate and the pairs with most attempts.
+func (h *holePunches) report() {
+	if h.total.Attempts == 0 && h.syncPings == 0 {
+		return
+	}
+	log.Info().
+		Uint64("attempts", h.total.Attempts).
+		Uint64("relayed", h.total.Relayed).
+		Uint64("punched", h.total.Punched).
+		Uint64("succeeded", h.total.Succeeded).
+		Float64("success_rate", successRate(&h.total)).
+		Uint64("synchronized_pings", h.syncPings).
+		Msg("hole punching")
+
+	keys := make([][2]string, 0, len(h.pairs))
+	for k := range h.pairs {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if a, b := h.pairs[keys[i]].Attempts, h.pairs[keys[j]].Attempts; a != b {
+			return a > b
+		}
+		return keys[i][0]+keys[i][1] < keys[j][0]+keys[j][1]
+	})
+	if len(keys) > 10 {
+		keys = keys[:10]
+	}
+	for _, k := range keys {
+		p := h.pairs[k]
+		log.Info().
+			Str("initiator", orUnknown(k[0])).
+			Str("target", orUnknown(k[1])).
+			Uint64("attempts", p.Attempts).
+			Uint64("succeeded", p.Succeeded).
+			Float64("success_rate", successRate(p)).
+			Msg("hole punching pair")
+	}
+}
+
+func successRate(p *holePunchPair) float64 {
+	if p.Attempts == 0 {
+		return 0
+	}
+	return float64(p.Succeeded) / float64(p.Attempts)
+}
+
+func orUnknown(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// recordID returns the node ID of a validly signed record, empty otherwise.
+func recordID(r *enr.Record) string {
+	if r == nil {
+		return ""
+	}
+	n, err := enode.New(enode.ValidSchemes, r)
+	if err != nil {
+		return ""
+	}
+	return n.ID().String()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/rs/zerolog/log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Packet directions relative to the local node.
+const (
+	directionIn      = "in"
+	directionOut     = "out"
+	directionUnknown = "-"
+)
+
+// identity is the local node whose traffic is captured. Its node ID is
+// loaded from its nodekey or detected from the signature of the first
+// discv4 packet it sends.
+type identity struct {
+	ips map[string]bool
+
+	known bool
+	v4    discv4.NodeID
+	v5    enode.ID
+}
+
+// newIdentity returns the identity of a node reachable at the given
+// addresses, comma separated.
+func newIdentity(addrs string) *identity {
+	l := &identity{ips: make(map[string]bool)}
+	for _, a := range strings.Split(addrs, ",") {
+		if ip := net.ParseIP(strings.TrimSpace(a)); ip != nil {
+			l.ips[ip.String()] = true
+		}
+	}
+	return l
+}
+
+// interfaceAddrs returns the addresses of the capture devices, comma
+// separated.
+func interfaceAddrs(devices []string) string {
+	var addrs []string
+	for _, device := range devices {
+		ifi, err := net.InterfaceByName(device)
+		if err != nil {
+			log.Warn().Err(err).Msgf("could not list the addresses of %q", device)
+			continue
+		}
+		ifaddrs, err := ifi.Addrs()
+		if err != nil {
+			log.Warn().Err(err).Msgf("could not list the addresses of %q", device)
+			continue
+		}
+		for _, a := range ifaddrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				addrs = append(addrs, ipnet.IP.String())
+			}
+		}
+	}
+	return strings.Join(addrs, ",")
+}
+
+// gethNodeKey returns the path of the nodekey file in a geth data directory.
+func gethNodeKey(datadir string) string {
+	for _, p := range []string{filepath.Join(datadir, "geth", "nodekey"), filepath.Join(datadir, "nodekey")} {
+		if fileExists(p) {
+			return p
+		}
+	}
+	return filepath.Join(datadir, "geth", "nodekey")
+}
+
+// readNodeKey reads a private key stored hex encoded, as in geth's nodekey
+// file, or as 32 raw bytes, as in lighthouse's network key file.
+func readNodeKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 32 {
+		return crypto.ToECDSA(data)
+	}
+	key, err := crypto.HexToECDSA(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid node key in %q: %v", path, err)
+	}
+	return key, nil
+}
+
+// loadKey sets the identity from the node key stored in path.
+func (l *identity) loadKey(path string) (*ecdsa.PrivateKey, error) {
+	key, err := readNodeKey(path)
+	if err != nil {
+		return nil, err
+	}
+	l.setKey(key, "nodekey "+path)
+	return key, nil
+}
+
+// setKey sets the identity from a node key.
+func (l *identity) setKey(key *ecdsa.PrivateKey, source string) {
+	var id discv4.NodeID
+	copy(id[:], crypto.FromECDSAPub(&key.PublicKey)[1:])
+	l.set(id, source)
+}
+
+// detect sets the identity from the node ID of a packet sent in the given
+// direction, unless it is already known.
+func (l *identity) detect(direction string, sender *discv4.Sender) {
+	if l.known || direction != directionOut {
+		return
+	}
+	if id, err := sender.NodeID(); err == nil {
+		l.set(id, "outgoing discv4 traffic")
+	}
+}
+
+// loadENR reads the textual ENR of the local node from path, as found in
+// lighthouse's enr.dat, and adds its address to the local ones. The record
+// sets the identity if no node key was loaded.
+func (l *identity) loadENR(path string) (*enode.Node, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	n, err := enode.Parse(enode.ValidSchemes, strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ENR in %q: %v", path, err)
+	}
+	if l.known && n.ID() != l.v5 {
+		return nil, fmt.Errorf("ENR in %q belongs to %s, not the local node", path, n.ID())
+	}
+	if pub := n.Pubkey(); !l.known && pub != nil {
+		var id discv4.NodeID
+		copy(id[:], crypto.FromECDSAPub(pub)[1:])
+		l.set(id, "ENR "+path)
+	}
+	if ip := n.IP(); ip != nil {
+		l.ips[ip.String()] = true
+	}
+	log.Info().Msgf("local node record seq %d at %s (from %s)", n.Seq(), n.IP(), path)
+	return n, nil
+}
+
+func (l *identity) set(id discv4.NodeID, source string) {
+	l.known = true
+	l.v4 = id
+	l.v5 = enode.ID(crypto.Keccak256Hash(id[:]))
+	log.Info().Msgf("local node is %s (from %s)", l.v5, source)
+}
+
+// direction returns whether a packet between the src and dst endpoints was
+// received or sent by the local node.
+func (l *identity) direction(src, dst string) string {
+	switch {
+	case l.isLocal(dst):
+		return directionIn
+	case l.isLocal(src):
+		return directionOut
+	default:
+		return directionUnknown
+	}
+}
+
+func (l *identity) isLocal(endpoint string) bool {
+	host, _, err := net.SplitHostPort(endpoint)
+	return err == nil && l.ips[host]
+}
+
+// destination returns the node ID inbound discv5 headers are masked with.
+func (l *identity) destination(direction string) (enode.ID, bool) {
+	if !l.known || direction == directionOut {
+		return enode.ID{}, false
+	}
+	return l.v5, true
+}
+
+// loadKeyLog adds the discv5 sessions of the key log at path to sessions.
+func loadKeyLog(sessions *discv5.SessionStore, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	keys, err := discv5.ReadKeyLog(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	sessions.AddLoggedSessions(keys)
+	log.Info().Msgf("loaded %d discv5 sessions from key log %s", len(keys), path)
+	return nil
+}
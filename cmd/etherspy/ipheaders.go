@@ -0,0 +1,122 @@
+package main
+
+import (
+	"github.com/drgomesp/etherspy/pkg/tracker"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/rs/zerolog/log"
+	"strconv"
+)
+
+// A peer's path is anomalous once its TTLs spread over pathSpread hops, or
+// change on more than pathFlapping of its packets, given pathMinPackets.
+// Routes shift by a hop or two, senders behind an address or spoofers
+// don't share a path.
+const (
+	pathSpread     = 4
+	pathFlapping   = 0.2
+	pathMinPackets = 20
+	maxPathPeers   = 100000
+)
+
+// ipHeaderOf returns the IP header fields of packet profiled by ipPaths.
+func ipHeaderOf(packet gopacket.Packet) (tracker.IPHeader, bool) {
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		return tracker.IPHeader{
+			TTL:          ip.TTL,
+			DSCP:         ip.TOS >> 2,
+			DontFragment: ip.Flags&layers.IPv4DontFragment != 0,
+			Fragmented:   ip.Flags&layers.IPv4MoreFragments != 0 || ip.FragOffset != 0,
+		}, true
+	case *layers.IPv6:
+		return tracker.IPHeader{
+			TTL:        ip.HopLimit,
+			DSCP:       ip.TrafficClass >> 2,
+			Fragmented: packet.Layer(layers.LayerTypeIPv6Fragment) != nil,
+		}, true
+	}
+	return tracker.IPHeader{}, false
+}
+
+// ipPaths profiles the IP headers of the discovery packets of each peer
+// address: TTL or hop limit, DSCP and fragmentation, warning about the
+// peers whose TTLs vary. Tracked nodes get the profile of their packets.
+// Enabled with -ip-headers.
+type ipPaths struct {
+	peers     map[string]*tracker.PathProfile // by IP
+	anomalous map[string]bool
+
+	total                    tracker.PathProfile
+	dscp                     map[uint8]uint64
+	skipped                  uint64 // packets of peers past maxPathPeers
+	lastAnomalies, anomalies uint64
+}
+
+func newIPPaths() *ipPaths {
+	return &ipPaths{
+		peers:     make(map[string]*tracker.PathProfile),
+		anomalous: make(map[string]bool),
+		dscp:      make(map[uint8]uint64),
+	}
+}
+
+// observe accounts for the header of a packet sent from ip.
+func (p *ipPaths) observe(ip string, h tracker.IPHeader) {
+	p.total.Observe(h)
+	p.dscp[h.DSCP]++
+
+	prof := p.peers[ip]
+	if prof == nil {
+		if len(p.peers) >= maxPathPeers {
+			p.skipped++
+			return
+		}
+		prof = new(tracker.PathProfile)
+		p.peers[ip] = prof
+	}
+	prof.Observe(h)
+	if p.anomalous[ip] || prof.Packets < pathMinPackets {
+		return
+	}
+	spread := prof.TTLMax - prof.TTLMin
+	flapping := float64(prof.TTLChanges) / float64(prof.Packets)
+	if spread < pathSpread && flapping <= pathFlapping && len(prof.InitialTTLs) == 1 {
+		return
+	}
+	p.anomalous[ip] = true
+	p.anomalies++
+	ev := log.Warn().Str("ip", ip)
+	ev = enrichEvent(ev, ip)
+	ev.Uint8("ttl_min", prof.TTLMin).
+		Uint8("ttl_max", prof.TTLMax).
+		Float64("ttl_stddev", prof.TTLStdDev).
+		Uint64("ttl_changes", prof.TTLChanges).
+		Uint64("packets", prof.Packets).
+		Interface("initial_ttls", prof.InitialTTLs).
+		Msg("TTL variance, path change or spoofing")
+}
+
+// report logs the totals of the headers and the anomalies found since the
+// last report.
+func (p *ipPaths) report() {
+	if p.total.Packets == 0 {
+		return
+	}
+	ev := log.Info().
+		Int("peers", len(p.peers)).
+		Uint64("packets", p.total.Packets).
+		Uint64("dont_fragment", p.total.DontFragment).
+		Uint64("fragmented", p.total.Fragmented).
+		Interface("initial_ttls", p.total.InitialTTLs).
+		Uint64("anomalies", p.anomalies-p.lastAnomalies).
+		Uint64("anomalies_total", p.anomalies).
+		Uint64("skipped", p.skipped)
+	for dscp, n := range p.dscp {
+		if dscp != 0 {
+			ev = ev.Uint64("dscp_"+strconv.Itoa(int(dscp)), n)
+		}
+	}
+	ev.Msg("ip headers")
+	p.lastAnomalies = p.anomalies
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/rs/zerolog/log"
+	"net"
+	"sort"
+	"time"
+)
+
+// A FINDNODE is answered by up to kademliaBucket nodes, split over several
+// NEIGHBORS packets, all expected within lookupTimeout. A response whose
+// median log distance to the target is at least farDistance is no closer
+// than random nodes are, and one with more than subnetShare of its nodes
+// in the same /24 (or /48) looks like a crafted one.
+const (
+	kademliaBucket = 16
+	lookupTimeout  = 5 * time.Second
+	farDistance    = 254
+	subnetShare    = 0.5
+)
+
+// lookup is a FINDNODE and the nodes answered to it so far.
+type lookup struct {
+	time      time.Time
+	target    enode.ID // hash of the requested public key
+	responder enode.ID // known once a NEIGHBORS arrives
+	nodes     []discv4.Node
+}
+
+// responderStats counts the FINDNODEs sent to a node and how its responses
+// looked.
+type responderStats struct {
+	requests, answered, unsolicited uint64
+	unsorted, far, duplicates, self uint64
+	concentrated                    uint64
+	suspicious                      uint64
+}
+
+// lookups correlates discv4 FINDNODE requests with the NEIGHBORS answering
+// them, by the pair of endpoints and timing since NEIGHBORS don't echo the
+// target, and checks the answers against a healthy Kademlia table: nodes
+// sorted by XOR distance to the target, closer than random nodes, without
+// duplicates, the responder itself or a concentration in one subnet.
+// Responses failing those checks hint at eclipse or table poisoning
+// attempts. Enabled with -findnode-analysis.
+type lookups struct {
+	pending    map[[2]string]*lookup      // by requester, responder address
+	responders map[string]*responderStats // by address
+
+	total     responderStats
+	closest   [257]uint64 // answers by log distance of their closest node
+	lastPurge time.Time
+}
+
+func newLookups() *lookups {
+	return &lookups{
+		pending:    make(map[[2]string]*lookup),
+		responders: make(map[string]*responderStats),
+	}
+}
+
+func (l *lookups) responder(addr string) *responderStats {
+	s := l.responders[addr]
+	if s == nil {
+		s = new(responderStats)
+		l.responders[addr] = s
+	}
+	return s
+}
+
+// observe accounts for a discv4 packet.
+func (l *lookups) observe(rec *record, pkt *discv4.Packet) {
+	l.purge(rec.Time)
+	if pkt.Kind != discv4.PacketFindNode && pkt.Kind != discv4.PacketNeighbors {
+		return
+	}
+	body, err := pkt.Body()
+	if err != nil {
+		return
+	}
+	switch b := body.(type) {
+	case *discv4.FindNode:
+		key := [2]string{rec.Src, rec.Dst}
+		if prev := l.pending[key]; prev != nil {
+			l.finish(rec.Dst, prev)
+		}
+		l.pending[key] = &lookup{time: rec.Time, target: v4ID(b.Target)}
+		l.responder(rec.Dst).requests++
+		l.total.requests++
+	case *discv4.Neighbors:
+		q := l.pending[[2]string{rec.Dst, rec.Src}]
+		if q == nil || rec.Time.Sub(q.time) > lookupTimeout {
+			l.responder(rec.Src).unsolicited++
+			l.total.unsolicited++
+			return
+		}
+		if id, err := pkt.Sender.NodeID(); err == nil {
+			q.responder = v4ID(id)
+		}
+		q.nodes = append(q.nodes, b.Nodes...)
+		if len(q.nodes) >= kademliaBucket {
+			delete(l.pending, [2]string{rec.Dst, rec.Src})
+			l.finish(rec.Src, q)
+		}
+	}
+}
+
+// finish checks the answer of a lookup sent to the responder at addr.
+func (l *lookups) finish(addr string, q *lookup) {
+	if len(q.nodes) == 0 {
+		return
+	}
+	s := l.responder(addr)
+	s.answered++
+	l.total.answered++
+
+	ids := make([]enode.ID, len(q.nodes))
+	distances := make([]int, len(q.nodes))
+	seen := make(map[enode.ID]bool)
+	subnets := make(map[string]int)
+	var unsorted, duplicates, self bool
+	for i, n := range q.nodes {
+		ids[i] = v4ID(n.ID)
+		distances[i] = enode.LogDist(q.target, ids[i])
+		if i > 0 && enode.DistCmp(q.target, ids[i-1], ids[i]) > 0 {
+			unsorted = true
+		}
+		if seen[ids[i]] {
+			duplicates = true
+		}
+		seen[ids[i]] = true
+		if ids[i] == q.responder {
+			self = true
+		}
+		subnets[subnet(n.IP)]++
+	}
+	sorted := append([]int(nil), distances...)
+	sort.Ints(sorted)
+	l.closest[sorted[0]]++
+	far := sorted[len(sorted)/2] >= farDistance
+
+	var largest int
+	for _, n := range subnets {
+		if n > largest {
+			largest = n
+		}
+	}
+	concentrated := len(q.nodes) >= 4 && float64(largest)/float64(len(q.nodes)) > subnetShare
+
+	for _, c := range []struct {
+		failed  bool
+		counter func(*responderStats) *uint64
+	}{
+		{unsorted, func(s *responderStats) *uint64 { return &s.unsorted }},
+		{far, func(s *responderStats) *uint64 { return &s.far }},
+		{duplicates, func(s *responderStats) *uint64 { return &s.duplicates }},
+		{self, func(s *responderStats) *uint64 { return &s.self }},
+		{concentrated, func(s *responderStats) *uint64 { return &s.concentrated }},
+	} {
+		if c.failed {
+			*c.counter(s)++
+			*c.counter(&l.total)++
+		}
+	}
+	// A far or unsorted answer alone may come from a small or young table,
+	// combined with a concentration or duplicates it is suspicious.
+	if (far || unsorted) && (concentrated || duplicates) {
+		s.suspicious++
+		l.total.suspicious++
+	}
+}
+
+// subnet returns the /24 of an IPv4 address or the /48 of an IPv6 one.
+func subnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// purge checks the lookups whose answers are overdue, at most once per
+// timeout.
+func (l *lookups) purge(now time.Time) {
+	if now.Sub(l.lastPurge) < lookupTimeout {
+		return
+	}
+	l.lastPurge = now
+	for key, q := range l.pending {
+		if now.Sub(q.time) > lookupTimeout {
+			delete(l.pending, key)
+			l.finish(key[1], q)
+		}
+	}
+}
+
+// closestQuantile returns the log distance below which fall the closest
+// nodes of a q fraction of the answers.
+func (l *lookups) closestQuantile(q float64) int {
+	var seen uint64
+	for d, n := range l.closest {
+		seen += n
+		if n > 0 && float64(seen) >= q*float64(l.total.answered) {
+			return d
+		}
+	}
+	return 0
+}
+
+// report logs how lookups were answered overall, then the responders with
+// most suspicious answers.
+func (l *lookups) report() {
+	t := &l.total
+	if t.requests == 0 && t.unsolicited == 0 {
+		return
+	}
+	log.Info().
+		Uint64("findnodes", t.requests).
+		Uint64("answered", t.answered).
+		Uint64("unsolicited_neighbors", t.unsolicited).
+		Uint64("unsorted", t.unsorted).
+		Uint64("far", t.far).
+		Uint64("duplicates", t.duplicates).
+		Uint64("self", t.self).
+		Uint64("concentrated", t.concentrated).
+		Uint64("suspicious", t.suspicious).
+		Int("closest_logdist_p50", l.closestQuantile(0.5)).
+		Int("closest_logdist_p90", l.closestQuantile(0.9)).
+		Msg("findnode lookups")
+
+	var addrs []string
+	for addr, s := range l.responders {
+		if s.suspicious > 0 {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		if a, b := l.responders[addrs[i]].suspicious, l.responders[addrs[j]].suspicious; a != b {
+			return a > b
+		}
+		return addrs[i] < addrs[j]
+	})
+	if len(addrs) > 10 {
+		addrs = addrs[:10]
+	}
+	for _, addr := range addrs {
+		s := l.responders[addr]
+		enrichEvent(log.Warn().Str("responder", addr), addr).
+			Uint64("answered", s.answered).
+			Uint64("suspicious", s.suspicious).
+			Uint64("far", s.far).
+			Uint64("unsorted", s.unsorted).
+			Uint64("duplicates", s.duplicates).
+			Uint64("concentrated", s.concentrated).
+			Msg("suspicious neighbors")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/tracker"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// labels tags the peers of known networks with labels of the operator's
+// choosing, such as the nodes of a staking provider or a cloud region.
+// They are read with -labels from a file of lines giving an IP or CIDR
+// prefix and its comma separated labels, lines starting with # are
+// comments:
+//
+//	10.0.0.0/8      lab
+//	34.64.0.0/10    gcp,cloud
+//	203.0.113.7     bootnode
+//
+// An address gets the labels of every prefix it falls in, the broadest
+// first.
+type labels struct {
+	bits     []int                     // prefix lengths in use, increasing
+	prefixes map[netip.Prefix][]string // by masked prefix
+}
+
+func loadLabels(path string) (*labels, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	l := &labels{prefixes: make(map[netip.Prefix][]string)}
+	bits := make(map[int]bool)
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want an IP or prefix and labels", path, line)
+		}
+		var prefix netip.Prefix
+		if strings.Contains(fields[0], "/") {
+			prefix, err = netip.ParsePrefix(fields[0])
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(fields[0])
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		prefix = prefix.Masked()
+		for _, label := range strings.Split(fields[1], ",") {
+			if label = strings.TrimSpace(label); label != "" {
+				l.prefixes[prefix] = append(l.prefixes[prefix], label)
+			}
+		}
+		bits[prefix.Bits()] = true
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for b := range bits {
+		l.bits = append(l.bits, b)
+	}
+	sort.Ints(l.bits)
+	log.Info().Msgf("loaded %d labeled prefixes from %s", len(l.prefixes), path)
+	return l, nil
+}
+
+// lookup returns the labels of the IP of endpoint, nil if it has none.
+func (l *labels) lookup(endpoint string) []string {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		host = endpoint
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+	var found []string
+	for _, b := range l.bits {
+		if b > addr.BitLen() {
+			break
+		}
+		prefix, err := addr.Prefix(b)
+		if err != nil {
+			continue
+		}
+		for _, label := range l.prefixes[prefix] {
+			if !contains(found, label) {
+				found = append(found, label)
+			}
+		}
+	}
+	return found
+}
+
+func (l *labels) observe(string) {}
+
+func (l *labels) endpoint(e *tracker.Endpoint) {
+	if found := l.lookup(e.Addr); found != nil {
+		e.Labels = found
+	}
+}
+
+func (l *labels) event(ev *zerolog.Event, endpoint string) *zerolog.Event {
+	if found := l.lookup(endpoint); found != nil {
+		ev = ev.Strs("labels", found)
+	}
+	return ev
+}
+
+func (l *labels) report() {}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/gossipsub"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/rs/zerolog/log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	libp2pIdle     = 5 * time.Minute // connections forgotten past it
+	libp2pMaxConns = 10000
+	libp2pTopics   = 20 // reported
+)
+
+// libp2pSide is one direction of a followed connection.
+type libp2pSide struct {
+	stream  *gossipsub.Stream
+	next    uint32 // sequence number of the next byte
+	started bool   // once data starting a libp2p connection was seen
+	lost    bool   // out of sync, given up
+}
+
+// libp2pConn is a followed TCP connection, sides indexed by initiator
+// first.
+type libp2pConn struct {
+	addrs     [2]string
+	sides     [2]libp2pSide
+	handshake [2]bool // noise handshake messages all sent
+	last      time.Time
+}
+
+// gossipTopic accounts for the traffic of a gossip topic kind.
+type gossipTopic struct {
+	Messages, Bytes, Decoded uint64 // published, sizes on the wire and decompressed
+	IHave, IWant, IDontWant  uint64 // message IDs
+	Graft, Prune, Subscribe  uint64
+	MaxSize                  int
+}
+
+// libp2pTraffic follows the libp2p connections of consensus clients on the
+// given TCP ports: protocol negotiation, noise handshakes and the sizes of
+// encrypted frames, and over plaintext connections peer IDs, topics and
+// messages of gossipsub. Enabled with -libp2p-ports.
+type libp2pTraffic struct {
+	ports map[uint16]bool
+	conns map[[2]string]*libp2pConn // by unordered address pair
+
+	total, handshakes, lost, errors uint64
+	protocols                       map[string]uint64 // negotiated, connections and streams
+	frames, frameBytes              uint64
+	maxFrame                        int
+	rpcs                            uint64
+	peers                           map[string]bool
+	topics                          map[string]*gossipTopic // by kind
+	lastExpire                      time.Time
+}
+
+// newLibp2pTraffic follows the comma separated TCP ports.
+func newLibp2pTraffic(ports string) (*libp2pTraffic, error) {
+	t := &libp2pTraffic{
+		ports:     make(map[uint16]bool),
+		conns:     make(map[[2]string]*libp2pConn),
+		protocols: make(map[string]uint64),
+		peers:     make(map[string]bool),
+		topics:    make(map[string]*gossipTopic),
+	}
+	for _, p := range strings.Split(ports, ",") {
+		n, err := strconv.ParseUint(strings.TrimSpace(p), 10, 16)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid libp2p port %q", p)
+		}
+		t.ports[uint16(n)] = true
+	}
+	return t, nil
+}
+
+// filter returns the capture filter matching the libp2p traffic.
+func (t *libp2pTraffic) filter() string {
+	ports := make([]int, 0, len(t.ports))
+	for p := range t.ports {
+		ports = append(ports, int(p))
+	}
+	sort.Ints(ports)
+	terms := make([]string, len(ports))
+	for i, p := range ports {
+		terms[i] = "tcp port " + strconv.Itoa(p)
+	}
+	return strings.Join(terms, " or ")
+}
+
+// observe follows packet if it is libp2p traffic, reporting whether it
+// was.
+func (t *libp2pTraffic) observe(packet gopacket.Packet) bool {
+	tcp, ok := packet.TransportLayer().(*layers.TCP)
+	if !ok || !t.ports[uint16(tcp.SrcPort)] && !t.ports[uint16(tcp.DstPort)] {
+		return false
+	}
+	nl := packet.NetworkLayer()
+	if nl == nil {
+		return true
+	}
+	flow := nl.NetworkFlow()
+	src := net.JoinHostPort(flow.Src().String(), strconv.Itoa(int(tcp.SrcPort)))
+	dst := net.JoinHostPort(flow.Dst().String(), strconv.Itoa(int(tcp.DstPort)))
+	now := packet.Metadata().Timestamp
+	t.expire(now)
+
+	key := [2]string{src, dst}
+	if dst < src {
+		key = [2]string{dst, src}
+	}
+	c := t.conns[key]
+	if c == nil {
+		if tcp.RST || tcp.FIN || len(t.conns) >= libp2pMaxConns {
+			return true
+		}
+		// The side listening on a libp2p port accepted the connection,
+		// unless the handshake tells otherwise.
+		initiator, responder := src, dst
+		if t.ports[uint16(tcp.SrcPort)] && !t.ports[uint16(tcp.DstPort)] || tcp.SYN && tcp.ACK {
+			initiator, responder = dst, src
+		}
+		c = &libp2pConn{addrs: [2]string{initiator, responder}}
+		c.sides[0].stream = gossipsub.NewStream(true)
+		c.sides[1].stream = gossipsub.NewStream(false)
+		t.conns[key] = c
+	}
+	c.last = now
+	if tcp.RST || tcp.FIN {
+		delete(t.conns, key)
+	}
+
+	i := 0
+	if src == c.addrs[1] {
+		i = 1
+	}
+	t.feed(c, i, tcp)
+	return true
+}
+
+// feed passes the payload of a segment sent by side i on, in order.
+func (t *libp2pTraffic) feed(c *libp2pConn, i int, tcp *layers.TCP) {
+	s := &c.sides[i]
+	data := tcp.Payload
+	if s.lost || len(data) == 0 {
+		return
+	}
+	if !s.started {
+		// Follow connections from their start, midway the data can't be
+		// told apart.
+		if !gossipsub.IsLibp2p(data) {
+			s.lost = true
+			return
+		}
+		s.started, s.next = true, tcp.Seq
+		if i == 0 {
+			t.total++
+		}
+	}
+	switch d := int32(tcp.Seq - s.next); {
+	case d > 0:
+		// A segment is missing, the stream can't be followed past it.
+		s.lost = true
+		t.lost++
+		return
+	case d < 0:
+		// Retransmitted data, only what follows is new.
+		if -int(d) >= len(data) {
+			return
+		}
+		data = data[-d:]
+	}
+	s.next += uint32(len(data))
+
+	s.stream.Feed(data)
+	for {
+		ev, err := s.stream.Next()
+		if err != nil {
+			log.Debug().Err(err).Str("src", c.addrs[i]).Str("dst", c.addrs[1-i]).Msg("libp2p stream out of sync")
+			s.lost = true
+			t.errors++
+			return
+		}
+		if ev == nil {
+			return
+		}
+		t.event(c, i, ev)
+	}
+}
+
+// event accounts for what side i of a connection sent.
+func (t *libp2pTraffic) event(c *libp2pConn, i int, ev *gossipsub.Event) {
+	switch ev.Kind {
+	case gossipsub.EventProtocol:
+		// Both sides name the protocols agreed on, count them once.
+		if i == 1 && ev.Protocol != gossipsub.Multistream && ev.Protocol != gossipsub.NotAvailable {
+			t.protocols[ev.Protocol]++
+		}
+	case gossipsub.EventSubstream:
+		// Streams settle once data follows their negotiation, the side
+		// sending it counts them. Gossipsub streams carry data one way.
+		t.protocols[ev.Protocol]++
+	case gossipsub.EventHandshake:
+		if ev.Handshake == gossipsub.NoiseHandshakeFinal || ev.Handshake == gossipsub.NoiseHandshakeResponse {
+			c.handshake[i] = true
+			if c.handshake[0] && c.handshake[1] {
+				t.handshakes++
+			}
+		}
+	case gossipsub.EventFrame:
+		t.frames++
+		t.frameBytes += uint64(ev.Size)
+		if ev.Size > t.maxFrame {
+			t.maxFrame = ev.Size
+		}
+	case gossipsub.EventIdentified:
+		if id := ev.Peer.String(); !t.peers[id] {
+			t.peers[id] = true
+			log.Debug().Str("peer", id).Str("addr", c.addrs[i]).Msg("libp2p peer identified")
+		}
+	case gossipsub.EventRPC:
+		t.rpcs++
+		t.rpc(ev.RPC)
+	}
+}
+
+func (t *libp2pTraffic) topic(name string) *gossipTopic {
+	kind := gossipsub.TopicKind(name)
+	g := t.topics[kind]
+	if g == nil {
+		g = new(gossipTopic)
+		t.topics[kind] = g
+	}
+	return g
+}
+
+func (t *libp2pTraffic) rpc(r *gossipsub.RPC) {
+	for _, s := range r.Subscriptions {
+		if s.Subscribe {
+			t.topic(s.Topic).Subscribe++
+		}
+	}
+	for i := range r.Publish {
+		m := &r.Publish[i]
+		g := t.topic(m.Topic)
+		g.Messages++
+		g.Bytes += uint64(m.Size)
+		g.Decoded += uint64(m.DecodedSize())
+		if m.Size > g.MaxSize {
+			g.MaxSize = m.Size
+		}
+	}
+	c := r.Control
+	if c == nil {
+		return
+	}
+	for _, h := range c.IHave {
+		t.topic(h.Topic).IHave += uint64(len(h.MessageIDs))
+	}
+	for _, topic := range c.Graft {
+		t.topic(topic).Graft++
+	}
+	for _, p := range c.Prune {
+		t.topic(p.Topic).Prune++
+	}
+	// Wanted messages are not tied to a topic.
+	if len(c.IWant) > 0 || len(c.IDontWant) > 0 {
+		g := t.topic("*")
+		g.IWant += uint64(len(c.IWant))
+		g.IDontWant += uint64(len(c.IDontWant))
+	}
+}
+
+// expire forgets the connections idle for libp2pIdle, once a minute.
+func (t *libp2pTraffic) expire(now time.Time) {
+	if now.Sub(t.lastExpire) < time.Minute {
+		return
+	}
+	t.lastExpire = now
+	for key, c := range t.conns {
+		if now.Sub(c.last) > libp2pIdle {
+			delete(t.conns, key)
+		}
+	}
+}
+
+// report logs the totals of the libp2p traffic, then those of the busiest
+// gossip topics.
+func (t *libp2pTraffic) report() {
+	ev := log.Info().
+		Uint64("connections", t.total).
+		Int("open", len(t.conns)).
+		Uint64("noise_handshakes", t.handshakes).
+		Uint64("frames", t.frames).
+		Uint64("frame_bytes", t.frameBytes).
+		Int("max_frame", t.maxFrame).
+		Uint64("rpcs", t.rpcs).
+		Int("peers", len(t.peers)).
+		Uint64("lost", t.lost).
+		Uint64("errors", t.errors)
+	for p, n := range t.protocols {
+		ev = ev.Uint64(p, n)
+	}
+	ev.Msg("libp2p traffic")
+
+	kinds := make([]string, 0, len(t.topics))
+	for k := range t.topics {
+		kinds = append(kinds, k)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		a, b := t.topics[kinds[i]], t.topics[kinds[j]]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return kinds[i] < kinds[j]
+	})
+	if len(kinds) > libp2pTopics {
+		kinds = kinds[:libp2pTopics]
+	}
+	for _, k := range kinds {
+		g := t.topics[k]
+		log.Info().
+			Str("topic", k).
+			Uint64("messages", g.Messages).
+			Uint64("bytes", g.Bytes).
+			Uint64("decoded_bytes", g.Decoded).
+			Int("max_size", g.MaxSize).
+			Uint64("ihave", g.IHave).
+			Uint64("iwant", g.IWant).
+			Uint64("idontwant", g.IDontWant).
+			Uint64("graft", g.Graft).
+			Uint64("prune", g.Prune).
+			Uint64("subscribe", g.Subscribe).
+			Msg("gossip topic")
+	}
+}
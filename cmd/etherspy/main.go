@@ -1,28 +1,154 @@
 package main
 
 import (
-	"crypto/ecdsa"
+	"encoding/json"
 	"flag"
-	"github.com/davecgh/go-spew/spew"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/bufpool"
+	"github.com/drgomesp/etherspy/pkg/decap"
+	"github.com/drgomesp/etherspy/pkg/errcode"
+	"github.com/drgomesp/etherspy/pkg/ethereum/fastcrypto"
 	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
 	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/drgomesp/etherspy/pkg/etherspy"
+	"github.com/drgomesp/etherspy/pkg/match"
+	"github.com/drgomesp/etherspy/pkg/report"
+	"github.com/drgomesp/etherspy/pkg/sink"
+	"github.com/drgomesp/etherspy/pkg/snapshot"
+	"github.com/drgomesp/etherspy/pkg/stats"
+	"github.com/drgomesp/etherspy/pkg/tracker"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/examples/util"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 )
 
-var iface = flag.String("i", "enp9s0", "Interface to get packets from")
-var fname = flag.String("r", "", "Filename to read from, overrides -i")
+var configFile = flag.String("config", "", "YAML or TOML file setting flags by name, the command line overriding it")
+var configProfile = flag.String("config-profile", "", "Named profile of -config to apply on top of its top level settings")
+var iface = flag.String("i", "enp9s0", "Interfaces to get packets from, comma separated")
+var fname = flag.String("r", "", "Filename to read from, a pcap file or a simulator trace of JSON lines, overrides -i")
+var watchdogTimeout = flag.Duration("watchdog", 2*time.Minute, "Reopen live captures delivering no packet for this long, or whose interface went away, with the same settings, 0 disables it")
+var captureBackend = flag.String("capture", backendPcap, "Live capture backend, pcap or afpacket (AF_PACKET, linux only, needs no libpcap)")
 var snaplen = flag.Int("s", 1600, "SnapLen for pcap packet capture")
-var filter = flag.String("f", "udp and dst port 30303", "BPF filter for pcap")
+var filters = filterList{exprs: []string{"udp and dst port 30303"}}
 var logAllPackets = flag.Bool("v", false, "Logs every packet in great detail")
+var decodeWorkers = flag.Int("workers", 0, "Decrypt discv5 packets and recover discv4 senders on this many worker goroutines, output keeps capture order, 0 decodes them inline")
+var workerQueue = flag.Int("worker-queue", 4096, "Packets each worker queues up with -workers, past which live captures drop them and report the drops")
+var noVerify = flag.Bool("no-verify", false, "Skip discv4 hash and signature verification (trusted captures only)")
+var profileStages = flag.Bool("profile", false, "Report per-stage processing latency percentiles every minute")
+var seenDB = flag.String("seen-db", "", "File persisting a bloom filter of every node ID ever seen, enables new node rate reporting")
+var cardinality = flag.Bool("cardinality", false, "Report approximate unique node ID and IP counts over 1m/1h/24h windows every minute")
+var topTalkers = flag.Int("top-talkers", 0, "Report the N busiest source IPs and node IDs every minute")
+var ghostEntries = flag.Bool("ghosts", false, "Report nodes listed in other peers' Neighbors and NODES responses that send no traffic themselves within -ghost-window, as stale routing table entries")
+var ghostWindow = flag.Duration("ghost-window", time.Hour, "Window within which listed nodes have to send traffic not to be counted as ghosts or dead")
+var topologyOut = flag.String("topology", "", "Export the graph of who pings, pongs and lists whom in NEIGHBORS and NODES to PREFIX.dot and PREFIX.gexf every minute and at exit")
+var topologyMaxEdges = flag.Int("topology-max-edges", 1<<20, "Most edges kept in the -topology graph, later ones are left out")
+var accountingWindows = flag.String("accounting", "", "Account bytes and packets to each source IP and node ID over these windows, comma separated, e.g. 1m,1h, and report the heaviest senders every minute")
+var accountingTop = flag.Int("accounting-top", 100, "Number of senders ranked per window and key in the accounting export")
+var accountingQuota = flag.Int64("accounting-quota", 0, "Bytes a sender may send within the shortest accounting window before it is reported over quota, 0 disables quotas")
+var accountingOut = flag.String("accounting-out", "", "Write the accounting ranking to this file every minute, as CSV if it ends in .csv and JSON otherwise")
+var tailStats = flag.Bool("tails", false, "Report which peers send unknown trailing RLP fields in discv4 packets, with sizes and hex samples")
+var holePunching = flag.Bool("holepunch", false, "Detect discv5 NAT hole punching attempts through relays and synchronized pings, and report their success rates")
+var endpointProofTracking = flag.Bool("endpoint-proofs", false, "Correlate discv4 pings with their pongs and report endpoint proof completions, failures and round-trip times, and FINDNODEs sent without a proof")
+var findNodeAnalysis = flag.Bool("findnode-analysis", false, "Correlate discv4 FINDNODEs with the NEIGHBORS answering them and report answers inconsistent with a healthy Kademlia table, as eclipse or poisoning attempts would send")
+var suggestOut = flag.String("suggest-peers", "", "Keep the best peers observed, reliable, conformant and close, in this file as enode URLs ready for admin_addPeer, as a JSON array if it ends in .json and one per line otherwise; implies -endpoint-proofs")
+var suggestCount = flag.Int("suggest-count", 25, "Number of peers suggested with -suggest-peers or -suggest-geth")
+var suggestGeth = flag.String("suggest-geth", "", "Add the peers suggested to the geth node with this admin API, an HTTP URL or IPC socket path, as they are found; implies -endpoint-proofs")
+var rdnsRate = flag.Float64("rdns", 0, "Look up the hostnames of observed IPs in the background at up to this many per second, attaching them to node profiles and reports, 0 disables lookups")
+var rdnsCache = flag.Int("rdns-cache", 10000, "Number of IPs whose hostnames are cached with -rdns")
+var labelsFile = flag.String("labels", "", "File of IPs or CIDR prefixes and the comma separated labels attached to the peers within them in node profiles and reports")
+var geoIPFiles = flag.String("geoip", "", "MaxMind databases, such as GeoLite2-City.mmdb and GeoLite2-ASN.mmdb comma separated, locating the peers of node profiles, reports and packet records by country, city and AS")
+var enrichSpec = flag.String("enrich", "", "Enrichment stages to run, in order, as name[:timeout] comma separated among "+enrichStageNames()+" (default every stage set up by its flags, in that order)")
+var rpcPorts = flag.String("rpc-ports", "", "Also capture the JSON-RPC traffic of the local node on these comma separated TCP ports, as in 8545,8546, and report its flow statistics on a timeline next to the discovery traffic")
+var libp2pPorts = flag.String("libp2p-ports", "", "Also capture the libp2p traffic of consensus clients on these comma separated TCP ports, as in 9000, and report its protocols, noise handshakes, frame sizes and, over plaintext connections, peers and gossip topics")
+var ipHeaders = flag.Bool("ip-headers", false, "Profile the TTL or hop limit, DSCP and fragmentation of each peer's discovery packets, warn about TTLs varying as with path changes or spoofing, and add the profile to tracked nodes")
+var sessionAffinity = flag.Duration("session-affinity", 0, "Measure how often peers re-bond and re-handshake and their session lifetimes per client, warning of clients renewing them more often than this, e.g. 10m")
+var fingerprint = flag.Bool("fingerprint", false, "Guess the client implementation of nodes not advertising it, from their record entries, NEIGHBORS sizes and ping timing compared to those of nodes that do, and tag tracked nodes with the guess and its confidence. Only discovery traffic is used, not the eth handshakes of RLPx connections")
+var handshakeEvents = flag.Bool("handshake-events", false, "Correlate discv5 WHOAREYOU challenges with the messages they challenge and the handshakes answering them, and output a HANDSHAKE_EVENT record per challenge")
+var classifyNetworks = flag.Bool("classify-networks", false, "Classify nodes by the Ethereum network of the fork ID in their records (mainnet, sepolia, holesky, hoodi or custom) and tag their packets with it. Only the eth entries of records are used, not the Status messages of RLPx connections")
+var versionsOut = flag.String("versions-out", "", "Track client versions advertised in ENRs and write their timeline to this file, as CSV if it ends in .csv and JSON otherwise")
+var versionsBucket = flag.Duration("versions-bucket", 24*time.Hour, "Time bucket of the client version timeline")
+var versionsAdoption = flag.String("versions-adoption", "", "Minimum versions whose adoption is reported, comma separated, e.g. geth>=1.14")
+var snapshotOut = flag.String("snapshot", "", "Write a canonical JSON snapshot of the analyzer state and the node table of -track-nodes to this file when the capture ends")
+var snapshotExpect = flag.String("snapshot-expect", "", "Compare the final analyzer state with this snapshot, exiting non-zero on any difference")
+var outputFormat = flag.String("output", outputLog, "Output format ("+strings.Join(outputFormats, "|")+")")
+var replayTiming = flag.Bool("replay-timing", false, "Process the packets of the -r file at the pace they were captured, so timeouts and rate alerts behave as they did live")
+var replaySpeed = flag.Float64("replay-speed", 1, "Speed multiplier of -replay-timing, e.g. 10 to replay ten times faster")
+var decapSpec = flag.String("decap", "vlan,vxlan,geneve,gre", "Encapsulations peeled before decoding, comma separated ("+strings.Join(decap.Names(), ", ")+"), or none")
+var reassemble = flag.Bool("reassemble", true, "Capture IPv4 and IPv6 fragments and reassemble the datagrams split across them, such as large NEIGHBORS and NODES packets")
+var timeSource = flag.String("time-source", timeSourcePcap, "Timestamp packets with the capture's time ("+timeSourcePcap+") or the time they are read ("+timeSourceWall+")")
+var timeFormat = flag.String("time-format", sink.TimeRFC3339, "Format of printed times ("+strings.Join(sink.TimeStyles, "|")+")")
+var timeZone = flag.String("tz", "UTC", "Time zone of printed times, UTC, Local or an IANA name such as Europe/Berlin")
+var pcapOutPath = flag.String("w", "", "Write the packets decoded successfully to this pcap file, with their original framing")
+var saveFailures = flag.String("save-failures", "", "Save the payloads that fail to decode, with their metadata and error, to this directory, or to this JSON lines file if it ends with .jsonl")
+var saveFailuresMax = flag.Uint64("save-failures-max", 1000, "Most payloads saved with -save-failures")
+var pcapOutSelect = flag.String("w-select", "", "Only write packets of these protocols or protocol/kind pairs to -w, comma separated, e.g. discv4/PACKET_ENR_RESPONSE,discv5")
+var fieldSpec = flag.String("fields", "", "Fields of the json, csv and summary outputs, in order, comma separated from "+strings.Join(sink.AllFields, ","))
+var sinks = flag.String("sink", "", "Also write output to files, given as comma separated format:path pairs, e.g. json:packets.jsonl")
+var sinkMaxSize = flag.Int64("sink-max-size", 0, "Rotate sink files once they exceed this many megabytes, 0 disables rotation")
+var sinkKeep = flag.Int("sink-keep", 5, "Number of rotated sink files kept")
+var grep = flag.String("grep", "", "Only output packets whose decoded text, including hex of raw fields, matches this regular expression")
+var matchFilter = flag.String("match", "", "Only output packets whose decoded fields satisfy this expression, e.g. 'proto==discv4 && kind==NEIGHBORS && nodes>8'")
+var followNode = flag.String("follow-node", "", "Only output traffic of this node, given as node ID, enode URL or ENR")
+var transcriptPeers = flag.String("transcript", "", "Record a transcript of the exchange between two peers, given as a,b where each is a host or host:port")
+var reportOut = flag.String("report-out", "", "Write the analyzer reports to this file after every report, as text, Markdown, HTML or PDF by its extension (.txt, .md, .html, .pdf)")
+var transcriptOut = flag.String("transcript-out", "", "File the transcript is written to, as HTML if it ends in .html and text otherwise (default stdout on exit)")
+var transcriptMax = flag.Int("transcript-max", 10000, "Packets the transcript keeps, the oldest are dropped beyond it")
+var localIPs = flag.String("local-ip", "", "Addresses of the local node, comma separated (default the addresses of the capture interface)")
+var learnDestIDs = flag.Bool("learn-dest-ids", true, "Learn the node IDs listening on endpoints from the discv5 handshakes they send, to unmask the packets sent to them")
+var keyLogFile = flag.String("keylog", "", "Key log of discv5 session keys, as written by instrumented nodes or the ping command, to decrypt their sessions")
+var nodekeyHex = flag.String("nodekey", "", "Private key of the local node, hex encoded, as an alternative to -nodekey-file")
+var nodekeyFile = flag.String("nodekey-file", "", "File holding the local node's private key, hex encoded (geth nodekey) or raw (lighthouse network key), used to decode discv5 traffic addressed to it")
+var gethDatadir = flag.String("geth-datadir", "", "Data directory of a co-located geth node, its nodekey is loaded as with -nodekey-file")
+var enrFile = flag.String("enr-file", "", "File holding the local node's textual ENR (default enr.dat next to the node key, if present)")
+var enrWatch = flag.String("enr-watch", "", "File or directory of ENRs and enode URLs, one per line, merged into the node table and used to unmask discv5 packets sent to the nodes they describe; changes are picked up while capturing")
+var enrWatchInterval = flag.Duration("enr-watch-interval", 10*time.Second, "How often -enr-watch is checked for changes")
+var narrowEvery = flag.Duration("narrow", 0, "Narrow the capture filter to the hosts seen exchanging discovery traffic, widening it again this often to re-learn them, e.g. 10m (live captures only)")
+var narrowLearn = flag.Duration("narrow-learn", 30*time.Second, "How long the capture filter stays wide to learn active hosts with -narrow")
+var narrowMax = flag.Int("narrow-max", 256, "Most hosts the capture filter is narrowed to with -narrow, the busiest are kept")
+var breakerThreshold = flag.Float64("breaker-threshold", 0.9, "Failure rate over the breaker window past which a decoder's warnings are replaced by a single diagnosis")
+var breakerWindow = flag.Int("breaker-window", 200, "Number of recent packets the decoder failure rate is computed over")
+var breakerDisable = flag.Bool("breaker-disable", false, "Disable a decoder once its failure rate trips the breaker")
+var networkSpecs networkList
+var alertRules alertList
+var destIDs destIDList
+var alertWindow = flag.Duration("alert-window", time.Minute, "Window packet rates of -alert rules are measured over")
+var alertWebhook = flag.String("alert-webhook", "", "URL alerts are posted to as JSON")
+var alertSlack = flag.String("alert-slack", "", "Slack incoming webhook URL alerts are posted to as messages")
+var perf = flag.String("perf", "", "Performance preset ("+perfPresetNames()+")")
+var trackNodes = flag.Int("track-nodes", 0, "Keep a table of up to this many observed nodes, summarized every minute and queryable through the admin API")
+var kafkaBrokers = flag.String("kafka", "", "Publish decoded packets to Kafka brokers, comma separated host:port addresses")
+var kafkaTopic = flag.String("kafka-topic", "etherspy", "Kafka topic packets are published to, keyed by sender node ID")
+var cloudEventsURL = flag.String("cloudevents", "", "Post decoded packets and alerts as CloudEvents to this HTTP endpoint, such as a Knative broker")
+var cloudEventsMode = flag.String("cloudevents-mode", sink.CloudEventsBinary, "Content mode of the CloudEvents posted ("+sink.CloudEventsBinary+"|"+sink.CloudEventsStructured+"|"+sink.CloudEventsBatch+")")
+var cloudEventsSource = flag.String("cloudevents-source", "", "Source attribute of the CloudEvents posted (default /etherspy/ followed by the hostname)")
+var influxURL = flag.String("influx", "", "Write per-interval aggregates of packets, peers, discv5 handshakes and decode errors in line protocol to this InfluxDB write URL, e.g. http://localhost:8086/api/v2/write?org=o&bucket=b")
+var influxToken = flag.String("influx-token", os.Getenv("INFLUX_TOKEN"), "InfluxDB 2 API token of -influx (default $INFLUX_TOKEN)")
+var influxInterval = flag.Duration("influx-interval", 10*time.Second, "Interval the -influx aggregates are kept over, in capture time")
+var influxMeasurement = flag.String("influx-measurement", "etherspy", "Prefix of the -influx measurement names")
+var influxTags = flag.String("influx-tags", "", "Tags added to every -influx point, comma separated key=value pairs, e.g. host=a,region=eu")
+var kafkaEncoding = flag.String("kafka-encoding", sink.EncodingJSON, "Encoding of Kafka messages ("+sink.EncodingJSON+"|"+sink.EncodingProtobuf+")")
+var dbPath = flag.String("db", "", "SQLite database decoded packets and the node table are stored in, e.g. packets.sqlite")
+var metricsAddr = flag.String("metrics", "", "Address Prometheus metrics are served on, e.g. :9100")
+var rawPubPath = flag.String("raw-pub", "", "Unix socket raw datagrams of the monitored networks are streamed on as length-prefixed frames, for sidecar decoders")
+var listErrorCodes = flag.Bool("error-codes", false, "Print the decode error code taxonomy as JSON and exit")
+var tuiMode = flag.Bool("tui", false, "Show a live terminal dashboard of packets per second and decode error rates per protocol, top talkers by node ID and recent discv5 handshakes instead of printing packets")
+var sparklineSpan = flag.Duration("sparkline", 0, "Keep sparklines of the packets per second of each protocol over this span, e.g. 5m, redrawn every second below the log on stderr")
+var httpAddr = flag.String("http", "", "Address of a read-only HTTP API serving the node table, recent packets and statistics as JSON, e.g. :8080")
+var dumpDir = flag.String("dump-dir", ".", "Directory of the internal state dumps written on SIGUSR1 or through the admin API")
+var quietMode = flag.Bool("quiet", false, "Print nothing but errors and a final line of the result, for checks in scripts and cron jobs")
+var maxErrorRate = flag.Float64("max-error-rate", 1, "Exit with code 2 when more than this fraction of the packets of monitored protocols failed to decode, e.g. 0.05")
+var adminAddr = flag.String("admin", "", "Address of the admin API to pause and resume capture, toggle decoders and change filters at runtime, e.g. localhost:6062")
 
 // Packet sizes
 const (
@@ -38,94 +164,862 @@ const (
 )
 
 func init() {
+	flag.StringVar(outputFormat, "o", outputLog, "Shorthand for -output")
+	flag.Var(&destIDs, "dest-id", "Node ID, enode URL or record of a node whose discv5 traffic is unmasked; repeat for several candidates, each tried on packets to unknown endpoints")
+	flag.Var(&filters, "f", "BPF filter for pcap; repeat to capture the traffic matching any of them")
+	flag.Var(&alertRules, "alert", "Alert when a rule is exceeded, given as [name=]scope[:kind]>threshold with scope total, ip or node and threshold in packets per second, or spike and threshold a multiple of the usual rate, e.g. ip:discv4/FINDNODE>20 or spike:discv5/WHOAREYOU>5; repeat for several rules")
+	flag.Var(&networkSpecs, "network", "Monitor a network, given as label=preset[:filter] with preset one of "+networkPresetNames()+", or label=filter; repeat for several networks, overrides -f")
+
 	zerolog.SetGlobalLevel(zerolog.TraceLevel)
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 }
 
 func main() {
+	// Wireshark runs extcaps with options of its own, not a command.
+	if len(os.Args) > 1 && strings.HasPrefix(os.Args[1], "-") && isExtcap(os.Args[1:]) {
+		checkError(extcapCommand(os.Args[1:]))
+		os.Exit(exitCode)
+	}
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		if os.Args[1] == "help" {
+			flag.Usage()
+			return
+		}
+		cmd := lookupCommand(os.Args[1])
+		if cmd == nil {
+			flag.Usage()
+			log.Fatal().Msgf("unknown command %q", os.Args[1])
+		}
+		checkError(cmd.run(os.Args[2:]))
+		os.Exit(exitCode)
+	}
+	runCapture("", os.Args[1:])
+}
+
+// runCapture captures or reads traffic and decodes it, as the command name
+// does, empty if none was given, with the flags in args.
+func runCapture(name string, args []string) {
+	// Deferred first, so profiles are written before exiting.
+	defer func() {
+		if exitCode != exitOK {
+			os.Exit(exitCode)
+		}
+	}()
+	// util.Run parses the flags of os.Args, those following the command.
+	os.Args = append(os.Args[:1:1], args...)
 	defer util.Run()()
-	var handle *pcap.Handle
+	var handle *capture
 	var err error
 
+	if *configFile != "" {
+		checkError(loadConfig(*configFile, *configProfile))
+	} else if *configProfile != "" {
+		log.Fatal().Msg("-config-profile needs -config")
+	}
+	checkError(setupCommand(name))
+
+	if *listErrorCodes {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		checkError(enc.Encode(errcode.Taxonomy()))
+		return
+	}
+
+	if *reportOut != "" {
+		if _, ok := report.FormatOf(*reportOut); !ok {
+			log.Fatal().Msgf("-report-out %s: unknown extension, want one of .txt, .md, .html or .pdf", *reportOut)
+		}
+		source := *fname
+		if source == "" {
+			source = *iface
+		}
+		reports = newReportCollector(*reportOut, source)
+	}
+	if *quietMode {
+		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+	}
+	checkError(setupTimes(*timeSource, *timeFormat, *timeZone))
+	checkError(checkOutputFormat(*outputFormat))
+	if *tuiMode && *sparklineSpan > 0 {
+		log.Fatal().Msg("-sparkline can't be combined with -tui")
+	}
+	if *fieldSpec != "" {
+		outputFields, err = sink.ParseFields(*fieldSpec)
+		checkError(err)
+	}
+	if *replayTiming && (*fname == "" || *replaySpeed <= 0) {
+		log.Fatal().Msg("-replay-timing needs a file to read with -r and a positive -replay-speed")
+	}
+	if *quietMode && (*tuiMode || *sparklineSpan > 0) {
+		log.Fatal().Msg("-quiet can't be combined with -tui or -sparkline")
+	}
+	format := *outputFormat
+	if *tuiMode || *quietMode {
+		// The dashboard takes over the terminal, file sinks are kept.
+		format = outputNone
+	}
+	checkError(newOutput(format, *sinks, *sinkMaxSize<<20, *sinkKeep))
+	if *dbPath != "" {
+		checkError(openDB(*dbPath))
+	}
+	if *kafkaBrokers != "" {
+		checkError(addKafka(*kafkaBrokers, *kafkaTopic, *kafkaEncoding))
+	}
+	if *cloudEventsURL != "" {
+		checkError(addCloudEvents(*cloudEventsURL, *cloudEventsMode, *cloudEventsSource))
+	}
+	if *influxURL != "" {
+		checkError(addInflux(*influxURL, *influxToken, *influxMeasurement, *influxTags, *influxInterval))
+	}
+	if *grep != "" {
+		grepPattern, err = regexp.Compile(*grep)
+		checkError(err)
+	}
+	if *matchFilter != "" {
+		matchExpr, err = match.Compile(*matchFilter)
+		checkError(err)
+	}
+
+	if *transcriptPeers != "" {
+		conversation, err = newTranscript(*transcriptPeers, *transcriptMax)
+		checkError(err)
+	}
+
+	if *breakerWindow < 1 {
+		log.Fatal().Msg("-breaker-window must be positive")
+	}
+	captureFilter, err := setupNetworks(networkSpecs, filters.expr(), func() *breakers {
+		return newBreakers(*breakerWindow, *breakerThreshold, *breakerDisable)
+	})
+	checkError(err)
+	if *rpcPorts != "" {
+		rpc, err := newRPCTimeline(*rpcPorts)
+		checkError(err)
+		captureFilter = "(" + captureFilter + ") or (" + rpc.filter() + ")"
+	}
+	if *libp2pPorts != "" {
+		libp2p, err := newLibp2pTraffic(*libp2pPorts)
+		checkError(err)
+		captureFilter = "(" + captureFilter + ") or (" + libp2p.filter() + ")"
+	}
+	wholeFilter := captureFilter
+	if *reassemble {
+		captureFilter = "(" + captureFilter + ") or (" + fragmentFilter + ")"
+	}
+	innerFilter := captureFilter
+
+	preset, err := lookupPerfPreset(*perf)
+	checkError(err)
+	preset.applyRuntime()
+
 	// Set up pcap packet capture
 	if *fname != "" {
 		log.Info().Msgf("Reading from pcap dump %q", *fname)
-		handle, err = pcap.OpenOffline(*fname)
+		handle, err = openInput(*fname)
 	} else {
 		log.Info().Msgf("Starting capture on interface %q", *iface)
-		handle, err = pcap.OpenLive(*iface, int32(*snaplen), true, pcap.BlockForever)
+		handle, err = openDevices(*captureBackend, preset, *iface, *snaplen)
 	}
 	if err != nil {
-		log.Fatal().Err(err).Send()
+		exitWith(exitCapture, err)
 	}
 
-	if err := handle.SetBPFFilter(*filter); err != nil {
+	if *decapSpec != "none" && *decapSpec != "" {
+		var tunnels string
+		decapsulator, tunnels, err = newDecapsulation(handle, *decapSpec, innerFilter)
+		checkError(err)
+		captureFilter = "(" + captureFilter + ") or " + tunnels
+	}
+	if err := handle.SetBPFFilter(captureFilter); err != nil {
 		log.Fatal().Err(err).Send()
 	}
+	checkError(compileNetworks(handle))
+	if *reassemble {
+		reassembler, err = newReassembly(handle, wholeFilter)
+		checkError(err)
+	}
+
+	if *followNode != "" {
+		following, err = newFollower(*followNode)
+		checkError(err)
+		following.attach(handle, captureFilter)
+	}
+
+	if *rawPubPath != "" {
+		checkError(serveRawPub(*rawPubPath))
+	}
+
+	if *saveFailures != "" {
+		failures, err = newFailureLog(*saveFailures, *saveFailuresMax)
+		checkError(err)
+	}
+	if *pcapOutPath != "" {
+		pcapOut, err = newPcapWriter(*pcapOutPath, handle.LinkType(), handle.SnapLen(), *pcapOutSelect)
+		checkError(err)
+	}
+	if extcapPipe != "" {
+		pcapOut, err = newAnnotatedWriter(extcapPipe, handle.LinkType(), handle.SnapLen(), extcapRecords)
+		checkError(err)
+	}
+
+	control := newController(handle, captureFilter)
+	if *adminAddr != "" {
+		go func() {
+			log.Fatal().Err(control.serve(*adminAddr)).Msg("admin API stopped")
+		}()
+	}
+
+	addrs := *localIPs
+	if addrs == "" && *fname == "" {
+		addrs = interfaceAddrs(handle.devices)
+	}
+	local := newIdentity(addrs)
+	sessions := discv5.NewSessionStore()
+	keyFile := *nodekeyFile
+	if keyFile == "" && *gethDatadir != "" {
+		keyFile = gethNodeKey(*gethDatadir)
+	}
+	switch {
+	case *nodekeyHex != "" && keyFile != "":
+		log.Fatal().Msg("-nodekey can't be combined with -nodekey-file or -geth-datadir")
+	case *nodekeyHex != "":
+		key, err := crypto.HexToECDSA(strings.TrimSpace(*nodekeyHex))
+		if err != nil {
+			log.Fatal().Msgf("invalid -nodekey: %v", err)
+		}
+		local.setKey(key, "-nodekey")
+		sessions.AddPrivateKey(key)
+	case keyFile != "":
+		key, err := local.loadKey(keyFile)
+		checkError(err)
+		sessions.AddPrivateKey(key)
+	}
+	if *keyLogFile != "" {
+		checkError(loadKeyLog(sessions, *keyLogFile))
+	}
+	decoder := &etherspy.Decoder{Sessions: sessions, SkipVerify: *noVerify}
+	recordFile := *enrFile
+	if recordFile == "" && keyFile != "" {
+		if p := filepath.Join(filepath.Dir(keyFile), "enr.dat"); fileExists(p) {
+			recordFile = p
+		}
+	}
+	if recordFile != "" {
+		_, err := local.loadENR(recordFile)
+		checkError(err)
+	}
+
+	// Without narrowing, narrowTick stays nil and never fires.
+	var narrowTick <-chan time.Time
+	if *narrowEvery > 0 {
+		switch {
+		case *fname != "":
+			log.Warn().Msg("-narrow has no effect when reading a capture file")
+		case following != nil:
+			log.Fatal().Msg("-narrow can't be combined with -follow-node")
+		default:
+			narrowing = newNarrower(handle, captureFilter, local, *narrowEvery, *narrowLearn, *narrowMax)
+			narrowTick = time.Tick(time.Second)
+		}
+	}
+
+	// Without a watchdog, watchTick stays nil and never fires.
+	var watch *watchdog
+	var watchTick <-chan time.Time
+	if *fname == "" && *watchdogTimeout > 0 {
+		watch = newWatchdog(handle, *watchdogTimeout)
+		watchTick = time.Tick(watchdogCheck)
+	}
+
+	// Benchmark the crypto implementations before any packet is decoded.
+	impls := fastcrypto.Select(5 * time.Millisecond)
+	log.Info().Strs("cpu_features", impls.Features).
+		Str("keccak", impls.Keccak[0].Name).
+		Str("aes_ctr", impls.CTR[0].Name).
+		Msg("crypto implementations selected")
 
 	log.Info().Msg("reading in packets")
 
 	// Read in packets, pass to assembler.
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	payloads := bufpool.New(bufpool.DefaultSize)
 	ticker := time.Tick(time.Minute)
 
+	if *trackNodes > 0 {
+		nodes = tracker.New(*trackNodes)
+	} else if db != nil || *suggestOut != "" || *suggestGeth != "" {
+		nodes = tracker.New(dbNodes)
+	}
+	if *enrWatch != "" || len(destIDs) > 0 || *learnDestIDs {
+		candidates := make([]enode.ID, len(destIDs))
+		for i, s := range destIDs {
+			candidates[i], err = parseDestID(s)
+			checkError(err)
+		}
+		resolution = newResolver(candidates)
+	}
+	if *enrWatch != "" {
+		watcher := newENRWatcher(*enrWatch, resolution)
+		checkError(watcher.poll())
+		go watcher.watch(*enrWatchInterval)
+	}
+	enrichment, err = newPipeline(*enrichSpec)
+	checkError(err)
+	analysis, err := newAnalyzers()
+	checkError(err)
+	if analysis.metrics != nil {
+		go func() {
+			log.Fatal().Err(analysis.metrics.serve(*metricsAddr)).Msg("metrics endpoint stopped")
+		}()
+	}
+	if *httpAddr != "" {
+		recent := sink.NewRecent(apiRecent)
+		recent.Times = times
+		output = append(output, recent)
+		go func() {
+			log.Fatal().Err(serveAPI(*httpAddr, control, analysis, recent)).Msg("HTTP API stopped")
+		}()
+	}
+
+	// The state is dumped on the capture loop, which keeps running.
+	control.dump = &dumper{dir: *dumpDir, control: control, analysis: analysis, sessions: sessions}
+	if len(dumpSignals) > 0 {
+		requested := make(chan os.Signal, 1)
+		signal.Notify(requested, dumpSignals...)
+		go func() {
+			for range requested {
+				if _, err := control.do(control.dumpState); err != nil {
+					log.Error().Err(err).Msg("state dump failed")
+				}
+			}
+		}()
+	}
+
+	// Without workers, decoded stays nil and never fires.
+	var decoded chan *workerJob
+	if *decodeWorkers > 0 {
+		if *workerQueue < 1 {
+			log.Fatal().Msg("-worker-queue must be positive")
+		}
+		decoding = newWorkerPool(*decodeWorkers, *workerQueue, *fname != "")
+		decoded = decoding.completed
+	}
+
+	// Without a dashboard, quit stays nil and never fires.
+	var dash *tui
+	var quit chan struct{}
+	if analysis.dashboard != nil {
+		quit = make(chan struct{})
+		view := func() (dashboardView, error) {
+			v, err := control.do(func() (interface{}, error) {
+				status, _ := control.status()
+				return analysis.dashboard.view(analysis.clock(), status.(controlStatus)), nil
+			})
+			if err != nil {
+				return dashboardView{}, err
+			}
+			return v.(dashboardView), nil
+		}
+		dash, err = newTUI(analysis.dashboard.logs, control, view, func() { close(quit) })
+		checkError(err)
+		go dash.run()
+	}
+
+	// Without sparklines, sparkTick stays nil and never fires.
+	var sparkTick <-chan time.Time
+	if analysis.spark != nil {
+		log.Logger = log.Output(logOutput(consoleWriter(analysis.spark)))
+		sparkTick = time.Tick(sparkRefresh)
+	}
+
+	packets := handle.Packets()
+	if *replayTiming {
+		packets = pace(packets, *replaySpeed)
+	}
+	loop := &captureLoop{analysis: analysis, local: local, decoder: decoder, payloads: payloads}
 	for {
+		waitStart := time.Now()
+
+		// Packets queue up in the capture buffer, and are eventually
+		// dropped, while paused.
+		in := packets
+		if control.paused {
+			in = nil
+		}
+
 		select {
-		case packet := <-packetSource.Packets():
-			// A nil packet indicates the end of a pcap file.
+		case request := <-control.requests:
+			request()
+
+		case job := <-decoded:
+			decoding.done(job)
+
+		case <-quit:
+			if decoding != nil {
+				decoding.drain()
+			}
+			finish(analysis)
+			return
+
+		case packet := <-in:
+			// A nil packet indicates the end of a pcap file, or of a live
+			// capture whose interfaces went away.
 			if packet == nil {
+				if watch != nil {
+					log.Warn().Msg("capture closed")
+					watch.closed = true
+					packets = watch.check(time.Now())
+					continue
+				}
+				if dash != nil {
+					// Keep showing the final state until the user quits.
+					log.Info().Msg("end of capture, press q to quit")
+					packets = nil
+					continue
+				}
+				if decoding != nil {
+					decoding.drain()
+				}
+				finish(analysis)
 				return
 			}
 
-			udp := packet.TransportLayer().(*layers.UDP)
-			if udp == nil {
-				continue
+			if watch != nil {
+				watch.observe(packet.Metadata().Timestamp)
 			}
+			loop.packet(packet, waitStart)
 
-			buf := packet.Layers()[3].LayerContents()
+		case <-watchTick:
+			// Nothing is read while paused.
+			if control.paused {
+				watch.observe(time.Now())
+			} else if p := watch.check(time.Now()); p != nil {
+				packets = p
+			}
 
-			var (
-				hash   []byte
-				p      interface{}
-				ptype  discv4.PacketKind
-				nodeID discv4.NodeID
-			)
+		case <-narrowTick:
+			narrowing.tick(time.Now())
 
-			useV5 := true
+		case <-sparkTick:
+			analysis.spark.draw(analysis.clock())
 
-			if buf != nil {
-				if useV5 {
-					pkey := newkey()
-					db, err := enode.OpenDB("")
-					if err != nil {
-						panic(err)
-					}
-					ln := enode.NewLocalNode(db, pkey)
+		case <-ticker:
+			gets, allocs := payloads.Stats()
+			log.Trace().Uint64("buffers", gets).Uint64("allocs", allocs).Msg("the clock is ticking")
+			analysis.report()
+			if conversation != nil && *transcriptOut != "" {
+				if err := conversation.save(*transcriptOut); err != nil {
+					log.Warn().Err(err).Msg("could not write transcript")
+				}
+			}
+		}
+	}
+}
+
+// captureLoop holds what the capture loop decodes packets with.
+type captureLoop struct {
+	analysis *analyzers
+	local    *identity
+	decoder  *etherspy.Decoder
+	payloads *bufpool.Pool
+}
+
+// packet decodes a packet read from the capture after waiting for it since
+// waitStart, feeds it to the analyzers and writes its record. With decode
+// workers, the decoding and what follows may complete later, through the
+// worker pool.
+func (l *captureLoop) packet(packet gopacket.Packet, waitStart time.Time) {
+	if decapsulator != nil {
+		if packet = decapsulator.packet(packet); packet == nil {
+			return
+		}
+	}
+	var reassembled bool
+	if reassembler != nil {
+		if packet, reassembled = reassembler.packet(packet); packet == nil {
+			return
+		}
+	}
+	start := l.analysis.timer.Since(stats.StageCapture, waitStart)
+	if l.analysis.rpc != nil && l.analysis.rpc.observe(packet) {
+		return
+	}
+	if l.analysis.libp2p != nil && l.analysis.libp2p.observe(packet) {
+		return
+	}
+	l.analysis.observePacket(packet)
+
+	// TCP traffic, as of devp2p sessions, is only accounted for.
+	udp, ok := packet.TransportLayer().(*layers.UDP)
+	if !ok {
+		return
+	}
+
+	buf := udp.Payload
+	start = l.analysis.timer.Since(stats.StageParse, start)
+	if len(buf) == 0 {
+		return
+	}
+	l.analysis.observePayload(len(buf))
 
-					p, err := discv5.Decode(buf, ln.ID())
-					if err != nil {
-						log.Warn().Msgf("[discv5] %s", err.Error())
-						continue
+	nw := networkOf(packet)
+	if nw == nil {
+		return
+	}
+	if rawPub != nil {
+		publishRaw(packet, udp, nw.label, buf)
+	}
+
+	rec := newRecord(packet, "", len(buf))
+	rec.Network = nw.label
+	rec.Direction = l.local.direction(rec.Src, rec.Dst)
+	if l.analysis.accounting != nil {
+		l.analysis.accounting.observeIP(rec.Time, rec.Src, rec.Size)
+	}
+	// The header is kept for the node table, which learns the
+	// sender once decoded.
+	var ipHeader *tracker.IPHeader
+	if l.analysis.paths != nil {
+		if h, ok := ipHeaderOf(packet); ok {
+			h.Fragmented = h.Fragmented || reassembled
+			ip, _, _ := net.SplitHostPort(rec.Src)
+			l.analysis.paths.observe(ip, h)
+			ipHeader = &h
+		}
+	}
+	// Headers are masked with the recipient's node ID, only packets
+	// received by the local node, sent to nodes of known records or
+	// endpoints, or to candidate nodes can be unmasked.
+	var dest *enode.ID
+	if id, ok := l.local.destination(rec.Direction); ok {
+		dest = &id
+	} else if resolution != nil {
+		if id, ok := resolution.destination(rec.Dst, buf); ok {
+			dest = &id
+		}
+	}
+
+	protocol, pkt, err := l.decoder.Detect(buf, dest)
+	rec.Protocol = protocol
+	if err != nil {
+		if protocol == "" {
+			protocol = "unknown"
+		}
+		if nw.decoders.enabled(protocol) && (protocol == "unknown" || nw.protocols[protocol]) {
+			l.analysis.observeError(protocol, err)
+			nw.decoders.failure(protocol, err)
+			if failures != nil {
+				failures.save(rec, dest, buf, err)
+			}
+		}
+		return
+	}
+	if !nw.protocols[protocol] || !nw.decoders.enabled(protocol) {
+		return
+	}
+	if narrowing != nil {
+		narrowing.observe(rec.Src, rec.Dst)
+	}
+	if enrichment != nil {
+		enrichment.observe(rec.Src)
+		enrichment.observe(rec.Dst)
+		rec.SrcGeo, rec.DstGeo = locate(rec.Src), locate(rec.Dst)
+	}
+
+	// Packet data is reused once the loop moves on, packets written
+	// out after decoding on the workers are copied.
+	ci, frame := packet.Metadata().CaptureInfo, packet.Data()
+	if decoding != nil && pcapOut != nil {
+		frame = append([]byte(nil), frame...)
+	}
+	raw := buf
+	if decoding != nil && failures != nil {
+		raw = append([]byte(nil), buf...)
+	}
+
+	switch protocol {
+	case "discv5":
+		// Unmasking happens in place, so decode a copy.
+		payload := l.payloads.Copy(buf)
+		var p discv5.Packet
+		decode := func() {
+			p, err = l.decoder.DecodeV5(payload.B, *dest)
+		}
+		emit := func() {
+			if err != nil {
+				payload.Release()
+				l.analysis.observeError("discv5", err)
+				nw.decoders.failure("discv5", err)
+				if failures != nil {
+					failures.save(rec, dest, raw, err)
+				}
+				return
+			}
+			nw.decoders.success("discv5")
+			if h, ok := p.(*discv5.Handshake); ok && resolution != nil && *learnDestIDs {
+				resolution.learn(rec.Src, h.SrcID)
+			}
+			l.analysis.observeKind("discv5", p.Name(), rec.Size)
+			if l.analysis.versions != nil {
+				l.analysis.versions.observeBody(rec.Time, p)
+			}
+			if l.analysis.holePunch != nil {
+				l.analysis.holePunch.observeV5(rec, p)
+			}
+			if l.analysis.affinity != nil {
+				l.analysis.affinity.observeV5(rec, p)
+			}
+			if l.analysis.prints != nil {
+				l.analysis.prints.observeV5(p)
+			}
+			if l.analysis.ghosts != nil {
+				l.analysis.ghosts.observeV5(rec, p)
+			}
+			if l.analysis.topology != nil {
+				l.analysis.topology.observeV5(rec, p, dest)
+			}
+			if l.analysis.dashboard != nil {
+				l.analysis.dashboard.observeV5(rec, p)
+			}
+			if nodes != nil {
+				trackV5(rec, p, ipHeader)
+			}
+			if l.analysis.accounting != nil {
+				if id, ok := discv5.SrcID(p); ok {
+					l.analysis.accounting.observeNode(rec.Time, id, rec.Size)
+				}
+			}
+			if l.analysis.chains != nil {
+				l.analysis.chains.observeBody(rec.Time, p)
+				if id, ok := discv5.SrcID(p); ok {
+					rec.Chain = l.analysis.chains.of(rec.Time, id)
+				}
+			}
+
+			rec.Kind = p.Name()
+			rec.NodeID = func() (string, error) { return discv5SrcID(p), nil }
+			rec.Body = func() (interface{}, error) { return p, nil }
+			if pcapOut != nil {
+				pcapOut.write(rec, ci, frame)
+			}
+			if l.analysis.alerts != nil {
+				l.analysis.alerts.observe(rec)
+			}
+			if err := writeRecord(rec); err != nil {
+				log.Warn().Msgf("[%s] %s", nw.qualify("discv5"), err.Error())
+			}
+			if l.analysis.handshakes != nil {
+				for _, ev := range l.analysis.handshakes.observe(rec, p, *dest) {
+					if err := writeRecord(ev); err != nil {
+						log.Warn().Msgf("[%s] %s", nw.qualify("discv5"), err.Error())
 					}
+				}
+			}
+			payload.Release()
+		}
+		if decoding != nil {
+			if !decoding.submit(flow(rec.Src, rec.Dst), decode, emit) {
+				payload.Release()
+			}
+			return
+		}
+		decode()
+		start = l.analysis.timer.Since(stats.StageDecode, start)
+		emit()
+		l.analysis.timer.Since(stats.StageSink, start)
 
-					log.Debug().Msgf("[discv5] %s packet received > %s", p.Kind(), spew.Sdump(p))
-				} else {
-					hash, p, ptype, nodeID, err = discv4.Decode(buf)
-					if err != nil {
-						log.Warn().Msgf("[discv4] %s", err.Error())
-						continue
+	case "discv4":
+		// Only the packet metadata is decoded up front, the body is
+		// materialized when the output actually needs it.
+		var payload *bufpool.Buffer
+		if decoding != nil {
+			// The workers recover the sender from a copy.
+			payload = l.payloads.Copy(buf)
+			pkt, _ = discv4.Peek(payload.B)
+		}
+		emit := func() {
+			nw.decoders.success("discv4")
+			l.analysis.observeKind("discv4", pkt.Kind.String(), rec.Size)
+			l.local.detect(rec.Direction, pkt.Sender)
+
+			if l.analysis.wantsNodeIDs() {
+				if id, err := pkt.Sender.NodeID(); err == nil {
+					l.analysis.observeNode(id, id[:])
+					if l.analysis.accounting != nil {
+						l.analysis.accounting.observeV4(rec.Time, id, rec.Size)
 					}
+				}
+			}
 
-					_, _ = hash, nodeID
+			if l.analysis.holePunch != nil {
+				l.analysis.holePunch.observeV4(rec, pkt.Kind)
+			}
+
+			if l.analysis.proofs != nil {
+				l.analysis.proofs.observe(rec, pkt)
+			}
 
-					log.Debug().Msgf("[discv4] %s packet received > %s", ptype, spew.Sdump(p))
+			if l.analysis.affinity != nil {
+				if id, err := pkt.Sender.NodeID(); err == nil {
+					l.analysis.affinity.observeV4(rec, v4ID(id), pkt)
 				}
 			}
 
-		case <-ticker:
-			log.Trace().Msg("the clock is ticking")
+			if l.analysis.prints != nil {
+				if id, err := pkt.Sender.NodeID(); err == nil {
+					l.analysis.prints.observeV4(rec, v4ID(id), pkt)
+				}
+			}
+
+			if l.analysis.topology != nil {
+				if id, err := pkt.Sender.NodeID(); err == nil {
+					l.analysis.topology.observeV4(rec, v4ID(id), pkt)
+				}
+			}
+
+			if l.analysis.lookups != nil {
+				l.analysis.lookups.observe(rec, pkt)
+			}
+
+			if l.analysis.ghosts != nil {
+				if id, err := pkt.Sender.NodeID(); err == nil {
+					l.analysis.ghosts.observeV4(rec, id, pkt)
+				}
+			}
+
+			if l.analysis.tails != nil {
+				if rest, err := pkt.Tail(); err == nil {
+					l.analysis.tails.observe(pkt.Kind.String(), rec.Src, rest)
+				}
+			}
+
+			if nodes != nil {
+				trackV4(rec, pkt, ipHeader)
+			}
+
+			if l.analysis.versions != nil && pkt.Kind == discv4.PacketENRResponse {
+				if body, err := pkt.Body(); err == nil {
+					l.analysis.versions.observeBody(rec.Time, body)
+				}
+			}
+
+			if l.analysis.chains != nil {
+				if pkt.Kind == discv4.PacketENRResponse {
+					if body, err := pkt.Body(); err == nil {
+						l.analysis.chains.observeBody(rec.Time, body)
+					}
+				}
+				if id, err := pkt.Sender.NodeID(); err == nil {
+					rec.Chain = l.analysis.chains.ofV4(rec.Time, id)
+				}
+			}
+
+			rec.Kind = pkt.Kind.String()
+			rec.NodeID = func() (string, error) {
+				id, err := pkt.Sender.NodeID()
+				return id.String(), err
+			}
+			rec.Body = func() (interface{}, error) { return pkt.Body() }
+			if pcapOut != nil {
+				pcapOut.write(rec, ci, frame)
+			}
+			if l.analysis.alerts != nil {
+				l.analysis.alerts.observe(rec)
+			}
+			if err := writeRecord(rec); err != nil {
+				log.Warn().Msgf("[%s] %s", nw.qualify("discv4"), err.Error())
+			}
+			payload.Release()
+		}
+		if decoding != nil {
+			recoverSender := func() { pkt.Sender.NodeID() }
+			if !decoding.submit(flow(rec.Src, rec.Dst), recoverSender, emit) {
+				payload.Release()
+			}
+			return
+		}
+		start = l.analysis.timer.Since(stats.StageDecode, start)
+		emit()
+		l.analysis.timer.Since(stats.StageSink, start)
+	}
+}
+
+// finish reports the final analyzer state once the capture ends, writing
+// and comparing snapshots as requested.
+func finish(a *analyzers) {
+	state := a.snapshot()
+	if a.alerts != nil {
+		a.alerts.close(a.lastSeen)
+	}
+	if a.handshakes != nil {
+		for _, ev := range a.handshakes.flush() {
+			if err := writeRecord(ev); err != nil {
+				log.Warn().Err(err).Msg("could not write handshake event")
+			}
+		}
+	}
+	a.report()
+	if a.batch != nil {
+		if err := a.batch.write(a); err != nil {
+			log.Error().Err(err).Msg("could not write report")
+		}
+	}
+
+	if conversation != nil {
+		if err := conversation.save(*transcriptOut); err != nil {
+			log.Fatal().Err(err).Msg("could not write transcript")
+		}
+	}
+
+	if err := output.Close(); err != nil {
+		log.Warn().Err(err).Msg("could not close output")
+	}
+	if pcapOut != nil {
+		if err := pcapOut.close(); err != nil {
+			log.Warn().Err(err).Msg("could not close capture file")
+		}
+	}
+	if failures != nil {
+		if err := failures.close(); err != nil {
+			log.Warn().Err(err).Msg("could not close failure log")
 		}
 	}
+
+	if *snapshotOut != "" {
+		if err := snapshot.Write(*snapshotOut, state); err != nil {
+			log.Fatal().Err(err).Msg("could not write snapshot")
+		}
+		log.Info().Msgf("wrote state snapshot to %q", *snapshotOut)
+	}
+
+	if *snapshotExpect != "" {
+		expected, err := os.ReadFile(*snapshotExpect)
+		checkError(err)
+		actual, err := snapshot.Canonical(state)
+		checkError(err)
+		changes, err := snapshot.Diff(expected, actual)
+		checkError(err)
+		for _, c := range changes {
+			log.Error().Msgf("snapshot mismatch %s", c)
+		}
+		if len(changes) > 0 {
+			log.Fatal().Msgf("state differs from %q in %d places", *snapshotExpect, len(changes))
+		}
+		log.Info().Msgf("state matches %q", *snapshotExpect)
+	}
+
+	result := a.result()
+	exitCode = result.code(*maxErrorRate)
+	if *quietMode {
+		fmt.Println(result)
+	}
+}
+
+// discv5SrcID returns the source node ID carried by a discv5 packet, if any.
+func discv5SrcID(p discv5.Packet) string {
+	if id, ok := discv5.SrcID(p); ok {
+		return id.String()
+	}
+	return ""
 }
 
 func checkError(err error) {
@@ -134,10 +1028,7 @@ func checkError(err error) {
 	}
 }
 
-func newkey() *ecdsa.PrivateKey {
-	key, err := crypto.GenerateKey()
-	if err != nil {
-		panic("couldn't generate key: " + err.Error())
-	}
-	return key
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"github.com/drgomesp/etherspy/pkg/errcode"
+	"github.com/drgomesp/etherspy/pkg/stats"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// metrics exposes capture and decoding counters to Prometheus.
+type metrics struct {
+	captured prometheus.Counter
+	bytes    prometheus.Counter
+	decoded  *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	sizes    *prometheus.HistogramVec
+
+	// Node IDs are counted in a sketch, scrapes read it concurrently.
+	mu    sync.Mutex
+	nodes stats.HLL
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		captured: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "etherspy",
+			Name:      "packets_captured_total",
+			Help:      "Packets delivered by the capture.",
+		}),
+		bytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "etherspy",
+			Name:      "bytes_processed_total",
+			Help:      "Bytes of UDP payload handed to the decoders.",
+		}),
+		decoded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "etherspy",
+			Name:      "packets_decoded_total",
+			Help:      "Packets decoded, by protocol and kind.",
+		}, []string{"protocol", "kind"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "etherspy",
+			Name:      "decode_errors_total",
+			Help:      "Packets that failed to decode, by protocol, error code and reason.",
+		}, []string{"protocol", "code", "reason"}),
+		sizes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "etherspy",
+			Name:      "packet_size_bytes",
+			Help:      "Size of decoded packets, by protocol.",
+			Buckets:   []float64{64, 128, 256, 512, 768, 1024, 1280},
+		}, []string{"protocol"}),
+	}
+	return m
+}
+
+// serve registers the metrics and serves them on addr under /metrics.
+func (m *metrics) serve(addr string) error {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(m.captured, m.bytes, m.decoded, m.errors, m.sizes)
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "etherspy",
+		Name:      "unique_node_ids",
+		Help:      "Approximate number of distinct sender node IDs seen since start.",
+	}, func() float64 {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return float64(m.nodes.Estimate())
+	}))
+	if enrichment != nil {
+		reg.MustRegister(enrichment.collectors()...)
+	}
+	reg.MustRegister(prometheus.NewGoCollector(), prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	log.Info().Msgf("serving metrics on %s/metrics", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+func (m *metrics) observeDecoded(protocol, kind string, size int) {
+	m.decoded.WithLabelValues(protocol, kind).Inc()
+	m.sizes.WithLabelValues(protocol).Observe(float64(size))
+}
+
+func (m *metrics) observeError(protocol string, err error) {
+	m.errors.WithLabelValues(protocol, errcode.ID(err), errorReason(err)).Inc()
+}
+
+func (m *metrics) observeNode(raw []byte) {
+	m.mu.Lock()
+	m.nodes.Add(raw)
+	m.mu.Unlock()
+}
+
+// errorReason reduces an error to a label value of bounded cardinality: the
+// name of its code or, for errors without one, its message without the
+// details that follow a colon, as in "unknown type: 9".
+func errorReason(err error) string {
+	if c, ok := errcode.Of(err); ok {
+		return c.Name
+	}
+	msg := err.Error()
+	if i := strings.IndexByte(msg, ':'); i > 0 {
+		msg = msg[:i]
+	}
+	return strings.ReplaceAll(strings.TrimSpace(msg), " ", "_")
+}
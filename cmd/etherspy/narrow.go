@@ -0,0 +1,137 @@
+package main
+
+import (
+	"github.com/rs/zerolog/log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// narrowing tightens the capture filter with -narrow, nil if unset.
+var narrowing *narrower
+
+// narrower cuts the traffic copied from the kernel on busy shared hosts by
+// narrowing the capture filter to the hosts seen exchanging discovery
+// traffic. The filter is widened back to the base one every so often to
+// learn the hosts anew, as peers come and go. Hosts of the local node are
+// never added, they would let everything through.
+type narrower struct {
+	handle *capture
+	base   string
+	local  *identity
+
+	every, learn time.Duration
+	limit        int // hosts, the busiest are kept past it
+
+	hosts    map[string]uint64 // packets seen while learning
+	narrowed bool
+	next     time.Time // of the next switch
+}
+
+func newNarrower(handle *capture, base string, local *identity, every, learn time.Duration, limit int) *narrower {
+	return &narrower{
+		handle: handle,
+		base:   base,
+		local:  local,
+		every:  every,
+		learn:  learn,
+		limit:  limit,
+		hosts:  make(map[string]uint64),
+		next:   time.Now().Add(learn),
+	}
+}
+
+// observe learns the remote hosts of a decoded packet.
+func (n *narrower) observe(src, dst string) {
+	for _, endpoint := range []string{src, dst} {
+		if n.local.isLocal(endpoint) {
+			continue
+		}
+		if host, _, err := net.SplitHostPort(endpoint); err == nil {
+			n.hosts[host]++
+		}
+	}
+}
+
+// tick narrows the filter once the learning span is over and widens it
+// again when it is time to re-learn. Filters are switched in real time,
+// whatever the timestamps of the packets.
+func (n *narrower) tick(now time.Time) {
+	if now.Before(n.next) {
+		return
+	}
+	if n.narrowed {
+		n.narrowed = false
+		n.hosts = make(map[string]uint64)
+		n.next = now.Add(n.learn)
+		if err := n.handle.SetBPFFilter(n.base); err != nil {
+			log.Warn().Err(err).Msgf("could not widen capture filter to %q", n.base)
+			return
+		}
+		log.Info().Msgf("capture filter widened for %s to learn active hosts", n.learn)
+		return
+	}
+	n.next = now.Add(n.every)
+	n.narrowed = n.apply()
+}
+
+// setBase replaces the base filter, as set through the admin API, keeping
+// the filter narrowed if it was.
+func (n *narrower) setBase(expr string) {
+	n.base = expr
+	if n.narrowed {
+		n.narrowed = n.apply()
+	}
+}
+
+// apply narrows the base filter to the busiest hosts learned, reporting
+// whether it did. Without any host learned the filter stays wide.
+func (n *narrower) apply() bool {
+	if len(n.hosts) == 0 {
+		log.Info().Msg("no active hosts learned, capture filter left wide")
+		return false
+	}
+	hosts := make([]string, 0, len(n.hosts))
+	for h := range n.hosts {
+		hosts = append(hosts, h)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if a, b := n.hosts[hosts[i]], n.hosts[hosts[j]]; a != b {
+			return a > b
+		}
+		return hosts[i] < hosts[j]
+	})
+	if len(hosts) > n.limit {
+		hosts = hosts[:n.limit]
+	}
+	// Filters of many hosts may exceed the length of programs the kernel
+	// accepts, the busiest half is kept until one fits.
+	for {
+		err := n.handle.SetBPFFilter(n.expr(hosts))
+		if err == nil {
+			break
+		}
+		if len(hosts) == 1 {
+			log.Warn().Err(err).Msg("could not narrow capture filter")
+			return false
+		}
+		log.Debug().Err(err).Msgf("could not narrow capture filter to %d hosts, trying %d", len(hosts), len(hosts)/2)
+		hosts = hosts[:len(hosts)/2]
+	}
+	log.Info().Msgf("capture filter narrowed to %d active hosts for %s", len(hosts), n.every)
+	return true
+}
+
+// expr returns the base filter narrowed to hosts.
+func (n *narrower) expr(hosts []string) string {
+	terms := make([]string, len(hosts))
+	for i, h := range hosts {
+		terms[i] = "host " + h
+	}
+	expr := "(" + strings.Join(terms, " or ") + ")"
+	if n.base != "" {
+		expr = "(" + n.base + ") and " + expr
+	}
+	return expr
+}
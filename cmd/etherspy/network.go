@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"sort"
+	"strings"
+)
+
+// networkPreset is the traffic of a kind of node: where it listens and the
+// discovery protocols it speaks.
+type networkPreset struct {
+	filter    string
+	protocols []string
+}
+
+var networkPresets = map[string]networkPreset{
+	// Execution clients run both discovery protocols on the devp2p port.
+	"el": {filter: "udp port 30303", protocols: []string{"discv4", "discv5"}},
+	// Consensus clients only speak discv5, on port 9000 by default.
+	"cl": {filter: "udp port 9000", protocols: []string{"discv5"}},
+}
+
+func networkPresetNames() string {
+	names := make([]string, 0, len(networkPresets))
+	for name := range networkPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, "|")
+}
+
+// networks are the monitored networks, in the order they were given. A
+// single unlabeled network covering the whole capture is used unless
+// -network is set.
+var networks []*network
+
+// network is a set of traffic monitored together, told apart from other
+// networks by its capture filter. Each has its own decoders, and its label
+// tags everything it outputs.
+type network struct {
+	label     string
+	filter    string
+	protocols map[string]bool
+	decoders  *breakers
+
+	bpf matcher
+}
+
+// networkList collects the values of the repeatable -network flag.
+type networkList []string
+
+func (l *networkList) String() string { return strings.Join(*l, " ") }
+
+func (l *networkList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// parseNetwork parses a network given as label=preset, label=preset:filter
+// or label=filter, the latter decoding every protocol.
+func parseNetwork(spec string) (*network, error) {
+	i := strings.IndexByte(spec, '=')
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid network %q, want label=preset[:filter] or label=filter", spec)
+	}
+	n := &network{label: spec[:i], protocols: make(map[string]bool)}
+	rest := spec[i+1:]
+
+	name, filter := rest, ""
+	if j := strings.IndexByte(rest, ':'); j >= 0 {
+		name, filter = rest[:j], rest[j+1:]
+	}
+	if preset, ok := networkPresets[name]; ok {
+		n.filter = preset.filter
+		if filter != "" {
+			n.filter = filter
+		}
+		for _, p := range preset.protocols {
+			n.protocols[p] = true
+		}
+	} else {
+		n.filter = rest
+		n.protocols["discv4"], n.protocols["discv5"] = true, true
+	}
+	if strings.TrimSpace(n.filter) == "" {
+		return nil, fmt.Errorf("network %q has no capture filter", n.label)
+	}
+	return n, nil
+}
+
+// setupNetworks parses the -network specs, or sets up the default network
+// capturing everything matched by filter. It returns the filter to capture
+// with, matching the traffic of every network.
+func setupNetworks(specs []string, filter string, newDecoders func() *breakers) (string, error) {
+	networks = nil
+	if len(specs) == 0 {
+		networks = append(networks, &network{
+			filter:    filter,
+			protocols: map[string]bool{"discv4": true, "discv5": true},
+			decoders:  newDecoders(),
+		})
+		return filter, nil
+	}
+
+	labels := make(map[string]bool)
+	filters := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		n, err := parseNetwork(spec)
+		if err != nil {
+			return "", err
+		}
+		if labels[n.label] {
+			return "", fmt.Errorf("network %q given twice", n.label)
+		}
+		labels[n.label] = true
+		n.decoders = newDecoders()
+		n.decoders.network = n.label
+		networks = append(networks, n)
+		filters = append(filters, "("+n.filter+")")
+	}
+	return strings.Join(filters, " or "), nil
+}
+
+// compileNetworks compiles the filters networks are told apart by, only
+// needed when there are several.
+func compileNetworks(handle *capture) error {
+	if len(networks) < 2 {
+		return nil
+	}
+	for _, n := range networks {
+		bpf, err := handle.NewBPF(n.filter)
+		if err != nil {
+			return fmt.Errorf("network %q: %v", n.label, err)
+		}
+		n.bpf = bpf
+	}
+	return nil
+}
+
+// networkOf returns the first network whose filter matches packet, nil if
+// none does.
+func networkOf(packet gopacket.Packet) *network {
+	if len(networks) == 1 {
+		return networks[0]
+	}
+	for _, n := range networks {
+		if n.bpf.Matches(packet.Metadata().CaptureInfo, packet.Data()) {
+			return n
+		}
+	}
+	return nil
+}
+
+// decoderStates returns whether each decoder of every network is enabled,
+// keyed by label/protocol, or protocol alone for the default network.
+func decoderStates() map[string]bool {
+	states := make(map[string]bool)
+	for _, n := range networks {
+		for protocol, enabled := range n.decoders.states() {
+			states[n.qualify(protocol)] = enabled
+		}
+	}
+	return states
+}
+
+// decoderNames lists the decoders of every network, in a stable order,
+// including those that saw no packet yet.
+func decoderNames() []string {
+	var names []string
+	for _, n := range networks {
+		for _, protocol := range []string{"discv4", "discv5"} {
+			if n.protocols[protocol] {
+				names = append(names, n.qualify(protocol))
+			}
+		}
+	}
+	return names
+}
+
+// qualify prefixes protocol with the network label, if any.
+func (n *network) qualify(protocol string) string {
+	if n.label == "" {
+		return protocol
+	}
+	return n.label + "/" + protocol
+}
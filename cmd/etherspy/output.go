@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/davecgh/go-spew/spew"
+	"github.com/drgomesp/etherspy/pkg/match"
+	"github.com/drgomesp/etherspy/pkg/sink"
+	"github.com/google/gopacket"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Output formats.
+const (
+	outputLog     = "log"
+	outputSummary = "summary"
+	outputJSON    = "json"
+	outputCSV     = "csv"
+	outputNone    = "none"
+)
+
+var outputFormats = []string{outputLog, outputSummary, outputJSON, outputCSV, outputNone}
+
+// outputFields are the fields selected with -fields, nil for the defaults
+// of each format.
+var outputFields sink.FieldSet
+
+// output receives every record passing the filters, set up by newOutput.
+var output sink.Multi
+
+// grepPattern is the compiled -grep pattern, nil if unset.
+var grepPattern *regexp.Regexp
+
+// matchExpr is the compiled -match expression, nil if unset.
+var matchExpr *match.Expr
+
+// cloudEvents is the sink of -cloudevents, which alerts are also emitted
+// to, nil if unset.
+var cloudEvents *sink.CloudEvents
+
+// influx is the sink of -influx, which decode errors are also counted
+// in, nil if unset.
+var influx *sink.Influx
+
+// following is the node selected with -follow-node, nil if unset.
+var following *follower
+
+// record describes a decoded packet for output.
+type record = sink.DecodedPacket
+
+// newRecord fills in the capture metadata of a record from packet.
+func newRecord(packet gopacket.Packet, protocol string, size int) *record {
+	r := &record{
+		Time:      packetTime(packet),
+		Protocol:  protocol,
+		Size:      size,
+		Src:       "-",
+		Dst:       "-",
+		Direction: directionUnknown,
+	}
+	if network, transport := packet.NetworkLayer(), packet.TransportLayer(); network != nil && transport != nil {
+		nf, tf := network.NetworkFlow(), transport.TransportFlow()
+		r.Src = net.JoinHostPort(nf.Src().String(), tf.Src().String())
+		r.Dst = net.JoinHostPort(nf.Dst().String(), tf.Dst().String())
+	}
+	return r
+}
+
+func checkOutputFormat(format string) error {
+	for _, f := range outputFormats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown output format %q, want one of %s", format, strings.Join(outputFormats, "|"))
+}
+
+// newOutput sets up the stdout sink of the given format and the file sinks
+// listed in specs, comma separated format:path pairs. Files are rotated
+// past maxSize bytes, unless zero, keeping keep old files.
+func newOutput(format, specs string, maxSize int64, keep int) error {
+	output = nil
+	if format != outputNone {
+		s, err := newSink(format, os.Stdout)
+		if err != nil {
+			return err
+		}
+		output = append(output, s)
+	}
+	for _, spec := range strings.Split(specs, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		i := strings.IndexByte(spec, ':')
+		if i < 0 {
+			return fmt.Errorf("invalid sink %q, want format:path", spec)
+		}
+		format, path := spec[:i], spec[i+1:]
+		if err := checkOutputFormat(format); err != nil {
+			return err
+		}
+		f, err := sink.NewRotatingFile(path, maxSize, keep)
+		if err != nil {
+			return err
+		}
+		s, err := newSink(format, f)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		output = append(output, fileSink{s, f})
+		log.Info().Msgf("writing %s output to %q", format, path)
+	}
+	return nil
+}
+
+// addKafka adds a sink publishing to the Kafka topic on brokers, comma
+// separated host:port addresses.
+func addKafka(brokers, topic, encoding string) error {
+	var addrs []string
+	for _, b := range strings.Split(brokers, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			addrs = append(addrs, b)
+		}
+	}
+	s, err := sink.NewKafka(sink.KafkaConfig{
+		Brokers:  addrs,
+		Topic:    topic,
+		Encoding: encoding,
+		Times:    times,
+		OnError:  func(err error) { log.Warn().Err(err).Msg("kafka sink") },
+	})
+	if err != nil {
+		return err
+	}
+	output = append(output, s)
+	log.Info().Msgf("publishing %s output to kafka topic %q on %s", encoding, topic, strings.Join(addrs, ","))
+	return nil
+}
+
+// addCloudEvents adds a sink posting CloudEvents to url in the given
+// content mode. The source defaults to one naming the host.
+func addCloudEvents(url, mode, source string) error {
+	if source == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "localhost"
+		}
+		source = "/etherspy/" + host
+	}
+	s, err := sink.NewCloudEvents(sink.CloudEventsConfig{
+		URL:     url,
+		Mode:    mode,
+		Source:  source,
+		Times:   times,
+		OnError: func(err error) { log.Warn().Err(err).Msg("cloudevents sink") },
+	})
+	if err != nil {
+		return err
+	}
+	cloudEvents = s
+	output = append(output, s)
+	log.Info().Msgf("posting %s CloudEvents from %s to %s", mode, source, url)
+	return nil
+}
+
+// addInflux adds a sink writing aggregates over interval to the line
+// protocol endpoint url, tagged with tags, comma separated key=value pairs.
+func addInflux(url, token, measurement, tags string, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("-influx-interval must be positive")
+	}
+	tagMap := make(map[string]string)
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok || k == "" || v == "" {
+			return fmt.Errorf("invalid influx tag %q, want key=value", tag)
+		}
+		tagMap[k] = v
+	}
+	s, err := sink.NewInflux(sink.InfluxConfig{
+		URL:         url,
+		Token:       token,
+		Measurement: measurement,
+		Interval:    interval,
+		Tags:        tagMap,
+		OnError:     func(err error) { log.Warn().Err(err).Msg("influx sink") },
+	})
+	if err != nil {
+		return err
+	}
+	influx = s
+	output = append(output, s)
+	log.Info().Msgf("writing %s aggregates to %s", interval, url)
+	return nil
+}
+
+// fileSink closes the file a sink writes to along with the output. Sinks
+// leave the writers they are given open, stdout among them.
+type fileSink struct {
+	sink.Sink
+	f io.Closer
+}
+
+func (s fileSink) Close() error {
+	if c, ok := s.Sink.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			s.f.Close()
+			return err
+		}
+	}
+	return s.f.Close()
+}
+
+func newSink(format string, w io.Writer) (sink.Sink, error) {
+	switch format {
+	case outputLog:
+		// Dumps to stdout go to the main log, as they always did.
+		logger := log.Logger
+		if w != os.Stdout {
+			logger = log.Logger.Output(zerolog.ConsoleWriter{Out: w, NoColor: true})
+		}
+		return &sink.Log{Logger: logger, Times: times}, nil
+	case outputSummary:
+		s := sink.NewSummary(w)
+		s.Times, s.Fields = times, outputFields
+		return s, nil
+	case outputJSON:
+		s := sink.NewJSON(w)
+		s.Times, s.Fields = times, outputFields
+		return s, nil
+	case outputCSV:
+		s := sink.NewCSV(w)
+		s.Times, s.Fields = times, outputFields
+		return s, nil
+	default:
+		return nil, fmt.Errorf("output format %q can't be written to a sink", format)
+	}
+}
+
+// recordFields exposes the capture metadata and decoded fields of a record
+// to -match expressions. Decoded fields are addressed by their
+// case-insensitive name, with dots into nested values as in from.ip.
+type recordFields struct {
+	r    *record
+	body interface{}
+	done bool
+}
+
+func (f *recordFields) Field(name string) (interface{}, bool) {
+	switch strings.ToLower(name) {
+	case "proto", "protocol":
+		return f.r.Protocol, true
+	case "kind":
+		return f.r.Kind, true
+	case "src":
+		return f.r.Src, true
+	case "dst":
+		return f.r.Dst, true
+	case "size":
+		return f.r.Size, true
+	case "direction":
+		return f.r.Direction, true
+	case "network":
+		return f.r.Network, true
+	case "chain":
+		return f.r.Chain, true
+	case "node", "node_id":
+		if f.r.NodeID == nil {
+			return nil, false
+		}
+		id, err := f.r.NodeID()
+		return id, err == nil
+	}
+
+	if !f.done {
+		f.done = true
+		if body, err := f.r.Body(); err == nil {
+			f.body = sink.Value(reflect.ValueOf(body), 0)
+		}
+	}
+	v := f.body
+	for _, key := range strings.Split(name, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		v, ok = lookupFold(obj, key)
+		if !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func lookupFold(obj map[string]interface{}, key string) (interface{}, bool) {
+	if v, ok := obj[key]; ok {
+		return v, true
+	}
+	for k, v := range obj {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// writeRecord writes r to the output sinks, unless it is filtered out by
+// -follow-node, -match or -grep. Transcripts see every record regardless.
+func writeRecord(r *record) error {
+	if conversation != nil {
+		conversation.add(r)
+	}
+
+	if following != nil && !following.match(r) {
+		return nil
+	}
+
+	if matchExpr != nil && !matchExpr.Match(&recordFields{r: r}) {
+		return nil
+	}
+
+	if grepPattern != nil {
+		text, err := renderText(r)
+		if err != nil {
+			return err
+		}
+		if !grepPattern.MatchString(text) {
+			return nil
+		}
+	}
+
+	return output.Write(*r)
+}
+
+// renderText renders every field of a record as text for pattern matching:
+// the capture metadata, the sender node ID, a dump of the decoded packet and
+// the hex encoding of all its raw byte fields.
+func renderText(r *record) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s %s %s %d %s\n", times.Format(r.Time), r.Protocol, r.Kind, r.Src, r.Dst, r.Size, r.Direction)
+	if r.NodeID != nil {
+		if id, err := r.NodeID(); err == nil {
+			fmt.Fprintf(&b, "node %s\n", id)
+		}
+	}
+	p, err := r.Body()
+	if err != nil {
+		return "", err
+	}
+	b.WriteString(spew.Sdump(p))
+	for _, h := range hexFields(reflect.ValueOf(p), 0) {
+		b.WriteString(h)
+		b.WriteByte('\n')
+	}
+	return b.String(), nil
+}
+
+// hexFields returns the hex encoding of every byte slice and array reachable
+// from v.
+func hexFields(v reflect.Value, depth int) []string {
+	if depth > 16 || !v.IsValid() {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return hexFields(v.Elem(), depth+1)
+	case reflect.Struct:
+		var out []string
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Type().Field(i).IsExported() {
+				continue
+			}
+			out = append(out, hexFields(v.Field(i), depth+1)...)
+		}
+		return out
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Kind() == reflect.Array && !v.CanAddr() {
+				c := reflect.New(v.Type()).Elem()
+				c.Set(v)
+				v = c
+			}
+			return []string{hex.EncodeToString(v.Slice(0, v.Len()).Bytes())}
+		}
+		var out []string
+		for i := 0; i < v.Len(); i++ {
+			out = append(out, hexFields(v.Index(i), depth+1)...)
+		}
+		return out
+	default:
+		return nil
+	}
+}
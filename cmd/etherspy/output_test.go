@@ -0,0 +1,115 @@
+package main
+
+import (
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/drgomesp/etherspy/pkg/match"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"net"
+	"testing"
+)
+
+// v4Record returns the record of body as sent by the node of testKeyA,
+// filled in as by the capture loop.
+func v4Record(t *testing.T, body discv4.Body) *record {
+	t.Helper()
+	data, _, err := discv4.Encode(testKeyA, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := discv4.Decode(data, discv4.DecodeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &record{Protocol: "discv4", Kind: pkt.Kind.String(), Src: "10.0.0.1:30303", Dst: "10.0.0.2:30303", Size: len(data)}
+	rec.NodeID = func() (string, error) {
+		id, err := pkt.Sender.NodeID()
+		return id.String(), err
+	}
+	rec.Body = func() (interface{}, error) { return pkt.Body() }
+	return rec
+}
+
+// v5Record returns the record of p as sent by the node of testKeyA to that
+// of testKeyB, in a session both know, filled in as by the capture loop.
+func v5Record(t *testing.T, p discv5.Packet) *record {
+	t.Helper()
+	a, b := discv5.NewEncoder(testKeyA), discv5.NewEncoder(testKeyB)
+	nodeA := enode.NewV4(&testKeyA.PublicKey, net.IPv4(10, 0, 0, 1), 30303, 30303)
+	nodeB := enode.NewV4(&testKeyB.PublicKey, net.IPv4(10, 0, 0, 2), 30303, 30303)
+	initiatorKey, recipientKey := make([]byte, 16), make([]byte, 16)
+	recipientKey[0] = 1
+	a.Sessions.SetSession(nodeA.ID(), nodeB.ID(), initiatorKey, recipientKey)
+	b.Sessions.SetSession(nodeA.ID(), nodeB.ID(), initiatorKey, recipientKey)
+	data, err := a.Encode(nodeB, p, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := len(data)
+	p, err = discv5.Decode(data, discv5.DecodeOptions{Dest: nodeB.ID(), Sessions: b.Sessions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &record{Protocol: "discv5", Kind: p.Name(), Src: "10.0.0.1:30303", Dst: "10.0.0.2:30303", Size: size}
+	rec.NodeID = func() (string, error) { return discv5SrcID(p), nil }
+	rec.Body = func() (interface{}, error) { return p, nil }
+	return rec
+}
+
+func TestMatchFields(t *testing.T) {
+	neighbors := make([]discv4.Node, 12)
+	for i := range neighbors {
+		neighbors[i] = discv4.Node{IP: net.IPv4(10, 0, 1, byte(i)).To4(), UDP: 30303, TCP: 30303}
+	}
+	records := map[string]*record{
+		"ping": v4Record(t, &discv4.Ping{
+			Version:    4,
+			From:       discv4.Endpoint{IP: net.IPv4(10, 0, 0, 1).To4(), UDP: 30303, TCP: 30304},
+			To:         discv4.Endpoint{IP: net.IPv4(10, 0, 0, 2).To4(), UDP: 30303},
+			Expiration: 1700000000,
+		}),
+		"neighbors": v4Record(t, &discv4.Neighbors{Nodes: neighbors, Expiration: 1700000000}),
+		"whoareyou": v5Record(t, &discv5.Whoareyou{RecordSeq: 7}),
+		"findnode":  v5Record(t, &discv5.FindNode{ReqID: []byte{1, 2}, Distances: []uint{256, 255, 254}}),
+	}
+	v4ID, err := records["ping"].NodeID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v5ID := enode.PubkeyToIDV4(&testKeyA.PublicKey).String()
+
+	tests := []struct {
+		expr  string
+		match []string // names of the matching records
+	}{
+		{"proto==discv4", []string{"ping", "neighbors"}},
+		{"protocol==discv5 && size>0", []string{"whoareyou", "findnode"}},
+		{"proto==discv4 && kind==NEIGHBORS && nodes>8", []string{"neighbors"}},
+		{"nodes>12", nil},
+		{"kind==PING && version==4 && from.ip==10.0.0.1 && From.TCP==30304 && to.udp==30303", []string{"ping"}},
+		{"expiration>=1700000000", []string{"ping", "neighbors"}},
+		{"node==" + v4ID, []string{"ping", "neighbors"}},
+		{"node_id==" + v5ID, []string{"findnode"}},
+		{"kind==WHOAREYOU && recordseq==7", []string{"whoareyou"}},
+		{`kind=="MESSAGE/FIND_NODE" && body.distances==3 && srcid==` + v5ID, []string{"findnode"}},
+		{"body.reqid==0102", []string{"findnode"}},
+		{"src~=^10\\.0\\.0\\.1: && dst==10.0.0.2:30303", []string{"ping", "neighbors", "whoareyou", "findnode"}},
+		{"from.ip.x==1 || body.nothing==1", nil},
+	}
+	for _, tt := range tests {
+		e, err := match.Compile(tt.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		want := make(map[string]bool)
+		for _, name := range tt.match {
+			want[name] = true
+		}
+		for name, rec := range records {
+			if got := e.Match(&recordFields{r: rec}); got != want[name] {
+				t.Errorf("%s on %s: %v, want %v", tt.expr, name, got, want[name])
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/pcapng"
+	"github.com/drgomesp/etherspy/pkg/sink"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/rs/zerolog/log"
+	"os"
+	"strings"
+)
+
+// pcapOut writes the packets decoded successfully to a new capture file,
+// set up with -w or by the extcap command, and nil if neither is.
+var pcapOut *pcapWriter
+
+type pcapWriter struct {
+	f *os.File
+	w *pcapgo.Writer
+
+	// ng replaces w for captures annotated with the decoded packets, their
+	// JSON records as well if records is set.
+	ng      *pcapng.Writer
+	records bool
+
+	// Selected protocols and protocol/kind pairs, everything if empty.
+	selected map[string]bool
+}
+
+// newPcapWriter creates the capture file path for packets of the given link
+// type. Only packets matching one of the comma separated selectors, either
+// a protocol or protocol/kind as in discv4/PING, are written, all of them if
+// there are none.
+func newPcapWriter(path string, linkType layers.LinkType, snaplen int, selectors string) (*pcapWriter, error) {
+	p := &pcapWriter{selected: make(map[string]bool)}
+	for _, s := range strings.Split(selectors, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		protocol := s
+		if i := strings.IndexByte(s, '/'); i >= 0 {
+			protocol = s[:i]
+		}
+		if protocol != "discv4" && protocol != "discv5" {
+			return nil, fmt.Errorf("invalid selector %q, want protocol or protocol/kind of discv4 or discv5", s)
+		}
+		p.selected[s] = true
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	p.f, p.w = f, pcapgo.NewWriterNanos(f)
+	if err := p.w.WriteFileHeader(uint32(snaplen), linkType); err != nil {
+		f.Close()
+		return nil, err
+	}
+	log.Info().Msgf("writing decoded packets to %q", path)
+	return p, nil
+}
+
+// newAnnotatedWriter writes every packet decoded to the pcapng file or
+// pipe at path, each with a comment summing up its decoding and, if
+// records is set, another with its JSON record.
+func newAnnotatedWriter(path string, linkType layers.LinkType, snaplen int, records bool) (*pcapWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	ng, err := pcapng.NewWriter(f, linkType, snaplen, "etherspy")
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &pcapWriter{f: f, ng: ng, records: records}, nil
+}
+
+// write saves the frame of a packet captured as described by ci, decoded
+// to rec, with its original framing. Writes are unbuffered so the file is
+// complete whenever the capture is interrupted.
+func (p *pcapWriter) write(rec *record, ci gopacket.CaptureInfo, frame []byte) {
+	if len(p.selected) > 0 && !p.selected[rec.Protocol] && !p.selected[rec.Protocol+"/"+rec.Kind] {
+		return
+	}
+	if p.ng == nil {
+		if err := p.w.WritePacket(ci, frame); err != nil {
+			log.Warn().Err(err).Msg("could not write packet to capture file")
+		}
+		return
+	}
+	if err := p.ng.WritePacket(ci, frame, p.comments(rec)...); err != nil {
+		// Wireshark closes the pipe once its capture is stopped.
+		log.Info().Err(err).Msg("capture pipe closed, stopping")
+		os.Exit(exitCode)
+	}
+}
+
+// comments describes rec as packet comments, which Wireshark filters on
+// as frame.comment, e.g. frame.comment contains "discv5 WHOAREYOU".
+func (p *pcapWriter) comments(rec *record) []string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "etherspy: %s %s %s > %s", rec.Tag(), rec.Kind, rec.Src, rec.Dst)
+	if rec.NodeID != nil {
+		if id, err := rec.NodeID(); err == nil {
+			fmt.Fprintf(&b, " node %s", id)
+		}
+	}
+	if rec.Chain != "" {
+		fmt.Fprintf(&b, " chain %s", rec.Chain)
+	}
+	out := []string{b.String()}
+	if p.records {
+		r := sink.NewRecord(*rec)
+		r.Time.Format = times
+		if data, err := json.Marshal(r); err == nil {
+			out = append(out, string(data))
+		}
+	}
+	return out
+}
+
+func (p *pcapWriter) close() error {
+	return p.f.Close()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// perfPreset is a coherent set of runtime and capture tuning knobs.
+type perfPreset struct {
+	gcPercent     int   // GOGC
+	memoryLimit   int64 // GOMEMLIMIT in bytes, 0 means no limit
+	maxProcs      int   // GOMAXPROCS, 0 means the runtime default
+	captureBuffer int   // kernel capture buffer in bytes, 0 means the backend default
+	immediate     bool  // deliver packets as soon as they arrive instead of batching
+}
+
+var perfPresets = map[string]perfPreset{
+	// Deliver every packet immediately and keep GC pauses rare.
+	"low-latency": {gcPercent: 200, captureBuffer: 4 << 20, immediate: true},
+	// Large kernel buffers absorb bursts, a lazy GC trades memory for CPU.
+	"throughput": {gcPercent: 400, captureBuffer: 64 << 20},
+	// Aggressive GC under a hard heap limit, for small hosts and containers.
+	"low-memory": {gcPercent: 50, memoryLimit: 256 << 20, maxProcs: 2, captureBuffer: 1 << 20},
+}
+
+func perfPresetNames() string {
+	names := make([]string, 0, len(perfPresets))
+	for name := range perfPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, "|")
+}
+
+func lookupPerfPreset(name string) (perfPreset, error) {
+	if name == "" {
+		return perfPreset{}, nil
+	}
+	p, ok := perfPresets[name]
+	if !ok {
+		return p, fmt.Errorf("unknown performance preset %q, want one of %s", name, perfPresetNames())
+	}
+	return p, nil
+}
+
+// applyRuntime applies the runtime knobs of the preset. Knobs explicitly set
+// through their standard environment variables take precedence.
+func (p perfPreset) applyRuntime() {
+	if _, ok := os.LookupEnv("GOGC"); !ok && p.gcPercent != 0 {
+		debug.SetGCPercent(p.gcPercent)
+	}
+	if _, ok := os.LookupEnv("GOMEMLIMIT"); !ok && p.memoryLimit != 0 {
+		debug.SetMemoryLimit(p.memoryLimit)
+	}
+	if _, ok := os.LookupEnv("GOMAXPROCS"); !ok && p.maxProcs != 0 {
+		runtime.GOMAXPROCS(p.maxProcs)
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/ethereum/enr"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	gethenr "github.com/ethereum/go-ethereum/p2p/enr"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// pinger checks on a single node over a discovery protocol.
+type pinger interface {
+	// ping returns the round trip time of a PING, 0 if it went unanswered.
+	ping(timeout time.Duration) (time.Duration, error)
+	// record asks the node for its record, nil if it didn't answer.
+	record(timeout time.Duration) (*enr.Record, error)
+	close()
+}
+
+// pingCommand runs the ping command: it pings a node given by its enode URL
+// or record, prints the round trip times of its PONGs, then asks for its
+// record and prints it. It fails if the node never answered.
+func pingCommand(args []string) error {
+	fs := flag.NewFlagSet("ping", flag.ExitOnError)
+	protocol := fs.String("protocol", "", "Discovery protocol, v4 or v5 (default v4 for enode URLs, v5 for records)")
+	count := fs.Int("c", 3, "Number of pings")
+	interval := fs.Duration("interval", time.Second, "Time between two pings")
+	timeout := fs.Duration("timeout", 5*time.Second, "Time to wait for an answer")
+	listen := fs.String("listen", "", "UDP address pings are sent from (default any address of the node's family)")
+	keyFile := fs.String("nodekey-file", "", "Key pings are signed with (default a new key)")
+	keyLogFile := fs.String("keylog", os.Getenv("DISCV5KEYLOGFILE"), "Append the keys of discv5 sessions to this key log, so captures of the pings can be decrypted (default $DISCV5KEYLOGFILE)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: etherspy ping [flags] enode://...|enr:...\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("want a single enode URL or record")
+	}
+
+	arg := strings.TrimSpace(fs.Arg(0))
+	node, err := enode.Parse(enode.ValidSchemes, arg)
+	if err != nil {
+		return fmt.Errorf("invalid node %q: %v", arg, err)
+	}
+	if node.IP() == nil || node.UDP() == 0 {
+		return fmt.Errorf("node %s has no UDP endpoint", node.ID().TerminalString())
+	}
+	if *protocol == "" {
+		*protocol = "v5"
+		if strings.HasPrefix(arg, "enode://") {
+			*protocol = "v4"
+		}
+	}
+	if *listen == "" {
+		*listen = "0.0.0.0:0"
+		if node.IP().To4() == nil {
+			*listen = "[::]:0"
+		}
+	}
+
+	var key *ecdsa.PrivateKey
+	if *keyFile != "" {
+		key, err = readNodeKey(*keyFile)
+	} else {
+		key, err = crypto.GenerateKey()
+	}
+	if err != nil {
+		return err
+	}
+
+	to := &net.UDPAddr{IP: node.IP(), Port: node.UDP()}
+	var p pinger
+	switch *protocol {
+	case "v4":
+		p, err = newV4Pinger(*listen, key, to)
+	case "v5":
+		var v *v5Pinger
+		if v, err = newV5Pinger(*listen, key, node, to); err == nil && *keyLogFile != "" {
+			f, ferr := os.OpenFile(*keyLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+			if ferr != nil {
+				v.close()
+				return ferr
+			}
+			defer f.Close()
+			v.enc.KeyLog = f
+		}
+		p = v
+	default:
+		return fmt.Errorf("unknown protocol %q, want v4 or v5", *protocol)
+	}
+	if err != nil {
+		return err
+	}
+	defer p.close()
+
+	fmt.Printf("PING %s (%s) over discv%s\n", node.ID().TerminalString(), to, (*protocol)[1:])
+	var (
+		pongs         int
+		min, max, sum time.Duration
+	)
+	for i := 0; i < *count; i++ {
+		if i > 0 {
+			time.Sleep(*interval)
+		}
+		rtt, err := p.ping(*timeout)
+		if err != nil {
+			return err
+		}
+		if rtt == 0 {
+			fmt.Printf("no PONG from %s: seq=%d timeout=%s\n", to, i+1, *timeout)
+			continue
+		}
+		pongs++
+		sum += rtt
+		if min == 0 || rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+		fmt.Printf("PONG from %s: seq=%d time=%s\n", to, i+1, rtt.Round(time.Microsecond))
+	}
+
+	fmt.Printf("--- %s ping statistics ---\n", to)
+	fmt.Printf("%d pings, %d pongs, %.0f%% loss", *count, pongs, 100*float64(*count-pongs)/float64(*count))
+	if pongs > 0 {
+		fmt.Printf(", min/avg/max %s/%s/%s",
+			min.Round(time.Microsecond),
+			(sum / time.Duration(pongs)).Round(time.Microsecond),
+			max.Round(time.Microsecond))
+	}
+	fmt.Println()
+	if pongs == 0 {
+		return fmt.Errorf("node %s is unreachable", node.ID().TerminalString())
+	}
+
+	r, err := p.record(*timeout)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		fmt.Fprintf(os.Stderr, "node %s did not send its record\n", node.ID().TerminalString())
+		return nil
+	}
+	fmt.Printf("--- record seq %d ---\n%s\n%s\n", r.Seq, r.Text(), r)
+	return nil
+}
+
+// v4Pinger pings a node over discv4, answering its pings so it accepts our
+// ENRREQUEST.
+type v4Pinger struct {
+	p    *prober
+	to   *net.UDPAddr
+	ch   chan *discv4.Packet
+	done func()
+}
+
+func newV4Pinger(listen string, key *ecdsa.PrivateKey, to *net.UDPAddr) (*v4Pinger, error) {
+	p, err := newProber(listen, key)
+	if err != nil {
+		return nil, err
+	}
+	ch, done := p.subscribe(to)
+	return &v4Pinger{p: p, to: to, ch: ch, done: done}, nil
+}
+
+func (v *v4Pinger) ping(timeout time.Duration) (time.Duration, error) {
+	local := v.p.conn.LocalAddr().(*net.UDPAddr)
+	sent := time.Now()
+	hash, err := v.p.send(v.to, &discv4.Ping{
+		Version:    4,
+		From:       discv4.Endpoint{IP: local.IP, UDP: uint16(local.Port)},
+		To:         discv4.Endpoint{IP: v.to.IP, UDP: uint16(v.to.Port)},
+		Expiration: expiration(),
+	})
+	if err != nil {
+		return 0, err
+	}
+	pong := wait(v.ch, discv4.PacketPong, timeout, func(b discv4.Body) bool {
+		return bytes.Equal(b.(*discv4.Pong).ReplyTok, hash)
+	})
+	if pong == nil {
+		return 0, nil
+	}
+	return time.Since(sent), nil
+}
+
+func (v *v4Pinger) record(timeout time.Duration) (*enr.Record, error) {
+	hash, err := v.p.send(v.to, &discv4.ENRRequest{Expiration: expiration()})
+	if err != nil {
+		return nil, err
+	}
+	b := wait(v.ch, discv4.PacketENRResponse, timeout, func(b discv4.Body) bool {
+		return bytes.Equal(b.(*discv4.ENRResponse).ReplyTok, hash)
+	})
+	if b == nil {
+		return nil, nil
+	}
+	return enr.New(&b.(*discv4.ENRResponse).Record), nil
+}
+
+func (v *v4Pinger) close() {
+	v.done()
+	v.p.conn.Close()
+}
+
+// v5Pinger pings a node over discv5, performing the handshake it asks for
+// with the first PING, whose round trip time includes it.
+type v5Pinger struct {
+	conn *net.UDPConn
+	node *enode.Node
+	to   *net.UDPAddr
+	enc  *discv5.Encoder
+	in   chan []byte // packets sent by the node
+}
+
+func newV5Pinger(listen string, key *ecdsa.PrivateKey, node *enode.Node, to *net.UDPAddr) (*v5Pinger, error) {
+	addr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// Nodes drop handshakes lacking the record of their sender.
+	var r gethenr.Record
+	r.SetSeq(1)
+	r.Set(gethenr.UDP(conn.LocalAddr().(*net.UDPAddr).Port))
+	if err := enode.SignV4(&r, key); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	enc := discv5.NewEncoder(key)
+	enc.Record = &r
+	v := &v5Pinger{conn: conn, node: node, to: to, enc: enc, in: make(chan []byte, 16)}
+	go v.read()
+	return v, nil
+}
+
+func (v *v5Pinger) read() {
+	buf := make([]byte, discv5.MaxPacketSize)
+	for {
+		n, from, err := v.conn.ReadFromUDP(buf)
+		if err != nil {
+			close(v.in)
+			return
+		}
+		if !from.IP.Equal(v.to.IP) || from.Port != v.to.Port {
+			continue
+		}
+		select {
+		case v.in <- append([]byte(nil), buf[:n]...):
+		default:
+		}
+	}
+}
+
+// send encodes req, as a handshake if challenge is set.
+func (v *v5Pinger) send(req discv5.Packet, challenge *discv5.Whoareyou) error {
+	packet, err := v.enc.Encode(v.node, req, challenge)
+	if err != nil {
+		return err
+	}
+	_, err = v.conn.WriteToUDP(packet, v.to)
+	return err
+}
+
+// next returns the next message answering the request with the given ID,
+// answering the node's challenges by resending req. It returns nil on
+// timeout.
+func (v *v5Pinger) next(req discv5.Packet, timeout time.Duration) (discv5.Packet, error) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case data, ok := <-v.in:
+			if !ok {
+				return nil, nil
+			}
+			pkt, err := discv5.Decode(data, discv5.DecodeOptions{Dest: v.enc.ID(), Sessions: v.enc.Sessions})
+			if err != nil {
+				continue
+			}
+			var body discv5.Packet
+			switch pkt := pkt.(type) {
+			case *discv5.Whoareyou:
+				if err := v.send(req, pkt); err != nil {
+					return nil, err
+				}
+				continue
+			case *discv5.Message:
+				body = pkt.Body
+			case *discv5.Handshake:
+				body = pkt.Body
+			}
+			if body != nil && bytes.Equal(body.RequestID(), req.RequestID()) {
+				return body, nil
+			}
+		case <-deadline:
+			return nil, nil
+		}
+	}
+}
+
+func (v *v5Pinger) request(req discv5.Packet, timeout time.Duration) (discv5.Packet, error) {
+	id := make([]byte, 8)
+	rand.Read(id)
+	req.SetRequestID(id)
+	if err := v.send(req, nil); err != nil {
+		return nil, err
+	}
+	return v.next(req, timeout)
+}
+
+func (v *v5Pinger) ping(timeout time.Duration) (time.Duration, error) {
+	sent := time.Now()
+	pong, err := v.request(&discv5.Ping{}, timeout)
+	if err != nil || pong == nil {
+		return 0, err
+	}
+	if _, ok := pong.(*discv5.Pong); !ok {
+		return 0, fmt.Errorf("node answered PING with %s", pong.Name())
+	}
+	return time.Since(sent), nil
+}
+
+// record asks for the nodes at distance 0, which is the node itself.
+func (v *v5Pinger) record(timeout time.Duration) (*enr.Record, error) {
+	req := &discv5.FindNode{Distances: []uint{0}}
+	answer, err := v.request(req, timeout)
+	if err != nil || answer == nil {
+		return nil, err
+	}
+	nodes, ok := answer.(*discv5.Nodes)
+	if !ok {
+		return nil, fmt.Errorf("node answered FINDNODE with %s", answer.Name())
+	}
+	for _, r := range nodes.Nodes {
+		if rec := enr.New(r); rec.Verified && rec.NodeID == v.node.ID() {
+			return rec, nil
+		}
+	}
+	return nil, nil
+}
+
+func (v *v5Pinger) close() {
+	v.conn.Close()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/drgomesp/etherspy/pkg/stats"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"time"
+)
+
+// A ping is given pongTimeout to be answered, lenient as with ENRRequests.
+// An endpoint proof holds for bondExpiration, as in geth. At most
+// proofsMaxEndpoints endpoints are counted for, those seen least recently
+// are forgotten first.
+const (
+	pongTimeout        = 5 * time.Second
+	bondExpiration     = 24 * time.Hour
+	proofsMaxEndpoints = 1 << 18
+)
+
+// Outcomes of a discv4 ping.
+const (
+	proofCompleted   = "completed"   // answered in time by the pinged endpoint
+	proofUnanswered  = "unanswered"  // no pong within the timeout
+	proofLate        = "late"        // answered past the timeout or expiration
+	proofMisdirected = "misdirected" // answered from or to another endpoint
+	proofUnsolicited = "unsolicited" // pong to no ping captured
+)
+
+// pendingPing is a discv4 ping awaiting its pong.
+type pendingPing struct {
+	time       time.Time
+	from, to   string
+	expiration uint64
+}
+
+// endpointStats counts the pings sent to an endpoint and the FINDNODEs it
+// sent without having proven itself.
+type endpointStats struct {
+	pings, completed, unanswered uint64
+	unprovenFindNodes            uint64
+	rtt                          time.Duration // smoothed as TCP does
+	seen                         time.Time
+}
+
+// endpointProofs follows the discv4 endpoint proof: a node answers FINDNODE
+// only from endpoints that answered one of its pings with a pong echoing the
+// ping's hash within the last day. It correlates pings and pongs, measures
+// round-trip times and counts FINDNODEs sent without a proof captured, which
+// peers silently ignore. Enabled with -endpoint-proofs.
+type endpointProofs struct {
+	pings  map[string]pendingPing  // by hash
+	proven map[[2]string]time.Time // last proof by verifier, prover address
+
+	outcomes  map[string]uint64
+	rtt       stats.Histogram
+	endpoints map[string]*endpointStats // by pinged address
+
+	findNodes, unprovenFindNodes uint64
+	lastExpire                   time.Time
+}
+
+func newEndpointProofs() *endpointProofs {
+	return &endpointProofs{
+		pings:     make(map[string]pendingPing),
+		proven:    make(map[[2]string]time.Time),
+		outcomes:  make(map[string]uint64),
+		endpoints: make(map[string]*endpointStats),
+	}
+}
+
+// endpoint returns the counts of addr, seen at now.
+func (e *endpointProofs) endpoint(addr string, now time.Time) *endpointStats {
+	s := e.endpoints[addr]
+	if s == nil {
+		if len(e.endpoints) >= proofsMaxEndpoints {
+			e.evict()
+		}
+		s = new(endpointStats)
+		e.endpoints[addr] = s
+	}
+	if now.After(s.seen) {
+		s.seen = now
+	}
+	return s
+}
+
+// evict forgets the tenth of the endpoints seen least recently, as the node
+// table does.
+func (e *endpointProofs) evict() {
+	addrs := make([]string, 0, len(e.endpoints))
+	for addr := range e.endpoints {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return e.endpoints[addrs[i]].seen.Before(e.endpoints[addrs[j]].seen) })
+	for _, addr := range addrs[:len(addrs)/10+1] {
+		delete(e.endpoints, addr)
+	}
+}
+
+// observe accounts for a discv4 packet.
+func (e *endpointProofs) observe(rec *record, pkt *discv4.Packet) {
+	e.expire(rec.Time)
+	switch pkt.Kind {
+	case discv4.PacketPing, discv4.PacketPong:
+	case discv4.PacketFindNode:
+		e.findNodes++
+		// The recipient verifies the sender.
+		if t, ok := e.proven[[2]string{rec.Dst, rec.Src}]; !ok || rec.Time.Sub(t) > bondExpiration {
+			e.unprovenFindNodes++
+			e.endpoint(rec.Src, rec.Time).unprovenFindNodes++
+		}
+		return
+	default:
+		return
+	}
+
+	body, err := pkt.Body()
+	if err != nil {
+		return
+	}
+	switch b := body.(type) {
+	case *discv4.Ping:
+		e.pings[string(pkt.Hash)] = pendingPing{time: rec.Time, from: rec.Src, to: rec.Dst, expiration: b.Expiration}
+		e.endpoint(rec.Dst, rec.Time).pings++
+	case *discv4.Pong:
+		p, ok := e.pings[string(b.ReplyTok)]
+		outcome := proofCompleted
+		switch {
+		case !ok:
+			outcome = proofUnsolicited
+		case p.from != rec.Dst || p.to != rec.Src:
+			outcome = proofMisdirected
+		case rec.Time.Sub(p.time) > pongTimeout || uint64(rec.Time.Unix()) > p.expiration:
+			outcome = proofLate
+		}
+		e.outcomes[outcome]++
+		if !ok {
+			return
+		}
+		delete(e.pings, string(b.ReplyTok))
+		if outcome == proofCompleted {
+			rtt := rec.Time.Sub(p.time)
+			e.rtt.Observe(rtt)
+			e.proven[[2]string{p.from, p.to}] = rec.Time
+			s := e.endpoint(p.to, rec.Time)
+			s.completed++
+			if s.completed == 1 {
+				s.rtt = rtt
+			} else {
+				s.rtt += (rtt - s.rtt) / 8
+			}
+		}
+	}
+}
+
+// expire gives up on the pings left unanswered for too long and forgets
+// expired proofs, at most once per timeout.
+func (e *endpointProofs) expire(now time.Time) {
+	if now.Sub(e.lastExpire) < pongTimeout {
+		return
+	}
+	e.lastExpire = now
+	for hash, p := range e.pings {
+		if now.Sub(p.time) > pongTimeout {
+			delete(e.pings, hash)
+			e.outcomes[proofUnanswered]++
+			e.endpoint(p.to, p.time).unanswered++
+		}
+	}
+	for key, t := range e.proven {
+		if now.Sub(t) > bondExpiration {
+			delete(e.proven, key)
+		}
+	}
+}
+
+// report logs ping outcomes and round-trip times, then the endpoints
+// failing most proofs or sending most FINDNODEs without one.
+func (e *endpointProofs) report() {
+	var pings uint64
+	for _, n := range e.outcomes {
+		pings += n
+	}
+	if pings == 0 && e.findNodes == 0 {
+		return
+	}
+	ev := log.Info()
+	for outcome, n := range e.outcomes {
+		ev = ev.Uint64(outcome, n)
+	}
+	if resolved := e.outcomes[proofCompleted] + e.outcomes[proofUnanswered] + e.outcomes[proofLate]; resolved > 0 {
+		ev = ev.Float64("completion_rate", float64(e.outcomes[proofCompleted])/float64(resolved))
+	}
+	ev.Dur("rtt_p50", e.rtt.Quantile(0.5)).
+		Dur("rtt_p90", e.rtt.Quantile(0.9)).
+		Dur("rtt_p99", e.rtt.Quantile(0.99)).
+		Int("proven_endpoints", len(e.proven)).
+		Uint64("findnodes", e.findNodes).
+		Uint64("findnodes_unproven", e.unprovenFindNodes).
+		Msg("endpoint proofs")
+
+	addrs := make([]string, 0, len(e.endpoints))
+	for addr, s := range e.endpoints {
+		if s.unanswered > 0 || s.unprovenFindNodes > 0 {
+			addrs = append(addrs, addr)
+		}
+	}
+	failures := func(s *endpointStats) uint64 { return s.unanswered + s.unprovenFindNodes }
+	sort.Slice(addrs, func(i, j int) bool {
+		if a, b := failures(e.endpoints[addrs[i]]), failures(e.endpoints[addrs[j]]); a != b {
+			return a > b
+		}
+		return addrs[i] < addrs[j]
+	})
+	if len(addrs) > 10 {
+		addrs = addrs[:10]
+	}
+	for _, addr := range addrs {
+		s := e.endpoints[addr]
+		enrichEvent(log.Info().Str("endpoint", addr), addr).
+			Uint64("pings", s.pings).
+			Uint64("completed", s.completed).
+			Uint64("unanswered", s.unanswered).
+			Uint64("findnodes_unproven", s.unprovenFindNodes).
+			Msg("endpoint proof failures")
+	}
+}
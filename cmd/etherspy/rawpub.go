@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/drgomesp/etherspy/pkg/datagram"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/rs/zerolog/log"
+	"net"
+	"os"
+)
+
+// rawBuffer is the number of datagrams buffered per sidecar before they are
+// dropped.
+const rawBuffer = 4096
+
+// rawPub publishes the raw datagrams of monitored networks to sidecars, nil
+// unless enabled.
+var rawPub *datagram.Hub
+
+// serveRawPub starts publishing datagrams to sidecars connecting to the Unix
+// socket at path, replacing a stale socket left by a previous run.
+func serveRawPub(path string) error {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	rawPub = datagram.NewHub()
+	log.Info().Msgf("publishing raw datagrams on %s", path)
+	go func() {
+		err := rawPub.Serve(l, rawBuffer, func(addr net.Addr, dropped uint64, err error) {
+			log.Info().Uint64("dropped", dropped).Msgf("raw datagram subscriber disconnected: %v", err)
+		})
+		log.Warn().Err(err).Msg("raw datagram socket closed")
+	}()
+	return nil
+}
+
+// publishRaw hands the UDP payload buf of packet to the sidecars.
+func publishRaw(packet gopacket.Packet, udp *layers.UDP, network string, buf []byte) {
+	d := datagram.Datagram{Time: packetTime(packet), Network: network, Payload: buf}
+	if nl := packet.NetworkLayer(); nl != nil {
+		flow := nl.NetworkFlow()
+		d.Src = &net.UDPAddr{IP: net.IP(flow.Src().Raw()), Port: int(udp.SrcPort)}
+		d.Dst = &net.UDPAddr{IP: net.IP(flow.Dst().Raw()), Port: int(udp.DstPort)}
+	}
+	rawPub.Publish(d)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"github.com/drgomesp/etherspy/pkg/tracker"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hostnames are cached for rdnsTTL, failed lookups for rdnsNegativeTTL so
+// they are retried now and then. Up to rdnsWorkers lookups run at once so a
+// slow server doesn't hold the others back. IPs waiting for a worker are
+// bounded by rdnsQueue, past which they are dropped until seen again.
+const (
+	rdnsTTL         = time.Hour
+	rdnsNegativeTTL = 10 * time.Minute
+	rdnsWorkers     = 4
+	rdnsQueue       = 1024
+)
+
+// rdnsEntry is the outcome of the PTR lookup of an IP, name empty if it
+// failed.
+type rdnsEntry struct {
+	name    string
+	expires time.Time
+}
+
+// rdns looks up the PTR records of the IPs seen in the background, at a
+// bounded rate, and caches the hostnames, which many hosting providers give
+// away. Packets are never held back by lookups, hostnames are attached to
+// node profiles and reports once known. Times are real ones, whatever the
+// timestamps of the packets. It is the rdns stage of the enrichment
+// pipeline.
+type rdns struct {
+	capacity int
+	timeout  time.Duration // of a lookup
+	queue    chan string
+	limit    <-chan time.Time
+
+	mu      sync.Mutex
+	names   map[string]rdnsEntry // by IP
+	waiting map[string]bool      // queued or being looked up
+	purged  time.Time
+
+	resolved, failed, dropped uint64
+}
+
+// newRDNS starts resolving up to rate IPs per second, caching at most
+// capacity of them, giving up on lookups after timeout.
+func newRDNS(rate float64, capacity int, timeout time.Duration) *rdns {
+	every := time.Duration(float64(time.Second) / rate)
+	if every <= 0 {
+		every = time.Nanosecond
+	}
+	r := &rdns{
+		capacity: capacity,
+		timeout:  timeout,
+		queue:    make(chan string, rdnsQueue),
+		limit:    time.Tick(every),
+		names:    make(map[string]rdnsEntry),
+		waiting:  make(map[string]bool),
+	}
+	for i := 0; i < rdnsWorkers; i++ {
+		go r.work()
+	}
+	return r
+}
+
+// observe queues the IP of endpoint for a lookup, unless its hostname is
+// cached, it is being looked up already or the cache is full.
+func (r *rdns) observe(endpoint string) {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		host = endpoint
+	}
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.names[host]; ok && now.Before(e.expires) || r.waiting[host] {
+		return
+	}
+	if len(r.names) >= r.capacity && !r.purge(now) {
+		return
+	}
+	select {
+	case r.queue <- host:
+		r.waiting[host] = true
+	default:
+		r.dropped++
+	}
+}
+
+// purge forgets the expired entries of a full cache, reporting whether
+// there is room left. Full caches are purged at most once per negative TTL.
+func (r *rdns) purge(now time.Time) bool {
+	if now.Sub(r.purged) >= rdnsNegativeTTL {
+		r.purged = now
+		for ip, e := range r.names {
+			if now.After(e.expires) {
+				delete(r.names, ip)
+			}
+		}
+	}
+	return len(r.names) < r.capacity
+}
+
+func (r *rdns) work() {
+	for ip := range r.queue {
+		<-r.limit
+		ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+		names, err := net.DefaultResolver.LookupAddr(ctx, ip)
+		cancel()
+
+		e := rdnsEntry{expires: time.Now().Add(rdnsNegativeTTL)}
+		if err == nil && len(names) > 0 {
+			e = rdnsEntry{name: strings.TrimSuffix(names[0], "."), expires: time.Now().Add(rdnsTTL)}
+		}
+		r.mu.Lock()
+		r.names[ip] = e
+		delete(r.waiting, ip)
+		if e.name != "" {
+			r.resolved++
+		} else {
+			r.failed++
+		}
+		r.mu.Unlock()
+	}
+}
+
+// hostname returns the cached hostname of the IP of endpoint, empty if
+// unknown. Expired hostnames are still returned until looked up again.
+func (r *rdns) hostname(endpoint string) string {
+	host, _, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		host = endpoint
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.names[host].name
+}
+
+func (r *rdns) endpoint(e *tracker.Endpoint) {
+	e.Hostname = r.hostname(e.Addr)
+}
+
+// event adds the hostname of endpoint to a report event, if known.
+func (r *rdns) event(ev *zerolog.Event, endpoint string) *zerolog.Event {
+	if name := r.hostname(endpoint); name != "" {
+		ev = ev.Str("hostname", name)
+	}
+	return ev
+}
+
+// pending returns the number of IPs queued or being looked up.
+func (r *rdns) pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.waiting)
+}
+
+// domain approximates the domain a hostname was registered under by its
+// last two labels, which is enough to tell most hosting providers apart.
+func domain(name string) string {
+	labels := strings.Split(name, ".")
+	if len(labels) <= 2 {
+		return name
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+// report logs how many lookups succeeded, then the domains most IPs
+// resolved to.
+func (r *rdns) report() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.resolved == 0 && r.failed == 0 {
+		return
+	}
+	log.Info().
+		Uint64("resolved", r.resolved).
+		Uint64("failed", r.failed).
+		Uint64("dropped", r.dropped).
+		Int("pending", len(r.waiting)).
+		Int("cached", len(r.names)).
+		Msg("reverse dns")
+
+	domains := make(map[string]int)
+	for _, e := range r.names {
+		if e.name != "" {
+			domains[domain(e.name)]++
+		}
+	}
+	names := make([]string, 0, len(domains))
+	for d := range domains {
+		names = append(names, d)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if a, b := domains[names[i]], domains[names[j]]; a != b {
+			return a > b
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > 10 {
+		names = names[:10]
+	}
+	for i, d := range names {
+		log.Info().
+			Int("rank", i+1).
+			Str("domain", d).
+			Int("ips", domains[d]).
+			Msg("reverse dns domain")
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/google/gopacket"
+	"time"
+)
+
+// replayLag is how late a packet may be handed over before pacing starts
+// over from it, as after the capture was paused, rather than rushing
+// through the packets that fell behind.
+const replayLag = time.Second
+
+// pace hands over the packets of a capture file as they were captured:
+// each one once the time since the first packet, divided by speed, passed
+// since the first was handed over. The returned channel is closed along
+// with in.
+func pace(in <-chan gopacket.Packet, speed float64) <-chan gopacket.Packet {
+	out := make(chan gopacket.Packet)
+	go func() {
+		defer close(out)
+		var first, start time.Time
+		for p := range in {
+			ts := p.Metadata().Timestamp
+			if first.IsZero() {
+				first, start = ts, time.Now()
+			}
+			due := start.Add(time.Duration(float64(ts.Sub(first)) / speed))
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+			}
+			out <- p
+			if time.Since(due) > replayLag {
+				first, start = ts, time.Now()
+			}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/drgomesp/etherspy/pkg/report"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reports collects the lines analyzers log while reporting into a report
+// rendered to -report-out, nil if unset.
+var reports *reportCollector
+
+// reportEvent is a log line of a report, its fields in the order logged.
+type reportEvent struct {
+	message string
+	fields  []report.Field
+}
+
+// reportCollector turns the lines logged by a round of analyzer reports
+// into a report document: lines sharing a message, such as the ranks of
+// top talkers, become the rows of a table. Lines are seen as JSON, teed off
+// the console writer.
+type reportCollector struct {
+	path   string
+	source string
+
+	mu         sync.Mutex
+	collecting bool
+	events     []reportEvent
+}
+
+func newReportCollector(path, source string) *reportCollector {
+	return &reportCollector{path: path, source: source}
+}
+
+// logOutput returns the writer log lines go to: w, and the report being
+// collected with -report-out.
+func logOutput(w io.Writer) io.Writer {
+	if reports == nil {
+		return w
+	}
+	return zerolog.MultiLevelWriter(w, reports)
+}
+
+// Write keeps the log line p while a report is being collected.
+func (c *reportCollector) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.collecting {
+		return len(p), nil
+	}
+	if ev, ok := parseReportEvent(p); ok {
+		c.events = append(c.events, ev)
+	}
+	return len(p), nil
+}
+
+// parseReportEvent reads a JSON log line, keeping its fields in order.
+func parseReportEvent(p []byte) (reportEvent, bool) {
+	var ev reportEvent
+	dec := json.NewDecoder(bytes.NewReader(p))
+	dec.UseNumber()
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return ev, false
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return ev, false
+		}
+		key, _ := t.(string)
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return ev, false
+		}
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			value = string(raw)
+		}
+		switch key {
+		case zerolog.MessageFieldName:
+			ev.message = value
+		case zerolog.LevelFieldName, zerolog.TimestampFieldName:
+		default:
+			ev.fields = append(ev.fields, report.Field{Name: key, Value: value})
+		}
+	}
+	return ev, ev.message != ""
+}
+
+func (c *reportCollector) begin() {
+	c.mu.Lock()
+	c.collecting, c.events = true, nil
+	c.mu.Unlock()
+}
+
+// end stops collecting and writes the report of the lines collected.
+func (c *reportCollector) end(lastSeen time.Time) {
+	c.mu.Lock()
+	events := c.events
+	c.collecting, c.events = false, nil
+	c.mu.Unlock()
+
+	r := &report.Report{
+		Title:     "etherspy report",
+		Generated: time.Now(),
+		Meta:      []report.Field{{Name: "source", Value: c.source}},
+	}
+	if !lastSeen.IsZero() {
+		r.Meta = append(r.Meta, report.Field{Name: "last packet", Value: times.Format(lastSeen)})
+	}
+	r.Sections = reportSections(events)
+	if err := report.WriteFile(c.path, r); err != nil {
+		log.Warn().Err(err).Msg("could not write report")
+	}
+}
+
+// reportSections groups events by message, in the order messages first
+// appear. Lines without fields are notes of a closing section.
+func reportSections(events []reportEvent) []report.Section {
+	var (
+		sections []report.Section
+		index    = make(map[string]int)
+		notes    []string
+	)
+	for _, ev := range events {
+		if len(ev.fields) == 0 {
+			notes = append(notes, ev.message)
+			continue
+		}
+		i, ok := index[ev.message]
+		if !ok {
+			i = len(sections)
+			index[ev.message] = i
+			sections = append(sections, report.Section{Title: ev.message, Table: new(report.Table)})
+		}
+		addReportRow(sections[i].Table, ev.fields)
+	}
+	for i := range sections {
+		// A single line reads better as fields than as a table.
+		if t := sections[i].Table; len(t.Rows) == 1 {
+			for j, col := range t.Columns {
+				sections[i].Fields = append(sections[i].Fields, report.Field{Name: col, Value: t.Rows[0][j]})
+			}
+			sections[i].Table = nil
+		}
+	}
+	if len(notes) > 0 {
+		sections = append(sections, report.Section{Title: "notes", Notes: notes})
+	}
+	return sections
+}
+
+// addReportRow adds the fields of a line as a row of t, adding columns for
+// the fields earlier lines lacked.
+func addReportRow(t *report.Table, fields []report.Field) {
+	row := make([]string, len(t.Columns))
+	for _, f := range fields {
+		j := -1
+		for k, col := range t.Columns {
+			if col == f.Name {
+				j = k
+				break
+			}
+		}
+		if j < 0 {
+			t.Columns = append(t.Columns, f.Name)
+			for k := range t.Rows {
+				t.Rows[k] = append(t.Rows[k], "")
+			}
+			row = append(row, "")
+			j = len(t.Columns) - 1
+		}
+		row[j] = strings.TrimSpace(f.Value)
+	}
+	t.Rows = append(t.Rows, row)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// resolverMaxLearned bounds the endpoints learned from handshakes, later
+// ones are left out.
+const resolverMaxLearned = 1 << 16
+
+// resolution maps endpoints to node IDs with -enr-watch, -dest-id or
+// -learn-dest-ids, nil if none is set.
+var resolution *resolver
+
+// destIDList collects the values of the repeatable -dest-id flag.
+type destIDList []string
+
+func (l *destIDList) String() string { return strings.Join(*l, " ") }
+
+func (l *destIDList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// parseDestID parses a node ID given as hex, an enode URL or a record.
+func parseDestID(s string) (enode.ID, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "enode://") || strings.HasPrefix(s, "enr:") {
+		n, err := enode.Parse(enode.ValidSchemes, s)
+		if err != nil {
+			return enode.ID{}, err
+		}
+		return n.ID(), nil
+	}
+	var id enode.ID
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil || len(b) != len(id) {
+		return id, fmt.Errorf("invalid node ID %q, want %d hex bytes, an enode URL or a record", s, len(id))
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// resolver is a table of the node IDs listening on UDP endpoints. Headers
+// of discv5 packets are masked with the recipient's node ID, so knowing who
+// listens on the destination of a packet lets it be unmasked even when it
+// is not addressed to the local node. It is filled from the background, so
+// it is safe for concurrent use. Packets to endpoints it doesn't know are
+// unmasked with each of the candidate node IDs in turn.
+type resolver struct {
+	mu         sync.RWMutex
+	ids        map[string]enode.ID // by ip:port
+	learned    int
+	candidates []enode.ID
+}
+
+func newResolver(candidates []enode.ID) *resolver {
+	return &resolver{ids: make(map[string]enode.ID), candidates: candidates}
+}
+
+// add records that n listens on the UDP endpoint of its record, replacing
+// whatever node was known there. It reports whether the table changed.
+func (r *resolver) add(n *enode.Node) bool {
+	if n.IP() == nil || n.UDP() == 0 {
+		return false
+	}
+	endpoint := net.JoinHostPort(n.IP().String(), strconv.Itoa(n.UDP()))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id, ok := r.ids[endpoint]; ok && id == n.ID() {
+		return false
+	}
+	r.ids[endpoint] = n.ID()
+	return true
+}
+
+// learn records that the node id sent a handshake from endpoint, which is
+// where it listens unless it is behind a NAT that changes ports.
+func (r *resolver) learn(endpoint string, id enode.ID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if known, ok := r.ids[endpoint]; ok && known == id || r.learned >= resolverMaxLearned {
+		return
+	}
+	r.ids[endpoint] = id
+	r.learned++
+}
+
+// lookup returns the node ID listening on endpoint, an ip:port pair.
+func (r *resolver) lookup(endpoint string) (enode.ID, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	id, ok := r.ids[endpoint]
+	return id, ok
+}
+
+// destination returns the node ID the header of buf, a packet sent to
+// endpoint, is masked with: that of the node known there, or the first
+// candidate unmasking it.
+func (r *resolver) destination(endpoint string, buf []byte) (enode.ID, bool) {
+	if id, ok := r.lookup(endpoint); ok {
+		return id, true
+	}
+	for _, id := range r.candidates {
+		if discv5.Match(buf, id) {
+			return id, true
+		}
+	}
+	return enode.ID{}, false
+}
+
+func (r *resolver) len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.ids)
+}
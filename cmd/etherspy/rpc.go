@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/rs/zerolog/log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The RPC timeline is kept in rpcBuckets of rpcBucket each. A bucket is a
+// spike when it exceeds the mean of the buckets before it by spikeSigmas
+// standard deviations, given at least spikeHistory of them.
+const (
+	rpcBucket    = time.Minute
+	rpcBuckets   = 60
+	spikeSigmas  = 3
+	spikeHistory = 5
+)
+
+// rpcSlot is a bucket of the RPC timeline.
+type rpcSlot struct {
+	start                     time.Time
+	packets, bytes, conns     float64 // of RPC traffic
+	discovery, discoveryFails float64 // decoded and failed discovery packets
+}
+
+// rpcTimeline follows the JSON-RPC traffic of a node captured on its host,
+// as flow metadata only: packets, bytes and connections to the RPC ports,
+// whether TLS or not. It lines them up with the discovery traffic over time
+// and reports the RPC spikes coinciding with discovery anomalies, as when
+// heavy RPC use starves the node. Enabled with -rpc-ports.
+type rpcTimeline struct {
+	ports  map[uint16]bool
+	slots  []rpcSlot // oldest first
+	logged time.Time // start of the latest bucket reported
+}
+
+// newRPCTimeline follows the comma separated TCP ports.
+func newRPCTimeline(ports string) (*rpcTimeline, error) {
+	r := &rpcTimeline{ports: make(map[uint16]bool)}
+	for _, p := range strings.Split(ports, ",") {
+		n, err := strconv.ParseUint(strings.TrimSpace(p), 10, 16)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid RPC port %q", p)
+		}
+		r.ports[uint16(n)] = true
+	}
+	return r, nil
+}
+
+// filter returns the capture filter matching the RPC traffic.
+func (r *rpcTimeline) filter() string {
+	ports := make([]int, 0, len(r.ports))
+	for p := range r.ports {
+		ports = append(ports, int(p))
+	}
+	sort.Ints(ports)
+	terms := make([]string, len(ports))
+	for i, p := range ports {
+		terms[i] = "tcp port " + strconv.Itoa(p)
+	}
+	return strings.Join(terms, " or ")
+}
+
+// slot returns the bucket of t, starting new ones as time goes by.
+func (r *rpcTimeline) slot(t time.Time) *rpcSlot {
+	start := t.Truncate(rpcBucket)
+	if n := len(r.slots); n > 0 {
+		last := r.slots[n-1].start
+		if !start.After(last) {
+			// Late packets of a capture go to the latest bucket.
+			return &r.slots[n-1]
+		}
+		// Quiet buckets count as much as busy ones.
+		if start.Sub(last) > rpcBuckets*rpcBucket {
+			last = start.Add(-rpcBuckets * rpcBucket)
+		}
+		for b := last.Add(rpcBucket); b.Before(start); b = b.Add(rpcBucket) {
+			r.slots = append(r.slots, rpcSlot{start: b})
+		}
+	}
+	r.slots = append(r.slots, rpcSlot{start: start})
+	if len(r.slots) > rpcBuckets {
+		r.slots = r.slots[len(r.slots)-rpcBuckets:]
+	}
+	return &r.slots[len(r.slots)-1]
+}
+
+// observe accounts for packet if it is RPC traffic, reporting whether it
+// was.
+func (r *rpcTimeline) observe(packet gopacket.Packet) bool {
+	tcp, ok := packet.TransportLayer().(*layers.TCP)
+	if !ok || !r.ports[uint16(tcp.SrcPort)] && !r.ports[uint16(tcp.DstPort)] {
+		return false
+	}
+	md := packet.Metadata()
+	s := r.slot(md.Timestamp)
+	s.packets++
+	s.bytes += float64(md.Length)
+	if tcp.SYN && !tcp.ACK {
+		s.conns++
+	}
+	return true
+}
+
+// observeDiscovery accounts for a discovery packet, decoded or not.
+func (r *rpcTimeline) observeDiscovery(now time.Time, failed bool) {
+	s := r.slot(now)
+	if failed {
+		s.discoveryFails++
+	} else {
+		s.discovery++
+	}
+}
+
+// deviation returns how many standard deviations the value of slot i is
+// from the mean of the slots before it, 0 without enough history.
+func (r *rpcTimeline) deviation(i int, value func(*rpcSlot) float64) float64 {
+	if i < spikeHistory {
+		return 0
+	}
+	var sum, sq float64
+	for j := 0; j < i; j++ {
+		v := value(&r.slots[j])
+		sum += v
+		sq += v * v
+	}
+	mean := sum / float64(i)
+	std := math.Sqrt(sq/float64(i) - mean*mean)
+	if std == 0 {
+		// A flat history, any change stands out.
+		std = math.Max(mean, 1) / spikeSigmas
+	}
+	return (value(&r.slots[i]) - mean) / std
+}
+
+func rpcBytes(s *rpcSlot) float64       { return s.bytes }
+func rpcConns(s *rpcSlot) float64       { return s.conns }
+func discoveryRate(s *rpcSlot) float64  { return s.discovery }
+func discoveryFails(s *rpcSlot) float64 { return s.discoveryFails }
+
+// anomalous reports whether the discovery traffic of slot i spiked or
+// collapsed, or its failures spiked.
+func (r *rpcTimeline) anomalous(i int) bool {
+	return math.Abs(r.deviation(i, discoveryRate)) >= spikeSigmas || r.deviation(i, discoveryFails) >= spikeSigmas
+}
+
+// correlation returns the Pearson correlation of two series over the
+// complete buckets, 0 if either is flat.
+func (r *rpcTimeline) correlation(x, y func(*rpcSlot) float64) float64 {
+	n := len(r.slots) - 1
+	if n < 2 {
+		return 0
+	}
+	var sx, sy, sxx, syy, sxy float64
+	for i := 0; i < n; i++ {
+		a, b := x(&r.slots[i]), y(&r.slots[i])
+		sx, sy, sxx, syy, sxy = sx+a, sy+b, sxx+a*a, syy+b*b, sxy+a*b
+	}
+	cov := sxy - sx*sy/float64(n)
+	vx, vy := sxx-sx*sx/float64(n), syy-sy*sy/float64(n)
+	if vx <= 0 || vy <= 0 {
+		return 0
+	}
+	return cov / math.Sqrt(vx*vy)
+}
+
+// report logs the buckets completed since the last report, side by side
+// with the discovery traffic, warning about RPC spikes next to discovery
+// anomalies, then how both series correlate.
+func (r *rpcTimeline) report() {
+	// The latest bucket is still filling up.
+	for i := 0; i < len(r.slots)-1; i++ {
+		s := &r.slots[i]
+		if !s.start.After(r.logged) {
+			continue
+		}
+		r.logged = s.start
+		spike := r.deviation(i, rpcBytes) >= spikeSigmas || r.deviation(i, rpcConns) >= spikeSigmas
+		anomaly := r.anomalous(i) || i+1 < len(r.slots)-1 && r.anomalous(i+1) || i > 0 && r.anomalous(i-1)
+		ev := log.Info()
+		if spike && anomaly {
+			ev = log.Warn()
+		}
+		ev.Time("bucket", s.start).
+			Float64("rpc_packets", s.packets).
+			Float64("rpc_bytes", s.bytes).
+			Float64("rpc_conns", s.conns).
+			Float64("discovery", s.discovery).
+			Float64("discovery_fails", s.discoveryFails).
+			Bool("rpc_spike", spike).
+			Bool("discovery_anomaly", r.anomalous(i)).
+			Msg("rpc timeline")
+	}
+	if len(r.slots) > spikeHistory {
+		log.Info().
+			Float64("bytes_discovery", r.correlation(rpcBytes, discoveryRate)).
+			Float64("bytes_fails", r.correlation(rpcBytes, discoveryFails)).
+			Float64("conns_discovery", r.correlation(rpcConns, discoveryRate)).
+			Msg("rpc correlation")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/schema"
+	"io"
+	"os"
+	"strings"
+)
+
+// schemaCommand runs the schema command, publishing the JSON Schema
+// documents of the JSON outputs and validating output against them:
+//
+//	etherspy schema dump [name]              print one schema, or all keyed by name
+//	etherspy schema validate name [file...]  check JSON documents or lines, stdin without files
+func schemaCommand(args []string) error {
+	usage := fmt.Errorf("usage: etherspy schema dump [name] | validate name [file...], with name one of %s", strings.Join(schema.Names(), "|"))
+	if len(args) == 0 {
+		return usage
+	}
+	switch args[0] {
+	case "dump":
+		return dumpSchemas(args[1:])
+	case "validate":
+		if len(args) < 2 {
+			return usage
+		}
+		return validateFiles(args[1], args[2:])
+	default:
+		return usage
+	}
+}
+
+func dumpSchemas(names []string) error {
+	if len(names) == 1 {
+		data, err := schema.Get(names[0])
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if len(names) == 0 {
+		names = schema.Names()
+	}
+	all := make(map[string]json.RawMessage)
+	for _, name := range names {
+		data, err := schema.Get(name)
+		if err != nil {
+			return err
+		}
+		all[name] = data
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(all)
+}
+
+// validateFiles checks every JSON document in files, such as the lines of
+// the json output, against the named schema and reports the invalid ones.
+func validateFiles(name string, files []string) error {
+	if _, err := schema.Get(name); err != nil {
+		return err
+	}
+	var checked, invalid int
+	check := func(label string, r io.Reader) error {
+		d := json.NewDecoder(r)
+		for i := 1; ; i++ {
+			var doc json.RawMessage
+			if err := d.Decode(&doc); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("%s: document %d: %v", label, i, err)
+			}
+			checked++
+			if err := schema.Validate(name, doc); err != nil {
+				invalid++
+				fmt.Fprintf(os.Stderr, "%s: document %d: %v\n", label, i, err)
+			}
+		}
+	}
+
+	if len(files) == 0 {
+		if err := check("stdin", os.Stdin); err != nil {
+			return err
+		}
+	}
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = check(path, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d of %d documents do not match the %s schema", invalid, checked, name)
+	}
+	if checked == 0 {
+		return errors.New("no documents to validate")
+	}
+	fmt.Fprintf(os.Stderr, "%d documents match the %s schema\n", checked, name)
+	return nil
+}
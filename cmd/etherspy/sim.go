@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// simEvent is a datagram of a simulator trace, one JSON object per line:
+//
+//	{"time":"2023-11-14T22:13:22.01Z","from":"10.0.0.1:30303","to":"10.0.0.2:30303","data":"0x..."}
+//
+// time is RFC 3339, or nanoseconds of simulated time as a number, and data
+// the UDP payload in hex. The events of go-ethereum's p2p simulations carry
+// no payloads, so simulated nodes are expected to log their datagrams this
+// way, as a wrapper of their UDP connection can.
+type simEvent struct {
+	Time json.RawMessage `json:"time"`
+	From string          `json:"from"`
+	To   string          `json:"to"`
+	Data string          `json:"data"`
+}
+
+// Simulated frames get these locally administered MAC addresses.
+var (
+	simSrcMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	simDstMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+)
+
+// simSource reads a simulator trace, as UDP datagrams in Ethernet frames so
+// they go through the same filters and decoding as captured ones.
+type simSource struct {
+	f      *os.File
+	lines  *bufio.Scanner
+	line   int
+	filter matcher
+	buf    gopacket.SerializeBuffer
+}
+
+// isSimTrace tells whether the file at path is a simulator trace rather
+// than a capture file, by its first character.
+func isSimTrace(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	var b [1]byte
+	for {
+		if _, err := f.Read(b[:]); err != nil {
+			return false
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b[0] == '{'
+	}
+}
+
+// openInput opens a capture file, or a simulator trace.
+func openInput(path string) (*capture, error) {
+	if !isSimTrace(path) {
+		return openFile(path)
+	}
+	log.Info().Msgf("%q is a simulator trace", path)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &simSource{f: f, lines: bufio.NewScanner(f), buf: gopacket.NewSerializeBuffer()}
+	s.lines.Buffer(nil, 1<<20)
+	return &capture{sources: []source{s}}, nil
+}
+
+func (s *simSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for s.lines.Scan() {
+		s.line++
+		line := strings.TrimSpace(s.lines.Text())
+		if line == "" {
+			continue
+		}
+		frame, ci, err := s.frame(line)
+		if err != nil {
+			log.Warn().Err(err).Int("line", s.line).Msg("invalid simulator event")
+			continue
+		}
+		if s.filter != nil && !s.filter.Matches(ci, frame) {
+			continue
+		}
+		return frame, ci, nil
+	}
+	if err := s.lines.Err(); err != nil {
+		log.Error().Err(err).Int("line", s.line).Msg("reading simulator trace")
+		return nil, gopacket.CaptureInfo{}, io.ErrUnexpectedEOF
+	}
+	return nil, gopacket.CaptureInfo{}, io.EOF
+}
+
+// frame builds the Ethernet frame of an event.
+func (s *simSource) frame(line string) ([]byte, gopacket.CaptureInfo, error) {
+	var ev simEvent
+	if err := json.Unmarshal([]byte(line), &ev); err != nil {
+		return nil, gopacket.CaptureInfo{}, err
+	}
+	t, err := simTime(ev.Time)
+	if err != nil {
+		return nil, gopacket.CaptureInfo{}, err
+	}
+	src, err := netip.ParseAddrPort(ev.From)
+	if err != nil {
+		return nil, gopacket.CaptureInfo{}, fmt.Errorf("from: %v", err)
+	}
+	dst, err := netip.ParseAddrPort(ev.To)
+	if err != nil {
+		return nil, gopacket.CaptureInfo{}, fmt.Errorf("to: %v", err)
+	}
+	payload, err := hex.DecodeString(strings.TrimPrefix(ev.Data, "0x"))
+	if err != nil {
+		return nil, gopacket.CaptureInfo{}, fmt.Errorf("data: %v", err)
+	}
+
+	eth := &layers.Ethernet{SrcMAC: simSrcMAC, DstMAC: simDstMAC}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(src.Port()), DstPort: layers.UDPPort(dst.Port())}
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+	var ip gopacket.SerializableLayer
+	switch {
+	case srcIP.Is4() && dstIP.Is4():
+		eth.EthernetType = layers.EthernetTypeIPv4
+		ip4 := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: srcIP.AsSlice(), DstIP: dstIP.AsSlice()}
+		udp.SetNetworkLayerForChecksum(ip4)
+		ip = ip4
+	case srcIP.Is6() && dstIP.Is6():
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: srcIP.AsSlice(), DstIP: dstIP.AsSlice()}
+		udp.SetNetworkLayerForChecksum(ip6)
+		ip = ip6
+	default:
+		return nil, gopacket.CaptureInfo{}, fmt.Errorf("mixed address families %s and %s", ev.From, ev.To)
+	}
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(s.buf, opts, eth, ip, udp, gopacket.Payload(payload)); err != nil {
+		return nil, gopacket.CaptureInfo{}, err
+	}
+	// Frames outlive the next read, as those of capture files do.
+	frame := append([]byte(nil), s.buf.Bytes()...)
+	return frame, gopacket.CaptureInfo{Timestamp: t, CaptureLength: len(frame), Length: len(frame)}, nil
+}
+
+// simTime parses the time of an event, RFC 3339 or nanoseconds.
+func simTime(raw json.RawMessage) (time.Time, error) {
+	if len(raw) == 0 {
+		return time.Time{}, fmt.Errorf("missing time")
+	}
+	if raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return time.Time{}, err
+		}
+		return time.Parse(time.RFC3339Nano, s)
+	}
+	ns, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("time: %v", err)
+	}
+	return time.Unix(0, ns).UTC(), nil
+}
+
+func (s *simSource) LinkType() layers.LinkType { return layers.LinkTypeEthernet }
+
+func (s *simSource) SnapLen() int { return 65535 }
+
+func (s *simSource) SetBPFFilter(expr string) error {
+	filter, err := newMatcher(s.LinkType(), s.SnapLen(), expr)
+	if err != nil {
+		return err
+	}
+	s.filter = filter
+	return nil
+}
+
+func (s *simSource) Close() { s.f.Close() }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"flag"
+	"github.com/drgomesp/etherspy/pkg/bufpool"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/drgomesp/etherspy/pkg/etherspy"
+	"github.com/drgomesp/etherspy/pkg/snapshot"
+	"github.com/drgomesp/etherspy/pkg/stats"
+	"github.com/drgomesp/etherspy/pkg/tracker"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "Rewrite the golden files of the tests")
+
+// golden compares data with the golden file name of testdata, rewriting it
+// instead with -update.
+func golden(t *testing.T, name string, data []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := snapshot.Diff(want, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range changes {
+		t.Errorf("%s differs: %s", name, c)
+	}
+}
+
+var (
+	testKeyA, _ = crypto.HexToECDSA("49a7b37aa6f6645917e7b807e9d1c00d4fa71f18343b0d4122a4d2df64dd6fee")
+	testKeyB, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+)
+
+// testCapture feeds packets to the capture loop.
+type testCapture struct {
+	t    *testing.T
+	loop *captureLoop
+	time time.Time
+}
+
+// newTestCapture returns a capture feeding the analyzers a, on the default
+// network, from time on.
+func newTestCapture(t *testing.T, a *analyzers, at time.Time) *testCapture {
+	if _, err := setupNetworks(nil, "udp", func() *breakers { return newBreakers(10, 0.5, false) }); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { networks = nil })
+	loop := &captureLoop{
+		analysis: a,
+		local:    newIdentity(""),
+		decoder:  &etherspy.Decoder{Sessions: discv5.NewSessionStore()},
+		payloads: bufpool.New(bufpool.DefaultSize),
+	}
+	return &testCapture{t: t, loop: loop, time: at}
+}
+
+// send sends data from src to dst a second after the previous packet.
+func (c *testCapture) send(src, dst string, data []byte) {
+	c.t.Helper()
+	c.time = c.time.Add(time.Second)
+	c.loop.packet(udpPacket(c.t, c.time, src, dst, data), time.Now())
+}
+
+// sendV4 sends body, signed by the node of key, from src to dst and returns
+// its hash.
+func (c *testCapture) sendV4(key *ecdsa.PrivateKey, src, dst string, body discv4.Body) []byte {
+	c.t.Helper()
+	data, hash, err := discv4.Encode(key, body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.send(src, dst, data)
+	return hash
+}
+
+// udpPacket wraps data in the IPv4 and UDP headers of a packet from src to
+// dst, captured at t.
+func udpPacket(t *testing.T, at time.Time, src, dst string, data []byte) gopacket.Packet {
+	t.Helper()
+	addr := func(s string) (net.IP, layers.UDPPort) {
+		host, port, err := net.SplitHostPort(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, _ := strconv.Atoi(port)
+		return net.ParseIP(host).To4(), layers.UDPPort(p)
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP}
+	udp := &layers.UDP{}
+	ip.SrcIP, udp.SrcPort = addr(src)
+	ip.DstIP, udp.DstPort = addr(dst)
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload(data)); err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	packet.Metadata().Timestamp = at
+	return packet
+}
+
+// snapshotOf runs a small capture between two nodes and returns the
+// canonical snapshot of the state it yields, with seen as the node IDs of
+// -seen-db.
+func snapshotOf(t *testing.T, seen *stats.Bloom) []byte {
+	*cardinality, *topTalkers, *tailStats = true, 2, true
+	nodes = tracker.New(16)
+	defer func() {
+		*cardinality, *topTalkers, *tailStats = false, 0, false
+		nodes = nil
+	}()
+	a, err := newAnalyzers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.seen = seen
+
+	const addrA, addrB = "10.0.0.1:30303", "10.0.0.2:30303"
+	c := newTestCapture(t, a, time.Date(2023, 11, 14, 22, 0, 0, 0, time.UTC))
+	expiration := uint64(c.time.Add(time.Minute).Unix())
+	ping := c.sendV4(testKeyA, addrA, addrB, &discv4.Ping{
+		Version:    4,
+		From:       discv4.Endpoint{IP: net.IPv4(10, 0, 0, 1).To4(), UDP: 30303, TCP: 30303},
+		To:         discv4.Endpoint{IP: net.IPv4(10, 0, 0, 2).To4(), UDP: 30303},
+		Expiration: expiration,
+		Rest:       []rlp.RawValue{{0x05}},
+	})
+	c.sendV4(testKeyB, addrB, addrA, &discv4.Pong{To: discv4.Endpoint{IP: net.IPv4(10, 0, 0, 1).To4(), UDP: 30303}, ReplyTok: ping, Expiration: expiration})
+	request := c.sendV4(testKeyA, addrA, addrB, &discv4.ENRRequest{Expiration: expiration})
+	var record enr.Record
+	record.SetSeq(3)
+	record.Set(enr.IPv4(net.IPv4(10, 0, 0, 2)))
+	record.Set(enr.UDP(30303))
+	if err := enode.SignV4(&record, testKeyB); err != nil {
+		t.Fatal(err)
+	}
+	c.sendV4(testKeyB, addrB, addrA, &discv4.ENRResponse{ReplyTok: request, Record: record})
+	c.sendV4(testKeyA, addrA, addrB, &discv4.FindNode{Expiration: expiration})
+	// Neither discv4 nor, to an unknown destination, discv5.
+	c.send(addrB, addrA, make([]byte, 63))
+
+	data, err := snapshot.Canonical(a.snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSnapshotGolden(t *testing.T) {
+	golden(t, "snapshot.json", snapshotOf(t, nil))
+}
+
+// TestSnapshotPersisted checks the node IDs seen by previous runs, loaded
+// with -seen-db, don't change the snapshot.
+func TestSnapshotPersisted(t *testing.T) {
+	seen := stats.NewBloom(1000, 0.01)
+	for i := 0; i < 100; i++ {
+		seen.Add([]byte{byte(i)})
+	}
+	if got, want := snapshotOf(t, seen), snapshotOf(t, nil); !bytes.Equal(got, want) {
+		t.Errorf("snapshot with seen node IDs differs:\n%s\nwant\n%s", got, want)
+	}
+}
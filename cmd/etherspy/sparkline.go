@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/stats"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sparklines are sparkColumns buckets wide and redrawn every sparkRefresh.
+const (
+	sparkColumns = 60
+	sparkRefresh = time.Second
+)
+
+// sparkBars are the heights of a bucket, from empty to the busiest of its
+// row.
+var sparkBars = []rune(" ▁▂▃▄▅▆▇█")
+
+// sparklines draws a line per protocol with its decoded packets per second
+// over a recent span, redrawn in place at the bottom of the log, from the
+// series of the analyzers. Enabled with -sparkline.
+type sparklines struct {
+	series *stats.Series
+	span   time.Duration
+	bucket time.Duration
+
+	mu    sync.Mutex
+	out   io.Writer
+	drawn int // lines drawn below the log, to be erased
+}
+
+func newSparklines(series *stats.Series, span time.Duration, out io.Writer) *sparklines {
+	// Bars are whole buckets of the series.
+	bucket := (span / sparkColumns).Truncate(time.Second)
+	if bucket < time.Second {
+		bucket = time.Second
+	}
+	return &sparklines{
+		series: series,
+		span:   span,
+		bucket: bucket,
+		out:    out,
+	}
+}
+
+// Write writes log lines above the sparklines, which are erased until the
+// next draw.
+func (s *sparklines) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.erase()
+	return s.out.Write(p)
+}
+
+func (s *sparklines) erase() {
+	if s.drawn > 0 {
+		// Move to the first line drawn and clear to the end of the screen.
+		fmt.Fprintf(s.out, "\x1b[%dF\x1b[J", s.drawn)
+		s.drawn = 0
+	}
+}
+
+// draw redraws the sparklines as of now.
+func (s *sparklines) draw(now time.Time) {
+	protocols := s.series.Keys(seriesDecoded)
+	var b strings.Builder
+	fmt.Fprintf(&b, "packets/s over %s, %s per bar\n", s.span, s.bucket)
+	for _, key := range protocols {
+		p := strings.TrimPrefix(key, seriesDecoded)
+		buckets := s.series.Buckets(key, now, s.bucket, sparkColumns)
+		var peak float64
+		for _, v := range buckets {
+			if v > peak {
+				peak = v
+			}
+		}
+		line := make([]rune, len(buckets))
+		for i, v := range buckets {
+			level := 0
+			if peak > 0 {
+				level = int(v / peak * float64(len(sparkBars)-1))
+				if level == 0 && v > 0 {
+					level = 1
+				}
+			}
+			line[i] = sparkBars[level]
+		}
+		// The last bucket is still filling up, the rate is that of the one
+		// before.
+		rate := buckets[len(buckets)-2] / s.bucket.Seconds()
+		fmt.Fprintf(&b, "%-8s %s %8.1f/s peak %.1f/s\n", p, string(line), rate, peak/s.bucket.Seconds())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.erase()
+	io.WriteString(s.out, b.String())
+	s.drawn = len(protocols) + 1
+}
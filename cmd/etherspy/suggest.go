@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/rs/zerolog/log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A node is suggested once known for suggestMinAge and seen within
+// suggestFresh, having answered at least suggestMinAnswered of the pings
+// captured to it. Calls to geth are given gethTimeout.
+const (
+	suggestMinAge      = 5 * time.Minute
+	suggestFresh       = 10 * time.Minute
+	suggestMinAnswered = 0.9
+	gethTimeout        = 5 * time.Second
+)
+
+// peerSuggestion is a node worth peering with.
+type peerSuggestion struct {
+	URL      string        `json:"enode"`
+	Client   string        `json:"client,omitempty"`
+	RTT      time.Duration `json:"rtt_ns"`
+	Answered float64       `json:"answered"` // share of pings answered
+	Known    time.Duration `json:"known_ns"` // since first seen
+}
+
+// suggestions ranks the execution clients observed by how good a peer they
+// would make and keeps a list of the best ones, ready for admin_addPeer: the
+// nodes known for a while and still around, with a signed record giving a
+// public TCP endpoint, that answer pings reliably and never sent FINDNODE
+// without an endpoint proof nor suspicious NEIGHBORS, lowest round-trip
+// time first. The list is written to a file, as a JSON array like geth's
+// static-nodes.json if it ends in .json and one URL per line otherwise,
+// and new suggestions can be added to a geth node directly. Enabled with
+// -suggest-peers or -suggest-geth, which track nodes and endpoint proofs.
+type suggestions struct {
+	count int
+	out   string
+	geth  string // HTTP URL or IPC socket path of geth's admin API
+
+	added  map[string]bool // URLs added to geth
+	latest []peerSuggestion
+}
+
+func newSuggestions(count int, out, geth string) *suggestions {
+	return &suggestions{count: count, out: out, geth: geth, added: make(map[string]bool)}
+}
+
+// rank returns the best peers among the nodes seen by now.
+func (s *suggestions) rank(now time.Time, proofs *endpointProofs, lookups *lookups) []peerSuggestion {
+	var peers []peerSuggestion
+	for _, n := range nodes.Nodes(0) {
+		if now.Sub(n.LastSeen) > suggestFresh {
+			// Nodes are sorted by last seen, the rest is gone.
+			break
+		}
+		if n.Record == "" || n.LastSeen.Sub(n.FirstSeen) < suggestMinAge {
+			continue
+		}
+		node, err := enode.Parse(enode.ValidSchemes, n.Record)
+		if err != nil || !peerable(node) {
+			continue
+		}
+		addr := net.JoinHostPort(node.IP().String(), strconv.Itoa(node.UDP()))
+		e := proofs.endpoints[addr]
+		if e == nil || e.completed == 0 || e.unprovenFindNodes > 0 {
+			continue
+		}
+		answered := float64(e.completed) / float64(e.completed+e.unanswered)
+		if answered < suggestMinAnswered {
+			continue
+		}
+		if lookups != nil {
+			if r := lookups.responders[addr]; r != nil && r.suspicious > 0 {
+				continue
+			}
+		}
+		peers = append(peers, peerSuggestion{
+			URL:      node.URLv4(),
+			Client:   n.Client,
+			RTT:      e.rtt,
+			Answered: answered,
+			Known:    n.LastSeen.Sub(n.FirstSeen),
+		})
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if peers[i].RTT != peers[j].RTT {
+			return peers[i].RTT < peers[j].RTT
+		}
+		return peers[i].Known > peers[j].Known
+	})
+	if len(peers) > s.count {
+		peers = peers[:s.count]
+	}
+	return peers
+}
+
+// peerable reports whether a node can be dialed as an execution client: its
+// record has an eth entry and a public IP with a TCP port.
+func peerable(n *enode.Node) bool {
+	var entry rlp.RawValue
+	if n.Load(enr.WithEntry("eth", &entry)) != nil {
+		return false
+	}
+	ip := n.IP()
+	return ip != nil && ip.IsGlobalUnicast() && !ip.IsPrivate() && n.TCP() != 0
+}
+
+// update ranks the peers anew, writes them out and adds the new ones to
+// geth.
+func (s *suggestions) update(now time.Time, proofs *endpointProofs, lookups *lookups) {
+	s.latest = s.rank(now, proofs, lookups)
+	if s.out != "" {
+		if err := s.save(s.out); err != nil {
+			log.Warn().Err(err).Msg("could not write peer suggestions")
+		}
+	}
+	var added int
+	if s.geth != "" {
+		for _, p := range s.latest {
+			if s.added[p.URL] {
+				continue
+			}
+			if err := gethAddPeer(s.geth, p.URL); err != nil {
+				log.Warn().Err(err).Str("enode", p.URL).Msg("could not add peer to geth")
+				break
+			}
+			s.added[p.URL] = true
+			added++
+		}
+	}
+	log.Info().
+		Int("suggested", len(s.latest)).
+		Int("added", added).
+		Int("added_total", len(s.added)).
+		Msg("peer suggestions")
+	for i, p := range s.latest {
+		log.Debug().
+			Int("rank", i+1).
+			Str("enode", p.URL).
+			Str("client", p.Client).
+			Dur("rtt", p.RTT).
+			Float64("answered", p.Answered).
+			Dur("known", p.Known).
+			Msg("peer suggestion")
+	}
+}
+
+func (s *suggestions) save(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	urls := make([]string, len(s.latest))
+	for i, p := range s.latest {
+		urls[i] = p.URL
+	}
+	if strings.HasSuffix(path, ".json") {
+		enc := json.NewEncoder(tmp)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(urls)
+	} else {
+		for _, u := range urls {
+			if _, err = fmt.Fprintln(tmp, u); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// gethAddPeer calls admin_addPeer on the geth node at endpoint, an HTTP URL
+// or the path of its IPC socket.
+func gethAddPeer(endpoint, url string) error {
+	req, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  "admin_addPeer",
+		"params":  []string{url},
+	})
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Result bool `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if strings.HasPrefix(endpoint, "http://") || strings.HasPrefix(endpoint, "https://") {
+		client := http.Client{Timeout: gethTimeout}
+		r, err := client.Post(endpoint, "application/json", bytes.NewReader(req))
+		if err != nil {
+			return err
+		}
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+			return fmt.Errorf("%s: %v", r.Status, err)
+		}
+	} else {
+		conn, err := net.DialTimeout("unix", endpoint, gethTimeout)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(gethTimeout))
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+			return err
+		}
+	}
+	switch {
+	case resp.Error != nil:
+		return fmt.Errorf("admin_addPeer: %s", resp.Error.Message)
+	case !resp.Result:
+		return fmt.Errorf("admin_addPeer refused %s", url)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/hex"
+	"github.com/drgomesp/etherspy/pkg/stats"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/rs/zerolog/log"
+	"sort"
+)
+
+// Bounds of the tail accounting.
+const (
+	tailSamples     = 5  // distinct samples kept per packet kind
+	tailSampleBytes = 64 // samples are truncated to this many bytes
+	tailPeers       = 1000
+)
+
+// tailKind accounts for the non-empty RLP tails of one packet kind.
+type tailKind struct {
+	Packets  uint64   `json:"packets"`
+	Bytes    uint64   `json:"bytes"`
+	MaxBytes int      `json:"max_bytes"`
+	Samples  []string `json:"samples"`
+}
+
+// tails accounts for packets carrying unknown trailing RLP fields, which
+// reveal protocol extensions and client experiments in the wild.
+type tails struct {
+	kinds map[string]*tailKind
+	peers *stats.TopK
+}
+
+func newTails() *tails {
+	return &tails{kinds: make(map[string]*tailKind), peers: stats.NewTopK(tailPeers)}
+}
+
+// observe accounts for the tail of a packet of the given kind sent by peer.
+func (t *tails) observe(kind, peer string, rest []rlp.RawValue) {
+	if len(rest) == 0 {
+		return
+	}
+	var raw []byte
+	for _, v := range rest {
+		raw = append(raw, v...)
+	}
+
+	k := t.kinds[kind]
+	if k == nil {
+		k = new(tailKind)
+		t.kinds[kind] = k
+	}
+	k.Packets++
+	k.Bytes += uint64(len(raw))
+	if len(raw) > k.MaxBytes {
+		k.MaxBytes = len(raw)
+	}
+	if len(k.Samples) < tailSamples {
+		if len(raw) > tailSampleBytes {
+			raw = raw[:tailSampleBytes]
+		}
+		sample := hex.EncodeToString(raw)
+		if !contains(k.Samples, sample) {
+			k.Samples = append(k.Samples, sample)
+		}
+	}
+	t.peers.Add(peer, 1)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *tails) report() {
+	names := make([]string, 0, len(t.kinds))
+	for name := range t.kinds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		k := t.kinds[name]
+		log.Info().
+			Str("kind", name).
+			Uint64("packets", k.Packets).
+			Uint64("bytes", k.Bytes).
+			Int("max_bytes", k.MaxBytes).
+			Strs("samples", k.Samples).
+			Msg("rlp tails")
+	}
+	for i, h := range t.peers.Top(10) {
+		enrichEvent(log.Info().Int("rank", i+1).Str("peer", h.Key), h.Key).
+			Uint64("packets", h.Count).
+			Msg("rlp tail sender")
+	}
+}
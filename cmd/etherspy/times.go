@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/sink"
+	"github.com/google/gopacket"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"time"
+)
+
+// Timestamp sources.
+const (
+	timeSourcePcap = "pcap" // as stamped by the capture
+	timeSourceWall = "wall" // as read by etherspy
+)
+
+// times renders every time printed, set up by setupTimes.
+var times sink.TimeFormat
+
+// wallClock is whether packets are stamped with the time they are read
+// rather than the capture's timestamps.
+var wallClock bool
+
+// setupTimes applies the timestamp source, format and zone to packets and
+// to the log.
+func setupTimes(source, style, zone string) error {
+	switch source {
+	case timeSourcePcap, timeSourceWall:
+		wallClock = source == timeSourceWall
+	default:
+		return fmt.Errorf("unknown timestamp source %q, want %s|%s", source, timeSourcePcap, timeSourceWall)
+	}
+	f, err := sink.ParseTimeFormat(style, zone)
+	if err != nil {
+		return err
+	}
+	times = f
+
+	// Log lines are stamped in the same format and zone as packets, so
+	// both line up.
+	zerolog.TimeFieldFormat = time.RFC3339Nano
+	log.Logger = log.Output(logOutput(consoleWriter(os.Stderr)))
+	return nil
+}
+
+// consoleWriter writes log lines to out, stamped as packets are.
+func consoleWriter(out io.Writer) zerolog.ConsoleWriter {
+	return zerolog.ConsoleWriter{Out: out, FormatTimestamp: func(i interface{}) string {
+		s, ok := i.(string)
+		if !ok {
+			return fmt.Sprint(i)
+		}
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return s
+		}
+		return times.Format(t)
+	}}
+}
+
+// packetTime returns the time packet is stamped with.
+func packetTime(packet gopacket.Packet) time.Time {
+	if wallClock {
+		return time.Now()
+	}
+	return packet.Metadata().Timestamp
+}
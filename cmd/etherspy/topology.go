@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/drgomesp/etherspy/pkg/topology"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+)
+
+// topologyGraph collects who pings and pongs whom and who returns whom in
+// NEIGHBORS and NODES, and exports the graph to PREFIX.dot and PREFIX.gexf
+// every minute and at the end of the capture. Enabled with -topology.
+type topologyGraph struct {
+	graph  *topology.Graph
+	prefix string
+}
+
+func newTopologyGraph(prefix string, maxEdges int) *topologyGraph {
+	return &topologyGraph{graph: topology.New(maxEdges), prefix: prefix}
+}
+
+// observeV4 accounts for a discv4 packet sent by the node id.
+func (t *topologyGraph) observeV4(rec *record, id enode.ID, pkt *discv4.Packet) {
+	from := id.String()
+	t.graph.Locate(from, rec.Src)
+	switch pkt.Kind {
+	case discv4.PacketPing:
+		t.graph.Add(from, rec.Dst, topology.EdgePing, rec.Time)
+	case discv4.PacketPong:
+		t.graph.Add(from, rec.Dst, topology.EdgePong, rec.Time)
+	case discv4.PacketNeighbors:
+		body, err := pkt.Body()
+		if err != nil {
+			return
+		}
+		for _, n := range body.(*discv4.Neighbors).Nodes {
+			t.graph.Add(from, v4ID(n.ID).String(), topology.EdgeListed, rec.Time)
+		}
+	}
+}
+
+// observeV5 accounts for a discv5 packet sent to the node dest, nil if
+// unknown.
+func (t *topologyGraph) observeV5(rec *record, p discv5.Packet, dest *enode.ID) {
+	id, ok := discv5.SrcID(p)
+	if !ok {
+		return
+	}
+	from, to := id.String(), rec.Dst
+	if dest != nil {
+		to = dest.String()
+	}
+	t.graph.Locate(from, rec.Src)
+
+	var body discv5.Packet
+	switch p := p.(type) {
+	case *discv5.Handshake:
+		body = p.Body
+	case *discv5.Message:
+		body = p.Body
+	}
+	switch b := body.(type) {
+	case *discv5.Ping:
+		t.graph.Add(from, to, topology.EdgePing, rec.Time)
+	case *discv5.Pong:
+		t.graph.Add(from, to, topology.EdgePong, rec.Time)
+	case *discv5.Nodes:
+		for _, r := range b.Nodes {
+			if node, err := enode.New(enode.ValidSchemes, r); err == nil {
+				t.graph.Add(from, node.ID().String(), topology.EdgeListed, rec.Time)
+			}
+		}
+	}
+}
+
+// report exports the graph.
+func (t *topologyGraph) report() {
+	if err := writeGraph(t.prefix+".dot", t.graph.WriteDOT); err != nil {
+		log.Error().Err(err).Msg("exporting topology")
+	}
+	if err := writeGraph(t.prefix+".gexf", t.graph.WriteGEXF); err != nil {
+		log.Error().Err(err).Msg("exporting topology")
+	}
+	if dropped := t.graph.Dropped(); dropped > 0 {
+		log.Warn().Uint64("dropped", dropped).Msg("topology graph full, edges left out")
+	}
+}
+
+// writeGraph writes a graph export to a temporary file renamed to path,
+// so readers never see it half written.
+func writeGraph(path string, write func(io.Writer) error) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if err := write(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
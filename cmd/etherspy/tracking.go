@@ -0,0 +1,172 @@
+package main
+
+import (
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/drgomesp/etherspy/pkg/tracker"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"time"
+)
+
+// nodes is the table of observed nodes kept with -track-nodes, nil if
+// unset.
+var nodes *tracker.Tracker
+
+// enrTimeout is how long an ENRRequest waits for its answer. It is far more
+// lenient than clients are, as captures may delay packets.
+const enrTimeout = 5 * time.Second
+
+// enrRequest is an ENRRequest awaiting its response.
+type enrRequest struct {
+	time       time.Time
+	from, to   string
+	expiration uint64
+}
+
+// enrRequests holds the ENRRequests seen by hash, which responses echo.
+var enrRequests = make(map[string]enrRequest)
+
+// enrResponses counts ENRResponses by how they were correlated.
+var enrResponses = make(map[string]uint64)
+
+// enrExpired is when unanswered requests were last expired.
+var enrExpired time.Time
+
+// trackV4 feeds a discv4 packet into the node table.
+func trackV4(rec *record, pkt *discv4.Packet, ip *tracker.IPHeader) {
+	sender, err := pkt.Sender.NodeID()
+	if err != nil {
+		return
+	}
+	id := enode.ID(crypto.Keccak256Hash(sender[:]))
+	nodes.Observe(id, tracker.Observation{Time: rec.Time, Protocol: "discv4", Kind: pkt.Kind.String(), Src: rec.Src, IP: ip})
+
+	switch pkt.Kind {
+	case discv4.PacketPing, discv4.PacketENRRequest, discv4.PacketENRResponse:
+	default:
+		return
+	}
+	body, err := pkt.Body()
+	if err != nil {
+		return
+	}
+	switch b := body.(type) {
+	case *discv4.Ping:
+		nodes.ObserveEndpoint(id, rec.Time, b.From.IP, b.From.UDP)
+	case *discv4.ENRRequest:
+		expireENRRequests(rec.Time)
+		enrRequests[string(pkt.Hash)] = enrRequest{time: rec.Time, from: rec.Src, to: rec.Dst, expiration: b.Expiration}
+	case *discv4.ENRResponse:
+		trackENRResponse(rec, id, b)
+	}
+}
+
+// trackENRResponse caches the record of an ENRResponse once it is found to
+// answer a pending request of the node it was sent to, in time, with the
+// responder's own record.
+func trackENRResponse(rec *record, sender enode.ID, b *discv4.ENRResponse) {
+	req, ok := enrRequests[string(b.ReplyTok)]
+	outcome := "cached"
+	switch {
+	case !ok:
+		outcome = "unsolicited"
+	case req.from != rec.Dst || req.to != rec.Src:
+		outcome = "misdirected"
+	case rec.Time.Sub(req.time) > enrTimeout || uint64(rec.Time.Unix()) > req.expiration:
+		outcome = "stale"
+	}
+	var n *enode.Node
+	if outcome == "cached" {
+		var err error
+		if n, err = enode.New(enode.ValidSchemes, &b.Record); err != nil || n.ID() != sender {
+			outcome = "foreign"
+		}
+	}
+	enrResponses[outcome]++
+	if outcome != "cached" {
+		log.Debug().Str("src", rec.Src).Msgf("ENRResponse not cached: %s", outcome)
+		return
+	}
+	delete(enrRequests, string(b.ReplyTok))
+	nodes.ObserveRecord(n, recordClient(&b.Record), tracker.Provenance{
+		Time:        rec.Time,
+		Source:      "discv4/" + discv4.PacketENRResponse.String(),
+		From:        rec.Src,
+		RequestedBy: req.from,
+		Latency:     rec.Time.Sub(req.time),
+	})
+}
+
+// expireENRRequests forgets the requests left unanswered for too long, at
+// most once per timeout.
+func expireENRRequests(now time.Time) {
+	if now.Sub(enrExpired) < enrTimeout {
+		return
+	}
+	enrExpired = now
+	for hash, req := range enrRequests {
+		if now.Sub(req.time) > enrTimeout {
+			delete(enrRequests, hash)
+			enrResponses["unanswered"]++
+		}
+	}
+}
+
+// trackV5 feeds a discv5 packet into the node table, along with the records
+// it carries.
+func trackV5(rec *record, p discv5.Packet, ip *tracker.IPHeader) {
+	if id, ok := discv5.SrcID(p); ok {
+		nodes.Observe(id, tracker.Observation{Time: rec.Time, Protocol: "discv5", Kind: p.Name(), Src: rec.Src, IP: ip})
+	}
+
+	var body discv5.Packet
+	switch p := p.(type) {
+	case *discv5.Handshake:
+		trackRecord(rec, p.Name(), p.Record)
+		body = p.Body
+	case *discv5.Message:
+		body = p.Body
+	}
+	if n, ok := body.(*discv5.Nodes); ok {
+		for _, r := range n.Nodes {
+			trackRecord(rec, n.Name(), r)
+		}
+	}
+}
+
+// trackRecord caches a validly signed record carried by a packet of the
+// given kind.
+func trackRecord(rec *record, kind string, r *enr.Record) {
+	if r == nil {
+		return
+	}
+	if n, err := enode.New(enode.ValidSchemes, r); err == nil {
+		nodes.ObserveRecord(n, recordClient(r), tracker.Provenance{Time: rec.Time, Source: rec.Protocol + "/" + kind, From: rec.Src})
+	}
+}
+
+// reportNodes logs an overview of the node table.
+func reportNodes(now time.Time) {
+	s := nodes.Summarize(now, time.Hour)
+	stale := nodes.MarkStale(now, time.Hour)
+	clients := make(map[string]int)
+	for client, n := range s.Clients {
+		// Versions are left out, the timeline of -versions-out has them.
+		if i := strings.IndexByte(client, '/'); i >= 0 {
+			client = client[:i]
+		}
+		clients[client] += n
+	}
+	e := log.Info().Int("nodes", s.Nodes).Int("active_1h", s.Active).Int("new_1h", s.New).Int("stale_1h", stale)
+	for outcome, n := range enrResponses {
+		e = e.Uint64("enr_responses_"+outcome, n)
+	}
+	for client, n := range clients {
+		e = e.Int("client_"+client, n)
+	}
+	e.Msg("node table")
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"html/template"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// conversation is the peer pair selected with -transcript, nil if unset.
+var conversation *transcript
+
+// transcript records the exchange between two peers in chronological order,
+// like Wireshark's "Follow stream" but listing decoded packets. Only the
+// latest entries are kept, in a ring.
+type transcript struct {
+	a, b    string // host or host:port
+	entries []transcriptEntry
+	oldest  int    // index of the oldest entry once the ring is full
+	max     int    // entries kept
+	dropped uint64 // older entries dropped
+	last    time.Time
+}
+
+type transcriptEntry struct {
+	Time     time.Time
+	Delta    time.Duration // since the previous entry
+	Forward  bool          // sent from a to b
+	Protocol string
+	Kind     string
+	Size     int
+	Fields   string
+}
+
+// newTranscript parses a peer pair given as "a,b", each peer being a host or
+// a host:port endpoint, keeping up to max entries.
+func newTranscript(spec string, max int) (*transcript, error) {
+	parts := strings.Split(spec, ",")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, errors.New("transcript peers must be given as a,b")
+	}
+	if max < 1 {
+		return nil, errors.New("transcript must keep at least one entry")
+	}
+	return &transcript{a: strings.TrimSpace(parts[0]), b: strings.TrimSpace(parts[1]), max: max}, nil
+}
+
+// matchPeer reports whether endpoint belongs to peer.
+func matchPeer(endpoint, peer string) bool {
+	if endpoint == peer {
+		return true
+	}
+	host, _, err := net.SplitHostPort(endpoint)
+	return err == nil && host == peer
+}
+
+// add appends r if it was exchanged between the two peers. Fields are
+// rendered right away since the decoded packet may not outlive the call.
+func (t *transcript) add(r *record) {
+	var forward bool
+	switch {
+	case matchPeer(r.Src, t.a) && matchPeer(r.Dst, t.b):
+		forward = true
+	case matchPeer(r.Src, t.b) && matchPeer(r.Dst, t.a):
+	default:
+		return
+	}
+
+	e := transcriptEntry{
+		Time:     r.Time,
+		Forward:  forward,
+		Protocol: r.Protocol,
+		Kind:     r.Kind,
+		Size:     r.Size,
+	}
+	if !t.last.IsZero() {
+		e.Delta = r.Time.Sub(t.last)
+	}
+	t.last = r.Time
+	if p, err := r.Body(); err == nil {
+		e.Fields = strings.Join(keyFields(reflect.ValueOf(p), "", 0), " ")
+	} else {
+		e.Fields = "error: " + err.Error()
+	}
+	if len(t.entries) < t.max {
+		t.entries = append(t.entries, e)
+		return
+	}
+	t.entries[t.oldest] = e
+	t.oldest = (t.oldest + 1) % t.max
+	t.dropped++
+}
+
+// list returns the kept entries, oldest first.
+func (t *transcript) list() []transcriptEntry {
+	return t.tail(len(t.entries))
+}
+
+// tail returns the latest n entries, oldest first.
+func (t *transcript) tail(n int) []transcriptEntry {
+	if n > len(t.entries) {
+		n = len(t.entries)
+	}
+	out := make([]transcriptEntry, 0, n)
+	for i := len(t.entries) - n; i < len(t.entries); i++ {
+		out = append(out, t.entries[(t.oldest+i)%len(t.entries)])
+	}
+	return out
+}
+
+// summary describes the transcript in a line, such as "12 packets" or
+// "10000 packets, 52 earlier dropped".
+func (t *transcript) summary() string {
+	s := fmt.Sprintf("%d packets", len(t.entries))
+	if t.dropped > 0 {
+		s += fmt.Sprintf(", %d earlier dropped", t.dropped)
+	}
+	return s
+}
+
+// keyFields renders the scalar fields of a decoded packet as name=value
+// pairs. Byte fields are abbreviated and lists are summarized by length,
+// nested packets are flattened with a dotted prefix.
+func keyFields(v reflect.Value, prefix string, depth int) []string {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if depth > 4 || !v.IsValid() || v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var out []string
+	for i := 0; i < v.NumField(); i++ {
+		f, fv := v.Type().Field(i), v.Field(i)
+		if !f.IsExported() || f.Tag.Get("rlp") == "tail" {
+			continue
+		}
+		name := prefix + f.Name
+		if ip, ok := fv.Interface().(net.IP); ok {
+			out = append(out, name+"="+ip.String())
+			continue
+		}
+		switch fv.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Struct:
+			if s, ok := fv.Interface().(fmt.Stringer); ok && fv.Kind() == reflect.Struct {
+				out = append(out, name+"="+s.String())
+				continue
+			}
+			out = append(out, keyFields(fv, name+".", depth+1)...)
+		case reflect.Slice, reflect.Array:
+			if fv.Type().Elem().Kind() == reflect.Uint8 {
+				out = append(out, name+"="+shortHex(fv))
+			} else {
+				out = append(out, fmt.Sprintf("%s=[%d]", name, fv.Len()))
+			}
+		case reflect.Map, reflect.Func, reflect.Chan:
+		default:
+			out = append(out, fmt.Sprintf("%s=%v", name, fv.Interface()))
+		}
+	}
+	return out
+}
+
+// shortHex hex encodes a byte slice or array, eliding all but the first and
+// last four bytes of long values.
+func shortHex(v reflect.Value) string {
+	b := make([]byte, v.Len())
+	reflect.Copy(reflect.ValueOf(b), v)
+	if len(b) > 12 {
+		return hex.EncodeToString(b[:4]) + "…" + hex.EncodeToString(b[len(b)-4:])
+	}
+	return hex.EncodeToString(b)
+}
+
+// arrow returns the direction of e, peer a always being on the left.
+func (e transcriptEntry) arrow() string {
+	if e.Forward {
+		return "->"
+	}
+	return "<-"
+}
+
+// line renders e as a line of the text transcript.
+func (e transcriptEntry) line() string {
+	return fmt.Sprintf("%s  %+10.6fs  A %s B  %-7s %-24s %5dB  %s",
+		times.Format(e.Time), e.Delta.Seconds(), e.arrow(),
+		e.Protocol, e.Kind, e.Size, e.Fields)
+}
+
+// writeText writes the transcript as aligned plain text.
+func (t *transcript) writeText(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "# %s <-> %s, %s\n", t.a, t.b, t.summary()); err != nil {
+		return err
+	}
+	for _, e := range t.list() {
+		if _, err := fmt.Fprintln(w, e.line()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var transcriptHTML = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return times.Format(t) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.A}} &harr; {{.B}}</title>
+<style>
+body { font-family: monospace; }
+td { padding: 2px 8px; vertical-align: top; white-space: nowrap; }
+td.fields { white-space: normal; }
+tr.fwd td.arrow { color: #1565c0; }
+tr.rev td.arrow { color: #c62828; }
+</style>
+</head>
+<body>
+<h1>{{.A}} &harr; {{.B}}</h1>
+<p>{{.Summary}}</p>
+<table>
+<tr><th>time</th><th>delta</th><th>direction</th><th>protocol</th><th>kind</th><th>size</th><th>fields</th></tr>
+{{range .Entries}}<tr class="{{if .Forward}}fwd{{else}}rev{{end}}"><td>{{time .Time}}</td><td>+{{.Delta}}</td><td class="arrow">{{if .Forward}}A &rarr; B{{else}}A &larr; B{{end}}</td><td>{{.Protocol}}</td><td>{{.Kind}}</td><td>{{.Size}}</td><td class="fields">{{.Fields}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// writeHTML writes the transcript as a standalone HTML page.
+func (t *transcript) writeHTML(w io.Writer) error {
+	return transcriptHTML.Execute(w, struct {
+		A, B, Summary string
+		Entries       []transcriptEntry
+	}{t.a, t.b, t.summary(), t.list()})
+}
+
+// save writes the transcript to path, as HTML if it ends in .html or .htm
+// and plain text otherwise. An empty path writes text to stdout.
+func (t *transcript) save(path string) error {
+	if path == "" {
+		return t.writeText(os.Stdout)
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm":
+		err = t.writeHTML(f)
+	default:
+		err = t.writeText(f)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	log.Debug().Msgf("wrote transcript of %s to %q", t.summary(), path)
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTranscriptRing(t *testing.T) {
+	tr, err := newTranscript("10.0.0.1,10.0.0.2:30303", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2023, 11, 14, 22, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		src, dst := "10.0.0.1:30303", "10.0.0.2:30303"
+		if i%2 == 1 {
+			src, dst = dst, src
+		}
+		tr.add(&record{
+			Time:     start.Add(time.Duration(i) * time.Second),
+			Protocol: "discv4",
+			Kind:     "PING",
+			Src:      src,
+			Dst:      dst,
+			Size:     i,
+			Body:     func() (interface{}, error) { return struct{ N int }{i}, nil },
+		})
+	}
+	tr.add(&record{Src: "10.0.0.3:30303", Dst: "10.0.0.2:30303"})
+
+	entries := tr.list()
+	if len(entries) != 3 || tr.dropped != 2 {
+		t.Fatalf("kept %d entries and dropped %d, want 3 and 2", len(entries), tr.dropped)
+	}
+	for i, e := range entries {
+		if e.Size != i+2 || e.Fields != "N="+string(rune('2'+i)) || e.Forward != (i%2 == 0) || e.Delta != time.Second {
+			t.Errorf("entry %d: %+v", i, e)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := tr.writeText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "# 10.0.0.1 <-> 10.0.0.2:30303, 3 packets, 2 earlier dropped\n") {
+		t.Errorf("text transcript:\n%s", buf.String())
+	}
+
+	if _, err := newTranscript("a,b", 0); err == nil {
+		t.Error("accepted a transcript keeping no entries")
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gdamore/tcell/v2"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The dashboard is redrawn every tuiRefresh and keeps the last tuiLogLines
+// log lines.
+const (
+	tuiRefresh  = time.Second
+	tuiLogLines = 100
+)
+
+// tui draws the dashboard panels on the terminal, in the manner of iftop:
+// decoded packets per second and error rates per protocol, the busiest
+// node IDs, the latest discv5 handshakes, the most frequent decode errors
+// and recent log lines. A second view follows the conversation of the
+// transcript. State is read through the controller, as are the key
+// bindings applied. Enabled with -tui:
+//
+//	p    pause or resume the capture
+//	1-9  enable or disable the decoder of that number
+//	f    edit the capture filter
+//	g    edit the -grep pattern of the output
+//	m    edit the -match expression of the output
+//	t    switch between the panels and the transcript
+//	c    select the peer pair of the transcript
+//	q    quit
+type tui struct {
+	screen  tcell.Screen
+	control *controller
+	view    func() (dashboardView, error)
+	quit    func()
+	logger  zerolog.Logger // restored on stop
+	stopped sync.Once
+
+	transcript bool       // the transcript is shown rather than the panels
+	prompt     *tuiPrompt // line being edited, nil if none
+	status     string     // outcome of the last change, until the next key
+}
+
+// tuiPrompt is a line edited at the bottom of the screen, applied with
+// Enter and abandoned with Escape.
+type tuiPrompt struct {
+	label string
+	text  []rune
+	apply func(string) error
+}
+
+// newTUI takes over the terminal, logging to logs until stopped. The view
+// is read and changes are applied through control, quit is called once the
+// user leaves.
+func newTUI(logs io.Writer, control *controller, view func() (dashboardView, error), quit func()) (*tui, error) {
+	screen, err := tcell.NewScreen()
+	if err != nil {
+		return nil, err
+	}
+	if err := screen.Init(); err != nil {
+		return nil, err
+	}
+	t := &tui{screen: screen, control: control, view: view, quit: quit, logger: log.Logger}
+	w := consoleWriter(logs)
+	w.NoColor = true
+	log.Logger = log.Output(logOutput(w))
+	return t, nil
+}
+
+// stop gives the terminal back and logs to it again.
+func (t *tui) stop() {
+	t.stopped.Do(func() {
+		t.screen.Fini()
+		log.Logger = t.logger
+	})
+}
+
+// run redraws the dashboard and handles key presses until quit.
+func (t *tui) run() {
+	events := make(chan tcell.Event)
+	go func() {
+		for {
+			ev := t.screen.PollEvent()
+			if ev == nil {
+				return
+			}
+			events <- ev
+		}
+	}()
+
+	var v dashboardView
+	refresh := time.NewTicker(tuiRefresh)
+	defer refresh.Stop()
+	for {
+		if next, err := t.view(); err == nil {
+			v = next
+		}
+		t.draw(v)
+
+		select {
+		case <-refresh.C:
+		case ev := <-events:
+			switch ev := ev.(type) {
+			case *tcell.EventResize:
+				t.screen.Sync()
+			case *tcell.EventKey:
+				if ev.Key() == tcell.KeyCtrlC || (t.prompt == nil && ev.Rune() == 'q') {
+					t.stop()
+					t.quit()
+					return
+				}
+				t.key(ev, v)
+			}
+		}
+	}
+}
+
+// key handles a key press other than quitting, given the state shown.
+func (t *tui) key(ev *tcell.EventKey, v dashboardView) {
+	if p := t.prompt; p != nil {
+		switch ev.Key() {
+		case tcell.KeyEnter:
+			t.prompt = nil
+			if err := p.apply(strings.TrimSpace(string(p.text))); err != nil {
+				t.status = err.Error()
+			}
+		case tcell.KeyEscape:
+			t.prompt = nil
+		case tcell.KeyBackspace, tcell.KeyBackspace2:
+			if len(p.text) > 0 {
+				p.text = p.text[:len(p.text)-1]
+			}
+		case tcell.KeyRune:
+			p.text = append(p.text, ev.Rune())
+		}
+		return
+	}
+
+	t.status = ""
+	switch r := ev.Rune(); r {
+	case 'p':
+		t.apply(t.control.setPaused(!v.Paused))
+	case '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		if i := int(r - '1'); i < len(v.Decoders) {
+			d := v.Decoders[i]
+			t.apply(t.control.setDecoder(d.Name, !d.Enabled))
+		}
+	case 'f':
+		t.edit("Capture filter", v.BPF, func(expr string) error {
+			return t.apply(t.control.setBPF(expr))
+		})
+	case 'g':
+		t.edit("Grep pattern", v.Grep, func(expr string) error {
+			return t.apply(t.control.setGrep(expr))
+		})
+	case 'm':
+		t.edit("Match expression", v.Match, func(expr string) error {
+			return t.apply(t.control.setMatch(expr))
+		})
+	case 't':
+		t.transcript = !t.transcript
+	case 'c':
+		t.edit("Transcript peers (a,b)", "", func(peers string) error {
+			t.transcript = true
+			return t.apply(t.control.setTranscript(peers))
+		})
+	}
+}
+
+// edit prompts for a line, starting from text, and applies it with apply.
+func (t *tui) edit(label, text string, apply func(string) error) {
+	t.prompt = &tuiPrompt{label: label, text: []rune(text), apply: apply}
+}
+
+// apply runs a change on the capture loop.
+func (t *tui) apply(change func() (interface{}, error)) error {
+	_, err := t.control.do(change)
+	return err
+}
+
+var (
+	tuiTitle  = tcell.StyleDefault.Bold(true)
+	tuiHeader = tcell.StyleDefault.Reverse(true)
+	tuiText   = tcell.StyleDefault
+	tuiAlert  = tcell.StyleDefault.Foreground(tcell.ColorRed)
+)
+
+func (t *tui) draw(v dashboardView) {
+	s := t.screen
+	s.Clear()
+	width, height := s.Size()
+
+	state := "capturing"
+	if v.Paused {
+		state = "PAUSED"
+	}
+	t.print(0, 0, width, tuiHeader, fmt.Sprintf(" etherspy  %s  %s", times.Format(v.Time), state))
+	t.drawStatus(width, height)
+	if t.transcript {
+		t.drawTranscript(v, width, height)
+		s.Show()
+		return
+	}
+
+	// Left column: traffic and errors, right column: talkers and handshakes.
+	half := width / 2
+	y := 2
+	t.print(0, y, half, tuiTitle, "Protocol      pkts/s    errors")
+	protocols := make([]string, 0, len(v.Rates))
+	for p := range v.Rates {
+		protocols = append(protocols, p)
+	}
+	sort.Strings(protocols)
+	for _, p := range protocols {
+		y++
+		style := tuiText
+		if v.ErrorRates[p] > 0.5 {
+			style = tuiAlert
+		}
+		t.print(0, y, half, style, fmt.Sprintf("%-12s %7.1f %8.1f%%", p, v.Rates[p], 100*v.ErrorRates[p]))
+	}
+	y += 2
+	t.print(0, y, half, tuiTitle, "Decode errors")
+	for _, c := range v.Codes {
+		y++
+		t.print(0, y, half, tuiText, fmt.Sprintf("%-12s %8d", c.Code, c.Count))
+	}
+	y += 2
+	t.print(0, y, half, tuiTitle, "Decoders and filters")
+	for i, d := range v.Decoders {
+		y++
+		state, style := "on", tuiText
+		if !d.Enabled {
+			state, style = "off", tuiAlert
+		}
+		t.print(0, y, half, style, fmt.Sprintf("[%d] %-12s %s", i+1, d.Name, state))
+	}
+	for _, f := range []struct{ key, name, expr string }{{"f", "capture", v.BPF}, {"g", "grep", v.Grep}, {"m", "match", v.Match}} {
+		y++
+		if f.expr == "" {
+			f.expr = "(none)"
+		}
+		t.print(0, y, half, tuiText, fmt.Sprintf("[%s] %-12s %s", f.key, f.name, f.expr))
+	}
+	left := y
+
+	y = 2
+	t.print(half, y, width-half, tuiTitle, "Top talkers (node ID)")
+	for _, h := range v.Talkers {
+		y++
+		t.print(half, y, width-half, tuiText, fmt.Sprintf("%8d  %s", h.Count, h.Key))
+	}
+	y += 2
+	t.print(half, y, width-half, tuiTitle, "Recent handshakes")
+	for _, h := range v.Handshakes {
+		y++
+		flags := ""
+		if h.Record {
+			flags += " enr"
+		}
+		if !h.Keys {
+			flags += " undecrypted"
+		}
+		t.print(half, y, width-half, tuiText, fmt.Sprintf("%s %-21s %.16s%s", h.Time.Format("15:04:05"), h.Src, h.Node, flags))
+	}
+	if y < left {
+		y = left
+	}
+
+	// Log lines fill the remaining rows, above the status line.
+	y += 2
+	if y < height-1 {
+		t.print(0, y, width, tuiTitle, "Log")
+		t.printTail(y+1, width, height-1, v.Logs)
+	}
+	s.Show()
+}
+
+// drawTranscript fills the screen below the header with the latest packets
+// of the transcript.
+func (t *tui) drawTranscript(v dashboardView, width, height int) {
+	if v.Transcript == "" {
+		t.print(0, 2, width, tuiTitle, "No transcript, press c to select a peer pair")
+		return
+	}
+	t.print(0, 2, width, tuiTitle, "Transcript "+v.Transcript)
+	t.printTail(3, width, height-1, v.Exchange)
+}
+
+// drawStatus writes the last line: the prompt being edited, the outcome of
+// the last change or the key bindings.
+func (t *tui) drawStatus(width, height int) {
+	switch {
+	case t.prompt != nil:
+		t.print(0, height-1, width, tuiText, t.prompt.label+": "+string(t.prompt.text)+"_")
+	case t.status != "":
+		t.print(0, height-1, width, tuiAlert, t.status)
+	default:
+		t.print(0, height-1, width, tuiHeader, " [p] pause/resume  [1-9] decoders  [f] filter  [g] grep  [m] match  [t] transcript  [c] peers  [q] quit")
+	}
+}
+
+// printTail writes the last lines that fit from row y up to row end.
+func (t *tui) printTail(y, width, end int, lines []string) {
+	if rows := end - y; len(lines) > rows {
+		if rows < 0 {
+			rows = 0
+		}
+		lines = lines[len(lines)-rows:]
+	}
+	for _, line := range lines {
+		t.print(0, y, width, tuiText, line)
+		y++
+	}
+}
+
+// print writes text at x, y, cut at width columns.
+func (t *tui) print(x, y, width int, style tcell.Style, text string) {
+	col := 0
+	for _, r := range text {
+		if col >= width {
+			return
+		}
+		t.screen.SetContent(x+col, y, r, nil, style)
+		col++
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"github.com/drgomesp/etherspy/pkg/stats"
+	"github.com/gdamore/tcell/v2"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTUI returns a dashboard drawn on a simulated screen, its changes run
+// as the capture loop would.
+func testTUI(t *testing.T) (*tui, tcell.SimulationScreen, *dashboard) {
+	screen := tcell.NewSimulationScreen("")
+	if err := screen.Init(); err != nil {
+		t.Fatal(err)
+	}
+	screen.SetSize(120, 30)
+	control := newController(nil, "")
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case fn := <-control.requests:
+				fn()
+			case <-done:
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(done)
+		screen.Fini()
+		conversation = nil
+	})
+	d := newDashboard(stats.NewSeries(time.Second, time.Minute), newLogRing(tuiLogLines))
+	return &tui{screen: screen, control: control}, screen, d
+}
+
+// screenText returns the rows of the screen, trailing spaces trimmed.
+func screenText(s tcell.SimulationScreen) []string {
+	cells, width, height := s.GetContents()
+	rows := make([]string, height)
+	for y := range rows {
+		var b strings.Builder
+		for x := 0; x < width; x++ {
+			if r := cells[y*width+x].Runes; len(r) > 0 {
+				b.WriteRune(r[0])
+			} else {
+				b.WriteRune(' ')
+			}
+		}
+		rows[y] = strings.TrimRight(b.String(), " ")
+	}
+	return rows
+}
+
+// typeKeys presses the keys of text.
+func typeKeys(ui *tui, v dashboardView, text string) {
+	for _, r := range text {
+		ui.key(tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone), v)
+	}
+}
+
+func TestTUITranscript(t *testing.T) {
+	ui, screen, d := testTUI(t)
+	now := time.Date(2023, 11, 14, 22, 0, 0, 0, time.UTC)
+	v := d.view(now, controlStatus{})
+
+	typeKeys(ui, v, "t")
+	ui.draw(v)
+	if rows := screenText(screen); !strings.Contains(rows[2], "No transcript") {
+		t.Fatalf("transcript view without a transcript:\n%s", strings.Join(rows, "\n"))
+	}
+
+	// A pair is selected through the prompt.
+	typeKeys(ui, v, "c")
+	typeKeys(ui, v, "10.0.0.1,10.0.0.3")
+	ui.key(tcell.NewEventKey(tcell.KeyBackspace2, 0, tcell.ModNone), v)
+	typeKeys(ui, v, "2")
+	ui.draw(v)
+	if rows := screenText(screen); rows[len(rows)-1] != "Transcript peers (a,b): 10.0.0.1,10.0.0.2_" {
+		t.Fatalf("prompt %q", rows[len(rows)-1])
+	}
+	ui.key(tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone), v)
+	if conversation == nil || conversation.a != "10.0.0.1" || conversation.b != "10.0.0.2" {
+		t.Fatalf("transcript %+v, want of 10.0.0.1 and 10.0.0.2", conversation)
+	}
+
+	conversation.add(&record{
+		Time:     now,
+		Protocol: "discv4",
+		Kind:     "PING",
+		Src:      "10.0.0.2:30303",
+		Dst:      "10.0.0.1:30303",
+		Size:     98,
+		Body:     func() (interface{}, error) { return struct{ Version uint }{4}, nil },
+	})
+	ui.draw(d.view(now, controlStatus{}))
+	rows := screenText(screen)
+	if rows[2] != "Transcript 10.0.0.1 <-> 10.0.0.2, 1 packets" || !strings.Contains(rows[3], "A <- B  discv4  PING") || !strings.HasSuffix(rows[3], "Version=4") {
+		t.Errorf("transcript view:\n%s", strings.Join(rows, "\n"))
+	}
+
+	// Invalid pairs are reported, the selection is kept.
+	typeKeys(ui, v, "c")
+	typeKeys(ui, v, "nope")
+	ui.key(tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone), v)
+	ui.draw(v)
+	if rows := screenText(screen); !strings.Contains(rows[len(rows)-1], "a,b") || conversation.a != "10.0.0.1" {
+		t.Errorf("invalid pair: status %q, transcript of %s", rows[len(rows)-1], conversation.a)
+	}
+
+	// Escape leaves the prompt without a change, t goes back to the panels.
+	typeKeys(ui, v, "c")
+	ui.key(tcell.NewEventKey(tcell.KeyEscape, 0, tcell.ModNone), v)
+	typeKeys(ui, v, "t")
+	ui.draw(v)
+	if rows := screenText(screen); ui.prompt != nil || !strings.HasPrefix(rows[2], "Protocol") || !strings.Contains(rows[len(rows)-1], "[t] transcript") {
+		t.Errorf("panels:\n%s", strings.Join(rows, "\n"))
+	}
+}
+
+func TestTUIControls(t *testing.T) {
+	ui, screen, d := testTUI(t)
+	if _, err := setupNetworks(nil, "udp", func() *breakers { return newBreakers(10, 0.5, false) }); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		networks, grepPattern, matchExpr = nil, nil, nil
+	})
+	now := time.Date(2023, 11, 14, 22, 0, 0, 0, time.UTC)
+	current := func() dashboardView {
+		status, err := ui.control.do(ui.control.status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.view(now, status.(controlStatus))
+	}
+	enter := func(v dashboardView) {
+		ui.key(tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone), v)
+	}
+
+	v := current()
+	ui.draw(v)
+	rows := strings.Join(screenText(screen), "\n")
+	for _, want := range []string{"[1] discv4       on", "[2] discv5       on", "[f] capture      (none)", "[g] grep         (none)", "[m] match        (none)"} {
+		if !strings.Contains(rows, want) {
+			t.Errorf("panels lack %q:\n%s", want, rows)
+		}
+	}
+
+	typeKeys(ui, v, "2")
+	if v = current(); !v.Decoders[0].Enabled || v.Decoders[1].Enabled {
+		t.Errorf("decoders %+v after pressing 2, want discv5 disabled", v.Decoders)
+	}
+	typeKeys(ui, v, "2")
+	typeKeys(ui, v, "9")
+	if v = current(); !v.Decoders[0].Enabled || !v.Decoders[1].Enabled {
+		t.Errorf("decoders %+v after pressing 2 and 9, want both enabled", v.Decoders)
+	}
+
+	typeKeys(ui, v, "gPING|PONG")
+	enter(v)
+	if v = current(); grepPattern == nil || v.Grep != "PING|PONG" {
+		t.Fatalf("grep pattern %q, want PING|PONG", v.Grep)
+	}
+	// The prompt starts from the pattern in effect.
+	typeKeys(ui, v, "g")
+	if string(ui.prompt.text) != "PING|PONG" {
+		t.Errorf("prompt %q, want the current pattern", string(ui.prompt.text))
+	}
+	for range "|PONG" {
+		ui.key(tcell.NewEventKey(tcell.KeyBackspace2, 0, tcell.ModNone), v)
+	}
+	enter(v)
+	if v = current(); v.Grep != "PING" {
+		t.Errorf("grep pattern %q, want PING", v.Grep)
+	}
+	typeKeys(ui, v, "g")
+	for range "PING" {
+		ui.key(tcell.NewEventKey(tcell.KeyBackspace2, 0, tcell.ModNone), v)
+	}
+	typeKeys(ui, v, "(")
+	enter(v)
+	if ui.status == "" || current().Grep != "PING" {
+		t.Errorf("invalid pattern: status %q, pattern %q", ui.status, current().Grep)
+	}
+
+	typeKeys(ui, v, "mkind==PING && size>100")
+	enter(v)
+	if v = current(); matchExpr == nil || v.Match != "kind==PING && size>100" {
+		t.Fatalf("match expression %q, want kind==PING && size>100", v.Match)
+	}
+	typeKeys(ui, v, "m")
+	if string(ui.prompt.text) != v.Match {
+		t.Errorf("prompt %q, want the current expression", string(ui.prompt.text))
+	}
+	typeKeys(ui, v, " &&")
+	enter(v)
+	if ui.status == "" || current().Match != "kind==PING && size>100" {
+		t.Errorf("invalid expression: status %q, expression %q", ui.status, current().Match)
+	}
+	typeKeys(ui, v, "m")
+	for range v.Match {
+		ui.key(tcell.NewEventKey(tcell.KeyBackspace2, 0, tcell.ModNone), v)
+	}
+	enter(v)
+	if v = current(); matchExpr != nil || v.Match != "" {
+		t.Errorf("match expression %q left after clearing it", v.Match)
+	}
+
+	typeKeys(ui, v, "f")
+	if ui.prompt == nil || ui.prompt.label != "Capture filter" {
+		t.Fatalf("prompt %+v, want the capture filter", ui.prompt)
+	}
+	ui.key(tcell.NewEventKey(tcell.KeyEscape, 0, tcell.ModNone), v)
+	if ui.prompt != nil {
+		t.Error("escape left the prompt open")
+	}
+}
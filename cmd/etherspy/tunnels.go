@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/drgomesp/etherspy/pkg/decap"
+	"github.com/google/gopacket"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"strings"
+)
+
+// decapsulator peels encapsulations off captured packets, nil if disabled
+// with -decap none.
+var decapsulator *decapsulation
+
+// decapsulation peels the encapsulations given with -decap before packets
+// are reassembled and decoded. The capture lets every encapsulated packet
+// through, so peeled packets are checked against the capture filter.
+type decapsulation struct {
+	decap  *decap.Decapsulator
+	filter matcher
+
+	peeled   map[string]uint64 // by encapsulation
+	filtered uint64
+}
+
+// newDecapsulation peels the encapsulations of spec, comma separated, off
+// the packets of c, keeping those that match filter once peeled. It
+// returns the capture filter to add to let encapsulated packets through.
+func newDecapsulation(c *capture, spec, filter string) (*decapsulation, string, error) {
+	var encaps []string
+	for _, e := range strings.Split(spec, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			encaps = append(encaps, e)
+		}
+	}
+	d, err := decap.New(encaps...)
+	if err != nil {
+		return nil, "", err
+	}
+	m, err := c.NewBPF(filter)
+	if err != nil {
+		return nil, "", err
+	}
+	return &decapsulation{decap: d, filter: m, peeled: make(map[string]uint64)}, d.Filter(), nil
+}
+
+// packet returns p with its encapsulations peeled, p itself if it isn't
+// encapsulated, or nil if the peeled packet doesn't match the filter.
+func (d *decapsulation) packet(p gopacket.Packet) gopacket.Packet {
+	inner, encap := d.decap.Packet(p)
+	if encap == "" {
+		return p
+	}
+	d.peeled[encap]++
+	if !d.filter.Matches(inner.Metadata().CaptureInfo, inner.Data()) {
+		d.filtered++
+		return nil
+	}
+	return inner
+}
+
+// report logs how many packets were peeled of each encapsulation.
+func (d *decapsulation) report() {
+	if len(d.peeled) == 0 {
+		return
+	}
+	encaps := make([]string, 0, len(d.peeled))
+	for e := range d.peeled {
+		encaps = append(encaps, e)
+	}
+	sort.Strings(encaps)
+	for _, e := range encaps {
+		log.Info().Str("encapsulation", e).Uint64("packets", d.peeled[e]).Msg("decapsulated")
+	}
+	log.Info().Uint64("filtered", d.filtered).Msg("decapsulation")
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clientEntry is the "client" ENR entry of EIP-7636: the name and version
+// of the software running the node.
+type clientEntry struct {
+	Name    string
+	Version string
+	Rest    []rlp.RawValue `rlp:"tail"`
+}
+
+func (clientEntry) ENRKey() string { return "client" }
+
+// recordClient returns the client advertised by a record as name/version,
+// empty if it has no client entry.
+func recordClient(r *enr.Record) string {
+	var entry clientEntry
+	if r.Load(&entry) != nil || entry.Name == "" {
+		return ""
+	}
+	return strings.ToLower(entry.Name) + "/" + entry.Version
+}
+
+// clientVersion is a client name and version as observed.
+type clientVersion struct {
+	Client  string
+	Version string
+}
+
+// versionBucket holds the version each node was last seen running within
+// one time bucket.
+type versionBucket struct {
+	start time.Time
+	nodes map[enode.ID]clientVersion
+}
+
+// versionTimeline tracks the client versions advertised by nodes over time,
+// so the adoption of releases can be followed.
+type versionTimeline struct {
+	bucket    time.Duration
+	buckets   []*versionBucket
+	adoptions []adoption
+}
+
+// adoption is a minimum version whose share among the nodes of a client is
+// reported, such as geth>=1.14.
+type adoption struct {
+	client string
+	min    string
+}
+
+func newVersionTimeline(bucket time.Duration, adoptions string) (*versionTimeline, error) {
+	if bucket <= 0 {
+		return nil, fmt.Errorf("version bucket must be positive, got %s", bucket)
+	}
+	t := &versionTimeline{bucket: bucket}
+	for _, a := range strings.Split(adoptions, ",") {
+		if a = strings.TrimSpace(a); a == "" {
+			continue
+		}
+		i := strings.Index(a, ">=")
+		if i <= 0 || i+2 == len(a) {
+			return nil, fmt.Errorf("invalid adoption %q, want client>=version", a)
+		}
+		t.adoptions = append(t.adoptions, adoption{client: strings.ToLower(a[:i]), min: a[i+2:]})
+	}
+	return t, nil
+}
+
+// observeRecord accounts for the client entry of a record seen at time now,
+// if it has one and is validly signed.
+func (t *versionTimeline) observeRecord(now time.Time, r *enr.Record) {
+	var entry clientEntry
+	if r == nil || r.Load(&entry) != nil || entry.Name == "" {
+		return
+	}
+	n, err := enode.New(enode.ValidSchemes, r)
+	if err != nil {
+		return
+	}
+	t.observe(now, n.ID(), clientVersion{Client: strings.ToLower(entry.Name), Version: entry.Version})
+}
+
+func (t *versionTimeline) observe(now time.Time, id enode.ID, v clientVersion) {
+	start := now.Truncate(t.bucket)
+	var b *versionBucket
+	if n := len(t.buckets); n > 0 && !t.buckets[n-1].start.Before(start) {
+		// Packets are mostly in order, search back for late ones.
+		for i := n - 1; i >= 0 && b == nil; i-- {
+			if t.buckets[i].start.Equal(start) {
+				b = t.buckets[i]
+			}
+		}
+	}
+	if b == nil {
+		b = &versionBucket{start: start, nodes: make(map[enode.ID]clientVersion)}
+		t.buckets = append(t.buckets, b)
+		sort.Slice(t.buckets, func(i, j int) bool { return t.buckets[i].start.Before(t.buckets[j].start) })
+	}
+	b.nodes[id] = v
+}
+
+// observeBody accounts for the records carried by a decoded packet.
+func (t *versionTimeline) observeBody(now time.Time, body interface{}) {
+	switch p := body.(type) {
+	case *discv4.ENRResponse:
+		t.observeRecord(now, &p.Record)
+	case *discv5.Handshake:
+		t.observeRecord(now, p.Record)
+		t.observeBody(now, p.Body)
+	case *discv5.Message:
+		t.observeBody(now, p.Body)
+	case *discv5.Nodes:
+		for _, r := range p.Nodes {
+			t.observeRecord(now, r)
+		}
+	}
+}
+
+// report logs the adoption shares of the latest bucket.
+func (t *versionTimeline) report() {
+	if len(t.buckets) == 0 || len(t.adoptions) == 0 {
+		return
+	}
+	latest := t.buckets[len(t.buckets)-1].start.UTC()
+	for _, p := range t.series() {
+		if p.Time.Equal(latest) && strings.HasPrefix(p.Version, ">=") {
+			log.Info().Msgf("%.1f%% of %s nodes on %s since %s (%d nodes)", p.Share*100, p.Client, p.Version, latest.Format(time.RFC3339), p.Nodes)
+		}
+	}
+}
+
+// versionPoint is one point of the exported time series: the number of
+// nodes of a client running a version, or a range of versions for
+// adoptions, within a bucket.
+type versionPoint struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Version string    `json:"version"`
+	Nodes   int       `json:"nodes"`
+	Share   float64   `json:"share"` // of the client's nodes in the bucket
+}
+
+func (t *versionTimeline) series() []versionPoint {
+	var points []versionPoint
+	for _, b := range t.buckets {
+		clients := make(map[string]int)
+		versions := make(map[clientVersion]int)
+		for _, v := range b.nodes {
+			clients[v.Client]++
+			versions[v]++
+		}
+		start := len(points)
+		for v, n := range versions {
+			points = append(points, versionPoint{Time: b.start.UTC(), Client: v.Client, Version: v.Version, Nodes: n, Share: float64(n) / float64(clients[v.Client])})
+		}
+		for _, a := range t.adoptions {
+			var n int
+			for _, v := range b.nodes {
+				if v.Client == a.client && compareVersions(v.Version, a.min) >= 0 {
+					n++
+				}
+			}
+			p := versionPoint{Time: b.start.UTC(), Client: a.client, Version: ">=" + a.min, Nodes: n}
+			if clients[a.client] > 0 {
+				p.Share = float64(n) / float64(clients[a.client])
+			}
+			points = append(points, p)
+		}
+		bucket := points[start:]
+		sort.Slice(bucket, func(i, j int) bool {
+			if bucket[i].Client != bucket[j].Client {
+				return bucket[i].Client < bucket[j].Client
+			}
+			return bucket[i].Version < bucket[j].Version
+		})
+	}
+	return points
+}
+
+// save writes the time series to path, as CSV if it ends in .csv and as
+// JSON otherwise. The file is replaced atomically.
+func (t *versionTimeline) save(path string) error {
+	points := t.series()
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if strings.HasSuffix(path, ".csv") {
+		w := csv.NewWriter(tmp)
+		w.Write([]string{"time", "client", "version", "nodes", "share"})
+		for _, p := range points {
+			w.Write([]string{p.Time.Format(time.RFC3339), p.Client, p.Version, strconv.Itoa(p.Nodes), strconv.FormatFloat(p.Share, 'f', 4, 64)})
+		}
+		w.Flush()
+		err = w.Error()
+	} else {
+		enc := json.NewEncoder(tmp)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(points)
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// compareVersions compares the leading dotted numbers of two versions such
+// as "v1.14.0-stable", returning -1, 0 or 1. Missing components count as
+// zero and anything after the numbers is ignored.
+func compareVersions(a, b string) int {
+	pa, pb := versionNumbers(a), versionNumbers(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionNumbers(v string) []int {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	var nums []int
+	for _, part := range strings.Split(v, ".") {
+		end := 0
+		for end < len(part) && part[end] >= '0' && part[end] <= '9' {
+			end++
+		}
+		if end == 0 {
+			break
+		}
+		n, _ := strconv.Atoi(part[:end])
+		nums = append(nums, n)
+		if end < len(part) {
+			break
+		}
+	}
+	return nums
+}
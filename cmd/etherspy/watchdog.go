@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/google/gopacket"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// kindCaptureRestart is the kind of the records written when the capture
+// is reopened.
+const kindCaptureRestart = "CAPTURE_RESTART"
+
+// watchdogCheck is how often a stalled capture is looked for, and reopening
+// a failed one retried.
+const watchdogCheck = 5 * time.Second
+
+// CaptureRestart is the record written once a live capture was reopened.
+type CaptureRestart struct {
+	Devices  []string
+	Reason   string // closed, or silent past the watchdog timeout
+	Silence  string // since the last packet
+	Attempts int    // to reopen the interfaces
+}
+
+// watchdog reopens a live capture that stopped delivering packets, as when
+// its interface bounced or a VPN reconnected, with the same settings and
+// filter. Enabled with -watchdog.
+type watchdog struct {
+	handle  *capture
+	timeout time.Duration
+
+	last     time.Time // wall clock of the latest packet
+	closed   bool      // the packet channel closed
+	attempts int       // failed reopen attempts since the last packet
+	restarts uint64
+}
+
+func newWatchdog(handle *capture, timeout time.Duration) *watchdog {
+	return &watchdog{handle: handle, timeout: timeout, last: time.Now()}
+}
+
+// observe notes that the capture is alive.
+func (w *watchdog) observe(now time.Time) {
+	w.last = now
+}
+
+// check reopens the capture if it was closed or silent past the timeout,
+// returning the packets of the new handles, nil if it wasn't reopened.
+func (w *watchdog) check(now time.Time) <-chan gopacket.Packet {
+	silence := now.Sub(w.last)
+	if !w.closed && silence < w.timeout {
+		return nil
+	}
+	reason := "silent"
+	if w.closed {
+		reason = "closed"
+	}
+	w.attempts++
+	if err := w.handle.reopen(); err != nil {
+		// The interface may still be down, retried on the next check.
+		log.Warn().Err(err).Str("reason", reason).Int("attempts", w.attempts).Msg("could not reopen capture")
+		return nil
+	}
+
+	w.restarts++
+	ev := CaptureRestart{
+		Devices:  w.handle.devices,
+		Reason:   reason,
+		Silence:  silence.Round(time.Second).String(),
+		Attempts: w.attempts,
+	}
+	log.Warn().
+		Strs("devices", ev.Devices).
+		Str("reason", reason).
+		Dur("silence", silence).
+		Int("attempts", w.attempts).
+		Uint64("restarts", w.restarts).
+		Msg("capture reopened")
+	rec := &record{
+		Time:      now,
+		Protocol:  "capture",
+		Kind:      kindCaptureRestart,
+		Src:       "-",
+		Dst:       "-",
+		Direction: directionUnknown,
+		Body:      func() (interface{}, error) { return &ev, nil },
+	}
+	if err := writeRecord(rec); err != nil {
+		log.Warn().Err(err).Msg("could not write capture restart")
+	}
+
+	w.last, w.closed, w.attempts = now, false, 0
+	return w.handle.Packets()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"github.com/rs/zerolog/log"
+	"hash/fnv"
+)
+
+// decoding runs the costly decoding steps off the capture loop, nil unless
+// -workers is set.
+var decoding *workerPool
+
+// workerPool moves the most expensive steps of the capture loop, discv5
+// decryption and discv4 sender recovery, to worker goroutines. Packets leave
+// in the order they were submitted: the work left to do on a packet once
+// decoded runs back on the capture loop, after that of every packet
+// submitted before.
+//
+// Each worker has a queue of its own, and the packets of a flow, the pair of
+// endpoints exchanging them, always go to the same one. discv5 sessions are
+// set up by handshakes that have to be decoded before the messages that
+// follow, which a worker does as it takes its packets in order.
+//
+// Queues are bounded. Packets finding theirs full are dropped and counted,
+// so that a busy capture falls behind by as little as possible, unless
+// reading a capture file, where the loop waits for the workers instead.
+type workerPool struct {
+	workers   []chan *workerJob
+	queue     chan *workerJob // submission order
+	completed chan *workerJob
+	pending   int
+	wait      bool
+
+	submitted, dropped uint64
+}
+
+// workerJob is a packet being decoded.
+type workerJob struct {
+	work  func()
+	ready chan struct{}
+	then  func()
+}
+
+// newWorkerPool starts workers, each queuing up to queue packets. With wait
+// set, submitting to a full queue waits rather than drops the packet.
+func newWorkerPool(workers, queue int, wait bool) *workerPool {
+	w := &workerPool{
+		workers:   make([]chan *workerJob, workers),
+		queue:     make(chan *workerJob, workers*queue),
+		completed: make(chan *workerJob),
+		wait:      wait,
+	}
+	for i := range w.workers {
+		jobs := make(chan *workerJob, queue)
+		w.workers[i] = jobs
+		go func() {
+			for job := range jobs {
+				job.work()
+				close(job.ready)
+			}
+		}()
+	}
+	// Hand completed jobs back in submission order.
+	go func() {
+		for job := range w.queue {
+			<-job.ready
+			w.completed <- job
+		}
+	}()
+	return w
+}
+
+// submit runs work on the worker of flow, then schedules then to run on the
+// capture loop, through done. submit reports whether the packet was queued,
+// false if it was dropped, in which case neither function runs.
+func (w *workerPool) submit(flow string, work, then func()) bool {
+	w.submitted++
+	job := &workerJob{work: work, ready: make(chan struct{}), then: then}
+	if !w.enqueue(w.workers[w.worker(flow)], job) {
+		w.dropped++
+		return false
+	}
+	w.pending++
+	for {
+		select {
+		case w.queue <- job:
+			return true
+		case done := <-w.completed:
+			w.done(done)
+		}
+	}
+}
+
+// enqueue hands job to a worker, reporting whether it could. Without wait it
+// gives up at once if the worker is busy, otherwise it completes the earlier
+// jobs until there is room.
+func (w *workerPool) enqueue(jobs chan *workerJob, job *workerJob) bool {
+	for {
+		select {
+		case jobs <- job:
+			return true
+		default:
+		}
+		if !w.wait {
+			return false
+		}
+		select {
+		case jobs <- job:
+			return true
+		case done := <-w.completed:
+			w.done(done)
+		}
+	}
+}
+
+// worker returns the index of the worker decoding the packets exchanged by
+// the endpoints of flow.
+func (w *workerPool) worker(flow string) int {
+	h := fnv.New32a()
+	h.Write([]byte(flow))
+	return int(h.Sum32() % uint32(len(w.workers)))
+}
+
+// flow identifies the endpoints exchanging a packet regardless of its
+// direction.
+func flow(src, dst string) string {
+	if src > dst {
+		src, dst = dst, src
+	}
+	return src + " " + dst
+}
+
+// done runs the remaining work of a completed job.
+func (w *workerPool) done(job *workerJob) {
+	w.pending--
+	job.then()
+}
+
+// drain waits for every submitted packet and completes it.
+func (w *workerPool) drain() {
+	for w.pending > 0 {
+		w.done(<-w.completed)
+	}
+}
+
+// report logs how many packets went through the workers and how many were
+// dropped with their queues full.
+func (w *workerPool) report() {
+	ev := log.Info()
+	if w.dropped > 0 {
+		ev = log.Warn()
+	}
+	backlog := 0
+	for _, jobs := range w.workers {
+		backlog += len(jobs)
+	}
+	ev.Int("workers", len(w.workers)).
+		Uint64("submitted", w.submitted).
+		Uint64("dropped", w.dropped).
+		Int("pending", w.pending).
+		Int("queued", backlog).
+		Msg("decode workers")
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// flowOf returns a flow decoded by worker i of w.
+func flowOf(t *testing.T, w *workerPool, i int) string {
+	t.Helper()
+	for n := 0; n < 1000; n++ {
+		f := flow(fmt.Sprintf("10.0.0.%d:30303", n), "10.0.1.1:30303")
+		if w.worker(f) == i {
+			return f
+		}
+	}
+	t.Fatalf("no flow for worker %d", i)
+	return ""
+}
+
+func TestWorkerPoolOrder(t *testing.T) {
+	const n = 4
+	w := newWorkerPool(n, 4, false)
+	var release, finished [n]chan struct{}
+	var emitted []int
+	for i := 0; i < n; i++ {
+		i := i
+		release[i], finished[i] = make(chan struct{}), make(chan struct{})
+		work := func() {
+			<-release[i]
+			close(finished[i])
+		}
+		if !w.submit(flowOf(t, w, i), work, func() { emitted = append(emitted, i) }) {
+			t.Fatalf("packet %d dropped", i)
+		}
+	}
+	// Each packet has a worker of its own, the last submitted finishes first.
+	for i := n - 1; i >= 0; i-- {
+		close(release[i])
+		<-finished[i]
+	}
+	w.drain()
+	if want := []int{0, 1, 2, 3}; !reflect.DeepEqual(emitted, want) {
+		t.Errorf("emitted %v, want %v", emitted, want)
+	}
+	if w.submitted != n || w.dropped != 0 || w.pending != 0 {
+		t.Errorf("submitted %d, dropped %d, pending %d", w.submitted, w.dropped, w.pending)
+	}
+}
+
+func TestWorkerPoolFull(t *testing.T) {
+	w := newWorkerPool(1, 2, false)
+	started, release := make(chan struct{}), make(chan struct{})
+	var emitted []int
+	submit := func(i int, work func()) bool {
+		return w.submit("a b", func() {
+			if work != nil {
+				work()
+			}
+			if i > 2 {
+				t.Errorf("dropped packet %d decoded", i)
+			}
+		}, func() { emitted = append(emitted, i) })
+	}
+
+	// The worker holds the first packet, two more fill its queue.
+	submit(0, func() {
+		close(started)
+		<-release
+	})
+	<-started
+	for i := 1; i < 5; i++ {
+		if queued := submit(i, nil); queued != (i <= 2) {
+			t.Errorf("packet %d queued %v", i, queued)
+		}
+	}
+	if w.submitted != 5 || w.dropped != 2 {
+		t.Errorf("submitted %d, dropped %d, want 5 and 2", w.submitted, w.dropped)
+	}
+	close(release)
+	w.drain()
+	if want := []int{0, 1, 2}; !reflect.DeepEqual(emitted, want) {
+		t.Errorf("emitted %v, want %v", emitted, want)
+	}
+}
+
+func TestWorkerPoolWait(t *testing.T) {
+	w := newWorkerPool(2, 1, true)
+	var emitted []int
+	for i := 0; i < 50; i++ {
+		i := i
+		if !w.submit(flow(fmt.Sprint(i%3), "x"), func() {}, func() { emitted = append(emitted, i) }) {
+			t.Fatalf("packet %d dropped while waiting", i)
+		}
+	}
+	w.drain()
+	if len(emitted) != 50 || w.dropped != 0 {
+		t.Fatalf("emitted %d, dropped %d, want 50 and 0", len(emitted), w.dropped)
+	}
+	for i, got := range emitted {
+		if got != i {
+			t.Fatalf("emitted %v out of order", emitted)
+		}
+	}
+}
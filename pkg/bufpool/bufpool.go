@@ -0,0 +1,80 @@
+// Package bufpool manages reusable byte buffers for packet payloads flowing
+// through the processing pipeline.
+package bufpool
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultSize fits any discovery packet, both protocols cap datagrams at
+// 1280 bytes.
+const DefaultSize = 1280
+
+// Buffer is a pooled byte slice. The owner must call Release exactly once
+// when the data is no longer referenced; B must not be used afterwards.
+type Buffer struct {
+	B []byte
+
+	pool     *Pool
+	released uint32
+}
+
+// Release returns the buffer to its pool. Releasing a buffer twice panics,
+// since it would hand the same memory to two owners.
+func (b *Buffer) Release() {
+	if b == nil {
+		return
+	}
+	if !atomic.CompareAndSwapUint32(&b.released, 0, 1) {
+		panic("bufpool: buffer released twice")
+	}
+	if b.pool == nil {
+		return
+	}
+	b.B = b.B[:0]
+	b.pool.pool.Put(b)
+}
+
+// Pool hands out buffers of a fixed capacity. Requests larger than that
+// capacity are served by plain allocations which are not recycled.
+type Pool struct {
+	size int
+	pool sync.Pool
+
+	gets, misses uint64
+}
+
+func New(size int) *Pool {
+	p := &Pool{size: size}
+	p.pool.New = func() interface{} {
+		atomic.AddUint64(&p.misses, 1)
+		return &Buffer{B: make([]byte, 0, size), pool: p}
+	}
+	return p
+}
+
+// Get returns a buffer of length n.
+func (p *Pool) Get(n int) *Buffer {
+	if n > p.size {
+		return &Buffer{B: make([]byte, n)}
+	}
+	atomic.AddUint64(&p.gets, 1)
+	b := p.pool.Get().(*Buffer)
+	b.released = 0
+	b.B = b.B[:n]
+	return b
+}
+
+// Copy returns a buffer holding a copy of src.
+func (p *Pool) Copy(src []byte) *Buffer {
+	b := p.Get(len(src))
+	copy(b.B, src)
+	return b
+}
+
+// Stats returns the number of pooled buffers handed out and how many of them
+// had to be freshly allocated.
+func (p *Pool) Stats() (gets, allocs uint64) {
+	return atomic.LoadUint64(&p.gets), atomic.LoadUint64(&p.misses)
+}
@@ -0,0 +1,486 @@
+// Package capfilter compiles capture filters to classic BPF without
+// libpcap, so capture backends such as AF_PACKET can filter in the kernel
+// in binaries built without cgo dependencies on libpcap.
+//
+// It understands the subset of the pcap filter language discovery traffic
+// is selected with, for Ethernet frames:
+//
+//	ip, ip6, udp, tcp
+//	[udp|tcp] [src|dst] port N
+//	[src|dst] host ADDR
+//	ip[OFF[:SIZE]] [& MASK] = VALUE, and the same of ip6 and ether
+//	and (&&), or (||), not (!), parentheses
+//
+// Operators of byte comparisons must be surrounded by spaces.
+//
+// Ports match on unfragmented IPv4 and on IPv6 packets without extension
+// headers, as libpcap does. Programs are limited to the 4096 instructions
+// the kernel accepts, enough for about 350 IPv4 hosts or 150 IPv6 ones.
+package capfilter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/net/bpf"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Offsets within an Ethernet frame.
+const (
+	etherType  = 12
+	ipv4       = 14
+	ipv4Proto  = ipv4 + 9
+	ipv4Frag   = ipv4 + 6
+	ipv4Src    = ipv4 + 12
+	ipv4Dst    = ipv4 + 16
+	ipv6       = 14
+	ipv6Next   = ipv6 + 6
+	ipv6Src    = ipv6 + 8
+	ipv6Dst    = ipv6 + 24
+	ipv6Header = 40
+)
+
+const (
+	typeIPv4 = 0x0800
+	typeIPv6 = 0x86dd
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// test compares size bytes at off, masked if mask is set, with val. With
+// ind, off is relative to the end of the IPv4 header.
+type test struct {
+	size int
+	off  uint32
+	ind  bool
+	mask uint32
+	val  uint32
+}
+
+// node is a filter expression: a test, or the conjunction, disjunction or
+// negation of other expressions.
+type node struct {
+	op   byte // '&', '|', '!' or 0 for a test
+	a, b *node
+	t    test
+}
+
+func and(a, b *node) *node { return &node{op: '&', a: a, b: b} }
+func or(a, b *node) *node  { return &node{op: '|', a: a, b: b} }
+func not(a *node) *node    { return &node{op: '!', a: a} }
+func leaf(t test) *node    { return &node{t: t} }
+
+func ether(typ uint32) *node { return leaf(test{size: 2, off: etherType, val: typ}) }
+
+// proto matches IPv4 and IPv6 packets of any of the given protocols.
+func proto(protos []uint32) (v4, v6 *node) {
+	for _, p := range protos {
+		t4 := leaf(test{size: 1, off: ipv4Proto, val: p})
+		t6 := leaf(test{size: 1, off: ipv6Next, val: p})
+		if v4 == nil {
+			v4, v6 = t4, t6
+		} else {
+			v4, v6 = or(v4, t4), or(v6, t6)
+		}
+	}
+	return and(ether(typeIPv4), v4), and(ether(typeIPv6), v6)
+}
+
+// port matches the TCP or UDP packets with the given source or destination
+// port, either if dir is empty.
+func port(protos []uint32, dir string, n uint32) *node {
+	v4, v6 := proto(protos)
+	var p4, p6 *node
+	for _, d := range []struct {
+		dir string
+		off uint32
+	}{{"src", 0}, {"dst", 2}} {
+		if dir != "" && dir != d.dir {
+			continue
+		}
+		t4 := leaf(test{size: 2, off: ipv4 + d.off, ind: true, val: n})
+		t6 := leaf(test{size: 2, off: ipv6 + ipv6Header + d.off, val: n})
+		if p4 == nil {
+			p4, p6 = t4, t6
+		} else {
+			p4, p6 = or(p4, t4), or(p6, t6)
+		}
+	}
+	unfragmented := leaf(test{size: 2, off: ipv4Frag, mask: 0x1fff, val: 0})
+	return or(and(v4, and(unfragmented, p4)), and(v6, p6))
+}
+
+// host matches the packets from or to ip, either if dir is empty.
+func host(dir string, ip net.IP) *node {
+	var n *node
+	for _, d := range []string{"src", "dst"} {
+		if dir != "" && dir != d {
+			continue
+		}
+		var t *node
+		if ip4 := ip.To4(); ip4 != nil {
+			off := uint32(ipv4Src)
+			if d == "dst" {
+				off = ipv4Dst
+			}
+			t = and(ether(typeIPv4), leaf(test{size: 4, off: off, val: binary.BigEndian.Uint32(ip4)}))
+		} else {
+			off := uint32(ipv6Src)
+			if d == "dst" {
+				off = ipv6Dst
+			}
+			t = ether(typeIPv6)
+			for i := 0; i < 16; i += 4 {
+				t = and(t, leaf(test{size: 4, off: off + uint32(i), val: binary.BigEndian.Uint32(ip[i:])}))
+			}
+		}
+		if n == nil {
+			n = t
+		} else {
+			n = or(n, t)
+		}
+	}
+	return n
+}
+
+// Compile compiles expr into a program accepting up to snaplen bytes of
+// the matching packets. An empty expression matches every packet.
+func Compile(expr string, snaplen int) ([]bpf.Instruction, error) {
+	p := &parser{tokens: tokenize(expr)}
+	var root *node
+	if len(p.tokens) > 0 {
+		var err error
+		if root, err = p.expr(); err != nil {
+			return nil, fmt.Errorf("invalid filter %q: %v", expr, err)
+		}
+		if len(p.tokens) > 0 {
+			return nil, fmt.Errorf("invalid filter %q: unexpected %q", expr, p.tokens[0])
+		}
+	}
+	return assemble(root, uint32(snaplen))
+}
+
+func tokenize(expr string) []string {
+	for _, op := range []string{"(", ")", "&&", "||", "!"} {
+		expr = strings.ReplaceAll(expr, op, " "+op+" ")
+	}
+	return strings.Fields(expr)
+}
+
+type parser struct {
+	tokens []string
+}
+
+func (p *parser) peek() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	return p.tokens[0]
+}
+
+func (p *parser) next() string {
+	t := p.peek()
+	if t != "" {
+		p.tokens = p.tokens[1:]
+	}
+	return t
+}
+
+func (p *parser) expr() (*node, error) {
+	n, err := p.term()
+	for err == nil && (p.peek() == "or" || p.peek() == "||") {
+		p.next()
+		var m *node
+		if m, err = p.term(); err == nil {
+			n = or(n, m)
+		}
+	}
+	return n, err
+}
+
+func (p *parser) term() (*node, error) {
+	n, err := p.factor()
+	for err == nil && (p.peek() == "and" || p.peek() == "&&") {
+		p.next()
+		var m *node
+		if m, err = p.factor(); err == nil {
+			n = and(n, m)
+		}
+	}
+	return n, err
+}
+
+func (p *parser) factor() (*node, error) {
+	switch t := p.next(); t {
+	case "not", "!":
+		n, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return not(n), nil
+	case "(":
+		n, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return n, nil
+	case "":
+		return nil, fmt.Errorf("unexpected end")
+	default:
+		p.tokens = append([]string{t}, p.tokens...)
+		return p.primitive()
+	}
+}
+
+// accessor parses a comparison of the bytes of the Ethernet, IPv4 or IPv6
+// header, such as ip[6:2] & 0x1fff = 0, from its first token.
+func (p *parser) accessor(t string) (*node, error) {
+	i := strings.IndexByte(t, '[')
+	if i < 0 || !strings.HasSuffix(t, "]") {
+		return nil, fmt.Errorf("invalid %q", t)
+	}
+	typ, base := uint32(typeIPv4), uint32(ipv4)
+	switch t[:i] {
+	case "ip":
+	case "ip6":
+		typ, base = typeIPv6, ipv6
+	case "ether":
+		typ, base = 0, 0
+	default:
+		return nil, fmt.Errorf("unsupported %q", t)
+	}
+	off, size := t[i+1:len(t)-1], "1"
+	if j := strings.IndexByte(off, ':'); j >= 0 {
+		off, size = off[:j], off[j+1:]
+	}
+	o, err := strconv.ParseUint(off, 0, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid offset in %q", t)
+	}
+	test := test{off: base + uint32(o)}
+	switch size {
+	case "1", "2", "4":
+		test.size = int(size[0] - '0')
+	default:
+		return nil, fmt.Errorf("invalid size in %q, want 1, 2 or 4", t)
+	}
+	if p.peek() == "&" {
+		p.next()
+		m, err := strconv.ParseUint(p.next(), 0, 32)
+		if err != nil || m == 0 {
+			return nil, fmt.Errorf("invalid mask")
+		}
+		test.mask = uint32(m)
+	}
+	if op := p.next(); op != "=" && op != "==" {
+		return nil, fmt.Errorf("missing = after %q", t)
+	}
+	v, err := strconv.ParseUint(p.next(), 0, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value compared to %q", t)
+	}
+	test.val = uint32(v)
+	if typ == 0 {
+		return leaf(test), nil
+	}
+	return and(ether(typ), leaf(test)), nil
+}
+
+func (p *parser) primitive() (*node, error) {
+	if t := p.peek(); strings.HasPrefix(t, "ip[") || strings.HasPrefix(t, "ip6[") || strings.HasPrefix(t, "ether[") {
+		return p.accessor(p.next())
+	}
+	protos := []uint32{protoTCP, protoUDP}
+	qualified := false
+	switch p.peek() {
+	case "ip", "ip6":
+		if p.next() == "ip" {
+			return ether(typeIPv4), nil
+		}
+		return ether(typeIPv6), nil
+	case "udp", "tcp":
+		protos, qualified = []uint32{protoUDP}, true
+		if p.next() == "tcp" {
+			protos = []uint32{protoTCP}
+		}
+	}
+	dir := ""
+	if p.peek() == "src" || p.peek() == "dst" {
+		dir = p.next()
+	}
+	switch t := p.peek(); {
+	case t == "port":
+		p.next()
+		n, err := strconv.ParseUint(p.next(), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port")
+		}
+		return port(protos, dir, uint32(n)), nil
+	case t == "host" && !qualified:
+		p.next()
+		addr := p.next()
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid host %q", addr)
+		}
+		return host(dir, ip), nil
+	case qualified && dir == "":
+		v4, v6 := proto(protos)
+		return or(v4, v6), nil
+	case t == "":
+		return nil, fmt.Errorf("unexpected end")
+	}
+	return nil, fmt.Errorf("unsupported %q", p.peek())
+}
+
+// inst is an instruction of a program being assembled, or a comparison
+// jumping to labels yet to be placed.
+type inst struct {
+	bpf.Instruction
+	cmp  uint32
+	t, f int // labels
+}
+
+type assembler struct {
+	insts  []inst
+	labels []int // instruction index by label
+}
+
+func (a *assembler) label() int {
+	a.labels = append(a.labels, -1)
+	return len(a.labels) - 1
+}
+
+func (a *assembler) place(l int) { a.labels[l] = len(a.insts) }
+
+func (a *assembler) emit(i bpf.Instruction) { a.insts = append(a.insts, inst{Instruction: i}) }
+
+// gen emits n, jumping to t if it matches and to f otherwise.
+func (a *assembler) gen(n *node, t, f int) {
+	switch n.op {
+	case '&':
+		m := a.label()
+		a.gen(n.a, m, f)
+		a.place(m)
+		a.gen(n.b, t, f)
+	case '|':
+		m := a.label()
+		a.gen(n.a, t, m)
+		a.place(m)
+		a.gen(n.b, t, f)
+	case '!':
+		a.gen(n.a, f, t)
+	default:
+		if n.t.ind {
+			a.emit(bpf.LoadMemShift{Off: ipv4})
+			a.emit(bpf.LoadIndirect{Off: n.t.off, Size: n.t.size})
+		} else {
+			a.emit(bpf.LoadAbsolute{Off: n.t.off, Size: n.t.size})
+		}
+		if n.t.mask != 0 {
+			a.emit(bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: n.t.mask})
+		}
+		a.insts = append(a.insts, inst{cmp: n.t.val, t: t, f: f})
+	}
+}
+
+// maxInstructions is the longest program the kernel accepts as a socket
+// filter.
+const maxInstructions = 4096
+
+func assemble(root *node, snaplen uint32) ([]bpf.Instruction, error) {
+	if root == nil {
+		return []bpf.Instruction{bpf.RetConstant{Val: snaplen}}, nil
+	}
+	a := new(assembler)
+	accept, reject := a.label(), a.label()
+	a.gen(root, accept, reject)
+	a.place(accept)
+	a.emit(bpf.RetConstant{Val: snaplen})
+	a.place(reject)
+	a.emit(bpf.RetConstant{Val: 0})
+
+	// Comparisons jump relative to the next instruction and only forward,
+	// at most 255 instructions away. Those with a target further away jump
+	// to unconditional jumps placed right after them, which reach any. As
+	// these lengthen the program, other comparisons may need them in turn.
+	long := make([]bool, len(a.insts))
+	pos := a.layout(long)
+	for grown := true; grown; {
+		grown = false
+		for i, in := range a.insts {
+			if in.Instruction != nil || long[i] {
+				continue
+			}
+			if pos[a.labels[in.t]]-pos[i]-1 > 255 || pos[a.labels[in.f]]-pos[i]-1 > 255 {
+				long[i], grown = true, true
+			}
+		}
+		if grown {
+			pos = a.layout(long)
+		}
+	}
+	if n := pos[len(a.insts)]; n > maxInstructions {
+		return nil, fmt.Errorf("filter too long, %d instructions, at most %d", n, maxInstructions)
+	}
+
+	prog := make([]bpf.Instruction, 0, pos[len(a.insts)])
+	for i, in := range a.insts {
+		if in.Instruction != nil {
+			prog = append(prog, in.Instruction)
+			continue
+		}
+		t, f := pos[a.labels[in.t]], pos[a.labels[in.f]]
+		if long[i] {
+			prog = append(prog,
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: in.cmp, SkipTrue: 0, SkipFalse: 1},
+				bpf.Jump{Skip: uint32(t - pos[i] - 2)},
+				bpf.Jump{Skip: uint32(f - pos[i] - 3)})
+			continue
+		}
+		prog = append(prog, bpf.JumpIf{Cond: bpf.JumpEqual, Val: in.cmp, SkipTrue: uint8(t - pos[i] - 1), SkipFalse: uint8(f - pos[i] - 1)})
+	}
+	return prog, nil
+}
+
+// layout returns the position in the program of every instruction, and
+// its length last, with the long comparisons taking three instructions.
+func (a *assembler) layout(long []bool) []int {
+	pos := make([]int, len(a.insts)+1)
+	for i := range a.insts {
+		pos[i+1] = pos[i] + 1
+		if long[i] {
+			pos[i+1] += 2
+		}
+	}
+	return pos
+}
+
+// Filter matches packets against a compiled filter in user space.
+type Filter struct {
+	vm *bpf.VM
+}
+
+// New compiles expr into a filter.
+func New(expr string, snaplen int) (*Filter, error) {
+	prog, err := Compile(expr, snaplen)
+	if err != nil {
+		return nil, err
+	}
+	vm, err := bpf.NewVM(prog)
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{vm: vm}, nil
+}
+
+// Matches reports whether the Ethernet frame data matches the filter.
+func (f *Filter) Matches(data []byte) bool {
+	n, err := f.vm.Run(data)
+	return err == nil && n > 0
+}
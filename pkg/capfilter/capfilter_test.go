@@ -0,0 +1,208 @@
+package capfilter
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+	"net"
+	"strings"
+	"testing"
+)
+
+// frame serializes an Ethernet frame carrying ip, a transport layer
+// and a payload.
+func frame(t *testing.T, ip gopacket.NetworkLayer, transport gopacket.SerializableLayer) []byte {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	if _, ok := ip.(*layers.IPv6); ok {
+		eth.EthernetType = layers.EthernetTypeIPv6
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	err := gopacket.SerializeLayers(buf, opts, eth, ip.(gopacket.SerializableLayer), transport, gopacket.Payload("discovery"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func ip4(src, dst string, proto layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: proto, SrcIP: net.ParseIP(src).To4(), DstIP: net.ParseIP(dst).To4()}
+}
+
+func ip6(src, dst string, proto layers.IPProtocol) *layers.IPv6 {
+	return &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: proto, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+}
+
+func udp(src, dst int) *layers.UDP {
+	return &layers.UDP{SrcPort: layers.UDPPort(src), DstPort: layers.UDPPort(dst)}
+}
+
+func tcp(src, dst int) *layers.TCP {
+	return &layers.TCP{SrcPort: layers.TCPPort(src), DstPort: layers.TCPPort(dst), DataOffset: 5}
+}
+
+// testFrames returns the frames the filters are run on, by name.
+func testFrames(t *testing.T) map[string][]byte {
+	withOptions := ip4("10.0.0.1", "10.0.0.2", layers.IPProtocolUDP)
+	withOptions.Options = []layers.IPv4Option{{OptionType: 1}, {OptionType: 1}, {OptionType: 1}, {OptionType: 0}}
+	first := ip4("10.0.0.1", "10.0.0.2", layers.IPProtocolUDP)
+	first.Flags = layers.IPv4MoreFragments
+	// A later fragment carries data that reads as UDP ports 30303.
+	later := ip4("10.0.0.1", "10.0.0.2", layers.IPProtocolUDP)
+	later.FragOffset = 185
+	return map[string][]byte{
+		"udp4":        frame(t, ip4("10.0.0.1", "10.0.0.2", layers.IPProtocolUDP), udp(40000, 30303)),
+		"udp4-dns":    frame(t, ip4("10.0.0.1", "10.0.0.2", layers.IPProtocolUDP), udp(40000, 53)),
+		"udp4-reply":  frame(t, ip4("10.0.0.2", "10.0.0.1", layers.IPProtocolUDP), udp(30303, 40000)),
+		"udp4-opts":   frame(t, withOptions, udp(40000, 30303)),
+		"tcp4":        frame(t, ip4("10.0.0.1", "10.0.0.2", layers.IPProtocolTCP), tcp(30303, 40000)),
+		"udp6":        frame(t, ip6("2001:db8::1", "2001:db8::2", layers.IPProtocolUDP), udp(40000, 30303)),
+		"tcp6":        frame(t, ip6("2001:db8::1", "2001:db8::2", layers.IPProtocolTCP), tcp(40000, 30303)),
+		"frag4-first": frame(t, first, udp(40000, 30303)),
+		"frag4-later": frame(t, later, udp(30303, 30303)),
+	}
+}
+
+func TestFilter(t *testing.T) {
+	frames := testFrames(t)
+	tests := []struct {
+		expr  string
+		match []string // names of the matching frames
+	}{
+		{"", []string{"udp4", "udp4-dns", "udp4-reply", "udp4-opts", "tcp4", "udp6", "tcp6", "frag4-first", "frag4-later"}},
+		{"ip", []string{"udp4", "udp4-dns", "udp4-reply", "udp4-opts", "tcp4", "frag4-first", "frag4-later"}},
+		{"ip6", []string{"udp6", "tcp6"}},
+		{"udp", []string{"udp4", "udp4-dns", "udp4-reply", "udp4-opts", "udp6", "frag4-first", "frag4-later"}},
+		{"tcp", []string{"tcp4", "tcp6"}},
+		{"port 30303", []string{"udp4", "udp4-reply", "udp4-opts", "tcp4", "udp6", "tcp6", "frag4-first"}},
+		{"udp port 30303", []string{"udp4", "udp4-reply", "udp4-opts", "udp6", "frag4-first"}},
+		{"udp dst port 30303", []string{"udp4", "udp4-opts", "udp6", "frag4-first"}},
+		{"tcp src port 30303", []string{"tcp4"}},
+		{"src port 30303", []string{"udp4-reply", "tcp4"}},
+		{"host 10.0.0.2", []string{"udp4", "udp4-dns", "udp4-reply", "udp4-opts", "tcp4", "frag4-first", "frag4-later"}},
+		{"src host 10.0.0.2", []string{"udp4-reply"}},
+		{"dst host 2001:db8::2", []string{"udp6", "tcp6"}},
+		{"src host 2001:db8::2", nil},
+		{"ip[9] = 6", []string{"tcp4"}},
+		{"ip[6:2] & 0x1fff = 0 and udp", []string{"udp4", "udp4-dns", "udp4-reply", "udp4-opts", "frag4-first"}},
+		{"ip[0] & 0xf = 6", []string{"udp4-opts"}},
+		{"ip6[6] == 17", []string{"udp6"}},
+		{"ether[12:2] = 0x86dd", []string{"udp6", "tcp6"}},
+		{"udp and not port 30303", []string{"udp4-dns", "frag4-later"}},
+		{"udp && !port 30303", []string{"udp4-dns", "frag4-later"}},
+		{"port 53 or ip6 and tcp", []string{"udp4-dns", "tcp6"}},
+		{"(port 53 or ip6) and tcp", []string{"tcp6"}},
+		{"not (ip or port 30303)", nil},
+		{"not (ip || udp)", []string{"tcp6"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			f, err := New(tt.expr, 65535)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := make(map[string]bool)
+			for _, name := range tt.match {
+				want[name] = true
+			}
+			for name, data := range frames {
+				if got := f.Matches(data); got != want[name] {
+					t.Errorf("%s: match %v, want %v", name, got, want[name])
+				}
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, expr := range []string{
+		"port",
+		"port x",
+		"port 65536",
+		"udp port",
+		"(udp",
+		"udp )",
+		"udp and",
+		"not",
+		"foo",
+		"udp6",
+		"udp host 10.0.0.1",
+		"host nothost",
+		"ip[1:3] = 1",
+		"ip[x] = 1",
+		"ip[1] & 0 = 1",
+		"ip[1] 1",
+		"ip[1] = x",
+		"tcp[1] = 1",
+	} {
+		if _, err := Compile(expr, 65535); err == nil {
+			t.Errorf("%q compiled", expr)
+		}
+	}
+}
+
+// TestCompileLong checks filters whose comparisons jump further than 255
+// instructions still match, as narrowed filters do.
+func TestCompileLong(t *testing.T) {
+	hosts := make([]string, 200)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("host 10.0.%d.%d", i/100, i%100)
+	}
+	expr := "udp port 30303 and (" + strings.Join(hosts, " or ") + ")"
+	prog, err := Compile(expr, 65535)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prog) <= 255 {
+		t.Fatalf("program of %d instructions, want more than 255", len(prog))
+	}
+	var long bool
+	for _, in := range prog {
+		if _, ok := in.(bpf.Jump); ok {
+			long = true
+		}
+	}
+	if !long {
+		t.Error("no unconditional jump in the program")
+	}
+	vm, err := bpf.NewVM(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		src  string
+		port int
+		want bool
+	}{
+		{"10.0.0.0", 30303, true},
+		{"10.0.1.99", 30303, true},
+		{"10.0.1.0", 30303, true},
+		{"10.0.2.0", 30303, false},
+		{"10.0.0.0", 53, false},
+	} {
+		n, err := vm.Run(frame(t, ip4(tt.src, "192.168.0.1", layers.IPProtocolUDP), udp(40000, tt.port)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := n > 0; got != tt.want {
+			t.Errorf("from %s:%d: match %v, want %v", tt.src, tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestCompileTooLong(t *testing.T) {
+	hosts := make([]string, 256)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("host 2001:db8::%x", i)
+	}
+	_, err := Compile(strings.Join(hosts, " or "), 65535)
+	if err == nil || !strings.Contains(err.Error(), "filter too long") {
+		t.Fatalf("error %v, want filter too long", err)
+	}
+}
@@ -0,0 +1,211 @@
+// Package datagram hands the raw datagrams of a capture to other consumers,
+// in process through subscriptions or to sidecar processes over a stream
+// socket, so experimental decoders can work on the same traffic without
+// opening a second capture.
+//
+// Over a socket, every datagram is sent as a frame, all integers big endian:
+//
+//	uint32  length of the rest of the frame
+//	int64   capture time, nanoseconds since the Unix epoch
+//	[16]byte source IP, IPv4 addresses in IPv4-mapped form
+//	uint16  source port
+//	[16]byte destination IP
+//	uint16  destination port
+//	uint8   length of the network label, followed by the label
+//	...     UDP payload, up to the end of the frame
+package datagram
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Datagram is a captured UDP payload with its metadata.
+type Datagram struct {
+	Time     time.Time
+	Src, Dst *net.UDPAddr
+
+	// Network is the label of the monitored network the datagram belongs
+	// to, empty when a single network is monitored.
+	Network string
+
+	Payload []byte
+}
+
+// headerSize is the size of a frame up to the network label.
+const headerSize = 4 + 8 + 2*(16+2) + 1
+
+// MaxFrameSize bounds the frames ReadFrame accepts.
+const MaxFrameSize = 1 << 16
+
+// WriteFrame writes d to w as a single frame.
+func WriteFrame(w io.Writer, d Datagram) error {
+	if len(d.Network) > 255 {
+		return errors.New("network label longer than 255 bytes")
+	}
+	frame := make([]byte, headerSize+len(d.Network)+len(d.Payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+	binary.BigEndian.PutUint64(frame[4:], uint64(d.Time.UnixNano()))
+	putAddr(frame[12:], d.Src)
+	putAddr(frame[30:], d.Dst)
+	frame[48] = byte(len(d.Network))
+	copy(frame[headerSize:], d.Network)
+	copy(frame[headerSize+len(d.Network):], d.Payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+func putAddr(b []byte, addr *net.UDPAddr) {
+	if addr == nil {
+		return
+	}
+	copy(b, addr.IP.To16())
+	binary.BigEndian.PutUint16(b[16:], uint16(addr.Port))
+}
+
+// ReadFrame reads a single frame from r.
+func ReadFrame(r io.Reader) (Datagram, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return Datagram{}, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < headerSize-4 || n > MaxFrameSize {
+		return Datagram{}, errors.New("invalid frame size")
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return Datagram{}, err
+	}
+	label := int(frame[44])
+	if headerSize-4+label > len(frame) {
+		return Datagram{}, errors.New("network label beyond frame")
+	}
+	return Datagram{
+		Time:    time.Unix(0, int64(binary.BigEndian.Uint64(frame))),
+		Src:     getAddr(frame[8:]),
+		Dst:     getAddr(frame[26:]),
+		Network: string(frame[headerSize-4 : headerSize-4+label]),
+		Payload: frame[headerSize-4+label:],
+	}, nil
+}
+
+func getAddr(b []byte) *net.UDPAddr {
+	ip := net.IP(append([]byte(nil), b[:16]...))
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(b[16:]))}
+}
+
+// Hub fans datagrams out to its subscriptions. Publishing never blocks:
+// datagrams are dropped for subscribers that fall behind.
+type Hub struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+// NewHub returns a hub without subscriptions.
+func NewHub() *Hub {
+	return &Hub{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscription receives the datagrams published on a hub on C.
+type Subscription struct {
+	C <-chan Datagram
+
+	c       chan Datagram
+	hub     *Hub
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+// Subscribe returns a subscription buffering up to buffer datagrams.
+func (h *Hub) Subscribe(buffer int) *Subscription {
+	c := make(chan Datagram, buffer)
+	s := &Subscription{C: c, c: c, hub: h}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+// Dropped returns the number of datagrams dropped because the subscription
+// was full.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close ends the subscription and closes C.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.hub.mu.Lock()
+		delete(s.hub.subs, s)
+		s.hub.mu.Unlock()
+		close(s.c)
+	})
+}
+
+// Publish hands d to every subscription. Its payload is copied when there
+// are subscribers, so the caller may reuse it; subscribers share the copy
+// and must not modify it.
+func (h *Hub) Publish(d Datagram) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.subs) == 0 {
+		return
+	}
+	d.Payload = append([]byte(nil), d.Payload...)
+	for s := range h.subs {
+		select {
+		case s.c <- d:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// Serve accepts connections on l and streams frames of every published
+// datagram to each of them until it disconnects. Each connection buffers
+// up to buffer datagrams. Serve returns when l fails, as when closed.
+func (h *Hub) Serve(l net.Listener, buffer int, onClose func(addr net.Addr, dropped uint64, err error)) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go h.stream(conn, buffer, onClose)
+	}
+}
+
+func (h *Hub) stream(conn net.Conn, buffer int, onClose func(net.Addr, uint64, error)) {
+	s := h.Subscribe(buffer)
+	defer conn.Close()
+	defer s.Close()
+
+	// Sidecars only read, a read returning means they are gone.
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+
+	var err error
+	for err == nil {
+		select {
+		case d := <-s.C:
+			err = WriteFrame(conn, d)
+		case <-gone:
+			err = io.EOF
+		}
+	}
+	if onClose != nil {
+		onClose(conn.RemoteAddr(), s.Dropped(), err)
+	}
+}
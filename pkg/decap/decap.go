@@ -0,0 +1,136 @@
+// Package decap peels the encapsulations off captured packets, so
+// discovery traffic captured on trunk ports or overlay networks is decoded
+// like any other: 802.1Q and 802.1ad VLAN tags, VXLAN (UDP port 4789),
+// Geneve (UDP port 6081) and GRE. Peeled packets are handed back as
+// Ethernet frames of their own, the tunneled frame or, for tunnels of bare
+// IP, its packet behind the Ethernet header of the outer frame.
+package decap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"sort"
+	"strings"
+)
+
+// Encapsulations that can be peeled.
+const (
+	VLAN   = "vlan"
+	VXLAN  = "vxlan"
+	Geneve = "geneve"
+	GRE    = "gre"
+)
+
+// Filters selects the outer packets of every encapsulation, as capture
+// filters.
+var Filters = map[string]string{
+	VLAN:   "ether[12:2] = 0x8100 or ether[12:2] = 0x88a8",
+	VXLAN:  "udp port 4789",
+	Geneve: "udp port 6081",
+	GRE:    "ip[9] = 47 or ip6[6] = 47",
+}
+
+// Names returns the names of the encapsulations, sorted.
+func Names() []string {
+	names := make([]string, 0, len(Filters))
+	for name := range Filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Decapsulator peels the enabled encapsulations.
+type Decapsulator struct {
+	names   []string
+	enabled map[gopacket.LayerType]string
+}
+
+// New peels the given encapsulations.
+func New(encaps ...string) (*Decapsulator, error) {
+	d := &Decapsulator{enabled: make(map[gopacket.LayerType]string)}
+	for _, e := range encaps {
+		switch e {
+		case VLAN:
+			d.enabled[layers.LayerTypeDot1Q] = VLAN
+		case VXLAN:
+			d.enabled[layers.LayerTypeVXLAN] = VXLAN
+		case Geneve:
+			d.enabled[layers.LayerTypeGeneve] = Geneve
+		case GRE:
+			d.enabled[layers.LayerTypeGRE] = GRE
+		default:
+			return nil, fmt.Errorf("unknown encapsulation %q, want %s", e, strings.Join(Names(), ", "))
+		}
+		d.names = append(d.names, e)
+	}
+	return d, nil
+}
+
+// Filter returns the capture filter selecting the outer packets of the
+// enabled encapsulations, empty if none is.
+func (d *Decapsulator) Filter() string {
+	exprs := make([]string, len(d.names))
+	for i, name := range d.names {
+		exprs[i] = "(" + Filters[name] + ")"
+	}
+	return strings.Join(exprs, " or ")
+}
+
+// Packet returns p with its enabled encapsulations peeled, and the
+// innermost encapsulation peeled, empty if p isn't encapsulated. Packets
+// whose innermost encapsulation carries neither Ethernet nor IP are
+// returned as they are.
+func (d *Decapsulator) Packet(p gopacket.Packet) (gopacket.Packet, string) {
+	all := p.Layers()
+	inner := -1
+	for i, l := range all {
+		if _, ok := d.enabled[l.LayerType()]; ok {
+			inner = i
+		}
+	}
+	if inner < 0 {
+		return p, ""
+	}
+	tunnel := all[inner]
+	next, ok := tunnel.(interface{ NextLayerType() gopacket.LayerType })
+	if !ok {
+		return p, ""
+	}
+	payload := tunnel.LayerPayload()
+
+	var data []byte
+	switch next.NextLayerType() {
+	case layers.LayerTypeEthernet:
+		data = append([]byte(nil), payload...)
+	case layers.LayerTypeIPv4:
+		data = frame(all[:inner], layers.EthernetTypeIPv4, payload)
+	case layers.LayerTypeIPv6:
+		data = frame(all[:inner], layers.EthernetTypeIPv6, payload)
+	default:
+		return p, ""
+	}
+
+	out := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	md := out.Metadata()
+	md.CaptureInfo = p.Metadata().CaptureInfo
+	md.CaptureLength, md.Length = len(data), len(data)
+	return out, d.enabled[tunnel.LayerType()]
+}
+
+// frame puts payload behind an Ethernet header with the addresses of the
+// innermost Ethernet layer among outer, zero if there is none.
+func frame(outer []gopacket.Layer, typ layers.EthernetType, payload []byte) []byte {
+	data := make([]byte, 14, 14+len(payload))
+	for i := len(outer) - 1; i >= 0; i-- {
+		if eth, ok := outer[i].(*layers.Ethernet); ok {
+			copy(data[0:6], eth.DstMAC)
+			copy(data[6:12], eth.SrcMAC)
+			break
+		}
+	}
+	binary.BigEndian.PutUint16(data[12:14], uint16(typ))
+	return append(data, payload...)
+}
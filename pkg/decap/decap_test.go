@@ -0,0 +1,286 @@
+package decap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	outerSrc = net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	outerDst = net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	innerSrc = net.HardwareAddr{0x02, 0, 0, 0, 1, 1}
+	innerDst = net.HardwareAddr{0x02, 0, 0, 0, 1, 2}
+	payload  = []byte("discovery packet")
+)
+
+func serialize(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+// datagram returns the layers of the tunneled discovery datagram.
+func datagram() []gopacket.SerializableLayer {
+	return []gopacket.SerializableLayer{
+		&layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 2)},
+		&layers.UDP{SrcPort: 30303, DstPort: 30304},
+		gopacket.Payload(payload),
+	}
+}
+
+// innerFrame returns the tunneled Ethernet frame of the datagram.
+func innerFrame(t *testing.T) []byte {
+	eth := &layers.Ethernet{SrcMAC: innerSrc, DstMAC: innerDst, EthernetType: layers.EthernetTypeIPv4}
+	return serialize(t, append([]gopacket.SerializableLayer{eth}, datagram()...)...)
+}
+
+func outerEthernet(typ layers.EthernetType) *layers.Ethernet {
+	return &layers.Ethernet{SrcMAC: outerSrc, DstMAC: outerDst, EthernetType: typ}
+}
+
+func outerIPv4(proto layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: proto, SrcIP: net.IPv4(192, 168, 0, 1), DstIP: net.IPv4(192, 168, 0, 2)}
+}
+
+// geneve returns a Geneve header, which gopacket can't serialize, carrying
+// protocol in the network vni.
+func geneve(protocol layers.EthernetType, vni uint32) gopacket.Payload {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint16(header[2:], uint16(protocol))
+	binary.BigEndian.PutUint32(header[4:], vni<<8)
+	return header
+}
+
+func TestPacket(t *testing.T) {
+	tests := []struct {
+		name   string
+		encaps []string
+		frame  func(t *testing.T) []byte
+		encap  string           // peeled, empty if the packet is left as is
+		src    net.HardwareAddr // of the peeled frame
+	}{
+		{
+			name:   "vlan",
+			encaps: []string{VLAN},
+			frame: func(t *testing.T) []byte {
+				return serialize(t, append([]gopacket.SerializableLayer{
+					outerEthernet(layers.EthernetTypeDot1Q),
+					&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeIPv4},
+				}, datagram()...)...)
+			},
+			encap: VLAN,
+			src:   outerSrc,
+		},
+		{
+			name:   "qinq",
+			encaps: []string{VLAN},
+			frame: func(t *testing.T) []byte {
+				return serialize(t, append([]gopacket.SerializableLayer{
+					outerEthernet(layers.EthernetTypeQinQ),
+					&layers.Dot1Q{VLANIdentifier: 200, Type: layers.EthernetTypeDot1Q},
+					&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeIPv4},
+				}, datagram()...)...)
+			},
+			encap: VLAN,
+			src:   outerSrc,
+		},
+		{
+			name:   "vxlan",
+			encaps: []string{VXLAN},
+			frame: func(t *testing.T) []byte {
+				return serialize(t,
+					outerEthernet(layers.EthernetTypeIPv4),
+					outerIPv4(layers.IPProtocolUDP),
+					&layers.UDP{SrcPort: 50000, DstPort: 4789},
+					&layers.VXLAN{ValidIDFlag: true, VNI: 42},
+					gopacket.Payload(innerFrame(t)))
+			},
+			encap: VXLAN,
+			src:   innerSrc,
+		},
+		{
+			name:   "vxlan in vlan",
+			encaps: []string{VLAN, VXLAN},
+			frame: func(t *testing.T) []byte {
+				return serialize(t,
+					outerEthernet(layers.EthernetTypeDot1Q),
+					&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeIPv4},
+					outerIPv4(layers.IPProtocolUDP),
+					&layers.UDP{SrcPort: 50000, DstPort: 4789},
+					&layers.VXLAN{ValidIDFlag: true, VNI: 42},
+					gopacket.Payload(innerFrame(t)))
+			},
+			encap: VXLAN,
+			src:   innerSrc,
+		},
+		{
+			name:   "geneve",
+			encaps: []string{Geneve},
+			frame: func(t *testing.T) []byte {
+				return serialize(t,
+					outerEthernet(layers.EthernetTypeIPv4),
+					outerIPv4(layers.IPProtocolUDP),
+					&layers.UDP{SrcPort: 50000, DstPort: 6081},
+					append(geneve(layers.EthernetTypeTransparentEthernetBridging, 42), innerFrame(t)...))
+			},
+			encap: Geneve,
+			src:   innerSrc,
+		},
+		{
+			name:   "geneve of IP",
+			encaps: []string{Geneve},
+			frame: func(t *testing.T) []byte {
+				return serialize(t,
+					outerEthernet(layers.EthernetTypeIPv4),
+					outerIPv4(layers.IPProtocolUDP),
+					&layers.UDP{SrcPort: 50000, DstPort: 6081},
+					append(geneve(layers.EthernetTypeIPv4, 42), serialize(t, datagram()...)...))
+			},
+			encap: Geneve,
+			src:   outerSrc,
+		},
+		{
+			name:   "gre",
+			encaps: []string{GRE},
+			frame: func(t *testing.T) []byte {
+				return serialize(t, append([]gopacket.SerializableLayer{
+					outerEthernet(layers.EthernetTypeIPv4),
+					outerIPv4(layers.IPProtocolGRE),
+					&layers.GRE{Protocol: layers.EthernetTypeIPv4},
+				}, datagram()...)...)
+			},
+			encap: GRE,
+			src:   outerSrc,
+		},
+		{
+			name:   "gre over IPv6",
+			encaps: []string{GRE},
+			frame: func(t *testing.T) []byte {
+				return serialize(t, append([]gopacket.SerializableLayer{
+					outerEthernet(layers.EthernetTypeIPv6),
+					&layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolGRE, SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")},
+					&layers.GRE{Protocol: layers.EthernetTypeIPv4},
+				}, datagram()...)...)
+			},
+			encap: GRE,
+			src:   outerSrc,
+		},
+		{
+			name:   "gre of Ethernet",
+			encaps: []string{GRE},
+			frame: func(t *testing.T) []byte {
+				return serialize(t,
+					outerEthernet(layers.EthernetTypeIPv4),
+					outerIPv4(layers.IPProtocolGRE),
+					&layers.GRE{Protocol: layers.EthernetTypeTransparentEthernetBridging},
+					gopacket.Payload(innerFrame(t)))
+			},
+			encap: GRE,
+			src:   innerSrc,
+		},
+		{
+			name:   "disabled",
+			encaps: []string{VLAN, Geneve},
+			frame: func(t *testing.T) []byte {
+				return serialize(t,
+					outerEthernet(layers.EthernetTypeIPv4),
+					outerIPv4(layers.IPProtocolUDP),
+					&layers.UDP{SrcPort: 50000, DstPort: 4789},
+					&layers.VXLAN{ValidIDFlag: true, VNI: 42},
+					gopacket.Payload(innerFrame(t)))
+			},
+		},
+		{
+			name:   "not encapsulated",
+			encaps: []string{VLAN, VXLAN, Geneve, GRE},
+			frame: func(t *testing.T) []byte {
+				return serialize(t, append([]gopacket.SerializableLayer{outerEthernet(layers.EthernetTypeIPv4)}, datagram()...)...)
+			},
+		},
+		{
+			name:   "neither Ethernet nor IP",
+			encaps: []string{GRE},
+			frame: func(t *testing.T) []byte {
+				return serialize(t,
+					outerEthernet(layers.EthernetTypeIPv4),
+					outerIPv4(layers.IPProtocolGRE),
+					&layers.GRE{Protocol: layers.EthernetTypeARP},
+					gopacket.Payload(make([]byte, 28)))
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := New(tt.encaps...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := tt.frame(t)
+			p := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+			md := p.Metadata()
+			md.Timestamp, md.InterfaceIndex = time.Unix(1700000000, 0), 3
+			md.CaptureLength, md.Length = len(data), len(data)
+
+			out, encap := d.Packet(p)
+			if encap != tt.encap {
+				t.Fatalf("peeled %q, want %q", encap, tt.encap)
+			}
+			if encap == "" {
+				if out != p {
+					t.Fatal("packet not returned as is")
+				}
+				return
+			}
+
+			eth, ok := out.LinkLayer().(*layers.Ethernet)
+			if !ok {
+				t.Fatalf("peeled packet without Ethernet: %v", out)
+			}
+			if !bytes.Equal(eth.SrcMAC, tt.src) {
+				t.Errorf("source MAC %v, want %v", eth.SrcMAC, tt.src)
+			}
+			ip, ok := out.NetworkLayer().(*layers.IPv4)
+			if !ok || !ip.SrcIP.Equal(net.IPv4(10, 0, 0, 1)) {
+				t.Fatalf("peeled network layer %v, want the tunneled one", out.NetworkLayer())
+			}
+			udp, ok := out.TransportLayer().(*layers.UDP)
+			if !ok || udp.SrcPort != 30303 || udp.DstPort != 30304 {
+				t.Fatalf("peeled transport layer %v, want the tunneled one", out.TransportLayer())
+			}
+			if !bytes.Equal(udp.Payload, payload) {
+				t.Errorf("payload %q, want %q", udp.Payload, payload)
+			}
+			got := out.Metadata()
+			if !got.Timestamp.Equal(md.Timestamp) || got.InterfaceIndex != md.InterfaceIndex {
+				t.Errorf("capture info %+v, want that of the outer packet %+v", got.CaptureInfo, md.CaptureInfo)
+			}
+			if got.CaptureLength != len(out.Data()) || got.Length != len(out.Data()) {
+				t.Errorf("lengths %d/%d, want %d", got.CaptureLength, got.Length, len(out.Data()))
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(VLAN, "mpls"); err == nil {
+		t.Error("unknown encapsulation accepted")
+	}
+	d, err := New(VXLAN, GRE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "(udp port 4789) or (ip[9] = 47 or ip6[6] = 47)"; d.Filter() != want {
+		t.Errorf("filter %q, want %q", d.Filter(), want)
+	}
+	if d, _ := New(); d.Filter() != "" {
+		t.Errorf("filter %q without encapsulations", d.Filter())
+	}
+}
@@ -0,0 +1,214 @@
+// Package defrag reassembles the IP datagrams of a capture that were split
+// into fragments, as happens to discovery packets larger than the path
+// MTU. IPv4 fragments are reassembled by gopacket's ip4defrag, IPv6
+// fragments, which it doesn't handle, by the package itself. Reassembled
+// datagrams are handed back as packets of their own, decoded like any
+// captured packet.
+package defrag
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
+	"github.com/google/gopacket/layers"
+	"sort"
+	"time"
+)
+
+// Fragments of a datagram are kept for Timeout after the latest one, as
+// the 60 seconds of RFC 8200 leave too much room to floods. At most
+// MaxDatagrams IPv6 datagrams are reassembled at once, each of at most
+// maxFragments fragments.
+const (
+	Timeout      = 30 * time.Second
+	MaxDatagrams = 4096
+	maxFragments = 64
+	maxSize      = 65535
+)
+
+// Errors of IPv6 reassembly.
+var (
+	ErrOverlap          = errors.New("overlapping IPv6 fragments")
+	ErrTooLarge         = errors.New("IPv6 datagram too large")
+	ErrTooManyFragments = errors.New("too many IPv6 fragments")
+	ErrTooManyDatagrams = errors.New("too many IPv6 datagrams being reassembled")
+)
+
+// Defragmenter reassembles fragmented datagrams. It is not safe for
+// concurrent use.
+type Defragmenter struct {
+	v4 *ip4defrag.IPv4Defragmenter
+	v6 map[v6Key]*v6Datagram
+
+	lastDiscard time.Time
+}
+
+type v6Key struct {
+	src, dst [16]byte
+	id       uint32
+}
+
+// v6Datagram holds the fragments of an IPv6 datagram received so far.
+type v6Datagram struct {
+	header *layers.IPv6 // of the first fragment
+	next   layers.IPProtocol
+	frags  []v6Fragment // by offset
+	size   int          // known once the last fragment arrived, -1 before
+	seen   time.Time
+}
+
+type v6Fragment struct {
+	off  int
+	data []byte
+}
+
+func New() *Defragmenter {
+	return &Defragmenter{
+		v4: ip4defrag.NewIPv4Defragmenter(),
+		v6: make(map[v6Key]*v6Datagram),
+	}
+}
+
+// Packet takes a captured packet. Packets that aren't fragments are
+// returned as is. Fragments are kept until their datagram is complete,
+// returning nil, and with the last one the whole datagram is returned as a
+// new packet with the link layer header and capture metadata of that
+// fragment; reassembled reports the latter. Fragments that can't be
+// reassembled return an error.
+func (d *Defragmenter) Packet(p gopacket.Packet) (out gopacket.Packet, reassembled bool, err error) {
+	now := p.Metadata().Timestamp
+	if now.Sub(d.lastDiscard) >= time.Second {
+		d.lastDiscard = now
+		d.discard(now.Add(-Timeout))
+	}
+
+	switch ip := p.NetworkLayer().(type) {
+	case *layers.IPv4:
+		if ip.Flags&layers.IPv4MoreFragments == 0 && ip.FragOffset == 0 {
+			return p, false, nil
+		}
+		whole, err := d.v4.DefragIPv4WithTimestamp(ip, now)
+		if err != nil || whole == nil {
+			return nil, false, err
+		}
+		out, err := rebuild(p, whole, whole.Payload)
+		return out, err == nil, err
+
+	case *layers.IPv6:
+		frag, ok := p.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment)
+		if !ok {
+			return p, false, nil
+		}
+		header, payload, err := d.insertV6(ip, frag, now)
+		if err != nil || header == nil {
+			return nil, false, err
+		}
+		out, err := rebuild(p, header, payload)
+		return out, err == nil, err
+	}
+	return p, false, nil
+}
+
+// insertV6 adds a fragment to its datagram, returning the header and
+// payload of the datagram once complete.
+func (d *Defragmenter) insertV6(ip *layers.IPv6, frag *layers.IPv6Fragment, now time.Time) (*layers.IPv6, []byte, error) {
+	key := v6Key{id: frag.Identification}
+	copy(key.src[:], ip.SrcIP.To16())
+	copy(key.dst[:], ip.DstIP.To16())
+	dg := d.v6[key]
+	if dg == nil {
+		if len(d.v6) >= MaxDatagrams {
+			return nil, nil, ErrTooManyDatagrams
+		}
+		dg = &v6Datagram{size: -1}
+		d.v6[key] = dg
+	}
+	dg.seen = now
+
+	off, data := int(frag.FragmentOffset)*8, frag.LayerPayload()
+	end := off + len(data)
+	fail := func(err error) (*layers.IPv6, []byte, error) {
+		delete(d.v6, key)
+		return nil, nil, err
+	}
+	switch {
+	case end > maxSize:
+		return fail(ErrTooLarge)
+	case len(dg.frags) >= maxFragments:
+		return fail(ErrTooManyFragments)
+	case !frag.MoreFragments:
+		if dg.size >= 0 && dg.size != end {
+			return fail(ErrOverlap)
+		}
+		if n := len(dg.frags); n > 0 && dg.frags[n-1].off+len(dg.frags[n-1].data) > end {
+			return fail(ErrOverlap)
+		}
+		dg.size = end
+	}
+	if off == 0 {
+		h := *ip
+		dg.header, dg.next = &h, frag.NextHeader
+	}
+
+	// Overlapping fragments are dropped with their datagram, as RFC 5722
+	// requires.
+	i := sort.Search(len(dg.frags), func(i int) bool { return dg.frags[i].off >= off })
+	if i > 0 && dg.frags[i-1].off+len(dg.frags[i-1].data) > off || i < len(dg.frags) && dg.frags[i].off < end {
+		return fail(ErrOverlap)
+	}
+	if dg.size >= 0 && end > dg.size {
+		return fail(ErrOverlap)
+	}
+	dg.frags = append(dg.frags, v6Fragment{})
+	copy(dg.frags[i+1:], dg.frags[i:])
+	dg.frags[i] = v6Fragment{off: off, data: append([]byte(nil), data...)}
+
+	if dg.size < 0 || dg.header == nil {
+		return nil, nil, nil
+	}
+	payload := make([]byte, 0, dg.size)
+	for _, f := range dg.frags {
+		if f.off != len(payload) {
+			return nil, nil, nil // a hole left
+		}
+		payload = append(payload, f.data...)
+	}
+	delete(d.v6, key)
+	h := dg.header
+	h.NextHeader, h.HopByHop = dg.next, nil
+	return h, payload, nil
+}
+
+// discard forgets the datagrams without fragments since t.
+func (d *Defragmenter) discard(t time.Time) {
+	d.v4.DiscardOlderThan(t)
+	for key, dg := range d.v6 {
+		if dg.seen.Before(t) {
+			delete(d.v6, key)
+		}
+	}
+}
+
+// rebuild returns a packet of the datagram with the given header and
+// payload, behind the link layer headers of p.
+func rebuild(p gopacket.Packet, header gopacket.SerializableLayer, payload []byte) (gopacket.Packet, error) {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, header, gopacket.Payload(payload)); err != nil {
+		return nil, err
+	}
+	var data []byte
+	for _, l := range p.Layers() {
+		if l == p.NetworkLayer() {
+			break
+		}
+		data = append(data, l.LayerContents()...)
+	}
+	data = append(data, buf.Bytes()...)
+
+	out := gopacket.NewPacket(data, p.Layers()[0].LayerType(), gopacket.Default)
+	md := out.Metadata()
+	md.CaptureInfo = p.Metadata().CaptureInfo
+	md.CaptureLength, md.Length = len(data), len(data)
+	return out, nil
+}
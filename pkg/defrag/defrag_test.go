@@ -0,0 +1,339 @@
+package defrag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"net"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// datagram returns a UDP datagram carrying n bytes of payload.
+func datagram(n int) []byte {
+	data := make([]byte, 8+n)
+	binary.BigEndian.PutUint16(data[0:], 30303)
+	binary.BigEndian.PutUint16(data[2:], 30303)
+	binary.BigEndian.PutUint16(data[4:], uint16(len(data)))
+	for i := 8; i < len(data); i++ {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+// fragment is a fragment of a datagram, data starting at byte off of it.
+type fragment struct {
+	off  int
+	data []byte
+	more bool
+}
+
+// split cuts data into fragments of size bytes, the last one shorter.
+func split(data []byte, size int) []fragment {
+	var frags []fragment
+	for off := 0; off < len(data); off += size {
+		end := off + size
+		if end > len(data) {
+			end = len(data)
+		}
+		frags = append(frags, fragment{off: off, data: data[off:end], more: end < len(data)})
+	}
+	return frags
+}
+
+// packet serializes f as captured at ts, an IPv4 fragment or, with v6, an
+// IPv6 one with a fragment header, of the datagram id.
+func packet(t *testing.T, v6 bool, id uint32, f fragment, ts time.Time) gopacket.Packet {
+	t.Helper()
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	var ip gopacket.SerializableLayer
+	payload := f.data
+	if v6 {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip = &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolIPv6Fragment,
+			SrcIP:      net.ParseIP("2001:db8::1"),
+			DstIP:      net.ParseIP("2001:db8::2"),
+		}
+		// gopacket can't serialize fragment headers.
+		header := make([]byte, 8)
+		header[0] = byte(layers.IPProtocolUDP)
+		binary.BigEndian.PutUint16(header[2:], uint16(f.off/8)<<3)
+		if f.more {
+			header[3] |= 1
+		}
+		binary.BigEndian.PutUint32(header[4:], id)
+		payload = append(header, f.data...)
+	} else {
+		ip4 := &layers.IPv4{
+			Version:    4,
+			IHL:        5,
+			TTL:        64,
+			Id:         uint16(id),
+			FragOffset: uint16(f.off / 8),
+			Protocol:   layers.IPProtocolUDP,
+			SrcIP:      net.IPv4(10, 0, 0, 1),
+			DstIP:      net.IPv4(10, 0, 0, 2),
+		}
+		if f.more {
+			ip4.Flags = layers.IPv4MoreFragments
+		}
+		ip = ip4
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, eth, ip, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	p := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	p.Metadata().Timestamp = ts
+	return p
+}
+
+// feed passes the fragments of datagram id through d in the given order,
+// one second apart, returning the packet and error of the last one.
+func feed(t *testing.T, d *Defragmenter, v6 bool, id uint32, frags []fragment, order []int) (gopacket.Packet, error) {
+	t.Helper()
+	for n, i := range order {
+		p, reassembled, err := d.Packet(packet(t, v6, id, frags[i], t0.Add(time.Duration(n)*time.Second)))
+		if n == len(order)-1 || err != nil {
+			if reassembled != (p != nil) {
+				t.Fatalf("reassembled %v, packet %v", reassembled, p)
+			}
+			return p, err
+		}
+		if p != nil {
+			t.Fatalf("fragment %d of %v: datagram complete", i, order)
+		}
+	}
+	return nil, nil
+}
+
+// sameDatagram checks p is the reassembled datagram, captured with the
+// last fragment at.
+func sameDatagram(t *testing.T, p gopacket.Packet, want []byte, at time.Time) {
+	t.Helper()
+	if p == nil {
+		t.Fatal("datagram not reassembled")
+	}
+	udp, ok := p.TransportLayer().(*layers.UDP)
+	if !ok {
+		t.Fatalf("reassembled packet without UDP: %v", p)
+	}
+	if got := append(udp.LayerContents(), udp.LayerPayload()...); !bytes.Equal(got, want) {
+		t.Fatalf("reassembled %d bytes, want %d", len(got), len(want))
+	}
+	if _, ok := p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); !ok {
+		t.Error("link layer lost")
+	}
+	if md := p.Metadata(); !md.Timestamp.Equal(at) || md.CaptureLength != len(p.Data()) {
+		t.Errorf("metadata %+v, want captured at %v", md.CaptureInfo, at)
+	}
+}
+
+func TestUnfragmented(t *testing.T) {
+	d := New()
+	for _, v6 := range []bool{false, true} {
+		p := packet(t, v6, 1, fragment{data: datagram(100)}, t0)
+		if v6 {
+			// Without a fragment header.
+			p = gopacket.NewPacket(p.Data(), layers.LayerTypeEthernet, gopacket.Default)
+			ip := p.NetworkLayer().(*layers.IPv6)
+			ip.NextHeader = layers.IPProtocolUDP
+			buf := gopacket.NewSerializeBuffer()
+			if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, p.LinkLayer().(*layers.Ethernet), ip, gopacket.Payload(datagram(100))); err != nil {
+				t.Fatal(err)
+			}
+			p = gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+		}
+		out, reassembled, err := d.Packet(p)
+		if out != p || reassembled || err != nil {
+			t.Errorf("v6=%v: packet %v, reassembled %v, error %v, want it as is", v6, out, reassembled, err)
+		}
+	}
+}
+
+func TestReassemble(t *testing.T) {
+	data := datagram(3000)
+	frags := split(data, 1000) // four fragments, the last of 8 bytes
+	for _, order := range [][]int{
+		{0, 1, 2, 3},
+		{3, 2, 1, 0},
+		{1, 3, 0, 2},
+		{2, 0, 3, 1},
+	} {
+		for _, v6 := range []bool{false, true} {
+			t.Run(fmt.Sprintf("v6=%v/%v", v6, order), func(t *testing.T) {
+				p, err := feed(t, New(), v6, 7, frags, order)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sameDatagram(t, p, data, t0.Add(time.Duration(len(order)-1)*time.Second))
+			})
+		}
+	}
+}
+
+// TestHole checks datagrams are held until their holes are filled, apart
+// from the other datagrams between the same hosts.
+func TestHole(t *testing.T) {
+	data, other := datagram(3000), datagram(2000)
+	frags, otherFrags := split(data, 1000), split(other, 1000)
+	for _, v6 := range []bool{false, true} {
+		d := New()
+		if p, err := feed(t, d, v6, 1, frags, []int{0, 3, 1}); p != nil || err != nil {
+			t.Fatalf("v6=%v: datagram with a hole: packet %v, error %v", v6, p, err)
+		}
+		p, err := feed(t, d, v6, 2, otherFrags, []int{2, 1, 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sameDatagram(t, p, other, t0.Add(2*time.Second))
+		p, err = feed(t, d, v6, 1, frags, []int{2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sameDatagram(t, p, data, t0)
+	}
+}
+
+func TestOverlapV6(t *testing.T) {
+	data := datagram(3000)
+	frags := split(data, 1000)
+	tests := []struct {
+		name  string
+		frags []fragment
+	}{
+		{"duplicate", []fragment{frags[0], frags[1], frags[1]}},
+		{"overlapping the previous", []fragment{frags[0], {off: 992, data: data[992:2000], more: true}}},
+		{"overlapping the next", []fragment{frags[1], {off: 0, data: data[:1008], more: true}}},
+		{"beyond the last", []fragment{frags[3], {off: 3000, data: data[:8], more: true}}},
+		{"last before others", []fragment{frags[2], {off: 1000, data: data[1000:1008]}}},
+		{"two lasts", []fragment{frags[3], {off: 2000, data: data[2000:2008]}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := New()
+			order := make([]int, len(tt.frags))
+			for i := range order {
+				order[i] = i
+			}
+			if _, err := feed(t, d, true, 1, tt.frags, order); !errors.Is(err, ErrOverlap) {
+				t.Fatalf("error %v, want %v", err, ErrOverlap)
+			}
+			if len(d.v6) != 0 {
+				t.Fatal("datagram kept after an overlap")
+			}
+			// Fragments arriving later start the datagram anew.
+			if p, err := feed(t, d, true, 1, frags, []int{3, 1, 2}); p != nil || err != nil {
+				t.Fatalf("packet %v, error %v, want the datagram incomplete", p, err)
+			}
+		})
+	}
+}
+
+// TestOverlapV4 checks exact duplicates of IPv4 fragments are taken, as
+// retransmissions, while overlapping fragments never make a datagram.
+func TestOverlapV4(t *testing.T) {
+	data := datagram(3000)
+	frags := split(data, 1000)
+	d := New()
+	p, err := feed(t, d, false, 1, []fragment{frags[0], frags[1], frags[1], frags[2], frags[3]}, []int{0, 1, 2, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameDatagram(t, p, data, t0.Add(4*time.Second))
+
+	overlapping := fragment{off: 992, data: make([]byte, 1008), more: true}
+	p, err = feed(t, d, false, 2, []fragment{frags[0], overlapping, frags[2], frags[3]}, []int{0, 1, 2, 3})
+	if p != nil {
+		t.Fatalf("datagram of overlapping fragments reassembled, error %v", err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	data := datagram(3000)
+	frags := split(data, 1000)
+	for _, v6 := range []bool{false, true} {
+		d := New()
+		if p, err := feed(t, d, v6, 1, frags, []int{0}); p != nil || err != nil {
+			t.Fatalf("v6=%v: packet %v, error %v", v6, p, err)
+		}
+		// The first fragment is evicted once the others arrive Timeout
+		// later.
+		for _, i := range []int{1, 2, 3} {
+			p, _, err := d.Packet(packet(t, v6, 1, frags[i], t0.Add(Timeout+time.Duration(i)*time.Second)))
+			if p != nil || err != nil {
+				t.Fatalf("v6=%v: packet %v, error %v, want the datagram incomplete", v6, p, err)
+			}
+		}
+		// Within the timeout, it completes the datagram again.
+		p, _, err := d.Packet(packet(t, v6, 1, frags[0], t0.Add(Timeout+10*time.Second)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sameDatagram(t, p, data, t0.Add(Timeout+10*time.Second))
+	}
+}
+
+func TestLimitsV6(t *testing.T) {
+	t.Run("too large", func(t *testing.T) {
+		d := New()
+		_, _, err := d.Packet(packet(t, true, 1, fragment{off: 65528, data: make([]byte, 16), more: true}, t0))
+		if !errors.Is(err, ErrTooLarge) {
+			t.Fatalf("error %v, want %v", err, ErrTooLarge)
+		}
+	})
+	t.Run("too many fragments", func(t *testing.T) {
+		d := New()
+		frags := split(datagram(1000), 8)
+		order := make([]int, maxFragments+1)
+		for i := range order {
+			order[i] = i
+		}
+		if _, err := feed(t, d, true, 1, frags, order); !errors.Is(err, ErrTooManyFragments) {
+			t.Fatalf("error %v, want %v", err, ErrTooManyFragments)
+		}
+		if len(d.v6) != 0 {
+			t.Fatal("datagram kept past the fragment limit")
+		}
+	})
+	t.Run("too many datagrams", func(t *testing.T) {
+		d := New()
+		first := split(datagram(1000), 504)[0]
+		for id := uint32(0); id < MaxDatagrams; id++ {
+			if _, _, err := d.Packet(packet(t, true, id, first, t0)); err != nil {
+				t.Fatalf("datagram %d: %v", id, err)
+			}
+		}
+		if _, _, err := d.Packet(packet(t, true, MaxDatagrams, first, t0)); !errors.Is(err, ErrTooManyDatagrams) {
+			t.Fatalf("error %v, want %v", err, ErrTooManyDatagrams)
+		}
+		// Fragments of the datagrams being reassembled are still taken,
+		// and room is made as they time out.
+		if _, _, err := d.Packet(packet(t, true, 0, split(datagram(1000), 504)[1], t0)); err != nil {
+			t.Fatalf("fragment of a datagram being reassembled: %v", err)
+		}
+		if _, _, err := d.Packet(packet(t, true, MaxDatagrams, first, t0.Add(Timeout+time.Second))); err != nil {
+			t.Fatalf("after the timeout: %v", err)
+		}
+	})
+}
+
+func TestLimitsV4(t *testing.T) {
+	d := New()
+	_, _, err := d.Packet(packet(t, false, 1, fragment{off: 65528, data: make([]byte, 16), more: true}, t0))
+	if err == nil {
+		t.Fatal("fragment beyond the largest datagram taken")
+	}
+}
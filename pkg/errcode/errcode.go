@@ -0,0 +1,114 @@
+// Package errcode assigns stable codes to decoding failures, such as D4-001
+// for a discv4 packet with a bad hash, so dashboards and automation can key
+// off codes rather than error messages, which may change between releases.
+//
+// Protocol packages register their codes at init time; the taxonomy of a
+// program covers the packages it links.
+package errcode
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Code identifies a class of decoding failures. Once assigned, the ID and
+// name of a code never change meaning.
+type Code struct {
+	ID          string `json:"id"`   // such as D4-001
+	Name        string `json:"name"` // such as bad-hash
+	Protocol    string `json:"protocol"`
+	Description string `json:"description"`
+}
+
+// String returns the ID and name of the code, as in D4-001/bad-hash.
+func (c Code) String() string {
+	return c.ID + "/" + c.Name
+}
+
+var (
+	mu       sync.RWMutex
+	registry = make(map[string]Code)
+)
+
+// Register adds a code to the taxonomy. It panics if id is already taken,
+// which is a programming error.
+func Register(id, name, protocol, description string) Code {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := registry[id]; ok {
+		panic("errcode: duplicate code " + id)
+	}
+	c := Code{ID: id, Name: name, Protocol: protocol, Description: description}
+	registry[id] = c
+	return c
+}
+
+// Taxonomy returns every registered code, sorted by ID.
+func Taxonomy() []Code {
+	mu.RLock()
+	codes := make([]Code, 0, len(registry))
+	for _, c := range registry {
+		codes = append(codes, c)
+	}
+	mu.RUnlock()
+	sort.Slice(codes, func(i, j int) bool { return codes[i].ID < codes[j].ID })
+	return codes
+}
+
+// Lookup returns the registered code with the given ID.
+func Lookup(id string) (Code, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := registry[id]
+	return c, ok
+}
+
+// Error is a decoding failure tagged with its code. Its message is that of
+// the failure alone, the code is carried on the side.
+type Error struct {
+	Code Code
+	msg  string
+	err  error
+}
+
+// New returns an error with the given code and message, meant to be
+// declared once and compared against.
+func New(c Code, msg string) *Error {
+	return &Error{Code: c, msg: msg}
+}
+
+// Errorf returns an error with the given code and a formatted message.
+func Errorf(c Code, format string, args ...interface{}) *Error {
+	return &Error{Code: c, msg: fmt.Sprintf(format, args...)}
+}
+
+// Wrap tags err with a code, returning nil if err is nil.
+func Wrap(c Code, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Code: c, msg: err.Error(), err: err}
+}
+
+func (e *Error) Error() string { return e.msg }
+func (e *Error) Unwrap() error { return e.err }
+
+// Of returns the code of the first error in err's chain that has one.
+func Of(err error) (Code, bool) {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code, true
+	}
+	return Code{}, false
+}
+
+// ID returns the code ID of err, or "unknown" for errors without a code.
+func ID(err error) string {
+	if c, ok := Of(err); ok {
+		return c.ID
+	}
+	return "unknown"
+}
@@ -0,0 +1,340 @@
+// Package enr decodes Ethereum Node Records (EIP-778) as carried by
+// discovery packets, with typed accessors for the standard entries, and
+// formats them for people and as JSON.
+package enr
+
+import (
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/eth"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	gethenr "github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Keys of the entries with typed accessors.
+const (
+	KeyID        = "id"
+	KeySecp256k1 = "secp256k1"
+	KeyIP        = "ip"
+	KeyIP6       = "ip6"
+	KeyTCP       = "tcp"
+	KeyTCP6      = "tcp6"
+	KeyUDP       = "udp"
+	KeyUDP6      = "udp6"
+	KeyEth       = "eth"
+)
+
+var knownKeys = map[string]bool{
+	KeyID: true, KeySecp256k1: true, KeyIP: true, KeyIP6: true,
+	KeyTCP: true, KeyTCP6: true, KeyUDP: true, KeyUDP6: true, KeyEth: true,
+}
+
+// Pair is a key/value entry of a record, the value still RLP encoded.
+type Pair struct {
+	Key   string
+	Value rlp.RawValue
+}
+
+// Record is a decoded node record.
+type Record struct {
+	Seq       uint64
+	Signature []byte
+	Pairs     []Pair // every entry, in key order
+
+	// NodeID is the node the record belongs to. It is only set, and
+	// Verified true, if the signature is valid for its identity scheme.
+	NodeID   enode.ID
+	Verified bool
+
+	r *gethenr.Record
+}
+
+// New decodes the entries of r.
+func New(r *gethenr.Record) *Record {
+	rec := &Record{Seq: r.Seq(), Signature: r.Signature(), r: r}
+	elems := r.AppendElements(nil)
+	for i := 1; i+1 < len(elems); i += 2 {
+		k, _ := elems[i].(string)
+		v, _ := elems[i+1].(rlp.RawValue)
+		rec.Pairs = append(rec.Pairs, Pair{Key: k, Value: v})
+	}
+	if n, err := enode.New(enode.ValidSchemes, r); err == nil {
+		rec.NodeID, rec.Verified = n.ID(), true
+	}
+	return rec
+}
+
+// Decode decodes an RLP encoded record.
+func Decode(data []byte) (*Record, error) {
+	var r gethenr.Record
+	if err := rlp.DecodeBytes(data, &r); err != nil {
+		return nil, err
+	}
+	return New(&r), nil
+}
+
+// Parse decodes the textual form of a record, "enr:" followed by its
+// base64 encoding.
+func Parse(text string) (*Record, error) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "enr:") {
+		return nil, fmt.Errorf("missing \"enr:\" prefix")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(text[4:])
+	if err != nil {
+		return nil, err
+	}
+	return Decode(data)
+}
+
+// FromPacket returns the records carried by a decoded discovery packet: the
+// record of a discv4 ENRResponse, the sender's record sent with a discv5
+// handshake and the records of discv5 NODES responses.
+func FromPacket(p interface{}) []*Record {
+	var records []*Record
+	switch p := p.(type) {
+	case *discv4.ENRResponse:
+		records = append(records, New(&p.Record))
+	case *discv5.Handshake:
+		if p.Record != nil {
+			records = append(records, New(p.Record))
+		}
+		records = append(records, FromPacket(p.Body)...)
+	case *discv5.Message:
+		records = append(records, FromPacket(p.Body)...)
+	case *discv5.Nodes:
+		for _, r := range p.Nodes {
+			records = append(records, New(r))
+		}
+	}
+	return records
+}
+
+// Record returns the go-ethereum form of the record.
+func (r *Record) Record() *gethenr.Record {
+	return r.r
+}
+
+// Text returns the textual form of the record.
+func (r *Record) Text() string {
+	data, err := rlp.EncodeToBytes(r.r)
+	if err != nil {
+		return ""
+	}
+	return "enr:" + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Get returns the raw value of the entry key.
+func (r *Record) Get(key string) (rlp.RawValue, bool) {
+	i := sort.Search(len(r.Pairs), func(i int) bool { return r.Pairs[i].Key >= key })
+	if i < len(r.Pairs) && r.Pairs[i].Key == key {
+		return r.Pairs[i].Value, true
+	}
+	return nil, false
+}
+
+// Unknown returns the entries without typed accessors, such as those of
+// consensus clients.
+func (r *Record) Unknown() []Pair {
+	var pairs []Pair
+	for _, p := range r.Pairs {
+		if !knownKeys[p.Key] {
+			pairs = append(pairs, p)
+		}
+	}
+	return pairs
+}
+
+func (r *Record) load(key string, v interface{}) bool {
+	raw, ok := r.Get(key)
+	return ok && rlp.DecodeBytes(raw, v) == nil
+}
+
+// ID returns the identity scheme, "v4" for secp256k1 signed records.
+func (r *Record) ID() string {
+	var id string
+	r.load(KeyID, &id)
+	return id
+}
+
+// IP returns the IPv4 address of the node.
+func (r *Record) IP() (net.IP, bool) {
+	return r.ip(KeyIP, net.IPv4len)
+}
+
+// IP6 returns the IPv6 address of the node.
+func (r *Record) IP6() (net.IP, bool) {
+	return r.ip(KeyIP6, net.IPv6len)
+}
+
+func (r *Record) ip(key string, size int) (net.IP, bool) {
+	var ip []byte
+	if !r.load(key, &ip) || len(ip) != size {
+		return nil, false
+	}
+	return net.IP(ip), true
+}
+
+// TCP returns the TCP port of the IPv4 address.
+func (r *Record) TCP() (uint16, bool) { return r.port(KeyTCP) }
+
+// UDP returns the UDP port of the IPv4 address.
+func (r *Record) UDP() (uint16, bool) { return r.port(KeyUDP) }
+
+// TCP6 returns the TCP port of the IPv6 address.
+func (r *Record) TCP6() (uint16, bool) { return r.port(KeyTCP6) }
+
+// UDP6 returns the UDP port of the IPv6 address.
+func (r *Record) UDP6() (uint16, bool) { return r.port(KeyUDP6) }
+
+func (r *Record) port(key string) (uint16, bool) {
+	var port uint16
+	ok := r.load(key, &port)
+	return port, ok
+}
+
+// Pubkey returns the compressed secp256k1 public key of the node.
+func (r *Record) Pubkey() ([]byte, bool) {
+	var key []byte
+	if !r.load(KeySecp256k1, &key) || len(key) != 33 {
+		return nil, false
+	}
+	return key, true
+}
+
+// PublicKey returns the decompressed secp256k1 public key of the node.
+func (r *Record) PublicKey() (*ecdsa.PublicKey, error) {
+	key, ok := r.Pubkey()
+	if !ok {
+		return nil, fmt.Errorf("no secp256k1 key")
+	}
+	return crypto.DecompressPubkey(key)
+}
+
+// ForkID returns the fork ID of the eth entry, advertised by execution
+// clients.
+func (r *Record) ForkID() (eth.ForkID, bool) {
+	var entry eth.ENREntry
+	if !r.load(KeyEth, &entry) {
+		return eth.ForkID{}, false
+	}
+	return entry.ForkID, true
+}
+
+// String formats the record for people, one entry per line.
+func (r *Record) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "enr seq=%d id=%s", r.Seq, r.ID())
+	if r.Verified {
+		fmt.Fprintf(&b, " node=%s", r.NodeID)
+	} else {
+		b.WriteString(" (invalid signature)")
+	}
+	for _, p := range r.Pairs {
+		if p.Key == KeyID {
+			continue
+		}
+		fmt.Fprintf(&b, "\n  %-10s %s", p.Key, r.format(p))
+	}
+	return b.String()
+}
+
+// format renders the value of an entry, unknown ones as hex.
+func (r *Record) format(p Pair) string {
+	switch p.Key {
+	case KeyIP:
+		if ip, ok := r.IP(); ok {
+			return ip.String()
+		}
+	case KeyIP6:
+		if ip, ok := r.IP6(); ok {
+			return ip.String()
+		}
+	case KeyTCP, KeyUDP, KeyTCP6, KeyUDP6:
+		if port, ok := r.port(p.Key); ok {
+			return strconv.Itoa(int(port))
+		}
+	case KeySecp256k1:
+		if key, ok := r.Pubkey(); ok {
+			return hex.EncodeToString(key)
+		}
+	case KeyEth:
+		if id, ok := r.ForkID(); ok {
+			return fmt.Sprintf("fork 0x%x next %d", id.Hash, id.Next)
+		}
+	}
+	return "0x" + hex.EncodeToString(p.Value)
+}
+
+// recordJSON is the JSON form of a record. Absent entries are omitted and
+// unknown ones keyed by name with their raw value in hex.
+type recordJSON struct {
+	Seq       uint64            `json:"seq"`
+	NodeID    string            `json:"node_id,omitempty"`
+	Verified  bool              `json:"verified"`
+	ID        string            `json:"id,omitempty"`
+	Secp256k1 string            `json:"secp256k1,omitempty"`
+	IP        string            `json:"ip,omitempty"`
+	TCP       *uint16           `json:"tcp,omitempty"`
+	UDP       *uint16           `json:"udp,omitempty"`
+	IP6       string            `json:"ip6,omitempty"`
+	TCP6      *uint16           `json:"tcp6,omitempty"`
+	UDP6      *uint16           `json:"udp6,omitempty"`
+	Eth       *forkIDJSON       `json:"eth,omitempty"`
+	Unknown   map[string]string `json:"unknown,omitempty"`
+	Signature string            `json:"signature"`
+	Text      string            `json:"enr"`
+}
+
+type forkIDJSON struct {
+	Hash string `json:"hash"`
+	Next uint64 `json:"next"`
+}
+
+func (r *Record) MarshalJSON() ([]byte, error) {
+	out := recordJSON{
+		Seq:       r.Seq,
+		Verified:  r.Verified,
+		ID:        r.ID(),
+		Signature: hex.EncodeToString(r.Signature),
+		Text:      r.Text(),
+	}
+	if r.Verified {
+		out.NodeID = r.NodeID.String()
+	}
+	if key, ok := r.Pubkey(); ok {
+		out.Secp256k1 = hex.EncodeToString(key)
+	}
+	if ip, ok := r.IP(); ok {
+		out.IP = ip.String()
+	}
+	if ip, ok := r.IP6(); ok {
+		out.IP6 = ip.String()
+	}
+	for key, port := range map[string]**uint16{KeyTCP: &out.TCP, KeyUDP: &out.UDP, KeyTCP6: &out.TCP6, KeyUDP6: &out.UDP6} {
+		if v, ok := r.port(key); ok {
+			*port = &v
+		}
+	}
+	if id, ok := r.ForkID(); ok {
+		out.Eth = &forkIDJSON{Hash: "0x" + hex.EncodeToString(id.Hash[:]), Next: id.Next}
+	}
+	for _, p := range r.Unknown() {
+		if out.Unknown == nil {
+			out.Unknown = make(map[string]string)
+		}
+		out.Unknown[p.Key] = "0x" + hex.EncodeToString(p.Value)
+	}
+	return json.Marshal(out)
+}
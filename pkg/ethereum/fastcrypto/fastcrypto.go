@@ -0,0 +1,250 @@
+// Package fastcrypto provides the hashing and cipher primitives used on the
+// packet decoding hot path. They avoid the allocations and key schedules
+// the plain go-ethereum and standard library calls pay on every packet:
+// hash states and expanded AES keys are reused across calls. Hardware
+// acceleration is left to the underlying implementations, crypto/aes using
+// AES-NI or the ARMv8 AES instructions where available.
+//
+// Where several implementations of a primitive exist, the fastest on the
+// running CPU is picked by a short benchmark, once, before the primitive is
+// first used, so that it never changes under concurrent callers.
+package fastcrypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/sys/cpu"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBudget is the time each implementation is benchmarked for when a
+// primitive is used before Select is called.
+const DefaultBudget = 2 * time.Millisecond
+
+// Impl is a named implementation of a primitive.
+type Impl struct {
+	Name string
+	// Throughput is the measured speed of the implementation in bytes per
+	// second, set by Select.
+	Throughput float64
+}
+
+var (
+	keccakImpls = map[string]func([]byte) []byte{
+		"alloc":  func(data []byte) []byte { return crypto.Keccak256(data) },
+		"pooled": pooledKeccak256,
+	}
+	ctrImpls = map[string]func(key, iv []byte) (cipher.Stream, error){
+		"expand": expandCTR,
+		"cached": cachedCTR,
+	}
+
+	// The selected implementations, only written by Select under once.
+	selectOnce sync.Once
+	selection  Selection
+	keccak256  = pooledKeccak256
+	newCTR     = cachedCTR
+)
+
+// Keccak256 returns the legacy Keccak-256 digest of data.
+func Keccak256(data []byte) []byte {
+	Select(DefaultBudget)
+	return keccak256(data)
+}
+
+// NewCTR returns an AES-CTR stream for the given key and IV.
+func NewCTR(key, iv []byte) (cipher.Stream, error) {
+	Select(DefaultBudget)
+	return newCTR(key, iv)
+}
+
+var keccakPool = sync.Pool{
+	New: func() interface{} { return crypto.NewKeccakState() },
+}
+
+// pooledKeccak256 reuses hash states across calls.
+func pooledKeccak256(data []byte) []byte {
+	h := keccakPool.Get().(crypto.KeccakState)
+	h.Reset()
+	h.Write(data)
+	out := make([]byte, 32)
+	h.Read(out)
+	keccakPool.Put(h)
+	return out
+}
+
+// hashState is a pooled hash state along with room for its digest.
+type hashState struct {
+	k   crypto.KeccakState
+	sum [32]byte
+}
+
+var hashPool = sync.Pool{
+	New: func() interface{} { return &hashState{k: crypto.NewKeccakState()} },
+}
+
+// Keccak256Hash returns the digest of data as an array, which unlike the
+// slice of Keccak256 needn't be allocated.
+func Keccak256Hash(data []byte) [32]byte {
+	s := hashPool.Get().(*hashState)
+	s.k.Reset()
+	s.k.Write(data)
+	// Reading into h directly would move it to the heap.
+	s.k.Read(s.sum[:])
+	h := s.sum
+	hashPool.Put(s)
+	return h
+}
+
+// maxCachedBlocks bounds the number of expanded AES keys kept around. Masking
+// keys are derived from destination node IDs, of which a capture typically
+// has very few.
+const maxCachedBlocks = 1024
+
+var blockCache = struct {
+	sync.Mutex
+	m map[string]cipher.Block
+}{m: make(map[string]cipher.Block)}
+
+// expandCTR performs the AES key expansion on every call.
+func expandCTR(key, iv []byte) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, iv), nil
+}
+
+// cachedCTR keeps expanded AES keys, so repeated keys skip the key schedule.
+func cachedCTR(key, iv []byte) (cipher.Stream, error) {
+	blockCache.Lock()
+	block, ok := blockCache.m[string(key)]
+	if !ok {
+		var err error
+		if block, err = aes.NewCipher(key); err != nil {
+			blockCache.Unlock()
+			return nil, err
+		}
+		if len(blockCache.m) >= maxCachedBlocks {
+			blockCache.m = make(map[string]cipher.Block)
+		}
+		blockCache.m[string(key)] = block
+	}
+	blockCache.Unlock()
+	return cipher.NewCTR(block, iv), nil
+}
+
+// Features returns the hardware acceleration features relevant to the
+// primitives of this package that are available on the running CPU.
+func Features() []string {
+	var f []string
+	switch runtime.GOARCH {
+	case "amd64", "386":
+		if cpu.X86.HasAES {
+			f = append(f, "aes-ni")
+		}
+		if cpu.X86.HasPCLMULQDQ {
+			f = append(f, "pclmulqdq")
+		}
+		if cpu.X86.HasAVX2 {
+			f = append(f, "avx2")
+		}
+		if cpu.X86.HasBMI2 {
+			f = append(f, "bmi2")
+		}
+	case "arm64":
+		if cpu.ARM64.HasAES {
+			f = append(f, "aes")
+		}
+		if cpu.ARM64.HasPMULL {
+			f = append(f, "pmull")
+		}
+		if cpu.ARM64.HasSHA3 {
+			f = append(f, "sha3")
+		}
+	}
+	return f
+}
+
+// Selection is the outcome of Select.
+type Selection struct {
+	Features []string
+	Keccak   []Impl
+	CTR      []Impl
+}
+
+func (s Selection) String() string {
+	name := func(impls []Impl) string {
+		if len(impls) == 0 {
+			return "none"
+		}
+		return fmt.Sprintf("%s (%.0f MB/s)", impls[0].Name, impls[0].Throughput/1e6)
+	}
+	features := "none"
+	if len(s.Features) > 0 {
+		features = strings.Join(s.Features, ",")
+	}
+	return fmt.Sprintf("cpu=%s keccak=%s aes-ctr=%s", features, name(s.Keccak), name(s.CTR))
+}
+
+// Select benchmarks every implementation for roughly budget each on a
+// packet-sized input and makes the fastest one that used by the primitives
+// of this package. The returned implementations are ordered fastest first.
+//
+// Only the first call benchmarks, later ones return its outcome whatever
+// their budget. Calling Select before decoding starts keeps the benchmarks
+// off the first packets.
+func Select(budget time.Duration) Selection {
+	selectOnce.Do(func() {
+		buf := make([]byte, 1280)
+		key, iv := make([]byte, 16), make([]byte, 16)
+
+		s := Selection{Features: Features()}
+		for name, f := range keccakImpls {
+			f := f
+			s.Keccak = append(s.Keccak, bench(name, budget, len(buf), func() { f(buf) }))
+		}
+		for name, f := range ctrImpls {
+			f := f
+			s.CTR = append(s.CTR, bench(name, budget, len(buf), func() {
+				stream, err := f(key, iv)
+				if err == nil {
+					stream.XORKeyStream(buf, buf)
+				}
+			}))
+		}
+		sortImpls(s.Keccak)
+		sortImpls(s.CTR)
+
+		keccak256 = keccakImpls[s.Keccak[0].Name]
+		newCTR = ctrImpls[s.CTR[0].Name]
+		selection = s
+	})
+	return selection
+}
+
+func bench(name string, budget time.Duration, size int, f func()) Impl {
+	var (
+		n     int
+		start = time.Now()
+	)
+	for time.Since(start) < budget {
+		for i := 0; i < 64; i++ {
+			f()
+		}
+		n += 64
+	}
+	return Impl{Name: name, Throughput: float64(n*size) / time.Since(start).Seconds()}
+}
+
+func sortImpls(impls []Impl) {
+	sort.Slice(impls, func(i, j int) bool {
+		return impls[i].Throughput > impls[j].Throughput
+	})
+}
@@ -0,0 +1,116 @@
+package fastcrypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"github.com/ethereum/go-ethereum/crypto"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeccak256(t *testing.T) {
+	for _, size := range []int{0, 1, 135, 136, 137, 1280} {
+		data := bytes.Repeat([]byte{0xa5}, size)
+		want := crypto.Keccak256(data)
+		// Twice, the second call reusing the pooled state.
+		for i := 0; i < 2; i++ {
+			if got := Keccak256(data); !bytes.Equal(got, want) {
+				t.Errorf("Keccak256 of %d bytes: %x, want %x", size, got, want)
+			}
+			for name, f := range keccakImpls {
+				if got := f(data); !bytes.Equal(got, want) {
+					t.Errorf("%s Keccak256 of %d bytes: %x, want %x", name, size, got, want)
+				}
+			}
+			if got := Keccak256Hash(data); !bytes.Equal(got[:], want) {
+				t.Errorf("Keccak256Hash of %d bytes: %x, want %x", size, got, want)
+			}
+		}
+	}
+}
+
+func TestNewCTR(t *testing.T) {
+	plaintext := bytes.Repeat([]byte("etherspy"), 40)
+	iv := make([]byte, aes.BlockSize)
+	for i := 0; i < 3; i++ {
+		key := bytes.Repeat([]byte{byte(i % 2)}, 16)
+		block, _ := aes.NewCipher(key)
+		want := make([]byte, len(plaintext))
+		cipher.NewCTR(block, iv).XORKeyStream(want, plaintext)
+
+		stream, err := NewCTR(key, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(plaintext))
+		stream.XORKeyStream(got, plaintext)
+		if !bytes.Equal(got, want) {
+			t.Errorf("key %x: ciphertext %x, want %x", key, got, want)
+		}
+		for name, f := range ctrImpls {
+			stream, err := f(key, iv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stream.XORKeyStream(got, plaintext)
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s key %x: ciphertext %x, want %x", name, key, got, want)
+			}
+		}
+	}
+	if _, err := NewCTR(make([]byte, 7), iv); err == nil {
+		t.Error("accepted a 7 byte key")
+	}
+}
+
+func TestNewCTRCacheBound(t *testing.T) {
+	iv := make([]byte, aes.BlockSize)
+	key := make([]byte, 16)
+	for i := 0; i < 2*maxCachedBlocks; i++ {
+		key[0], key[1] = byte(i), byte(i>>8)
+		if _, err := NewCTR(key, iv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(blockCache.m); n > maxCachedBlocks {
+		t.Errorf("%d cached keys, want at most %d", n, maxCachedBlocks)
+	}
+}
+
+// TestSelect runs the selection while the primitives are in use, which the
+// race detector checks.
+func TestSelect(t *testing.T) {
+	data := []byte("etherspy")
+	want := crypto.Keccak256(data)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if got := Keccak256(data); !bytes.Equal(got, want) {
+					t.Errorf("Keccak256 %x, want %x", got, want)
+					return
+				}
+			}
+		}()
+	}
+	s := Select(time.Millisecond)
+	wg.Wait()
+
+	if len(s.Keccak) != len(keccakImpls) || len(s.CTR) != len(ctrImpls) {
+		t.Fatalf("selected among %d Keccak and %d AES-CTR implementations, want %d and %d", len(s.Keccak), len(s.CTR), len(keccakImpls), len(ctrImpls))
+	}
+	for _, impls := range [][]Impl{s.Keccak, s.CTR} {
+		for i, impl := range impls {
+			if impl.Throughput <= 0 || i > 0 && impl.Throughput > impls[i-1].Throughput {
+				t.Errorf("implementations %+v not fastest first", impls)
+			}
+		}
+	}
+	if again := Select(time.Second); again.String() != s.String() {
+		t.Errorf("selected %s anew, then %s", s, again)
+	}
+}
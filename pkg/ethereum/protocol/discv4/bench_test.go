@@ -0,0 +1,99 @@
+package discv4
+
+import (
+	"github.com/ethereum/go-ethereum/crypto"
+	"net"
+	"testing"
+)
+
+var benchKey, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+
+// benchPackets are packets of the kinds dominating captures.
+func benchPackets(b *testing.B) map[string][]byte {
+	nodes := make([]Node, 12)
+	for i := range nodes {
+		nodes[i] = Node{IP: net.IPv4(10, 0, 0, byte(i)).To4(), UDP: 30303, TCP: 30303}
+		nodes[i].ID[0] = byte(i)
+	}
+	bodies := map[string]Body{
+		"ping": &Ping{
+			Version:    4,
+			From:       Endpoint{IP: net.IPv4(10, 0, 0, 1).To4(), UDP: 30303, TCP: 30303},
+			To:         Endpoint{IP: net.IPv4(10, 0, 0, 2).To4(), UDP: 30303},
+			Expiration: 1700000000,
+		},
+		"neighbors": &Neighbors{Nodes: nodes, Expiration: 1700000000},
+	}
+	packets := make(map[string][]byte, len(bodies))
+	for name, body := range bodies {
+		packet, _, err := Encode(benchKey, body)
+		if err != nil {
+			b.Fatal(err)
+		}
+		packets[name] = packet
+	}
+	return packets
+}
+
+// BenchmarkDecodePeek measures the metadata decoded of every packet, into a
+// reused packet.
+func BenchmarkDecodePeek(b *testing.B) {
+	packet := benchPackets(b)["ping"]
+	var p Packet
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := PeekInto(&p, packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDecode measures full decoding, with the hash verified and the
+// sender recovered.
+func BenchmarkDecode(b *testing.B) {
+	for name, packet := range benchPackets(b) {
+		packet := packet
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(packet)))
+			for i := 0; i < b.N; i++ {
+				if _, err := Decode(packet, DecodeOptions{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDecodeSkipChecks measures decoding the body alone, as done for
+// captures of trusted provenance.
+func BenchmarkDecodeSkipChecks(b *testing.B) {
+	for name, packet := range benchPackets(b) {
+		packet := packet
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(packet)))
+			for i := 0; i < b.N; i++ {
+				if _, err := Decode(packet, DecodeOptions{SkipHash: true, SkipSender: true}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDecodeVerify measures the hash verification alone.
+func BenchmarkDecodeVerify(b *testing.B) {
+	p, err := Peek(benchPackets(b)["ping"])
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := p.Verify(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -3,9 +3,6 @@
 package discv4
 
 import (
-	"bytes"
-	"errors"
-	"fmt"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/p2p/enr"
 	"github.com/ethereum/go-ethereum/rlp"
@@ -51,13 +48,13 @@ const (
 
 type Ping struct {
 	Version    uint
-	From, To   rpcEndpoint
+	From, To   Endpoint
 	Expiration uint64
 	Rest       []rlp.RawValue `rlp:"tail"`
 }
 
 type Pong struct {
-	To         rpcEndpoint
+	To         Endpoint
 	ReplyTok   []byte
 	Expiration uint64
 	Rest       []rlp.RawValue `rlp:"tail"`
@@ -70,7 +67,7 @@ type FindNode struct {
 }
 
 type Neighbors struct {
-	Nodes      []rpcNode
+	Nodes      []Node
 	Expiration uint64
 	Rest       []rlp.RawValue `rlp:"tail"`
 }
@@ -86,41 +83,60 @@ type ENRResponse struct {
 	Rest     []rlp.RawValue `rlp:"tail"`
 }
 
-func Decode(buf []byte) (hash []byte, p interface{}, ptype PacketKind, id NodeID, err error) {
-	if len(buf) < headSize+1 {
-		return hash, p, 0x0, id, errors.New("packet too small")
-	}
+// Body is the decoded body of a packet.
+type Body interface {
+	Name() string
+	Kind() PacketKind
+}
 
-	hash, sig, sigdata := buf[:macSize], buf[macSize:headSize], buf[headSize:]
-	if !bytes.Equal(hash, crypto.Keccak256(buf[macSize:])) {
-		return hash, p, 0x0, id, errors.New("bad hash")
-	}
+func (*Ping) Name() string            { return PacketPing.String() }
+func (*Ping) Kind() PacketKind        { return PacketPing }
+func (*Pong) Name() string            { return PacketPong.String() }
+func (*Pong) Kind() PacketKind        { return PacketPong }
+func (*FindNode) Name() string        { return PacketFindNode.String() }
+func (*FindNode) Kind() PacketKind    { return PacketFindNode }
+func (*Neighbors) Name() string       { return PacketNeighbors.String() }
+func (*Neighbors) Kind() PacketKind   { return PacketNeighbors }
+func (*ENRRequest) Name() string      { return PacketENRRequest.String() }
+func (*ENRRequest) Kind() PacketKind  { return PacketENRRequest }
+func (*ENRResponse) Name() string     { return PacketENRResponse.String() }
+func (*ENRResponse) Kind() PacketKind { return PacketENRResponse }
+
+// DecodeOptions selects the checks Decode performs. The zero value
+// performs them all.
+type DecodeOptions struct {
+	// SkipHash skips verifying the packet hash, which fails for packets
+	// truncated by the snapshot length of a capture.
+	SkipHash bool
+	// SkipSender skips recovering the sender's node ID from the signature,
+	// leaving it to the packet's Sender on demand. Together with SkipHash
+	// it skips by far the most expensive steps of decoding, which should
+	// only be done on captures of trusted provenance.
+	SkipSender bool
+}
 
-	fromID, err := recoverNodeID(crypto.Keccak256(buf[headSize:]), sig)
+// Decode fully decodes a packet: its hash is verified, its body decoded and
+// the sender's node ID recovered from the signature, short of the checks
+// opts skips. Errors carry a code of package errcode; packets of an unknown
+// type fail with an *ErrUnknownType and packets with a bad hash with an
+// *ErrBadHash. Peek decodes the metadata alone.
+func Decode(buf []byte, opts DecodeOptions) (*Packet, error) {
+	pkt, err := Peek(buf)
 	if err != nil {
-		return hash, p, 0x0, id, err
+		return nil, err
 	}
-
-	switch ptype = PacketKind(sigdata[0]); ptype {
-	case PacketPing:
-		p = new(Ping)
-	case PacketPong:
-		p = new(Pong)
-	case PacketFindNode:
-		p = new(FindNode)
-	case PacketNeighbors:
-		p = new(Neighbors)
-	case PacketENRRequest:
-		p = new(ENRRequest)
-	case PacketENRResponse:
-		p = new(ENRResponse)
-	default:
-		return hash, p, 0x0, id, fmt.Errorf("unknown type: %d", ptype)
+	if !opts.SkipHash {
+		if err := pkt.Verify(); err != nil {
+			return nil, err
+		}
 	}
-
-	err = rlp.
-		NewStream(bytes.NewReader(sigdata[1:]), 0).
-		Decode(p)
-
-	return hash, p, ptype, fromID, err
+	if !opts.SkipSender {
+		if _, err := pkt.Sender.NodeID(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := pkt.Body(); err != nil {
+		return nil, err
+	}
+	return pkt, nil
 }
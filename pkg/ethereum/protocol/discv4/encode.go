@@ -0,0 +1,35 @@
+package discv4
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/ethereum/fastcrypto"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Encode serializes body and signs it with key. It returns the packet and
+// its hash, which is what a Pong replying to a Ping carries as ReplyTok.
+func Encode(key *ecdsa.PrivateKey, body Body) (packet, hash []byte, err error) {
+	b := new(bytes.Buffer)
+	b.Write(make([]byte, headSize))
+	b.WriteByte(byte(body.Kind()))
+	if err := rlp.Encode(b, body); err != nil {
+		return nil, nil, err
+	}
+	packet = b.Bytes()
+	if len(packet) > MaxPacketSize {
+		return nil, nil, fmt.Errorf("packet of %d bytes exceeds maximum size %d", len(packet), MaxPacketSize)
+	}
+
+	sig, err := crypto.Sign(fastcrypto.Keccak256(packet[headSize:]), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	copy(packet[macSize:], sig)
+
+	hash = fastcrypto.Keccak256(packet[macSize:])
+	copy(packet, hash)
+	return packet, hash, nil
+}
@@ -0,0 +1,101 @@
+package discv4
+
+import (
+	"bytes"
+	"errors"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+	"net"
+	"testing"
+)
+
+func testRecord(t *testing.T) enr.Record {
+	var r enr.Record
+	r.Set(enr.IPv4(net.IPv4(10, 0, 0, 1)))
+	r.Set(enr.UDP(30303))
+	if err := enode.SignV4(&r, benchKey); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	var target NodeID
+	target[0], target[63] = 1, 2
+	bodies := []Body{
+		&Ping{
+			Version:    4,
+			From:       Endpoint{IP: net.IPv4(10, 0, 0, 1).To4(), UDP: 30303, TCP: 30303},
+			To:         Endpoint{IP: net.ParseIP("2001:db8::1"), UDP: 30303},
+			Expiration: 1700000000,
+		},
+		&Ping{Version: 4, Expiration: 1700000000, Rest: []rlp.RawValue{{0x01}}}, // EIP-868 ENR sequence
+		&Pong{To: Endpoint{IP: net.IPv4(10, 0, 0, 2).To4(), UDP: 30303}, ReplyTok: bytes.Repeat([]byte{7}, 32), Expiration: 1700000000},
+		&FindNode{Target: target, Expiration: 1700000000},
+		&Neighbors{Nodes: []Node{{IP: net.IPv4(10, 0, 0, 3).To4(), UDP: 30303, TCP: 30304, ID: target}}, Expiration: 1700000000},
+		&ENRRequest{Expiration: 1700000000},
+		&ENRResponse{ReplyTok: bytes.Repeat([]byte{9}, 32), Record: testRecord(t)},
+	}
+	wantID := NodeID{}
+	copy(wantID[:], crypto.FromECDSAPub(&benchKey.PublicKey)[1:])
+
+	for _, body := range bodies {
+		t.Run(body.Name(), func(t *testing.T) {
+			packet, hash, err := Encode(benchKey, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pkt, err := Decode(packet, DecodeOptions{})
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			if pkt.Kind != body.Kind() {
+				t.Errorf("kind %v, want %v", pkt.Kind, body.Kind())
+			}
+			if !bytes.Equal(pkt.Hash, hash) {
+				t.Errorf("hash %x, want %x", pkt.Hash, hash)
+			}
+			if id, _ := pkt.Sender.NodeID(); id != wantID {
+				t.Errorf("sender %v, want %v", id, wantID)
+			}
+			got, _ := pkt.Body()
+			gotRLP, _ := rlp.EncodeToBytes(got)
+			wantRLP, _ := rlp.EncodeToBytes(body)
+			if !bytes.Equal(gotRLP, wantRLP) {
+				t.Errorf("body %+v, want %+v", got, body)
+			}
+		})
+	}
+}
+
+func TestDecodeCorrupted(t *testing.T) {
+	packet, _, err := Encode(benchKey, &ENRRequest{Expiration: 1700000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet[len(packet)-1]++
+	var bad *ErrBadHash
+	if _, err := Decode(packet, DecodeOptions{}); !errors.As(err, &bad) {
+		t.Fatalf("error %v, want *ErrBadHash", err)
+	}
+	if _, err := Decode(packet, DecodeOptions{SkipHash: true, SkipSender: true}); err != nil {
+		t.Fatalf("decode skipping checks: %v", err)
+	}
+	packet[headSize] = 0x7f
+	var unknown *ErrUnknownType
+	if _, err := Decode(packet, DecodeOptions{}); !errors.As(err, &unknown) || unknown.Type != 0x7f {
+		t.Fatalf("error %v, want *ErrUnknownType", err)
+	}
+}
+
+func TestEncodeTooLarge(t *testing.T) {
+	nodes := make([]Node, 64)
+	for i := range nodes {
+		nodes[i].IP = net.ParseIP("2001:db8::1")
+	}
+	if _, _, err := Encode(benchKey, &Neighbors{Nodes: nodes}); err == nil {
+		t.Fatal("no error encoding a packet beyond MaxPacketSize")
+	}
+}
@@ -0,0 +1,43 @@
+package discv4
+
+import (
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/eth"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+)
+
+// Seq returns the sequence number of the record.
+func (p *ENRResponse) Seq() uint64 {
+	return p.Record.Seq()
+}
+
+// Keys returns the keys of the record in the order they are stored.
+func (p *ENRResponse) Keys() []string {
+	// Elements are the sequence number followed by key/value pairs.
+	elems := p.Record.AppendElements(nil)
+	keys := make([]string, 0, len(elems)/2)
+	for i := 1; i+1 < len(elems); i += 2 {
+		if k, ok := elems[i].(string); ok {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// ForkID returns the fork ID of the "eth" entry, or nil if the record has
+// none.
+func (p *ENRResponse) ForkID() (*eth.ForkID, error) {
+	var entry eth.ENREntry
+	if err := p.Record.Load(&entry); err != nil {
+		if enr.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &entry.ForkID, nil
+}
+
+// Node verifies the record's signature and returns the node it describes.
+func (p *ENRResponse) Node() (*enode.Node, error) {
+	return enode.New(enode.ValidSchemes, &p.Record)
+}
@@ -0,0 +1,172 @@
+package discv4
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/errcode"
+	"github.com/drgomesp/etherspy/pkg/ethereum/fastcrypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"sync"
+)
+
+// Error codes, stable across releases. See package errcode.
+var (
+	codeBadHash      = errcode.Register("D4-001", "bad-hash", "discv4", "packet hash does not match its content, it is truncated, corrupted or not discv4")
+	codeTooSmall     = errcode.Register("D4-002", "too-small", "discv4", "packet shorter than the hash, signature and type")
+	codeUnknownType  = errcode.Register("D4-003", "unknown-type", "discv4", "packet type is not one of the discv4 packet types")
+	codeBadSignature = errcode.Register("D4-004", "bad-signature", "discv4", "sender public key can't be recovered from the signature")
+	codeBadRLP       = errcode.Register("D4-005", "bad-rlp", "discv4", "packet body is not valid RLP for its type")
+)
+
+var (
+	errTooSmall    = errcode.New(codeTooSmall, "packet too small")
+	errBadHash     = errcode.New(codeBadHash, "bad hash")
+	errUnknownType = errcode.New(codeUnknownType, "unknown type")
+)
+
+// ErrBadHash is the error of a packet whose hash doesn't match its
+// content. Its message leaves the hashes out, so failures group by it.
+type ErrBadHash struct {
+	Expected []byte // hash of the content
+	Got      []byte // hash carried by the packet, copied out of it
+}
+
+func (e *ErrBadHash) Error() string { return errBadHash.Error() }
+func (e *ErrBadHash) Unwrap() error { return errBadHash }
+
+// ErrUnknownType is the error of a packet whose type is not a discv4 one.
+type ErrUnknownType struct {
+	Type PacketKind
+}
+
+func (e *ErrUnknownType) Error() string { return fmt.Sprintf("unknown type: %d", e.Type) }
+func (e *ErrUnknownType) Unwrap() error { return errUnknownType }
+
+// Packet is a discv4 packet whose cheap metadata is available right away and
+// whose expensive parts (RLP body, hash verification and sender recovery) are
+// only computed when requested.
+type Packet struct {
+	Kind   PacketKind
+	Size   int
+	Hash   []byte
+	Sender *Sender
+
+	buf    []byte
+	sender Sender // what Sender points to, allocated along
+	once   sync.Once
+	body   Body
+	err    error
+}
+
+// Peek extracts the metadata of a packet without decoding its body or
+// verifying it.
+func Peek(buf []byte) (*Packet, error) {
+	p := new(Packet)
+	if err := PeekInto(p, buf); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// PeekInto is Peek into a caller-provided packet, which is reset first, so
+// that packets can be reused without allocating. p keeps referencing buf.
+func PeekInto(p *Packet, buf []byte) error {
+	if len(buf) < headSize+1 {
+		return errTooSmall
+	}
+
+	hash, sig, sigdata := buf[:macSize], buf[macSize:headSize], buf[headSize:]
+
+	kind := PacketKind(sigdata[0])
+	if newBody(kind) == nil {
+		return &ErrUnknownType{Type: kind}
+	}
+
+	*p = Packet{
+		Kind:   kind,
+		Size:   len(buf),
+		Hash:   hash,
+		buf:    buf,
+		sender: Sender{sigdata: sigdata, sig: sig},
+	}
+	p.Sender = &p.sender
+	return nil
+}
+
+// Verify checks the packet hash, returning an *ErrBadHash if it doesn't
+// match.
+func (p *Packet) Verify() error {
+	hash := fastcrypto.Keccak256Hash(p.buf[macSize:])
+	if !bytes.Equal(p.Hash, hash[:]) {
+		return &ErrBadHash{Expected: append([]byte(nil), hash[:]...), Got: append([]byte(nil), p.Hash...)}
+	}
+	return nil
+}
+
+// Body decodes the RLP body of the packet on first use and caches the result.
+func (p *Packet) Body() (Body, error) {
+	p.once.Do(func() {
+		p.body = newBody(p.Kind)
+		d := decoders.Get().(*decoder)
+		d.r.Reset(p.buf[headSize+1:])
+		d.s.Reset(&d.r, 0)
+		p.err = errcode.Wrap(codeBadRLP, d.s.Decode(p.body))
+		decoders.Put(d)
+	})
+	return p.body, p.err
+}
+
+// decoder is the reusable state of body decoding. Unlike rlp.DecodeBytes,
+// a stream ignores the data following the body, which EIP-8 allows.
+type decoder struct {
+	r bytes.Reader
+	s rlp.Stream
+}
+
+var decoders = sync.Pool{
+	New: func() interface{} { return new(decoder) },
+}
+
+func newBody(kind PacketKind) Body {
+	switch kind {
+	case PacketPing:
+		return new(Ping)
+	case PacketPong:
+		return new(Pong)
+	case PacketFindNode:
+		return new(FindNode)
+	case PacketNeighbors:
+		return new(Neighbors)
+	case PacketENRRequest:
+		return new(ENRRequest)
+	case PacketENRResponse:
+		return new(ENRResponse)
+	default:
+		return nil
+	}
+}
+
+// Tail returns the trailing RLP fields of the packet body unknown to this
+// package, which are ignored for forward compatibility.
+func (p *Packet) Tail() ([]rlp.RawValue, error) {
+	body, err := p.Body()
+	if err != nil {
+		return nil, err
+	}
+	switch b := body.(type) {
+	case *Ping:
+		return b.Rest, nil
+	case *Pong:
+		return b.Rest, nil
+	case *FindNode:
+		return b.Rest, nil
+	case *Neighbors:
+		return b.Rest, nil
+	case *ENRRequest:
+		return b.Rest, nil
+	case *ENRResponse:
+		return b.Rest, nil
+	default:
+		return nil, nil
+	}
+}
@@ -2,7 +2,10 @@ package discv4
 
 import (
 	"fmt"
+	"github.com/drgomesp/etherspy/pkg/errcode"
+	"github.com/drgomesp/etherspy/pkg/ethereum/fastcrypto"
 	"github.com/ethereum/go-ethereum/crypto/secp256k1"
+	"sync"
 )
 
 type NodeID [64]byte
@@ -12,18 +15,40 @@ func (n NodeID) String() string {
 	return fmt.Sprintf("%x", n[:])
 }
 
+// MarshalText encodes the node ID as hex.
+func (n NodeID) MarshalText() ([]byte, error) {
+	return []byte(n.String()), nil
+}
+
 // recoverNodeID computes the public key used to sign the
 // given hash from the signature.
 func recoverNodeID(hash, sig []byte) (id NodeID, err error) {
 	pubkey, err := secp256k1.RecoverPubkey(hash, sig)
 	if err != nil {
-		return id, err
+		return id, errcode.Wrap(codeBadSignature, err)
 	}
 	if len(pubkey)-1 != len(id) {
-		return id, fmt.Errorf("recovered pubkey has %d bits, want %d bits", len(pubkey)*8, (len(id)+1)*8)
+		return id, errcode.Errorf(codeBadSignature, "recovered pubkey has %d bits, want %d bits", len(pubkey)*8, (len(id)+1)*8)
 	}
 	for i := range id {
 		id[i] = pubkey[i+1]
 	}
 	return id, nil
 }
+
+// Sender lazily recovers the node ID of a packet's sender from its signature.
+type Sender struct {
+	sigdata, sig []byte
+
+	once sync.Once
+	id   NodeID
+	err  error
+}
+
+// NodeID recovers the sender's node ID on first use and caches the result.
+func (s *Sender) NodeID() (NodeID, error) {
+	s.once.Do(func() {
+		s.id, s.err = recoverNodeID(fastcrypto.Keccak256(s.sigdata), s.sig)
+	})
+	return s.id, s.err
+}
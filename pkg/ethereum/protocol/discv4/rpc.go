@@ -2,14 +2,16 @@ package discv4
 
 import "net"
 
-type rpcNode struct {
+// Node is a node as listed in a Neighbors packet.
+type Node struct {
 	IP  net.IP // len 4 for IPv4 or 16 for IPv6
 	UDP uint16 // for discovery protocol
 	TCP uint16 // for RLPx protocol
 	ID  NodeID
 }
 
-type rpcEndpoint struct {
+// Endpoint is the address of a node as sent in Ping and Pong packets.
+type Endpoint struct {
 	IP  net.IP // len 4 for IPv4 or 16 for IPv6
 	UDP uint16 // for discovery protocol
 	TCP uint16 // for RLPx protocol
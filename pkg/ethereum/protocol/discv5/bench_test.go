@@ -0,0 +1,105 @@
+package discv5
+
+import (
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"net"
+	"testing"
+)
+
+var (
+	benchKeyA, _ = crypto.HexToECDSA("eef77acb6c6a6eebc5b363a475ac583ec7eccdb42b6481424c60f59aa326547f")
+	benchKeyB, _ = crypto.HexToECDSA("66fb62bfbd66b9177a138c1e5cddbe4f7c30c343e94e68df8769459cb1cde628")
+)
+
+// benchNodes returns the encoders of two nodes A and B, and their records.
+func benchNodes() (a, b *Encoder, nodeA, nodeB *enode.Node) {
+	a, b = NewEncoder(benchKeyA), NewEncoder(benchKeyB)
+	b.Sessions.AddPrivateKey(benchKeyB)
+	nodeA = enode.NewV4(&benchKeyA.PublicKey, net.IPv4(10, 0, 0, 1), 30303, 30303)
+	nodeB = enode.NewV4(&benchKeyB.PublicKey, net.IPv4(10, 0, 0, 2), 30303, 30303)
+	return a, b, nodeA, nodeB
+}
+
+// benchDecode decodes packet addressed to dest b.N times. Decoding
+// unmasks in place, every iteration decodes a fresh copy.
+func benchDecode(b *testing.B, packet []byte, opts DecodeOptions) {
+	buf := make([]byte, len(packet))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(buf, packet)
+		if _, err := Decode(buf, opts); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDecodeWhoareyou measures decoding a challenge.
+func BenchmarkDecodeWhoareyou(b *testing.B) {
+	encA, _, _, nodeB := benchNodes()
+	packet, err := encA.Encode(nodeB, &Whoareyou{RecordSeq: 1}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchDecode(b, packet, DecodeOptions{Dest: nodeB.ID()})
+}
+
+// BenchmarkDecodeMessage measures decoding an ordinary message, decrypted
+// with the keys of its session.
+func BenchmarkDecodeMessage(b *testing.B) {
+	encA, encB, nodeA, nodeB := benchNodes()
+	initiatorKey, recipientKey := make([]byte, 16), make([]byte, 16)
+	recipientKey[0] = 1
+	encA.Sessions.SetSession(nodeA.ID(), nodeB.ID(), initiatorKey, recipientKey)
+	encB.Sessions.SetSession(nodeA.ID(), nodeB.ID(), initiatorKey, recipientKey)
+	packet, err := encA.Encode(nodeB, &FindNode{ReqID: []byte{1, 2, 3, 4}, Distances: []uint{256, 255}}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchDecode(b, packet, DecodeOptions{Dest: nodeB.ID(), Sessions: encB.Sessions})
+}
+
+// BenchmarkDecodeMessageMasked measures decoding a message of an unknown
+// session, which is only unmasked.
+func BenchmarkDecodeMessageMasked(b *testing.B) {
+	encA, _, _, nodeB := benchNodes()
+	packet, err := encA.Encode(nodeB, &Ping{ReqID: []byte{1}, ENRSeq: 1}, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchDecode(b, packet, DecodeOptions{Dest: nodeB.ID()})
+}
+
+// BenchmarkDecodeHandshake measures decoding a handshake addressed to a
+// node under our control, deriving its session keys.
+func BenchmarkDecodeHandshake(b *testing.B) {
+	encA, encB, nodeA, nodeB := benchNodes()
+	challenge := &Whoareyou{RecordSeq: 0}
+	if _, err := encB.Encode(nodeA, challenge, nil); err != nil {
+		b.Fatal(err)
+	}
+	packet, err := encA.Encode(nodeB, &Ping{ReqID: []byte{1}, ENRSeq: 1}, challenge)
+	if err != nil {
+		b.Fatal(err)
+	}
+	// The challenge is forgotten once answered, every handshake answers
+	// it anew.
+	challengeData := challenge.ChallengeData
+	buf := make([]byte, len(packet))
+	b.ReportAllocs()
+	b.SetBytes(int64(len(packet)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		encB.Sessions.storeChallenge(nodeA.ID(), challengeData)
+		copy(buf, packet)
+		p, err := Decode(buf, DecodeOptions{Dest: nodeB.ID(), Sessions: encB.Sessions})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if p.(*Handshake).Body == nil {
+			b.Fatal("handshake message not decrypted")
+		}
+	}
+}
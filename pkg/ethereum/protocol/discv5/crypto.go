@@ -1,5 +1,18 @@
 package discv5
 
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"golang.org/x/crypto/hkdf"
+)
+
 const (
 	// Encryption/authentication parameters.
 	aesKeySize   = 16
@@ -8,3 +21,81 @@ const (
 
 // Nonce represents a nonce used for AES/GCM.
 type Nonce [gcmNonceSize]byte
+
+// decodePubkey decodes a compressed secp256k1 public key.
+func decodePubkey(e []byte) (*ecdsa.PublicKey, error) {
+	if len(e) != 33 {
+		return nil, errors.New("wrong size public key data")
+	}
+	return crypto.DecompressPubkey(e)
+}
+
+// deriveKeys derives the session keys of a handshake between the initiator
+// n1 and the recipient n2. The initiator key encrypts messages sent by n1,
+// the recipient key those sent by n2.
+func deriveKeys(priv *ecdsa.PrivateKey, pub *ecdsa.PublicKey, n1, n2 enode.ID, challenge []byte) (initiatorKey, recipientKey []byte) {
+	const text = "discovery v5 key agreement"
+	info := make([]byte, 0, len(text)+len(n1)+len(n2))
+	info = append(info, text...)
+	info = append(info, n1[:]...)
+	info = append(info, n2[:]...)
+
+	eph := ecdh(priv, pub)
+	if eph == nil {
+		return nil, nil
+	}
+	kdf := hkdf.New(sha256.New, eph, challenge, info)
+	initiatorKey, recipientKey = make([]byte, aesKeySize), make([]byte, aesKeySize)
+	kdf.Read(initiatorKey)
+	kdf.Read(recipientKey)
+	return initiatorKey, recipientKey
+}
+
+// ecdh creates a shared secret.
+func ecdh(privkey *ecdsa.PrivateKey, pubkey *ecdsa.PublicKey) []byte {
+	secX, secY := pubkey.ScalarMult(pubkey.X, pubkey.Y, privkey.D.Bytes())
+	if secX == nil {
+		return nil
+	}
+	sec := make([]byte, 33)
+	sec[0] = 0x02 | byte(secY.Bit(0))
+	math.ReadBits(secX, sec[1:])
+	return sec
+}
+
+// newGCM returns the AES-GCM cipher of key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("can't create block cipher: %v", err)
+	}
+	aesgcm, err := cipher.NewGCMWithNonceSize(block, gcmNonceSize)
+	if err != nil {
+		return nil, fmt.Errorf("can't create GCM: %v", err)
+	}
+	return aesgcm, nil
+}
+
+// encryptGCM encrypts pt using AES-GCM with the given key and nonce.
+func encryptGCM(key, nonce, pt, authData []byte) ([]byte, error) {
+	aesgcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return aesgcm.Seal(nil, nonce, pt, authData), nil
+}
+
+// makeIDSignature signs the ID nonce proving ownership of key to the node
+// destID, which challenged us with the given challenge data.
+func makeIDSignature(key *ecdsa.PrivateKey, challenge, ephkey []byte, destID enode.ID) ([]byte, error) {
+	h := sha256.New()
+	h.Write([]byte("discovery v5 identity proof"))
+	h.Write(challenge)
+	h.Write(ephkey)
+	h.Write(destID[:])
+	sig, err := crypto.Sign(h.Sum(nil), key)
+	if err != nil {
+		return nil, err
+	}
+	return sig[:len(sig)-1], nil // remove recovery id
+}
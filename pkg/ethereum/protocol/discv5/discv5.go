@@ -1,11 +1,10 @@
 // Package discv5 implements the Discovery v5 Wire Protocol.
-// https://github.com/ethereum/devp2p/blob/master/discv4.md
+// https://github.com/ethereum/devp2p/blob/master/discv5/discv5-wire.md
 package discv5
 
 import (
-	"bytes"
 	"encoding/binary"
-	"errors"
+	"github.com/drgomesp/etherspy/pkg/errcode"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 	"net"
 )
@@ -23,20 +22,40 @@ type NodeID [32]byte
 
 var protocolID = [6]byte{'d', 'i', 's', 'c', 'v', '5'}
 
+// Error codes, stable across releases. See package errcode.
+var (
+	codeTooShort            = errcode.Register("D5-001", "too-short", "discv5", "packet shorter than its static header or auth data")
+	codeInvalidHeader       = errcode.Register("D5-002", "invalid-header", "discv5", "static header does not unmask to the protocol ID, the packet is not addressed to the local node or not discv5")
+	codeInvalidFlag         = errcode.Register("D5-003", "invalid-flag", "discv5", "unknown packet flag in header")
+	codeMinVersion          = errcode.Register("D5-004", "min-version", "discv5", "header version below the minimum supported")
+	codeMsgTooShort         = errcode.Register("D5-005", "msg-too-short", "discv5", "message or handshake packet below the minimum size")
+	codeUnknownMessage      = errcode.Register("D5-006", "unknown-message", "discv5", "decrypted message of unknown kind")
+	codeAuthSize            = errcode.Register("D5-007", "auth-size", "discv5", "declared auth data size does not match the packet")
+	codeUnexpectedHandshake = errcode.Register("D5-008", "unexpected-handshake", "discv5", "handshake received outside of a handshake")
+	codeInvalidAuthKey      = errcode.Register("D5-009", "invalid-auth-key", "discv5", "invalid ephemeral public key in handshake")
+	codeNoRecord            = errcode.Register("D5-010", "no-record", "discv5", "handshake record missing or malformed")
+	codeInvalidNonceSig     = errcode.Register("D5-011", "invalid-nonce-sig", "discv5", "invalid ID nonce signature in handshake")
+	codeMessageTooShort     = errcode.Register("D5-012", "message-too-short", "discv5", "packet carries no message data")
+	codeMessageDecrypt      = errcode.Register("D5-013", "message-decrypt", "discv5", "message could not be decrypted with the session keys")
+	codeInvalidReqID        = errcode.Register("D5-014", "invalid-request-id", "discv5", "request ID longer than 8 bytes")
+	codeBadRLP              = errcode.Register("D5-015", "bad-rlp", "discv5", "decrypted message body is not valid RLP")
+)
+
 // Errors.
 var (
-	errTooShort            = errors.New("packet too short")
-	errInvalidHeader       = errors.New("invalid packet header")
-	errInvalidFlag         = errors.New("invalid flag value in header")
-	errMinVersion          = errors.New("version of packet header below minimum")
-	errMsgTooShort         = errors.New("message/handshake packet below minimum size")
-	errAuthSize            = errors.New("declared auth size is beyond packet length")
-	errUnexpectedHandshake = errors.New("unexpected auth response, not in handshake")
-	errInvalidAuthKey      = errors.New("invalid ephemeral pubkey")
-	errNoRecord            = errors.New("expected ENR in handshake but none sent")
-	errInvalidNonceSig     = errors.New("invalid ID nonce signature")
-	errMessageTooShort     = errors.New("message contains no data")
-	errMessageDecrypt      = errors.New("cannot decrypt message")
+	errTooShort            = errcode.New(codeTooShort, "packet too short")
+	errInvalidHeader       = errcode.New(codeInvalidHeader, "invalid packet header")
+	errInvalidFlag         = errcode.New(codeInvalidFlag, "invalid flag value in header")
+	errMinVersion          = errcode.New(codeMinVersion, "version of packet header below minimum")
+	errMsgTooShort         = errcode.New(codeMsgTooShort, "message/handshake packet below minimum size")
+	errAuthSize            = errcode.New(codeAuthSize, "declared auth size is beyond packet length")
+	errUnexpectedHandshake = errcode.New(codeUnexpectedHandshake, "unexpected auth response, not in handshake")
+	errInvalidAuthKey      = errcode.New(codeInvalidAuthKey, "invalid ephemeral pubkey")
+	errNoRecord            = errcode.New(codeNoRecord, "expected ENR in handshake but none sent")
+	errInvalidNonceSig     = errcode.New(codeInvalidNonceSig, "invalid ID nonce signature")
+	errMessageTooShort     = errcode.New(codeMessageTooShort, "message contains no data")
+	errMessageDecrypt      = errcode.New(codeMessageDecrypt, "cannot decrypt message")
+	errInvalidReqID        = errcode.New(codeInvalidReqID, "request ID larger than 8 bytes")
 )
 
 // Protocol constants.
@@ -47,13 +66,35 @@ const (
 
 	minMessageSize      = 48 // this refers to data after static headers
 	randomPacketMsgSize = 20
+	maxRequestIDSize    = 8
 )
 
 type PacketKind byte
 
 func (p PacketKind) String() string {
 	switch p {
-
+	case PacketPing:
+		return "PING"
+	case PacketPong:
+		return "PONG"
+	case PacketFindNode:
+		return "FIND_NODE"
+	case PacketNodes:
+		return "NODES"
+	case PacketTalkRequest:
+		return "TALK_REQUEST"
+	case PacketTalkResponse:
+		return "TALK_RESPONSE"
+	case PacketTicket:
+		return "TICKET"
+	case PacketRegTopic:
+		return "REG_TOPIC"
+	case PacketRegConfirmation:
+		return "REG_CONFIRMATION"
+	case PacketTopicQuery:
+		return "TOPIC_QUERY"
+	case PacketWhoAreYou:
+		return "WHOAREYOU"
 	default:
 		return "UNKNOWN"
 	}
@@ -75,8 +116,8 @@ const (
 	PacketNodes
 	PacketTalkRequest
 	PacketTalkResponse
-	PacketTicket
 	PacketRegTopic
+	PacketTicket
 	PacketRegConfirmation
 	PacketTopicQuery
 	PacketUnknown   = PacketKind(255)
@@ -107,12 +148,30 @@ func (p *Ping) Kind() PacketKind          { return PacketPing }
 func (p *Ping) RequestID() []byte         { return p.ReqID }
 func (p *Ping) SetRequestID(bytes []byte) { p.ReqID = bytes }
 
-func (p *Pong) Name() string              { return "Pong" }
+func (p *Pong) Name() string              { return "PONG" }
 func (p *Pong) Kind() PacketKind          { return PacketPong }
 func (p *Pong) RequestID() []byte         { return p.ReqID }
 func (p *Pong) SetRequestID(bytes []byte) { p.ReqID = bytes }
 
-func Decode(buf []byte, nid enode.ID) (Packet, error) {
+// DecodeOptions sets up Decode.
+type DecodeOptions struct {
+	// Dest is the node the packet is addressed to, whose ID masks its
+	// header.
+	Dest enode.ID
+
+	// Sessions holds the keys of the sessions whose messages are
+	// decrypted, and records the handshake state Decode observes. It may be
+	// nil.
+	Sessions *SessionStore
+}
+
+// Decode decodes a packet addressed to opts.Dest, unmasking it in place.
+// Ordinary and handshake message packets are returned as *Message and
+// *Handshake, their encrypted message is only decoded when opts.Sessions
+// holds the keys of the session it belongs to.
+func Decode(buf []byte, opts DecodeOptions) (Packet, error) {
+	nid, sessions := opts.Dest, opts.Sessions
+
 	// Unmask the static header.
 	if len(buf) < sizeofStaticPacketData {
 		return nil, errTooShort
@@ -123,13 +182,11 @@ func Decode(buf []byte, nid enode.ID) (Packet, error) {
 	staticHeader := buf[sizeofMaskingIV:sizeofStaticPacketData]
 	mask.XORKeyStream(staticHeader, staticHeader)
 
-	reader := bytes.NewReader(buf)
 	// Decode and verify the static header.
-	reader.Reset(staticHeader)
-	binary.Read(reader, binary.BigEndian, &head.StaticHeader)
+	head.StaticHeader.decode(staticHeader)
 	remainingInput := len(buf) - sizeofStaticPacketData
 	if err := head.checkValid(remainingInput); err != nil {
-		return nil, errInvalidHeader
+		return nil, err
 	}
 
 	// Unmask auth data.
@@ -138,5 +195,31 @@ func Decode(buf []byte, nid enode.ID) (Packet, error) {
 	mask.XORKeyStream(authData, authData)
 	head.AuthData = authData
 
-	return nil, errors.New("TODO")
+	// Decode auth part and message.
+	headerData := buf[:authDataEnd]
+	msgData := buf[authDataEnd:]
+	switch head.Flag {
+	case flagWhoareyou:
+		return decodeWhoareyou(&head, headerData, nid, sessions)
+	case flagHandshake:
+		return decodeHandshake(&head, headerData, msgData, nid, sessions)
+	case flagMessage:
+		return decodeMessage(&head, headerData, msgData, nid, sessions)
+	default:
+		return nil, errInvalidFlag
+	}
+}
+
+// Match reports whether buf looks like a discv5 packet addressed to the node
+// nid, that is whether its masked header starts with the protocol ID. It is
+// much cheaper than Decode and leaves buf untouched.
+func Match(buf []byte, nid enode.ID) bool {
+	if len(buf) < sizeofStaticPacketData {
+		return false
+	}
+	var head Header
+	copy(head.IV[:], buf[:sizeofMaskingIV])
+	var id [len(protocolID)]byte
+	head.mask(nid).XORKeyStream(id[:], buf[sizeofMaskingIV:sizeofMaskingIV+len(id)])
+	return id == protocolID
 }
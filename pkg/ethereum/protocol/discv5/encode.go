@@ -0,0 +1,244 @@
+package discv5
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+	"io"
+)
+
+// Encoder crafts packets sent by the node owning Key.
+type Encoder struct {
+	Key *ecdsa.PrivateKey
+
+	// Record is sent along handshakes answering a challenger whose copy of
+	// it is outdated. It may be nil.
+	Record *enr.Record
+
+	// Sessions holds the keys of established sessions. Handshakes store the
+	// keys they establish in it, so the same store decodes the replies.
+	Sessions *SessionStore
+
+	// KeyLog, if set, receives the keys of the sessions handshakes
+	// establish, so captures of the traffic can be decrypted.
+	KeyLog io.Writer
+}
+
+// NewEncoder returns an encoder for the node owning key, with an empty
+// session store.
+func NewEncoder(key *ecdsa.PrivateKey) *Encoder {
+	return &Encoder{Key: key, Sessions: NewSessionStore()}
+}
+
+// ID returns the node ID of the encoding node.
+func (e *Encoder) ID() enode.ID {
+	return enode.PubkeyToIDV4(&e.Key.PublicKey)
+}
+
+// Encode encodes p as a packet addressed to dest:
+//
+//   - a *Whoareyou is encoded as a challenge, its ChallengeData is filled in
+//     and a zero IDNonce is replaced with a random one;
+//   - a message answering challenge, which must have been received from dest,
+//     is encoded as a handshake establishing a new session;
+//   - any other message is encrypted with the session keys shared with dest,
+//     or replaced with random data triggering a handshake if there is none.
+//
+// The public key of dest is only needed for handshakes.
+func (e *Encoder) Encode(dest *enode.Node, p Packet, challenge *Whoareyou) ([]byte, error) {
+	var (
+		head Header
+		key  []byte
+		err  error
+	)
+	switch p.(type) {
+	case *Message, *Handshake:
+		return nil, fmt.Errorf("cannot encode %T, encode its body instead", p)
+	}
+
+	switch {
+	case p.Kind() == PacketWhoAreYou:
+		w, ok := p.(*Whoareyou)
+		if !ok {
+			return nil, fmt.Errorf("cannot encode %T as a challenge", p)
+		}
+		head, err = e.whoareyouHeader(w)
+	case challenge != nil:
+		head, key, err = e.handshakeHeader(dest, challenge)
+	default:
+		if key = e.Sessions.key(e.ID(), dest.ID()); key == nil {
+			return e.encodeRandom(dest.ID())
+		}
+		head, err = e.messageHeader()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := crand.Read(head.IV[:]); err != nil {
+		return nil, fmt.Errorf("can't generate masking IV: %v", err)
+	}
+	headerData := writeHeader(&head)
+
+	var msgData []byte
+	if w, ok := p.(*Whoareyou); ok {
+		w.ChallengeData = append([]byte(nil), headerData...)
+		e.Sessions.storeChallenge(dest.ID(), headerData)
+	} else {
+		if msgData, err = encryptMessage(key, head.Nonce, p, headerData); err != nil {
+			return nil, err
+		}
+	}
+	return maskPacket(dest.ID(), &head, headerData, msgData), nil
+}
+
+func (e *Encoder) whoareyouHeader(w *Whoareyou) (Header, error) {
+	if w.IDNonce == ([16]byte{}) {
+		if _, err := crand.Read(w.IDNonce[:]); err != nil {
+			return Header{}, err
+		}
+	}
+	var auth bytes.Buffer
+	binary.Write(&auth, binary.BigEndian, &whoareyouAuthData{IDNonce: w.IDNonce, RecordSeq: w.RecordSeq})
+	head := makeHeader(flagWhoareyou, auth.Bytes())
+	head.Nonce = w.Nonce
+	return head, nil
+}
+
+func (e *Encoder) messageHeader() (Header, error) {
+	var auth bytes.Buffer
+	binary.Write(&auth, binary.BigEndian, &messageAuthData{SrcID: e.ID()})
+	head := makeHeader(flagMessage, auth.Bytes())
+	_, err := crand.Read(head.Nonce[:])
+	return head, err
+}
+
+// handshakeHeader builds the header of a handshake answering challenge and
+// returns the key encrypting its message.
+func (e *Encoder) handshakeHeader(dest *enode.Node, challenge *Whoareyou) (Header, []byte, error) {
+	if len(challenge.ChallengeData) == 0 {
+		return Header{}, nil, errors.New("challenge has no challenge data")
+	}
+	destPub := dest.Pubkey()
+	if destPub == nil {
+		return Header{}, nil, errors.New("can't find secp256k1 key for recipient")
+	}
+
+	ephkey, err := crypto.GenerateKey()
+	if err != nil {
+		return Header{}, nil, fmt.Errorf("can't generate ephemeral key: %v", err)
+	}
+	ephpub := crypto.CompressPubkey(&ephkey.PublicKey)
+	sig, err := makeIDSignature(e.Key, challenge.ChallengeData, ephpub, dest.ID())
+	if err != nil {
+		return Header{}, nil, fmt.Errorf("can't sign: %v", err)
+	}
+	var record []byte
+	if e.Record != nil && challenge.RecordSeq < e.Record.Seq() {
+		if record, err = rlp.EncodeToBytes(e.Record); err != nil {
+			return Header{}, nil, err
+		}
+	}
+
+	initiatorKey, recipientKey := deriveKeys(ephkey, destPub, e.ID(), dest.ID(), challenge.ChallengeData)
+	if initiatorKey == nil {
+		return Header{}, nil, errors.New("key derivation failed")
+	}
+	e.Sessions.SetSession(e.ID(), dest.ID(), initiatorKey, recipientKey)
+
+	var auth handshakeAuthData
+	auth.h.SrcID = e.ID()
+	auth.h.SigSize = byte(len(sig))
+	auth.h.PubkeySize = byte(len(ephpub))
+	var authData bytes.Buffer
+	binary.Write(&authData, binary.BigEndian, &auth.h)
+	authData.Write(sig)
+	authData.Write(ephpub)
+	authData.Write(record)
+
+	head := makeHeader(flagHandshake, authData.Bytes())
+	if _, err := crand.Read(head.Nonce[:]); err != nil {
+		return Header{}, nil, err
+	}
+	if e.KeyLog != nil {
+		err := WriteKeyLog(e.KeyLog, SessionKeys{
+			Nonce:        head.Nonce,
+			Initiator:    e.ID(),
+			Recipient:    dest.ID(),
+			InitiatorKey: initiatorKey,
+			RecipientKey: recipientKey,
+		})
+		if err != nil {
+			return Header{}, nil, fmt.Errorf("can't write key log: %v", err)
+		}
+	}
+	return head, initiatorKey, nil
+}
+
+// encodeRandom encodes a message packet with random content, which the
+// recipient cannot decrypt and answers with a WHOAREYOU challenge.
+func (e *Encoder) encodeRandom(dest enode.ID) ([]byte, error) {
+	head, err := e.messageHeader()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := crand.Read(head.IV[:]); err != nil {
+		return nil, err
+	}
+	msgData := make([]byte, randomPacketMsgSize)
+	if _, err := crand.Read(msgData); err != nil {
+		return nil, err
+	}
+	return maskPacket(dest, &head, writeHeader(&head), msgData), nil
+}
+
+func makeHeader(flag byte, authData []byte) Header {
+	return Header{
+		StaticHeader: StaticHeader{
+			ProtocolID: protocolID,
+			Version:    version,
+			Flag:       flag,
+			AuthSize:   uint16(len(authData)),
+		},
+		AuthData: authData,
+	}
+}
+
+// writeHeader returns the masking IV followed by the unmasked header.
+func writeHeader(head *Header) []byte {
+	var b bytes.Buffer
+	b.Write(head.IV[:])
+	binary.Write(&b, binary.BigEndian, &head.StaticHeader)
+	b.Write(head.AuthData)
+	return b.Bytes()
+}
+
+// maskPacket masks the header of a packet to dest and appends the message
+// data.
+func maskPacket(dest enode.ID, head *Header, headerData, msgData []byte) []byte {
+	packet := make([]byte, len(headerData), len(headerData)+len(msgData))
+	copy(packet, headerData)
+	masked := packet[sizeofMaskingIV:]
+	head.mask(dest).XORKeyStream(masked, masked)
+	return append(packet, msgData...)
+}
+
+// encryptMessage encrypts the kind byte and RLP encoding of p.
+func encryptMessage(key []byte, nonce Nonce, p Packet, headerData []byte) ([]byte, error) {
+	if len(p.RequestID()) > maxRequestIDSize {
+		return nil, errInvalidReqID
+	}
+	body, err := rlp.EncodeToBytes(p)
+	if err != nil {
+		return nil, err
+	}
+	pt := append([]byte{byte(p.Kind())}, body...)
+	return encryptGCM(key, nonce[:], pt, headerData)
+}
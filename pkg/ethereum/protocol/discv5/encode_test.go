@@ -0,0 +1,249 @@
+package discv5
+
+import (
+	"bytes"
+	"errors"
+	"github.com/drgomesp/etherspy/pkg/errcode"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+	"net"
+	"testing"
+)
+
+func testRecord(t *testing.T) *enr.Record {
+	var r enr.Record
+	r.SetSeq(2)
+	r.Set(enr.IPv4(net.IPv4(10, 0, 0, 1)))
+	r.Set(enr.UDP(30303))
+	if err := enode.SignV4(&r, benchKeyA); err != nil {
+		t.Fatal(err)
+	}
+	return &r
+}
+
+// testMessages returns a message of every kind.
+func testMessages(t *testing.T) []Packet {
+	record := testRecord(t)
+	reqID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	return []Packet{
+		&Ping{ReqID: reqID, ENRSeq: 3},
+		&Pong{ReqID: reqID, ENRSeq: 3, ToIP: net.IPv4(10, 0, 0, 2).To4(), ToPort: 30303},
+		&FindNode{ReqID: reqID, Distances: []uint{256, 255, 254}},
+		&Nodes{ReqID: reqID, Total: 1, Nodes: []*enr.Record{record}},
+		&TalkRequest{ReqID: reqID, Protocol: "test", Message: []byte("hello")},
+		&TalkResponse{ReqID: reqID, Message: []byte("world")},
+		&RegTopic{ReqID: reqID, Topic: []byte("topic"), ENR: record, Ticket: []byte{1}},
+		&Ticket{ReqID: reqID, Ticket: []byte{1, 2}, WaitTime: 60},
+		&RegConfirmation{ReqID: reqID, Topic: []byte("topic")},
+		&TopicQuery{ReqID: reqID, Topic: []byte("topic")},
+		&RelayInit{Initiator: record, Target: enode.ID{1}, Nonce: Nonce{2}},
+		&RelayMsg{Initiator: record, Nonce: Nonce{3}},
+	}
+}
+
+// sameMessage reports whether got encodes like want.
+func sameMessage(t *testing.T, got, want Packet) {
+	t.Helper()
+	if got == nil {
+		t.Fatalf("message %s not decrypted", want.Name())
+	}
+	if got.Kind() != want.Kind() {
+		t.Fatalf("kind %v, want %v", got.Kind(), want.Kind())
+	}
+	gotRLP, _ := rlp.EncodeToBytes(got)
+	wantRLP, _ := rlp.EncodeToBytes(want)
+	if !bytes.Equal(gotRLP, wantRLP) {
+		t.Fatalf("message %+v, want %+v", got, want)
+	}
+}
+
+func TestEncodeWhoareyouRoundTrip(t *testing.T) {
+	encA, _, _, nodeB := benchNodes()
+	w := &Whoareyou{Nonce: Nonce{1, 2, 3}, RecordSeq: 7}
+	packet, err := encA.Encode(nodeB, w, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.IDNonce == ([16]byte{}) || len(w.ChallengeData) == 0 {
+		t.Fatal("challenge not filled in")
+	}
+	p, err := Decode(packet, DecodeOptions{Dest: nodeB.ID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := p.(*Whoareyou)
+	if !ok {
+		t.Fatalf("decoded %T, want *Whoareyou", p)
+	}
+	if got.Nonce != w.Nonce || got.IDNonce != w.IDNonce || got.RecordSeq != w.RecordSeq {
+		t.Errorf("decoded %+v, want %+v", got, w)
+	}
+	if !bytes.Equal(got.ChallengeData, w.ChallengeData) {
+		t.Errorf("challenge data %x, want %x", got.ChallengeData, w.ChallengeData)
+	}
+}
+
+func TestEncodeMasking(t *testing.T) {
+	encA, _, nodeA, nodeB := benchNodes()
+	packet, err := encA.Encode(nodeB, &Ping{ReqID: []byte{1}, ENRSeq: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(packet, protocolID[:]) {
+		t.Fatal("header not masked")
+	}
+	if !Match(packet, nodeB.ID()) {
+		t.Error("packet does not match its recipient")
+	}
+	if Match(packet, nodeA.ID()) {
+		t.Error("packet matches another node than its recipient")
+	}
+	if _, err := Decode(append([]byte(nil), packet...), DecodeOptions{Dest: nodeA.ID()}); errcode.ID(err) != codeInvalidHeader.ID {
+		t.Errorf("decoding with the wrong node ID: error %v, want %s", err, codeInvalidHeader.ID)
+	}
+
+	// Without a session, the message is random data triggering a
+	// handshake.
+	p, err := Decode(packet, DecodeOptions{Dest: nodeB.ID(), Sessions: NewSessionStore()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := p.(*Message)
+	if !ok || m.SrcID != nodeA.ID() || m.Body != nil {
+		t.Fatalf("decoded %+v, want an undecryptable message of A", p)
+	}
+}
+
+// TestEncodeSession runs a handshake between A and B, B decoding as a node
+// under our control, and checks every message round-trips in both
+// directions of the session it establishes.
+func TestEncodeSession(t *testing.T) {
+	encA, encB, nodeA, nodeB := benchNodes()
+	encA.Record = testRecord(t)
+
+	// A's first message can't be decrypted, B challenges it.
+	first, err := encA.Encode(nodeB, &Ping{ReqID: []byte{1}, ENRSeq: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Decode(first, DecodeOptions{Dest: nodeB.ID(), Sessions: encB.Sessions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := encB.Encode(nodeA, &Whoareyou{Nonce: p.(*Message).Nonce}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = Decode(packet, DecodeOptions{Dest: nodeA.ID(), Sessions: encA.Sessions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := p.(*Whoareyou)
+
+	// A answers with a handshake carrying its record, which B completes.
+	ping := &Ping{ReqID: []byte{2}, ENRSeq: 1}
+	packet, err = encA.Encode(nodeB, ping, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = Decode(packet, DecodeOptions{Dest: nodeB.ID(), Sessions: encB.Sessions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, ok := p.(*Handshake)
+	if !ok {
+		t.Fatalf("decoded %T, want *Handshake", p)
+	}
+	if h.SrcID != nodeA.ID() {
+		t.Errorf("handshake from %v, want %v", h.SrcID, nodeA.ID())
+	}
+	if h.Record == nil || h.Record.Seq() != encA.Record.Seq() {
+		t.Errorf("handshake record %v, want A's", h.Record)
+	}
+	sameMessage(t, h.Body, ping)
+
+	for _, msg := range testMessages(t) {
+		t.Run(msg.Name(), func(t *testing.T) {
+			for _, dir := range []struct {
+				from     *Encoder
+				to       *enode.Node
+				sessions *SessionStore
+			}{
+				{encA, nodeB, encB.Sessions},
+				{encB, nodeA, encA.Sessions},
+			} {
+				packet, err := dir.from.Encode(dir.to, msg, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				p, err := Decode(packet, DecodeOptions{Dest: dir.to.ID(), Sessions: dir.sessions})
+				if err != nil {
+					t.Fatal(err)
+				}
+				m, ok := p.(*Message)
+				if !ok {
+					t.Fatalf("decoded %T, want *Message", p)
+				}
+				if m.SrcID != dir.from.ID() {
+					t.Errorf("message from %v, want %v", m.SrcID, dir.from.ID())
+				}
+				sameMessage(t, m.Body, msg)
+			}
+		})
+	}
+}
+
+func TestEncodeRejects(t *testing.T) {
+	encA, _, _, nodeB := benchNodes()
+	if _, err := encA.Encode(nodeB, &Message{}, nil); err == nil {
+		t.Error("encoded a *Message")
+	}
+	_, err := encA.Encode(nodeB, &Ping{ReqID: make([]byte, 9)}, &Whoareyou{ChallengeData: []byte{1}})
+	if !errors.Is(err, errInvalidReqID) {
+		t.Errorf("request ID of 9 bytes: error %v, want %v", err, errInvalidReqID)
+	}
+}
+
+// TestEncodeKeyLog checks a third party decrypts a session from the key
+// log of its initiator, as a capture would be.
+func TestEncodeKeyLog(t *testing.T) {
+	encA, encB, nodeA, nodeB := benchNodes()
+	var keyLog bytes.Buffer
+	encA.KeyLog = &keyLog
+
+	challenge := &Whoareyou{}
+	if _, err := encB.Encode(nodeA, challenge, nil); err != nil {
+		t.Fatal(err)
+	}
+	ping := &Ping{ReqID: []byte{1}, ENRSeq: 1}
+	handshake, err := encA.Encode(nodeB, ping, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pong := &Pong{ReqID: []byte{1}, ENRSeq: 1, ToIP: net.IPv4(10, 0, 0, 1).To4(), ToPort: 30303}
+	if _, err := Decode(append([]byte(nil), handshake...), DecodeOptions{Dest: nodeB.ID(), Sessions: encB.Sessions}); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := encB.Encode(nodeA, pong, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := ReadKeyLog(&keyLog)
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("key log holds %d sessions, error %v", len(keys), err)
+	}
+	observer := NewSessionStore()
+	observer.AddLoggedSessions(keys)
+	p, err := Decode(handshake, DecodeOptions{Dest: nodeB.ID(), Sessions: observer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameMessage(t, p.(*Handshake).Body, ping)
+	p, err = Decode(reply, DecodeOptions{Dest: nodeA.ID(), Sessions: observer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sameMessage(t, p.(*Message).Body, pong)
+}
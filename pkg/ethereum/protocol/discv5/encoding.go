@@ -1,8 +1,9 @@
 package discv5
 
 import (
-	"crypto/aes"
 	"crypto/cipher"
+	"encoding/binary"
+	"github.com/drgomesp/etherspy/pkg/ethereum/fastcrypto"
 	"github.com/ethereum/go-ethereum/p2p/enode"
 )
 
@@ -46,11 +47,22 @@ type (
 
 // headerMask returns a cipher for 'masking' / 'unmasking' packet headers.
 func (h *Header) mask(destID enode.ID) cipher.Stream {
-	block, err := aes.NewCipher(destID[:16])
+	stream, err := fastcrypto.NewCTR(destID[:16], h.IV[:])
 	if err != nil {
 		panic("can't create cipher")
 	}
-	return cipher.NewCTR(block, h.IV[:])
+	return stream
+}
+
+// decode reads the static header from b, which holds sizeofStaticHeader
+// bytes. Fields are read one by one as binary.Read would, without its
+// allocations.
+func (h *StaticHeader) decode(b []byte) {
+	copy(h.ProtocolID[:], b)
+	h.Version = binary.BigEndian.Uint16(b[6:])
+	h.Flag = b[8]
+	copy(h.Nonce[:], b[9:])
+	h.AuthSize = binary.BigEndian.Uint16(b[9+gcmNonceSize:])
 }
 
 // checkValid performs some basic validity checks on the header.
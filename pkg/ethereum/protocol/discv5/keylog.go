@@ -0,0 +1,112 @@
+package discv5
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"io"
+	"strings"
+)
+
+// A key log holds session keys, as NSS key logs do for TLS, so captures of
+// nodes instrumented to write one can be decrypted offline. Every line
+// holds the keys of a session, hex encoded and space separated:
+//
+//	DISCV5_SESSION <nonce> <initiator ID> <recipient ID> <initiator key> <recipient key>
+//
+// where the nonce is that of the handshake message establishing the
+// session, the initiator key encrypts the messages the initiator sends and
+// the recipient key those it receives. Empty lines and lines starting with
+// # are ignored, as are lines of other labels.
+const keyLogLabel = "DISCV5_SESSION"
+
+// SessionKeys are the keys of a session and the nonce of the handshake
+// message that established it.
+type SessionKeys struct {
+	Nonce                      Nonce
+	Initiator, Recipient       enode.ID
+	InitiatorKey, RecipientKey []byte
+}
+
+// WriteKeyLog appends the keys of a session to a key log.
+func WriteKeyLog(w io.Writer, k SessionKeys) error {
+	_, err := fmt.Fprintf(w, "%s %x %x %x %x %x\n", keyLogLabel, k.Nonce[:], k.Initiator[:], k.Recipient[:], k.InitiatorKey, k.RecipientKey)
+	return err
+}
+
+// ReadKeyLog returns the session keys of a key log, in order.
+func ReadKeyLog(r io.Reader) ([]SessionKeys, error) {
+	var keys []SessionKeys
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || fields[0] != keyLogLabel {
+			continue
+		}
+		k, err := parseKeyLogLine(fields[1:])
+		if err != nil {
+			return nil, fmt.Errorf("key log line %d: %v", line, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, s.Err()
+}
+
+func parseKeyLogLine(fields []string) (k SessionKeys, err error) {
+	if len(fields) != 5 {
+		return k, fmt.Errorf("want 5 fields after %s, got %d", keyLogLabel, len(fields))
+	}
+	var raw [5][]byte
+	for i, f := range fields {
+		if raw[i], err = hex.DecodeString(f); err != nil {
+			return k, fmt.Errorf("field %d: %v", i+2, err)
+		}
+	}
+	switch {
+	case len(raw[0]) != len(k.Nonce):
+		return k, fmt.Errorf("nonce of %d bytes, want %d", len(raw[0]), len(k.Nonce))
+	case len(raw[1]) != len(k.Initiator) || len(raw[2]) != len(k.Recipient):
+		return k, fmt.Errorf("node IDs must be of %d bytes", len(k.Initiator))
+	case len(raw[3]) != aesKeySize || len(raw[4]) != aesKeySize:
+		return k, fmt.Errorf("keys must be of %d bytes", aesKeySize)
+	}
+	copy(k.Nonce[:], raw[0])
+	copy(k.Initiator[:], raw[1])
+	copy(k.Recipient[:], raw[2])
+	k.InitiatorKey, k.RecipientKey = raw[3], raw[4]
+	return k, nil
+}
+
+// AddLoggedSessions registers the sessions of a key log. A session is
+// taken into use when the handshake establishing it is decoded. Until then,
+// messages between a pair of nodes are decrypted with the earliest session
+// logged for them, which was likely under way when the capture started.
+func (s *SessionStore) AddLoggedSessions(keys []SessionKeys) {
+	initial := make(map[sessionID]bool)
+	s.mu.Lock()
+	for _, k := range keys {
+		s.logged[k.Nonce] = k
+	}
+	s.mu.Unlock()
+	for _, k := range keys {
+		id := sessionID{k.Initiator, k.Recipient}
+		if !initial[id] {
+			initial[id], initial[sessionID{k.Recipient, k.Initiator}] = true, true
+			s.SetSession(k.Initiator, k.Recipient, k.InitiatorKey, k.RecipientKey)
+		}
+	}
+}
+
+// useLogged takes the logged session established by the handshake with the
+// given nonce into use, reporting whether there is one.
+func (s *SessionStore) useLogged(src, dst enode.ID, nonce Nonce) bool {
+	s.mu.Lock()
+	k, ok := s.logged[nonce]
+	s.mu.Unlock()
+	if !ok || k.Initiator != src || k.Recipient != dst {
+		return false
+	}
+	s.SetSession(k.Initiator, k.Recipient, k.InitiatorKey, k.RecipientKey)
+	return true
+}
@@ -0,0 +1,189 @@
+package discv5
+
+import (
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+)
+
+// FindNode is a query for nodes at the given logarithmic distances.
+type FindNode struct {
+	ReqID     []byte
+	Distances []uint
+}
+
+// Nodes is the response to FindNode and TopicQuery. Large responses are
+// split across Total messages.
+type Nodes struct {
+	ReqID []byte
+	Total uint8
+	Nodes []*enr.Record
+}
+
+// TalkRequest carries an application-level request of a sub-protocol.
+// Payload is Message as decoded by the decoder registered for Protocol, see
+// RegisterTalkProtocol.
+type TalkRequest struct {
+	ReqID    []byte
+	Protocol string
+	Message  []byte
+
+	Payload      interface{} `rlp:"-" json:",omitempty"`
+	PayloadError string      `rlp:"-" json:",omitempty"`
+}
+
+// TalkResponse is the response to TalkRequest. Responses don't name their
+// protocol, Protocol and Payload are only set when the request was decoded
+// with the same session store.
+type TalkResponse struct {
+	ReqID   []byte
+	Message []byte
+
+	Protocol     string      `rlp:"-" json:",omitempty"`
+	Payload      interface{} `rlp:"-" json:",omitempty"`
+	PayloadError string      `rlp:"-" json:",omitempty"`
+}
+
+// RegTopic asks for the sender to be registered in a topic queue.
+type RegTopic struct {
+	ReqID  []byte
+	Topic  []byte
+	ENR    *enr.Record
+	Ticket []byte
+}
+
+// Ticket is the response to RegTopic, to be presented again after waiting
+// WaitTime seconds.
+type Ticket struct {
+	ReqID    []byte
+	Ticket   []byte
+	WaitTime uint
+}
+
+// RegConfirmation notifies the sender that it was registered for Topic.
+type RegConfirmation struct {
+	ReqID []byte
+	Topic []byte
+}
+
+// TopicQuery asks for nodes registered for Topic.
+type TopicQuery struct {
+	ReqID []byte
+	Topic []byte
+}
+
+func (p *FindNode) Name() string              { return "FIND_NODE" }
+func (p *FindNode) Kind() PacketKind          { return PacketFindNode }
+func (p *FindNode) RequestID() []byte         { return p.ReqID }
+func (p *FindNode) SetRequestID(bytes []byte) { p.ReqID = bytes }
+
+func (p *Nodes) Name() string              { return "NODES" }
+func (p *Nodes) Kind() PacketKind          { return PacketNodes }
+func (p *Nodes) RequestID() []byte         { return p.ReqID }
+func (p *Nodes) SetRequestID(bytes []byte) { p.ReqID = bytes }
+
+func (p *TalkRequest) Name() string              { return "TALK_REQUEST" }
+func (p *TalkRequest) Kind() PacketKind          { return PacketTalkRequest }
+func (p *TalkRequest) RequestID() []byte         { return p.ReqID }
+func (p *TalkRequest) SetRequestID(bytes []byte) { p.ReqID = bytes }
+
+func (p *TalkResponse) Name() string              { return "TALK_RESPONSE" }
+func (p *TalkResponse) Kind() PacketKind          { return PacketTalkResponse }
+func (p *TalkResponse) RequestID() []byte         { return p.ReqID }
+func (p *TalkResponse) SetRequestID(bytes []byte) { p.ReqID = bytes }
+
+func (p *RegTopic) Name() string              { return "REG_TOPIC" }
+func (p *RegTopic) Kind() PacketKind          { return PacketRegTopic }
+func (p *RegTopic) RequestID() []byte         { return p.ReqID }
+func (p *RegTopic) SetRequestID(bytes []byte) { p.ReqID = bytes }
+
+func (p *Ticket) Name() string              { return "TICKET" }
+func (p *Ticket) Kind() PacketKind          { return PacketTicket }
+func (p *Ticket) RequestID() []byte         { return p.ReqID }
+func (p *Ticket) SetRequestID(bytes []byte) { p.ReqID = bytes }
+
+func (p *RegConfirmation) Name() string              { return "REG_CONFIRMATION" }
+func (p *RegConfirmation) Kind() PacketKind          { return PacketRegConfirmation }
+func (p *RegConfirmation) RequestID() []byte         { return p.ReqID }
+func (p *RegConfirmation) SetRequestID(bytes []byte) { p.ReqID = bytes }
+
+func (p *TopicQuery) Name() string              { return "TOPIC_QUERY" }
+func (p *TopicQuery) Kind() PacketKind          { return PacketTopicQuery }
+func (p *TopicQuery) RequestID() []byte         { return p.ReqID }
+func (p *TopicQuery) SetRequestID(bytes []byte) { p.ReqID = bytes }
+
+// RelayInit asks a relay to introduce the initiator to Target, a node the
+// initiator could not reach, as part of NAT hole punching. Nonce is that of
+// the initiator's message the target did not answer. It is a notification,
+// without request ID.
+type RelayInit struct {
+	Initiator *enr.Record
+	Target    enode.ID
+	Nonce     Nonce
+}
+
+// RelayMsg is the introduction a relay forwards to the target of a
+// RelayInit, which then punches a hole by answering the initiator's Nonce
+// with a WHOAREYOU.
+type RelayMsg struct {
+	Initiator *enr.Record
+	Nonce     Nonce
+}
+
+// The hole punching notifications reuse the kinds of the retired topic
+// messages, they are told apart by their encoding.
+const (
+	PacketRelayInit = PacketRegTopic
+	PacketRelayMsg  = PacketTicket
+)
+
+func (p *RelayInit) Name() string              { return "RELAYINIT" }
+func (p *RelayInit) Kind() PacketKind          { return PacketRelayInit }
+func (p *RelayInit) RequestID() []byte         { return nil }
+func (p *RelayInit) SetRequestID(bytes []byte) {}
+
+func (p *RelayMsg) Name() string              { return "RELAYMSG" }
+func (p *RelayMsg) Kind() PacketKind          { return PacketRelayMsg }
+func (p *RelayMsg) RequestID() []byte         { return nil }
+func (p *RelayMsg) SetRequestID(bytes []byte) {}
+
+// newNotification returns an empty notification of the given kind, or nil
+// if no notification has this kind.
+func newNotification(kind PacketKind) Packet {
+	switch kind {
+	case PacketRelayInit:
+		return new(RelayInit)
+	case PacketRelayMsg:
+		return new(RelayMsg)
+	default:
+		return nil
+	}
+}
+
+// newMessage returns an empty message of the given kind, or nil if the kind
+// is not a message.
+func newMessage(kind PacketKind) Packet {
+	switch kind {
+	case PacketPing:
+		return new(Ping)
+	case PacketPong:
+		return new(Pong)
+	case PacketFindNode:
+		return new(FindNode)
+	case PacketNodes:
+		return new(Nodes)
+	case PacketTalkRequest:
+		return new(TalkRequest)
+	case PacketTalkResponse:
+		return new(TalkResponse)
+	case PacketRegTopic:
+		return new(RegTopic)
+	case PacketTicket:
+		return new(Ticket)
+	case PacketRegConfirmation:
+		return new(RegConfirmation)
+	case PacketTopicQuery:
+		return new(TopicQuery)
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,220 @@
+package discv5
+
+import (
+	"encoding/binary"
+	"github.com/drgomesp/etherspy/pkg/errcode"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Whoareyou is the challenge sent in response to a message that could not be
+// decrypted, asking the sender to perform a handshake.
+type Whoareyou struct {
+	Nonce     Nonce    // nonce of the message that triggered the challenge
+	IDNonce   [16]byte // ID proof data
+	RecordSeq uint64   // highest known ENR sequence of the challenger
+
+	// ChallengeData is the masking IV and unmasked header of the packet,
+	// which is the input of the handshake key derivation.
+	ChallengeData []byte
+}
+
+// Message is an ordinary message packet. The message itself is encrypted
+// with the session keys of the sender and recipient, Body is only set when
+// those are known.
+type Message struct {
+	SrcID enode.ID
+	Nonce Nonce
+
+	// HeaderData is the masking IV and unmasked header, authenticated as
+	// associated data of the encrypted message.
+	HeaderData []byte
+	Ciphertext []byte
+
+	Plaintext []byte
+	Body      Packet
+}
+
+// Handshake is a message packet which also establishes a new session in
+// response to a WHOAREYOU challenge.
+type Handshake struct {
+	SrcID           enode.ID
+	Nonce           Nonce
+	Signature       []byte      // ID nonce signature
+	EphemeralPubkey []byte      // compressed ephemeral public key
+	Record          *enr.Record // the sender's record, nil if not sent
+
+	HeaderData []byte
+	Ciphertext []byte
+
+	Plaintext []byte
+	Body      Packet
+}
+
+func (p *Whoareyou) Name() string              { return "WHOAREYOU" }
+func (p *Whoareyou) Kind() PacketKind          { return PacketWhoAreYou }
+func (p *Whoareyou) RequestID() []byte         { return nil }
+func (p *Whoareyou) SetRequestID(bytes []byte) {}
+
+func (p *Message) Name() string              { return bodyName("MESSAGE", p.Body) }
+func (p *Message) Kind() PacketKind          { return bodyKind(p.Body) }
+func (p *Message) RequestID() []byte         { return bodyRequestID(p.Body) }
+func (p *Message) SetRequestID(bytes []byte) {}
+
+func (p *Handshake) Name() string              { return bodyName("HANDSHAKE", p.Body) }
+func (p *Handshake) Kind() PacketKind          { return bodyKind(p.Body) }
+func (p *Handshake) RequestID() []byte         { return bodyRequestID(p.Body) }
+func (p *Handshake) SetRequestID(bytes []byte) {}
+
+func bodyName(name string, body Packet) string {
+	if body == nil {
+		return name
+	}
+	return name + "/" + body.Name()
+}
+
+func bodyKind(body Packet) PacketKind {
+	if body == nil {
+		return PacketUnknown
+	}
+	return body.Kind()
+}
+
+func bodyRequestID(body Packet) []byte {
+	if body == nil {
+		return nil
+	}
+	return body.RequestID()
+}
+
+// decodeMessageBody decodes a decrypted message: a kind byte followed by the
+// RLP encoded message.
+func decodeMessageBody(pt []byte) (Packet, error) {
+	kind := PacketKind(pt[0])
+	p := newMessage(kind)
+	if p == nil {
+		return nil, errcode.Errorf(codeUnknownMessage, "unknown message kind: %d", kind)
+	}
+	if err := rlp.DecodeBytes(pt[1:], p); err != nil {
+		n := newNotification(kind)
+		if n == nil || rlp.DecodeBytes(pt[1:], n) != nil {
+			return nil, errcode.Wrap(codeBadRLP, err)
+		}
+		return n, nil
+	}
+	if len(p.RequestID()) > maxRequestIDSize {
+		return nil, errInvalidReqID
+	}
+	return p, nil
+}
+
+func decodeWhoareyou(head *Header, headerData []byte, dest enode.ID, sessions *SessionStore) (Packet, error) {
+	if len(head.AuthData) != sizeofWhoareyouAuthData {
+		return nil, errAuthSize
+	}
+	if sessions != nil {
+		sessions.storeChallenge(dest, headerData)
+	}
+	p := &Whoareyou{Nonce: head.Nonce, ChallengeData: headerData}
+	n := copy(p.IDNonce[:], head.AuthData)
+	p.RecordSeq = binary.BigEndian.Uint64(head.AuthData[n:])
+	return p, nil
+}
+
+func decodeMessage(head *Header, headerData, msgData []byte, dest enode.ID, sessions *SessionStore) (Packet, error) {
+	if len(head.AuthData) != sizeofMessageAuthData {
+		return nil, errAuthSize
+	}
+	if len(msgData) == 0 {
+		return nil, errMessageTooShort
+	}
+	p := &Message{
+		Nonce:      head.Nonce,
+		HeaderData: headerData,
+		Ciphertext: msgData,
+	}
+	copy(p.SrcID[:], head.AuthData)
+	head.src = p.SrcID
+	if sessions != nil {
+		if pt, err := sessions.decrypt(p.SrcID, dest, p.Nonce, headerData, msgData); err == nil {
+			p.Plaintext = pt
+			if p.Body, err = decodeMessageBody(pt); err == nil {
+				decodeTalk(p.Body, p.SrcID, dest, sessions)
+			}
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+func decodeHandshake(head *Header, headerData, msgData []byte, dest enode.ID, sessions *SessionStore) (Packet, error) {
+	auth, err := decodeHandshakeAuthData(head)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgData) == 0 {
+		return nil, errMessageTooShort
+	}
+	head.src = auth.h.SrcID
+
+	p := &Handshake{
+		SrcID:           auth.h.SrcID,
+		Nonce:           head.Nonce,
+		Signature:       auth.signature,
+		EphemeralPubkey: auth.pubkey,
+		HeaderData:      headerData,
+		Ciphertext:      msgData,
+	}
+	if len(auth.record) > 0 {
+		p.Record = new(enr.Record)
+		if err := rlp.DecodeBytes(auth.record, p.Record); err != nil {
+			return nil, errNoRecord
+		}
+	}
+	if sessions != nil {
+		if !sessions.useLogged(p.SrcID, dest, p.Nonce) {
+			sessions.completeHandshake(p.SrcID, dest, p.EphemeralPubkey)
+		}
+		if pt, err := sessions.decrypt(p.SrcID, dest, p.Nonce, headerData, msgData); err == nil {
+			p.Plaintext = pt
+			if p.Body, err = decodeMessageBody(pt); err == nil {
+				decodeTalk(p.Body, p.SrcID, dest, sessions)
+			}
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// decodeHandshakeAuthData splits the variable-size handshake auth data.
+func decodeHandshakeAuthData(head *Header) (auth handshakeAuthData, err error) {
+	if len(head.AuthData) < sizeofHandshakeAuthData {
+		return auth, errTooShort
+	}
+	copy(auth.h.SrcID[:], head.AuthData)
+	auth.h.SigSize = head.AuthData[len(auth.h.SrcID)]
+	auth.h.PubkeySize = head.AuthData[len(auth.h.SrcID)+1]
+
+	varspace := head.AuthData[sizeofHandshakeAuthData:]
+	if len(varspace) < int(auth.h.SigSize)+int(auth.h.PubkeySize) {
+		return auth, errTooShort
+	}
+	auth.signature = varspace[:auth.h.SigSize]
+	auth.pubkey = varspace[auth.h.SigSize : auth.h.SigSize+auth.h.PubkeySize]
+	auth.record = varspace[auth.h.SigSize+auth.h.PubkeySize:]
+	return auth, nil
+}
+
+// SrcID returns the node ID of the sender of p, which only message and
+// handshake packets carry.
+func SrcID(p Packet) (enode.ID, bool) {
+	switch p := p.(type) {
+	case *Message:
+		return p.SrcID, true
+	case *Handshake:
+		return p.SrcID, true
+	default:
+		return enode.ID{}, false
+	}
+}
@@ -0,0 +1,355 @@
+package discv5
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Portal Network sub-protocols, by TALKREQ protocol identifier.
+// https://github.com/ethereum/portal-network-specs/blob/master/portal-wire-protocol.md
+var portalNetworks = map[string]string{
+	"\x50\x0a": "state",
+	"\x50\x0b": "history",
+	"\x50\x0c": "beacon",
+}
+
+func init() {
+	for protocol, network := range portalNetworks {
+		network := network
+		RegisterTalkProtocol(protocol, func(msg []byte, request bool) (interface{}, error) {
+			return DecodePortal(network, msg, request)
+		})
+	}
+}
+
+// Portal wire protocol message kinds.
+const (
+	portalPing = iota
+	portalPong
+	portalFindNodes
+	portalNodes
+	portalFindContent
+	portalContent
+	portalOffer
+	portalAccept
+)
+
+var portalKinds = []string{"PING", "PONG", "FIND_NODES", "NODES", "FIND_CONTENT", "CONTENT", "OFFER", "ACCEPT"}
+
+// PortalMessage is a decoded Portal wire protocol message. Message is one
+// of the Portal* message types.
+type PortalMessage struct {
+	Network string
+	Kind    string
+	Message interface{}
+}
+
+// PortalPing and PortalPong check liveness and exchange record sequence
+// numbers, along with network-specific data such as the radius of the
+// content a node stores.
+type PortalPing struct {
+	ENRSeq        uint64
+	CustomPayload []byte
+}
+
+type PortalPong PortalPing
+
+// PortalFindNodes asks for nodes at the given logarithmic distances.
+type PortalFindNodes struct {
+	Distances []uint16
+}
+
+// PortalNodes answers PortalFindNodes, in Total messages.
+type PortalNodes struct {
+	Total uint8
+	ENRs  []*enr.Record
+}
+
+// PortalFindContent asks for content, or for nodes closer to it.
+type PortalFindContent struct {
+	ContentKey PortalContentKey
+}
+
+// PortalContent answers PortalFindContent with one of: the ID of a uTP
+// connection the content follows over, the content itself or closer nodes.
+type PortalContent struct {
+	ConnectionID []byte        `json:",omitempty"`
+	Content      []byte        `json:",omitempty"`
+	ENRs         []*enr.Record `json:",omitempty"`
+}
+
+// PortalOffer offers content to a node.
+type PortalOffer struct {
+	ContentKeys []PortalContentKey
+}
+
+// PortalAccept answers PortalOffer with the ID of the uTP connection to
+// transfer the content over and which of the offered keys are wanted.
+type PortalAccept struct {
+	ConnectionID []byte
+	Accepted     []bool
+}
+
+// PortalContentKey identifies Portal content. Type names the content, Hash
+// is set for content keyed by block hash or root, Number for content keyed
+// by block number, slot, period or epoch.
+type PortalContentKey struct {
+	Type   string
+	Hash   []byte `json:",omitempty"`
+	Number uint64 `json:",omitempty"`
+	Count  uint64 `json:",omitempty"`
+	Raw    []byte
+}
+
+var errPortalTruncated = errors.New("portal: message truncated")
+
+// DecodePortal decodes a message of the given Portal network, a TALKREQ
+// payload if request is set and a TALKRESP payload otherwise. Messages are
+// SSZ containers prefixed by their kind.
+func DecodePortal(network string, msg []byte, request bool) (*PortalMessage, error) {
+	if len(msg) == 0 {
+		return nil, errPortalTruncated
+	}
+	kind, b := msg[0], msg[1:]
+	if int(kind) >= len(portalKinds) {
+		return nil, fmt.Errorf("portal: unknown message kind %d", kind)
+	}
+	// Requests have even kinds, their responses the next odd one.
+	if request != (kind%2 == 0) {
+		return nil, fmt.Errorf("portal: %s sent as a %s", portalKinds[kind], map[bool]string{true: "request", false: "response"}[request])
+	}
+	m := &PortalMessage{Network: network, Kind: portalKinds[kind]}
+	var err error
+	switch kind {
+	case portalPing, portalPong:
+		var p PortalPing
+		if len(b) < 12 {
+			return nil, errPortalTruncated
+		}
+		p.ENRSeq = binary.LittleEndian.Uint64(b)
+		p.CustomPayload, err = sszTail(b, 8, 12)
+		if kind == portalPong {
+			m.Message = (*PortalPong)(&p)
+		} else {
+			m.Message = &p
+		}
+	case portalFindNodes:
+		var list []byte
+		if list, err = sszTail(b, 0, 4); err == nil {
+			if len(list)%2 != 0 {
+				return nil, errPortalTruncated
+			}
+			f := &PortalFindNodes{Distances: make([]uint16, len(list)/2)}
+			for i := range f.Distances {
+				f.Distances[i] = binary.LittleEndian.Uint16(list[2*i:])
+			}
+			m.Message = f
+		}
+	case portalNodes:
+		if len(b) < 5 {
+			return nil, errPortalTruncated
+		}
+		n := &PortalNodes{Total: b[0]}
+		n.ENRs, err = sszRecords(b, 1, 5)
+		m.Message = n
+	case portalFindContent:
+		var key []byte
+		if key, err = sszTail(b, 0, 4); err == nil {
+			m.Message = &PortalFindContent{ContentKey: portalContentKey(network, key)}
+		}
+	case portalContent:
+		m.Message, err = decodePortalContent(b)
+	case portalOffer:
+		var keys [][]byte
+		if keys, err = sszByteLists(b, 0, 4); err == nil {
+			o := &PortalOffer{ContentKeys: make([]PortalContentKey, len(keys))}
+			for i, k := range keys {
+				o.ContentKeys[i] = portalContentKey(network, k)
+			}
+			m.Message = o
+		}
+	case portalAccept:
+		if len(b) < 6 {
+			return nil, errPortalTruncated
+		}
+		a := &PortalAccept{ConnectionID: b[:2]}
+		var bits []byte
+		if bits, err = sszTail(b, 2, 6); err == nil {
+			a.Accepted, err = sszBitList(bits)
+		}
+		m.Message = a
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// decodePortalContent decodes the union answering PortalFindContent.
+func decodePortalContent(b []byte) (*PortalContent, error) {
+	if len(b) == 0 {
+		return nil, errPortalTruncated
+	}
+	c := new(PortalContent)
+	var err error
+	switch b[0] {
+	case 0:
+		if len(b) != 3 {
+			return nil, errPortalTruncated
+		}
+		c.ConnectionID = b[1:]
+	case 1:
+		c.Content = b[1:]
+	case 2:
+		c.ENRs, err = sszRecordList(b[1:])
+	default:
+		return nil, fmt.Errorf("portal: unknown content selector %d", b[0])
+	}
+	return c, err
+}
+
+// portalContentKey names the content of a key of the given network.
+func portalContentKey(network string, key []byte) PortalContentKey {
+	k := PortalContentKey{Type: "unknown", Raw: key}
+	if len(key) == 0 {
+		return k
+	}
+	b := key[1:]
+	u64 := func(i int) uint64 {
+		if len(b) < i+8 {
+			return 0
+		}
+		return binary.LittleEndian.Uint64(b[i:])
+	}
+	hash := func() []byte {
+		if len(b) < 32 {
+			return nil
+		}
+		return b[:32]
+	}
+	switch network + "/" + fmt.Sprint(key[0]) {
+	case "history/0":
+		k.Type, k.Hash = "block_header", hash()
+	case "history/1":
+		k.Type, k.Hash = "block_body", hash()
+	case "history/2":
+		k.Type, k.Hash = "receipts", hash()
+	case "history/3":
+		k.Type, k.Number = "block_header_by_number", u64(0)
+	case "beacon/16":
+		k.Type, k.Hash = "light_client_bootstrap", hash()
+	case "beacon/17":
+		k.Type, k.Number, k.Count = "light_client_updates_by_range", u64(0), u64(8)
+	case "beacon/18":
+		k.Type, k.Number = "light_client_finality_update", u64(0)
+	case "beacon/19":
+		k.Type, k.Number = "light_client_optimistic_update", u64(0)
+	case "beacon/20":
+		k.Type, k.Number = "historical_summaries_with_proof", u64(0)
+	case "state/32":
+		k.Type = "account_trie_node"
+	case "state/33":
+		k.Type = "contract_trie_node"
+	case "state/34":
+		k.Type = "contract_bytecode"
+	}
+	return k
+}
+
+// sszTail returns the variable-size field of a container whose offset is
+// at b[at:], the last field of a fixed part of size fixed.
+func sszTail(b []byte, at, fixed int) ([]byte, error) {
+	if len(b) < fixed {
+		return nil, errPortalTruncated
+	}
+	off := int(binary.LittleEndian.Uint32(b[at:]))
+	if off != fixed || off > len(b) {
+		return nil, fmt.Errorf("portal: invalid offset %d", off)
+	}
+	return b[off:], nil
+}
+
+// sszByteLists decodes a list of byte lists, the variable-size field of a
+// container as with sszTail.
+func sszByteLists(b []byte, at, fixed int) ([][]byte, error) {
+	list, err := sszTail(b, at, fixed)
+	if err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return nil, nil
+	}
+	if len(list) < 4 {
+		return nil, errPortalTruncated
+	}
+	// Items are preceded by their offsets, the first tells their count.
+	first := int(binary.LittleEndian.Uint32(list))
+	if first%4 != 0 || first < 4 || first > len(list) {
+		return nil, fmt.Errorf("portal: invalid offset %d", first)
+	}
+	items := make([][]byte, first/4)
+	for i := range items {
+		start := int(binary.LittleEndian.Uint32(list[4*i:]))
+		end := len(list)
+		if i+1 < len(items) {
+			end = int(binary.LittleEndian.Uint32(list[4*(i+1):]))
+		}
+		if start < first || end < start || end > len(list) {
+			return nil, fmt.Errorf("portal: invalid offset %d", start)
+		}
+		items[i] = list[start:end]
+	}
+	return items, nil
+}
+
+// sszRecords decodes a list of records, the variable-size field of a
+// container as with sszTail.
+func sszRecords(b []byte, at, fixed int) ([]*enr.Record, error) {
+	items, err := sszByteLists(b, at, fixed)
+	if err != nil {
+		return nil, err
+	}
+	return decodeRecords(items)
+}
+
+// sszRecordList decodes a list of records making up a whole value.
+func sszRecordList(b []byte) ([]*enr.Record, error) {
+	// A list is encoded as a container holding just it.
+	prefixed := make([]byte, 4+len(b))
+	binary.LittleEndian.PutUint32(prefixed, 4)
+	copy(prefixed[4:], b)
+	return sszRecords(prefixed, 0, 4)
+}
+
+func decodeRecords(items [][]byte) ([]*enr.Record, error) {
+	records := make([]*enr.Record, len(items))
+	for i, item := range items {
+		records[i] = new(enr.Record)
+		if err := rlp.DecodeBytes(item, records[i]); err != nil {
+			return nil, fmt.Errorf("portal: invalid record: %v", err)
+		}
+	}
+	return records, nil
+}
+
+// sszBitList decodes a bit list, whose length is marked by the highest bit
+// set in its last byte.
+func sszBitList(b []byte) ([]bool, error) {
+	if len(b) == 0 || b[len(b)-1] == 0 {
+		return nil, errors.New("portal: bit list without length")
+	}
+	last := b[len(b)-1]
+	n := 8 * (len(b) - 1)
+	for last > 1 {
+		last >>= 1
+		n++
+	}
+	bits := make([]bool, n)
+	for i := range bits {
+		bits[i] = b[i/8]&(1<<(i%8)) != 0
+	}
+	return bits, nil
+}
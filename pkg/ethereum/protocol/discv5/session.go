@@ -0,0 +1,167 @@
+package discv5
+
+import (
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"sync"
+)
+
+// sessionID identifies the direction of a session, messages sent by src to
+// dst are encrypted with the same key.
+type sessionID struct {
+	src, dst enode.ID
+}
+
+// SessionStore tracks the state needed to decrypt captured messages: session
+// keys between node pairs, static keys of nodes under our control and the
+// WHOAREYOU challenges their handshakes answer. It also keeps the protocols
+// of the TALKREQs awaiting their response, to decode those.
+type SessionStore struct {
+	mu         sync.Mutex
+	privkeys   map[enode.ID]*ecdsa.PrivateKey
+	keys       map[sessionID][]byte
+	ciphers    map[sessionID]cipher.AEAD // of keys, set up once per session
+	challenges map[enode.ID][]byte       // challenge data keyed by the challenged node
+	talks      map[talkID]string         // protocols of TALKREQs awaiting their response
+	logged     map[Nonce]SessionKeys     // sessions of key logs, by handshake nonce
+}
+
+func NewSessionStore() *SessionStore {
+	return &SessionStore{
+		privkeys:   make(map[enode.ID]*ecdsa.PrivateKey),
+		keys:       make(map[sessionID][]byte),
+		ciphers:    make(map[sessionID]cipher.AEAD),
+		challenges: make(map[enode.ID][]byte),
+		talks:      make(map[talkID]string),
+		logged:     make(map[Nonce]SessionKeys),
+	}
+}
+
+// AddPrivateKey registers the static key of a node under our control, so
+// keys of handshakes addressed to it can be derived.
+func (s *SessionStore) AddPrivateKey(key *ecdsa.PrivateKey) {
+	s.mu.Lock()
+	s.privkeys[enode.PubkeyToIDV4(&key.PublicKey)] = key
+	s.mu.Unlock()
+}
+
+// SetSession registers externally obtained session keys between the
+// handshake initiator and recipient.
+func (s *SessionStore) SetSession(initiator, recipient enode.ID, initiatorKey, recipientKey []byte) {
+	s.mu.Lock()
+	s.keys[sessionID{initiator, recipient}] = initiatorKey
+	s.keys[sessionID{recipient, initiator}] = recipientKey
+	delete(s.ciphers, sessionID{initiator, recipient})
+	delete(s.ciphers, sessionID{recipient, initiator})
+	s.mu.Unlock()
+}
+
+// key returns the key encrypting messages sent by src to dst.
+func (s *SessionStore) key(src, dst enode.ID) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.keys[sessionID{src, dst}]
+}
+
+// storeChallenge remembers a WHOAREYOU challenge sent to the node dst.
+func (s *SessionStore) storeChallenge(dst enode.ID, challengeData []byte) {
+	s.mu.Lock()
+	s.challenges[dst] = append([]byte(nil), challengeData...)
+	s.mu.Unlock()
+}
+
+// completeHandshake derives the session keys of a handshake sent by src to
+// dst, if the static key of dst and the answered challenge are known.
+func (s *SessionStore) completeHandshake(src, dst enode.ID, ephkey []byte) bool {
+	s.mu.Lock()
+	priv, challenge := s.privkeys[dst], s.challenges[src]
+	s.mu.Unlock()
+	if priv == nil || challenge == nil {
+		return false
+	}
+
+	pub, err := decodePubkey(ephkey)
+	if err != nil {
+		return false
+	}
+	initiatorKey, recipientKey := deriveKeys(priv, pub, src, dst, challenge)
+	if initiatorKey == nil {
+		return false
+	}
+
+	s.SetSession(src, dst, initiatorKey, recipientKey)
+	s.mu.Lock()
+	delete(s.challenges, src)
+	s.mu.Unlock()
+	return true
+}
+
+// aead returns the cipher of the key encrypting messages sent by src to
+// dst, nil if unknown.
+func (s *SessionStore) aead(src, dst enode.ID) cipher.AEAD {
+	id := sessionID{src, dst}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c := s.ciphers[id]; c != nil {
+		return c
+	}
+	key := s.keys[id]
+	if key == nil {
+		return nil
+	}
+	c, err := newGCM(key)
+	if err != nil {
+		return nil
+	}
+	s.ciphers[id] = c
+	return c
+}
+
+// decrypt decrypts the message of a packet sent by src to dst.
+func (s *SessionStore) decrypt(src, dst enode.ID, nonce Nonce, headerData, ciphertext []byte) ([]byte, error) {
+	c := s.aead(src, dst)
+	if c == nil {
+		return nil, errMessageDecrypt
+	}
+	pt, err := c.Open(nil, nonce[:], ciphertext, headerData)
+	if err != nil {
+		return nil, errMessageDecrypt
+	}
+	if len(pt) == 0 {
+		return nil, errMessageTooShort
+	}
+	return pt, nil
+}
+
+// SessionSummary lists what a session store holds, without key material.
+type SessionSummary struct {
+	PrivateKeys []enode.ID    `json:"private_keys"` // nodes under our control
+	Sessions    [][2]enode.ID `json:"sessions"`     // sender, recipient of each known key
+	Challenges  []enode.ID    `json:"challenges"`   // challenged nodes yet to answer
+	Talks       int           `json:"talks"`        // TALKREQs awaiting their response
+	Logged      int           `json:"logged"`       // sessions read from key logs
+}
+
+// Summary returns what the store holds, for debugging.
+func (s *SessionStore) Summary() SessionSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sum := SessionSummary{
+		PrivateKeys: make([]enode.ID, 0, len(s.privkeys)),
+		Sessions:    make([][2]enode.ID, 0, len(s.keys)),
+		Challenges:  make([]enode.ID, 0, len(s.challenges)),
+		Talks:       len(s.talks),
+		Logged:      len(s.logged),
+	}
+	for id := range s.privkeys {
+		sum.PrivateKeys = append(sum.PrivateKeys, id)
+	}
+	for id := range s.keys {
+		sum.Sessions = append(sum.Sessions, [2]enode.ID{id.src, id.dst})
+	}
+	for id := range s.challenges {
+		sum.Challenges = append(sum.Challenges, id)
+	}
+	return sum
+}
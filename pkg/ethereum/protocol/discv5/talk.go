@@ -0,0 +1,103 @@
+package discv5
+
+import (
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"sync"
+)
+
+// TalkDecoder decodes the message of a TALKREQ, or of a TALKRESP if request
+// is false, of the sub-protocol it was registered for.
+type TalkDecoder func(msg []byte, request bool) (interface{}, error)
+
+var talkDecoders = struct {
+	sync.RWMutex
+	m map[string]TalkDecoder
+}{m: make(map[string]TalkDecoder)}
+
+// RegisterTalkProtocol registers the decoder of the TALKREQ sub-protocol
+// with the given protocol identifier, replacing any previous one. Decoders
+// of the Portal Network are registered by default.
+func RegisterTalkProtocol(protocol string, d TalkDecoder) {
+	talkDecoders.Lock()
+	talkDecoders.m[protocol] = d
+	talkDecoders.Unlock()
+}
+
+// talkDecoder returns the decoder of protocol, nil if none is registered.
+func talkDecoder(protocol string) TalkDecoder {
+	talkDecoders.RLock()
+	defer talkDecoders.RUnlock()
+	return talkDecoders.m[protocol]
+}
+
+// maxTalks bounds the requests awaiting their response in a session store.
+const maxTalks = 4096
+
+// talkID identifies a TALKREQ by its sender, recipient and request ID,
+// which its response echoes.
+type talkID struct {
+	requester, responder enode.ID
+	reqID                string
+}
+
+// decodeTalk decodes the payload of a TALKREQ or TALKRESP sent by src to
+// dst. The protocol of requests is remembered in sessions, if not nil, so
+// that of their responses is known.
+func decodeTalk(body Packet, src, dst enode.ID, sessions *SessionStore) {
+	var (
+		protocol string
+		msg      []byte
+		request  bool
+	)
+	switch p := body.(type) {
+	case *TalkRequest:
+		protocol, msg, request = p.Protocol, p.Message, true
+		if sessions != nil {
+			sessions.storeTalk(talkID{src, dst, string(p.ReqID)}, protocol)
+		}
+	case *TalkResponse:
+		if sessions == nil {
+			return
+		}
+		protocol, msg = sessions.takeTalk(talkID{dst, src, string(p.ReqID)}), p.Message
+		p.Protocol = protocol
+	default:
+		return
+	}
+	d := talkDecoder(protocol)
+	if d == nil {
+		return
+	}
+	payload, err := d(msg, request)
+	var errText string
+	if err != nil {
+		errText = err.Error()
+	}
+	switch p := body.(type) {
+	case *TalkRequest:
+		p.Payload, p.PayloadError = payload, errText
+	case *TalkResponse:
+		p.Payload, p.PayloadError = payload, errText
+	}
+}
+
+// storeTalk remembers the protocol of a request awaiting its response.
+func (s *SessionStore) storeTalk(id talkID, protocol string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.talks) >= maxTalks {
+		// Requests left unanswered would pile up otherwise.
+		s.talks = make(map[talkID]string)
+	}
+	s.talks[id] = protocol
+}
+
+// takeTalk returns the protocol of the request a response answers, empty
+// if unknown, and forgets the request.
+func (s *SessionStore) takeTalk(id talkID) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	protocol := s.talks[id]
+	delete(s.talks, id)
+	return protocol
+}
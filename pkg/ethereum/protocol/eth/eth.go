@@ -0,0 +1,144 @@
+// Package eth implements decoding of the eth wire protocol messages carried
+// over RLPx, versions eth/66 to eth/68.
+// https://github.com/ethereum/devp2p/blob/master/caps/eth.md
+package eth
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Supported protocol versions.
+const (
+	ETH66 = 66
+	ETH67 = 67
+	ETH68 = 68
+)
+
+// BaseProtocolLength is the number of message codes reserved by the p2p base
+// protocol. Message codes of eth, usually the first capability, follow it on
+// the wire.
+const BaseProtocolLength = 16
+
+// ProtocolLength is the number of message codes used by eth/66 to eth/68.
+// GetNodeData and NodeData remain reserved after eth/66.
+const ProtocolLength = 17
+
+type MessageKind uint64
+
+const (
+	MessageStatus MessageKind = iota
+	MessageNewBlockHashes
+	MessageTransactions
+	MessageGetBlockHeaders
+	MessageBlockHeaders
+	MessageGetBlockBodies
+	MessageBlockBodies
+	MessageNewBlock
+	MessageNewPooledTransactionHashes
+	MessageGetPooledTransactions
+	MessagePooledTransactions
+	_
+	_
+	MessageGetNodeData
+	MessageNodeData
+	MessageGetReceipts
+	MessageReceipts
+)
+
+func (k MessageKind) String() string {
+	switch k {
+	case MessageStatus:
+		return "STATUS"
+	case MessageNewBlockHashes:
+		return "NEW_BLOCK_HASHES"
+	case MessageTransactions:
+		return "TRANSACTIONS"
+	case MessageGetBlockHeaders:
+		return "GET_BLOCK_HEADERS"
+	case MessageBlockHeaders:
+		return "BLOCK_HEADERS"
+	case MessageGetBlockBodies:
+		return "GET_BLOCK_BODIES"
+	case MessageBlockBodies:
+		return "BLOCK_BODIES"
+	case MessageNewBlock:
+		return "NEW_BLOCK"
+	case MessageNewPooledTransactionHashes:
+		return "NEW_POOLED_TRANSACTION_HASHES"
+	case MessageGetPooledTransactions:
+		return "GET_POOLED_TRANSACTIONS"
+	case MessagePooledTransactions:
+		return "POOLED_TRANSACTIONS"
+	case MessageGetNodeData:
+		return "GET_NODE_DATA"
+	case MessageNodeData:
+		return "NODE_DATA"
+	case MessageGetReceipts:
+		return "GET_RECEIPTS"
+	case MessageReceipts:
+		return "RECEIPTS"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+type Message interface {
+	Name() string
+	Kind() MessageKind
+}
+
+// Decode decodes the payload of an eth message of the given kind, relative
+// to the capability offset, as sent by a peer speaking version.
+func Decode(version uint, kind MessageKind, data []byte) (Message, error) {
+	if version < ETH66 || version > ETH68 {
+		return nil, fmt.Errorf("unsupported eth version %d", version)
+	}
+	if version >= ETH67 && (kind == MessageGetNodeData || kind == MessageNodeData) {
+		return nil, fmt.Errorf("%s not supported by eth/%d", kind, version)
+	}
+
+	var msg Message
+	switch kind {
+	case MessageStatus:
+		msg = new(Status)
+	case MessageNewBlockHashes:
+		msg = new(NewBlockHashes)
+	case MessageTransactions:
+		msg = new(Transactions)
+	case MessageGetBlockHeaders:
+		msg = new(GetBlockHeaders)
+	case MessageBlockHeaders:
+		msg = new(BlockHeaders)
+	case MessageGetBlockBodies:
+		msg = new(GetBlockBodies)
+	case MessageBlockBodies:
+		msg = new(BlockBodies)
+	case MessageNewBlock:
+		msg = new(NewBlock)
+	case MessageNewPooledTransactionHashes:
+		p := new(NewPooledTransactionHashes)
+		if version < ETH68 {
+			// Before eth/68 announcements are a plain list of hashes.
+			return p, rlp.DecodeBytes(data, &p.Hashes)
+		}
+		msg = p
+	case MessageGetPooledTransactions:
+		msg = new(GetPooledTransactions)
+	case MessagePooledTransactions:
+		msg = new(PooledTransactions)
+	case MessageGetNodeData:
+		msg = new(GetNodeData)
+	case MessageNodeData:
+		msg = new(NodeData)
+	case MessageGetReceipts:
+		msg = new(GetReceipts)
+	case MessageReceipts:
+		msg = new(Receipts)
+	default:
+		return nil, fmt.Errorf("unknown message kind: %d", kind)
+	}
+	// Trailing data is tolerated for forward compatibility.
+	return msg, rlp.NewStream(bytes.NewReader(data), uint64(len(data))).Decode(msg)
+}
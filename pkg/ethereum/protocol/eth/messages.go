@@ -0,0 +1,165 @@
+package eth
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+	"math/big"
+)
+
+// Status is the handshake message exchanged right after the connection is
+// established.
+type Status struct {
+	ProtocolVersion uint32
+	NetworkID       uint64
+	TD              *big.Int
+	Head            common.Hash
+	Genesis         common.Hash
+	ForkID          ForkID
+	Rest            []rlp.RawValue `rlp:"tail"`
+}
+
+// NewBlockHashes announces blocks available at the sender.
+type NewBlockHashes []struct {
+	Hash   common.Hash
+	Number uint64
+}
+
+// Transactions propagates full transactions.
+type Transactions []Tx
+
+// BlockHeadersRequest describes a range of headers, Skip blocks apart.
+type BlockHeadersRequest struct {
+	Origin  HashOrNumber
+	Amount  uint64
+	Skip    uint64
+	Reverse bool
+}
+
+type GetBlockHeaders struct {
+	RequestID uint64
+	Request   BlockHeadersRequest
+}
+
+type BlockHeaders struct {
+	RequestID uint64
+	Headers   []*Header
+}
+
+type GetBlockBodies struct {
+	RequestID uint64
+	Hashes    []common.Hash
+}
+
+// BlockBody holds the transactions and uncles of a block, and the fields
+// added by later forks such as withdrawals in Rest.
+type BlockBody struct {
+	Transactions []Tx
+	Uncles       []*Header
+	Rest         []rlp.RawValue `rlp:"tail"`
+}
+
+type BlockBodies struct {
+	RequestID uint64
+	Bodies    []*BlockBody
+}
+
+// Block is a full block as propagated before the merge.
+type Block struct {
+	Header       *Header
+	Transactions []Tx
+	Uncles       []*Header
+	Rest         []rlp.RawValue `rlp:"tail"`
+}
+
+// NewBlock propagates a full block along with the total difficulty.
+type NewBlock struct {
+	Block *Block
+	TD    *big.Int
+}
+
+// NewPooledTransactionHashes announces transactions available at the
+// sender. Types and sizes are only sent since eth/68.
+type NewPooledTransactionHashes struct {
+	Types  []byte
+	Sizes  []uint32
+	Hashes []common.Hash
+}
+
+type GetPooledTransactions struct {
+	RequestID uint64
+	Hashes    []common.Hash
+}
+
+type PooledTransactions struct {
+	RequestID    uint64
+	Transactions []Tx
+}
+
+// GetNodeData requests state trie nodes by hash, eth/66 only.
+type GetNodeData struct {
+	RequestID uint64
+	Hashes    []common.Hash
+}
+
+type NodeData struct {
+	RequestID uint64
+	Data      [][]byte
+}
+
+type GetReceipts struct {
+	RequestID uint64
+	Hashes    []common.Hash
+}
+
+// Receipts holds the receipts of each requested block, left encoded.
+type Receipts struct {
+	RequestID uint64
+	Receipts  [][]rlp.RawValue
+}
+
+func (*Status) Name() string      { return "STATUS" }
+func (*Status) Kind() MessageKind { return MessageStatus }
+
+func (*NewBlockHashes) Name() string      { return "NEW_BLOCK_HASHES" }
+func (*NewBlockHashes) Kind() MessageKind { return MessageNewBlockHashes }
+
+func (*Transactions) Name() string      { return "TRANSACTIONS" }
+func (*Transactions) Kind() MessageKind { return MessageTransactions }
+
+func (*GetBlockHeaders) Name() string      { return "GET_BLOCK_HEADERS" }
+func (*GetBlockHeaders) Kind() MessageKind { return MessageGetBlockHeaders }
+
+func (*BlockHeaders) Name() string      { return "BLOCK_HEADERS" }
+func (*BlockHeaders) Kind() MessageKind { return MessageBlockHeaders }
+
+func (*GetBlockBodies) Name() string      { return "GET_BLOCK_BODIES" }
+func (*GetBlockBodies) Kind() MessageKind { return MessageGetBlockBodies }
+
+func (*BlockBodies) Name() string      { return "BLOCK_BODIES" }
+func (*BlockBodies) Kind() MessageKind { return MessageBlockBodies }
+
+func (*NewBlock) Name() string      { return "NEW_BLOCK" }
+func (*NewBlock) Kind() MessageKind { return MessageNewBlock }
+
+func (*NewPooledTransactionHashes) Name() string { return "NEW_POOLED_TRANSACTION_HASHES" }
+func (*NewPooledTransactionHashes) Kind() MessageKind {
+	return MessageNewPooledTransactionHashes
+}
+
+func (*GetPooledTransactions) Name() string      { return "GET_POOLED_TRANSACTIONS" }
+func (*GetPooledTransactions) Kind() MessageKind { return MessageGetPooledTransactions }
+
+func (*PooledTransactions) Name() string      { return "POOLED_TRANSACTIONS" }
+func (*PooledTransactions) Kind() MessageKind { return MessagePooledTransactions }
+
+func (*GetNodeData) Name() string      { return "GET_NODE_DATA" }
+func (*GetNodeData) Kind() MessageKind { return MessageGetNodeData }
+
+func (*NodeData) Name() string      { return "NODE_DATA" }
+func (*NodeData) Kind() MessageKind { return MessageNodeData }
+
+func (*GetReceipts) Name() string      { return "GET_RECEIPTS" }
+func (*GetReceipts) Kind() MessageKind { return MessageGetReceipts }
+
+func (*Receipts) Name() string      { return "RECEIPTS" }
+func (*Receipts) Kind() MessageKind { return MessageReceipts }
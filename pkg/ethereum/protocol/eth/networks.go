@@ -0,0 +1,89 @@
+package eth
+
+import (
+	"encoding/binary"
+	"github.com/ethereum/go-ethereum/common"
+	"hash/crc32"
+)
+
+// NetworkCustom names the networks whose fork IDs match no known network.
+const NetworkCustom = "custom"
+
+// Network is a public Ethereum network, as identified by EIP-2124 fork IDs.
+type Network struct {
+	Name      string
+	NetworkID uint64
+	Genesis   common.Hash
+	Forks     []uint64 // activation blocks, then timestamps, in order
+
+	hashes [][4]byte // after the genesis and each fork
+}
+
+// Known networks, fork IDs of nodes on their latest forks are only matched
+// once those are listed here.
+var (
+	Mainnet = newNetwork("mainnet", 1, "0xd4e56740f876aef8c010b86a40d5f56745a118d0906a34e69aec8c0db1cb8fa3",
+		1150000, 1920000, 2463000, 2675000, 4370000, 7280000, 9069000, 9200000, 12244000, 12965000, 13773000, 15050000,
+		1681338455, 1710338135, 1746612311, 1764798551, 1765290071, 1767747671)
+	Sepolia = newNetwork("sepolia", 11155111, "0x25a5cc106eea7138acab33231d7160d69cb777ee0c2c553fcddf5138993e6dd9",
+		1735371, 1677557088, 1706655072, 1741159776, 1760427360, 1761017184, 1761607008)
+	Holesky = newNetwork("holesky", 17000, "0xb5f7f912443c940f21fd611f12828d75b534364ed9e95ca4e307729a4661bde4",
+		1696000704, 1707305664, 1740434112, 1759308480, 1759800000, 1760389824)
+	Hoodi = newNetwork("hoodi", 560048, "0xbbe312868b376a3001692a646dd2d7d1e4406380dfd86b98aa8a34d1557c971b",
+		1742999832, 1761677592, 1762365720, 1762955544)
+
+	Networks = []*Network{Mainnet, Sepolia, Holesky, Hoodi}
+)
+
+func newNetwork(name string, id uint64, genesis string, forks ...uint64) *Network {
+	n := &Network{Name: name, NetworkID: id, Genesis: common.HexToHash(genesis), Forks: forks}
+	hash := crc32.ChecksumIEEE(n.Genesis[:])
+	n.hashes = append(n.hashes, checksum(hash))
+	for _, fork := range forks {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], fork)
+		hash = crc32.Update(hash, crc32.IEEETable, b[:])
+		n.hashes = append(n.hashes, checksum(hash))
+	}
+	return n
+}
+
+func checksum(hash uint32) (b [4]byte) {
+	binary.BigEndian.PutUint32(b[:], hash)
+	return b
+}
+
+// Matches reports whether id is a fork ID of n, at any of its forks.
+func (n *Network) Matches(id ForkID) bool {
+	for _, h := range n.hashes {
+		if h == id.Hash {
+			return true
+		}
+	}
+	return false
+}
+
+// Current returns the fork ID of n past its last known fork.
+func (n *Network) Current() ForkID {
+	return ForkID{Hash: n.hashes[len(n.hashes)-1]}
+}
+
+// ClassifyForkID returns the known network id belongs to, nil if none.
+func ClassifyForkID(id ForkID) *Network {
+	for _, n := range Networks {
+		if n.Matches(id) {
+			return n
+		}
+	}
+	return nil
+}
+
+// NetworkName returns the name of the network a node announcing the status
+// is on, NetworkCustom if it is none of the known ones. The genesis has to
+// agree with the fork ID.
+func (s *Status) NetworkName() string {
+	if n := ClassifyForkID(s.ForkID); n != nil && n.Genesis == s.Genesis {
+		return n.Name
+	}
+	return NetworkCustom
+}
@@ -0,0 +1,153 @@
+package eth
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"io"
+	"math/big"
+)
+
+// ForkID is the EIP-2124 fork identifier of the chain a node is on.
+type ForkID struct {
+	Hash [4]byte // CRC32 checksum of the genesis block and passed fork block numbers
+	Next uint64  // Block number of the next upcoming fork, or 0 if none is known
+}
+
+func (f ForkID) String() string {
+	return fmt.Sprintf("%x/%d", f.Hash, f.Next)
+}
+
+// ENREntry is the "eth" entry of the records of nodes speaking eth.
+type ENREntry struct {
+	ForkID ForkID
+	Rest   []rlp.RawValue `rlp:"tail"`
+}
+
+func (ENREntry) ENRKey() string { return "eth" }
+
+// Header is a block header. Fields introduced by forks are optional, so
+// headers of any era decode.
+type Header struct {
+	ParentHash  common.Hash
+	UncleHash   common.Hash
+	Coinbase    common.Address
+	Root        common.Hash
+	TxHash      common.Hash
+	ReceiptHash common.Hash
+	Bloom       types.Bloom
+	Difficulty  *big.Int
+	Number      *big.Int
+	GasLimit    uint64
+	GasUsed     uint64
+	Time        uint64
+	Extra       []byte
+	MixDigest   common.Hash
+	Nonce       types.BlockNonce
+
+	BaseFee          *big.Int       `rlp:"optional"` // London
+	WithdrawalsHash  *common.Hash   `rlp:"optional"` // Shanghai
+	BlobGasUsed      *uint64        `rlp:"optional"` // Cancun
+	ExcessBlobGas    *uint64        `rlp:"optional"` // Cancun
+	ParentBeaconRoot *common.Hash   `rlp:"optional"` // Cancun
+	RequestsHash     *common.Hash   `rlp:"optional"` // Prague
+	Rest             []rlp.RawValue `rlp:"tail"`
+}
+
+// Hash returns the block hash of the header.
+func (h *Header) Hash() common.Hash {
+	enc, _ := rlp.EncodeToBytes(h)
+	return crypto.Keccak256Hash(enc)
+}
+
+// Tx is a transaction in its wire encoding. Only the type and hash are
+// extracted, so transaction types unknown to go-ethereum still decode.
+type Tx struct {
+	Type uint8
+	Hash common.Hash
+	Raw  []byte // legacy RLP list or type byte followed by the payload
+}
+
+func (tx *Tx) DecodeRLP(s *rlp.Stream) error {
+	kind, _, err := s.Kind()
+	if err != nil {
+		return err
+	}
+	switch kind {
+	case rlp.List:
+		raw, err := s.Raw()
+		if err != nil {
+			return err
+		}
+		tx.Type, tx.Raw = types.LegacyTxType, raw
+	case rlp.String:
+		raw, err := s.Bytes()
+		if err != nil {
+			return err
+		}
+		if len(raw) == 0 {
+			return errors.New("empty typed transaction")
+		}
+		tx.Type, tx.Raw = raw[0], raw
+	default:
+		return errors.New("invalid transaction encoding")
+	}
+	tx.Hash = crypto.Keccak256Hash(tx.Raw)
+	return nil
+}
+
+func (tx *Tx) EncodeRLP(w io.Writer) error {
+	if tx.Type == types.LegacyTxType {
+		_, err := w.Write(tx.Raw)
+		return err
+	}
+	return rlp.Encode(w, tx.Raw)
+}
+
+// Transaction decodes the full transaction, for types known to
+// go-ethereum.
+func (tx *Tx) Transaction() (*types.Transaction, error) {
+	t := new(types.Transaction)
+	return t, t.UnmarshalBinary(tx.Raw)
+}
+
+// HashOrNumber is the origin of a block header query, either a block hash or
+// a block number.
+type HashOrNumber struct {
+	Hash   common.Hash
+	Number uint64
+}
+
+func (hn *HashOrNumber) DecodeRLP(s *rlp.Stream) error {
+	_, size, err := s.Kind()
+	switch {
+	case err != nil:
+		return err
+	case size == common.HashLength:
+		hn.Number = 0
+		return s.Decode(&hn.Hash)
+	case size <= 8:
+		hn.Hash = common.Hash{}
+		hn.Number, err = s.Uint64()
+		return err
+	default:
+		return fmt.Errorf("invalid input size %d for origin", size)
+	}
+}
+
+func (hn *HashOrNumber) EncodeRLP(w io.Writer) error {
+	if hn.Hash == (common.Hash{}) {
+		return rlp.Encode(w, hn.Number)
+	}
+	return rlp.Encode(w, hn.Hash)
+}
+
+func (hn HashOrNumber) String() string {
+	if hn.Hash == (common.Hash{}) {
+		return fmt.Sprint(hn.Number)
+	}
+	return hn.Hash.Hex()
+}
@@ -0,0 +1,77 @@
+// Package gossipsub implements decoding of the libp2p traffic of Ethereum
+// consensus clients: multistream-select negotiation, noise and plaintext
+// security, yamux and mplex multiplexing, and the gossipsub RPCs carrying
+// the consensus topics.
+//
+// Consensus clients secure their connections with noise, so past the
+// handshake only the sizes of the encrypted frames can be told. Peer IDs,
+// topics and messages are decoded from connections secured with plaintext,
+// as in test networks, or from decrypted streams.
+// https://github.com/ethereum/consensus-specs/blob/dev/specs/phase0/p2p-interface.md
+package gossipsub
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Protocol IDs negotiated with multistream-select.
+const (
+	Multistream = "/multistream/1.0.0"
+	Noise       = "/noise"
+	Plaintext   = "/plaintext/2.0.0"
+	Yamux       = "/yamux/1.0.0"
+	Mplex       = "/mplex/6.7.0"
+	Meshsub10   = "/meshsub/1.0.0"
+	Meshsub11   = "/meshsub/1.1.0"
+	Meshsub12   = "/meshsub/1.2.0"
+
+	// NotAvailable rejects a proposed protocol.
+	NotAvailable = "na"
+)
+
+// DefaultPort is the TCP port consensus clients listen on for libp2p.
+const DefaultPort = 9000
+
+// maxMessageSize bounds length prefixed messages, as gossipsub bounds
+// RPCs.
+const maxMessageSize = 10 << 20
+
+// Errors.
+var (
+	ErrIncomplete     = errors.New("incomplete data")
+	errMessageTooLong = errors.New("message too long")
+	errBadVarint      = errors.New("invalid length prefix")
+)
+
+// splitDelimited splits the uvarint length prefixed message at the start of
+// b, as libp2p protocols frame their messages.
+func splitDelimited(b []byte) (msg, rest []byte, err error) {
+	size, n := binary.Uvarint(b)
+	switch {
+	case n == 0:
+		return nil, b, ErrIncomplete
+	case n < 0:
+		return nil, b, errBadVarint
+	case size > maxMessageSize:
+		return nil, b, errMessageTooLong
+	case uint64(len(b)-n) < size:
+		return nil, b, ErrIncomplete
+	}
+	return b[n : n+int(size)], b[n+int(size):], nil
+}
+
+// SplitRPC splits the length prefixed RPC at the start of the data of a
+// gossipsub stream, returning ErrIncomplete until it is whole.
+func SplitRPC(b []byte) (rpc, rest []byte, err error) {
+	return splitDelimited(b)
+}
+
+// IsMeshsub reports whether protocol is a version of gossipsub.
+func IsMeshsub(protocol string) bool {
+	switch protocol {
+	case Meshsub10, Meshsub11, Meshsub12:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package gossipsub
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Multistream-select messages are protocol IDs, or na, each ending in a
+// newline and prefixed with its length.
+// https://github.com/multiformats/multistream-select
+
+var errNotMultistream = errors.New("not a multistream-select message")
+
+// multistreamHeader starts every libp2p connection and stream, in both
+// directions.
+var multistreamHeader = []byte("\x13" + Multistream + "\n")
+
+// IsLibp2p reports whether b, the first data of a TCP connection in either
+// direction, starts a libp2p connection.
+func IsLibp2p(b []byte) bool {
+	if len(b) < len(multistreamHeader) {
+		return bytes.HasPrefix(multistreamHeader, b) && len(b) > 0
+	}
+	return bytes.HasPrefix(b, multistreamHeader)
+}
+
+// SplitMultistream splits the multistream-select message at the start of b,
+// returning the protocol ID it names.
+func SplitMultistream(b []byte) (protocol string, rest []byte, err error) {
+	msg, rest, err := splitDelimited(b)
+	if err != nil {
+		return "", b, err
+	}
+	if len(msg) < 2 || msg[len(msg)-1] != '\n' || msg[0] != '/' && string(msg) != NotAvailable+"\n" {
+		return "", b, errNotMultistream
+	}
+	return string(msg[:len(msg)-1]), rest, nil
+}
+
+// looksMultistream reports whether b starts with what may be a multistream
+// message, before it is whole.
+func looksMultistream(b []byte) bool {
+	if len(b) < 2 {
+		return len(b) == 1 && b[0] > 1 && b[0] < 0x80
+	}
+	// Protocol IDs are short, their length fits a single varint byte.
+	return b[0] > 1 && b[0] < 0x80 && (b[1] == '/' || b[0] == 3 && b[1] == 'n')
+}
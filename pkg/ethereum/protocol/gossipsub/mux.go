@@ -0,0 +1,102 @@
+package gossipsub
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// MuxFrame is a frame of a multiplexed connection, yamux or mplex, with the
+// data of one of its streams.
+type MuxFrame struct {
+	Stream uint64
+	Open   bool // first frame of the stream
+	Close  bool // last frame sent on the stream, closed or reset
+	Data   []byte
+}
+
+// Yamux frame types and flags.
+// https://github.com/hashicorp/yamux/blob/master/spec.md
+const (
+	yamuxData   = 0
+	yamuxGoAway = 3 // the last type, after window updates and pings
+
+	yamuxSYN = 1
+	yamuxFIN = 4
+	yamuxRST = 8
+
+	yamuxHeaderSize = 12
+)
+
+// SplitYamux splits the yamux frame at the start of b. Frames without data
+// are returned with a nil Data.
+func SplitYamux(b []byte) (*MuxFrame, []byte, error) {
+	if len(b) < yamuxHeaderSize {
+		return nil, b, ErrIncomplete
+	}
+	if b[0] != 0 || b[1] > yamuxGoAway {
+		return nil, b, fmt.Errorf("invalid yamux header version %d type %d", b[0], b[1])
+	}
+	flags := binary.BigEndian.Uint16(b[2:])
+	f := &MuxFrame{
+		Stream: uint64(binary.BigEndian.Uint32(b[4:])),
+		Open:   flags&yamuxSYN != 0,
+		Close:  flags&(yamuxFIN|yamuxRST) != 0,
+	}
+	// The length field of other types carries a window, ping or error.
+	if b[1] != yamuxData {
+		return f, b[yamuxHeaderSize:], nil
+	}
+	size := binary.BigEndian.Uint32(b[8:])
+	if size > maxMessageSize {
+		return nil, b, errMessageTooLong
+	}
+	if uint32(len(b)-yamuxHeaderSize) < size {
+		return nil, b, ErrIncomplete
+	}
+	f.Data = b[yamuxHeaderSize : yamuxHeaderSize+int(size)]
+	return f, b[yamuxHeaderSize+int(size):], nil
+}
+
+// Mplex frame flags.
+// https://github.com/libp2p/specs/blob/master/mplex/README.md
+const (
+	mplexNewStream     = 0
+	mplexCloseReceiver = 3 // and the close and reset flags above it
+	mplexMaxFlag       = 6
+
+	mplexInitiatorStreams = 1 << 62 // tells apart the streams of each side
+)
+
+// SplitMplex splits the mplex frame at the start of b.
+func SplitMplex(b []byte) (*MuxFrame, []byte, error) {
+	header, n := binary.Uvarint(b)
+	switch {
+	case n == 0:
+		return nil, b, ErrIncomplete
+	case n < 0:
+		return nil, b, errBadVarint
+	}
+	flag := header & 7
+	if flag > mplexMaxFlag {
+		return nil, b, fmt.Errorf("invalid mplex flag %d", flag)
+	}
+	data, rest, err := splitDelimited(b[n:])
+	if err != nil {
+		return nil, b, err
+	}
+	// Stream IDs are chosen by either side, the even flags are sent by the
+	// side that opened the stream.
+	id := header >> 3
+	if flag%2 == 0 {
+		id |= mplexInitiatorStreams
+	}
+	f := &MuxFrame{
+		Stream: id,
+		Open:   flag == mplexNewStream,
+		Close:  flag >= mplexCloseReceiver,
+	}
+	if !f.Open && !f.Close {
+		f.Data = data
+	}
+	return f, rest, nil
+}
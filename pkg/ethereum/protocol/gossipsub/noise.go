@@ -0,0 +1,59 @@
+package gossipsub
+
+import "encoding/binary"
+
+// Noise secured connections carry frames prefixed with their 2 byte length,
+// first the three messages of the XX handshake, initiator first, then
+// transport messages. Identities are exchanged encrypted in the second and
+// third handshake messages.
+// https://github.com/libp2p/specs/blob/master/noise/README.md
+
+const (
+	noiseKeySize = 32 // of X25519 keys
+	noiseTagSize = 16 // of ChaChaPoly
+)
+
+// Messages of the XX handshake.
+const (
+	NoiseHandshakeInit     = 1 // -> e
+	NoiseHandshakeResponse = 2 // <- e, ee, s, es
+	NoiseHandshakeFinal    = 3 // -> s, se
+)
+
+// noiseHandshakes is the number of handshake messages sent by each side.
+func noiseHandshakes(initiator bool) int {
+	if initiator {
+		return 2
+	}
+	return 1
+}
+
+// SplitNoiseFrame splits the frame at the start of b.
+func SplitNoiseFrame(b []byte) (frame, rest []byte, err error) {
+	if len(b) < 2 {
+		return nil, b, ErrIncomplete
+	}
+	size := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+size {
+		return nil, b, ErrIncomplete
+	}
+	return b[2 : 2+size], b[2+size:], nil
+}
+
+// noisePayloadSize returns the size of the encrypted payload of handshake
+// message msg of the given size, the libp2p handshake payload, or -1 if the
+// message is too short.
+func noisePayloadSize(msg, size int) int {
+	switch msg {
+	case NoiseHandshakeInit:
+		size -= noiseKeySize
+	case NoiseHandshakeResponse:
+		size -= noiseKeySize + noiseKeySize + noiseTagSize + noiseTagSize
+	case NoiseHandshakeFinal:
+		size -= noiseKeySize + noiseTagSize + noiseTagSize
+	}
+	if size < 0 {
+		return -1
+	}
+	return size
+}
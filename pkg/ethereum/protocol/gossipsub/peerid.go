@@ -0,0 +1,129 @@
+package gossipsub
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/crypto"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math/big"
+)
+
+// Key types of libp2p public keys.
+const (
+	KeyRSA       = 0
+	KeyEd25519   = 1
+	KeySecp256k1 = 2
+	KeyECDSA     = 3
+)
+
+// Multihash codes of peer IDs. Keys of up to maxInlineKeySize bytes,
+// marshalled, are inlined in the peer ID, larger ones are hashed.
+const (
+	multihashIdentity = 0x00
+	multihashSHA256   = 0x12
+	maxInlineKeySize  = 42
+)
+
+// PeerID identifies a libp2p peer, a multihash of its public key.
+// https://github.com/libp2p/specs/blob/master/peer-ids/peer-ids.md
+type PeerID []byte
+
+// IDFromPublicKey returns the peer ID of a node of the given record key, as
+// consensus clients derive it from their secp256k1 key.
+func IDFromPublicKey(pub *ecdsa.PublicKey) PeerID {
+	return IDFromMarshalledKey(MarshalPublicKey(KeySecp256k1, crypto.CompressPubkey(pub)))
+}
+
+// IDFromMarshalledKey returns the peer ID of a public key in its protobuf
+// encoding.
+func IDFromMarshalledKey(key []byte) PeerID {
+	if len(key) <= maxInlineKeySize {
+		return append([]byte{multihashIdentity, byte(len(key))}, key...)
+	}
+	sum := sha256.Sum256(key)
+	return append([]byte{multihashSHA256, sha256.Size}, sum[:]...)
+}
+
+// MarshalPublicKey returns the protobuf encoding of a public key.
+func MarshalPublicKey(keyType int, data []byte) []byte {
+	b := protowire.AppendTag(nil, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(keyType))
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, data)
+}
+
+// UnmarshalPublicKey decodes the protobuf encoding of a public key.
+func UnmarshalPublicKey(b []byte) (keyType int, data []byte, err error) {
+	keyType = -1
+	err = walkFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			keyType = int(n)
+		case num == 2 && typ == protowire.BytesType:
+			data = v
+		}
+		return nil
+	})
+	if err == nil && (keyType < 0 || data == nil) {
+		err = errors.New("incomplete public key")
+	}
+	return keyType, data, err
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// String returns the peer ID in base58, as in 16Uiu2HAm...
+func (id PeerID) String() string {
+	n := new(big.Int).SetBytes(id)
+	radix, mod := big.NewInt(58), new(big.Int)
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, b := range id {
+		if b != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (id PeerID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// ParsePeerID decodes a peer ID in base58.
+func ParsePeerID(s string) (PeerID, error) {
+	n, radix := new(big.Int), big.NewInt(58)
+	zeros := 0
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+	for i := 0; i < len(s); i++ {
+		d := -1
+		for j := 0; j < len(base58Alphabet); j++ {
+			if base58Alphabet[j] == s[i] {
+				d = j
+				break
+			}
+		}
+		if d < 0 {
+			return nil, fmt.Errorf("invalid peer ID character %q", s[i])
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(d)))
+	}
+	id := append(make([]byte, zeros), n.Bytes()...)
+	if len(id) < 2 || int(id[1]) != len(id)-2 {
+		return nil, errors.New("invalid peer ID multihash")
+	}
+	return id, nil
+}
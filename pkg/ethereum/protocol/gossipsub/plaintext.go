@@ -0,0 +1,42 @@
+package gossipsub
+
+import (
+	"errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Exchange is the message opening a plaintext secured connection, sent by
+// each side to identify itself.
+// https://github.com/libp2p/specs/blob/master/plaintext/README.md
+type Exchange struct {
+	ID     PeerID
+	Key    []byte // marshalled public key
+	KeyErr error  // set if the peer ID doesn't match the key
+}
+
+// DecodeExchange decodes the body of an Exchange message.
+func DecodeExchange(b []byte) (*Exchange, error) {
+	e := new(Exchange)
+	err := walkFields(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			e.ID = PeerID(v)
+		case 2:
+			e.Key = v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if e.ID == nil {
+		return nil, errors.New("exchange without peer ID")
+	}
+	if e.Key != nil && string(IDFromMarshalledKey(e.Key)) != string(e.ID) {
+		e.KeyErr = errors.New("peer ID doesn't match its key")
+	}
+	return e, nil
+}
@@ -0,0 +1,271 @@
+package gossipsub
+
+import (
+	"errors"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// RPC is a gossipsub RPC: subscription changes, published messages and
+// mesh control messages.
+// https://github.com/libp2p/specs/blob/master/pubsub/gossipsub/gossipsub-v1.1.md
+type RPC struct {
+	Subscriptions []Subscription `json:"subscriptions,omitempty"`
+	Publish       []Message      `json:"publish,omitempty"`
+	Control       *Control       `json:"control,omitempty"`
+}
+
+// Subscription subscribes to, or unsubscribes from, a topic.
+type Subscription struct {
+	Subscribe bool   `json:"subscribe"`
+	Topic     string `json:"topic"`
+}
+
+// Message is a published message. Ethereum messages are anonymous, without
+// sender, sequence number or signature.
+type Message struct {
+	From      PeerID `json:"from,omitempty"`
+	Data      []byte `json:"-"`
+	Size      int    `json:"size"`
+	Seqno     []byte `json:"seqno,omitempty"`
+	Topic     string `json:"topic"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// DecodedSize returns the size of the message data once decompressed, with
+// ssz_snappy encoded topics, or its size.
+func (m *Message) DecodedSize() int {
+	if t, err := ParseTopic(m.Topic); err == nil && t.Encoding == EncodingSSZSnappy {
+		if n, err := snappy.DecodedLen(m.Data); err == nil {
+			return n
+		}
+	}
+	return len(m.Data)
+}
+
+// Control holds the mesh maintenance messages of an RPC.
+type Control struct {
+	IHave     []IHave  `json:"ihave,omitempty"`
+	IWant     [][]byte `json:"iwant,omitempty"`     // message IDs
+	Graft     []string `json:"graft,omitempty"`     // topics
+	Prune     []Prune  `json:"prune,omitempty"`     // topics
+	IDontWant [][]byte `json:"idontwant,omitempty"` // message IDs, v1.2
+}
+
+// IHave announces the IDs of messages recently seen on a topic.
+type IHave struct {
+	Topic      string   `json:"topic"`
+	MessageIDs [][]byte `json:"message_ids"`
+}
+
+// Prune removes the recipient from the mesh of a topic, offering other
+// peers.
+type Prune struct {
+	Topic   string   `json:"topic"`
+	Peers   []PeerID `json:"peers,omitempty"`
+	Backoff uint64   `json:"backoff,omitempty"` // seconds
+}
+
+// Topics returns the topics the RPC refers to, in order of appearance.
+func (r *RPC) Topics() []string {
+	var topics []string
+	seen := make(map[string]bool)
+	add := func(t string) {
+		if !seen[t] {
+			seen[t] = true
+			topics = append(topics, t)
+		}
+	}
+	for _, s := range r.Subscriptions {
+		add(s.Topic)
+	}
+	for _, m := range r.Publish {
+		add(m.Topic)
+	}
+	if c := r.Control; c != nil {
+		for _, h := range c.IHave {
+			add(h.Topic)
+		}
+		for _, t := range c.Graft {
+			add(t)
+		}
+		for _, p := range c.Prune {
+			add(p.Topic)
+		}
+	}
+	return topics
+}
+
+var errBadProtobuf = errors.New("invalid protobuf")
+
+// walkFields calls fn with each field of a protobuf message, v holding the
+// value of length delimited fields and n that of varint and fixed ones.
+func walkFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return errBadProtobuf
+		}
+		b = b[l:]
+		var (
+			v []byte
+			n uint64
+		)
+		switch typ {
+		case protowire.VarintType:
+			n, l = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			v, l = protowire.ConsumeBytes(b)
+		case protowire.Fixed32Type:
+			var f uint32
+			f, l = protowire.ConsumeFixed32(b)
+			n = uint64(f)
+		case protowire.Fixed64Type:
+			n, l = protowire.ConsumeFixed64(b)
+		default:
+			l = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if l < 0 {
+			return errBadProtobuf
+		}
+		b = b[l:]
+		if err := fn(num, typ, v, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodeRPC decodes the body of an RPC.
+func DecodeRPC(b []byte) (*RPC, error) {
+	r := new(RPC)
+	err := walkFields(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			var s Subscription
+			err := walkFields(v, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+				switch num {
+				case 1:
+					s.Subscribe = n != 0
+				case 2:
+					s.Topic = string(v)
+				}
+				return nil
+			})
+			r.Subscriptions = append(r.Subscriptions, s)
+			return err
+		case 2:
+			m, err := decodeMessage(v)
+			if err != nil {
+				return err
+			}
+			r.Publish = append(r.Publish, *m)
+		case 3:
+			c, err := decodeControl(v)
+			if err != nil {
+				return err
+			}
+			r.Control = c
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func decodeMessage(b []byte) (*Message, error) {
+	m := new(Message)
+	err := walkFields(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			m.From = PeerID(v)
+		case 2:
+			m.Data, m.Size = v, len(v)
+		case 3:
+			m.Seqno = v
+		case 4:
+			m.Topic = string(v)
+		case 5:
+			m.Signature = v
+		}
+		return nil
+	})
+	return m, err
+}
+
+// messageIDs collects the message IDs of a control message, field num.
+func messageIDs(b []byte, num protowire.Number) ([][]byte, string, error) {
+	var (
+		ids   [][]byte
+		topic string
+	)
+	err := walkFields(b, func(n protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		switch {
+		case n == num && typ == protowire.BytesType:
+			ids = append(ids, v)
+		case n == 1 && typ == protowire.BytesType:
+			topic = string(v)
+		}
+		return nil
+	})
+	return ids, topic, err
+}
+
+func decodeControl(b []byte) (*Control, error) {
+	c := new(Control)
+	err := walkFields(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			ids, topic, err := messageIDs(v, 2)
+			c.IHave = append(c.IHave, IHave{Topic: topic, MessageIDs: ids})
+			return err
+		case 2:
+			ids, _, err := messageIDs(v, 1)
+			c.IWant = append(c.IWant, ids...)
+			return err
+		case 3:
+			_, topic, err := messageIDs(v, 0)
+			c.Graft = append(c.Graft, topic)
+			return err
+		case 4:
+			p, err := decodePrune(v)
+			c.Prune = append(c.Prune, p)
+			return err
+		case 5:
+			ids, _, err := messageIDs(v, 1)
+			c.IDontWant = append(c.IDontWant, ids...)
+			return err
+		}
+		return nil
+	})
+	return c, err
+}
+
+func decodePrune(b []byte) (Prune, error) {
+	var p Prune
+	err := walkFields(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch num {
+		case 1:
+			p.Topic = string(v)
+		case 2:
+			return walkFields(v, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+				if num == 1 {
+					p.Peers = append(p.Peers, PeerID(v))
+				}
+				return nil
+			})
+		case 3:
+			p.Backoff = n
+		}
+		return nil
+	})
+	return p, err
+}
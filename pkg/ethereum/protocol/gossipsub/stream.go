@@ -0,0 +1,259 @@
+package gossipsub
+
+// maxSubstreams bounds the multiplexed streams followed on a connection,
+// the data of further streams is skipped.
+const maxSubstreams = 256
+
+// EventKind tells what an Event is about.
+type EventKind int
+
+const (
+	EventProtocol   EventKind = iota // a multistream message of the connection, Protocol
+	EventHandshake                   // a noise handshake message, Handshake and Size
+	EventFrame                       // an encrypted noise transport frame, Size
+	EventIdentified                  // the plaintext identity of the sender, Peer
+	EventSubstream                   // the protocol of a multiplexed stream, Substream and Protocol
+	EventRPC                         // a gossipsub RPC, Substream, Size and RPC
+)
+
+// Event is something sent on a connection.
+type Event struct {
+	Kind      EventKind
+	Protocol  string
+	Handshake int // noise handshake message, NoiseHandshakeInit to NoiseHandshakeFinal
+	Size      int
+	Peer      PeerID
+	Substream uint64
+	RPC       *RPC
+}
+
+type phase int
+
+const (
+	phaseNegotiate phase = iota // multistream-select of the connection
+	phaseNoise
+	phasePlaintext // awaiting the Exchange
+	phaseMux
+	phaseOpaque // of an unknown protocol, skipped
+)
+
+// substream is a multiplexed stream.
+type substream struct {
+	buf      []byte
+	proposed string
+	protocol string // once negotiated
+}
+
+// Stream decodes what one side of a libp2p connection sends. Stream data
+// is fed in as it is captured, in order.
+type Stream struct {
+	initiator bool
+	buf       []byte
+	phase     phase
+	events    []*Event
+
+	proposed        string // protocol of the latest multistream message
+	security, muxer string
+	handshakes      int // noise handshake messages read
+	substreams      map[uint64]*substream
+}
+
+// NewStream returns a decoder of the data sent by the side that opened the
+// connection, or by the other side if initiator is false.
+func NewStream(initiator bool) *Stream {
+	return &Stream{initiator: initiator, substreams: make(map[uint64]*substream)}
+}
+
+// Feed appends captured stream data.
+func (s *Stream) Feed(data []byte) {
+	if s.phase == phaseOpaque {
+		return
+	}
+	s.buf = append(s.buf, data...)
+}
+
+// Security returns the security protocol of the connection, once
+// negotiated.
+func (s *Stream) Security() string { return s.security }
+
+// Muxer returns the multiplexer of the connection, once negotiated. It is
+// only seen on plaintext connections.
+func (s *Stream) Muxer() string { return s.muxer }
+
+// Next returns the next event, or nil if more data is needed. An error
+// leaves the stream out of sync.
+func (s *Stream) Next() (*Event, error) {
+	for len(s.events) == 0 {
+		ok, err := s.step()
+		if err != nil || !ok {
+			return nil, err
+		}
+	}
+	ev := s.events[0]
+	s.events = s.events[1:]
+	return ev, nil
+}
+
+// step decodes the next unit of data, reporting whether there was one.
+func (s *Stream) step() (bool, error) {
+	if len(s.buf) == 0 {
+		return false, nil
+	}
+	switch s.phase {
+	case phaseNegotiate:
+		return s.negotiate()
+
+	case phaseNoise:
+		frame, rest, err := SplitNoiseFrame(s.buf)
+		if err == ErrIncomplete {
+			return false, nil
+		}
+		s.buf = rest
+		if s.handshakes < noiseHandshakes(s.initiator) {
+			s.handshakes++
+			msg := NoiseHandshakeResponse
+			if s.initiator {
+				msg = 2*s.handshakes - 1
+			}
+			s.events = append(s.events, &Event{Kind: EventHandshake, Handshake: msg, Size: len(frame)})
+		} else {
+			s.events = append(s.events, &Event{Kind: EventFrame, Size: len(frame)})
+		}
+		return true, nil
+
+	case phasePlaintext:
+		msg, rest, err := splitDelimited(s.buf)
+		if err == ErrIncomplete {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		e, err := DecodeExchange(msg)
+		if err != nil {
+			return false, err
+		}
+		s.buf = rest
+		s.phase = phaseNegotiate
+		s.events = append(s.events, &Event{Kind: EventIdentified, Peer: e.ID})
+		return true, nil
+
+	case phaseMux:
+		split := SplitYamux
+		if s.muxer == Mplex {
+			split = SplitMplex
+		}
+		f, rest, err := split(s.buf)
+		if err == ErrIncomplete {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		s.buf = rest
+		return true, s.substream(f)
+
+	default:
+		s.buf = nil
+		return false, nil
+	}
+}
+
+// negotiate reads a multistream message, or moves on to the protocol
+// negotiated once the data is something else.
+func (s *Stream) negotiate() (bool, error) {
+	if len(s.buf) < 2 {
+		return false, nil
+	}
+	if looksMultistream(s.buf) {
+		protocol, rest, err := SplitMultistream(s.buf)
+		if err == ErrIncomplete {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		s.buf = rest
+		if protocol != Multistream {
+			s.proposed = protocol
+		}
+		s.events = append(s.events, &Event{Kind: EventProtocol, Protocol: protocol})
+		return true, nil
+	}
+
+	switch {
+	case s.security == "" && s.proposed == Noise:
+		s.security, s.phase = Noise, phaseNoise
+	case s.security == "" && s.proposed == Plaintext:
+		s.security, s.phase = Plaintext, phasePlaintext
+	case s.security == Plaintext && (s.proposed == Yamux || s.proposed == Mplex):
+		s.muxer, s.phase = s.proposed, phaseMux
+	default:
+		s.phase = phaseOpaque
+	}
+	return true, nil
+}
+
+// substream accounts for a multiplexed frame, decoding the RPCs of
+// gossipsub streams.
+func (s *Stream) substream(f *MuxFrame) error {
+	sub := s.substreams[f.Stream]
+	if sub == nil {
+		if len(s.substreams) >= maxSubstreams {
+			return nil
+		}
+		sub = new(substream)
+		s.substreams[f.Stream] = sub
+	}
+	if f.Close {
+		delete(s.substreams, f.Stream)
+	}
+	if len(f.Data) == 0 || sub.protocol != "" && !IsMeshsub(sub.protocol) {
+		return nil
+	}
+	sub.buf = append(sub.buf, f.Data...)
+
+	for len(sub.buf) > 0 {
+		if sub.protocol == "" {
+			if !looksMultistream(sub.buf) {
+				if sub.proposed == "" || len(sub.buf) < 2 {
+					return nil
+				}
+				sub.protocol = sub.proposed
+				s.events = append(s.events, &Event{Kind: EventSubstream, Substream: f.Stream, Protocol: sub.protocol})
+				if !IsMeshsub(sub.protocol) {
+					sub.buf = nil
+					return nil
+				}
+				continue
+			}
+			protocol, rest, err := SplitMultistream(sub.buf)
+			if err == ErrIncomplete {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			sub.buf = rest
+			if protocol != Multistream {
+				sub.proposed = protocol
+			}
+			continue
+		}
+
+		msg, rest, err := SplitRPC(sub.buf)
+		if err == ErrIncomplete {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		sub.buf = rest
+		rpc, err := DecodeRPC(msg)
+		if err != nil {
+			return err
+		}
+		s.events = append(s.events, &Event{Kind: EventRPC, Substream: f.Stream, Size: len(msg), RPC: rpc})
+	}
+	return nil
+}
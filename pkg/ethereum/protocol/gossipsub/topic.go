@@ -0,0 +1,60 @@
+package gossipsub
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// EncodingSSZSnappy is the encoding of consensus gossip messages, SSZ
+// compressed with snappy.
+const EncodingSSZSnappy = "ssz_snappy"
+
+// Topic is a consensus gossip topic, as in
+// /eth2/6a95a1a9/beacon_attestation_12/ssz_snappy.
+type Topic struct {
+	ForkDigest [4]byte // of the fork the messages belong to
+	Name       string  // as in beacon_attestation_12
+	Encoding   string
+}
+
+// ParseTopic parses a consensus gossip topic.
+func ParseTopic(s string) (Topic, error) {
+	var t Topic
+	parts := strings.Split(s, "/")
+	if len(parts) != 5 || parts[0] != "" || parts[1] != "eth2" || parts[3] == "" {
+		return t, fmt.Errorf("not a consensus topic: %q", s)
+	}
+	digest, err := hex.DecodeString(parts[2])
+	if err != nil || len(digest) != len(t.ForkDigest) {
+		return t, fmt.Errorf("invalid fork digest %q", parts[2])
+	}
+	copy(t.ForkDigest[:], digest)
+	t.Name, t.Encoding = parts[3], parts[4]
+	return t, nil
+}
+
+// Kind returns the name of the topic without its subnet, as in
+// beacon_attestation.
+func (t Topic) Kind() string {
+	i := strings.LastIndexByte(t.Name, '_')
+	if i < 0 || i == len(t.Name)-1 {
+		return t.Name
+	}
+	for _, c := range t.Name[i+1:] {
+		if c < '0' || c > '9' {
+			return t.Name
+		}
+	}
+	return t.Name[:i]
+}
+
+// TopicKind returns the kind of a consensus topic, or the topic itself if
+// it is of another network.
+func TopicKind(topic string) string {
+	t, err := ParseTopic(topic)
+	if err != nil {
+		return topic
+	}
+	return t.Kind()
+}
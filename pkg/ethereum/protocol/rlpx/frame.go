@@ -0,0 +1,152 @@
+package rlpx
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/golang/snappy"
+	"hash"
+)
+
+// Frame is a decrypted RLPx frame carrying a single message.
+type Frame struct {
+	Size       int    // size of the frame data, without padding
+	HeaderData []byte // RLP list of capability and context IDs, usually empty
+
+	Code uint64 // message code
+	Data []byte // message data, snappy compressed after a p2p v5 Hello
+}
+
+// Payload returns the message data, decompressing it when snappy is set.
+func (f *Frame) Payload(snappyEnabled bool) ([]byte, error) {
+	if !snappyEnabled {
+		return f.Data, nil
+	}
+	size, err := snappy.DecodedLen(f.Data)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxUint24 {
+		return nil, errors.New("message too large")
+	}
+	return snappy.Decode(nil, f.Data)
+}
+
+// FrameReader decrypts the frames sent in one direction of a connection.
+// Stream data is fed in as it is captured, in order.
+type FrameReader struct {
+	dec cipher.Stream
+	mac *hashMAC // nil if MACs are not verified
+
+	buf    []byte
+	header []byte // decrypted header of the frame being read
+}
+
+// NewFrameReader returns a reader of the frames sent by the initiator of
+// the session, or by the recipient if initiator is false.
+func NewFrameReader(s Secrets, initiator bool) (*FrameReader, error) {
+	encc, err := aes.NewCipher(s.AES)
+	if err != nil {
+		return nil, fmt.Errorf("invalid AES secret: %v", err)
+	}
+	// An all-zeroes IV is used since the key is ephemeral.
+	r := &FrameReader{dec: cipher.NewCTR(encc, make([]byte, encc.BlockSize()))}
+
+	h := s.RecipientMAC
+	if initiator {
+		h = s.InitiatorMAC
+	}
+	if h != nil {
+		macc, err := aes.NewCipher(s.MAC)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC secret: %v", err)
+		}
+		r.mac = &hashMAC{cipher: macc, hash: h}
+	}
+	return r, nil
+}
+
+// Feed appends captured stream data.
+func (r *FrameReader) Feed(data []byte) {
+	r.buf = append(r.buf, data...)
+}
+
+// Next decrypts the next frame, or returns nil if more data is needed. An
+// error leaves the reader out of sync with the stream.
+func (r *FrameReader) Next() (*Frame, error) {
+	if r.header == nil {
+		if len(r.buf) < frameHeaderSize {
+			return nil, nil
+		}
+		header := r.buf[:frameHeaderSize]
+		if r.mac != nil && !hmac.Equal(r.mac.computeHeader(header[:16]), header[16:]) {
+			return nil, errBadHeaderMAC
+		}
+		r.header = make([]byte, 16)
+		r.dec.XORKeyStream(r.header, header[:16])
+		r.buf = r.buf[frameHeaderSize:]
+	}
+
+	size := int(r.header[0])<<16 | int(r.header[1])<<8 | int(r.header[2])
+	padded := size
+	if padding := size % 16; padding > 0 {
+		padded += 16 - padding
+	}
+	if len(r.buf) < padded+frameMACSize {
+		return nil, nil
+	}
+
+	data := r.buf[:padded]
+	if r.mac != nil && !hmac.Equal(r.mac.computeFrame(data), r.buf[padded:padded+frameMACSize]) {
+		return nil, errBadFrameMAC
+	}
+	pt := make([]byte, padded)
+	r.dec.XORKeyStream(pt, data)
+	r.buf = r.buf[padded+frameMACSize:]
+
+	f := &Frame{Size: size}
+	if _, rest, err := rlp.SplitList(r.header[3:]); err == nil {
+		f.HeaderData = r.header[3 : len(r.header)-len(rest)]
+	}
+	r.header = nil
+
+	code, msg, err := rlp.SplitUint64(pt[:size])
+	if err != nil {
+		return nil, fmt.Errorf("invalid message code: %v", err)
+	}
+	f.Code, f.Data = code, msg
+	return f, nil
+}
+
+// hashMAC holds the state of the RLPx MAC of one direction.
+type hashMAC struct {
+	cipher cipher.Block
+	hash   hash.Hash
+}
+
+// computeHeader computes the MAC of a frame header.
+func (m *hashMAC) computeHeader(header []byte) []byte {
+	return m.compute(m.hash.Sum(nil), header)
+}
+
+// computeFrame computes the MAC of frame data.
+func (m *hashMAC) computeFrame(data []byte) []byte {
+	m.hash.Write(data)
+	seed := m.hash.Sum(nil)
+	return m.compute(seed, seed[:16])
+}
+
+// compute encrypts the current hash state, XORs it with seed and writes the
+// result back into the hash. The first 16 bytes of the new sum are the MAC.
+func (m *hashMAC) compute(sum, seed []byte) []byte {
+	buf := make([]byte, 16)
+	m.cipher.Encrypt(buf, sum)
+	for i := range buf {
+		buf[i] ^= seed[i]
+	}
+	m.hash.Write(buf)
+	return m.hash.Sum(nil)[:16]
+}
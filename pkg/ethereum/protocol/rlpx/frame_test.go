@@ -0,0 +1,145 @@
+package rlpx
+
+import (
+	"bytes"
+	"errors"
+	gethrlpx "github.com/ethereum/go-ethereum/p2p/rlpx"
+	"github.com/golang/snappy"
+	"io"
+	"net"
+	"testing"
+)
+
+type testFrame struct {
+	code uint64
+	data []byte
+}
+
+// writeFrames writes frames as the initiator of the session of the test
+// vectors, with the RLPx implementation of go-ethereum, and returns the
+// stream sent.
+func writeFrames(t *testing.T, snappyEnabled bool, frames []testFrame) []byte {
+	s := testSecrets(t)
+	local, remote := net.Pipe()
+	conn := gethrlpx.NewConn(local, nil)
+	conn.InitWithSecrets(gethrlpx.Secrets{AES: s.AES, MAC: s.MAC, EgressMAC: s.InitiatorMAC, IngressMAC: s.RecipientMAC})
+	conn.SetSnappy(snappyEnabled)
+
+	errc := make(chan error, 1)
+	go func() {
+		defer conn.Close()
+		for _, f := range frames {
+			if _, err := conn.Write(f.code, f.data); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	stream, err := io.ReadAll(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	return stream
+}
+
+func testFrames() []testFrame {
+	return []testFrame{
+		{0x00, []byte{0xc0}},
+		{0x10, bytes.Repeat([]byte{0xab}, 15)},
+		{0x11, bytes.Repeat([]byte{0xcd}, 16)},
+		{0x22, bytes.Repeat([]byte("etherspy"), 512)},
+		{0x03, nil},
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, snappyEnabled := range []bool{false, true} {
+		frames := testFrames()
+		stream := writeFrames(t, snappyEnabled, frames)
+
+		r, err := NewFrameReader(testSecrets(t), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Data is fed in small pieces, as captured from TCP segments.
+		var got []*Frame
+		for len(stream) > 0 {
+			n := 7
+			if n > len(stream) {
+				n = len(stream)
+			}
+			r.Feed(stream[:n])
+			stream = stream[n:]
+			for {
+				f, err := r.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if f == nil {
+					break
+				}
+				got = append(got, f)
+			}
+		}
+		if len(got) != len(frames) {
+			t.Fatalf("snappy %v: read %d frames, want %d", snappyEnabled, len(got), len(frames))
+		}
+		for i, f := range got {
+			data, err := f.Payload(snappyEnabled)
+			if err != nil {
+				t.Fatalf("snappy %v: frame %d: %v", snappyEnabled, i, err)
+			}
+			if f.Code != frames[i].code || !bytes.Equal(data, frames[i].data) {
+				t.Errorf("snappy %v: frame %d: code %#x data %x, want %#x %x", snappyEnabled, i, f.Code, data, frames[i].code, frames[i].data)
+			}
+		}
+	}
+}
+
+func TestFrameBadMAC(t *testing.T) {
+	stream := writeFrames(t, false, testFrames()[:1])
+	for _, test := range []struct {
+		offset int
+		err    error
+	}{
+		{0, errBadHeaderMAC},                   // header
+		{frameHeaderSize - 1, errBadHeaderMAC}, // header MAC
+		{frameHeaderSize, errBadFrameMAC},      // frame data
+		{len(stream) - 1, errBadFrameMAC},      // frame MAC
+	} {
+		corrupted := append([]byte(nil), stream...)
+		corrupted[test.offset] ^= 1
+		r, err := NewFrameReader(testSecrets(t), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Feed(corrupted)
+		if _, err := r.Next(); !errors.Is(err, test.err) {
+			t.Errorf("byte %d corrupted: error %v, want %v", test.offset, err, test.err)
+		}
+	}
+
+	// Without MAC states, frames are decrypted unverified.
+	s := testSecrets(t)
+	s.InitiatorMAC = nil
+	r, err := NewFrameReader(s, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream[len(stream)-1] ^= 1
+	r.Feed(stream)
+	if f, err := r.Next(); err != nil || f == nil || f.Code != 0 {
+		t.Errorf("unverified frame %+v, error %v", f, err)
+	}
+}
+
+func TestFramePayloadTooLarge(t *testing.T) {
+	f := &Frame{Data: snappy.Encode(nil, make([]byte, maxUint24+1))}
+	if _, err := f.Payload(true); err == nil {
+		t.Error("decompressed a message beyond the size limit")
+	}
+}
@@ -0,0 +1,124 @@
+package rlpx
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+	"github.com/ethereum/go-ethereum/rlp"
+	"golang.org/x/crypto/sha3"
+	"hash"
+)
+
+// AuthMsg is the handshake message sent by the initiator of a connection
+// (EIP-8 format).
+type AuthMsg struct {
+	Signature       [sigLen]byte
+	InitiatorPubkey [pubLen]byte
+	Nonce           [shaLen]byte
+	Version         uint
+	Rest            []rlp.RawValue `rlp:"tail"`
+}
+
+// AckMsg is the handshake message sent by the recipient in response to
+// AuthMsg (EIP-8 format).
+type AckMsg struct {
+	RandomPubkey [pubLen]byte
+	Nonce        [shaLen]byte
+	Version      uint
+	Rest         []rlp.RawValue `rlp:"tail"`
+}
+
+// SplitHandshake splits the size prefixed handshake message at the start of
+// buf from the data following it. It returns ErrIncomplete if buf does not
+// hold the whole message yet.
+func SplitHandshake(buf []byte) (msg, rest []byte, err error) {
+	if len(buf) < 2 {
+		return nil, nil, ErrIncomplete
+	}
+	size := int(binary.BigEndian.Uint16(buf))
+	if size < minHandshakeSize {
+		return nil, nil, errHandshakeLen
+	}
+	if len(buf) < 2+size {
+		return nil, nil, ErrIncomplete
+	}
+	return buf[:2+size], buf[2+size:], nil
+}
+
+// DecodeAuth decrypts and decodes an auth message with the static key of
+// the recipient.
+func DecodeAuth(msg []byte, key *ecdsa.PrivateKey) (*AuthMsg, error) {
+	auth := new(AuthMsg)
+	return auth, open(msg, key, auth)
+}
+
+// DecodeAck decrypts and decodes an ack message with the static key of the
+// initiator.
+func DecodeAck(msg []byte, key *ecdsa.PrivateKey) (*AckMsg, error) {
+	ack := new(AckMsg)
+	return ack, open(msg, key, ack)
+}
+
+func open(msg []byte, key *ecdsa.PrivateKey, v interface{}) error {
+	if len(msg) < 2 {
+		return errHandshakeLen
+	}
+	prefix := msg[:2]
+	pt, err := ecies.ImportECDSA(key).Decrypt(msg[2:], nil, prefix)
+	if err != nil {
+		return err
+	}
+	// Messages carry random padding after the RLP list.
+	return rlp.NewStream(bytes.NewReader(pt), 0).Decode(v)
+}
+
+// EphemeralPubkey recovers the initiator's ephemeral public key from the
+// auth signature, given the static key of the recipient.
+func (a *AuthMsg) EphemeralPubkey(key *ecdsa.PrivateKey) (*ecdsa.PublicKey, error) {
+	remote, err := crypto.UnmarshalPubkey(append([]byte{0x04}, a.InitiatorPubkey[:]...))
+	if err != nil {
+		return nil, err
+	}
+	token, err := ecies.ImportECDSA(key).GenerateShared(ecies.ImportECDSAPublic(remote), sskLen, sskLen)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := crypto.Ecrecover(xor(token, a.Nonce[:]), a.Signature[:])
+	if err != nil {
+		return nil, err
+	}
+	return crypto.UnmarshalPubkey(pub)
+}
+
+// Secrets are the keys of an RLPx session.
+type Secrets struct {
+	AES, MAC []byte
+
+	// Initial MAC states of the frames sent by the initiator and by the
+	// recipient. Frame MACs are not verified when nil.
+	InitiatorMAC, RecipientMAC hash.Hash
+}
+
+// DeriveSecrets derives the session secrets from the ephemeral key of one
+// side, the ephemeral public key of the other side, both nonces and the
+// handshake messages as sent on the wire. Ephemeral keys are never sent,
+// they can only be obtained from an instrumented client.
+func DeriveSecrets(ephkey *ecdsa.PrivateKey, remoteEphPub *ecdsa.PublicKey, initNonce, respNonce, auth, ack []byte) (Secrets, error) {
+	ecdhe, err := ecies.ImportECDSA(ephkey).GenerateShared(ecies.ImportECDSAPublic(remoteEphPub), sskLen, sskLen)
+	if err != nil {
+		return Secrets{}, err
+	}
+	shared := crypto.Keccak256(ecdhe, crypto.Keccak256(respNonce, initNonce))
+	s := Secrets{AES: crypto.Keccak256(ecdhe, shared)}
+	s.MAC = crypto.Keccak256(ecdhe, s.AES)
+
+	s.InitiatorMAC = sha3.NewLegacyKeccak256()
+	s.InitiatorMAC.Write(xor(s.MAC, respNonce))
+	s.InitiatorMAC.Write(auth)
+	s.RecipientMAC = sha3.NewLegacyKeccak256()
+	s.RecipientMAC.Write(xor(s.MAC, initNonce))
+	s.RecipientMAC.Write(ack)
+	return s, nil
+}
@@ -0,0 +1,41 @@
+// Package rlpx implements decoding of the RLPx transport protocol, the
+// encrypted TCP transport of devp2p.
+// https://github.com/ethereum/devp2p/blob/master/rlpx.md
+package rlpx
+
+import (
+	"errors"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	sskLen = 16 // ecies.MaxSharedKeyLength(pubKey) / 2
+	sigLen = crypto.SignatureLength
+	pubLen = 64 // 512 bit pubkey in uncompressed representation without format byte
+	shaLen = 32 // hash length (for nonce etc)
+
+	eciesOverhead = 65 /* pubkey */ + 16 /* IV */ + 32 /* MAC */
+
+	// Handshake messages are at least as large as a pre-EIP-8 ack.
+	minHandshakeSize = 97 + eciesOverhead
+
+	frameHeaderSize = 32 // encrypted header and its MAC
+	frameMACSize    = 16
+	maxUint24       = 1<<24 - 1
+)
+
+// Errors.
+var (
+	ErrIncomplete   = errors.New("incomplete data")
+	errHandshakeLen = errors.New("invalid handshake message size")
+	errBadHeaderMAC = errors.New("bad header MAC")
+	errBadFrameMAC  = errors.New("bad frame MAC")
+)
+
+func xor(one, other []byte) []byte {
+	x := make([]byte, len(one))
+	for i := range one {
+		x[i] = one[i] ^ other[i]
+	}
+	return x
+}
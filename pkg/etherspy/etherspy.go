@@ -0,0 +1,84 @@
+// Package etherspy captures and decodes Ethereum discovery traffic. A
+// Sniffer reads packets from a live interface, a pcap file or a pcap
+// stream and hands out every discv4 and discv5 packet it decodes, or the
+// frames read for callers decoding them with a Decoder, as the etherspy
+// command does. Builds tagged nopcap don't link libpcap: they filter files
+// and streams with package capfilter and can't capture live.
+package etherspy
+
+import (
+	"github.com/drgomesp/etherspy/pkg/errcode"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+)
+
+// Protocols told apart by Detect.
+const (
+	ProtocolDiscv4 = "discv4"
+	ProtocolDiscv5 = "discv5"
+)
+
+// Error codes of Detect, stable across releases.
+var (
+	CodeUnknownDestination = errcode.Register("ES-001", "unknown-destination", "", "discv5 packet whose recipient's node ID, needed to unmask it, is not known")
+	CodeUnknownProtocol    = errcode.Register("ES-002", "unknown-protocol", "", "datagram is neither discv4 nor discv5")
+)
+
+var (
+	// ErrUnknownDestination is reported for discv5 packets whose
+	// recipient's node ID, needed to unmask them, is not known.
+	ErrUnknownDestination error = errcode.New(CodeUnknownDestination, "destination node ID unknown")
+
+	// ErrUnknownProtocol is reported for datagrams that are neither discv4
+	// nor discv5.
+	ErrUnknownProtocol error = errcode.New(CodeUnknownProtocol, "neither discv4 nor discv5")
+)
+
+// Detect tells discv4 and discv5 datagrams apart, since both share port
+// 30303. A discv5 header unmasks to its protocol ID with the node ID of the
+// recipient, dest, when known; a discv4 packet starts with the hash of the
+// rest, which is also what its verification checks, so the peeked packet is
+// returned for reuse. Without verify any packet with a valid discv4 type is
+// taken for discv4.
+//
+// Packets that fail both checks while dest is nil are taken for discv5,
+// which can't be recognized without it, along with ErrUnknownDestination.
+func Detect(buf []byte, dest *enode.ID, verify bool) (string, *discv4.Packet, error) {
+	if dest != nil && discv5.Match(buf, *dest) {
+		return ProtocolDiscv5, nil, nil
+	}
+	pkt, err := discv4.Peek(buf)
+	if err == nil && verify {
+		err = pkt.Verify()
+	}
+	switch {
+	case err == nil:
+		return ProtocolDiscv4, pkt, nil
+	case dest == nil:
+		return ProtocolDiscv5, nil, ErrUnknownDestination
+	default:
+		return "", nil, ErrUnknownProtocol
+	}
+}
+
+// Decoder decodes discovery datagrams: it tells their protocol apart with
+// Detect, then decrypts discv5 messages with the keys of Sessions. discv4
+// packets are left to decode lazily, as peeked by Detect.
+type Decoder struct {
+	Sessions *discv5.SessionStore
+
+	// SkipVerify skips discv4 hash verification, for trusted captures only.
+	SkipVerify bool
+}
+
+// Detect tells the protocol of buf, as Detect does.
+func (d *Decoder) Detect(buf []byte, dest *enode.ID) (string, *discv4.Packet, error) {
+	return Detect(buf, dest, !d.SkipVerify)
+}
+
+// DecodeV5 decodes the discv5 packet buf sent to dest. Unmasking happens in
+// place.
+func (d *Decoder) DecodeV5(buf []byte, dest enode.ID) (discv5.Packet, error) {
+	return discv5.Decode(buf, discv5.DecodeOptions{Dest: dest, Sessions: d.Sessions})
+}
@@ -0,0 +1,338 @@
+package etherspy
+
+import (
+	"crypto/ecdsa"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/drgomesp/etherspy/pkg/sink"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Source is an opened source of frames, such as a pcap handle.
+type Source interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+}
+
+// Config configures a Sniffer. Exactly one of Sources, Reader, File and
+// Interface selects where packets are read from, in that order of
+// precedence.
+type Config struct {
+	// Sources are read concurrently. They are opened, filtered and closed
+	// by the caller.
+	Sources []Source
+
+	Reader    io.Reader // pcap formatted stream
+	File      string    // pcap file
+	Interface string    // live capture interface
+
+	SnapLen int    // default 1600
+	Filter  string // BPF filter, default "udp port 30303"
+
+	// NodeKey is the private key of the node whose traffic is captured,
+	// needed to decode the discv5 packets it receives. LocalIPs are its
+	// addresses, by default those of Interface.
+	NodeKey  *ecdsa.PrivateKey
+	LocalIPs []net.IP
+
+	// SkipVerify skips discv4 hash verification, for trusted captures only.
+	SkipVerify bool
+
+	// Raw hands out the frames read undecoded, on Frames, for callers doing
+	// their own decoding.
+	Raw bool
+
+	// OnPacket is called with every decoded packet. When nil, packets are
+	// delivered on the Packets channel instead.
+	OnPacket func(sink.DecodedPacket)
+
+	// OnError is called with every packet that fails to decode, if set.
+	OnError func(protocol string, err error)
+}
+
+// Sniffer captures and decodes discovery packets in the background.
+type Sniffer struct {
+	cfg     Config
+	dest    *enode.ID
+	local   map[string]bool
+	decoder *Decoder
+
+	sources []Source
+	filter  matcher // of streams, which libpcap doesn't filter
+	close   func()  // closes the sources the Sniffer opened
+
+	packets chan sink.DecodedPacket
+	frames  chan gopacket.Packet
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+	started bool
+	err     error
+}
+
+// matcher tells whether a frame passes a filter, as a pcap.BPF does.
+type matcher interface {
+	Matches(ci gopacket.CaptureInfo, data []byte) bool
+}
+
+// New returns a Sniffer for cfg. Nothing is opened until Start.
+func New(cfg Config) *Sniffer {
+	if cfg.SnapLen == 0 {
+		cfg.SnapLen = 1600
+	}
+	if cfg.Filter == "" {
+		cfg.Filter = "udp port 30303"
+	}
+	s := &Sniffer{
+		cfg:     cfg,
+		local:   make(map[string]bool),
+		decoder: &Decoder{Sessions: discv5.NewSessionStore(), SkipVerify: cfg.SkipVerify},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	switch {
+	case cfg.Raw:
+		// Frames wait in the channel while the caller is busy, as they
+		// would in the capture buffer.
+		s.frames = make(chan gopacket.Packet, 1000)
+	case cfg.OnPacket == nil:
+		s.packets = make(chan sink.DecodedPacket, 64)
+	}
+	if cfg.NodeKey != nil {
+		id := enode.PubkeyToIDV4(&cfg.NodeKey.PublicKey)
+		s.dest = &id
+		s.decoder.Sessions.AddPrivateKey(cfg.NodeKey)
+	}
+	for _, ip := range cfg.LocalIPs {
+		s.local[ip.String()] = true
+	}
+	return s
+}
+
+// Start opens the packet source and starts decoding.
+func (s *Sniffer) Start() error {
+	if len(s.cfg.Sources) > 0 {
+		s.sources = s.cfg.Sources
+	} else if err := s.open(); err != nil {
+		return err
+	}
+	s.started = true
+	go s.run()
+	return nil
+}
+
+// Stop stops decoding and closes the packet source. It waits for the
+// packet being decoded, if any, to be delivered.
+func (s *Sniffer) Stop() {
+	if !s.started {
+		return
+	}
+	s.once.Do(func() { close(s.stop) })
+	<-s.done
+}
+
+// Packets returns the channel decoded packets are delivered on when no
+// OnPacket callback is set. It is closed once the Sniffer is done.
+func (s *Sniffer) Packets() <-chan sink.DecodedPacket {
+	return s.packets
+}
+
+// Frames returns the channel frames are delivered on with Raw set. It is
+// closed once the Sniffer is done.
+func (s *Sniffer) Frames() <-chan gopacket.Packet {
+	return s.frames
+}
+
+// Done is closed once the Sniffer stopped, either through Stop or because
+// the source was exhausted or failed.
+func (s *Sniffer) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the error the source failed with, if any, once Done is closed.
+func (s *Sniffer) Err() error {
+	if !s.started {
+		return nil
+	}
+	<-s.done
+	return s.err
+}
+
+// run reads every source on a goroutine of its own until all are
+// exhausted or the Sniffer is stopped.
+func (s *Sniffer) run() {
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, len(s.sources))
+	)
+	for _, src := range s.sources {
+		wg.Add(1)
+		go func(src Source) {
+			defer wg.Done()
+			if err := s.read(src); err != nil {
+				errs <- err
+			}
+		}(src)
+	}
+	wg.Wait()
+	close(errs)
+	s.err = <-errs
+	if s.close != nil {
+		s.close()
+	}
+	if s.packets != nil {
+		close(s.packets)
+	}
+	if s.frames != nil {
+		close(s.frames)
+	}
+	close(s.done)
+}
+
+// read delivers the packets of src, returning once it is exhausted, with
+// the error it failed with if any, or the Sniffer is stopped.
+func (s *Sniffer) read(src Source) error {
+	packets := gopacket.NewPacketSource(src, src.LinkType())
+	// Sources hand out fresh data, and payloads are copied before decoding.
+	packets.NoCopy = true
+	for {
+		select {
+		case <-s.stop:
+			return nil
+		default:
+		}
+
+		packet, err := packets.NextPacket()
+		switch {
+		case err == nil:
+		case err == io.EOF:
+			return nil
+		case closed(err):
+			return err
+		case err == syscall.EAGAIN:
+			continue
+		default:
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			// Timeouts of live captures, among others, are retried as the
+			// packet channels of gopacket do.
+			time.Sleep(5 * time.Millisecond)
+			continue
+		}
+		if s.filter != nil && !s.filter.Matches(packet.Metadata().CaptureInfo, packet.Data()) {
+			continue
+		}
+		if s.frames != nil {
+			select {
+			case s.frames <- packet:
+			case <-s.stop:
+				return nil
+			}
+			continue
+		}
+		p, ok := s.decode(packet)
+		if !ok {
+			continue
+		}
+		if s.cfg.OnPacket != nil {
+			s.cfg.OnPacket(p)
+			continue
+		}
+		select {
+		case s.packets <- p:
+		case <-s.stop:
+			return nil
+		}
+	}
+}
+
+// decode decodes the discovery packet carried by packet, if any.
+func (s *Sniffer) decode(packet gopacket.Packet) (sink.DecodedPacket, bool) {
+	p := sink.DecodedPacket{
+		Time:      packet.Metadata().Timestamp,
+		Src:       "-",
+		Dst:       "-",
+		Direction: "-",
+	}
+	udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok || len(udp.Payload) == 0 {
+		return p, false
+	}
+	// Unmasking discv5 happens in place and discv4 bodies are decoded
+	// lazily, while the source may reuse packet data: work on a copy.
+	buf := append([]byte(nil), udp.Payload...)
+	p.Size = len(buf)
+	if network := packet.NetworkLayer(); network != nil {
+		nf, tf := network.NetworkFlow(), udp.TransportFlow()
+		p.Src = net.JoinHostPort(nf.Src().String(), tf.Src().String())
+		p.Dst = net.JoinHostPort(nf.Dst().String(), tf.Dst().String())
+		switch {
+		case s.local[nf.Dst().String()]:
+			p.Direction = "in"
+		case s.local[nf.Src().String()]:
+			p.Direction = "out"
+		}
+	}
+
+	// Headers are masked with the recipient's node ID, only packets
+	// received by the local node can be unmasked.
+	var dest *enode.ID
+	if p.Direction != "out" {
+		dest = s.dest
+	}
+	protocol, pkt, err := s.decoder.Detect(buf, dest)
+	p.Protocol = protocol
+	if err != nil {
+		s.fail(protocol, err)
+		return p, false
+	}
+
+	switch protocol {
+	case ProtocolDiscv5:
+		dp, err := s.decoder.DecodeV5(buf, *dest)
+		if err != nil {
+			s.fail(protocol, err)
+			return p, false
+		}
+		p.Kind = dp.Name()
+		p.NodeID = func() (string, error) {
+			if id, ok := discv5.SrcID(dp); ok {
+				return id.String(), nil
+			}
+			return "", nil
+		}
+		p.Body = func() (interface{}, error) { return dp, nil }
+	default:
+		p.Kind = pkt.Kind.String()
+		p.NodeID = func() (string, error) {
+			id, err := pkt.Sender.NodeID()
+			return id.String(), err
+		}
+		p.Body = func() (interface{}, error) { return pkt.Body() }
+	}
+	return p, true
+}
+
+func (s *Sniffer) fail(protocol string, err error) {
+	if s.cfg.OnError != nil {
+		s.cfg.OnError(protocol, err)
+	}
+}
+
+// closed reports whether err, returned by a source, means it can't be read
+// any further.
+func closed(err error) bool {
+	switch err {
+	case io.ErrUnexpectedEOF, io.ErrNoProgress, io.ErrClosedPipe, io.ErrShortBuffer, syscall.EBADF:
+		return true
+	}
+	return strings.Contains(err.Error(), "use of closed file")
+}
@@ -0,0 +1,65 @@
+//go:build nopcap
+
+package etherspy
+
+import (
+	"bufio"
+	"errors"
+	"github.com/drgomesp/etherspy/pkg/capfilter"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"io"
+	"os"
+)
+
+// open opens the file or stream of the configuration, filtered in user
+// space by capfilter, which only knows Ethernet framing.
+func (s *Sniffer) open() error {
+	in := s.cfg.Reader
+	if in == nil {
+		if s.cfg.File == "" {
+			return errors.New("built without libpcap, live capture is unavailable")
+		}
+		f, err := os.Open(s.cfg.File)
+		if err != nil {
+			return err
+		}
+		in, s.close = f, func() { f.Close() }
+	}
+	src, err := newReader(in)
+	if err == nil && src.LinkType() != layers.LinkTypeEthernet {
+		err = errors.New("only Ethernet captures can be filtered without libpcap")
+	}
+	var filter *capfilter.Filter
+	if err == nil {
+		filter, err = capfilter.New(s.cfg.Filter, s.cfg.SnapLen)
+	}
+	if err != nil {
+		if s.close != nil {
+			s.close()
+		}
+		return err
+	}
+	s.sources, s.filter = []Source{src}, frameFilter{filter}
+	return nil
+}
+
+// newReader reads a pcap or pcapng stream.
+func newReader(in io.Reader) (Source, error) {
+	br := bufio.NewReader(in)
+	// pcapng streams start with a section header block.
+	if magic, _ := br.Peek(4); string(magic) == "\x0a\x0d\x0d\x0a" {
+		return pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+	}
+	return pcapgo.NewReader(br)
+}
+
+// frameFilter matches frames with a capfilter.Filter.
+type frameFilter struct {
+	f *capfilter.Filter
+}
+
+func (f frameFilter) Matches(_ gopacket.CaptureInfo, data []byte) bool {
+	return f.f.Matches(data)
+}
@@ -0,0 +1,64 @@
+//go:build !nopcap
+
+package etherspy
+
+import (
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+	"time"
+)
+
+// open opens the source of the configuration, filtered.
+func (s *Sniffer) open() error {
+	var handle *pcap.Handle
+	switch {
+	case s.cfg.Reader != nil:
+		r, err := pcapgo.NewReader(s.cfg.Reader)
+		if err != nil {
+			return err
+		}
+		// Streams aren't filtered by libpcap, packets are matched one by
+		// one instead.
+		bpf, err := pcap.NewBPF(r.LinkType(), s.cfg.SnapLen, s.cfg.Filter)
+		if err != nil {
+			return err
+		}
+		s.sources, s.filter = []Source{r}, bpf
+		return nil
+	case s.cfg.File != "":
+		var err error
+		if handle, err = pcap.OpenOffline(s.cfg.File); err != nil {
+			return err
+		}
+	default:
+		// The timeout lets Stop interrupt an idle capture.
+		var err error
+		if handle, err = pcap.OpenLive(s.cfg.Interface, int32(s.cfg.SnapLen), true, 250*time.Millisecond); err != nil {
+			return err
+		}
+		if len(s.local) == 0 {
+			s.addInterfaceAddrs()
+		}
+	}
+	if err := handle.SetBPFFilter(s.cfg.Filter); err != nil {
+		handle.Close()
+		return err
+	}
+	s.sources, s.close = []Source{handle}, handle.Close
+	return nil
+}
+
+func (s *Sniffer) addInterfaceAddrs() {
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return
+	}
+	for _, d := range devs {
+		if d.Name != s.cfg.Interface {
+			continue
+		}
+		for _, a := range d.Addresses {
+			s.local[a.IP.String()] = true
+		}
+	}
+}
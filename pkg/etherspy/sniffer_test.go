@@ -0,0 +1,178 @@
+package etherspy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/drgomesp/etherspy/pkg/sink"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	remoteIP = net.IPv4(10, 0, 0, 1)
+	localIP  = net.IPv4(10, 0, 0, 2)
+)
+
+// capture returns a pcap stream of UDP datagrams from the remote to the
+// local address, and of a TCP segment.
+func capture(t *testing.T, datagrams ...[]byte) *bytes.Buffer {
+	t.Helper()
+	var out bytes.Buffer
+	w := pcapgo.NewWriter(&out)
+	if err := w.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	write := func(i int, transport gopacket.SerializableLayer, payload []byte) {
+		eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{2, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, SrcIP: remoteIP, DstIP: localIP, Protocol: layers.IPProtocolUDP}
+		switch l := transport.(type) {
+		case *layers.UDP:
+			l.SetNetworkLayerForChecksum(ip)
+		case *layers.TCP:
+			ip.Protocol = layers.IPProtocolTCP
+			l.SetNetworkLayerForChecksum(ip)
+		}
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, eth, ip, transport, gopacket.Payload(payload)); err != nil {
+			t.Fatal(err)
+		}
+		ci := gopacket.CaptureInfo{Timestamp: time.Unix(1700000000+int64(i), 0), CaptureLength: len(buf.Bytes()), Length: len(buf.Bytes())}
+		if err := w.WritePacket(ci, buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, d := range datagrams {
+		write(i, &layers.UDP{SrcPort: 30303, DstPort: 30303}, d)
+	}
+	write(len(datagrams), &layers.TCP{SrcPort: 30303, DstPort: 30303, SYN: true}, nil)
+	return &out
+}
+
+func TestSniffer(t *testing.T) {
+	remoteKey, _ := crypto.GenerateKey()
+	localKey, _ := crypto.GenerateKey()
+	ping, _, err := discv4.Encode(remoteKey, &discv4.Ping{Version: 4, Expiration: 1700000100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := enode.NewV4(&localKey.PublicKey, localIP, 30303, 30303)
+	whoareyou, err := discv5.NewEncoder(remoteKey).Encode(local, &discv5.Whoareyou{RecordSeq: 3}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := capture(t, ping, whoareyou, []byte("not discovery"))
+	src, err := pcapgo.NewReader(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failed []error
+	s := New(Config{
+		Sources:  []Source{src},
+		NodeKey:  localKey,
+		LocalIPs: []net.IP{localIP},
+		OnError:  func(protocol string, err error) { failed = append(failed, err) },
+	})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var got []sink.DecodedPacket
+	for p := range s.Packets() {
+		got = append(got, p)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct{ protocol, kind string }{{ProtocolDiscv4, "PING"}, {ProtocolDiscv5, "WHOAREYOU"}}
+	if len(got) != len(want) {
+		t.Fatalf("decoded %d packets, want %d", len(got), len(want))
+	}
+	for i, w := range want {
+		p := got[i]
+		if p.Protocol != w.protocol || p.Kind != w.kind {
+			t.Errorf("packet %d: %s %s, want %s %s", i, p.Protocol, p.Kind, w.protocol, w.kind)
+		}
+		if p.Src != "10.0.0.1:30303" || p.Dst != "10.0.0.2:30303" || p.Direction != "in" || p.Size == 0 {
+			t.Errorf("packet %d: %s -> %s, %s, %d bytes", i, p.Src, p.Dst, p.Direction, p.Size)
+		}
+		if !p.Time.Equal(time.Unix(1700000000+int64(i), 0)) {
+			t.Errorf("packet %d at %v", i, p.Time)
+		}
+	}
+	if id, err := got[0].NodeID(); err != nil || id != fmt.Sprintf("%x", crypto.FromECDSAPub(&remoteKey.PublicKey)[1:]) {
+		t.Errorf("discv4 sender %s, %v", id, err)
+	}
+	if body, err := got[1].Body(); err != nil || body.(*discv5.Whoareyou).RecordSeq != 3 {
+		t.Errorf("discv5 body %+v, %v", body, err)
+	}
+	if len(failed) != 1 || !errors.Is(failed[0], ErrUnknownProtocol) {
+		t.Errorf("failures %v, want the datagram of neither protocol", failed)
+	}
+}
+
+func TestSnifferRaw(t *testing.T) {
+	src, err := pcapgo.NewReader(capture(t, []byte("a"), []byte("b")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(Config{Sources: []Source{src}, Raw: true})
+	if s.Packets() != nil {
+		t.Error("packets delivered in raw mode")
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for range s.Frames() {
+		n++
+	}
+	if n != 3 {
+		t.Errorf("%d frames, want 3", n)
+	}
+}
+
+func TestSnifferStop(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	ping, _, err := discv4.Encode(key, &discv4.Ping{Version: 4, Expiration: 1700000100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	datagrams := make([][]byte, 100)
+	for i := range datagrams {
+		datagrams[i] = ping
+	}
+	src, err := pcapgo.NewReader(capture(t, datagrams...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing takes the packets, Stop interrupts the delivery.
+	s := New(Config{Sources: []Source{src}})
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	<-s.Packets()
+	s.Stop()
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("not done once stopped")
+	}
+	n := 0
+	for range s.Packets() {
+		n++
+	}
+	if n >= len(datagrams)-1 {
+		t.Errorf("%d packets delivered after Stop", n)
+	}
+}
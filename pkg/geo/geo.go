@@ -0,0 +1,117 @@
+// Package geo looks up where IP addresses are, their country and city, and
+// the autonomous system announcing them, in MaxMind databases such as the
+// free GeoLite2 City, Country and ASN editions. Several databases are
+// consulted in turn, each filling in what it knows.
+package geo
+
+import (
+	"fmt"
+	"github.com/oschwald/maxminddb-golang"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Location is what the databases know of an address. Empty fields are
+// unknown.
+type Location struct {
+	Country string `json:"country,omitempty"` // ISO 3166-1 alpha-2 code
+	City    string `json:"city,omitempty"`    // English name
+	ASN     uint   `json:"asn,omitempty"`
+	Org     string `json:"org,omitempty"` // of the autonomous system
+}
+
+// String formats l on one line, such as "DE Berlin AS3320 Deutsche
+// Telekom AG", leaving out what is unknown.
+func (l Location) String() string {
+	var parts []string
+	for _, s := range []string{l.Country, l.City} {
+		if s != "" {
+			parts = append(parts, s)
+		}
+	}
+	if l.ASN != 0 {
+		parts = append(parts, "AS"+strconv.FormatUint(uint64(l.ASN), 10))
+	}
+	if l.Org != "" {
+		parts = append(parts, l.Org)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (l Location) empty() bool {
+	return l == Location{}
+}
+
+// record holds the fields read from the City, Country and ASN editions,
+// each leaving the others' zero.
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	ASN uint   `maxminddb:"autonomous_system_number"`
+	Org string `maxminddb:"autonomous_system_organization"`
+}
+
+// DB is a set of open databases, safe for concurrent use.
+type DB struct {
+	readers []*maxminddb.Reader
+}
+
+// Open opens the databases at paths.
+func Open(paths ...string) (*DB, error) {
+	db := new(DB)
+	for _, path := range paths {
+		r, err := maxminddb.Open(path)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		db.readers = append(db.readers, r)
+	}
+	return db, nil
+}
+
+// Types returns the types of the open databases, such as GeoLite2-ASN.
+func (db *DB) Types() []string {
+	types := make([]string, len(db.readers))
+	for i, r := range db.readers {
+		types[i] = r.Metadata.DatabaseType
+	}
+	return types
+}
+
+// Lookup returns the location of ip, false if no database knows of it.
+func (db *DB) Lookup(ip net.IP) (Location, bool) {
+	var loc Location
+	for _, r := range db.readers {
+		var rec record
+		if err := r.Lookup(ip, &rec); err != nil {
+			continue
+		}
+		if rec.Country.ISOCode != "" {
+			loc.Country = rec.Country.ISOCode
+		}
+		if name := rec.City.Names["en"]; name != "" {
+			loc.City = name
+		}
+		if rec.ASN != 0 {
+			loc.ASN, loc.Org = rec.ASN, rec.Org
+		}
+	}
+	return loc, !loc.empty()
+}
+
+// Close closes the databases.
+func (db *DB) Close() error {
+	var err error
+	for _, r := range db.readers {
+		if cerr := r.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,321 @@
+// Package match implements filter expressions over the fields of decoded
+// packets, such as
+//
+//	proto==discv4 && kind==NEIGHBORS && nodes>8
+//
+// Comparisons are joined with && and ||, negated with ! and grouped with
+// parentheses. The operators are ==, !=, <, <=, >, >= and ~= for regular
+// expression matches. Values are bare words, numbers or quoted strings.
+// Lists compare by their length against numbers, and a comparison on a
+// field the packet lacks is false.
+package match
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Fields gives access to the fields of a packet by name.
+type Fields interface {
+	Field(name string) (interface{}, bool)
+}
+
+// Expr is a compiled filter expression.
+type Expr struct {
+	src  string
+	root node
+}
+
+// Compile parses a filter expression.
+func Compile(src string) (*Expr, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.toks[p.pos].text, p.toks[p.pos].offset)
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+// Match reports whether the packet with the given fields satisfies e.
+func (e *Expr) Match(f Fields) bool {
+	return e.root.eval(f)
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+type node interface {
+	eval(Fields) bool
+}
+
+type and struct{ l, r node }
+type or struct{ l, r node }
+type not struct{ n node }
+
+func (n and) eval(f Fields) bool { return n.l.eval(f) && n.r.eval(f) }
+func (n or) eval(f Fields) bool  { return n.l.eval(f) || n.r.eval(f) }
+func (n not) eval(f Fields) bool { return !n.n.eval(f) }
+
+type comparison struct {
+	field string
+	op    string
+	value string
+	num   *float64
+	re    *regexp.Regexp
+}
+
+func (c *comparison) eval(f Fields) bool {
+	v, ok := f.Field(c.field)
+	if !ok || v == nil {
+		return false
+	}
+	if c.re != nil {
+		return c.re.MatchString(fmt.Sprint(v))
+	}
+	if c.num != nil {
+		if x, ok := number(v); ok {
+			return compare(c.op, x, *c.num)
+		}
+	}
+	s := fmt.Sprint(v)
+	switch c.op {
+	case "==":
+		return strings.EqualFold(s, c.value)
+	case "!=":
+		return !strings.EqualFold(s, c.value)
+	default:
+		return compareStrings(c.op, s, c.value)
+	}
+}
+
+// number returns v as a number: numbers as they are, numeric strings
+// parsed and lists by their length.
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case []interface{}:
+		return float64(len(v)), true
+	case string:
+		x, err := strconv.ParseFloat(v, 64)
+		return x, err == nil
+	default:
+		return 0, false
+	}
+}
+
+func compare(op string, x, y float64) bool {
+	switch op {
+	case "==":
+		return x == y
+	case "!=":
+		return x != y
+	case "<":
+		return x < y
+	case "<=":
+		return x <= y
+	case ">":
+		return x > y
+	default:
+		return x >= y
+	}
+}
+
+func compareStrings(op string, x, y string) bool {
+	switch op {
+	case "<":
+		return x < y
+	case "<=":
+		return x <= y
+	case ">":
+		return x > y
+	default:
+		return x >= y
+	}
+}
+
+type token struct {
+	text   string
+	quoted bool
+	offset int
+}
+
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "~=", "<", ">", "!", "(", ")"}
+
+func lex(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+			continue
+		case c == '"' || c == '\'':
+			end := strings.IndexRune(src[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			toks = append(toks, token{text: src[i+1 : i+1+end], quoted: true, offset: i})
+			i += end + 2
+			continue
+		}
+		op := ""
+		for _, o := range operators {
+			if strings.HasPrefix(src[i:], o) {
+				op = o
+				break
+			}
+		}
+		if op != "" {
+			toks = append(toks, token{text: op, offset: i})
+			i += len(op)
+			continue
+		}
+		start := i
+		for i < len(src) && !unicode.IsSpace(rune(src[i])) && !strings.ContainsRune("&|=!<>~()\"'", rune(src[i])) {
+			i++
+		}
+		if i == start {
+			return nil, fmt.Errorf("unexpected %q at offset %d", src[i], i)
+		}
+		toks = append(toks, token{text: src[start:i], offset: start})
+	}
+	return toks, nil
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek(text string) bool {
+	return p.pos < len(p.toks) && !p.toks[p.pos].quoted && p.toks[p.pos].text == text
+}
+
+func (p *parser) or() (node, error) {
+	l, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek("||") {
+		p.pos++
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l = or{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) and() (node, error) {
+	l, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek("&&") {
+		p.pos++
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l = and{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) unary() (node, error) {
+	switch {
+	case p.peek("!"):
+		p.pos++
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return not{n}, nil
+	case p.peek("("):
+		p.pos++
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peek(")") {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return n, nil
+	default:
+		return p.comparison()
+	}
+}
+
+func (p *parser) comparison() (node, error) {
+	if p.pos+3 > len(p.toks) {
+		return nil, fmt.Errorf("incomplete comparison at the end of the expression")
+	}
+	field, op, value := p.toks[p.pos], p.toks[p.pos+1], p.toks[p.pos+2]
+	if field.quoted || isOperator(field.text) {
+		return nil, fmt.Errorf("expected a field name at offset %d, got %q", field.offset, field.text)
+	}
+	if op.quoted || !isComparison(op.text) {
+		return nil, fmt.Errorf("expected a comparison operator at offset %d, got %q", op.offset, op.text)
+	}
+	if !value.quoted && isOperator(value.text) {
+		return nil, fmt.Errorf("expected a value at offset %d, got %q", value.offset, value.text)
+	}
+	p.pos += 3
+
+	c := &comparison{field: field.text, op: op.text, value: value.text}
+	if op.text == "~=" {
+		re, err := regexp.Compile(value.text)
+		if err != nil {
+			return nil, err
+		}
+		c.re = re
+	} else if x, err := strconv.ParseFloat(value.text, 64); err == nil {
+		c.num = &x
+	}
+	return c, nil
+}
+
+func isOperator(s string) bool {
+	for _, o := range operators {
+		if s == o {
+			return true
+		}
+	}
+	return false
+}
+
+func isComparison(s string) bool {
+	switch s {
+	case "==", "!=", "<", "<=", ">", ">=", "~=":
+		return true
+	}
+	return false
+}
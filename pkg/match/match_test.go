@@ -0,0 +1,113 @@
+package match
+
+import (
+	"strings"
+	"testing"
+)
+
+// fields are the fields of a packet, by name.
+type fields map[string]interface{}
+
+func (f fields) Field(name string) (interface{}, bool) {
+	v, ok := f[name]
+	return v, ok
+}
+
+var neighbors = fields{
+	"proto": "discv4",
+	"kind":  "NEIGHBORS",
+	"size":  1100,
+	"src":   "10.0.0.1:30303",
+	"nodes": []interface{}{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+	"ttl":   uint8(64),
+	"rtt":   0.25,
+	"seq":   "42",
+	"empty": nil,
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"proto==discv4", true},
+		{"proto == DISCV4", true},
+		{"proto!=discv5", true},
+		{"kind==NEIGHBORS && nodes>8", true},
+		{"proto==discv4 && kind==NEIGHBORS && nodes>12", false},
+		{"nodes>=12 && nodes<=12 && nodes==12", true},
+		{"size<1000 || ttl==64", true},
+		{"size<1000 || ttl<64", false},
+		{"rtt>0.2 && rtt<0.3", true},
+		{"seq>41", true},
+		{`src=="10.0.0.1:30303"`, true},
+		{"src=='10.0.0.1:30303'", true},
+		{`src~="^10\.0\.0\.\d+:"`, true},
+		{"kind~=PING", false},
+		{"kind>NEIGHBOR && kind<PING", true},
+
+		// && binds tighter than ||, ! tighter than both.
+		{"proto==discv5 && kind==NEIGHBORS || nodes>8", true},
+		{"proto==discv5 && (kind==NEIGHBORS || nodes>8)", false},
+		{"nodes>8 || proto==discv5 && kind==PING", true},
+		{"(nodes>8 || proto==discv5) && kind==PING", false},
+		{"!proto==discv5 && kind==NEIGHBORS", true},
+		{"!(proto==discv4 && kind==PING)", true},
+		{"!!proto==discv4", true},
+		{"!proto==discv4 || !kind==NEIGHBORS || nodes==12", true},
+
+		// Comparisons on fields the packet lacks are false, their negation
+		// true.
+		{"missing==1", false},
+		{"missing!=1", false},
+		{"!missing==1", true},
+		{"empty==nil", false},
+	}
+	for _, tt := range tests {
+		e, err := Compile(tt.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if got := e.Match(neighbors); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.expr, got, tt.want)
+		}
+		if e.String() != tt.expr {
+			t.Errorf("%s: source %q", tt.expr, e.String())
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string // part of the error
+	}{
+		{"", "incomplete comparison"},
+		{"proto", "incomplete comparison"},
+		{"proto==", "incomplete comparison"},
+		{"proto==discv4 &&", "incomplete comparison"},
+		{"proto discv4 x", `expected a comparison operator at offset 6, got "discv4"`},
+		{"proto=discv4", `unexpected '=' at offset 5`},
+		{"==discv4 x", `expected a field name at offset 0, got "=="`},
+		{`"proto"==discv4`, `expected a field name at offset 0, got "proto"`},
+		{"proto==&&", `expected a value at offset 7, got "&&"`},
+		{`proto"=="discv4`, "expected a comparison operator at offset 5"},
+		{"proto==discv4)", `unexpected ")" at offset 13`},
+		{"(proto==discv4", "missing closing parenthesis"},
+		{"proto==discv4 kind==PING", `unexpected "kind" at offset 14`},
+		{`src=="10.0.0.1`, "unterminated string at offset 5"},
+		{"kind~=[", "error parsing regexp"},
+		{"size & 1", `unexpected '&' at offset 5`},
+	}
+	for _, tt := range tests {
+		_, err := Compile(tt.expr)
+		if err == nil {
+			t.Errorf("%q compiled", tt.expr)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: error %q, want %q", tt.expr, err, tt.err)
+		}
+	}
+}
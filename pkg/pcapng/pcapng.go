@@ -0,0 +1,113 @@
+// Package pcapng writes captures in the pcapng format with comments on
+// their packets, which Wireshark shows with the packet and filters on as
+// frame.comment, so decoded metadata travels with the frames. Files have a
+// single section and interface, with nanosecond timestamps.
+package pcapng
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"io"
+)
+
+// Block types and option codes of pcapng.
+const (
+	blockSectionHeader    = 0x0a0d0d0a
+	blockInterface        = 0x00000001
+	blockEnhancedPacket   = 0x00000006
+	byteOrderMagic        = 0x1a2b3c4d
+	optionEnd             = 0
+	optionComment         = 1
+	optionUserApplication = 4
+	optionTimeResolution  = 9
+)
+
+// Writer writes a capture to an io.Writer, every block in a single write
+// so readers of pipes never see part of one. It is not safe for
+// concurrent use.
+type Writer struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewWriter writes the headers of a capture of frames of the given link
+// type, snaplen bytes at most, by the application named app.
+func NewWriter(w io.Writer, linkType layers.LinkType, snaplen int, app string) (*Writer, error) {
+	n := &Writer{w: w}
+
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:], byteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:], 1) // version 1.0
+	binary.LittleEndian.PutUint16(body[6:], 0)
+	binary.LittleEndian.PutUint64(body[8:], ^uint64(0)) // section length unknown
+	body = appendOption(body, optionUserApplication, []byte(app))
+	body = appendOption(body, optionEnd, nil)
+	if err := n.writeBlock(blockSectionHeader, body); err != nil {
+		return nil, err
+	}
+
+	body = make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:], uint16(linkType))
+	binary.LittleEndian.PutUint32(body[4:], uint32(snaplen))
+	body = appendOption(body, optionTimeResolution, []byte{9}) // nanoseconds
+	body = appendOption(body, optionEnd, nil)
+	if err := n.writeBlock(blockInterface, body); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// WritePacket writes a frame captured as described by ci, with comments.
+func (n *Writer) WritePacket(ci gopacket.CaptureInfo, data []byte, comments ...string) error {
+	body := make([]byte, 20, 20+len(data)+3)
+	ts := uint64(ci.Timestamp.UnixNano())
+	binary.LittleEndian.PutUint32(body[0:], 0) // interface
+	binary.LittleEndian.PutUint32(body[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(data)))
+	length := ci.Length
+	if length < len(data) {
+		length = len(data)
+	}
+	binary.LittleEndian.PutUint32(body[16:], uint32(length))
+	body = pad(append(body, data...))
+	if len(comments) > 0 {
+		for _, c := range comments {
+			body = appendOption(body, optionComment, []byte(c))
+		}
+		body = appendOption(body, optionEnd, nil)
+	}
+	return n.writeBlock(blockEnhancedPacket, body)
+}
+
+// writeBlock writes a block of the given type around body, a multiple of
+// four bytes long.
+func (n *Writer) writeBlock(typ uint32, body []byte) error {
+	total := uint32(12 + len(body))
+	n.buf = n.buf[:0]
+	n.buf = binary.LittleEndian.AppendUint32(n.buf, typ)
+	n.buf = binary.LittleEndian.AppendUint32(n.buf, total)
+	n.buf = append(n.buf, body...)
+	n.buf = binary.LittleEndian.AppendUint32(n.buf, total)
+	_, err := n.w.Write(n.buf)
+	return err
+}
+
+// appendOption appends an option of the given code and value, padded to
+// four bytes. Values longer than an option can hold are truncated.
+func appendOption(b []byte, code uint16, value []byte) []byte {
+	if len(value) > 0xfff0 {
+		value = value[:0xfff0]
+	}
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return pad(append(b, value...))
+}
+
+func pad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
@@ -0,0 +1,161 @@
+package report
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chart is a line chart of series sharing their time axis, a value every
+// Step from Start.
+type Chart struct {
+	Start  time.Time
+	Step   time.Duration
+	Unit   string // of the values, such as "packets/s"
+	Series []Series
+}
+
+// Series is a named line of a chart.
+type Series struct {
+	Name   string
+	Values []float64
+}
+
+// Text and Markdown charts are a line of textChartWidth characters per
+// series, each darker the higher its value; they stay ASCII for PDFs.
+// HTML charts are inline SVG of at most svgPoints points per series.
+const (
+	textChartRamp  = " .:-=+*#%@"
+	textChartWidth = 60
+	svgWidth       = 860
+	svgHeight      = 220
+	svgMargin      = 40
+	svgPoints      = 430
+)
+
+// svgColors are the colors of the series of HTML charts, in turn.
+var svgColors = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b", "#e377c2", "#7f7f7f"}
+
+// len returns the number of values of the longest series.
+func (c *Chart) len() int {
+	n := 0
+	for _, s := range c.Series {
+		if len(s.Values) > n {
+			n = len(s.Values)
+		}
+	}
+	return n
+}
+
+// span describes the time axis of the chart.
+func (c *Chart) span() string {
+	end := c.Start.Add(time.Duration(c.len()) * c.Step)
+	return fmt.Sprintf("%s to %s, every %s", c.Start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339), c.Step)
+}
+
+// resample returns values reduced to at most n by averaging neighbors.
+func resample(values []float64, n int) []float64 {
+	if len(values) <= n {
+		return values
+	}
+	out := make([]float64, n)
+	for i := range out {
+		lo, hi := i*len(values)/n, (i+1)*len(values)/n
+		var sum float64
+		for _, v := range values[lo:hi] {
+			sum += v
+		}
+		out[i] = sum / float64(hi-lo)
+	}
+	return out
+}
+
+func maxOf(values []float64) float64 {
+	var max float64
+	for _, v := range values {
+		max = math.Max(max, v)
+	}
+	return max
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', 4, 64)
+}
+
+// textLines renders the chart as a line of its span, then a line per
+// series.
+func (c *Chart) textLines() []string {
+	lines := []string{c.span()}
+	width := 0
+	for _, s := range c.Series {
+		if len(s.Name) > width {
+			width = len(s.Name)
+		}
+	}
+	ramp := len(textChartRamp) - 1
+	for _, s := range c.Series {
+		values := resample(s.Values, textChartWidth)
+		max := maxOf(s.Values)
+		var b strings.Builder
+		for _, v := range values {
+			i := 0
+			if max > 0 {
+				i = int(math.Ceil(v / max * float64(ramp)))
+			}
+			b.WriteByte(textChartRamp[i])
+		}
+		lines = append(lines, fmt.Sprintf("%-*s |%-*s| max %s %s", width, s.Name, textChartWidth, b.String(), formatValue(max), c.Unit))
+	}
+	return lines
+}
+
+// chartSVG renders c as an inline SVG document, its series as polylines
+// over a common scale with a legend below.
+func chartSVG(c *Chart) template.HTML {
+	var max float64
+	for _, s := range c.Series {
+		max = math.Max(max, maxOf(s.Values))
+	}
+	if max == 0 {
+		max = 1
+	}
+	n := c.len()
+	points := n
+	if points > svgPoints {
+		points = svgPoints
+	}
+	plotW, plotH := float64(svgWidth-2*svgMargin), float64(svgHeight-2*svgMargin)
+	height := svgHeight + 16*len(c.Series)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="sans-serif" font-size="11">`, svgWidth, height)
+	fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#999"/>`, svgMargin, svgHeight-svgMargin, svgWidth-svgMargin, svgHeight-svgMargin)
+	fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#999"/>`, svgMargin, svgMargin, svgMargin, svgHeight-svgMargin)
+	fmt.Fprintf(&b, `<text x="%d" y="%d" text-anchor="end">%s</text>`, svgMargin-4, svgMargin+4, template.HTMLEscapeString(formatValue(max)))
+	fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`, svgMargin, svgMargin-8, template.HTMLEscapeString(c.Unit))
+	fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`, svgMargin, svgHeight-svgMargin+16, template.HTMLEscapeString(c.span()))
+	for i, s := range c.Series {
+		color := svgColors[i%len(svgColors)]
+		values := resample(s.Values, points)
+		if len(values) > 0 {
+			b.WriteString(`<polyline fill="none" stroke-width="1.5" stroke="` + color + `" points="`)
+			for j, v := range values {
+				x := float64(svgMargin)
+				if len(values) > 1 {
+					x += plotW * float64(j) / float64(len(values)-1)
+				}
+				y := float64(svgHeight-svgMargin) - plotH*v/max
+				fmt.Fprintf(&b, "%.1f,%.1f ", x, y)
+			}
+			b.WriteString(`"/>`)
+		}
+		y := svgHeight + 16*i
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="10" height="10" fill="%s"/>`, svgMargin, y-9, color)
+		fmt.Fprintf(&b, `<text x="%d" y="%d">%s</text>`, svgMargin+16, y, template.HTMLEscapeString(s.Name))
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
@@ -0,0 +1,59 @@
+package report
+
+import (
+	"html/template"
+	"io"
+)
+
+// htmlTemplate renders a self-contained page, styles inline and no
+// external resources, so the file can be mailed or attached as is.
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{"svg": chartSVG}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em auto; max-width: 72em; padding: 0 1em; color: #222; }
+h1 { border-bottom: 2px solid #444; padding-bottom: .2em; }
+h2 { margin-top: 1.6em; border-bottom: 1px solid #ccc; }
+dl { display: grid; grid-template-columns: max-content auto; gap: .2em 1em; }
+dt { font-weight: bold; }
+dd { margin: 0; font-family: ui-monospace, Menlo, Consolas, monospace; }
+table { border-collapse: collapse; font-size: .9em; }
+th, td { border: 1px solid #ccc; padding: .25em .6em; text-align: left; font-family: ui-monospace, Menlo, Consolas, monospace; }
+th { background: #f0f0f0; }
+tr:nth-child(even) td { background: #fafafa; }
+figure { margin: 1em 0; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Meta}}<dl>{{range .Meta}}<dt>{{.Name}}</dt><dd>{{.Value}}</dd>{{end}}</dl>{{end}}
+{{range .Sections}}<section>
+<h2>{{.Title}}</h2>
+{{range .Notes}}<p>{{.}}</p>
+{{end}}{{if .Fields}}<dl>{{range .Fields}}<dt>{{.Name}}</dt><dd>{{.Value}}</dd>{{end}}</dl>
+{{end}}{{with .Table}}<table>
+<thead><tr>{{range .Columns}}<th>{{.}}</th>{{end}}</tr></thead>
+<tbody>
+{{range .Rows}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</tbody>
+</table>
+{{end}}{{with .Chart}}<figure>{{svg .}}</figure>
+{{end}}</section>
+{{end}}</body>
+</html>
+`))
+
+// renderHTML writes r as a self-contained HTML page.
+func renderHTML(w io.Writer, r *Report) error {
+	meta := r.Meta
+	if g := r.generated(); g != "" {
+		meta = append([]Field{{"generated", g}}, meta...)
+	}
+	return htmlTemplate.Execute(w, struct {
+		Title    string
+		Meta     []Field
+		Sections []Section
+	}{r.Title, meta, r.Sections})
+}
@@ -0,0 +1,63 @@
+package report
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// renderMarkdown writes r as GitHub flavored Markdown, tables as pipe
+// tables.
+func renderMarkdown(w io.Writer, r *Report) error {
+	b := bufio.NewWriter(w)
+	b.WriteString("# " + mdEscape(r.Title) + "\n\n")
+	meta := r.Meta
+	if g := r.generated(); g != "" {
+		meta = append([]Field{{"generated", g}}, meta...)
+	}
+	writeMarkdownFields(b, meta)
+
+	for _, s := range r.Sections {
+		b.WriteString("## " + mdEscape(s.Title) + "\n\n")
+		for _, n := range s.Notes {
+			b.WriteString(mdEscape(n) + "\n\n")
+		}
+		writeMarkdownFields(b, s.Fields)
+		if s.Table != nil && len(s.Table.Columns) > 0 {
+			writeMarkdownRow(b, s.Table.Columns)
+			b.WriteString("|" + strings.Repeat(" --- |", len(s.Table.Columns)) + "\n")
+			for _, row := range s.Table.Rows {
+				writeMarkdownRow(b, row)
+			}
+			b.WriteString("\n")
+		}
+		if s.Chart != nil {
+			b.WriteString("```\n" + strings.Join(s.Chart.textLines(), "\n") + "\n```\n\n")
+		}
+	}
+	return b.Flush()
+}
+
+func writeMarkdownFields(b *bufio.Writer, fields []Field) {
+	if len(fields) == 0 {
+		return
+	}
+	for _, f := range fields {
+		b.WriteString("- **" + mdEscape(f.Name) + "**: " + mdEscape(f.Value) + "\n")
+	}
+	b.WriteString("\n")
+}
+
+func writeMarkdownRow(b *bufio.Writer, row []string) {
+	b.WriteString("|")
+	for _, v := range row {
+		b.WriteString(" " + strings.ReplaceAll(mdEscape(v), "|", `\|`) + " |")
+	}
+	b.WriteString("\n")
+}
+
+// mdEscape keeps values from being read as Markdown.
+var mdEscape = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "<", "&lt;", ">", "&gt;",
+	"[", `\[`, "]", `\]`, "\n", " ", "\r", "",
+).Replace
@@ -0,0 +1,122 @@
+package report
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// PDFs are the text rendering set in Courier on landscape A4 pages, which
+// needs no font embedding and keeps tables aligned. Lines past pdfColumns
+// characters wrap.
+const (
+	pdfWidth    = 842
+	pdfHeight   = 595
+	pdfMargin   = 36
+	pdfFontSize = 8
+	pdfLeading  = 10
+	pdfColumns  = (pdfWidth - 2*pdfMargin) * 10 / (pdfFontSize * 6) // Courier glyphs are 0.6 em wide
+	pdfLines    = (pdfHeight - 2*pdfMargin) / pdfLeading
+)
+
+// renderPDF writes r as a PDF document.
+func renderPDF(w io.Writer, r *Report) error {
+	var text bytes.Buffer
+	if err := renderText(&text, r); err != nil {
+		return err
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(text.String(), "\n"), "\n") {
+		runes := []rune(line)
+		for len(runes) > pdfColumns {
+			lines = append(lines, string(runes[:pdfColumns]))
+			runes = runes[pdfColumns:]
+		}
+		lines = append(lines, string(runes))
+	}
+	var pages [][]string
+	for len(lines) > pdfLines {
+		pages = append(pages, lines[:pdfLines])
+		lines = lines[pdfLines:]
+	}
+	pages = append(pages, lines)
+
+	p := &pdfWriter{w: bufio.NewWriter(w)}
+	p.printf("%%PDF-1.4\n")
+	// Objects 1 to 3 are the catalog, the page tree and the font, each
+	// page is followed by its content stream.
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 4+2*i)
+	}
+	p.object("<< /Type /Catalog /Pages 2 0 R >>")
+	p.object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	p.object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+	for i, page := range pages {
+		p.object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+			pdfWidth, pdfHeight, 5+2*i))
+		var content bytes.Buffer
+		fmt.Fprintf(&content, "BT\n/F1 %d Tf\n%d TL\n%d %d Td\n", pdfFontSize, pdfLeading, pdfMargin, pdfHeight-pdfMargin-pdfFontSize)
+		for _, line := range page {
+			content.WriteString("(" + pdfString(line) + ") Tj T*\n")
+		}
+		content.WriteString("ET\n")
+		p.object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", content.Len(), content.Bytes()))
+	}
+
+	xref := p.n
+	p.printf("xref\n0 %d\n0000000000 65535 f \n", len(p.offsets)+1)
+	for _, off := range p.offsets {
+		p.printf("%010d 00000 n \n", off)
+	}
+	p.printf("trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(p.offsets)+1, xref)
+	if p.err != nil {
+		return p.err
+	}
+	return p.w.Flush()
+}
+
+// pdfWriter writes numbered objects, keeping their offsets for the cross
+// reference table.
+type pdfWriter struct {
+	w       *bufio.Writer
+	n       int
+	offsets []int
+	err     error
+}
+
+func (p *pdfWriter) printf(format string, args ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(p.w, format, args...)
+	p.n += n
+	p.err = err
+}
+
+func (p *pdfWriter) object(body string) {
+	p.offsets = append(p.offsets, p.n)
+	p.printf("%d 0 obj\n%s\nendobj\n", len(p.offsets), body)
+}
+
+// pdfString escapes s as the body of a literal string in WinAnsi encoding,
+// which covers Latin-1. Other characters become question marks.
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,137 @@
+// Package report models the reports of analyses, monitors and other runs
+// as titled sections of notes, fields, tables and charts, and renders them
+// as terminal text, Markdown, self-contained HTML or PDF, so the same
+// report fits a terminal, an issue or a document.
+package report
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Report is a titled list of sections.
+type Report struct {
+	Title     string
+	Generated time.Time
+	Meta      []Field // about the whole report, such as what was analyzed
+	Sections  []Section
+}
+
+// Field is a named value.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Section holds notes, then fields, then a table, then a chart, any of
+// which may be empty.
+type Section struct {
+	Title  string
+	Notes  []string
+	Fields []Field
+	Table  *Table
+	Chart  *Chart
+}
+
+// Table is a grid of values under column headings.
+type Table struct {
+	Columns []string
+	Rows    [][]string
+}
+
+// Format is a rendering of reports.
+type Format string
+
+// Formats.
+const (
+	Text     Format = "text"
+	Markdown Format = "markdown"
+	HTML     Format = "html"
+	PDF      Format = "pdf"
+)
+
+// Formats lists the formats in their usual order.
+var Formats = []Format{Text, Markdown, HTML, PDF}
+
+var extensions = map[string]Format{
+	".txt":  Text,
+	".text": Text,
+	".md":   Markdown,
+	".html": HTML,
+	".htm":  HTML,
+	".pdf":  PDF,
+}
+
+// FormatOf returns the format of a file by its extension.
+func FormatOf(path string) (Format, bool) {
+	f, ok := extensions[strings.ToLower(filepath.Ext(path))]
+	return f, ok
+}
+
+// ParseFormat returns the format named name.
+func ParseFormat(name string) (Format, error) {
+	for _, f := range Formats {
+		if string(f) == name {
+			return f, nil
+		}
+	}
+	return "", fmt.Errorf("unknown report format %q, want %s", name, formatNames())
+}
+
+func formatNames() string {
+	names := make([]string, len(Formats))
+	for i, f := range Formats {
+		names[i] = string(f)
+	}
+	return strings.Join(names, ", ")
+}
+
+// Render writes r to w in format f.
+func Render(w io.Writer, f Format, r *Report) error {
+	switch f {
+	case Text:
+		return renderText(w, r)
+	case Markdown:
+		return renderMarkdown(w, r)
+	case HTML:
+		return renderHTML(w, r)
+	case PDF:
+		return renderPDF(w, r)
+	default:
+		return fmt.Errorf("unknown report format %q, want %s", f, formatNames())
+	}
+}
+
+// WriteFile renders r to path in the format of its extension. The file is
+// replaced at once, so readers never see half a report.
+func WriteFile(path string, r *Report) error {
+	f, ok := FormatOf(path)
+	if !ok {
+		return fmt.Errorf("report %s: unknown extension, want one of .txt, .md, .html or .pdf", path)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := Render(tmp, f, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// generated returns the time the report was generated as rendered.
+func (r *Report) generated() string {
+	if r.Generated.IsZero() {
+		return ""
+	}
+	return r.Generated.UTC().Format(time.RFC3339)
+}
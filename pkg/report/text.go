@@ -0,0 +1,65 @@
+package report
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// renderText lays r out for terminals, tables aligned in columns.
+func renderText(w io.Writer, r *Report) error {
+	b := bufio.NewWriter(w)
+	b.WriteString(r.Title + "\n")
+	b.WriteString(strings.Repeat("=", len([]rune(r.Title))) + "\n")
+	meta := r.Meta
+	if g := r.generated(); g != "" {
+		meta = append([]Field{{"generated", g}}, meta...)
+	}
+	writeFields(b, meta)
+
+	for _, s := range r.Sections {
+		b.WriteString("\n" + s.Title + "\n")
+		b.WriteString(strings.Repeat("-", len([]rune(s.Title))) + "\n")
+		for _, n := range s.Notes {
+			b.WriteString(n + "\n")
+		}
+		writeFields(b, s.Fields)
+		if s.Table != nil {
+			tw := tabwriter.NewWriter(b, 0, 0, 2, ' ', 0)
+			tw.Write([]byte(strings.Join(cleanRow(s.Table.Columns), "\t") + "\n"))
+			for _, row := range s.Table.Rows {
+				tw.Write([]byte(strings.Join(cleanRow(row), "\t") + "\n"))
+			}
+			tw.Flush()
+		}
+		if s.Chart != nil {
+			b.WriteString(strings.Join(s.Chart.textLines(), "\n") + "\n")
+		}
+	}
+	return b.Flush()
+}
+
+func writeFields(w io.Writer, fields []Field) {
+	if len(fields) == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, f := range fields {
+		tw.Write([]byte(clean(f.Name) + ":\t" + clean(f.Value) + "\n"))
+	}
+	tw.Flush()
+}
+
+// clean keeps a value on one line and out of the way of tabwriter.
+func clean(s string) string {
+	return strings.NewReplacer("\t", " ", "\n", " ", "\r", "").Replace(s)
+}
+
+func cleanRow(row []string) []string {
+	c := make([]string, len(row))
+	for i, v := range row {
+		c[i] = clean(v)
+	}
+	return c
+}
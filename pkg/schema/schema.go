@@ -0,0 +1,233 @@
+// Package schema publishes the JSON Schema documents of the JSON etherspy
+// outputs, embedded in the binary, and validates documents against them so
+// format regressions are caught before consumers break.
+//
+// Validation covers the subset of JSON Schema the documents use: type,
+// const, enum, properties, required, additionalProperties, items, minimum,
+// pattern and references to the document's own $defs.
+package schema
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//go:embed schemas/*.json
+var files embed.FS
+
+// Names lists the published schemas, sorted.
+func Names() []string {
+	entries, _ := files.ReadDir("schemas")
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, strings.TrimSuffix(e.Name(), ".json"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Get returns the schema document of the given name.
+func Get(name string) ([]byte, error) {
+	data, err := files.ReadFile(path.Join("schemas", name+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("unknown schema %q, want one of %s", name, strings.Join(Names(), "|"))
+	}
+	return data, nil
+}
+
+// Error is a violation of a schema.
+type Error struct {
+	Path string // of the offending value, such as $.fields.Nonce
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Path + ": " + e.Msg
+}
+
+// Validate checks doc against the schema of the given name, returning the
+// first violation found as an *Error.
+func Validate(name string, doc []byte) error {
+	data, err := Get(name)
+	if err != nil {
+		return err
+	}
+	var root map[string]interface{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return fmt.Errorf("invalid schema %q: %v", name, err)
+	}
+	d := json.NewDecoder(bytes.NewReader(doc))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return &Error{Path: "$", Msg: err.Error()}
+	}
+	return validate(root, root, v, "$")
+}
+
+func validate(root, s map[string]interface{}, v interface{}, at string) error {
+	if ref, ok := s["$ref"].(string); ok {
+		def, err := resolve(root, ref)
+		if err != nil {
+			return err
+		}
+		return validate(root, def, v, at)
+	}
+
+	if t, ok := s["type"]; ok {
+		types, ok := t.([]interface{})
+		if !ok {
+			types = []interface{}{t}
+		}
+		matched := false
+		for _, t := range types {
+			if is(v, t.(string)) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return &Error{Path: at, Msg: fmt.Sprintf("%s, want %v", kind(v), t)}
+		}
+	}
+	if c, ok := s["const"]; ok && !equal(v, c) {
+		return &Error{Path: at, Msg: fmt.Sprintf("%v, want %v", v, c)}
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if equal(v, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &Error{Path: at, Msg: fmt.Sprintf("%v is not one of %v", v, enum)}
+		}
+	}
+	if minimum, ok := s["minimum"].(float64); ok {
+		if n, isNum := v.(json.Number); isNum {
+			if f, _ := n.Float64(); f < minimum {
+				return &Error{Path: at, Msg: fmt.Sprintf("%s is below %v", n, minimum)}
+			}
+		}
+	}
+	if pattern, ok := s["pattern"].(string); ok {
+		if str, isStr := v.(string); isStr {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+			}
+			if !re.MatchString(str) {
+				return &Error{Path: at, Msg: fmt.Sprintf("%q does not match %s", str, pattern)}
+			}
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		props, _ := s["properties"].(map[string]interface{})
+		if required, ok := s["required"].([]interface{}); ok {
+			for _, r := range required {
+				if _, ok := v[r.(string)]; !ok {
+					return &Error{Path: at, Msg: fmt.Sprintf("missing property %q", r)}
+				}
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if p, ok := props[k].(map[string]interface{}); ok {
+				if err := validate(root, p, v[k], at+"."+k); err != nil {
+					return err
+				}
+				continue
+			}
+			switch extra := s["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					return &Error{Path: at, Msg: fmt.Sprintf("unexpected property %q", k)}
+				}
+			case map[string]interface{}:
+				if err := validate(root, extra, v[k], at+"."+k); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if items, ok := s["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := validate(root, items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// resolve follows a reference to the $defs of the root document.
+func resolve(root map[string]interface{}, ref string) (map[string]interface{}, error) {
+	name := strings.TrimPrefix(ref, "#/$defs/")
+	defs, _ := root["$defs"].(map[string]interface{})
+	def, ok := defs[name].(map[string]interface{})
+	if name == ref || !ok {
+		return nil, fmt.Errorf("unresolvable reference %q", ref)
+	}
+	return def, nil
+}
+
+// is reports whether v is of the JSON Schema type t.
+func is(v interface{}, t string) bool {
+	switch v := v.(type) {
+	case nil:
+		return t == "null"
+	case bool:
+		return t == "boolean"
+	case string:
+		return t == "string"
+	case json.Number:
+		if t == "number" {
+			return true
+		}
+		_, err := v.Int64()
+		return t == "integer" && (err == nil || !strings.ContainsAny(v.String(), ".eE"))
+	case []interface{}:
+		return t == "array"
+	case map[string]interface{}:
+		return t == "object"
+	}
+	return false
+}
+
+// kind returns the JSON Schema type of v.
+func kind(v interface{}) string {
+	for _, t := range []string{"null", "boolean", "string", "integer", "number", "array", "object"} {
+		if is(v, t) {
+			return t
+		}
+	}
+	return "unknown"
+}
+
+// equal compares a scalar document value with one of the schema, whose
+// numbers are float64.
+func equal(v, s interface{}) bool {
+	switch v := v.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return err == nil && f == s
+	case []interface{}, map[string]interface{}:
+		return false
+	}
+	return v == s
+}
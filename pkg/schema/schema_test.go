@@ -0,0 +1,31 @@
+package schema
+
+import "testing"
+
+func TestValidate(t *testing.T) {
+	const valid = `{"time":"2023-11-14T22:13:20Z","protocol":"discv4","kind":"PING","src":"10.0.0.1:30303","dst":"-","size":98,"direction":"in","fields":{}}`
+	if err := Validate("packet", []byte(valid)); err != nil {
+		t.Fatalf("valid packet: %v", err)
+	}
+	for _, test := range []struct {
+		doc, path string
+	}{
+		{`{"protocol":"discv4"}`, "$"},
+		{`{"time":1,"protocol":"discv6","kind":"PING","src":"-","dst":"-","size":98,"direction":"in","fields":null}`, "$.protocol"},
+		{`{"time":1,"protocol":"discv4","kind":"PING","src":"-","dst":"-","size":-1,"direction":"in","fields":null}`, "$.size"},
+		{`{"time":1,"protocol":"discv4","kind":"PING","src":"-","dst":"-","size":1.5,"direction":"in","fields":null}`, "$.size"},
+		{`{"time":1,"protocol":"discv4","kind":"PING","src":"-","dst":"-","size":98,"direction":"in","fields":null,"node_id":"abc"}`, "$.node_id"},
+		{`{"time":1,"protocol":"discv4","kind":"PING","src":"-","dst":"-","size":98,"direction":"in","fields":null,"src_geo":{"asn":"AS3320"}}`, "$.src_geo.asn"},
+		{`{"time":1,"protocol":"discv4","kind":"PING","src":"-","dst":"-","size":98,"direction":"in","fields":null,"extra":1}`, "$"},
+		{`{"time":true,"protocol":"discv4","kind":"PING","src":"-","dst":"-","size":98,"direction":"in","fields":null}`, "$.time"},
+		{`{"time":1,`, "$"},
+	} {
+		err := Validate("packet", []byte(test.doc))
+		if e, ok := err.(*Error); !ok || e.Path != test.path {
+			t.Errorf("%s: error %v, want one at %s", test.doc, err, test.path)
+		}
+	}
+	if _, err := Get("nope"); err == nil {
+		t.Error("got an unknown schema")
+	}
+}
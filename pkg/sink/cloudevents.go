@@ -0,0 +1,274 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Content modes of the CloudEvents HTTP binding: an event per request with
+// its attributes in ce- headers and its data as the body, an event per
+// request as a JSON object, or events batched into a JSON array.
+const (
+	CloudEventsBinary     = "binary"
+	CloudEventsStructured = "structured"
+	CloudEventsBatch      = "batch"
+)
+
+// Types of the CloudEvents emitted.
+const (
+	EventPacket = "io.etherspy.packet"
+	EventAlert  = "io.etherspy.alert"
+)
+
+// Delivery of CloudEvents: events waiting beyond cloudEventsQueue are
+// dropped, batches hold up to cloudEventsBatch events and wait at most
+// cloudEventsLinger for more.
+const (
+	cloudEventsQueue   = 4096
+	cloudEventsBatch   = 100
+	cloudEventsLinger  = time.Second
+	cloudEventsTimeout = 10 * time.Second
+)
+
+// CloudEvent is an event of the CloudEvents 1.0 specification, with JSON
+// data.
+type CloudEvent struct {
+	ID      string
+	Source  string
+	Type    string
+	Time    time.Time
+	Subject string
+	Data    json.RawMessage
+
+	// Extensions are additional attributes, such as the protocol of a
+	// packet, for event routers to filter on. Names must be lower case
+	// letters and digits.
+	Extensions map[string]string
+}
+
+// MarshalJSON encodes e in the JSON event format.
+func (e CloudEvent) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, 8+len(e.Extensions))
+	for k, v := range e.Extensions {
+		m[k] = v
+	}
+	m["specversion"] = "1.0"
+	m["id"] = e.ID
+	m["source"] = e.Source
+	m["type"] = e.Type
+	m["time"] = e.Time.UTC().Format(time.RFC3339Nano)
+	if e.Subject != "" {
+		m["subject"] = e.Subject
+	}
+	m["datacontenttype"] = "application/json"
+	m["data"] = e.Data
+	return json.Marshal(m)
+}
+
+// headers sets the attributes of e as the headers of a binary mode request.
+func (e CloudEvent) headers(h http.Header) {
+	h.Set("Content-Type", "application/json")
+	h.Set("ce-specversion", "1.0")
+	h.Set("ce-id", e.ID)
+	h.Set("ce-source", e.Source)
+	h.Set("ce-type", e.Type)
+	h.Set("ce-time", e.Time.UTC().Format(time.RFC3339Nano))
+	if e.Subject != "" {
+		h.Set("ce-subject", e.Subject)
+	}
+	for k, v := range e.Extensions {
+		h.Set("ce-"+k, v)
+	}
+}
+
+// CloudEventsConfig configures a CloudEvents sink.
+type CloudEventsConfig struct {
+	URL    string
+	Mode   string // CloudEventsBinary, CloudEventsStructured or CloudEventsBatch
+	Source string // identifies this instance, a URI reference
+	Times  TimeFormat
+
+	// OnError is called with the errors of failed deliveries, which happen
+	// in the background. It may be nil.
+	OnError func(error)
+}
+
+// CloudEvents posts packets as CloudEvents of type EventPacket to an HTTP
+// endpoint, such as a Knative broker, the sender's node ID as subject and
+// the JSON record as data. Other events, such as alerts, can be emitted
+// along. Events are delivered in the background, in order.
+type CloudEvents struct {
+	config  CloudEventsConfig
+	client  http.Client
+	prefix  string // of event IDs, unique to the sink
+	seq     uint64
+	dropped uint64
+
+	queue chan CloudEvent
+	done  sync.WaitGroup
+}
+
+func NewCloudEvents(config CloudEventsConfig) (*CloudEvents, error) {
+	if config.URL == "" || config.Source == "" {
+		return nil, fmt.Errorf("cloudevents sink needs a URL and a source")
+	}
+	switch config.Mode {
+	case "":
+		config.Mode = CloudEventsBinary
+	case CloudEventsBinary, CloudEventsStructured, CloudEventsBatch:
+	default:
+		return nil, fmt.Errorf("unknown cloudevents mode %q, want %s|%s|%s", config.Mode, CloudEventsBinary, CloudEventsStructured, CloudEventsBatch)
+	}
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	s := &CloudEvents{
+		config: config,
+		client: http.Client{Timeout: cloudEventsTimeout},
+		prefix: hex.EncodeToString(nonce[:]) + "-",
+		queue:  make(chan CloudEvent, cloudEventsQueue),
+	}
+	s.done.Add(1)
+	go s.deliver()
+	return s, nil
+}
+
+func (s *CloudEvents) Write(p DecodedPacket) error {
+	r := NewRecord(p)
+	r.Time.Format = s.config.Times
+	ext := map[string]string{"protocol": p.Protocol, "kind": p.Kind}
+	if p.Network != "" {
+		ext["network"] = p.Network
+	}
+	return s.Emit(EventPacket, r.NodeID, p.Time, r, ext)
+}
+
+// Emit queues an event of type typ about subject, with data encoded as
+// JSON.
+func (s *CloudEvents) Emit(typ, subject string, t time.Time, data interface{}, extensions map[string]string) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	e := CloudEvent{
+		ID:         s.prefix + strconv.FormatUint(atomic.AddUint64(&s.seq, 1), 10),
+		Source:     s.config.Source,
+		Type:       typ,
+		Time:       t,
+		Subject:    subject,
+		Data:       raw,
+		Extensions: extensions,
+	}
+	select {
+	case s.queue <- e:
+		return nil
+	default:
+		if atomic.AddUint64(&s.dropped, 1)%cloudEventsQueue == 1 {
+			return fmt.Errorf("cloudevents endpoint not keeping up, %d events dropped so far", atomic.LoadUint64(&s.dropped))
+		}
+		return nil
+	}
+}
+
+// deliver posts the queued events until the queue is closed.
+func (s *CloudEvents) deliver() {
+	defer s.done.Done()
+	if s.config.Mode != CloudEventsBatch {
+		for e := range s.queue {
+			s.report(s.post(e))
+		}
+		return
+	}
+	var batch []CloudEvent
+	linger := time.NewTicker(cloudEventsLinger)
+	defer linger.Stop()
+	flush := func() {
+		if len(batch) > 0 {
+			s.report(s.postBatch(batch))
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case e, ok := <-s.queue:
+			if !ok {
+				flush()
+				return
+			}
+			if batch = append(batch, e); len(batch) >= cloudEventsBatch {
+				flush()
+			}
+		case <-linger.C:
+			flush()
+		}
+	}
+}
+
+func (s *CloudEvents) report(err error) {
+	if err != nil && s.config.OnError != nil {
+		s.config.OnError(err)
+	}
+}
+
+func (s *CloudEvents) post(e CloudEvent) error {
+	var (
+		body []byte
+		err  error
+	)
+	header := make(http.Header)
+	if s.config.Mode == CloudEventsBinary {
+		body = e.Data
+		e.headers(header)
+	} else {
+		body, err = json.Marshal(e)
+		header.Set("Content-Type", "application/cloudevents+json")
+	}
+	if err != nil {
+		return err
+	}
+	return s.send(header, body, 1)
+}
+
+func (s *CloudEvents) postBatch(batch []CloudEvent) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	header := make(http.Header)
+	header.Set("Content-Type", "application/cloudevents-batch+json")
+	return s.send(header, body, len(batch))
+}
+
+func (s *CloudEvents) send(header http.Header, body []byte, n int) error {
+	req, err := http.NewRequest(http.MethodPost, s.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%d events not delivered: %w", n, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%d events not delivered: %s", n, resp.Status)
+	}
+	return nil
+}
+
+// Close delivers the queued events and stops. Events can't be emitted
+// afterwards.
+func (s *CloudEvents) Close() error {
+	close(s.queue)
+	s.done.Wait()
+	return nil
+}
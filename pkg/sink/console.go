@@ -0,0 +1,79 @@
+package sink
+
+import (
+	"fmt"
+	"github.com/davecgh/go-spew/spew"
+	"github.com/rs/zerolog"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Log dumps every decoded packet to a logger at debug level, along with its
+// capture time.
+type Log struct {
+	Logger zerolog.Logger
+	Times  TimeFormat
+}
+
+func NewLog(logger zerolog.Logger) *Log {
+	return &Log{Logger: logger}
+}
+
+func (s *Log) Write(p DecodedPacket) error {
+	e := s.Logger.Debug()
+	if !e.Enabled() {
+		return nil
+	}
+	body, err := p.Body()
+	if err != nil {
+		return err
+	}
+	e.Str("captured", s.Times.Format(p.Time)).Msgf("[%s] %s packet (%s) > %s", p.Tag(), p.Kind, p.Direction, spew.Sdump(body))
+	return nil
+}
+
+// Summary prints one line of tab separated fixed columns per packet: time,
+// protocol (prefixed with the network label, if any), kind, source,
+// destination, size and sender node ID. Unknown values are printed as "-".
+// Setting Fields prints the selected columns instead.
+type Summary struct {
+	Times  TimeFormat
+	Fields FieldSet
+
+	w io.Writer
+}
+
+func NewSummary(w io.Writer) *Summary {
+	return &Summary{w: w}
+}
+
+func (s *Summary) Write(p DecodedPacket) error {
+	if s.Fields != nil {
+		r := newRecord(p, s.Fields)
+		r.Time.Format = s.Times
+		cols := make([]string, len(s.Fields))
+		for i, name := range s.Fields {
+			cols[i] = r.text(name)
+		}
+		_, err := fmt.Fprintln(s.w, strings.Join(cols, "\t"))
+		return err
+	}
+
+	id := "-"
+	if p.NodeID != nil {
+		if v, err := p.NodeID(); err == nil && v != "" {
+			id = v
+		}
+	}
+	_, err := fmt.Fprintln(s.w, strings.Join([]string{
+		s.Times.Format(p.Time),
+		p.Tag(),
+		p.Kind,
+		p.Src,
+		p.Dst,
+		strconv.Itoa(p.Size),
+		id,
+	}, "\t"))
+	return err
+}
@@ -0,0 +1,54 @@
+package sink
+
+import (
+	"encoding/csv"
+	"io"
+)
+
+// DefaultCSVFields are the columns of a CSV sink without selected fields.
+var DefaultCSVFields = FieldSet{FieldTime, FieldNetwork, FieldProtocol, FieldKind, FieldSrc, FieldDst, FieldSize, FieldDirection, FieldNodeID}
+
+// CSV writes one row per packet, after a header row naming the columns.
+// Decoded fields are written as JSON and unknown values as "-".
+type CSV struct {
+	Times  TimeFormat
+	Fields FieldSet // DefaultCSVFields if nil
+
+	w      *csv.Writer
+	header bool
+}
+
+func NewCSV(w io.Writer) *CSV {
+	return &CSV{w: csv.NewWriter(w)}
+}
+
+func (s *CSV) Write(p DecodedPacket) error {
+	fields := s.Fields
+	if fields == nil {
+		fields = DefaultCSVFields
+	}
+	if !s.header {
+		s.header = true
+		if err := s.w.Write(fields); err != nil {
+			return err
+		}
+	}
+	r := newRecord(p, fields)
+	r.Time.Format = s.Times
+	row := make([]string, len(fields))
+	for i, name := range fields {
+		row[i] = r.text(name)
+	}
+	if err := s.w.Write(row); err != nil {
+		return err
+	}
+	// Rows are flushed as they come, so the file can be followed.
+	s.w.Flush()
+	return s.w.Error()
+}
+
+// Close flushes the rows written, leaving the underlying writer open.
+func (s *CSV) Close() error {
+	s.w.Flush()
+	return s.w.Error()
+}
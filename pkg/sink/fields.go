@@ -0,0 +1,142 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/drgomesp/etherspy/pkg/geo"
+	"strconv"
+	"strings"
+)
+
+// Names of the record fields a FieldSet selects, as keyed in JSON.
+const (
+	FieldTime      = "time"
+	FieldNetwork   = "network"
+	FieldChain     = "chain"
+	FieldProtocol  = "protocol"
+	FieldKind      = "kind"
+	FieldSrc       = "src"
+	FieldDst       = "dst"
+	FieldSrcGeo    = "src_geo"
+	FieldDstGeo    = "dst_geo"
+	FieldSize      = "size"
+	FieldDirection = "direction"
+	FieldNodeID    = "node_id"
+	FieldFields    = "fields"
+	FieldError     = "error"
+)
+
+// AllFields lists every selectable field, in the order of Record.
+var AllFields = FieldSet{FieldTime, FieldNetwork, FieldChain, FieldProtocol, FieldKind, FieldSrc, FieldDst, FieldSrcGeo, FieldDstGeo, FieldSize, FieldDirection, FieldNodeID, FieldFields, FieldError}
+
+var fieldAliases = map[string]string{
+	"proto":  FieldProtocol,
+	"nodeid": FieldNodeID,
+	"node":   FieldNodeID,
+	"body":   FieldFields,
+}
+
+// FieldSet is an ordered selection of record fields. A nil set selects the
+// default fields of each sink.
+type FieldSet []string
+
+// ParseFields parses a comma separated list of field names, such as
+// "time,src,dst,kind,nodeid". Names are case-insensitive, nodeid and node
+// stand for node_id and proto for protocol.
+func ParseFields(spec string) (FieldSet, error) {
+	var fields FieldSet
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if alias, ok := fieldAliases[name]; ok {
+			name = alias
+		}
+		if !AllFields.Has(name) {
+			return nil, fmt.Errorf("unknown field %q, want one of %s", name, strings.Join(AllFields, ","))
+		}
+		if fields.Has(name) {
+			return nil, fmt.Errorf("field %q selected twice", name)
+		}
+		fields = append(fields, name)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no fields selected")
+	}
+	return fields, nil
+}
+
+// Has reports whether name is selected.
+func (s FieldSet) Has(name string) bool {
+	for _, f := range s {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the value of the named field of r.
+func (r *Record) Get(name string) interface{} {
+	switch name {
+	case FieldTime:
+		return r.Time
+	case FieldNetwork:
+		return r.Network
+	case FieldChain:
+		return r.Chain
+	case FieldProtocol:
+		return r.Protocol
+	case FieldKind:
+		return r.Kind
+	case FieldSrc:
+		return r.Src
+	case FieldDst:
+		return r.Dst
+	case FieldSrcGeo:
+		return r.SrcGeo
+	case FieldDstGeo:
+		return r.DstGeo
+	case FieldSize:
+		return r.Size
+	case FieldDirection:
+		return r.Direction
+	case FieldNodeID:
+		return r.NodeID
+	case FieldFields:
+		return r.Fields
+	case FieldError:
+		return r.Error
+	default:
+		return nil
+	}
+}
+
+// text returns the named field of r as a column value: times in their
+// format, decoded fields as JSON and empty values as "-".
+func (r *Record) text(name string) string {
+	var s string
+	switch name {
+	case FieldTime:
+		s = r.Time.Format.Format(r.Time.Time)
+	case FieldSize:
+		s = strconv.Itoa(r.Size)
+	case FieldSrcGeo, FieldDstGeo:
+		if loc, _ := r.Get(name).(*geo.Location); loc != nil {
+			s = loc.String()
+		}
+	case FieldFields:
+		if r.Fields != nil {
+			if data, err := json.Marshal(r.Fields); err == nil {
+				s = string(data)
+			}
+		}
+	default:
+		s, _ = r.Get(name).(string)
+	}
+	if s == "" {
+		return "-"
+	}
+	return s
+}
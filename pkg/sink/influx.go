@@ -0,0 +1,285 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delivery of aggregates: batches waiting beyond influxQueue are dropped.
+const (
+	influxQueue   = 64
+	influxTimeout = 10 * time.Second
+)
+
+// InfluxConfig configures an InfluxDB sink.
+type InfluxConfig struct {
+	// URL is the write endpoint, such as
+	// http://localhost:8086/api/v2/write?org=o&bucket=b for InfluxDB 2,
+	// http://localhost:8086/write?db=d for InfluxDB 1 or the endpoint of
+	// any other receiver of line protocol, such as Telegraf or
+	// VictoriaMetrics.
+	URL string
+
+	// Token authenticates with InfluxDB 2, empty if not needed.
+	Token string
+
+	// Measurement prefixes the names of the measurements, "etherspy" if
+	// empty.
+	Measurement string
+
+	// Interval is the span aggregates are kept over, a minute if zero.
+	Interval time.Duration
+
+	// Tags are added to every point, such as the host running the capture.
+	Tags map[string]string
+
+	// OnError is called with the errors of failed deliveries, which happen
+	// in the background. It may be nil.
+	OnError func(error)
+}
+
+// influxBucket holds the aggregates of an interval.
+type influxBucket struct {
+	start      time.Time
+	kinds      map[[3]string]uint64 // by network, protocol and kind
+	peers      map[string]bool      // source addresses
+	ips        map[string]bool
+	challenges uint64
+	handshakes uint64
+	errors     map[[2]string]uint64 // by protocol and error code
+}
+
+// Influx writes per interval aggregates of the packets in InfluxDB line
+// protocol: the packets of every protocol and kind, the unique peers and
+// source IPs, the discv5 handshakes challenged and completed, and decode
+// errors reported with Failure. Intervals follow the capture times of the
+// packets, so replayed captures chart as they happened, and an interval is
+// written once a packet of a later one arrives or the sink is closed.
+// Writes are delivered in the background, in order.
+type Influx struct {
+	config  InfluxConfig
+	client  http.Client
+	prefix  string
+	tags    string // escaped, with leading comma
+	dropped uint64
+
+	mu     sync.Mutex
+	bucket *influxBucket
+
+	queue chan []byte
+	done  sync.WaitGroup
+}
+
+func NewInflux(config InfluxConfig) (*Influx, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("influx sink needs a URL")
+	}
+	if _, err := url.Parse(config.URL); err != nil {
+		return nil, fmt.Errorf("invalid influx URL: %w", err)
+	}
+	if config.Interval <= 0 {
+		config.Interval = time.Minute
+	}
+	if config.Measurement == "" {
+		config.Measurement = "etherspy"
+	}
+	keys := make([]string, 0, len(config.Tags))
+	for k := range config.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var tags strings.Builder
+	for _, k := range keys {
+		tags.WriteString("," + escapeInflux(k) + "=" + escapeInflux(config.Tags[k]))
+	}
+	s := &Influx{
+		config: config,
+		client: http.Client{Timeout: influxTimeout},
+		prefix: escapeInflux(config.Measurement) + "_",
+		tags:   tags.String(),
+		queue:  make(chan []byte, influxQueue),
+	}
+	s.done.Add(1)
+	go s.deliver()
+	return s, nil
+}
+
+func (s *Influx) Write(p DecodedPacket) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.at(p.Time)
+	b.kinds[[3]string{p.Network, p.Protocol, p.Kind}]++
+	b.peers[p.Src] = true
+	if host, _, err := net.SplitHostPort(p.Src); err == nil {
+		b.ips[host] = true
+	}
+	switch {
+	case p.Kind == "WHOAREYOU":
+		b.challenges++
+	case strings.HasPrefix(p.Kind, "HANDSHAKE"):
+		b.handshakes++
+	}
+	return err
+}
+
+// Failure accounts for a packet of protocol seen at t that failed to
+// decode with the given error code, empty if it has none.
+func (s *Influx) Failure(t time.Time, protocol, code string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := s.at(t)
+	b.errors[[2]string{protocol, code}]++
+	return err
+}
+
+// at returns the bucket of the interval of t, flushing the current one if
+// t is past it. Packets from before the current interval, as reordered by
+// capture, are counted in it.
+func (s *Influx) at(t time.Time) (*influxBucket, error) {
+	start := t.Truncate(s.config.Interval)
+	var err error
+	if s.bucket != nil && start.After(s.bucket.start) {
+		err = s.flush()
+	}
+	if s.bucket == nil {
+		s.bucket = &influxBucket{
+			start:  start,
+			kinds:  make(map[[3]string]uint64),
+			peers:  make(map[string]bool),
+			ips:    make(map[string]bool),
+			errors: make(map[[2]string]uint64),
+		}
+	}
+	return s.bucket, err
+}
+
+// flush queues the lines of the current bucket and drops it.
+func (s *Influx) flush() error {
+	b := s.bucket
+	s.bucket = nil
+	if b == nil {
+		return nil
+	}
+	ts := " " + strconv.FormatInt(b.start.UnixNano(), 10) + "\n"
+	secs := s.config.Interval.Seconds()
+	var buf bytes.Buffer
+
+	kinds := make([][3]string, 0, len(b.kinds))
+	for k := range b.kinds {
+		kinds = append(kinds, k)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		a, b := kinds[i], kinds[j]
+		for n := range a {
+			if a[n] != b[n] {
+				return a[n] < b[n]
+			}
+		}
+		return false
+	})
+	var total uint64
+	for _, k := range kinds {
+		n := b.kinds[k]
+		total += n
+		buf.WriteString(s.prefix + "packets" + s.tags)
+		if k[0] != "" {
+			buf.WriteString(",network=" + escapeInflux(k[0]))
+		}
+		fmt.Fprintf(&buf, ",protocol=%s,kind=%s count=%di,rate=%g%s", escapeInflux(k[1]), escapeInflux(k[2]), n, float64(n)/secs, ts)
+	}
+	fmt.Fprintf(&buf, "%stotals%s packets=%di,rate=%g,peers=%di,ips=%di%s",
+		s.prefix, s.tags, total, float64(total)/secs, len(b.peers), len(b.ips), ts)
+	fmt.Fprintf(&buf, "%shandshakes%s challenges=%di,completed=%di,rate=%g%s",
+		s.prefix, s.tags, b.challenges, b.handshakes, float64(b.handshakes)/secs, ts)
+
+	errs := make([][2]string, 0, len(b.errors))
+	for k := range b.errors {
+		errs = append(errs, k)
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		if errs[i][0] != errs[j][0] {
+			return errs[i][0] < errs[j][0]
+		}
+		return errs[i][1] < errs[j][1]
+	})
+	for _, k := range errs {
+		buf.WriteString(s.prefix + "errors" + s.tags + ",protocol=" + escapeInflux(k[0]))
+		if k[1] != "" {
+			buf.WriteString(",code=" + escapeInflux(k[1]))
+		}
+		fmt.Fprintf(&buf, " count=%di%s", b.errors[k], ts)
+	}
+
+	select {
+	case s.queue <- buf.Bytes():
+		return nil
+	default:
+		s.dropped++
+		return fmt.Errorf("influx endpoint not keeping up, %d intervals dropped so far", s.dropped)
+	}
+}
+
+// deliver writes the queued batches until the queue is closed.
+func (s *Influx) deliver() {
+	defer s.done.Done()
+	for body := range s.queue {
+		if err := s.send(body); err != nil && s.config.OnError != nil {
+			s.config.OnError(err)
+		}
+	}
+}
+
+func (s *Influx) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.config.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.config.Token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("aggregates not written: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("aggregates not written: %s", resp.Status)
+	}
+	return nil
+}
+
+// Close writes the current interval and the queued ones and stops.
+// Packets can't be written afterwards.
+func (s *Influx) Close() error {
+	s.mu.Lock()
+	err := s.flush()
+	s.mu.Unlock()
+	close(s.queue)
+	s.done.Wait()
+	return err
+}
+
+// escapeInflux escapes the commas, equal signs and spaces of a measurement,
+// tag key or tag value.
+func escapeInflux(s string) string {
+	if !strings.ContainsAny(s, ", =\\") {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if r == ',' || r == ' ' || r == '=' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
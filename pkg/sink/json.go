@@ -0,0 +1,177 @@
+package sink
+
+import (
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/drgomesp/etherspy/pkg/geo"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"github.com/ethereum/go-ethereum/rlp"
+	"io"
+	"reflect"
+)
+
+// Record is the object written per packet by the JSON sink.
+type Record struct {
+	Time      Timestamp     `json:"time"`
+	Network   string        `json:"network,omitempty"`
+	Chain     string        `json:"chain,omitempty"`
+	Protocol  string        `json:"protocol"`
+	Kind      string        `json:"kind"`
+	Src       string        `json:"src"`
+	Dst       string        `json:"dst"`
+	SrcGeo    *geo.Location `json:"src_geo,omitempty"`
+	DstGeo    *geo.Location `json:"dst_geo,omitempty"`
+	Size      int           `json:"size"`
+	Direction string        `json:"direction"`
+	NodeID    string        `json:"node_id,omitempty"`
+	Fields    interface{}   `json:"fields"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// NewRecord converts p to its JSON form. Byte fields of the decoded packet
+// are hex encoded; a packet that fails to decode carries the error instead
+// of fields.
+func NewRecord(p DecodedPacket) Record {
+	return newRecord(p, nil)
+}
+
+// newRecord converts p, only materializing the node ID and the decoded
+// fields if selected.
+func newRecord(p DecodedPacket, fields FieldSet) Record {
+	r := Record{
+		Time:      Timestamp{Time: p.Time},
+		Network:   p.Network,
+		Chain:     p.Chain,
+		Protocol:  p.Protocol,
+		Kind:      p.Kind,
+		Src:       p.Src,
+		Dst:       p.Dst,
+		SrcGeo:    p.SrcGeo,
+		DstGeo:    p.DstGeo,
+		Size:      p.Size,
+		Direction: p.Direction,
+	}
+	if p.NodeID != nil && (fields == nil || fields.Has(FieldNodeID)) {
+		if id, err := p.NodeID(); err == nil {
+			r.NodeID = id
+		}
+	}
+	if fields == nil || fields.Has(FieldFields) || fields.Has(FieldError) {
+		if body, err := p.Body(); err == nil {
+			r.Fields = Value(reflect.ValueOf(body), 0)
+		} else {
+			r.Error = err.Error()
+		}
+	}
+	return r
+}
+
+// marshalFields encodes the selected fields of r as a JSON object, keyed in
+// the order of selection.
+func marshalFields(r Record, fields FieldSet) ([]byte, error) {
+	b := []byte{'{'}
+	for i, name := range fields {
+		v, err := json.Marshal(r.Get(name))
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, '"')
+		b = append(b, name...)
+		b = append(b, '"', ':')
+		b = append(b, v...)
+	}
+	return append(b, '}'), nil
+}
+
+// JSON writes one JSON object per line, of every field of Record or of the
+// selected ones in order.
+type JSON struct {
+	Times  TimeFormat
+	Fields FieldSet
+
+	w io.Writer
+}
+
+func NewJSON(w io.Writer) *JSON {
+	return &JSON{w: w}
+}
+
+func (s *JSON) Write(p DecodedPacket) error {
+	r := newRecord(p, s.Fields)
+	r.Time.Format = s.Times
+	var data []byte
+	var err error
+	if s.Fields == nil {
+		data, err = json.Marshal(r)
+	} else {
+		data, err = marshalFields(r, s.Fields)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.w.Write(append(data, '\n'))
+	return err
+}
+
+var (
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	recordType        = reflect.TypeOf(enr.Record{})
+)
+
+// Value converts a decoded packet into plain values for JSON encoding:
+// structs become objects of their exported fields, byte slices hex strings
+// and ENRs their textual form.
+func Value(v reflect.Value, depth int) interface{} {
+	if depth > 16 || !v.IsValid() {
+		return nil
+	}
+	if v.Type() == recordType {
+		r := v.Interface().(enr.Record)
+		enc, err := rlp.EncodeToBytes(&r)
+		if err != nil {
+			return nil
+		}
+		return "enr:" + base64.RawURLEncoding.EncodeToString(enc)
+	}
+	if v.Type().Implements(textMarshalerType) && (v.Kind() != reflect.Ptr || !v.IsNil()) {
+		if text, err := v.Interface().(encoding.TextMarshaler).MarshalText(); err == nil {
+			return string(text)
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return Value(v.Elem(), depth+1)
+	case reflect.Struct:
+		out := make(map[string]interface{}, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Type().Field(i); f.IsExported() {
+				out[f.Name] = Value(v.Field(i), depth+1)
+			}
+		}
+		return out
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			return hex.EncodeToString(b)
+		}
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			out[i] = Value(v.Index(i), depth+1)
+		}
+		return out
+	case reflect.Map, reflect.Func, reflect.Chan:
+		return nil
+	default:
+		return v.Interface()
+	}
+}
@@ -0,0 +1,176 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv4"
+	"github.com/drgomesp/etherspy/pkg/ethereum/protocol/discv5"
+	"github.com/drgomesp/etherspy/pkg/geo"
+	"github.com/drgomesp/etherspy/pkg/schema"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"github.com/ethereum/go-ethereum/p2p/enr"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	testKeyA, _ = crypto.HexToECDSA("eef77acb6c6a6eebc5b363a475ac583ec7eccdb42b6481424c60f59aa326547f")
+	testKeyB, _ = crypto.HexToECDSA("66fb62bfbd66b9177a138c1e5cddbe4f7c30c343e94e68df8769459cb1cde628")
+)
+
+func testRecord(t *testing.T) enr.Record {
+	var r enr.Record
+	r.Set(enr.IPv4(net.IPv4(10, 0, 0, 1)))
+	r.Set(enr.UDP(30303))
+	if err := enode.SignV4(&r, testKeyA); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// v4Packets decodes a packet of every discv4 kind, as the capture does.
+func v4Packets(t *testing.T) []DecodedPacket {
+	var target discv4.NodeID
+	target[0] = 1
+	bodies := []discv4.Body{
+		&discv4.Ping{Version: 4, From: discv4.Endpoint{IP: net.IPv4(10, 0, 0, 1).To4(), UDP: 30303, TCP: 30303}, Expiration: 1700000000},
+		&discv4.Pong{To: discv4.Endpoint{IP: net.ParseIP("2001:db8::1"), UDP: 30303}, ReplyTok: make([]byte, 32), Expiration: 1700000000},
+		&discv4.FindNode{Target: target, Expiration: 1700000000},
+		&discv4.Neighbors{Nodes: []discv4.Node{{IP: net.IPv4(10, 0, 0, 3).To4(), UDP: 30303, TCP: 30303, ID: target}}, Expiration: 1700000000},
+		&discv4.ENRRequest{Expiration: 1700000000},
+		&discv4.ENRResponse{ReplyTok: make([]byte, 32), Record: testRecord(t)},
+	}
+	var packets []DecodedPacket
+	for _, body := range bodies {
+		data, _, err := discv4.Encode(testKeyA, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkt, err := discv4.Decode(data, discv4.DecodeOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, DecodedPacket{
+			Protocol: "discv4",
+			Kind:     pkt.Kind.String(),
+			Size:     len(data),
+			NodeID: func() (string, error) {
+				id, err := pkt.Sender.NodeID()
+				return id.String(), err
+			},
+			Body: func() (interface{}, error) { return pkt.Body() },
+		})
+	}
+	return packets
+}
+
+// v5Packets decodes a challenge, a handshake and a message of every discv5
+// kind sent by A to B, decrypted with the keys of B.
+func v5Packets(t *testing.T) []DecodedPacket {
+	encA, encB := discv5.NewEncoder(testKeyA), discv5.NewEncoder(testKeyB)
+	encB.Sessions.AddPrivateKey(testKeyB)
+	record := testRecord(t)
+	encA.Record = &record
+	nodeA := enode.NewV4(&testKeyA.PublicKey, net.IPv4(10, 0, 0, 1), 30303, 30303)
+	nodeB := enode.NewV4(&testKeyB.PublicKey, net.IPv4(10, 0, 0, 2), 30303, 30303)
+
+	challenge := &discv5.Whoareyou{RecordSeq: 0}
+	whoareyou, err := encB.Encode(nodeA, challenge, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire := [][]byte{whoareyou}
+	handshake, err := encA.Encode(nodeB, &discv5.Ping{ReqID: []byte{1}, ENRSeq: 1}, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wire = append(wire, handshake)
+	reqID := []byte{1, 2, 3, 4}
+	for _, msg := range []discv5.Packet{
+		&discv5.Pong{ReqID: reqID, ENRSeq: 1, ToIP: net.IPv4(10, 0, 0, 2).To4(), ToPort: 30303},
+		&discv5.FindNode{ReqID: reqID, Distances: []uint{256}},
+		&discv5.Nodes{ReqID: reqID, Total: 1, Nodes: []*enr.Record{&record}},
+		&discv5.TalkRequest{ReqID: reqID, Protocol: "test", Message: []byte{1}},
+		&discv5.TalkResponse{ReqID: reqID, Message: []byte{2}},
+		&discv5.RelayInit{Initiator: &record, Target: nodeB.ID()},
+	} {
+		data, err := encA.Encode(nodeB, msg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wire = append(wire, data)
+	}
+
+	var packets []DecodedPacket
+	for i, data := range wire {
+		dest, sessions := nodeB.ID(), encB.Sessions
+		if i == 0 {
+			dest, sessions = nodeA.ID(), encA.Sessions
+		}
+		size := len(data)
+		p, err := discv5.Decode(data, discv5.DecodeOptions{Dest: dest, Sessions: sessions})
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, DecodedPacket{
+			Protocol: "discv5",
+			Kind:     p.Name(),
+			Size:     size,
+			NodeID: func() (string, error) {
+				if id, ok := discv5.SrcID(p); ok {
+					return id.String(), nil
+				}
+				return "", nil
+			},
+			Body: func() (interface{}, error) { return p, nil },
+		})
+	}
+	return packets
+}
+
+// TestJSONSchema checks the records of the JSON sink are valid packets of
+// the published schema, whatever their protocol, kind and options.
+func TestJSONSchema(t *testing.T) {
+	loc := &geo.Location{Country: "DE", City: "Berlin", ASN: 3320, Org: "Deutsche Telekom AG"}
+	packets := append(v4Packets(t), v5Packets(t)...)
+	packets = append(packets, DecodedPacket{
+		Protocol: "discv4",
+		Kind:     "PING",
+		Body:     func() (interface{}, error) { return nil, errors.New("rlp: too few elements") },
+	})
+	for i := range packets {
+		p := &packets[i]
+		p.Time = time.Unix(1700000000, 123456789)
+		p.Src, p.Dst = "10.0.0.1:30303", "-"
+		p.Direction = []string{"in", "out", "-"}[i%3]
+		if i%2 == 0 {
+			p.Network, p.Chain = "sepolia", "sepolia"
+			p.SrcGeo, p.DstGeo = loc, &geo.Location{Country: "US"}
+		}
+	}
+
+	for _, style := range TimeStyles {
+		var buf bytes.Buffer
+		s := NewJSON(&buf)
+		s.Times = TimeFormat{Style: style}
+		for _, p := range packets {
+			if err := s.Write(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sc := bufio.NewScanner(&buf)
+		sc.Buffer(nil, 1<<20)
+		n := 0
+		for ; sc.Scan(); n++ {
+			if err := schema.Validate("packet", sc.Bytes()); err != nil {
+				t.Errorf("%s %s, time %s: %v\n%s", packets[n].Protocol, packets[n].Kind, style, err, sc.Bytes())
+			}
+		}
+		if n != len(packets) {
+			t.Errorf("time %s: %d records, want %d", style, n, len(packets))
+		}
+	}
+}
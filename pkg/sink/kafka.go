@@ -0,0 +1,85 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"time"
+)
+
+// Encodings of the Kafka sink.
+const (
+	EncodingJSON     = "json"
+	EncodingProtobuf = "protobuf"
+)
+
+// KafkaConfig configures a Kafka sink.
+type KafkaConfig struct {
+	Brokers  []string
+	Topic    string
+	Encoding string // EncodingJSON or EncodingProtobuf
+	Times    TimeFormat
+
+	// OnError is called with the errors of failed deliveries, which happen
+	// in the background. It may be nil.
+	OnError func(error)
+}
+
+// Kafka publishes packets to a Kafka topic, one message per packet keyed by
+// the sender's node ID, so the packets of a node land on one partition.
+// Packets without a known sender are spread over partitions. Messages are
+// delivered in batches in the background.
+type Kafka struct {
+	w      *kafka.Writer
+	encode func(Record) ([]byte, error)
+	times  TimeFormat
+}
+
+func NewKafka(config KafkaConfig) (*Kafka, error) {
+	if len(config.Brokers) == 0 || config.Topic == "" {
+		return nil, fmt.Errorf("kafka sink needs brokers and a topic")
+	}
+	s := &Kafka{times: config.Times}
+	switch config.Encoding {
+	case "", EncodingJSON:
+		s.encode = func(r Record) ([]byte, error) { return json.Marshal(r) }
+	case EncodingProtobuf:
+		s.encode = MarshalProto
+	default:
+		return nil, fmt.Errorf("unknown kafka encoding %q, want %s|%s", config.Encoding, EncodingJSON, EncodingProtobuf)
+	}
+	s.w = &kafka.Writer{
+		Addr:         kafka.TCP(config.Brokers...),
+		Topic:        config.Topic,
+		Balancer:     &kafka.Hash{},
+		BatchTimeout: 100 * time.Millisecond,
+		RequiredAcks: kafka.RequireOne,
+		Async:        true,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil && config.OnError != nil {
+				config.OnError(fmt.Errorf("%d messages not delivered to kafka: %w", len(messages), err))
+			}
+		},
+	}
+	return s, nil
+}
+
+func (s *Kafka) Write(p DecodedPacket) error {
+	r := NewRecord(p)
+	r.Time.Format = s.times
+	value, err := s.encode(r)
+	if err != nil {
+		return err
+	}
+	var key []byte
+	if r.NodeID != "" {
+		key = []byte(r.NodeID)
+	}
+	return s.w.WriteMessages(context.Background(), kafka.Message{Key: key, Value: value})
+}
+
+// Close delivers the pending messages and closes the connections.
+func (s *Kafka) Close() error {
+	return s.w.Close()
+}
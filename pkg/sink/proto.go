@@ -0,0 +1,98 @@
+package sink
+
+import (
+	"encoding/json"
+	"github.com/drgomesp/etherspy/pkg/geo"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// PacketProto is the protobuf schema of the records MarshalProto encodes.
+// Decoded fields are carried as JSON, their shape depends on the packet
+// kind.
+const PacketProto = `syntax = "proto3";
+
+package etherspy;
+
+message Packet {
+  int64  time_unix_nano = 1;
+  string network        = 2;
+  string protocol       = 3;
+  string kind           = 4;
+  string src            = 5;
+  string dst            = 6;
+  uint32 size           = 7;
+  string direction      = 8;
+  string node_id        = 9;
+  string fields_json    = 10;
+  string error          = 11;
+  string chain          = 12;
+  Location src_geo      = 13;
+  Location dst_geo      = 14;
+}
+
+message Location {
+  string country = 1;
+  string city    = 2;
+  uint32 asn     = 3;
+  string org     = 4;
+}
+`
+
+// MarshalProto encodes r as an etherspy.Packet protobuf message.
+func MarshalProto(r Record) ([]byte, error) {
+	var fields []byte
+	if r.Fields != nil {
+		var err error
+		if fields, err = json.Marshal(r.Fields); err != nil {
+			return nil, err
+		}
+	}
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(r.Time.UnixNano()))
+	for _, f := range []struct {
+		num protowire.Number
+		s   string
+	}{{2, r.Network}, {3, r.Protocol}, {4, r.Kind}, {5, r.Src}, {6, r.Dst}} {
+		b = appendString(b, f.num, f.s)
+	}
+	if r.Size != 0 {
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(r.Size))
+	}
+	b = appendString(b, 8, r.Direction)
+	b = appendString(b, 9, r.NodeID)
+	b = appendString(b, 10, string(fields))
+	b = appendString(b, 11, r.Error)
+	b = appendString(b, 12, r.Chain)
+	b = appendLocation(b, 13, r.SrcGeo)
+	b = appendLocation(b, 14, r.DstGeo)
+	return b, nil
+}
+
+// appendLocation appends a Location message, omitted when unknown.
+func appendLocation(b []byte, num protowire.Number, l *geo.Location) []byte {
+	if l == nil {
+		return b
+	}
+	var m []byte
+	m = appendString(m, 1, l.Country)
+	m = appendString(m, 2, l.City)
+	if l.ASN != 0 {
+		m = protowire.AppendTag(m, 3, protowire.VarintType)
+		m = protowire.AppendVarint(m, uint64(l.ASN))
+	}
+	m = appendString(m, 4, l.Org)
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+// appendString appends a string field, omitted when empty as proto3 does.
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
@@ -0,0 +1,55 @@
+package sink
+
+import "sync"
+
+// Recent keeps the last packets written to it in their JSON form, for
+// queries while a capture runs. It is safe for concurrent use.
+type Recent struct {
+	Times TimeFormat
+
+	mu      sync.Mutex
+	records []Record // ring, next is the oldest once full
+	next    int
+	full    bool
+}
+
+// NewRecent keeps up to size packets.
+func NewRecent(size int) *Recent {
+	return &Recent{records: make([]Record, size)}
+}
+
+// Write converts p right away, since its node ID and fields can't be
+// materialized once the packet buffer is reused.
+func (s *Recent) Write(p DecodedPacket) error {
+	r := NewRecord(p)
+	r.Time.Format = s.Times
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[s.next] = r
+	s.next++
+	if s.next == len(s.records) {
+		s.next, s.full = 0, true
+	}
+	return nil
+}
+
+// Records returns up to limit of the packets kept, the most recent first.
+// A limit of zero or less returns all of them.
+func (s *Recent) Records(limit int) []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.next
+	if s.full {
+		n = len(s.records)
+	}
+	if limit <= 0 || limit > n {
+		limit = n
+	}
+	out := make([]Record, 0, limit)
+	for i := 1; i <= limit; i++ {
+		out = append(out, s.records[(s.next-i+len(s.records))%len(s.records)])
+	}
+	return out
+}
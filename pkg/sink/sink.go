@@ -0,0 +1,98 @@
+// Package sink writes decoded packets out. A Sink receives every packet
+// that passed the command's filters; the built-in ones print to a console,
+// write JSON lines or rotate files, and programs embedding the decoders can
+// add their own.
+package sink
+
+import (
+	"errors"
+	"github.com/drgomesp/etherspy/pkg/geo"
+	"io"
+	"time"
+)
+
+// DecodedPacket describes a decoded packet along with its capture metadata.
+type DecodedPacket struct {
+	Time     time.Time
+	Protocol string
+	Kind     string
+	Src, Dst string
+	Size     int
+
+	// SrcGeo and DstGeo locate the source and destination addresses, with
+	// GeoIP databases, nil if unknown.
+	SrcGeo, DstGeo *geo.Location
+
+	// Network is the label of the monitored network the packet belongs to,
+	// empty when a single network is monitored.
+	Network string
+
+	// Chain is the Ethereum network the sender was classified to by the
+	// fork ID of its record, such as "mainnet", empty if unknown.
+	Chain string
+
+	// Direction is whether the local node received ("in") or sent ("out")
+	// the packet, "-" if unknown.
+	Direction string
+
+	// NodeID and Body materialize the sender's node ID and the decoded
+	// packet on demand, sinks that don't print them never pay for them.
+	// NodeID may be nil when the protocol does not identify senders.
+	NodeID func() (string, error)
+	Body   func() (interface{}, error)
+}
+
+// Tag returns the protocol qualified with the network label, if any, as
+// console sinks print it.
+func (p DecodedPacket) Tag() string {
+	if p.Network == "" {
+		return p.Protocol
+	}
+	return p.Network + "/" + p.Protocol
+}
+
+// Sink is the destination of decoded packets.
+type Sink interface {
+	Write(DecodedPacket) error
+}
+
+// Multi writes every packet to all of its sinks, in order. Errors don't stop
+// the remaining sinks from being written to.
+type Multi []Sink
+
+func (m Multi) Write(p DecodedPacket) error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Write(p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return join(errs)
+}
+
+// Close closes the sinks that implement io.Closer.
+func (m Multi) Close() error {
+	var errs []error
+	for _, s := range m {
+		if c, ok := s.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return join(errs)
+}
+
+func join(errs []error) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	msg := errs[0].Error()
+	for _, err := range errs[1:] {
+		msg += "; " + err.Error()
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,70 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Time styles of a TimeFormat.
+const (
+	TimeRFC3339 = "rfc3339"  // 2006-01-02T15:04:05.999999999Z07:00
+	TimeEpoch   = "epoch"    // seconds since the Unix epoch, with nanoseconds
+	TimeEpochMs = "epoch-ms" // whole milliseconds since the Unix epoch
+)
+
+// TimeStyles lists the styles accepted by ParseTimeFormat.
+var TimeStyles = []string{TimeRFC3339, TimeEpoch, TimeEpochMs}
+
+// TimeFormat renders packet times. The zero value renders RFC 3339 times
+// in UTC.
+type TimeFormat struct {
+	Style    string
+	Location *time.Location // nil for UTC
+}
+
+// ParseTimeFormat returns the format of the given style in the time zone
+// zone, either "UTC", "Local" or an IANA name such as "Europe/Berlin".
+func ParseTimeFormat(style, zone string) (TimeFormat, error) {
+	switch style {
+	case "", TimeRFC3339, TimeEpoch, TimeEpochMs:
+	default:
+		return TimeFormat{}, fmt.Errorf("unknown time format %q, want one of %s", style, strings.Join(TimeStyles, "|"))
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		return TimeFormat{}, fmt.Errorf("unknown time zone %q: %v", zone, err)
+	}
+	return TimeFormat{Style: style, Location: loc}, nil
+}
+
+// Format renders t as text.
+func (f TimeFormat) Format(t time.Time) string {
+	switch f.Style {
+	case TimeEpoch:
+		return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+	case TimeEpochMs:
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	default:
+		if f.Location == nil {
+			return t.UTC().Format(time.RFC3339Nano)
+		}
+		return t.In(f.Location).Format(time.RFC3339Nano)
+	}
+}
+
+// Timestamp is a time rendered in JSON as its format dictates: a string in
+// RFC 3339 and a number since the epoch otherwise.
+type Timestamp struct {
+	time.Time
+	Format TimeFormat
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	if t.Format.Style == TimeEpoch || t.Format.Style == TimeEpochMs {
+		return []byte(t.Format.Format(t.Time)), nil
+	}
+	return json.Marshal(t.Format.Format(t.Time))
+}
@@ -0,0 +1,147 @@
+// Package snapshot renders analyzer state as canonical JSON and diffs two
+// such snapshots, so the outcome of processing a capture can be asserted on.
+package snapshot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// Canonical encodes v as canonical JSON: object keys sorted, two space
+// indentation and a trailing newline. Equal states always produce identical
+// bytes.
+func Canonical(v interface{}) ([]byte, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	// Round trip through generic values so struct field order does not
+	// leak into the output.
+	var generic interface{}
+	if err := decode(raw, &generic); err != nil {
+		return nil, err
+	}
+	out, err := json.MarshalIndent(generic, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+func decode(data []byte, v *interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// Write writes the canonical encoding of v to path.
+func Write(path string, v interface{}) error {
+	data, err := Canonical(v)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// Change is a single difference between two snapshots. Old is nil for added
+// values and New is nil for removed ones.
+type Change struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+func (c Change) String() string {
+	switch {
+	case c.Old == nil:
+		return fmt.Sprintf("+ %s: %v", c.Path, c.New)
+	case c.New == nil:
+		return fmt.Sprintf("- %s: %v", c.Path, c.Old)
+	default:
+		return fmt.Sprintf("~ %s: %v -> %v", c.Path, c.Old, c.New)
+	}
+}
+
+// Diff returns the changes needed to turn snapshot a into snapshot b, both
+// given as JSON documents, ordered by path.
+func Diff(a, b []byte) ([]Change, error) {
+	var va, vb interface{}
+	if err := decode(a, &va); err != nil {
+		return nil, fmt.Errorf("decoding old snapshot: %w", err)
+	}
+	if err := decode(b, &vb); err != nil {
+		return nil, fmt.Errorf("decoding new snapshot: %w", err)
+	}
+	var changes []Change
+	diff("", va, vb, &changes)
+	return changes, nil
+}
+
+// DiffReaders is like Diff but reads both snapshots from r1 and r2.
+func DiffReaders(r1, r2 io.Reader) ([]Change, error) {
+	a, err := io.ReadAll(r1)
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(r2)
+	if err != nil {
+		return nil, err
+	}
+	return Diff(a, b)
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func diff(path string, a, b interface{}, changes *[]Change) {
+	switch va := a.(type) {
+	case map[string]interface{}:
+		vb, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(va)+len(vb))
+		for k := range va {
+			keys = append(keys, k)
+		}
+		for k := range vb {
+			if _, ok := va[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			diff(join(path, k), va[k], vb[k], changes)
+		}
+		return
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < len(va) || i < len(vb); i++ {
+			var ea, eb interface{}
+			if i < len(va) {
+				ea = va[i]
+			}
+			if i < len(vb) {
+				eb = vb[i]
+			}
+			diff(path+"["+strconv.Itoa(i)+"]", ea, eb, changes)
+		}
+		return
+	}
+	if !reflect.DeepEqual(a, b) {
+		*changes = append(*changes, Change{Path: path, Old: a, New: b})
+	}
+}
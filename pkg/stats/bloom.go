@@ -0,0 +1,177 @@
+package stats
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// bloomMagic starts filter files. Files of the first version hashed keys
+// differently and can't be read.
+var bloomMagic = [8]byte{'e', 's', 'b', 'l', 'o', 'o', 'm', '2'}
+
+// Bloom is a bloom filter answering "has this key ever been added?" with a
+// bounded false positive rate and no false negatives. It can be persisted to
+// disk so the answer holds across restarts.
+type Bloom struct {
+	mu    sync.Mutex
+	bits  []uint64
+	m     uint64 // number of bits
+	k     uint64 // number of hash functions
+	count uint64 // number of distinct keys added (approximate)
+}
+
+// NewBloom sizes a filter for capacity keys at the given false positive rate.
+func NewBloom(capacity uint64, fpRate float64) *Bloom {
+	if capacity == 0 {
+		capacity = 1
+	}
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(capacity)*math.Ln2)))
+	m = (m + 63) &^ 63
+	return &Bloom{bits: make([]uint64, m/64), m: m, k: k}
+}
+
+// positions derives the k bit positions of key by double hashing.
+func (b *Bloom) positions(key []byte, f func(pos uint64) bool) {
+	h := fnv.New128a()
+	h.Write(key)
+	sum := h.Sum(nil)
+	// Keys differing in their last bytes differ in few bits of the FNV
+	// hash, both halves are finished as in hash64.
+	h1 := mix64(binary.BigEndian.Uint64(sum[:8]))
+	h2 := mix64(binary.BigEndian.Uint64(sum[8:])) | 1
+	for i := uint64(0); i < b.k; i++ {
+		if !f((h1 + i*h2) % b.m) {
+			return
+		}
+	}
+}
+
+// Contains reports whether key has probably been added before.
+func (b *Bloom) Contains(key []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	found := true
+	b.positions(key, func(pos uint64) bool {
+		found = b.bits[pos/64]&(1<<(pos%64)) != 0
+		return found
+	})
+	return found
+}
+
+// Add inserts key and reports whether it was new, i.e. not already contained.
+func (b *Bloom) Add(key []byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	added := false
+	b.positions(key, func(pos uint64) bool {
+		if b.bits[pos/64]&(1<<(pos%64)) == 0 {
+			b.bits[pos/64] |= 1 << (pos % 64)
+			added = true
+		}
+		return true
+	})
+	if added {
+		b.count++
+	}
+	return added
+}
+
+// Count returns the approximate number of distinct keys added.
+func (b *Bloom) Count() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.count
+}
+
+// FalsePositiveRate estimates the current false positive rate.
+func (b *Bloom) FalsePositiveRate() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return math.Pow(1-math.Exp(-float64(b.k*b.count)/float64(b.m)), float64(b.k))
+}
+
+// WriteTo serializes the filter.
+func (b *Bloom) WriteTo(w io.Writer) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	header := struct {
+		Magic       [8]byte
+		M, K, Count uint64
+	}{bloomMagic, b.m, b.k, b.count}
+	if err := binary.Write(bw, binary.LittleEndian, header); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(bw, binary.LittleEndian, b.bits); err != nil {
+		return 0, err
+	}
+	return int64(binary.Size(header) + 8*len(b.bits)), bw.Flush()
+}
+
+// ReadBloom deserializes a filter written with WriteTo.
+func ReadBloom(r io.Reader) (*Bloom, error) {
+	var header struct {
+		Magic       [8]byte
+		M, K, Count uint64
+	}
+	br := bufio.NewReader(r)
+	if err := binary.Read(br, binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Magic == [8]byte{'e', 's', 'b', 'l', 'o', 'o', 'm', '1'} {
+		return nil, errors.New("bloom filter file of an older version, remove it to start anew")
+	}
+	if header.Magic != bloomMagic {
+		return nil, errors.New("not a bloom filter file")
+	}
+	if header.M == 0 || header.M%64 != 0 || header.K == 0 {
+		return nil, fmt.Errorf("invalid bloom filter parameters m=%d k=%d", header.M, header.K)
+	}
+	b := &Bloom{bits: make([]uint64, header.M/64), m: header.M, k: header.K, count: header.Count}
+	if err := binary.Read(br, binary.LittleEndian, b.bits); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// LoadBloom reads the filter stored at path, or creates a new one sized for
+// capacity keys at fpRate if the file does not exist yet.
+func LoadBloom(path string, capacity uint64, fpRate float64) (*Bloom, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return NewBloom(capacity, fpRate), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadBloom(f)
+}
+
+// Save atomically writes the filter to path.
+func (b *Bloom) Save(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := b.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,142 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func testKeys(prefix string, n int) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("%s-%d", prefix, i))
+	}
+	return keys
+}
+
+func TestBloom(t *testing.T) {
+	tests := []struct {
+		capacity uint64
+		fpRate   float64
+		added    int
+	}{
+		{1000, 0.01, 1000},
+		{10000, 0.001, 10000},
+		{10000, 0.01, 5000},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d@%g", tt.capacity, tt.fpRate), func(t *testing.T) {
+			b := NewBloom(tt.capacity, tt.fpRate)
+			added := testKeys("added", tt.added)
+			for _, key := range added {
+				b.Add(key)
+			}
+			for _, key := range added {
+				if !b.Contains(key) {
+					t.Fatalf("false negative for %s", key)
+				}
+				if b.Add(key) {
+					t.Fatalf("%s added twice", key)
+				}
+			}
+			if c := b.Count(); c > uint64(tt.added) || c < uint64(tt.added)*99/100 {
+				t.Errorf("count %d, want about %d", c, tt.added)
+			}
+
+			var fp int
+			others := testKeys("other", 10000)
+			for _, key := range others {
+				if b.Contains(key) {
+					fp++
+				}
+			}
+			if rate := float64(fp) / float64(len(others)); rate > 2*tt.fpRate {
+				t.Errorf("false positive rate %g, want about %g", rate, tt.fpRate)
+			}
+			if est := b.FalsePositiveRate(); est > 2*tt.fpRate {
+				t.Errorf("estimated false positive rate %g, want about %g", est, tt.fpRate)
+			}
+		})
+	}
+}
+
+func TestBloomRoundTrip(t *testing.T) {
+	b := NewBloom(1000, 0.01)
+	keys := testKeys("key", 500)
+	for _, key := range keys {
+		b.Add(key)
+	}
+
+	var buf bytes.Buffer
+	n, err := b.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("wrote %d bytes, reported %d", buf.Len(), n)
+	}
+	read, err := ReadBloom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.m != b.m || read.k != b.k || read.Count() != b.Count() {
+		t.Errorf("read m=%d k=%d count=%d, want m=%d k=%d count=%d", read.m, read.k, read.Count(), b.m, b.k, b.Count())
+	}
+	for _, key := range keys {
+		if !read.Contains(key) {
+			t.Fatalf("read filter lost %s", key)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "seen.bloom")
+	fresh, err := LoadBloom(path, 1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh.Count() != 0 {
+		t.Errorf("missing file loaded with count %d", fresh.Count())
+	}
+	if err := b.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadBloom(path, 1, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.m != b.m || loaded.Count() != b.Count() || !loaded.Contains(keys[0]) {
+		t.Errorf("loaded m=%d count=%d, want the saved filter", loaded.m, loaded.Count())
+	}
+}
+
+func TestReadBloomBadHeader(t *testing.T) {
+	header := func(magic [8]byte, m, k uint64, bits int) []byte {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, magic)
+		binary.Write(&buf, binary.LittleEndian, []uint64{m, k, 0})
+		buf.Write(make([]byte, bits))
+		return buf.Bytes()
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated header", header(bloomMagic, 64, 3, 0)[:20]},
+		{"older version", header([8]byte{'e', 's', 'b', 'l', 'o', 'o', 'm', '1'}, 64, 3, 8)},
+		{"bad magic", header([8]byte{'n', 'o', 't', 'b', 'l', 'o', 'o', 'm'}, 64, 3, 8)},
+		{"no bits", header(bloomMagic, 0, 3, 0)},
+		{"unaligned bits", header(bloomMagic, 100, 3, 16)},
+		{"no hashes", header(bloomMagic, 64, 0, 8)},
+		{"truncated bits", header(bloomMagic, 128, 3, 8)},
+	}
+	for _, tt := range tests {
+		if _, err := ReadBloom(bytes.NewReader(tt.data)); err == nil {
+			t.Errorf("%s: read without error", tt.name)
+		}
+	}
+	if _, err := ReadBloom(bytes.NewReader(header(bloomMagic, 64, 3, 8))); err != nil {
+		t.Errorf("valid filter: %v", err)
+	}
+}
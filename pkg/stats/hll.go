@@ -0,0 +1,215 @@
+package stats
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// hllPrecision gives 4096 registers, a 4KB sketch with a standard error of
+// about 1.6%.
+const (
+	hllPrecision = 12
+	hllRegisters = 1 << hllPrecision
+)
+
+// HLL is a HyperLogLog sketch estimating the number of distinct keys added.
+type HLL struct {
+	registers [hllRegisters]uint8
+}
+
+func hash64(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	// FNV mixes the low bits poorly on short inputs, finish with the
+	// splitmix64 finalizer.
+	return mix64(h.Sum64())
+}
+
+// mix64 is the splitmix64 finalizer, spreading every bit of x over all of
+// the result.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Add inserts key into the sketch.
+func (h *HLL) Add(key []byte) {
+	x := hash64(key)
+	idx := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+// Merge folds other into h, so h estimates the union of both.
+func (h *HLL) Merge(other *HLL) {
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+}
+
+// Estimate returns the approximate number of distinct keys added. It uses
+// the improved estimator of Ertl ("New cardinality estimation algorithms for
+// HyperLogLog sketches", 2017), which needs neither the small range
+// correction of the original nor its bias, largest around 2.5 times the
+// number of registers.
+func (h *HLL) Estimate() uint64 {
+	const q = 64 - hllPrecision // highest rank is q+1
+	var counts [q + 2]int
+	for _, r := range h.registers {
+		counts[r]++
+	}
+	m := float64(hllRegisters)
+	z := m * hllTau(1-float64(counts[q+1])/m)
+	for k := q; k >= 1; k-- {
+		z = 0.5 * (z + float64(counts[k]))
+	}
+	z += m * hllSigma(float64(counts[0])/m)
+	return uint64(m*m/(2*math.Ln2*z) + 0.5)
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if z == prev {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if z == prev {
+			return z / 3
+		}
+	}
+}
+
+// SlidingHLL estimates distinct keys over a sliding time window, kept as a
+// ring of per-interval sketches.
+type SlidingHLL struct {
+	mu         sync.Mutex
+	resolution time.Duration
+	buckets    []HLL
+	starts     []time.Time
+}
+
+// NewSlidingHLL covers a window of n intervals of the given resolution.
+func NewSlidingHLL(resolution time.Duration, n int) *SlidingHLL {
+	return &SlidingHLL{
+		resolution: resolution,
+		buckets:    make([]HLL, n),
+		starts:     make([]time.Time, n),
+	}
+}
+
+// bucket returns the sketch for time t, or nil if t is older than the ring
+// covers.
+func (s *SlidingHLL) bucket(t time.Time) *HLL {
+	start := t.Truncate(s.resolution)
+	i := int(start.UnixNano()/int64(s.resolution)) % len(s.buckets)
+	if s.starts[i].After(start) {
+		return nil
+	}
+	if !s.starts[i].Equal(start) {
+		s.buckets[i] = HLL{}
+		s.starts[i] = start
+	}
+	return &s.buckets[i]
+}
+
+// Add records key as seen at time t.
+func (s *SlidingHLL) Add(t time.Time, key []byte) {
+	s.mu.Lock()
+	if b := s.bucket(t); b != nil {
+		b.Add(key)
+	}
+	s.mu.Unlock()
+}
+
+// Estimate returns the approximate number of distinct keys seen within
+// window before now. The window is rounded up to the sketch resolution and
+// capped to what the ring covers.
+func (s *SlidingHLL) Estimate(now time.Time, window time.Duration) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var union HLL
+	oldest := oldestBucket(now, window, s.resolution)
+	for i := range s.buckets {
+		if s.starts[i].IsZero() || s.starts[i].Before(oldest) || s.starts[i].After(now) {
+			continue
+		}
+		union.Merge(&s.buckets[i])
+	}
+	return union.Estimate()
+}
+
+// oldestBucket returns the start of the oldest bucket of the given
+// resolution within window before now, the window rounded up to the
+// resolution.
+func oldestBucket(now time.Time, window, resolution time.Duration) time.Time {
+	n := (window + resolution - 1) / resolution
+	if n < 1 {
+		n = 1
+	}
+	return now.Truncate(resolution).Add(-(n - 1) * resolution)
+}
+
+// Windows at which cardinalities are reported.
+var CardinalityWindows = []time.Duration{time.Minute, time.Hour, 24 * time.Hour}
+
+// Cardinality estimates distinct keys over the 1m, 1h and 24h windows with
+// bounded memory: minute sketches serve the first two, hour sketches the
+// last.
+type Cardinality struct {
+	minutes *SlidingHLL
+	hours   *SlidingHLL
+}
+
+func NewCardinality() *Cardinality {
+	return &Cardinality{
+		minutes: NewSlidingHLL(time.Minute, 60),
+		hours:   NewSlidingHLL(time.Hour, 24),
+	}
+}
+
+// Add records key as seen at time t.
+func (c *Cardinality) Add(t time.Time, key []byte) {
+	c.minutes.Add(t, key)
+	c.hours.Add(t, key)
+}
+
+// Estimate returns the approximate number of distinct keys seen within
+// window before now.
+func (c *Cardinality) Estimate(now time.Time, window time.Duration) uint64 {
+	if window <= time.Hour {
+		return c.minutes.Estimate(now, window)
+	}
+	return c.hours.Estimate(now, window)
+}
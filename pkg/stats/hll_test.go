@@ -0,0 +1,104 @@
+package stats
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHLLEstimate(t *testing.T) {
+	for _, n := range []int{10, 1000, 10000, 100000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			var h HLL
+			for _, key := range testKeys("node", n) {
+				h.Add(key)
+				h.Add(key)
+			}
+			if err := math.Abs(float64(h.Estimate())-float64(n)) / float64(n); err > 0.02 {
+				t.Errorf("estimate %d, off by %.1f%% of %d", h.Estimate(), err*100, n)
+			}
+		})
+	}
+}
+
+func TestHLLMerge(t *testing.T) {
+	var a, b, union HLL
+	for _, key := range testKeys("a", 5000) {
+		a.Add(key)
+		union.Add(key)
+	}
+	for _, key := range testKeys("b", 5000) {
+		b.Add(key)
+		union.Add(key)
+	}
+	a.Merge(&b)
+	if a.Estimate() != union.Estimate() {
+		t.Errorf("merged estimate %d, want %d", a.Estimate(), union.Estimate())
+	}
+}
+
+func TestSlidingHLL(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewSlidingHLL(time.Minute, 5)
+	for _, key := range testKeys("first", 1000) {
+		s.Add(t0, key)
+	}
+	for _, key := range testKeys("later", 1000) {
+		s.Add(t0.Add(3*time.Minute), key)
+	}
+
+	tests := []struct {
+		name   string
+		now    time.Duration // after t0
+		window time.Duration
+		want   uint64
+	}{
+		{"both minutes", 3 * time.Minute, 5 * time.Minute, 2000},
+		{"last minute", 3 * time.Minute, time.Minute, 1000},
+		{"within the minute", 3*time.Minute + 30*time.Second, time.Second, 1000},
+		{"before the later keys", 2 * time.Minute, 5 * time.Minute, 1000},
+		{"first minute at the edge", 4 * time.Minute, 5 * time.Minute, 2000},
+		{"first minute expired", 5 * time.Minute, 5 * time.Minute, 1000},
+		{"beyond the ring", 3 * time.Minute, time.Hour, 2000},
+		{"all expired", 8 * time.Minute, 5 * time.Minute, 0},
+	}
+	for _, tt := range tests {
+		got := s.Estimate(t0.Add(tt.now), tt.window)
+		if math.Abs(float64(got)-float64(tt.want)) > 0.02*float64(tt.want) {
+			t.Errorf("%s: estimate %d, want about %d", tt.name, got, tt.want)
+		}
+	}
+
+	// The slot of the first minute is reused five minutes later, keys
+	// arriving late for it are dropped.
+	s.Add(t0.Add(5*time.Minute), []byte("new"))
+	s.Add(t0, []byte("late"))
+	if got := s.Estimate(t0.Add(5*time.Minute), time.Minute); got != 1 {
+		t.Errorf("estimate of the reused slot %d, want 1", got)
+	}
+}
+
+func TestCardinality(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewCardinality()
+	for i, key := range testKeys("node", 3000) {
+		// A thousand keys at t0, 2h and 2h30m.
+		c.Add(t0.Add(time.Duration(i/1000)*time.Hour+time.Duration(i/2000)*30*time.Minute), key)
+	}
+	now := t0.Add(150 * time.Minute)
+	for _, tt := range []struct {
+		window time.Duration
+		want   uint64
+	}{
+		{time.Minute, 1000},
+		{time.Hour, 1000},
+		{2 * time.Hour, 2000},
+		{24 * time.Hour, 3000},
+	} {
+		got := c.Estimate(now, tt.window)
+		if math.Abs(float64(got)-float64(tt.want)) > 0.02*float64(tt.want) {
+			t.Errorf("%s: estimate %d, want about %d", tt.window, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Package stats implements the aggregate statistics kept by etherspy while
+// processing a capture.
+package stats
+
+import (
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// Stage identifies a step of the per-packet processing path.
+type Stage int
+
+const (
+	StageCapture Stage = iota // waiting for the capture handle to deliver a packet
+	StageParse                // link/network/transport layer parsing
+	StageDecode               // protocol decoding
+	StageEnrich               // enrichment of decoded packets
+	StageSink                 // writing the result to the output
+	numStages
+)
+
+func (s Stage) String() string {
+	switch s {
+	case StageCapture:
+		return "capture"
+	case StageParse:
+		return "parse"
+	case StageDecode:
+		return "decode"
+	case StageEnrich:
+		return "enrich"
+	case StageSink:
+		return "sink"
+	default:
+		return "unknown"
+	}
+}
+
+// Stages returns all known stages in processing order.
+func Stages() []Stage {
+	s := make([]Stage, numStages)
+	for i := range s {
+		s[i] = Stage(i)
+	}
+	return s
+}
+
+// Each power of two is split into this many linear sub-buckets, which bounds
+// the relative error of reported quantiles to roughly 1/subBuckets.
+const (
+	subBucketBits = 3
+	subBuckets    = 1 << subBucketBits
+)
+
+// Histogram is a log-linear histogram of durations with nanosecond
+// resolution and constant memory.
+type Histogram struct {
+	mu     sync.Mutex
+	counts [64 * subBuckets]uint64
+	n      uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+func bucketOf(d time.Duration) int {
+	v := uint64(d)
+	if v < subBuckets {
+		return int(v)
+	}
+	exp := bits.Len64(v) - 1 - subBucketBits
+	return (exp+1)*subBuckets + int(v>>uint(exp))&(subBuckets-1)
+}
+
+// bucketUpper returns the largest duration that falls into bucket b.
+func bucketUpper(b int) time.Duration {
+	if b < subBuckets {
+		return time.Duration(b)
+	}
+	exp := b/subBuckets - 1
+	base := uint64(subBuckets+b%subBuckets) << uint(exp)
+	return time.Duration(base + 1<<uint(exp) - 1)
+}
+
+// Observe records a single duration.
+func (h *Histogram) Observe(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.mu.Lock()
+	h.counts[bucketOf(d)]++
+	h.n++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+	h.mu.Unlock()
+}
+
+// Count returns the number of recorded durations.
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.n
+}
+
+// Quantile returns an upper bound for the q-th quantile (0 <= q <= 1).
+func (h *Histogram) Quantile(q float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.quantile(q)
+}
+
+func (h *Histogram) quantile(q float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.n))
+	if rank >= h.n {
+		rank = h.n - 1
+	}
+	var seen uint64
+	for b, c := range h.counts {
+		seen += c
+		if seen > rank {
+			if u := bucketUpper(b); u < h.max {
+				return u
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+// Reset clears all recorded durations.
+func (h *Histogram) Reset() {
+	h.mu.Lock()
+	h.counts = [len(h.counts)]uint64{}
+	h.n, h.sum, h.max = 0, 0, 0
+	h.mu.Unlock()
+}
+
+// StageReport summarises the latency of a single stage.
+type StageReport struct {
+	Stage Stage         `json:"-"`
+	Name  string        `json:"stage"`
+	Count uint64        `json:"count"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+func (h *Histogram) report(s Stage) StageReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r := StageReport{Stage: s, Name: s.String(), Count: h.n, Max: h.max}
+	if h.n > 0 {
+		r.Mean = h.sum / time.Duration(h.n)
+		r.P50, r.P90, r.P99 = h.quantile(0.5), h.quantile(0.9), h.quantile(0.99)
+	}
+	return r
+}
+
+// StageTimer keeps a latency histogram for every processing stage.
+type StageTimer struct {
+	stages [numStages]Histogram
+}
+
+func NewStageTimer() *StageTimer {
+	return &StageTimer{}
+}
+
+// Observe records d as the latency of stage s.
+func (t *StageTimer) Observe(s Stage, d time.Duration) {
+	if t == nil || s < 0 || s >= numStages {
+		return
+	}
+	t.stages[s].Observe(d)
+}
+
+// Since records the time elapsed since start as the latency of stage s and
+// returns the current time, so consecutive stages can be chained.
+func (t *StageTimer) Since(s Stage, start time.Time) time.Time {
+	now := time.Now()
+	t.Observe(s, now.Sub(start))
+	return now
+}
+
+// Report returns a summary of every stage that recorded at least one
+// duration. If reset is true the histograms are cleared afterwards, so the
+// next report only covers the following interval.
+func (t *StageTimer) Report(reset bool) []StageReport {
+	if t == nil {
+		return nil
+	}
+	var reports []StageReport
+	for i := range t.stages {
+		r := t.stages[i].report(Stage(i))
+		if reset {
+			t.stages[i].Reset()
+		}
+		if r.Count > 0 {
+			reports = append(reports, r)
+		}
+	}
+	return reports
+}
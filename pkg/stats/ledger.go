@@ -0,0 +1,107 @@
+package stats
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Usage is the traffic accounted to a key.
+type Usage struct {
+	Bytes   uint64 `json:"bytes"`
+	Packets uint64 `json:"packets"`
+}
+
+// Account is the usage of a key, as ranked by Ledger.Top.
+type Account struct {
+	Key string `json:"key"`
+	Usage
+}
+
+type ledgerBucket struct {
+	start time.Time
+	usage map[string]*Usage
+}
+
+// Ledger accounts bytes and packets per key over a sliding time window. Like
+// Window it keeps a ring of fixed resolution buckets, each holding the keys
+// active during it, so memory follows the number of recently active keys.
+type Ledger struct {
+	mu         sync.Mutex
+	resolution time.Duration
+	buckets    []ledgerBucket
+}
+
+// NewLedger covers n buckets of the given resolution.
+func NewLedger(resolution time.Duration, n int) *Ledger {
+	return &Ledger{resolution: resolution, buckets: make([]ledgerBucket, n)}
+}
+
+// Add accounts a packet of size bytes to key at time t. Packets older than
+// the window are dropped.
+func (l *Ledger) Add(t time.Time, key string, size int) {
+	start := t.Truncate(l.resolution)
+	b := &l.buckets[int(start.UnixNano()/int64(l.resolution))%len(l.buckets)]
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if b.start.After(start) {
+		return
+	}
+	if !b.start.Equal(start) {
+		b.start, b.usage = start, make(map[string]*Usage)
+	}
+	u := b.usage[key]
+	if u == nil {
+		u = new(Usage)
+		b.usage[key] = u
+	}
+	u.Bytes += uint64(size)
+	u.Packets++
+}
+
+// Totals returns the usage of every key within span before now. The span is
+// rounded up to the resolution and capped to what the ring covers.
+func (l *Ledger) Totals(now time.Time, span time.Duration) map[string]Usage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	totals := make(map[string]Usage)
+	oldest := now.Truncate(l.resolution).Add(-span + l.resolution)
+	for _, b := range l.buckets {
+		if b.start.IsZero() || b.start.Before(oldest) || b.start.After(now) {
+			continue
+		}
+		for key, u := range b.usage {
+			t := totals[key]
+			t.Bytes += u.Bytes
+			t.Packets += u.Packets
+			totals[key] = t
+		}
+	}
+	return totals
+}
+
+// Top returns the n keys with most bytes within span before now, heaviest
+// first. Ties are broken by packets, then by key.
+func (l *Ledger) Top(now time.Time, span time.Duration, n int) []Account {
+	totals := l.Totals(now, span)
+	accounts := make([]Account, 0, len(totals))
+	for key, u := range totals {
+		accounts = append(accounts, Account{Key: key, Usage: u})
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		a, b := accounts[i], accounts[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		if a.Packets != b.Packets {
+			return a.Packets > b.Packets
+		}
+		return a.Key < b.Key
+	})
+	if n > 0 && len(accounts) > n {
+		accounts = accounts[:n]
+	}
+	return accounts
+}
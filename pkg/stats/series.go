@@ -0,0 +1,120 @@
+package stats
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Series is a store of time series keyed by metric, such as
+// "decoded/discv5", each a ring of buckets of the same resolution. Writers
+// add values as events happen, readers query any span up to what the rings
+// cover, so every consumer of a metric sees the same numbers. Keys are
+// created on first write; querying an unknown key returns zeros.
+type Series struct {
+	mu         sync.RWMutex
+	resolution time.Duration
+	n          int
+	windows    map[string]*Window
+}
+
+// NewSeries keeps span of every metric at the given resolution.
+func NewSeries(resolution, span time.Duration) *Series {
+	n := int((span + resolution - 1) / resolution)
+	if n < 1 {
+		n = 1
+	}
+	return &Series{resolution: resolution, n: n, windows: make(map[string]*Window)}
+}
+
+// Resolution returns the length of a bucket.
+func (s *Series) Resolution() time.Duration {
+	return s.resolution
+}
+
+// Span returns the time covered by every series.
+func (s *Series) Span() time.Duration {
+	return s.resolution * time.Duration(s.n)
+}
+
+func (s *Series) window(key string) *Window {
+	s.mu.RLock()
+	w := s.windows[key]
+	s.mu.RUnlock()
+	return w
+}
+
+// Add records v at time t under key.
+func (s *Series) Add(key string, t time.Time, v float64) {
+	w := s.window(key)
+	if w == nil {
+		s.mu.Lock()
+		if w = s.windows[key]; w == nil {
+			w = NewWindow(s.resolution, s.n)
+			s.windows[key] = w
+		}
+		s.mu.Unlock()
+	}
+	w.Add(t, v)
+}
+
+// Touch creates key if it doesn't exist, so it is listed before its first
+// value.
+func (s *Series) Touch(key string) {
+	s.mu.Lock()
+	if s.windows[key] == nil {
+		s.windows[key] = NewWindow(s.resolution, s.n)
+	}
+	s.mu.Unlock()
+}
+
+// Sum returns the total recorded under key within span before now.
+func (s *Series) Sum(key string, now time.Time, span time.Duration) float64 {
+	if w := s.window(key); w != nil {
+		return w.Sum(now, span)
+	}
+	return 0
+}
+
+// Rate returns the per second rate recorded under key within span before
+// now.
+func (s *Series) Rate(key string, now time.Time, span time.Duration) float64 {
+	if w := s.window(key); w != nil {
+		return w.Rate(now, span)
+	}
+	return 0
+}
+
+// Buckets returns n sums of step each under key, the last ending with the
+// bucket holding now, oldest first. Steps are rounded to a multiple of the
+// resolution.
+func (s *Series) Buckets(key string, now time.Time, step time.Duration, n int) []float64 {
+	k := int(step / s.resolution)
+	if k < 1 {
+		k = 1
+	}
+	out := make([]float64, n)
+	w := s.window(key)
+	if w == nil {
+		return out
+	}
+	for i, v := range w.Buckets(now, n*k) {
+		out[i/k] += v
+	}
+	return out
+}
+
+// Keys returns the keys starting with prefix, sorted.
+func (s *Series) Keys(prefix string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var keys []string
+	for key := range s.windows {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
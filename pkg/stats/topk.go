@@ -0,0 +1,140 @@
+package stats
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+// HeavyHitter is a key reported by TopK along with its estimated count.
+// The true count lies within [Count-Error, Count].
+type HeavyHitter struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error"`
+}
+
+type topKEntry struct {
+	HeavyHitter
+	index int
+}
+
+type topKHeap []*topKEntry
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *topKHeap) Push(x interface{}) {
+	e := x.(*topKEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// TopK tracks the most frequent keys of a stream in constant memory using the
+// Space-Saving algorithm: any key occurring more than N/capacity times is
+// guaranteed to be tracked, no matter how many distinct keys an adversary
+// sends.
+type TopK struct {
+	mu       sync.Mutex
+	capacity int
+	entries  map[string]*topKEntry
+	heap     topKHeap
+}
+
+// NewTopK tracks up to capacity keys. Capacity should be a comfortable
+// multiple of the number of heavy hitters that will be queried.
+func NewTopK(capacity int) *TopK {
+	return &TopK{
+		capacity: capacity,
+		entries:  make(map[string]*topKEntry, capacity),
+	}
+}
+
+// Add counts n occurrences of key.
+func (t *TopK) Add(key string, n uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if e, ok := t.entries[key]; ok {
+		e.Count += n
+		heap.Fix(&t.heap, e.index)
+		return
+	}
+	if len(t.heap) < t.capacity {
+		e := &topKEntry{HeavyHitter: HeavyHitter{Key: key, Count: n}}
+		t.entries[key] = e
+		heap.Push(&t.heap, e)
+		return
+	}
+
+	// Replace the least frequent key, inheriting its count as error bound.
+	e := t.heap[0]
+	delete(t.entries, e.Key)
+	e.Key, e.Error = key, e.Count
+	e.Count += n
+	t.entries[key] = e
+	heap.Fix(&t.heap, 0)
+}
+
+// Top returns the n most frequent keys, most frequent first.
+func (t *TopK) Top(n int) []HeavyHitter {
+	t.mu.Lock()
+	top := make([]HeavyHitter, 0, len(t.heap))
+	for _, e := range t.heap {
+		top = append(top, e.HeavyHitter)
+	}
+	t.mu.Unlock()
+
+	// Ties are broken by key so equal states always rank identically.
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Key < top[j].Key
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// Decay scales every count by factor (0 < factor < 1), so rankings follow
+// current activity rather than lifetime totals. Keys whose count drops to
+// zero are forgotten.
+func (t *TopK) Decay(factor float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	kept := t.heap[:0]
+	for _, e := range t.heap {
+		e.Count = uint64(float64(e.Count) * factor)
+		e.Error = uint64(float64(e.Error) * factor)
+		if e.Count == 0 {
+			delete(t.entries, e.Key)
+			continue
+		}
+		kept = append(kept, e)
+	}
+	t.heap = kept
+	for i, e := range t.heap {
+		e.index = i
+	}
+	heap.Init(&t.heap)
+}
+
+// Reset forgets every tracked key.
+func (t *TopK) Reset() {
+	t.mu.Lock()
+	t.entries = make(map[string]*topKEntry, t.capacity)
+	t.heap = t.heap[:0]
+	t.mu.Unlock()
+}
@@ -0,0 +1,118 @@
+package stats
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestTopKEviction(t *testing.T) {
+	tests := []struct {
+		name string
+		adds []HeavyHitter // keys added and their counts
+		want []HeavyHitter
+	}{
+		{
+			name: "under capacity",
+			adds: []HeavyHitter{{Key: "a", Count: 5}, {Key: "b", Count: 3}, {Key: "a", Count: 1}},
+			want: []HeavyHitter{{Key: "a", Count: 6}, {Key: "b", Count: 3}},
+		},
+		{
+			name: "least frequent replaced",
+			adds: []HeavyHitter{{Key: "a", Count: 5}, {Key: "b", Count: 3}, {Key: "c", Count: 1}},
+			want: []HeavyHitter{{Key: "a", Count: 5}, {Key: "c", Count: 4, Error: 3}},
+		},
+		{
+			name: "replacement replaced",
+			adds: []HeavyHitter{{Key: "a", Count: 5}, {Key: "b", Count: 3}, {Key: "c", Count: 1}, {Key: "d", Count: 1}},
+			want: []HeavyHitter{{Key: "a", Count: 5}, {Key: "d", Count: 5, Error: 4}},
+		},
+		{
+			name: "ties ranked by key",
+			adds: []HeavyHitter{{Key: "b", Count: 2}, {Key: "a", Count: 2}},
+			want: []HeavyHitter{{Key: "a", Count: 2}, {Key: "b", Count: 2}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := NewTopK(2)
+			for _, a := range tt.adds {
+				k.Add(a.Key, a.Count)
+			}
+			got := k.Top(10)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("top %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestTopKBounds feeds a skewed stream drowned in distinct keys, as an
+// adversary would send, and checks the Space-Saving guarantees.
+func TestTopKBounds(t *testing.T) {
+	const capacity = 50
+	rnd := rand.New(rand.NewSource(1))
+	k := NewTopK(capacity)
+	counts := make(map[string]uint64)
+	var total uint64
+	for i := 0; i < 100000; i++ {
+		var key string
+		switch r := rnd.Intn(100); {
+		case r < 10:
+			key = "heavy-0"
+		case r < 15:
+			key = "heavy-1"
+		case r < 18:
+			key = fmt.Sprintf("heavy-%d", 2+rnd.Intn(3))
+		default:
+			key = fmt.Sprintf("noise-%d", i)
+		}
+		k.Add(key, 1)
+		counts[key]++
+		total++
+	}
+
+	top := k.Top(capacity)
+	if len(top) != capacity {
+		t.Fatalf("%d keys tracked, want %d", len(top), capacity)
+	}
+	tracked := make(map[string]bool)
+	for _, h := range top {
+		tracked[h.Key] = true
+		if c := counts[h.Key]; c > h.Count || c < h.Count-h.Error {
+			t.Errorf("%s: count %d not within [%d, %d]", h.Key, c, h.Count-h.Error, h.Count)
+		}
+		if h.Error > total/capacity {
+			t.Errorf("%s: error %d beyond N/capacity %d", h.Key, h.Error, total/capacity)
+		}
+	}
+	for key, c := range counts {
+		if c > total/capacity && !tracked[key] {
+			t.Errorf("%s occurring %d times of %d not tracked", key, c, total)
+		}
+	}
+	for i, key := range []string{"heavy-0", "heavy-1"} {
+		if top[i].Key != key {
+			t.Errorf("rank %d is %s, want %s", i, top[i].Key, key)
+		}
+	}
+}
+
+func TestTopKDecay(t *testing.T) {
+	k := NewTopK(4)
+	k.Add("a", 10)
+	k.Add("b", 1)
+	k.Decay(0.5)
+	if got := fmt.Sprint(k.Top(4)); got != fmt.Sprint([]HeavyHitter{{Key: "a", Count: 5}}) {
+		t.Errorf("top after decay %v, want a alone", got)
+	}
+	// A forgotten key is counted anew.
+	k.Add("b", 6)
+	if got := k.Top(1); got[0].Key != "b" || got[0].Count != 6 || got[0].Error != 0 {
+		t.Errorf("top %v, want b counted anew", got)
+	}
+	k.Reset()
+	if got := k.Top(4); len(got) != 0 {
+		t.Errorf("top after reset %v", got)
+	}
+}
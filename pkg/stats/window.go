@@ -0,0 +1,128 @@
+package stats
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Window sums values over a sliding time window using a ring of fixed
+// resolution buckets, so totals reflect recent activity rather than growing
+// for the lifetime of the process.
+type Window struct {
+	mu         sync.Mutex
+	resolution time.Duration
+	sums       []float64
+	starts     []time.Time
+}
+
+// NewWindow covers n buckets of the given resolution.
+func NewWindow(resolution time.Duration, n int) *Window {
+	return &Window{
+		resolution: resolution,
+		sums:       make([]float64, n),
+		starts:     make([]time.Time, n),
+	}
+}
+
+// Add records v at time t. Values older than the window are dropped.
+func (w *Window) Add(t time.Time, v float64) {
+	start := t.Truncate(w.resolution)
+	i := int(start.UnixNano()/int64(w.resolution)) % len(w.sums)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.starts[i].After(start) {
+		return
+	}
+	if !w.starts[i].Equal(start) {
+		w.sums[i] = 0
+		w.starts[i] = start
+	}
+	w.sums[i] += v
+}
+
+// Sum returns the total of the values recorded within span before now. The
+// span is rounded up to the resolution and capped to what the ring covers.
+func (w *Window) Sum(now time.Time, span time.Duration) float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var sum float64
+	oldest := oldestBucket(now, span, w.resolution)
+	for i, start := range w.starts {
+		if start.IsZero() || start.Before(oldest) || start.After(now) {
+			continue
+		}
+		sum += w.sums[i]
+	}
+	return sum
+}
+
+// Rate returns the per second rate of the values recorded within span
+// before now.
+func (w *Window) Rate(now time.Time, span time.Duration) float64 {
+	if max := w.resolution * time.Duration(len(w.sums)); span > max {
+		span = max
+	}
+	return w.Sum(now, span) / span.Seconds()
+}
+
+// Buckets returns the sums of the n buckets up to the one holding now,
+// oldest first, as a timeline of the window. Buckets the ring no longer
+// covers are zero.
+func (w *Window) Buckets(now time.Time, n int) []float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	out := make([]float64, n)
+	last := now.Truncate(w.resolution)
+	oldest := last.Add(-time.Duration(len(w.sums)-1) * w.resolution)
+	for k := range out {
+		start := last.Add(-time.Duration(n-1-k) * w.resolution)
+		i := int(start.UnixNano()/int64(w.resolution)) % len(w.sums)
+		if w.starts[i].Equal(start) && !start.Before(oldest) {
+			out[k] = w.sums[i]
+		}
+	}
+	return out
+}
+
+// EWMA is an exponentially weighted moving rate: past events lose half of
+// their weight every half-life.
+type EWMA struct {
+	mu       sync.Mutex
+	halfLife time.Duration
+	value    float64
+	last     time.Time
+}
+
+func NewEWMA(halfLife time.Duration) *EWMA {
+	return &EWMA{halfLife: halfLife}
+}
+
+func (e *EWMA) decay(t time.Time) {
+	if !e.last.IsZero() && t.After(e.last) {
+		e.value *= math.Exp2(-float64(t.Sub(e.last)) / float64(e.halfLife))
+	}
+	if t.After(e.last) {
+		e.last = t
+	}
+}
+
+// Add records v at time t.
+func (e *EWMA) Add(t time.Time, v float64) {
+	e.mu.Lock()
+	e.decay(t)
+	e.value += v
+	e.mu.Unlock()
+}
+
+// Rate returns the decayed per second rate as of time t.
+func (e *EWMA) Rate(t time.Time) float64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.decay(t)
+	// The decayed sum of a steady rate r converges to r*halfLife/ln(2).
+	return e.value * math.Ln2 / e.halfLife.Seconds()
+}
@@ -0,0 +1,90 @@
+package stats
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	w := NewWindow(time.Second, 4)
+	for i := 0; i < 4; i++ {
+		w.Add(t0.Add(time.Duration(i)*time.Second), float64(i+1))
+		w.Add(t0.Add(time.Duration(i)*time.Second+500*time.Millisecond), float64(i+1))
+	}
+
+	tests := []struct {
+		name string
+		now  time.Duration // after t0
+		span time.Duration
+		want float64
+	}{
+		{"whole ring", 3 * time.Second, 4 * time.Second, 20},
+		{"last bucket", 3 * time.Second, time.Second, 8},
+		{"rounded up", 3*time.Second + 900*time.Millisecond, time.Millisecond, 8},
+		{"last two", 3 * time.Second, 2 * time.Second, 14},
+		{"beyond the ring", 3 * time.Second, time.Minute, 20},
+		{"in the past", time.Second, 4 * time.Second, 6},
+		{"first expired", 4 * time.Second, 4 * time.Second, 18},
+		{"all expired", 10 * time.Second, 4 * time.Second, 0},
+	}
+	for _, tt := range tests {
+		if got := w.Sum(t0.Add(tt.now), tt.span); got != tt.want {
+			t.Errorf("%s: sum %g, want %g", tt.name, got, tt.want)
+		}
+	}
+	if got := w.Rate(t0.Add(3*time.Second), time.Minute); got != 5 {
+		t.Errorf("rate over the ring %g, want 5", got)
+	}
+	if got := fmt.Sprint(w.Buckets(t0.Add(4*time.Second), 6)); got != "[0 0 4 6 8 0]" {
+		t.Errorf("buckets %s, want [0 0 4 6 8 0]", got)
+	}
+
+	// The bucket of t0 rolls over to t0+4s, values arriving late for it are
+	// dropped.
+	w.Add(t0.Add(4*time.Second), 10)
+	w.Add(t0, 100)
+	if got := w.Sum(t0.Add(4*time.Second), time.Second); got != 10 {
+		t.Errorf("sum of the rolled over bucket %g, want 10", got)
+	}
+	if got := fmt.Sprint(w.Buckets(t0.Add(4*time.Second), 5)); got != "[0 4 6 8 10]" {
+		t.Errorf("buckets %s, want [0 4 6 8 10]", got)
+	}
+}
+
+func TestEWMA(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		interval time.Duration // between events of 1
+		want     float64       // rate per second
+	}{
+		{"10/s", 100 * time.Millisecond, 10},
+		{"1/s", time.Second, 1},
+		{"0.2/s", 5 * time.Second, 0.2},
+	}
+	for _, tt := range tests {
+		e := NewEWMA(time.Minute)
+		var now time.Time
+		for now = t0; now.Before(t0.Add(20 * time.Minute)); now = now.Add(tt.interval) {
+			e.Add(now, 1)
+		}
+		if got := e.Rate(now); math.Abs(got-tt.want) > 0.05*tt.want {
+			t.Errorf("%s: rate %g, want about %g", tt.name, got, tt.want)
+		}
+	}
+
+	e := NewEWMA(time.Minute)
+	e.Add(t0, 60)
+	r := e.Rate(t0)
+	if got := e.Rate(t0.Add(time.Minute)); math.Abs(got-r/2) > 1e-9 {
+		t.Errorf("rate a half-life later %g, want %g", got, r/2)
+	}
+	// Events out of order don't decay the rate back in time.
+	e.Add(t0, 0)
+	if got := e.Rate(t0.Add(time.Minute)); math.Abs(got-r/2) > 1e-9 {
+		t.Errorf("rate after a late event %g, want %g", got, r/2)
+	}
+}
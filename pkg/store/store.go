@@ -0,0 +1,200 @@
+// Package store persists decoded packets and observed nodes into a SQLite
+// database, for analysis with SQL after the capture. The schema is:
+//
+//	packets(id, time, network, protocol, kind, src, dst, direction, size, node_id, fields, error)
+//	nodes(id, first_seen, last_seen, enr_seq, client)
+//	node_endpoints(node_id, addr, advertised, last_seen)
+//	node_packets(node_id, kind, count)
+//
+// Times are Unix nanoseconds, fields holds the decoded packet as in the
+// JSON sink and kind in node_packets is qualified with the protocol, as in
+// discv4/PING.
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/drgomesp/etherspy/pkg/sink"
+	"github.com/drgomesp/etherspy/pkg/tracker"
+	_ "github.com/mattn/go-sqlite3"
+	"time"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS packets (
+	id        INTEGER PRIMARY KEY,
+	time      INTEGER NOT NULL,
+	network   TEXT NOT NULL,
+	protocol  TEXT NOT NULL,
+	kind      TEXT NOT NULL,
+	src       TEXT NOT NULL,
+	dst       TEXT NOT NULL,
+	direction TEXT NOT NULL,
+	size      INTEGER NOT NULL,
+	node_id   TEXT,
+	fields    TEXT,
+	error     TEXT
+);
+CREATE INDEX IF NOT EXISTS packets_time ON packets (time);
+CREATE INDEX IF NOT EXISTS packets_node_id ON packets (node_id);
+
+CREATE TABLE IF NOT EXISTS nodes (
+	id         TEXT PRIMARY KEY,
+	first_seen INTEGER NOT NULL,
+	last_seen  INTEGER NOT NULL,
+	enr_seq    INTEGER NOT NULL,
+	client     TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS node_endpoints (
+	node_id    TEXT NOT NULL REFERENCES nodes (id),
+	addr       TEXT NOT NULL,
+	advertised INTEGER NOT NULL,
+	last_seen  INTEGER NOT NULL,
+	PRIMARY KEY (node_id, addr, advertised)
+);
+
+CREATE TABLE IF NOT EXISTS node_packets (
+	node_id TEXT NOT NULL REFERENCES nodes (id),
+	kind    TEXT NOT NULL,
+	count   INTEGER NOT NULL,
+	PRIMARY KEY (node_id, kind)
+);
+`
+
+// Packets are inserted in batches, committed once either bound is reached.
+const (
+	batchSize = 1000
+	batchAge  = time.Second
+)
+
+// DB is a SQLite database of packets and nodes. It is a sink.Sink, and is
+// not safe for concurrent use.
+type DB struct {
+	db *sql.DB
+
+	tx      *sql.Tx
+	insert  *sql.Stmt
+	pending int
+	opened  time.Time
+}
+
+// Open opens the database at path, creating it and its tables as needed.
+func Open(path string) (*DB, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_synchronous=NORMAL")
+	if err != nil {
+		return nil, err
+	}
+	// A single connection keeps the batch transaction on it.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &DB{db: db}, nil
+}
+
+func (d *DB) begin() error {
+	if d.tx != nil {
+		return nil
+	}
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	insert, err := tx.Prepare(`INSERT INTO packets (time, network, protocol, kind, src, dst, direction, size, node_id, fields, error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	d.tx, d.insert, d.pending, d.opened = tx, insert, 0, time.Now()
+	return nil
+}
+
+// Flush commits the packets written so far.
+func (d *DB) Flush() error {
+	if d.tx == nil {
+		return nil
+	}
+	d.insert.Close()
+	err := d.tx.Commit()
+	d.tx, d.insert = nil, nil
+	return err
+}
+
+// Write inserts a decoded packet.
+func (d *DB) Write(p sink.DecodedPacket) error {
+	r := sink.NewRecord(p)
+	var fields, nodeID, errMsg interface{}
+	if r.Fields != nil {
+		data, err := json.Marshal(r.Fields)
+		if err != nil {
+			return err
+		}
+		fields = string(data)
+	}
+	if r.NodeID != "" {
+		nodeID = r.NodeID
+	}
+	if r.Error != "" {
+		errMsg = r.Error
+	}
+
+	if err := d.begin(); err != nil {
+		return err
+	}
+	if _, err := d.insert.Exec(r.Time.UnixNano(), r.Network, r.Protocol, r.Kind, r.Src, r.Dst, r.Direction, r.Size, nodeID, fields, errMsg); err != nil {
+		return err
+	}
+	d.pending++
+	if d.pending >= batchSize || time.Since(d.opened) >= batchAge {
+		return d.Flush()
+	}
+	return nil
+}
+
+// SaveNodes replaces the stored state of the given nodes. Nodes forgotten by
+// the tracker are kept as last saved.
+func (d *DB) SaveNodes(nodes []tracker.Node) error {
+	if err := d.Flush(); err != nil {
+		return err
+	}
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, n := range nodes {
+		id := n.ID.String()
+		if _, err := tx.Exec(`INSERT INTO nodes (id, first_seen, last_seen, enr_seq, client) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET first_seen = MIN(first_seen, excluded.first_seen), last_seen = excluded.last_seen, enr_seq = excluded.enr_seq, client = excluded.client`,
+			id, n.FirstSeen.UnixNano(), n.LastSeen.UnixNano(), n.ENRSeq, n.Client); err != nil {
+			return err
+		}
+		for _, e := range n.Endpoints {
+			if _, err := tx.Exec(`INSERT INTO node_endpoints (node_id, addr, advertised, last_seen) VALUES (?, ?, ?, ?)
+				ON CONFLICT (node_id, addr, advertised) DO UPDATE SET last_seen = excluded.last_seen`,
+				id, e.Addr, e.Advertised, e.LastSeen.UnixNano()); err != nil {
+				return err
+			}
+		}
+		for kind, count := range n.Packets {
+			if _, err := tx.Exec(`INSERT INTO node_packets (node_id, kind, count) VALUES (?, ?, ?)
+				ON CONFLICT (node_id, kind) DO UPDATE SET count = excluded.count`,
+				id, kind, count); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Close commits pending packets and closes the database.
+func (d *DB) Close() error {
+	err := d.Flush()
+	if cerr := d.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
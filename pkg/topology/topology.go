@@ -0,0 +1,313 @@
+// Package topology builds the graph of the discovery peers seen in a
+// capture, who pings whom and who hands out whom in its answers to lookups,
+// and writes it as GraphViz DOT or GEXF, as read by Gephi, for the local
+// network topology to be visualized.
+package topology
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of edges.
+const (
+	EdgePing   = "ping"   // the source pinged the target
+	EdgePong   = "pong"   // the source answered a ping of the target
+	EdgeListed = "listed" // the source returned the target in NEIGHBORS or NODES
+)
+
+// edgeColors are the colors of the kinds of edges in DOT.
+var edgeColors = map[string]string{
+	EdgePing:   "#1f77b4",
+	EdgePong:   "#2ca02c",
+	EdgeListed: "#ff7f0e",
+}
+
+// Vertex is a node of the graph, identified by its node ID or, until it is
+// known, by its address.
+type Vertex struct {
+	ID   string
+	Addr string // last known, empty if unknown
+}
+
+// Edge is a relation between two vertices, as often as it was seen.
+type Edge struct {
+	From, To    string
+	Kind        string
+	Count       uint64
+	First, Last time.Time
+}
+
+type edgeKey struct {
+	from, to, kind string
+}
+
+// Graph is the graph of a capture. It is safe for concurrent use.
+type Graph struct {
+	mu       sync.Mutex
+	maxEdges int
+	addrs    map[string]string // node ID by address
+	ids      map[string]string // address by node ID
+	edges    map[edgeKey]*Edge
+	dropped  uint64
+}
+
+// New returns an empty graph of at most maxEdges edges, later ones are
+// dropped.
+func New(maxEdges int) *Graph {
+	return &Graph{
+		maxEdges: maxEdges,
+		addrs:    make(map[string]string),
+		ids:      make(map[string]string),
+		edges:    make(map[edgeKey]*Edge),
+	}
+}
+
+// Locate records that the node id is at addr, as learned from its traffic
+// or records, so edges to the address are drawn to the node.
+func (g *Graph) Locate(id, addr string) {
+	g.mu.Lock()
+	g.addrs[addr] = id
+	g.ids[id] = addr
+	g.mu.Unlock()
+}
+
+// Add records an edge of the given kind seen at t from the vertex from to
+// the vertex to, each a node ID or the address of a node whose ID is
+// unknown.
+func (g *Graph) Add(from, to, kind string, t time.Time) {
+	key := edgeKey{from, to, kind}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	e := g.edges[key]
+	if e == nil {
+		if len(g.edges) >= g.maxEdges {
+			g.dropped++
+			return
+		}
+		e = &Edge{From: from, To: to, Kind: kind, First: t}
+		g.edges[key] = e
+	}
+	e.Count++
+	e.Last = t
+}
+
+// Dropped returns how many edges didn't fit in the graph.
+func (g *Graph) Dropped() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.dropped
+}
+
+// Snapshot returns the vertices and edges of the graph, sorted, with the
+// addresses of known nodes replaced by their IDs.
+func (g *Graph) Snapshot() ([]Vertex, []Edge) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	resolve := func(v string) string {
+		if id, ok := g.addrs[v]; ok {
+			return id
+		}
+		return v
+	}
+	merged := make(map[edgeKey]*Edge, len(g.edges))
+	vertices := make(map[string]bool)
+	for _, e := range g.edges {
+		key := edgeKey{resolve(e.From), resolve(e.To), e.Kind}
+		m := merged[key]
+		if m == nil {
+			m = &Edge{From: key.from, To: key.to, Kind: key.kind, First: e.First, Last: e.Last}
+			merged[key] = m
+		} else {
+			if e.First.Before(m.First) {
+				m.First = e.First
+			}
+			if e.Last.After(m.Last) {
+				m.Last = e.Last
+			}
+		}
+		m.Count += e.Count
+		vertices[key.from], vertices[key.to] = true, true
+	}
+
+	vs := make([]Vertex, 0, len(vertices))
+	for v := range vertices {
+		if addr, ok := g.ids[v]; ok {
+			vs = append(vs, Vertex{ID: v, Addr: addr})
+		} else if strings.Contains(v, ":") {
+			vs = append(vs, Vertex{ID: v, Addr: v})
+		} else {
+			vs = append(vs, Vertex{ID: v})
+		}
+	}
+	sort.Slice(vs, func(i, j int) bool { return vs[i].ID < vs[j].ID })
+	es := make([]Edge, 0, len(merged))
+	for _, e := range merged {
+		es = append(es, *e)
+	}
+	sort.Slice(es, func(i, j int) bool {
+		a, b := es[i], es[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.Kind < b.Kind
+	})
+	return vs, es
+}
+
+// label is the short name of a vertex: the first bytes of its node ID and
+// its address, joined by sep.
+func (v Vertex) label(sep string) string {
+	name := v.ID
+	if v.ID != v.Addr && len(name) > 16 {
+		name = name[:16]
+	}
+	if v.Addr != "" && v.Addr != v.ID {
+		name += sep + v.Addr
+	}
+	return name
+}
+
+// WriteDOT writes the graph in the GraphViz DOT language, edges colored by
+// kind and weighted by count.
+func (g *Graph) WriteDOT(w io.Writer) error {
+	vs, es := g.Snapshot()
+	var b strings.Builder
+	b.WriteString("digraph etherspy {\n")
+	b.WriteString("\tnode [shape=box, fontname=monospace, fontsize=9];\n")
+	for _, v := range vs {
+		fmt.Fprintf(&b, "\t%q [label=%q];\n", v.ID, v.label("\n"))
+	}
+	for _, e := range es {
+		fmt.Fprintf(&b, "\t%q -> %q [kind=%q, color=%q, weight=%d, penwidth=%.2f];\n",
+			e.From, e.To, e.Kind, edgeColors[e.Kind], e.Count, penWidth(e.Count))
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// penWidth grows with the logarithm of count, so busy edges stand out
+// without drowning the others.
+func penWidth(count uint64) float64 {
+	w := 1.0
+	for c := count; c > 1; c /= 4 {
+		w += 0.5
+	}
+	return w
+}
+
+// GEXF documents, version 1.3.
+type (
+	gexfDoc struct {
+		XMLName xml.Name  `xml:"gexf"`
+		XMLNS   string    `xml:"xmlns,attr"`
+		Version string    `xml:"version,attr"`
+		Meta    gexfMeta  `xml:"meta"`
+		Graph   gexfGraph `xml:"graph"`
+	}
+	gexfMeta struct {
+		LastModified string `xml:"lastmodifieddate,attr"`
+		Creator      string `xml:"creator"`
+		Description  string `xml:"description"`
+	}
+	gexfGraph struct {
+		DefaultEdgeType string           `xml:"defaultedgetype,attr"`
+		Mode            string           `xml:"mode,attr"`
+		Attributes      []gexfAttributes `xml:"attributes"`
+		Nodes           []gexfNode       `xml:"nodes>node"`
+		Edges           []gexfEdge       `xml:"edges>edge"`
+	}
+	gexfAttributes struct {
+		Class      string          `xml:"class,attr"`
+		Attributes []gexfAttribute `xml:"attribute"`
+	}
+	gexfAttribute struct {
+		ID    string `xml:"id,attr"`
+		Title string `xml:"title,attr"`
+		Type  string `xml:"type,attr"`
+	}
+	gexfNode struct {
+		ID        string      `xml:"id,attr"`
+		Label     string      `xml:"label,attr"`
+		AttValues []gexfValue `xml:"attvalues>attvalue,omitempty"`
+	}
+	gexfEdge struct {
+		ID        int         `xml:"id,attr"`
+		Source    string      `xml:"source,attr"`
+		Target    string      `xml:"target,attr"`
+		Kind      string      `xml:"kind,attr"`
+		Weight    uint64      `xml:"weight,attr"`
+		AttValues []gexfValue `xml:"attvalues>attvalue"`
+	}
+	gexfValue struct {
+		For   string `xml:"for,attr"`
+		Value string `xml:"value,attr"`
+	}
+)
+
+// WriteGEXF writes the graph as a GEXF document, edges weighted by count,
+// their kind also given as an attribute Gephi can partition them by.
+func (g *Graph) WriteGEXF(w io.Writer) error {
+	vs, es := g.Snapshot()
+	doc := gexfDoc{
+		XMLNS:   "http://gexf.net/1.3",
+		Version: "1.3",
+		Meta: gexfMeta{
+			LastModified: time.Now().UTC().Format("2006-01-02"),
+			Creator:      "etherspy",
+			Description:  "discovery peers and who pinged and listed whom",
+		},
+		Graph: gexfGraph{
+			DefaultEdgeType: "directed",
+			Mode:            "static",
+			Attributes: []gexfAttributes{
+				{Class: "node", Attributes: []gexfAttribute{{ID: "addr", Title: "address", Type: "string"}}},
+				{Class: "edge", Attributes: []gexfAttribute{
+					{ID: "type", Title: "type", Type: "string"},
+					{ID: "first", Title: "first seen", Type: "string"},
+					{ID: "last", Title: "last seen", Type: "string"},
+				}},
+			},
+		},
+	}
+	for _, v := range vs {
+		n := gexfNode{ID: v.ID, Label: v.label(" ")}
+		if v.Addr != "" {
+			n.AttValues = []gexfValue{{For: "addr", Value: v.Addr}}
+		}
+		doc.Graph.Nodes = append(doc.Graph.Nodes, n)
+	}
+	for i, e := range es {
+		doc.Graph.Edges = append(doc.Graph.Edges, gexfEdge{
+			ID:     i,
+			Source: e.From,
+			Target: e.To,
+			Kind:   e.Kind,
+			Weight: e.Count,
+			AttValues: []gexfValue{
+				{For: "type", Value: e.Kind},
+				{For: "first", Value: e.First.UTC().Format(time.RFC3339)},
+				{For: "last", Value: e.Last.UTC().Format(time.RFC3339)},
+			},
+		})
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
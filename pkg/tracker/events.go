@@ -0,0 +1,97 @@
+package tracker
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// EventKind is a change to the node table.
+type EventKind int
+
+const (
+	NodeAdded     EventKind = iota + 1 // first observation of a node
+	RecordUpdated                      // a newer or different record
+	NodeStale                          // not seen over the window of MarkStale
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case NodeAdded:
+		return "added"
+	case RecordUpdated:
+		return "record_updated"
+	case NodeStale:
+		return "stale"
+	}
+	return "unknown"
+}
+
+// MarshalText encodes the kind by name.
+func (k EventKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// NodeEvent is a change to the node table, with a copy of the node as of
+// the change.
+type NodeEvent struct {
+	Kind EventKind `json:"kind"`
+	Node Node      `json:"node"`
+}
+
+// Subscription delivers the events of a tracker. The tracker never waits
+// for subscribers: events that don't fit in the buffer of a subscription
+// are dropped and counted.
+type Subscription struct {
+	t       *Tracker
+	events  chan NodeEvent
+	dropped uint64
+	once    sync.Once
+}
+
+// Subscribe returns a subscription to the events of the table, buffering
+// up to buffer of them.
+func (t *Tracker) Subscribe(buffer int) *Subscription {
+	s := &Subscription{t: t, events: make(chan NodeEvent, buffer)}
+	t.mu.Lock()
+	t.subs[s] = true
+	t.mu.Unlock()
+	return s
+}
+
+// Events returns the channel events are delivered on, closed once
+// unsubscribed.
+func (s *Subscription) Events() <-chan NodeEvent {
+	return s.events
+}
+
+// Dropped returns the number of events dropped so far.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Unsubscribe stops the delivery of events and closes the channel. It may
+// be called several times.
+func (s *Subscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.t.mu.Lock()
+		delete(s.t.subs, s)
+		s.t.mu.Unlock()
+		close(s.events)
+	})
+}
+
+// publish hands an event about n to every subscriber. The table must be
+// locked for writing.
+func (t *Tracker) publish(kind EventKind, n *Node) {
+	if len(t.subs) == 0 {
+		return
+	}
+	e := NodeEvent{Kind: kind, Node: n.copy()}
+	for s := range t.subs {
+		select {
+		case s.events <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
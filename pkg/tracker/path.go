@@ -0,0 +1,98 @@
+package tracker
+
+import (
+	"math"
+	"sort"
+)
+
+// IPHeader is what the IP header of a packet tells about the path it took
+// from its sender.
+type IPHeader struct {
+	TTL          uint8 // hop limit with IPv6
+	DSCP         uint8
+	DontFragment bool
+	Fragmented   bool
+}
+
+// initialTTLs are the TTLs network stacks commonly start from.
+var initialTTLs = [...]uint8{32, 64, 128, 255}
+
+// InitialTTL returns the initial TTL a packet received with ttl most likely
+// started from, the smallest common one not below it.
+func InitialTTL(ttl uint8) uint8 {
+	for _, t := range initialTTLs {
+		if ttl <= t {
+			return t
+		}
+	}
+	return 255
+}
+
+// PathProfile summarizes the IP headers of the packets of a sender. A
+// stable path shows a steady TTL, varying ones hint at route changes,
+// several senders behind the address or spoofing.
+type PathProfile struct {
+	Packets      uint64  `json:"packets"`
+	TTLMin       uint8   `json:"ttl_min"`
+	TTLMax       uint8   `json:"ttl_max"`
+	TTLMean      float64 `json:"ttl_mean"`
+	TTLStdDev    float64 `json:"ttl_stddev"`
+	TTLChanges   uint64  `json:"ttl_changes"`   // packets with another TTL than the one before
+	InitialTTLs  []int   `json:"initial_ttls"`  // inferred, more than one hints at several stacks
+	Hops         int     `json:"hops"`          // of the latest packet, from its inferred initial TTL
+	DSCP         []int   `json:"dscp"`          // values seen
+	DontFragment uint64  `json:"dont_fragment"` // packets
+	Fragmented   uint64  `json:"fragmented"`
+
+	lastTTL uint8
+	m2      float64 // of the TTLs, for their variance
+}
+
+// Observe accounts for the IP header of a packet.
+func (p *PathProfile) Observe(h IPHeader) {
+	p.Packets++
+	ttl := float64(h.TTL)
+	if p.Packets == 1 {
+		p.TTLMin, p.TTLMax = h.TTL, h.TTL
+	} else {
+		if h.TTL < p.TTLMin {
+			p.TTLMin = h.TTL
+		}
+		if h.TTL > p.TTLMax {
+			p.TTLMax = h.TTL
+		}
+		if h.TTL != p.lastTTL {
+			p.TTLChanges++
+		}
+	}
+	p.lastTTL = h.TTL
+
+	// Welford's online variance.
+	delta := ttl - p.TTLMean
+	p.TTLMean += delta / float64(p.Packets)
+	p.m2 += delta * (ttl - p.TTLMean)
+	p.TTLStdDev = math.Sqrt(p.m2 / float64(p.Packets))
+
+	initial := InitialTTL(h.TTL)
+	p.Hops = int(initial - h.TTL)
+	p.InitialTTLs = addInt(p.InitialTTLs, int(initial))
+	p.DSCP = addInt(p.DSCP, int(h.DSCP))
+	if h.DontFragment {
+		p.DontFragment++
+	}
+	if h.Fragmented {
+		p.Fragmented++
+	}
+}
+
+// addInt adds v to the sorted set s.
+func addInt(s []int, v int) []int {
+	i := sort.Search(len(s), func(i int) bool { return s[i] >= v })
+	if i < len(s) && s[i] == v {
+		return s
+	}
+	s = append(s, 0)
+	copy(s[i+1:], s[i:])
+	s[i] = v
+	return s
+}
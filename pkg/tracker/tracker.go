@@ -0,0 +1,354 @@
+// Package tracker maintains a table of the nodes observed on the network:
+// when they were seen, where, what they sent and what their records say.
+// A Tracker is safe for concurrent use, so it can be queried while packets
+// are being fed into it, and subscribers are told about changes to the
+// table as they happen.
+package tracker
+
+import (
+	"github.com/drgomesp/etherspy/pkg/geo"
+	"github.com/ethereum/go-ethereum/p2p/enode"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxEndpoints bounds the endpoints kept per node.
+const maxEndpoints = 8
+
+// Node is the state of an observed node.
+type Node struct {
+	ID        enode.ID          `json:"id"`
+	FirstSeen time.Time         `json:"first_seen"`
+	LastSeen  time.Time         `json:"last_seen"`
+	Endpoints []Endpoint        `json:"endpoints"`
+	Packets   map[string]uint64 `json:"packets"` // by protocol/kind
+	ENRSeq    uint64            `json:"enr_seq,omitempty"`
+	Client    string            `json:"client,omitempty"`
+
+	// Record is the latest record of the node in textual form, and
+	// Provenance where it was learned from.
+	Record     string      `json:"record,omitempty"`
+	Provenance *Provenance `json:"provenance,omitempty"`
+
+	// Path profiles the IP headers of the node's packets, when observations
+	// carry them.
+	Path *PathProfile `json:"path,omitempty"`
+
+	// Fingerprint is the client implementation the node is believed to
+	// run, left for callers inferring it to fill in.
+	Fingerprint *Fingerprint `json:"fingerprint,omitempty"`
+}
+
+// Fingerprint is a guess of the client implementation of a node.
+type Fingerprint struct {
+	Client     string  `json:"client"`
+	Confidence float64 `json:"confidence"` // from 0 to 1
+	Source     string  `json:"source"`     // what the guess is based on
+}
+
+// Provenance describes how a record was obtained.
+type Provenance struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"` // protocol/kind of the packet carrying it
+	From   string    `json:"from"`   // address it was sent from
+
+	// For records answering a request, the address of the requester and
+	// the time taken to answer.
+	RequestedBy string        `json:"requested_by,omitempty"`
+	Latency     time.Duration `json:"latency_ns,omitempty"`
+}
+
+// Endpoint is an address a node was seen at, either as the source of its
+// packets or as advertised by itself in pings and records. Hostname,
+// Labels and Geo are left for callers enriching addresses to fill in.
+type Endpoint struct {
+	Addr       string        `json:"addr"`
+	Advertised bool          `json:"advertised"`
+	LastSeen   time.Time     `json:"last_seen"`
+	Hostname   string        `json:"hostname,omitempty"`
+	Labels     []string      `json:"labels,omitempty"`
+	Geo        *geo.Location `json:"geo,omitempty"`
+}
+
+// Observation is a packet sent by a node.
+type Observation struct {
+	Time     time.Time
+	Protocol string
+	Kind     string
+	Src      string    // host:port the packet came from
+	IP       *IPHeader // of the packet, nil if not looked at
+}
+
+// Tracker is a table of nodes keyed by node ID. Once it holds more than
+// its capacity, the nodes seen least recently are forgotten.
+type Tracker struct {
+	capacity int
+
+	mu    sync.RWMutex
+	nodes map[enode.ID]*Node
+	stale map[enode.ID]bool // reported stale and not seen since
+	subs  map[*Subscription]bool
+}
+
+// New returns a tracker holding at most capacity nodes.
+func New(capacity int) *Tracker {
+	return &Tracker{
+		capacity: capacity,
+		nodes:    make(map[enode.ID]*Node),
+		stale:    make(map[enode.ID]bool),
+		subs:     make(map[*Subscription]bool),
+	}
+}
+
+// node returns the entry of id, reporting whether it was just added.
+func (t *Tracker) node(id enode.ID, now time.Time) (n *Node, added bool) {
+	n = t.nodes[id]
+	if n == nil {
+		if len(t.nodes) >= t.capacity {
+			t.evict()
+		}
+		n = &Node{ID: id, FirstSeen: now, Packets: make(map[string]uint64)}
+		t.nodes[id] = n
+		added = true
+	}
+	if now.After(n.LastSeen) {
+		n.LastSeen = now
+		delete(t.stale, id)
+	}
+	return n, added
+}
+
+// evict forgets the tenth of the nodes seen least recently, so evictions
+// are rare in a full table.
+func (t *Tracker) evict() {
+	nodes := make([]*Node, 0, len(t.nodes))
+	for _, n := range t.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].LastSeen.Before(nodes[j].LastSeen) })
+	for _, n := range nodes[:len(nodes)/10+1] {
+		delete(t.nodes, n.ID)
+		delete(t.stale, n.ID)
+	}
+}
+
+// Observe records a packet sent by the node id.
+func (t *Tracker) Observe(id enode.ID, o Observation) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n, added := t.node(id, o.Time)
+	n.Packets[o.Protocol+"/"+o.Kind]++
+	if o.Src != "" {
+		n.addEndpoint(o.Src, false, o.Time)
+	}
+	if o.IP != nil {
+		if n.Path == nil {
+			n.Path = new(PathProfile)
+		}
+		n.Path.Observe(*o.IP)
+	}
+	if added {
+		t.publish(NodeAdded, n)
+	}
+}
+
+// ObserveEndpoint records an endpoint the node id advertised, as in the
+// From field of a discv4 ping.
+func (t *Tracker) ObserveEndpoint(id enode.ID, now time.Time, ip net.IP, port uint16) {
+	if ip == nil || ip.IsUnspecified() || port == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n, added := t.node(id, now)
+	n.addEndpoint(net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), true, now)
+	if added {
+		t.publish(NodeAdded, n)
+	}
+}
+
+// ObserveRecord records the content of a node record obtained as described
+// by p, along with the client it advertises, if any. Records describe nodes
+// third parties know about, the node itself need not have sent them.
+// Records older than the one known are ignored.
+func (t *Tracker) ObserveRecord(r *enode.Node, client string, p Provenance) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n, added := t.node(r.ID(), p.Time)
+	if r.Seq() < n.ENRSeq {
+		return
+	}
+	n.ENRSeq = r.Seq()
+	if client != "" {
+		n.Client = client
+	}
+	record := r.String()
+	changed := record != n.Record
+	n.Record = record
+	n.Provenance = &p
+	if ip := r.IP(); ip != nil && r.UDP() != 0 {
+		n.addEndpoint(net.JoinHostPort(ip.String(), strconv.Itoa(r.UDP())), true, p.Time)
+	}
+	switch {
+	case added:
+		t.publish(NodeAdded, n)
+	case changed:
+		t.publish(RecordUpdated, n)
+	}
+}
+
+// SetFingerprint sets the guess of the client of the node id, if it is in
+// the table.
+func (t *Tracker) SetFingerprint(id enode.ID, f Fingerprint) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if n := t.nodes[id]; n != nil {
+		n.Fingerprint = &f
+	}
+}
+
+// MarkStale tells subscribers about the nodes not seen over the window
+// before now, once until they are seen again, and returns how many are
+// stale.
+func (t *Tracker) MarkStale(now time.Time, window time.Duration) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	since := now.Add(-window)
+	for id, n := range t.nodes {
+		if !t.stale[id] && n.LastSeen.Before(since) {
+			t.stale[id] = true
+			t.publish(NodeStale, n)
+		}
+	}
+	return len(t.stale)
+}
+
+func (n *Node) addEndpoint(addr string, advertised bool, now time.Time) {
+	for i := range n.Endpoints {
+		e := &n.Endpoints[i]
+		if e.Addr == addr && e.Advertised == advertised {
+			if now.After(e.LastSeen) {
+				e.LastSeen = now
+			}
+			return
+		}
+	}
+	if len(n.Endpoints) == maxEndpoints {
+		// Replace the stalest endpoint.
+		oldest := 0
+		for i, e := range n.Endpoints {
+			if e.LastSeen.Before(n.Endpoints[oldest].LastSeen) {
+				oldest = i
+			}
+		}
+		n.Endpoints[oldest] = Endpoint{Addr: addr, Advertised: advertised, LastSeen: now}
+		return
+	}
+	n.Endpoints = append(n.Endpoints, Endpoint{Addr: addr, Advertised: advertised, LastSeen: now})
+}
+
+func (n *Node) copy() Node {
+	c := *n
+	c.Endpoints = append([]Endpoint(nil), n.Endpoints...)
+	if n.Provenance != nil {
+		p := *n.Provenance
+		c.Provenance = &p
+	}
+	if n.Fingerprint != nil {
+		f := *n.Fingerprint
+		c.Fingerprint = &f
+	}
+	if n.Path != nil {
+		p := *n.Path
+		p.DSCP = append([]int(nil), n.Path.DSCP...)
+		p.InitialTTLs = append([]int(nil), n.Path.InitialTTLs...)
+		c.Path = &p
+	}
+	c.Packets = make(map[string]uint64, len(n.Packets))
+	for k, v := range n.Packets {
+		c.Packets[k] = v
+	}
+	return c
+}
+
+// Get returns a copy of the state of the node id.
+func (t *Tracker) Get(id enode.ID) (Node, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	n, ok := t.nodes[id]
+	if !ok {
+		return Node{}, false
+	}
+	return n.copy(), true
+}
+
+// Nodes returns copies of the limit nodes seen most recently, all of them
+// if limit is zero.
+func (t *Tracker) Nodes(limit int) []Node {
+	t.mu.RLock()
+	nodes := make([]*Node, 0, len(t.nodes))
+	for _, n := range t.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if !nodes[i].LastSeen.Equal(nodes[j].LastSeen) {
+			return nodes[i].LastSeen.After(nodes[j].LastSeen)
+		}
+		return nodes[i].ID.String() < nodes[j].ID.String()
+	})
+	if limit > 0 && len(nodes) > limit {
+		nodes = nodes[:limit]
+	}
+	out := make([]Node, len(nodes))
+	for i, n := range nodes {
+		out[i] = n.copy()
+	}
+	t.mu.RUnlock()
+	return out
+}
+
+// Len returns the number of nodes in the table.
+func (t *Tracker) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.nodes)
+}
+
+// Summary is an overview of the table.
+type Summary struct {
+	Nodes   int            `json:"nodes"`
+	Active  int            `json:"active"` // seen within the summary window
+	New     int            `json:"new"`    // first seen within the window
+	Clients map[string]int `json:"clients"`
+}
+
+// Summarize returns an overview of the table, counting nodes active over
+// the window before now.
+func (t *Tracker) Summarize(now time.Time, window time.Duration) Summary {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	s := Summary{Nodes: len(t.nodes), Clients: make(map[string]int)}
+	since := now.Add(-window)
+	for _, n := range t.nodes {
+		if n.LastSeen.After(since) {
+			s.Active++
+		}
+		if n.FirstSeen.After(since) {
+			s.New++
+		}
+		if n.Client != "" {
+			s.Clients[n.Client]++
+		}
+	}
+	return s
+}